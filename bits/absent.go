@@ -0,0 +1,76 @@
+package bits
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//AbsentBucket records when the remote confirmed that it doesn't store a
+	//chunk, such that fetching it again shortly after doesn't ask again
+	AbsentBucket = []byte("absent")
+
+	//AbsentTTL is how long a chunk that the remote doesn't store isn't asked
+	//for again, unless another period is configured with 'bits.absent-ttl'
+	AbsentTTL = time.Minute
+)
+
+//knownAbsent returns how long ago the remote confirmed that it doesn't store
+//chunk 'k' of version 'v', if that was less than 'bits.absent-ttl' ago. The
+//cache is an optimization: if the local store can't be opened the remote is
+//asked.
+func (repo *Repository) knownAbsent(v KeyVersion, k K) (ago time.Duration, ok bool) {
+	if repo.conf.AbsentTTL <= 0 {
+		return 0, false
+	}
+
+	var at time.Time
+	repo.withStore(func(store *bolt.DB) error {
+		return store.View(func(tx *bolt.Tx) error {
+			if data := tx.Bucket(AbsentBucket).Get(chunkID{v, k}.storeKey()); len(data) == 8 {
+				at = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+			}
+
+			return nil
+		})
+	})
+
+	ago = time.Since(at)
+	return ago, !at.IsZero() && ago < repo.conf.AbsentTTL
+}
+
+//recordAbsent is called when reading chunk 'k' of version 'v' from 'remote'
+//failed, if the remote confirms that it doesn't store the chunk this is
+//recorded. Remotes that can't tell and errors in asking are never cached.
+func (repo *Repository) recordAbsent(remote Remote, v KeyVersion, k K) {
+	if repo.conf.AbsentTTL <= 0 {
+		return
+	}
+
+	remotes := []Remote{remote}
+	if fr, ok := remote.(*fallbackRemote); ok {
+		remotes = append([]Remote{fr.Remote}, fr.others...)
+	}
+
+	for _, r := range remotes {
+		haser, ok := unwrapRemote(r).(chunkHaser)
+		if !ok {
+			return
+		}
+
+		has, err := haser.hasChunk(v, k)
+		if err != nil || has {
+			return
+		}
+	}
+
+	at := make([]byte, 8)
+	binary.BigEndian.PutUint64(at, uint64(time.Now().UnixNano()))
+	repo.withStore(func(store *bolt.DB) error {
+		return store.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(AbsentBucket).Put(chunkID{v, k}.storeKey(), at)
+		})
+	})
+}
@@ -0,0 +1,238 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//AccessBucket holds how often each split file in the working tree was
+	//accessed, keyed by the branch and the path of the file
+	AccessBucket = []byte("access")
+
+	//AccessFlushInterval is how often the accesses that the daemon observed
+	//are written to the local store
+	AccessFlushInterval = 5 * time.Second
+)
+
+//FileAccess is how often a split file was accessed on a branch
+type FileAccess struct {
+	Count int64     `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+//accessKey returns the key of a file on a branch in the AccessBucket
+func accessKey(branch, p string) []byte {
+	return []byte(branch + "\x00" + p)
+}
+
+//currentBranch returns the branch that is checked out, HEAD when detached
+func (repo *Repository) currentBranch() string {
+	buf := bytes.NewBuffer(nil)
+	err := repo.Git(context.Background(), nil, buf, "symbolic-ref", "--short", "-q", "HEAD")
+	if err != nil || strings.TrimSpace(buf.String()) == "" {
+		return "HEAD"
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+//RecordAccess counts an access of each of the split files at 'paths' on the
+//branch that is checked out, pulls and prefetches on that branch download
+//the files that are accessed most first
+func (repo *Repository) RecordAccess(paths ...string) (err error) {
+	counts := map[string]int64{}
+	for _, p := range paths {
+		counts[p]++
+	}
+
+	return repo.withStore(func(store *bolt.DB) error {
+		return repo.writeAccess(store, repo.currentBranch(), counts)
+	})
+}
+
+//writeAccess adds 'counts' to the accesses of files on 'branch'
+func (repo *Repository) writeAccess(store *bolt.DB, branch string, counts map[string]int64) (err error) {
+	now := time.Now().UTC()
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(AccessBucket)
+		for p, n := range counts {
+			a := FileAccess{}
+			if data := b.Get(accessKey(branch, p)); data != nil {
+				err := json.Unmarshal(data, &a)
+				if err != nil {
+					return fmt.Errorf("failed to decode access of '%s': %v", p, err)
+				}
+			}
+
+			a.Count += n
+			a.Last = now
+			data, err := json.Marshal(a)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put(accessKey(branch, p), data)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to record file access: %v", err)
+	}
+
+	return nil
+}
+
+//AccessHints returns how often the split files were accessed on 'branch'
+func (repo *Repository) AccessHints(branch string) (hints map[string]FileAccess, err error) {
+	hints = map[string]FileAccess{}
+	prefix := accessKey(branch, "")
+	err = repo.withStore(func(store *bolt.DB) error {
+		return store.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(AccessBucket).Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				a := FileAccess{}
+				err := json.Unmarshal(v, &a)
+				if err != nil {
+					return fmt.Errorf("failed to decode access of '%s': %v", k[len(prefix):], err)
+				}
+
+				hints[string(k[len(prefix):])] = a
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file access: %v", err)
+	}
+
+	return hints, nil
+}
+
+//orderByAccess orders 'paths' such that the files that were accessed most
+//on the current branch come first, most recently accessed first on a tie.
+//Other files keep their order. Without hints the order is left as is.
+func (repo *Repository) orderByAccess(paths []string) {
+	hints, err := repo.AccessHints(repo.currentBranch())
+	if err != nil {
+		fmt.Fprintf(repo.output, "%v, files are downloaded in tree order\n", err)
+		return
+	}
+
+	if len(hints) == 0 {
+		return
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		a, b := hints[paths[i]], hints[paths[j]]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+
+		return a.Last.After(b.Last)
+	})
+}
+
+//WatchAccess records the split files in the working tree that are opened
+//until the context is cancelled, such that pulls and prefetches download the
+//files that are used most first. Files that git opens while it holds the
+//index lock (e.g. for a checkout) are not counted. Opens are written to the
+//local store every AccessFlushInterval. This is currently only supported on
+//linux.
+func (repo *Repository) WatchAccess(ctx context.Context) (err error) {
+	var mu sync.Mutex
+	counts := map[string]int64{}
+	lock := filepath.Join(repo.gitDir, "index.lock")
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- repo.watchOpens(ctx, func(p string) {
+			if _, err := os.Stat(lock); err == nil {
+				return
+			}
+
+			mu.Lock()
+			counts[p]++
+			mu.Unlock()
+		})
+	}()
+
+	split := map[string]bool{}
+	head := ""
+	flush := func() error {
+		mu.Lock()
+		opened := counts
+		counts = map[string]int64{}
+		mu.Unlock()
+		if len(opened) == 0 {
+			return nil
+		}
+
+		//only split files of the commit that is checked out are counted
+		buf := bytes.NewBuffer(nil)
+		err := repo.Git(context.Background(), nil, buf, "rev-parse", "-q", "--verify", "HEAD")
+		if err != nil {
+			return nil //no commits yet
+		}
+
+		if strings.TrimSpace(buf.String()) != head {
+			paths, _, err := repo.splitFiles("HEAD")
+			if err != nil {
+				return err
+			}
+
+			split = map[string]bool{}
+			for _, p := range paths {
+				split[p] = true
+			}
+
+			head = strings.TrimSpace(buf.String())
+		}
+
+		for p := range opened {
+			if !split[p] {
+				delete(opened, p)
+			}
+		}
+
+		if len(opened) == 0 {
+			return nil
+		}
+
+		return repo.withStore(func(store *bolt.DB) error {
+			return repo.writeAccess(store, repo.currentBranch(), opened)
+		})
+	}
+
+	for {
+		select {
+		case err = <-watchErr:
+			if err != nil {
+				return err
+			}
+
+			return flush()
+		case <-time.After(AccessFlushInterval):
+			err = flush()
+			if err != nil {
+				fmt.Fprintf(repo.output, "failed to record file access: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// +build linux
+
+package bits
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+//watchOpens calls 'fn' with the path (relative to the root of the working
+//tree) of each file that is opened until the context is cancelled, using
+//inotify on each directory outside of the git directory. Directories that
+//are created later are watched as well.
+func (repo *Repository) watchOpens(ctx context.Context, fn func(p string)) (err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to setup inotify: %v", err)
+	}
+
+	//a non-blocking file is read through the runtime poller, such that
+	//closing it stops the read below
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	dirs := map[int32]string{}
+	watch := func(dir string) error {
+		return filepath.Walk(filepath.Join(repo.rootDir, dir), func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return nil //e.g. removed meanwhile
+			}
+
+			if p == repo.gitDir || fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			wd, err := syscall.InotifyAddWatch(fd, p, syscall.IN_OPEN|syscall.IN_CREATE|syscall.IN_MOVED_TO)
+			if err != nil {
+				return fmt.Errorf("failed to watch '%s': %v", p, err)
+			}
+
+			rel, _ := filepath.Rel(repo.rootDir, p)
+			dirs[int32(wd)] = filepath.ToSlash(rel)
+			return nil
+		})
+	}
+
+	err = watch("")
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read inotify events: %v", err)
+		}
+
+		//@see man 7 inotify, each event is followed by its padded name
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			for i, c := range name {
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+
+			dir, ok := dirs[ev.Wd]
+			if !ok || len(name) == 0 {
+				continue
+			}
+
+			p := string(name)
+			if dir != "." {
+				p = dir + "/" + p
+			}
+
+			switch {
+			case ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+				err = watch(p)
+				if err != nil {
+					fmt.Fprintf(repo.output, "%v\n", err)
+				}
+			case ev.Mask&syscall.IN_OPEN != 0 && ev.Mask&syscall.IN_ISDIR == 0:
+				fn(p)
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package bits
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+//watchOpens calls 'fn' with the path of each file that is opened, this is
+//currently only supported on linux
+func (repo *Repository) watchOpens(ctx context.Context, fn func(p string)) (err error) {
+	return fmt.Errorf("recording file access is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,198 @@
+package bits
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+)
+
+var (
+	//ArchiveFormats lists the formats that Archive can write
+	ArchiveFormats = []string{"tar", "zip"}
+)
+
+//archiveWriter abstracts over the formats an archive can be written in
+type archiveWriter interface {
+	WriteHeader(hdr *tar.Header) (w io.Writer, err error)
+	Close() error
+}
+
+//Archive writes an archive of the tree at 'ref' to writer 'w' in the given
+//format, it works like 'git archive' but split files hold their original
+//content; chunks that are not stored locally are fetched. Optionally a prefix
+//is prepended to each path and the archive can be limited to certain paths.
+func (repo *Repository) Archive(ref, format, prefix string, paths []string, w io.Writer) (err error) {
+	var aw archiveWriter
+	switch format {
+	case "tar":
+		aw = &tarArchiveWriter{tw: tar.NewWriter(w)}
+	case "zip":
+		aw = &zipArchiveWriter{zw: zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("unsupported archive format '%s', expected one of: %v", format, ArchiveFormats)
+	}
+
+	//git archive takes care of attributes like export-ignore and export-subst,
+	//but it would also smudge split files in a filter process that may not be
+	//able to fetch their chunks, so it passes pointers on as they are
+	args := []string{"-c", "filter.bits.required=false", "-c", "filter.bits.smudge=", "-c", "filter.bits.process=", "archive", "--format=tar"}
+	if prefix != "" {
+		args = append(args, "--prefix="+prefix)
+	}
+
+	args = append(args, ref)
+	if len(paths) > 0 {
+		args = append(args, "--")
+		args = append(args, paths...)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(repo.Git(nil, nil, pw, args...))
+	}()
+
+	defer pr.Close()
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read archive of '%s': %v", ref, err)
+		}
+
+		err = repo.archiveEntry(aw, hdr, tr)
+		if err != nil {
+			return fmt.Errorf("failed to archive '%s': %v", hdr.Name, err)
+		}
+	}
+
+	return aw.Close()
+}
+
+//archiveEntry copies a single entry to the archive writer, the content of
+//regular files that hold a pointer is replaced by the original content
+func (repo *Repository) archiveEntry(aw archiveWriter, hdr *tar.Header, r io.Reader) (err error) {
+	if hdr.Typeflag != tar.TypeReg {
+		w, err := aw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, r)
+		return err
+	}
+
+	bufr := bufio.NewReader(r)
+	peek, _ := bufr.Peek(len(repo.header))
+	if !repo.hasHeader(peek) {
+		w, err := aw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, bufr)
+		return err
+	}
+
+	data, err := ioutil.ReadAll(bufr)
+	if err != nil {
+		return fmt.Errorf("failed to read pointer: %v", err)
+	}
+
+	ptr, err := repo.ReadPointer(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse pointer: %v", err)
+	}
+
+	//the archive header needs the size of the original file up front
+	hdr.Size, err = repo.pointerSize(ptr)
+	if err != nil {
+		return fmt.Errorf("failed to determine file size: %v", err)
+	}
+
+	w, err := aw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	return repo.readPointerAt(ptr, 0, -1, w)
+}
+
+//tarArchiveWriter writes entries to a tar archive as-is
+type tarArchiveWriter struct {
+	tw *tar.Writer
+}
+
+func (aw *tarArchiveWriter) WriteHeader(hdr *tar.Header) (w io.Writer, err error) {
+	err = aw.tw.WriteHeader(hdr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write tar header: %v", err)
+	}
+
+	return aw.tw, nil
+}
+
+func (aw *tarArchiveWriter) Close() error {
+	return aw.tw.Close()
+}
+
+//zipArchiveWriter converts tar entries to zip entries, the commit id that
+//git stores in the global tar header becomes the zip comment
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (aw *zipArchiveWriter) WriteHeader(hdr *tar.Header) (w io.Writer, err error) {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		if comment, ok := hdr.PAXRecords["comment"]; ok {
+			err = aw.zw.SetComment(comment)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set zip comment: %v", err)
+			}
+		}
+
+		return ioutil.Discard, nil
+	}
+
+	zhdr, err := zip.FileInfoHeader(hdr.FileInfo())
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert header: %v", err)
+	}
+
+	zhdr.Name = hdr.Name
+	zhdr.Modified = hdr.ModTime
+	if hdr.Typeflag == tar.TypeDir {
+		zhdr.Name = path.Clean(hdr.Name) + "/"
+	} else {
+		zhdr.Method = zip.Deflate
+	}
+
+	w, err = aw.zw.CreateHeader(zhdr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write zip header: %v", err)
+	}
+
+	//symlinks are stored as the link target in zip archives
+	if hdr.Typeflag == tar.TypeSymlink {
+		_, err = io.WriteString(w, hdr.Linkname)
+		if err != nil {
+			return nil, err
+		}
+
+		return ioutil.Discard, nil
+	}
+
+	return w, nil
+}
+
+func (aw *zipArchiveWriter) Close() error {
+	return aw.zw.Close()
+}
@@ -0,0 +1,182 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	//AuditPrefix is where audit logs are stored in the bucket, each flush
+	//writes a new object such that existing logs are never modified
+	AuditPrefix = ".audit/"
+
+	//AuditBatchSize is how many entries are kept before they are written,
+	//entries are also written when an operation completes
+	AuditBatchSize = 1000
+)
+
+//AuditEntry records that a chunk was pushed or fetched, by whom and when
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Host   string    `json:"host"`
+	Op     string    `json:"op"`
+	Key    string    `json:"key"`
+	Bytes  int64     `json:"bytes"`
+	Source string    `json:"source,omitempty"`
+}
+
+//auditWriter is implemented by remotes that can store audit logs next to
+//the chunks. Logs are never overwritten.
+type auditWriter interface {
+	writeAuditLog(name string, data []byte) error
+}
+
+//auditing returns whether chunk operations are recorded
+func (repo *Repository) auditing() bool {
+	return repo.conf.AuditLog != "" || repo.conf.AuditRemote
+}
+
+//auditUser returns who operations are recorded for: the email configured
+//in git, else the name or the user of the process
+func (repo *Repository) auditUser() string {
+	repo.auditOnce.Do(func() {
+		for _, key := range []string{"user.email", "user.name"} {
+			buf := bytes.NewBuffer(nil)
+			err := repo.Git(context.Background(), nil, buf, "config", key)
+			if err == nil && strings.TrimSpace(buf.String()) != "" {
+				repo.auditWho = strings.TrimSpace(buf.String())
+				return
+			}
+		}
+
+		repo.auditWho = os.Getenv("USER")
+	})
+
+	return repo.auditWho
+}
+
+//audit records that chunk 'k' of 'n' bytes was pushed or fetched ('op')
+func (repo *Repository) audit(op string, k K, n int64, source string) {
+	if !repo.auditing() {
+		return
+	}
+
+	host, _ := os.Hostname()
+	e := AuditEntry{
+		Time:   time.Now().UTC(),
+		User:   repo.auditUser(),
+		Host:   host,
+		Op:     op,
+		Key:    fmt.Sprintf("%x", k),
+		Bytes:  n,
+		Source: source,
+	}
+
+	repo.auditMu.Lock()
+	repo.auditPending = append(repo.auditPending, e)
+	full := len(repo.auditPending) >= AuditBatchSize
+	repo.auditMu.Unlock()
+	if full {
+		err := repo.writeAudit()
+		if err != nil {
+			fmt.Fprintf(repo.output, "%v\n", err)
+		}
+	}
+}
+
+//flushAudit writes the recorded entries when an operation completes, an
+//error writing them is returned unless the operation failed already. It
+//is deferred as: defer repo.flushAudit(&err)
+func (repo *Repository) flushAudit(err *error) {
+	ferr := repo.writeAudit()
+	if ferr == nil {
+		return
+	}
+
+	if *err == nil {
+		*err = ferr
+		return
+	}
+
+	fmt.Fprintf(repo.output, "%v\n", ferr)
+}
+
+//writeAudit appends the recorded entries to the local audit log and writes
+//them as a new object to the remote, as configured
+func (repo *Repository) writeAudit() (err error) {
+	repo.auditMu.Lock()
+	entries := repo.auditPending
+	repo.auditPending = nil
+	repo.auditMu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit entry: %v", err)
+		}
+	}
+
+	if repo.conf.AuditLog != "" {
+		p := repo.conf.AuditLog
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(repo.gitDir, p)
+		}
+
+		//entries are written at once such that concurrent (smudge) processes
+		//don't interleave them
+		f, err := repo.openFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log '%s': %v", p, err)
+		}
+
+		_, err = f.Write(buf.Bytes())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to write audit log '%s': %v", p, err)
+		}
+	}
+
+	if repo.conf.AuditRemote {
+		aw, ok := unwrapRemote(repo.currentRemote()).(auditWriter)
+		if !ok {
+			return fmt.Errorf("failed to write audit log: the remote doesn't store audit logs")
+		}
+
+		err = aw.writeAuditLog(auditLogName(entries[0]), buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to write audit log to the remote: %v", err)
+		}
+	}
+
+	return nil
+}
+
+//auditLogName returns a unique name for the log that starts with 'first',
+//logs are grouped by day and sort by time
+func auditLogName(first AuditEntry) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s%s/%s-%s-%x.jsonl",
+		AuditPrefix,
+		first.Time.Format("2006/01/02"),
+		first.Time.Format("20060102T150405.000000000Z"),
+		dnsLabel(first.Host),
+		suffix,
+	)
+}
@@ -0,0 +1,209 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	//ClonePhases names the phases that BenchClone measures, in the order
+	//they run
+	ClonePhases = []string{"clone", "list", "fetch", "combine", "write"}
+)
+
+//BenchResult is the outcome of a single benchmark run
+type BenchResult struct {
+	Name        string
+	Concurrency int
+	Bytes       int64
+	Items       int
+	Duration    time.Duration
+}
+
+func (res BenchResult) String() string {
+	if res.Bytes > 0 {
+		return fmt.Sprintf("%s (%d workers): %d chunks, %s", res.Name, res.Concurrency, res.Items, formatThroughput(int(res.Bytes), res.Duration))
+	}
+
+	return fmt.Sprintf("%s: %d chunks in %s", res.Name, res.Items, res.Duration.Round(time.Millisecond))
+}
+
+//BenchContent returns 'size' bytes of pseudo-random content, the same seed
+//gives the same content such that runs can be compared
+func BenchContent(size int64, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+//BenchSplit runs the split pipeline on 'data' with 'concurrency' workers,
+//chunks are hashed but not stored such that only the chunker and hashing
+//are measured
+func (repo *Repository) BenchSplit(data []byte, concurrency int) (res BenchResult, err error) {
+	if repo.conf.DeduplicationScope == 0 {
+		return res, fmt.Errorf("no deduplication scope configured, please run init")
+	}
+
+	prev := SplitConcurrency
+	SplitConcurrency = concurrency
+	defer func() { SplitConcurrency = prev }()
+
+	res = BenchResult{Name: "split", Concurrency: concurrency, Bytes: int64(len(data))}
+	start := time.Now()
+	err = repo.splitChunks(bytes.NewReader(data), false, func(k K, size int64) error {
+		res.Items++
+		return nil
+	})
+
+	res.Duration = time.Since(start)
+	if err != nil {
+		return res, fmt.Errorf("failed to split: %v", err)
+	}
+
+	return res, nil
+}
+
+//BenchListChunks lists the chunks of the remote
+func (repo *Repository) BenchListChunks() (res BenchResult, err error) {
+	if repo.currentRemote() == nil {
+		return res, withKind(ConfigError, fmt.Errorf("no remote configured, run 'git bits install' to configure one"))
+	}
+
+	res = BenchResult{Name: "list"}
+	lc := &lineCounter{}
+	start := time.Now()
+	err = repo.currentRemote().ListChunks(lc)
+	res.Duration = time.Since(start)
+	res.Items = lc.n
+	if err != nil {
+		return res, withKind(NetworkError, fmt.Errorf("failed to list chunks: %v", err))
+	}
+
+	return res, nil
+}
+
+//ClonePhase is how long a single phase of cloning took
+type ClonePhase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+//CloneBenchResult is the outcome of benchmarking a clone end-to-end
+type CloneBenchResult struct {
+	URL      string        `json:"url"`
+	Files    int           `json:"files"`
+	Chunks   int           `json:"chunks"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	Phases   []ClonePhase  `json:"phases"`
+}
+
+//BenchClone clones the git repository at 'gitURL' into 'dir' as
+//CloneAndMaterialize does and measures how long each of ClonePhases takes:
+//cloning and installing, listing the chunks of the split files in HEAD,
+//fetching them, combining each file in memory and writing it to the
+//working tree. Phases run one after the other such that their durations
+//add up, files are synced after they are written such that writing isn't
+//measured against the page cache only.
+func BenchClone(ctx context.Context, gitURL, dir string, conf *Conf) (res CloneBenchResult, err error) {
+	res = CloneBenchResult{URL: gitURL, Phases: []ClonePhase{}}
+	start := time.Now()
+	phase := func(name string, since time.Time) {
+		res.Phases = append(res.Phases, ClonePhase{Name: name, Duration: time.Since(since)})
+	}
+
+	defer func() { res.Duration = time.Since(start) }()
+	repo, err := CloneAndMaterialize(ctx, gitURL, dir, conf)
+	if err != nil {
+		return res, err
+	}
+
+	defer repo.Close()
+	phase("clone", start)
+
+	t := time.Now()
+	paths := []string{}
+	ptrs := map[string]*Pointer{}
+	keys := bytes.NewBuffer(nil)
+	seen := map[K]bool{}
+	err = repo.ForEachPointer("HEAD", nil, func(p string, ptr *Pointer) error {
+		paths = append(paths, p)
+		ptrs[p] = ptr
+		for _, c := range ptr.Chunks {
+			if !seen[c.K] {
+				seen[c.K] = true
+				fmt.Fprintf(keys, "%x\n", c.K)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return res, fmt.Errorf("failed to list the chunks of HEAD: %v", err)
+	}
+
+	res.Files, res.Chunks = len(paths), len(seen)
+	phase("list", t)
+
+	t = time.Now()
+	err = repo.Fetch(keys, ioutil.Discard)
+	if err != nil {
+		return res, fmt.Errorf("failed to fetch: %v", err)
+	}
+
+	phase("fetch", t)
+
+	//each file is combined in memory first such that writing it is
+	//measured on its own
+	var combining, writing time.Duration
+	buf := bytes.NewBuffer(nil)
+	for _, p := range paths {
+		if err = ctx.Err(); err != nil {
+			return res, err
+		}
+
+		buf.Reset()
+		t = time.Now()
+		err = repo.readPointerAtWith(ptrs[p], 0, -1, buf, func(PointerChunk) error { return nil })
+		if err != nil {
+			return res, fmt.Errorf("failed to combine '%s': %v", p, err)
+		}
+
+		combining += time.Since(t)
+		res.Bytes += int64(buf.Len())
+
+		t = time.Now()
+		err = writeSynced(filepath.Join(repo.rootDir, filepath.FromSlash(p)), buf.Bytes())
+		if err != nil {
+			return res, fmt.Errorf("failed to write '%s': %v", p, err)
+		}
+
+		writing += time.Since(t)
+	}
+
+	res.Phases = append(res.Phases, ClonePhase{"combine", combining}, ClonePhase{"write", writing})
+	return res, nil
+}
+
+//writeSynced replaces the content of file 'p' with 'data' and syncs it
+func writeSynced(p string, data []byte) (err error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
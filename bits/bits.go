@@ -1,7 +1,11 @@
 package bits
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"io"
+
+	"github.com/zeebo/blake3"
 )
 
 //KeySize describes the size of each chunk ley
@@ -21,6 +25,17 @@ type KeyOp struct {
 	CopyN   int64 //if any bytes were copied in the operation, its recorded here
 }
 
+//PullProgress describes how far a pull is, it is reported after each split
+//file is pulled
+type PullProgress struct {
+	Path       string //the file that was pulled
+	File       int    //how many files were pulled, including this one
+	Files      int    //how many split files are pulled in total
+	FileBytes  int64  //how many bytes were downloaded for this file
+	Bytes      int64  //how many bytes were downloaded so far
+	TotalBytes int64  //how many bytes are downloaded in total
+}
+
 var (
 	//PushOp tells a chunk was/is pushed to a remote
 	PushOp = Op("push")
@@ -40,9 +55,84 @@ var (
 //a (cryptographic) hash of plain-text chunk content
 type K [KeySize]byte
 
+//KeyHash identifies the algorithm that chunk keys are computed with, it is
+//recorded in pointers by its number
+type KeyHash int
+
+const (
+	//SHA256 is the default key hash
+	SHA256 KeyHash = iota
+
+	//BLAKE3 is considerably faster than SHA256 on most hardware
+	BLAKE3
+)
+
+//keyHashNames are the names by which key hashes are configured
+var keyHashNames = map[KeyHash]string{
+	SHA256: "sha256",
+	BLAKE3: "blake3",
+}
+
+//KeyHashes returns all key hashes that are supported, in the order of their
+//numbers
+func KeyHashes() (hashes []KeyHash) {
+	for h := KeyHash(0); int(h) < len(keyHashNames); h++ {
+		hashes = append(hashes, h)
+	}
+
+	return hashes
+}
+
+//ParseKeyHash returns the key hash with the given name
+func ParseKeyHash(name string) (h KeyHash, err error) {
+	for h, n := range keyHashNames {
+		if n == name {
+			return h, nil
+		}
+	}
+
+	return SHA256, fmt.Errorf("unknown key hash '%s', expected 'sha256' or 'blake3'", name)
+}
+
+func (h KeyHash) String() string {
+	if n, ok := keyHashNames[h]; ok {
+		return n
+	}
+
+	return fmt.Sprintf("unknown(%d)", int(h))
+}
+
+//Sum computes the key of plain-text chunk 'data'
+func (h KeyHash) Sum(data []byte) K {
+	if h == BLAKE3 {
+		return blake3.Sum256(data)
+	}
+
+	return sha256.Sum256(data)
+}
+
+//RemoteBackends names the kinds of remotes that chunks can be stored on:
+//an S3 bucket or a 'git bits serve-grpc' chunk service
+var RemoteBackends = []string{"s3", "grpc"}
+
 //Remote describes a method for streaming chunk information
 type Remote interface {
 	ChunkReader(k K) (rc io.ReadCloser, err error)
 	ChunkWriter(k K) (wc io.WriteCloser, err error)
 	ListChunks(w io.Writer) (err error)
+
+	//DeleteChunks removes the chunks, chunks that aren't stored are ignored
+	DeleteChunks(ks []K) (err error)
+}
+
+//chunkHaser is implemented by remotes that can tell whether they store a
+//chunk without reading it
+type chunkHaser interface {
+	hasChunk(v KeyVersion, k K) (ok bool, err error)
+}
+
+//chunkRangeReader is implemented by remotes that can read a chunk starting
+//at an offset, such that interrupted downloads can be resumed
+type chunkRangeReader interface {
+	chunkReaderFrom(k K, off int64) (rc io.ReadCloser, err error)
 }
@@ -0,0 +1,142 @@
+//Package bitstest provides helpers for testing programs that use git-bits
+//with real git repositories on the local filesystem
+package bitstest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+//GitInitRemote creates a bare repository in a temporary directory that can
+//be cloned and pushed to
+func GitInitRemote(t testing.TB) (dir string) {
+	dir, err := ioutil.TempDir("", "test_remote_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "init", "--bare")
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+//GitCloneWorkspace clones the remote into a temporary directory and opens
+//it as a git-bits repository
+func GitCloneWorkspace(remote string, t testing.TB) (dir string, repo *bits.Repository) {
+	dir, err := ioutil.TempDir("", "test_remote_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "clone", remote, dir)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err = bits.NewRepository(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, repo
+}
+
+//GitConfigure sets local git configuration of the repository
+func GitConfigure(t testing.TB, ctx context.Context, repo *bits.Repository, conf map[string]string) {
+	for k, val := range conf {
+		err := repo.Git(ctx, nil, nil, "config", "--local", k, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//GitCommit commits all changes in the working tree and returns the commit
+func GitCommit(t testing.TB, ctx context.Context, repo *bits.Repository, msg string) (commit string) {
+	err := repo.Git(ctx, nil, nil, "add", "-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.Git(ctx, nil, nil, "commit", "-m", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(ctx, nil, buf, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+//WriteGitAttrFile writes a .gitattributes file to the directory with the
+//given attributes per pattern, e.g. "*.bin": "filter=bits"
+func WriteGitAttrFile(t testing.TB, dir string, attr map[string]string) {
+	f, err := os.Create(filepath.Join(dir, ".gitattributes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	for pattern, attr := range attr {
+		fmt.Fprintf(f, "%s\t%s\n", pattern, attr)
+	}
+}
+
+//BuildBinaryInPath builds git-bits into $GOPATH/bin, the filters and hooks
+//that git runs need it in the PATH
+func BuildBinaryInPath(t testing.TB, ctx context.Context) {
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		t.Fatalf("GOPATH not set for building git-bits for integration test, env: %+v", os.Environ())
+	}
+
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", filepath.Join(gopath, "bin", "git-bits"))
+	cmd.Dir = filepath.Join(gopath, "src", "github.com", "nerdalize", "git-bits")
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		t.Fatalf("failed to build git-bits, make sure this project is in $GOPATH/src/github.com/nerdalize/git-bits: %v", err)
+	}
+}
+
+//WriteRandomFile creates a file of 'size' random bytes, random content
+//doesn't deduplicate such that split files have chunks of their own. The
+//caller closes the returned file.
+func WriteRandomFile(t testing.TB, path string, size int64) (f *os.File) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	randr := io.LimitReader(rand.Reader, size)
+	_, err = io.Copy(f, randr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
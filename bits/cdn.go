@@ -0,0 +1,119 @@
+package bits
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	//CDNURLExpiry determines how long signed cdn urls remain valid
+	CDNURLExpiry = time.Hour
+)
+
+//cdnEncoding is the url safe base64 variant cloudfront expects in signatures
+var cdnEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+//CDN fetches chunks from a content delivery network (e.g. CloudFront) in
+//front of the bucket using urls that are signed with a key pair, such that
+//chunks are read from an edge location close by
+type CDN struct {
+	base      *url.URL
+	keyPairID string
+	key       *rsa.PrivateKey
+	client    *http.Client
+}
+
+//NewCDN sets up fetching from the cdn at 'base', urls are signed with the
+//rsa private key in pem file 'keyFile' that belongs to key pair 'keyPairID'
+func NewCDN(base, keyPairID, keyFile string, client *http.Client) (cdn *CDN, err error) {
+	cdn = &CDN{keyPairID: keyPairID, client: client}
+	cdn.base, err = url.Parse(strings.TrimSuffix(base, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cdn url '%s': %v", base, err)
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cdn private key '%s': %v", keyFile, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem encoded private key found in '%s'", keyFile)
+	}
+
+	cdn.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		key, perr := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if perr != nil {
+			return nil, fmt.Errorf("failed to parse cdn private key '%s': %v", keyFile, err)
+		}
+
+		var ok bool
+		cdn.key, ok = key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("cdn private key '%s' is not an rsa key", keyFile)
+		}
+	}
+
+	return cdn, nil
+}
+
+//SignURL returns the url of 'p' signed with a canned policy that expires
+//at 'expires'
+//@see http://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/private-content-creating-signed-url-canned-policy.html
+func (cdn *CDN) SignURL(p string, expires time.Time) (loc string, err error) {
+	resource := cdn.base.String() + "/" + strings.TrimPrefix(p, "/")
+
+	//cloudfront reconstructs canned policies, so the format must match exactly
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, resource, expires.Unix())
+	sum := sha1.Sum([]byte(policy))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, cdn.key, crypto.SHA1, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign policy: %v", err)
+	}
+
+	q := url.Values{}
+	q.Set("Expires", fmt.Sprintf("%d", expires.Unix()))
+	q.Set("Signature", cdnEncoding.Replace(base64.StdEncoding.EncodeToString(sig)))
+	q.Set("Key-Pair-Id", cdn.keyPairID)
+	return resource + "?" + q.Encode(), nil
+}
+
+//ChunkReader returns the content of the chunk with the given key, as it is
+//named in a bucket that isn't sharded
+func (cdn *CDN) ChunkReader(k K) (rc io.ReadCloser, err error) {
+	return cdn.objectReader(ChunkObjectName(KeyVersion0, k, 0))
+}
+
+//objectReader returns the content of the object with the given name
+func (cdn *CDN) objectReader(name string) (rc io.ReadCloser, err error) {
+	loc, err := cdn.SignURL(name, time.Now().Add(CDNURLExpiry))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cdn.client.Get(loc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request chunk from cdn: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response from cdn: %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
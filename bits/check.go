@@ -0,0 +1,125 @@
+package bits
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	//CheckProbeSize is the size of the throwaway chunk that is used to check
+	//whether chunks can be written to and read from the remote
+	CheckProbeSize = 1024 * 1024
+)
+
+//CheckRemote verifies that the remote can be used by listing its chunks and
+//writing, reading and deleting a throwaway probe chunk. The outcome and
+//timing of each step is written to 'w' such that misconfiguration can be
+//caught before a long push. The first step that fails ends the check.
+func (repo *Repository) CheckRemote(w io.Writer) (err error) {
+	if repo.currentRemote() == nil {
+		return withKind(ConfigError, fmt.Errorf("no remote configured, run 'git bits install' to configure one"))
+	}
+
+	//steps fail because the remote can't be reached or refuses them
+	defer func() { err = withKind(NetworkError, err) }()
+
+	//listing checks the credentials and whether the bucket exists
+	start := time.Now()
+	lc := &lineCounter{}
+	err = repo.currentRemote().ListChunks(lc)
+	if err != nil {
+		return fmt.Errorf("failed to list chunks, check the bucket name and whether the credentials allow listing: %v", err)
+	}
+
+	fmt.Fprintf(w, "list:   ok, %d chunks in %s\n", lc.n, time.Since(start).Round(time.Millisecond))
+	if repo.conf.ReadOnly {
+		fmt.Fprintf(w, "put:    skipped, the repository is read-only\n")
+		return nil
+	}
+
+	//the probe uses a random key that no real chunk will ever have
+	probe := make([]byte, CheckProbeSize)
+	_, err = rand.Read(probe)
+	if err != nil {
+		return fmt.Errorf("failed to generate probe content: %v", err)
+	}
+
+	k := K{}
+	_, err = rand.Read(k[:])
+	if err != nil {
+		return fmt.Errorf("failed to generate probe key: %v", err)
+	}
+
+	//the probe is stored under the names that pushes use
+	start = time.Now()
+	wc, err := remoteChunkWriter(repo.currentRemote(), CurrentKeyVersion, k)
+	if err != nil {
+		return fmt.Errorf("failed to write probe chunk '%x', check whether the credentials allow writing: %v", k, err)
+	}
+
+	_, err = wc.Write(probe)
+	if err == nil {
+		err = wc.Close()
+	} else {
+		wc.Close()
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write probe chunk '%x', check whether the credentials allow writing: %v", k, err)
+	}
+
+	fmt.Fprintf(w, "put:    ok, %s\n", formatThroughput(len(probe), time.Since(start)))
+
+	start = time.Now()
+	rc, err := remoteChunkReader(repo.currentRemote(), CurrentKeyVersion, k)
+	if err != nil {
+		return fmt.Errorf("failed to read probe chunk '%x', check whether the credentials allow reading: %v", k, err)
+	}
+
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read probe chunk '%x', check whether the credentials allow reading: %v", k, err)
+	}
+
+	if !bytes.Equal(data, probe) {
+		return withKind(VerificationError, fmt.Errorf("probe chunk '%x' read back with different content (%d of %d bytes)", k, len(data), len(probe)))
+	}
+
+	fmt.Fprintf(w, "get:    ok, %s\n", formatThroughput(len(data), time.Since(start)))
+
+	start = time.Now()
+	err = remoteDeleteChunks(repo.currentRemote(), CurrentKeyVersion, []K{k})
+	if err == ErrDeleteNotSupported {
+		fmt.Fprintf(w, "delete: skipped, the remote doesn't support deleting the probe chunk '%x'\n", k)
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to delete probe chunk '%x', check whether the credentials allow deleting: %v", k, err)
+	}
+
+	fmt.Fprintf(w, "delete: ok, in %s\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+//formatThroughput describes the transfer of 'n' bytes in duration 'd'
+func formatThroughput(n int, d time.Duration) string {
+	return fmt.Sprintf("%s in %s (%s/s)", humanize.Bytes(uint64(n)), d.Round(time.Millisecond), humanize.Bytes(uint64(float64(n)/d.Seconds())))
+}
+
+//lineCounter counts the lines written to it
+type lineCounter struct {
+	n int
+}
+
+func (lc *lineCounter) Write(p []byte) (n int, err error) {
+	lc.n += bytes.Count(p, []byte("\n"))
+	return len(p), nil
+}
@@ -0,0 +1,91 @@
+package bits
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+//ChunkHook inspects the plain-text content of chunk 'k' on 'r' before it is
+//pushed (PushOp) or after it is fetched but before it is stored locally
+//(FetchOp), e.g. to scan it for viruses or for data that must not leave
+//the machine. Returning an error refuses the chunk.
+type ChunkHook func(op Op, k K, r io.Reader) error
+
+//decryptReader returns a reader of the plain-text content of encrypted
+//chunk 'k' of version 'v' that is read from 'r'
+func decryptReader(v KeyVersion, k K, r io.Reader) (pr io.Reader, err error) {
+	stream, err := v.stream(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cipher.StreamReader{S: stream, R: r}, nil
+}
+
+//inspectChunk hands the plain-text content of encrypted chunk 'k' of
+//version 'v' that is read with 'open' to the ChunkHook and to the command
+//that is configured for the operation ('bits.push-hook' or
+//'bits.fetch-hook'). If either refuses the chunk a VerificationError is
+//returned.
+func (repo *Repository) inspectChunk(op Op, v KeyVersion, k K, open func() (io.ReadCloser, error)) (err error) {
+	command := repo.conf.PushHook
+	if op == FetchOp {
+		command = repo.conf.FetchHook
+	}
+
+	hooks := []ChunkHook{}
+	if repo.ChunkHook != nil {
+		hooks = append(hooks, repo.ChunkHook)
+	}
+
+	if command != "" {
+		hooks = append(hooks, func(op Op, k K, r io.Reader) error {
+			return runChunkHook(command, op, k, r)
+		})
+	}
+
+	for _, hook := range hooks {
+		rc, err := open()
+		if err != nil {
+			return fmt.Errorf("failed to open chunk '%x' for inspection: %v", k, err)
+		}
+
+		pr, err := decryptReader(v, k, rc)
+		if err == nil {
+			err = hook(op, k, pr)
+			if err != nil {
+				err = withKind(VerificationError, fmt.Errorf("chunk '%x' was refused by the %s hook: %v", k, op, err))
+			}
+		}
+
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//runChunkHook runs 'command' with the shell, the plain-text content of the
+//chunk on its stdin and its key and the operation in the environment
+//(GIT_BITS_CHUNK and GIT_BITS_OP). A non-zero exit refuses the chunk, what
+//it writes to stderr is part of the error.
+func runChunkHook(command string, op Op, k K, r io.Reader) (err error) {
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_BITS_CHUNK=%x", k), fmt.Sprintf("GIT_BITS_OP=%s", op))
+	cmd.Stdin = r
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("'%s' failed: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,324 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: chunks.proto
+
+// Chunk storage that git-bits can use as its remote, such that chunks can be
+// stored behind a service that authenticates clients in its own way.
+
+package chunkpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Chunks_Get_FullMethodName  = "/gitbits.chunks.v1.Chunks/Get"
+	Chunks_Put_FullMethodName  = "/gitbits.chunks.v1.Chunks/Put"
+	Chunks_List_FullMethodName = "/gitbits.chunks.v1.Chunks/List"
+	Chunks_Has_FullMethodName  = "/gitbits.chunks.v1.Chunks/Has"
+)
+
+// ChunksClient is the client API for Chunks service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChunksClient interface {
+	// Get streams the (encrypted) content of a chunk, starting at an offset
+	// such that interrupted downloads can be resumed
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (Chunks_GetClient, error)
+	// Put stores a chunk, the first message holds its key and each message a
+	// part of its content. The chunk is stored once the stream completes.
+	Put(ctx context.Context, opts ...grpc.CallOption) (Chunks_PutClient, error)
+	// List streams the keys of all stored chunks
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Chunks_ListClient, error)
+	// Has returns whether a chunk is stored
+	Has(ctx context.Context, in *HasRequest, opts ...grpc.CallOption) (*HasResponse, error)
+}
+
+type chunksClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChunksClient(cc grpc.ClientConnInterface) ChunksClient {
+	return &chunksClient{cc}
+}
+
+func (c *chunksClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (Chunks_GetClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Chunks_ServiceDesc.Streams[0], Chunks_Get_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &chunksGetClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Chunks_GetClient interface {
+	Recv() (*ChunkData, error)
+	grpc.ClientStream
+}
+
+type chunksGetClient struct {
+	grpc.ClientStream
+}
+
+func (x *chunksGetClient) Recv() (*ChunkData, error) {
+	m := new(ChunkData)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *chunksClient) Put(ctx context.Context, opts ...grpc.CallOption) (Chunks_PutClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Chunks_ServiceDesc.Streams[1], Chunks_Put_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &chunksPutClient{stream}
+	return x, nil
+}
+
+type Chunks_PutClient interface {
+	Send(*PutRequest) error
+	CloseAndRecv() (*PutResponse, error)
+	grpc.ClientStream
+}
+
+type chunksPutClient struct {
+	grpc.ClientStream
+}
+
+func (x *chunksPutClient) Send(m *PutRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *chunksPutClient) CloseAndRecv() (*PutResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PutResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *chunksClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Chunks_ListClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Chunks_ServiceDesc.Streams[2], Chunks_List_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &chunksListClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Chunks_ListClient interface {
+	Recv() (*ListResponse, error)
+	grpc.ClientStream
+}
+
+type chunksListClient struct {
+	grpc.ClientStream
+}
+
+func (x *chunksListClient) Recv() (*ListResponse, error) {
+	m := new(ListResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *chunksClient) Has(ctx context.Context, in *HasRequest, opts ...grpc.CallOption) (*HasResponse, error) {
+	out := new(HasResponse)
+	err := c.cc.Invoke(ctx, Chunks_Has_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ChunksServer is the server API for Chunks service.
+// All implementations must embed UnimplementedChunksServer
+// for forward compatibility
+type ChunksServer interface {
+	// Get streams the (encrypted) content of a chunk, starting at an offset
+	// such that interrupted downloads can be resumed
+	Get(*GetRequest, Chunks_GetServer) error
+	// Put stores a chunk, the first message holds its key and each message a
+	// part of its content. The chunk is stored once the stream completes.
+	Put(Chunks_PutServer) error
+	// List streams the keys of all stored chunks
+	List(*ListRequest, Chunks_ListServer) error
+	// Has returns whether a chunk is stored
+	Has(context.Context, *HasRequest) (*HasResponse, error)
+	mustEmbedUnimplementedChunksServer()
+}
+
+// UnimplementedChunksServer must be embedded to have forward compatible implementations.
+type UnimplementedChunksServer struct {
+}
+
+func (UnimplementedChunksServer) Get(*GetRequest, Chunks_GetServer) error {
+	return status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedChunksServer) Put(Chunks_PutServer) error {
+	return status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedChunksServer) List(*ListRequest, Chunks_ListServer) error {
+	return status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedChunksServer) Has(context.Context, *HasRequest) (*HasResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Has not implemented")
+}
+func (UnimplementedChunksServer) mustEmbedUnimplementedChunksServer() {}
+
+// UnsafeChunksServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChunksServer will
+// result in compilation errors.
+type UnsafeChunksServer interface {
+	mustEmbedUnimplementedChunksServer()
+}
+
+func RegisterChunksServer(s grpc.ServiceRegistrar, srv ChunksServer) {
+	s.RegisterService(&Chunks_ServiceDesc, srv)
+}
+
+func _Chunks_Get_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChunksServer).Get(m, &chunksGetServer{stream})
+}
+
+type Chunks_GetServer interface {
+	Send(*ChunkData) error
+	grpc.ServerStream
+}
+
+type chunksGetServer struct {
+	grpc.ServerStream
+}
+
+func (x *chunksGetServer) Send(m *ChunkData) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Chunks_Put_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ChunksServer).Put(&chunksPutServer{stream})
+}
+
+type Chunks_PutServer interface {
+	SendAndClose(*PutResponse) error
+	Recv() (*PutRequest, error)
+	grpc.ServerStream
+}
+
+type chunksPutServer struct {
+	grpc.ServerStream
+}
+
+func (x *chunksPutServer) SendAndClose(m *PutResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *chunksPutServer) Recv() (*PutRequest, error) {
+	m := new(PutRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Chunks_List_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChunksServer).List(m, &chunksListServer{stream})
+}
+
+type Chunks_ListServer interface {
+	Send(*ListResponse) error
+	grpc.ServerStream
+}
+
+type chunksListServer struct {
+	grpc.ServerStream
+}
+
+func (x *chunksListServer) Send(m *ListResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Chunks_Has_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HasRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChunksServer).Has(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Chunks_Has_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChunksServer).Has(ctx, req.(*HasRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Chunks_ServiceDesc is the grpc.ServiceDesc for Chunks service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Chunks_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gitbits.chunks.v1.Chunks",
+	HandlerType: (*ChunksServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Has",
+			Handler:    _Chunks_Has_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Get",
+			Handler:       _Chunks_Get_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Put",
+			Handler:       _Chunks_Put_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "List",
+			Handler:       _Chunks_List_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "chunks.proto",
+}
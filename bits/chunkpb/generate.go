@@ -0,0 +1,5 @@
+//Package chunkpb holds the generated protobuf messages and grpc stubs of the
+//chunk service that git-bits can use as its remote
+package chunkpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chunks.proto
@@ -0,0 +1,220 @@
+package bits
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	//CIReportFormats lists the formats that WriteCIReport can write
+	CIReportFormats = []string{"text", "json", "junit"}
+
+	//CIChecks names the checks that are run for each split file: whether it
+	//can be reconstructed from local and remote chunks and whether all of
+	//its chunks are pushed to the remote
+	CIChecks = []string{"reconstructible", "pushed"}
+)
+
+//CIResult is the outcome of a single check for a single split file
+type CIResult struct {
+
+	//name of the check, one of CIChecks
+	Check string `json:"check"`
+
+	//path of the split file in the tree of the ref
+	Path string `json:"path"`
+
+	//number of chunks the file is made of
+	Chunks int `json:"chunks"`
+
+	//number of chunks that fail the check
+	Failed int `json:"failed"`
+
+	//explains why the check failed, empty if it passed
+	Message string `json:"message,omitempty"`
+}
+
+//Passed returns whether the file passed the check
+func (r CIResult) Passed() bool {
+	return r.Failed == 0
+}
+
+//CIReport holds the outcome of every check for every split file of a ref
+type CIReport struct {
+	Ref      string        `json:"ref"`
+	Passed   bool          `json:"passed"`
+	Failures int           `json:"failures"`
+	Duration time.Duration `json:"duration_ns"`
+	Results  []CIResult    `json:"results"`
+}
+
+//CICheck checks that every split file in the tree of 'ref' can be
+//reconstructed and that all of its chunks are stored remotely, such that
+//pipelines can refuse merges of which large files would be unavailable to
+//others. Like VerifyRef it only checks whether chunks exist. Failed checks
+//are part of the report, an error is only returned if checking failed.
+func (repo *Repository) CICheck(ref string) (report CIReport, err error) {
+	_, end := repo.trace(context.Background(), "ci-check", SpanAttr{"ref", ref})
+	defer end(&err)
+	start := time.Now()
+	report.Ref = ref
+	report.Results = []CIResult{}
+	if repo.currentRemote() == nil {
+		return report, withKind(ConfigError, fmt.Errorf("no remote configured, run 'git bits install' to configure one"))
+	}
+
+	files, keys, err := repo.refChunks(ref)
+	if err != nil {
+		return report, err
+	}
+
+	local := map[K]bool{}
+	for _, k := range keys {
+		local[k], err = repo.localChunk(k)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	//every chunk must be stored remotely, also those that are stored locally
+	remote, err := repo.remoteStores(keys)
+	if err != nil {
+		return report, withKind(NetworkError, err)
+	}
+
+	for _, p := range sortedPaths(files) {
+		reconstructible := CIResult{Check: CIChecks[0], Path: p, Chunks: len(files[p])}
+		pushed := CIResult{Check: CIChecks[1], Path: p, Chunks: len(files[p])}
+		for _, k := range files[p] {
+			if !remote[k] {
+				pushed.Failed++
+				if !local[k] {
+					reconstructible.Failed++
+				}
+			}
+		}
+
+		if !reconstructible.Passed() {
+			reconstructible.Message = fmt.Sprintf("%d of %d chunks are stored neither locally nor remotely", reconstructible.Failed, reconstructible.Chunks)
+		}
+
+		if !pushed.Passed() {
+			pushed.Message = fmt.Sprintf("%d of %d chunks are not stored remotely, push them with 'git bits push'", pushed.Failed, pushed.Chunks)
+		}
+
+		report.Results = append(report.Results, reconstructible, pushed)
+	}
+
+	for _, r := range report.Results {
+		if !r.Passed() {
+			report.Failures++
+		}
+	}
+
+	report.Passed = report.Failures == 0
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+//WriteCIReport writes the report to 'w' as plain text, json or junit xml
+func WriteCIReport(w io.Writer, report CIReport, format string) (err error) {
+	switch format {
+	case "text":
+		for _, r := range report.Results {
+			if !r.Passed() {
+				fmt.Fprintf(w, "FAIL %s %s: %s\n", r.Check, r.Path, r.Message)
+			}
+		}
+
+		status := "PASS"
+		if !report.Passed {
+			status = "FAIL"
+		}
+
+		_, err = fmt.Fprintf(w, "%s %d checks of %d files in '%s', %d failed\n", status, len(report.Results), len(report.Results)/len(CIChecks), report.Ref, report.Failures)
+		return err
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "junit":
+		return writeJUnit(w, report)
+	default:
+		return fmt.Errorf("unsupported report format '%s', expected one of: %v", format, CIReportFormats)
+	}
+}
+
+//writeJUnit writes the report as a junit xml test suite per check with a
+//test case per file, the format that ci systems show test results from
+func writeJUnit(w io.Writer, report CIReport) (err error) {
+	type failure struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+
+	type testcase struct {
+		Name      string   `xml:"name,attr"`
+		ClassName string   `xml:"classname,attr"`
+		Failure   *failure `xml:"failure,omitempty"`
+	}
+
+	type testsuite struct {
+		Name      string     `xml:"name,attr"`
+		Tests     int        `xml:"tests,attr"`
+		Failures  int        `xml:"failures,attr"`
+		TestCases []testcase `xml:"testcase"`
+	}
+
+	v := struct {
+		XMLName    xml.Name    `xml:"testsuites"`
+		Name       string      `xml:"name,attr"`
+		Tests      int         `xml:"tests,attr"`
+		Failures   int         `xml:"failures,attr"`
+		Time       string      `xml:"time,attr"`
+		TestSuites []testsuite `xml:"testsuite"`
+	}{
+		Name:     fmt.Sprintf("git-bits %s", report.Ref),
+		Tests:    len(report.Results),
+		Failures: report.Failures,
+		Time:     fmt.Sprintf("%.3f", report.Duration.Seconds()),
+	}
+
+	for _, check := range CIChecks {
+		suite := testsuite{Name: check, TestCases: []testcase{}}
+		for _, r := range report.Results {
+			if r.Check != check {
+				continue
+			}
+
+			tc := testcase{Name: r.Path, ClassName: "git-bits." + check}
+			if !r.Passed() {
+				tc.Failure = &failure{Message: r.Message, Text: fmt.Sprintf("%s: %s", r.Path, r.Message)}
+				suite.Failures++
+			}
+
+			suite.Tests++
+			suite.TestCases = append(suite.TestCases, tc)
+		}
+
+		v.TestSuites = append(v.TestSuites, suite)
+	}
+
+	_, err = io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode junit report: %v", err)
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,83 @@
+package bits
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	//ClaimTimeout is how long we wait for a chunk that another machine claimed
+	//to upload, claims that are older are assumed to be abandoned
+	ClaimTimeout = 5 * time.Minute
+
+	//ClaimPollInterval is how often we check whether a claimed chunk arrived
+	ClaimPollInterval = 2 * time.Second
+)
+
+//chunkClaimer is implemented by remotes that allow machines to claim the
+//upload of a chunk, such that the same chunk isn't uploaded by several
+//machines that push at the same time
+type chunkClaimer interface {
+	chunkHaser
+
+	//claimChunk atomically claims the upload of a chunk, it returns false if
+	//another machine claimed it less then ClaimTimeout ago
+	claimChunk(v KeyVersion, k K) (claimed bool, err error)
+
+	//releaseChunk removes the claim after uploading
+	releaseChunk(v KeyVersion, k K) error
+}
+
+//claimUpload determines whether we should upload chunk 'k' of version 'v'.
+//If the remote already stores the chunk, or another machine uploads it
+//while we wait, it returns ErrAlreadyPushed. Else the returned function
+//releases the claim.
+func (repo *Repository) claimUpload(v KeyVersion, k K) (release func(), err error) {
+	release = func() {}
+	claimer, ok := unwrapRemote(repo.currentRemote()).(chunkClaimer)
+	if !ok {
+		return release, nil
+	}
+
+	//the index may be outdated when others pushed since it was updated
+	has, err := claimer.hasChunk(v, k)
+	if err != nil {
+		return release, fmt.Errorf("failed to check whether the remote stores chunk '%s': %v", FormatKey(v, k), err)
+	}
+
+	if has {
+		return release, ErrAlreadyPushed
+	}
+
+	deadline := time.Now().Add(ClaimTimeout)
+	for {
+		claimed, err := claimer.claimChunk(v, k)
+		if err != nil {
+			return release, fmt.Errorf("failed to claim upload of chunk '%s': %v", FormatKey(v, k), err)
+		}
+
+		if claimed {
+			return func() {
+				err := claimer.releaseChunk(v, k)
+				if err != nil {
+					fmt.Fprintf(repo.output, "failed to release claim on chunk '%s': %v\n", FormatKey(v, k), err)
+				}
+			}, nil
+		}
+
+		//another machine uploads the chunk, wait for it to arrive
+		if time.Now().After(deadline) {
+			return release, nil
+		}
+
+		time.Sleep(ClaimPollInterval)
+		has, err = claimer.hasChunk(v, k)
+		if err != nil {
+			return release, fmt.Errorf("failed to check whether the remote stores chunk '%s': %v", FormatKey(v, k), err)
+		}
+
+		if has {
+			return release, ErrAlreadyPushed
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+//withoutFilter are the git options that check out pointers as they are
+//stored, also when git-bits is configured globally, such that a fresh
+//clone is materialized in-process. Files can't be cleaned with them.
+var withoutFilter = []string{"-c", "filter.bits.process=", "-c", "filter.bits.smudge=cat", "-c", "filter.bits.required=false"}
+
+//CloneAndMaterialize clones the git repository at 'gitURL' into 'dir',
+//installs git-bits with configuration 'conf' and pulls the chunks of HEAD
+//such that the working tree holds the actual content of split files. It
+//allows tools to embed git-bits instead of running its commands. With a
+//nil configuration the remote is configured from what the repository
+//shares (e.g. a public url), otherwise as with Install: leave its
+//deduplication scope zero to use the one the repository records. Git
+//operations that run later (e.g. MaterializeRef) still need the git-bits
+//executable for its filters.
+func CloneAndMaterialize(ctx context.Context, gitURL, dir string, conf *Conf) (repo *Repository, err error) {
+	exe, err := exec.LookPath("git")
+	if err != nil {
+		return nil, withKind(ConfigError, fmt.Errorf("git executable couldn't be found in your PATH: %v, make sure git it installed", err))
+	}
+
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(ctx, exe, append(append([]string{}, withoutFilter...), "clone", "--quiet", gitURL, dir)...)
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, withKind(NetworkError, fmt.Errorf("failed to clone '%s': %v: %s", gitURL, err, strings.TrimSpace(stderr.String())))
+	}
+
+	repo, err = NewRepository(dir, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf != nil {
+		c := *conf
+		conf = &c
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err = repo.Install(ioutil.Discard, conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to install git-bits in '%s': %v", dir, err)
+	}
+
+	return repo, nil
+}
+
+//MaterializeRef checks out 'ref' and pulls the chunks of its split files,
+//such that the working tree holds their actual content. Git runs the
+//filters that Install configured to check out the files, those that are
+//still pointers afterwards (e.g. because smudging was skipped) are
+//materialized by pulling.
+func (repo *Repository) MaterializeRef(ctx context.Context, ref string) (err error) {
+	ctx, end := repo.trace(ctx, "materialize", SpanAttr{"ref", ref})
+	defer end(&err)
+	err = repo.Git(ctx, nil, nil, "checkout", "--quiet", ref)
+	if err != nil {
+		return fmt.Errorf("failed to check out '%s': %v", ref, err)
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	return repo.pull(ctx, PullSelection{Refs: []string{"HEAD"}}, ioutil.Discard)
+}
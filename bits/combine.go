@@ -0,0 +1,174 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+)
+
+var (
+	//CombineConcurrency determines how many chunks are decrypted and written
+	//in parallel when combining into a regular file
+	CombineConcurrency = runtime.NumCPU()
+)
+
+//combineTarget is a regular file that chunks can be written to at their
+//offset in any order
+type combineTarget interface {
+	io.WriterAt
+	io.Seeker
+	Truncate(size int64) error
+}
+
+//parallelTarget returns 'w' as a target for parallel combining if it is a
+//regular file that isn't appended to, pipes and terminals can only be
+//written in order
+func parallelTarget(w io.Writer) (t combineTarget, ok bool) {
+	if CombineConcurrency < 2 {
+		return nil, false
+	}
+
+	f, ok := w.(*os.File)
+	if !ok {
+		return nil, false
+	}
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || !writesAtOffset(f) {
+		return nil, false
+	}
+
+	return f, true
+}
+
+//combineParallel reads the chunks of the pointer on 'r' and, if each has
+//its size recorded, preallocates the file and has CombineConcurrency
+//workers write their chunks at their offset. If a size is missing the
+//pointer is returned such that it can be combined in order instead.
+func (repo *Repository) combineParallel(r io.Reader, t combineTarget) (rest io.Reader, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %v", err)
+	}
+
+	chunks := []PointerChunk{}
+	total := int64(0)
+	for c, err := range repo.chunks(bytes.NewReader(data)) {
+		if err != nil {
+			return nil, fmt.Errorf("failed to loop over keys: %v", err)
+		}
+
+		chunks = append(chunks, c)
+		total += c.Size
+	}
+
+	for _, c := range chunks {
+		if c.Size < 0 {
+			return bytes.NewReader(data), nil
+		}
+	}
+
+	//the content is written from the current position on, as a sequential
+	//combine would, and the position is moved past it once written
+	base, err := t.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine the output position: %v", err)
+	}
+
+	err = t.Truncate(base + total)
+	if err != nil {
+		return nil, fmt.Errorf("failed to preallocate %d bytes: %v", total, err)
+	}
+
+	type combineJob struct {
+		c   PointerChunk
+		off int64
+	}
+
+	jobs := make(chan combineJob)
+	stop := make(chan struct{})
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	for i := 0; i < CombineConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				err := repo.writeChunkAt(job.c, t, job.off)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						close(stop)
+					}
+
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	off := base
+	for _, c := range chunks {
+		select {
+		case jobs <- combineJob{c, off}:
+		case <-stop:
+		}
+
+		off += c.Size
+	}
+
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, withKind(KindOf(firstErr), fmt.Errorf("failed to combine: %v", firstErr))
+	}
+
+	_, err = t.Seek(base+total, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move past the combined content: %v", err)
+	}
+
+	return nil, nil
+}
+
+//writeChunkAt decrypts the locally stored chunk 'c' and writes it to 'w' at
+//offset 'off', it must be exactly as large as the pointer recorded
+func (repo *Repository) writeChunkAt(c PointerChunk, w io.WriterAt, off int64) (err error) {
+	rc, err := repo.chunkReader(c.Version, c.K)
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+	n, err := io.Copy(&offsetWriter{w: w, off: off}, io.LimitReader(rc, c.Size+1))
+	if err != nil {
+		return fmt.Errorf("failed to copy chunk '%x' content after %d bytes: %v", c.K, n, err)
+	}
+
+	if n != c.Size {
+		return fmt.Errorf("chunk '%x' has %d bytes while the pointer records %d", c.K, n, c.Size)
+	}
+
+	return nil
+}
+
+//offsetWriter writes sequentially to 'w' from offset 'off' on
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (n int, err error) {
+	n, err = ow.w.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	return n, err
+}
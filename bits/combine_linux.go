@@ -0,0 +1,20 @@
+// +build linux
+
+package bits
+
+import (
+	"os"
+	"syscall"
+)
+
+//writesAtOffset returns whether writes to 'f' land at the offset they are
+//given, a file that was opened for appending (e.g. with '>>') writes each
+//at its end
+func writesAtOffset(f *os.File) bool {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return false
+	}
+
+	return flags&syscall.O_APPEND == 0
+}
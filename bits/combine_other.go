@@ -0,0 +1,13 @@
+// +build !linux
+
+package bits
+
+import (
+	"os"
+)
+
+//writesAtOffset returns whether writes to 'f' land at the offset they are
+//given, this is currently only known on linux
+func writesAtOffset(f *os.File) bool {
+	return false
+}
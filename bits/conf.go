@@ -4,9 +4,23 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/restic/chunker"
 )
 
 //Conf for the bits repository we're using
@@ -15,6 +29,13 @@ type Conf struct {
 	//holds the aws s3 bucket name
 	AWSS3BucketName string `json:"aws_s3_bucket_name"`
 
+	//git remote that the bucket stores chunks for, 'origin' when empty
+	Remote string `json:"remote"`
+
+	//replicas of the bucket (e.g. through cross-region replication) in
+	//order of preference, chunks are read from the one that is closest
+	AWSS3Replicas []string `json:"aws_s3_replicas"`
+
 	//The aws key that has access to the above bucket
 	AWSAccessKeyID string `json:"aws_access_key_id"`
 
@@ -23,31 +44,225 @@ type Conf struct {
 
 	//holds the chunking polynomial
 	DeduplicationScope uint64 `json:"deduplication_scope"`
+
+	//the algorithm that keys of new chunks are computed with
+	KeyHash KeyHash `json:"key_hash"`
+
+	//addresses of peers on the local network that serve chunks
+	Peers []string `json:"peers"`
+
+	//whether peers are discovered on the local network using mdns
+	PeerDiscovery bool `json:"peer_discovery"`
+
+	//bearer token that is sent to peers that require one
+	PeerToken string `json:"peer_token"`
+
+	//whether the requester pays for access to the bucket, instead of its owner
+	RequesterPays bool `json:"requester_pays"`
+
+	//pem file with certificates that are trusted in addition to the system's
+	CABundle string `json:"ca_bundle"`
+
+	//whether tls certificates of the remote are accepted without verification
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+
+	//how long setting up a connection to the remote may take
+	ConnectTimeout time.Duration `json:"connect_timeout"`
+
+	//how long a connection to the remote may stall while reading or writing
+	ReadTimeout time.Duration `json:"read_timeout"`
+
+	//how many idle connections to the remote are kept around for reuse
+	MaxIdleConns int `json:"max_idle_conns"`
+
+	//limits the number of connections to the remote, zero means no limit
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+
+	//url of a cdn in front of the bucket that chunks are fetched from
+	CDNURL string `json:"cdn_url"`
+
+	//id of the key pair that cdn urls are signed with
+	CDNKeyPairID string `json:"cdn_key_pair_id"`
+
+	//pem file with the private key that cdn urls are signed with
+	CDNPrivateKey string `json:"cdn_private_key"`
+
+	//patterns of refs (e.g. refs/heads/archive/*) that are not scanned for chunks
+	ScanExclude []string `json:"scan_exclude"`
+
+	//address (host:port) of a grpc chunk service that is used as the remote
+	GRPCAddress string `json:"grpc_address"`
+
+	//bearer token that is sent to the grpc chunk service
+	GRPCToken string `json:"grpc_token"`
+
+	//whether connections to the grpc chunk service don't use tls
+	GRPCPlaintext bool `json:"grpc_plaintext"`
+
+	//file that pushed and fetched chunks are appended to, relative paths
+	//are relative to the git directory
+	AuditLog string `json:"audit_log"`
+
+	//whether pushed and fetched chunks are also recorded in the bucket
+	AuditRemote bool `json:"audit_remote"`
+
+	//whether this clone refuses to write to the remote, e.g. for machines
+	//that must only ever read chunks
+	ReadOnly bool `json:"readonly"`
+
+	//levels of directories that chunk names in the bucket are sharded in
+	KeyShardDepth int `json:"key_shard_depth"`
+
+	//how long chunks that are stored remotely are kept locally without being
+	//used, zero keeps them until they are no longer referenced
+	CacheTTL time.Duration `json:"cache_ttl"`
+
+	//patterns of refs of which 'git bits prune-local' keeps the chunks
+	PruneKeepRefs []string `json:"prune_keep_ref"`
+
+	//'git bits prune-local' keeps the chunks of refs updated less than this
+	//long ago
+	PruneKeepAge time.Duration `json:"prune_keep_days"`
+
+	//number of bytes above which pulling or checking out asks for a
+	//confirmation before downloading, zero never asks
+	ConfirmThreshold int64 `json:"confirm_threshold"`
+
+	//number of bytes above which staged files that are not split are
+	//reported before committing, zero never reports them
+	AutoTrackSize int64 `json:"auto_track_size"`
+
+	//what is done with such files: 'warn' about them or 'add' patterns to
+	//.gitattributes that split them
+	AutoTrack string `json:"auto_track"`
+
+	//what splitting content that looks like small text does: 'warn' about
+	//it, refuse with an 'error' or skip the check when 'off'
+	TextCheck string `json:"text_check"`
+
+	//mode of files that are created in the chunk directory (e.g. 0660),
+	//zero uses 0666 masked by the umask
+	FileMode os.FileMode `json:"file_mode"`
+
+	//mode of directories that are created in the chunk directory (e.g.
+	//2770), zero uses 0777 masked by the umask
+	DirMode os.FileMode `json:"dir_mode"`
+
+	//url of a public bucket or cdn path that chunks are read from
+	//anonymously when no bucket or chunk service is configured
+	PublicURL string `json:"public_url"`
+
+	//hex encoded key that the key lists of new pointers are encrypted with,
+	//such that chunk hashes are not part of the git history
+	PointerKey string `json:"pointer_key"`
+
+	//size of the buffers that chunks are read into while splitting, at
+	//least the largest chunk the chunker creates
+	ChunkBufferSize int `json:"chunk_buffer"`
+
+	//commands that the plain-text content of each chunk is piped to before
+	//it is pushed or stored after fetching, a non-zero exit refuses it
+	PushHook  string `json:"push_hook"`
+	FetchHook string `json:"fetch_hook"`
+
+	//how the progress of operations is reported, see ProgressSinks
+	Progress string `json:"progress"`
+
+	//whether the pre-commit hook refuses commits of files that hold a
+	//pointer which the clean filter didn't write
+	RejectRawPointers bool `json:"reject_raw_pointers"`
+
+	//lines that pointers start and end with instead of the default ones,
+	//e.g. an organization specific marker that scanners match on
+	PointerHeader string `json:"pointer_header"`
+	PointerFooter string `json:"pointer_footer"`
+
+	//whether pointers with the default header and footer are no longer
+	//recognized once custom ones are configured
+	StrictSentinels bool `json:"strict_sentinels"`
+
+	//whether checkouts leave the pointers of files of which chunks are not
+	//stored locally, such that they are only downloaded once used
+	Lazy bool `json:"lazy"`
+
+	//ref patterns and the buckets that chunks of matching refs are pushed
+	//to instead of the configured remote, e.g. 'release/* archive-bucket'
+	Routes []string `json:"routes"`
+
+	//name this repository is known by in a bucket that it shares with other
+	//repositories, e.g. 'design/game-assets'. They reuse each other's chunks
+	//and pruning keeps the chunks that any of them references.
+	SharedRepository string `json:"shared_repository"`
+
+	//how long a chunk that the remote doesn't store isn't asked for again,
+	//such that retrying to fetch it doesn't hammer the remote. Zero always
+	//asks the remote.
+	AbsentTTL time.Duration `json:"absent_ttl"`
+
+	//format that new pointers are written in: 'lines' or 'json', which
+	//other tools can parse. Pointers of both formats are read.
+	PointerFormat string `json:"pointer_format"`
 }
 
 //DefaultConf will setup a default configuration
 func DefaultConf() *Conf {
 	return &Conf{
 		DeduplicationScope: 0x3DA3358B4DC173,
+		ConnectTimeout:     5 * time.Second,
+		ReadTimeout:        5 * time.Second,
+		MaxIdleConns:       10,
+		ChunkBufferSize:    ChunkBufferSize,
+		AbsentTTL:          AbsentTTL,
+	}
+}
+
+//remoteName returns the git remote that the bucket stores chunks for
+func (conf *Conf) remoteName() string {
+	if conf.Remote == "" {
+		return "origin"
 	}
+
+	return conf.Remote
 }
 
 //LoadGitValues will overwrite values based on configuration
 //set through git
 func (conf *Conf) OverwriteFromGit(repo *Repository) (err error) {
+
+	//settings that determine the keys of chunks are shared through a file in
+	//the repository, such that all clones split files the same way
 	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "config", "--file", filepath.Join(repo.rootDir, SharedConfFile), "--get-regexp", "^bits")
+	if err == nil {
+		err = conf.overwrite(buf, sharedConfKeys)
+		if err != nil {
+			return fmt.Errorf("invalid configuration in '%s': %v", SharedConfFile, err)
+		}
+	}
+
+	buf = bytes.NewBuffer(nil)
 	err = repo.Git(context.Background(), nil, buf, "config", "--get-regexp", "^bits")
 	if err != nil {
 		return nil //no bits conf, nothing to do
 	}
 
-	s := bufio.NewScanner(buf)
+	return conf.overwrite(buf, nil)
+}
+
+//overwrite sets values from the output of 'git config --get-regexp', if
+//'keys' is not nil only those keys are considered
+func (conf *Conf) overwrite(r io.Reader, keys map[string]bool) (err error) {
+	s := bufio.NewScanner(r)
 	for s.Scan() {
 		fields := strings.Fields(s.Text())
 		if len(fields) < 2 {
 			return fmt.Errorf("unexpected configuration returned from git: %v", s.Text())
 		}
 
+		if keys != nil && !keys[fields[0]] {
+			continue
+		}
+
 		switch fields[0] {
 		case "bits.deduplication-scope":
 			scope, err := strconv.ParseUint(fields[1], 10, 64)
@@ -56,14 +271,366 @@ func (conf *Conf) OverwriteFromGit(repo *Repository) (err error) {
 			}
 
 			conf.DeduplicationScope = scope
+		case "bits.key-hash":
+			conf.KeyHash, err = ParseKeyHash(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected configured key hash: %v", err)
+			}
 		case "bits.aws-s3-bucket-name":
 			conf.AWSS3BucketName = fields[1]
+		case "bits.remote":
+			conf.Remote = fields[1]
 		case "bits.aws-access-key-id":
 			conf.AWSAccessKeyID = fields[1]
 		case "bits.aws-secret-access-key":
 			conf.AWSSecretAccessKey = fields[1]
+		case "bits.aws-s3-replicas":
+			for _, replica := range strings.Split(fields[1], ",") {
+				if _, _, err := parseReplica(replica); err != nil {
+					return fmt.Errorf("unexpected format for configured replica '%v': %v", replica, err)
+				}
+
+				conf.AWSS3Replicas = append(conf.AWSS3Replicas, replica)
+			}
+		case "bits.peers":
+			conf.Peers = strings.Split(fields[1], ",")
+		case "bits.peer-discovery":
+			discover, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured peer discovery '%v', expected a boolean", fields[1])
+			}
+
+			conf.PeerDiscovery = discover
+		case "bits.peer-token":
+			conf.PeerToken = fields[1]
+		case "bits.requester-pays":
+			pays, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured requester pays '%v', expected a boolean", fields[1])
+			}
+
+			conf.RequesterPays = pays
+		case "bits.ca-bundle":
+			conf.CABundle = fields[1]
+		case "bits.insecure-skip-verify":
+			skip, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured insecure skip verify '%v', expected a boolean", fields[1])
+			}
+
+			conf.InsecureSkipVerify = skip
+		case "bits.connect-timeout":
+			timeout, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured connect timeout '%v', expected a duration (e.g. 5s)", fields[1])
+			}
+
+			conf.ConnectTimeout = timeout
+		case "bits.read-timeout":
+			timeout, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured read timeout '%v', expected a duration (e.g. 5s)", fields[1])
+			}
+
+			conf.ReadTimeout = timeout
+		case "bits.max-idle-conns":
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured max idle connections '%v', expected a base10 number", fields[1])
+			}
+
+			conf.MaxIdleConns = n
+		case "bits.max-conns-per-host":
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured max connections per host '%v', expected a base10 number", fields[1])
+			}
+
+			conf.MaxConnsPerHost = n
+		case "bits.cdn-url":
+			conf.CDNURL = fields[1]
+		case "bits.cdn-key-pair-id":
+			conf.CDNKeyPairID = fields[1]
+		case "bits.cdn-private-key":
+			conf.CDNPrivateKey = fields[1]
+		case "bits.scan-exclude":
+			for _, pattern := range strings.Split(fields[1], ",") {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("unexpected format for configured scan exclude '%v': %v", pattern, err)
+				}
+
+				conf.ScanExclude = append(conf.ScanExclude, pattern)
+			}
+		case "bits.grpc-address":
+			conf.GRPCAddress = fields[1]
+		case "bits.grpc-token":
+			conf.GRPCToken = fields[1]
+		case "bits.grpc-plaintext":
+			plaintext, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured grpc plaintext '%v', expected a boolean", fields[1])
+			}
+
+			conf.GRPCPlaintext = plaintext
+		case "bits.audit-log":
+			conf.AuditLog = fields[1]
+		case "bits.audit-remote":
+			audit, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured audit remote '%v', expected a boolean", fields[1])
+			}
+
+			conf.AuditRemote = audit
+		case "bits.readonly":
+			readonly, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured readonly '%v', expected a boolean", fields[1])
+			}
+
+			conf.ReadOnly = readonly
+		case "bits.key-shard-depth":
+			depth, err := strconv.Atoi(fields[1])
+			if err != nil || depth < 0 || depth > MaxKeyShardDepth {
+				return fmt.Errorf("unexpected format for configured key shard depth '%v', expected a number from 0 to %d", fields[1], MaxKeyShardDepth)
+			}
+
+			conf.KeyShardDepth = depth
+		case "bits.cache-ttl":
+			days, err := strconv.Atoi(fields[1])
+			if err != nil || days < 0 {
+				return fmt.Errorf("unexpected format for configured cache ttl '%v', expected a number of days", fields[1])
+			}
+
+			conf.CacheTTL = time.Duration(days) * 24 * time.Hour
+		case "bits.prune-keep-ref":
+			for _, pattern := range strings.Split(fields[1], ",") {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("unexpected format for configured prune keep ref '%v': %v", pattern, err)
+				}
+
+				conf.PruneKeepRefs = append(conf.PruneKeepRefs, pattern)
+			}
+		case "bits.prune-keep-days":
+			days, err := strconv.Atoi(fields[1])
+			if err != nil || days < 0 {
+				return fmt.Errorf("unexpected format for configured prune keep days '%v', expected a number of days", fields[1])
+			}
+
+			conf.PruneKeepAge = time.Duration(days) * 24 * time.Hour
+		case "bits.confirm-threshold":
+			n, err := humanize.ParseBytes(fields[1])
+			if err != nil || n > math.MaxInt64 {
+				return fmt.Errorf("unexpected format for configured confirm threshold '%v', expected a number of bytes (e.g. 10GB)", fields[1])
+			}
+
+			conf.ConfirmThreshold = int64(n)
+		case "bits.auto-track-size":
+			n, err := humanize.ParseBytes(fields[1])
+			if err != nil || n > math.MaxInt64 {
+				return fmt.Errorf("unexpected format for configured auto track size '%v', expected a number of bytes (e.g. 100MB)", fields[1])
+			}
+
+			conf.AutoTrackSize = int64(n)
+		case "bits.file-mode":
+			mode, err := ParseMode(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured file mode '%v': %v", fields[1], err)
+			}
+
+			conf.FileMode = mode
+		case "bits.dir-mode":
+			mode, err := ParseMode(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured dir mode '%v': %v", fields[1], err)
+			}
+
+			conf.DirMode = mode
+		case "bits.auto-track":
+			if fields[1] != "warn" && fields[1] != "add" {
+				return fmt.Errorf("unexpected auto track mode '%v', expected one of: %v", fields[1], AutoTrackModes)
+			}
+
+			conf.AutoTrack = fields[1]
+		case "bits.public-url":
+			conf.PublicURL = fields[1]
+		case "bits.chunk-buffer":
+			n, err := humanize.ParseBytes(fields[1])
+			if err != nil || n > math.MaxInt32 {
+				return fmt.Errorf("unexpected format for configured chunk buffer '%v', expected a number of bytes (e.g. 32MiB)", fields[1])
+			}
+
+			if n < chunker.MaxSize {
+				return fmt.Errorf("configured chunk buffer of %s is smaller than the largest chunk of %s", humanize.IBytes(n), humanize.IBytes(chunker.MaxSize))
+			}
+
+			conf.ChunkBufferSize = int(n)
+		case "bits.push-hook":
+			conf.PushHook = strings.TrimSpace(strings.TrimPrefix(s.Text(), fields[0])) //commands hold spaces
+		case "bits.fetch-hook":
+			conf.FetchHook = strings.TrimSpace(strings.TrimPrefix(s.Text(), fields[0]))
+		case "bits.pointer-key":
+			_, err = ParsePointerKey(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured pointer key: %v", err)
+			}
+
+			conf.PointerKey = fields[1]
+		case "bits.text-check":
+			if fields[1] != "warn" && fields[1] != "error" && fields[1] != "off" {
+				return fmt.Errorf("unexpected text check mode '%v', expected one of: %v", fields[1], TextCheckModes)
+			}
+
+			conf.TextCheck = fields[1]
+		case "bits.progress":
+			if _, err := NewProgressSink(fields[1], ioutil.Discard); err != nil {
+				return fmt.Errorf("unexpected format for configured progress: %v", err)
+			}
+
+			conf.Progress = fields[1]
+		case "bits.reject-raw-pointers":
+			reject, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured reject raw pointers '%v', expected a boolean", fields[1])
+			}
+
+			conf.RejectRawPointers = reject
+		case "bits.pointer-header", "bits.pointer-footer":
+			sentinel := strings.TrimPrefix(s.Text(), fields[0]+" ") //sentinels hold spaces
+			err = CheckSentinel(sentinel)
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured %s: %v", strings.TrimPrefix(fields[0], "bits."), err)
+			}
+
+			if fields[0] == "bits.pointer-header" {
+				conf.PointerHeader = sentinel
+			} else {
+				conf.PointerFooter = sentinel
+			}
+		case "bits.strict-sentinels":
+			strict, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured strict sentinels '%v', expected a boolean", fields[1])
+			}
+
+			conf.StrictSentinels = strict
+		case "bits.lazy":
+			lazy, err := strconv.ParseBool(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured lazy '%v', expected a boolean", fields[1])
+			}
+
+			conf.Lazy = lazy
+		case "bits.route":
+			route := strings.Join(fields[1:], " ")
+			if _, _, err := parseRoute(route); err != nil {
+				return fmt.Errorf("unexpected format for configured route '%v': %v", route, err)
+			}
+
+			conf.Routes = append(conf.Routes, route)
+		case "bits.shared-repository":
+			name, err := ParseSharedRepository(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured shared repository: %v", err)
+			}
+
+			conf.SharedRepository = name
+		case "bits.absent-ttl":
+			ttl, err := time.ParseDuration(fields[1])
+			if err != nil || ttl < 0 {
+				return fmt.Errorf("unexpected format for configured absent ttl '%v', expected a duration (e.g. 1m)", fields[1])
+			}
+
+			conf.AbsentTTL = ttl
+		case "bits.pointer-format":
+			format, err := ParsePointerFormat(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured pointer format: %v", err)
+			}
+
+			conf.PointerFormat = format
 		}
 	}
 
 	return nil
 }
+
+//TLSConfig returns the tls configuration for connections to the remote, it
+//trusts the configured ca bundle in addition to the system's certificates
+func (conf *Conf) TLSConfig() (tlsConf *tls.Config, err error) {
+	tlsConf = &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CABundle == "" {
+		return tlsConf, nil
+	}
+
+	pem, err := ioutil.ReadFile(conf.CABundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca bundle '%s': %v", conf.CABundle, err)
+	}
+
+	tlsConf.RootCAs, err = x509.SystemCertPool()
+	if err != nil {
+		tlsConf.RootCAs = x509.NewCertPool()
+	}
+
+	if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in ca bundle '%s'", conf.CABundle)
+	}
+
+	return tlsConf, nil
+}
+
+//HTTPClient returns a client for transfers to and from the remote that is
+//configured with the timeouts, connection limits and tls settings. Proxies
+//are configured through HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func (conf *Conf) HTTPClient() (client *http.Client, err error) {
+	tlsConf, err := conf.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: conf.ConnectTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, netw, addr string) (net.Conn, error) {
+				c, err := dialer.DialContext(ctx, netw, addr)
+				if err != nil || conf.ReadTimeout <= 0 {
+					return c, err
+				}
+
+				return &deadlineConn{Conn: c, timeout: conf.ReadTimeout}, nil
+			},
+			TLSClientConfig:       tlsConf,
+			TLSHandshakeTimeout:   conf.ConnectTimeout,
+			ResponseHeaderTimeout: conf.ReadTimeout,
+			MaxIdleConns:          conf.MaxIdleConns,
+			MaxIdleConnsPerHost:   conf.MaxIdleConns,
+			MaxConnsPerHost:       conf.MaxConnsPerHost,
+		},
+	}, nil
+}
+
+//deadlineConn fails reads and writes that stall for longer than the timeout,
+//unlike a client timeout this doesn't limit the duration of large transfers
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (n int, err error) {
+	err = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (n int, err error) {
+	err = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,210 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	//ErrNotConfirmed is returned when a download that is larger than the
+	//configured 'bits.confirm-threshold' is not confirmed
+	ErrNotConfirmed = errors.New("the download was not confirmed")
+)
+
+//missingChunks returns how many of the given chunks are not stored locally
+//and how many bytes they hold, chunks without a listed size are counted as
+//empty
+func (repo *Repository) missingChunks(chunks []PointerChunk) (n int, size int64) {
+	seen := map[K]bool{}
+	for _, c := range chunks {
+		if seen[c.K] {
+			continue
+		}
+
+		seen[c.K] = true
+		p, err := repo.chunkPath(c.Version, c.K, false)
+		if err != nil {
+			continue
+		}
+
+		if _, err = os.Stat(p); err == nil {
+			continue
+		}
+
+		n++
+		if c.Size > 0 {
+			size += c.Size
+		}
+	}
+
+	return n, size
+}
+
+//storedLocally returns whether all chunks of pointer 'ptr' are stored in the
+//local chunk directory, a pointer that can't be read isn't
+func (repo *Repository) storedLocally(ptr []byte) bool {
+	p, err := repo.ReadPointer(bytes.NewReader(ptr))
+	if err != nil {
+		return false
+	}
+
+	n, _ := repo.missingChunks(p.Chunks)
+	return n == 0
+}
+
+//splitFiles returns the paths of the split files in the tree of 'ref' in
+//the order git lists them, with their pointers
+func (repo *Repository) splitFiles(ref string) (paths []string, ptrs map[string]*Pointer, err error) {
+	out := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, out, "ls-tree", "-r", "-l", "-z", ref)
+	if err != nil {
+		return nil, nil, nil //nothing to pull, e.g. without commits
+	}
+
+	//@see https://git-scm.com/docs/git-ls-tree
+	//entry: <mode> SP <type> SP <object> SP <size> TAB <file> NUL
+	in := bytes.NewBuffer(nil)
+	blobs := map[string]string{}
+	for _, entry := range bytes.Split(out.Bytes(), []byte{0}) {
+		tfields := bytes.SplitN(entry, []byte("\t"), 2)
+		fields := bytes.Fields(entry)
+		if len(fields) < 5 || len(tfields) != 2 || !bytes.Equal(fields[1], []byte("blob")) {
+			continue
+		}
+
+		objSize, err := strconv.ParseInt(string(fields[3]), 10, 64)
+		if err != nil || objSize < int64(len(repo.header)+len(repo.footer)) {
+			continue
+		}
+
+		blobs[string(tfields[1])] = string(fields[2])
+		fmt.Fprintf(in, "%s\x00", tfields[1])
+	}
+
+	//only files that are split are read, others may be large
+	attrs := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), in, attrs, "check-attr", "-z", "--stdin", "filter")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check which files are split: %v", err)
+	}
+
+	//output: <path> NUL <attribute> NUL <value> NUL
+	split := []string{}
+	byBlob := map[string][]string{}
+	fields := bytes.Split(attrs.Bytes(), []byte{0})
+	for i := 0; i+2 < len(fields); i += 3 {
+		if string(fields[i+2]) != "bits" {
+			continue
+		}
+
+		p := string(fields[i])
+		paths = append(paths, p)
+		if _, ok := byBlob[blobs[p]]; !ok {
+			split = append(split, blobs[p])
+		}
+
+		byBlob[blobs[p]] = append(byBlob[blobs[p]], p)
+	}
+
+	ptrs = map[string]*Pointer{}
+	err = repo.readPointers(split, func(blob string, ptr *Pointer) {
+		for _, p := range byBlob[blob] {
+			ptrs[p] = ptr
+		}
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//files that are not valid pointers are not pulled
+	valid := paths[:0]
+	for _, p := range paths {
+		if ptrs[p] != nil {
+			valid = append(valid, p)
+		}
+	}
+
+	return valid, ptrs, nil
+}
+
+//PullSize returns how many chunks and bytes pulling the selection downloads:
+//the chunks of selected split files that are not stored locally
+func (repo *Repository) PullSize(sel PullSelection) (chunks int, size int64, err error) {
+	_, ptrs, err := repo.selectedFiles(sel)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	all := []PointerChunk{}
+	for _, ptr := range ptrs {
+		all = append(all, ptr.Chunks...)
+	}
+
+	chunks, size = repo.missingChunks(all)
+	return chunks, size, nil
+}
+
+//pullPlan returns how many bytes pulling each of the split files at 'paths'
+//downloads, chunks that files share are counted for the first. It also
+//returns the total.
+func (repo *Repository) pullPlan(paths []string, ptrs map[string]*Pointer) (files map[string]int64, total int64) {
+	files = map[string]int64{}
+	seen := map[K]bool{}
+	for _, p := range paths {
+		chunks := []PointerChunk{}
+		for _, c := range ptrs[p].Chunks {
+			if !seen[c.K] {
+				seen[c.K] = true
+				chunks = append(chunks, c)
+			}
+		}
+
+		_, files[p] = repo.missingChunks(chunks)
+		total += files[p]
+	}
+
+	return files, total
+}
+
+//FetchSize reads the keys in 'r' like Fetch and returns them such that they
+//can still be fetched, with how many chunks and bytes fetching downloads
+func (repo *Repository) FetchSize(r io.Reader) (keys io.Reader, chunks int, size int64, err error) {
+	buf := bytes.NewBuffer(nil)
+	all := []PointerChunk{}
+	err = repo.forEachChunk(io.TeeReader(r, buf), func(c PointerChunk) error {
+		all = append(all, c)
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	chunks, size = repo.missingChunks(all)
+	return buf, chunks, size, nil
+}
+
+//ConfirmDownload asks 'confirm' whether downloading 'chunks' chunks that
+//hold 'size' bytes is intended when it is more than the configured
+//'bits.confirm-threshold'. It returns ErrNotConfirmed if it isn't or if
+//there is no way to ask (confirm is nil).
+func (repo *Repository) ConfirmDownload(chunks int, size int64, confirm func(question string) bool) error {
+	if repo.conf.ConfirmThreshold <= 0 || size <= repo.conf.ConfirmThreshold {
+		return nil
+	}
+
+	question := fmt.Sprintf("about to download %d chunks (%s), more than the configured threshold of %s, continue?", chunks, humanize.Bytes(uint64(size)), humanize.Bytes(uint64(repo.conf.ConfirmThreshold)))
+	if confirm == nil || !confirm(question) {
+		return ErrNotConfirmed
+	}
+
+	return nil
+}
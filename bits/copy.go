@@ -0,0 +1,211 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//chunkCopier is implemented by remotes that can copy chunks from another
+//remote without streaming them through this machine
+type chunkCopier interface {
+	copyChunkFrom(src Remote, v KeyVersion, k K) (copied bool, err error)
+}
+
+//OpenRemote returns the remote with the given name: the configured remote
+//is named after its git remote and other s3 buckets can be opened using
+//'s3://<bucket>', these use the configured credentials
+func (repo *Repository) OpenRemote(name string) (remote Remote, err error) {
+	if strings.HasPrefix(name, "s3://") {
+		bucket := strings.TrimSuffix(strings.TrimPrefix(name, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("no bucket in remote '%s'", name)
+		}
+
+		return NewS3Remote(repo, name, bucket, repo.conf.AWSAccessKeyID, repo.conf.AWSSecretAccessKey)
+	}
+
+	if s3, ok := unwrapRemote(repo.currentRemote()).(*S3Remote); ok && s3.Name() == name {
+		return repo.currentRemote(), nil
+	}
+
+	return nil, fmt.Errorf("unknown remote '%s', expected the configured remote or 's3://<bucket>'", name)
+}
+
+//CopyChunks copies chunks that are not yet stored in remote 'to' from
+//remote 'from', either all chunks or only those of split files in 'ref'. It
+//copies up to 'concurrency' chunks in parallel, if its zero FetchConcurrency
+//is used. It returns how many chunks were copied and how many were skipped
+//because 'to' already stored them.
+func (repo *Repository) CopyChunks(from, to Remote, ref string, concurrency int) (copied, skipped int, err error) {
+	if repo.conf.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+
+	if concurrency < 1 {
+		concurrency = FetchConcurrency
+	}
+
+	ids := []chunkID{}
+	seen := map[chunkID]struct{}{}
+	add := func(c PointerChunk) error {
+		if _, ok := seen[c.id()]; !ok {
+			seen[c.id()] = struct{}{}
+			ids = append(ids, c.id())
+		}
+
+		return nil
+	}
+
+	if ref != "" {
+		err = repo.ForEachPointer(ref, nil, func(p string, ptr *Pointer) error {
+			for _, c := range ptr.Chunks {
+				add(c)
+			}
+
+			return nil
+		})
+	} else {
+		buf := bytes.NewBuffer(nil)
+		err = from.ListChunks(buf)
+		if err == nil {
+			err = repo.forEachChunk(buf, add)
+		}
+	}
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list chunks to copy: %v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = to.ListChunks(buf)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list chunks in the destination: %v", err)
+	}
+
+	existing := map[chunkID]struct{}{}
+	err = repo.forEachChunk(buf, func(c PointerChunk) error {
+		existing[c.id()] = struct{}{}
+		return nil
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read chunks in the destination: %v", err)
+	}
+
+	//copy chunks in parallel while collecting errors
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := []string{}
+	idCh := make(chan chunkID)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range idCh {
+				err := copyChunk(from, to, id.v, id.k)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err.Error())
+				} else {
+					copied++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, id := range ids {
+		if _, ok := existing[id]; ok {
+			skipped++
+			continue
+		}
+
+		idCh <- id
+	}
+
+	close(idCh)
+	wg.Wait()
+	if len(errs) > 0 {
+		return copied, skipped, fmt.Errorf("failed to copy %d of %d chunks: \n %s", len(errs), len(ids)-skipped, summarizeErrors(errs))
+	}
+
+	return copied, skipped, nil
+}
+
+//copyChunk copies chunk 'k' of version 'v' between remotes, server-side if
+//possible
+func copyChunk(from, to Remote, v KeyVersion, k K) (err error) {
+	if copier, ok := unwrapRemote(to).(chunkCopier); ok {
+		copied, err := copier.copyChunkFrom(from, v, k)
+		if err != nil {
+			return fmt.Errorf("failed to copy chunk '%s': %v", FormatKey(v, k), err)
+		}
+
+		if copied {
+			return nil
+		}
+	}
+
+	rc, err := remoteChunkReader(from, v, k)
+	if err != nil {
+		return fmt.Errorf("failed to get chunk reader for key '%s': %v", FormatKey(v, k), err)
+	}
+
+	defer rc.Close()
+	wc, err := remoteChunkWriter(to, v, k)
+	if err != nil {
+		return fmt.Errorf("failed to get chunk writer for key '%s': %v", FormatKey(v, k), err)
+	}
+
+	_, err = io.Copy(wc, rc)
+	if err == nil {
+		err = wc.Close()
+	} else {
+		wc.Close()
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to copy chunk '%s': %v", FormatKey(v, k), err)
+	}
+
+	return nil
+}
+
+//copyChunkFrom copies the chunk (and the checksum s3gof3r stores next to
+//it) within s3 if the source is a bucket at the same provider
+func (s *S3Remote) copyChunkFrom(src Remote, v KeyVersion, k K) (copied bool, err error) {
+	from, ok := unwrapRemote(src).(*S3Remote)
+	if !ok || from.bucket.Domain != s.bucket.Domain {
+		return false, nil
+	}
+
+	//the buckets may be sharded at different depths
+	name := s.versionedName(v, k)
+	for _, names := range [][2]string{{from.versionedName(v, k), name}, {md5Name(from.versionedName(v, k)), md5Name(name)}} {
+		err = s.copyObject(from, names[0], names[1])
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+//copyObject copies object 'src' from bucket 'from' to 'dst' in this bucket
+func (s *S3Remote) copyObject(from *S3Remote, src, dst string) (err error) {
+	resp, err := s.request("PUT", dst, http.Header{"X-Amz-Copy-Source": {fmt.Sprintf("/%s/%s", from.bucket.Name, src)}}, nil)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to copy '%s': %v", src, s.respError(resp))
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//WatchSettleTime is how long a chunk file must be left untouched before it
+	//is uploaded, such that chunks that are still being written are skipped
+	WatchSettleTime = 2 * time.Second
+)
+
+//Watch uploads chunks that are staged locally but not yet stored remotely every
+//'interval' until the context is cancelled, such that the pre-push hook finds
+//most chunks to be pushed already. The first pass indexes the remote and
+//considers all local chunks, later passes only consider recently staged chunks.
+//The local store is only opened for short periods to not block other commands.
+func (repo *Repository) Watch(ctx context.Context, interval time.Duration) (err error) {
+	if repo.conf.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if repo.currentRemote() == nil {
+		return fmt.Errorf("unable to watch, no remote configured")
+	}
+
+	indexed := false
+	since := time.Time{}
+	for {
+		cutoff := time.Now().Add(-WatchSettleTime)
+		n, err := repo.pushStaged(!indexed, since, cutoff)
+		if err != nil {
+			repo.metrics.Add("git_bits_errors_total", 1, "mode", "daemon")
+			repo.monitor.retry(PushOp)
+			fmt.Fprintf(repo.output, "failed to push staged chunks, retrying in %s: %v\n", interval, err)
+		} else {
+			if n > 0 {
+				fmt.Fprintf(repo.output, "pushed %d staged chunks\n", n)
+			}
+
+			indexed = true
+			since = cutoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+//pushStaged uploads local chunks (of the current key version) that were
+//modified between 'since' and 'cutoff' and are not known to be stored
+//remotely, optionally indexing the remote first. It returns the number of chunks that were uploaded.
+func (repo *Repository) pushStaged(index bool, since, cutoff time.Time) (n int, err error) {
+	ctx, end := repo.trace(context.Background(), "push-staged")
+	defer end(&err)
+	defer repo.flushAudit(&err)
+	keys := []K{}
+	err = repo.withStore(func(store *bolt.DB) error {
+		if index {
+			err := repo.indexRemote(ctx, store)
+			if err != nil {
+				return err
+			}
+		}
+
+		return store.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(IndexBucket)
+			return repo.walkChunks(CurrentKeyVersion, func(k K, fi os.FileInfo) error {
+				if fi.ModTime().Before(since) || !fi.ModTime().Before(cutoff) {
+					return nil
+				}
+
+				if c := b.Get(chunkID{CurrentKeyVersion, k}.storeKey()); c != nil && bytes.Equal(c, RemoteChunk) {
+					return nil
+				}
+
+				keys = append(keys, k)
+				return nil
+			})
+		})
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	//upload without holding the local store
+	var pushErr error
+	pushed := []chunkID{}
+	stored := []chunkID{}
+	etags := map[chunkID]string{}
+	repo.monitor.queue(PushOp, len(keys))
+	for i, k := range keys {
+		repo.monitor.queue(PushOp, -1)
+		size, etag, err := repo.pushChunk(ctx, CurrentKeyVersion, k)
+		if err == ErrAlreadyPushed {
+			repo.progress(KeyOp{PushOp, k, true, 0})
+			stored = append(stored, chunkID{CurrentKeyVersion, k})
+			continue
+		}
+
+		if err != nil {
+			pushErr = fmt.Errorf("pushed %d of %d staged chunks: %v", len(pushed), len(keys), err)
+			repo.monitor.queue(PushOp, -(len(keys) - i - 1))
+			break
+		}
+
+		repo.progress(KeyOp{PushOp, k, false, size})
+		repo.metrics.Add("git_bits_chunks_pushed_total", 1, "mode", "daemon")
+		repo.metrics.Add("git_bits_bytes_sent_total", float64(size), "mode", "daemon")
+		id := chunkID{CurrentKeyVersion, k}
+		pushed = append(pushed, id)
+		etags[id] = etag
+	}
+
+	if stored = append(stored, pushed...); len(stored) > 0 {
+		err = repo.withStore(func(store *bolt.DB) error {
+			repo.flushUsage(store)
+			err := repo.markRemote(store, stored...)
+			if err != nil {
+				return err
+			}
+
+			return repo.recordETags(store, etags)
+		})
+
+		if err != nil {
+			return len(pushed), err
+		}
+	}
+
+	return len(pushed), pushErr
+}
+
+//withStore opens the local store for the duration of 'fn', operations that
+//use it at the same time share it
+func (repo *Repository) withStore(fn func(store *bolt.DB) error) (err error) {
+	store, release, err := repo.sharedStore()
+	if err != nil {
+		return err
+	}
+
+	defer release()
+	return fn(store)
+}
+
+//sharedStore returns the local store that is shared by the operations that
+//use it at the same time, it is opened if none does. The returned function
+//must be called when done with it.
+func (repo *Repository) sharedStore() (store *bolt.DB, release func(), err error) {
+	repo.storeMu.Lock()
+	defer repo.storeMu.Unlock()
+	if repo.store == nil {
+		repo.store, err = repo.LocalStore()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		repo.storeLent = false
+	}
+
+	repo.storeUsers++
+	return repo.store, repo.releaseStore, nil
+}
+
+//lendStore makes operations that run while the caller holds 'store' use it,
+//instead of waiting for the lock on the local store it holds. The returned
+//function ends the loan, the store is not closed.
+func (repo *Repository) lendStore(store *bolt.DB) (release func()) {
+	repo.storeMu.Lock()
+	defer repo.storeMu.Unlock()
+	if repo.store == nil {
+		repo.store = store
+		repo.storeLent = true
+	}
+
+	repo.storeUsers++
+	return repo.releaseStore
+}
+
+//releaseStore is called by each user of the shared local store when it is
+//done, the last closes it
+func (repo *Repository) releaseStore() {
+	repo.storeMu.Lock()
+	defer repo.storeMu.Unlock()
+	repo.storeUsers--
+	if repo.storeUsers > 0 {
+		return
+	}
+
+	if !repo.storeLent {
+		repo.store.Close()
+	}
+
+	repo.store = nil
+}
+
+//walkAllChunks calls 'fn' for each chunk file in the local chunk directory,
+//of every supported key version
+func (repo *Repository) walkAllChunks(fn func(id chunkID, fi os.FileInfo) error) error {
+	vs := []KeyVersion{}
+	for v := range keyVersionStreams {
+		vs = append(vs, v)
+	}
+
+	sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+	for _, v := range vs {
+		err := repo.walkChunks(v, func(k K, fi os.FileInfo) error {
+			return fn(chunkID{v, k}, fi)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//walkChunks calls 'fn' for each chunk file of key version 'v' in the local
+//chunk directory
+func (repo *Repository) walkChunks(v KeyVersion, fn func(k K, fi os.FileInfo) error) error {
+	root := filepath.Join(repo.chunkDir, v.namespace())
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		//the chunks of other versions are stored in directories of their own
+		if fi.IsDir() {
+			if data, err := hex.DecodeString(fi.Name()); p != root && (err != nil || len(data) != 2) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		//chunk files are stored as <hex of the first 2 bytes>/<hex of the rest>
+		dir, name := filepath.Split(p)
+		data, err := hex.DecodeString(filepath.Base(dir) + name)
+		if err != nil || len(data) != KeySize {
+			return nil
+		}
+
+		k := K{}
+		copy(k[:], data)
+		return fn(k, fi)
+	})
+}
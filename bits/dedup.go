@@ -0,0 +1,142 @@
+package bits
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+)
+
+//ScannedFile is a version of a split file that scanning found in history
+type ScannedFile struct {
+	Path    string
+	Blob    string
+	Pointer *Pointer
+}
+
+//ScanFiles calls 'fn' with each split file in the commits selected by
+//rev-list arguments 'revs'. Each version is passed once, with the first path
+//it is found at.
+func (repo *Repository) ScanFiles(revs []string, fn func(f ScannedFile) error) (err error) {
+	_, end := repo.trace(context.Background(), "scan-files")
+	defer end(&err)
+	return repo.scanBlobs(revs, func(blob, path string, content io.Reader) error {
+		ptr, err := repo.ReadPointer(content)
+		if err != nil {
+			return fmt.Errorf("failed to read pointer of '%s': %v", path, err)
+		}
+
+		return fn(ScannedFile{Path: path, Blob: blob, Pointer: ptr})
+	})
+}
+
+//DedupShare describes how many of the chunks of a file are also chunks of
+//another file
+type DedupShare struct {
+	File   ScannedFile
+	Other  ScannedFile
+	Shared int     //distinct chunks of 'File' that 'Other' has as well
+	Share  float64 //fraction of the distinct chunks of 'File' that are shared
+}
+
+//DedupReport describes how chunks are shared between split files
+type DedupReport struct {
+	Files        int   //versions of split files that were scanned
+	Paths        int   //distinct paths of those files
+	Chunks       int   //chunks the files reference, counting each reference
+	UniqueChunks int   //distinct chunks the files reference
+	Bytes        int64 //plain-text bytes of the referenced chunks, counting each reference
+	UniqueBytes  int64 //plain-text bytes of the distinct chunks, what is actually stored
+
+	//Shares lists for each file the other files it shares chunks with, the
+	//highest share first
+	Shares []DedupShare
+}
+
+//DedupReport scans the files in the commits selected by rev-list arguments
+//'revs' and reports how their chunks are shared. File pairs that share less
+//than 'minShare' of the chunks of the first file are left out of the
+//shares. Chunk sizes that pointers don't record are not counted in bytes.
+func (repo *Repository) DedupReport(revs []string, minShare float64) (report *DedupReport, err error) {
+	report = &DedupReport{}
+	files := []ScannedFile{}
+	paths := map[string]struct{}{}
+	owners := map[K][]int{}
+	distinct := []int{}
+	sizes := map[K]int64{}
+	err = repo.ScanFiles(revs, func(f ScannedFile) error {
+		idx := len(files)
+		files = append(files, f)
+		paths[f.Path] = struct{}{}
+		seen := map[K]struct{}{}
+		for _, c := range f.Pointer.Chunks {
+			report.Chunks++
+			if c.Size > 0 {
+				report.Bytes += c.Size
+				sizes[c.K] = c.Size
+			}
+
+			if _, ok := seen[c.K]; ok {
+				continue
+			}
+
+			seen[c.K] = struct{}{}
+			owners[c.K] = append(owners[c.K], idx)
+		}
+
+		distinct = append(distinct, len(seen))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	report.Files = len(files)
+	report.Paths = len(paths)
+	report.UniqueChunks = len(owners)
+	for _, size := range sizes {
+		report.UniqueBytes += size
+	}
+
+	//count the chunks each pair of files has in common through the files
+	//that own each chunk, rather than comparing all pairs of files
+	shared := map[[2]int]int{}
+	for _, idxs := range owners {
+		for _, a := range idxs {
+			for _, b := range idxs {
+				if a != b {
+					shared[[2]int{a, b}]++
+				}
+			}
+		}
+	}
+
+	for pair, n := range shared {
+		share := float64(n) / float64(distinct[pair[0]])
+		if share < minShare {
+			continue
+		}
+
+		report.Shares = append(report.Shares, DedupShare{File: files[pair[0]], Other: files[pair[1]], Shared: n, Share: share})
+	}
+
+	sort.Slice(report.Shares, func(i, j int) bool {
+		a, b := report.Shares[i], report.Shares[j]
+		if a.Share != b.Share {
+			return a.Share > b.Share
+		}
+
+		if a.File.Path != b.File.Path {
+			return a.File.Path < b.File.Path
+		}
+
+		if a.Other.Path != b.Other.Path {
+			return a.Other.Path < b.Other.Path
+		}
+
+		return a.File.Blob+a.Other.Blob < b.File.Blob+b.Other.Blob
+	})
+
+	return report, nil
+}
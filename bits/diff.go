@@ -0,0 +1,78 @@
+package bits
+
+//PointerDelta describes the chunk level difference between two pointers, sizes
+//are -1 when they were not recorded in the pointer
+type PointerDelta struct {
+	OldSize   int64
+	NewSize   int64
+	OldChunks int
+	NewChunks int
+
+	//Added and Removed count the chunks that only occur on one side
+	Added   int
+	Removed int
+
+	//AddedSize is the number of bytes of the new file that are stored in
+	//chunks the old file doesn't have, -1 if this is unknown
+	AddedSize int64
+}
+
+//AddedRatio returns the fraction of the new file that is stored in chunks
+//that were not part of the old file, -1 if this is unknown
+func (d PointerDelta) AddedRatio() float64 {
+	if d.AddedSize < 0 || d.NewSize < 0 {
+		return -1
+	}
+
+	if d.NewSize == 0 {
+		return 0
+	}
+
+	return float64(d.AddedSize) / float64(d.NewSize)
+}
+
+//Delta compares the chunks of two pointers, a nil pointer is considered to
+//describe a file that doesn't exist
+func Delta(old, new *Pointer) (d PointerDelta) {
+	if old == nil {
+		old = &Pointer{}
+	}
+
+	if new == nil {
+		new = &Pointer{}
+	}
+
+	d.OldSize = old.Size()
+	d.NewSize = new.Size()
+	d.OldChunks = len(old.Chunks)
+	d.NewChunks = len(new.Chunks)
+
+	oldKeys := map[K]struct{}{}
+	for _, c := range old.Chunks {
+		oldKeys[c.K] = struct{}{}
+	}
+
+	newKeys := map[K]struct{}{}
+	for _, c := range new.Chunks {
+		newKeys[c.K] = struct{}{}
+		if _, ok := oldKeys[c.K]; ok {
+			continue
+		}
+
+		d.Added++
+		if c.Size < 0 || d.AddedSize < 0 {
+			d.AddedSize = -1
+			continue
+		}
+
+		d.AddedSize += c.Size
+	}
+
+	for _, c := range old.Chunks {
+		if _, ok := newKeys[c.K]; !ok {
+			d.Removed++
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,142 @@
+package bits
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//DirRemote stores chunks as files in a directory, using the same layout as
+//the local chunk directory. It is used by the chunk server to store what it
+//is sent.
+type DirRemote struct {
+	dir string
+}
+
+//NewDirRemote returns a remote that stores chunks in directory 'dir', it
+//is created if it doesn't exist yet
+func NewDirRemote(dir string) (remote *DirRemote, err error) {
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chunk directory '%s': %v", dir, err)
+	}
+
+	return &DirRemote{dir: dir}, nil
+}
+
+//path returns where the chunk with the given key is stored
+func (d *DirRemote) path(k K) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%x", k[:2]), fmt.Sprintf("%x", k[2:]))
+}
+
+//ChunkReader returns the content of the chunk with the given key
+func (d *DirRemote) ChunkReader(k K) (rc io.ReadCloser, err error) {
+	return d.chunkReaderFrom(k, 0)
+}
+
+//ChunkWriter returns a writer that stores the chunk once it is closed
+func (d *DirRemote) ChunkWriter(k K) (wc io.WriteCloser, err error) {
+	p := d.path(k)
+	err = os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory for chunk '%x': %v", k, err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+PartialChunkSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file for chunk '%x': %v", k, err)
+	}
+
+	return &dirChunkWriter{File: f, p: p}, nil
+}
+
+//ListChunks writes the keys of all stored chunks to 'w', one per line
+func (d *DirRemote) ListChunks(w io.Writer) (err error) {
+	return filepath.Walk(d.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		//partially written chunks and other files don't decode to a key
+		rel, err := filepath.Rel(d.dir, p)
+		if err != nil {
+			return err
+		}
+
+		data, err := hex.DecodeString(filepath.Dir(rel) + filepath.Base(rel))
+		if err != nil || len(data) != KeySize {
+			return nil
+		}
+
+		_, err = fmt.Fprintf(w, "%x\n", data)
+		return err
+	})
+}
+
+//chunkReaderFrom returns the content of the chunk starting at offset 'off'
+func (d *DirRemote) chunkReaderFrom(k K, off int64) (rc io.ReadCloser, err error) {
+	f, err := os.Open(d.path(k))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to seek chunk '%x': %v", k, err)
+	}
+
+	return f, nil
+}
+
+//hasChunk returns whether the chunk is stored, only chunks of version 0
+//are
+func (d *DirRemote) hasChunk(v KeyVersion, k K) (ok bool, err error) {
+	if v != KeyVersion0 {
+		return false, nil
+	}
+
+	_, err = os.Stat(d.path(k))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+//DeleteChunks removes the chunks, removing a chunk that isn't stored is a
+//no-op
+func (d *DirRemote) DeleteChunks(ks []K) error {
+	for _, k := range ks {
+		err := os.Remove(d.path(k))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete chunk '%x': %v", k, err)
+		}
+	}
+
+	return nil
+}
+
+//dirChunkWriter writes a chunk to a temporary file that is moved into place
+//when closed, such that readers never see part of it
+type dirChunkWriter struct {
+	*os.File
+	p string
+}
+
+func (w *dirChunkWriter) Close() error {
+	err := w.File.Close()
+	if err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+
+	return os.Rename(w.Name(), w.p)
+}
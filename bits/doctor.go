@@ -0,0 +1,114 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+var (
+	//FilterConf is the git configuration that makes git run git-bits as a
+	//filter, merge and diff driver. Install writes it, other tools that
+	//rewrite the git configuration may remove or change it.
+	FilterConf = map[string]string{
+		"filter.bits.clean":    "git bits split",
+		"filter.bits.smudge":   "git bits fetch | git bits combine",
+		"filter.bits.process":  "git bits filter-process",
+		"filter.bits.required": "true",
+		"merge.bits.name":      "git-bits pointer merge",
+		"merge.bits.driver":    "git bits merge-driver %O %A %B %P",
+		"diff.bits.textconv":   "git bits diff-driver",
+		"diff.bits.command":    "git bits diff-driver",
+	}
+)
+
+//ConfDrift is a setting of FilterConf that doesn't have the value git-bits
+//needs
+type ConfDrift struct {
+	Key      string
+	Expected string
+	Actual   string //empty if the setting was removed
+}
+
+//String describes the drift
+func (d ConfDrift) String() string {
+	if d.Actual == "" {
+		return fmt.Sprintf("'%s' is missing, expected '%s'", d.Key, d.Expected)
+	}
+
+	return fmt.Sprintf("'%s' is '%s', expected '%s'", d.Key, d.Actual, d.Expected)
+}
+
+//FilterDrift returns the settings of FilterConf that were removed or changed,
+//sorted by key. While the filter drifted git checks out pointers instead of
+//content and commits whatever is in the working tree as is.
+func (repo *Repository) FilterDrift() (drift []ConfDrift, err error) {
+	actual := map[string]string{}
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "config", "--get-regexp", `^(filter|merge|diff)\.bits\.`)
+	if err == nil {
+		s := bufio.NewScanner(buf)
+		for s.Scan() {
+			fields := strings.SplitN(s.Text(), " ", 2)
+			if len(fields) == 2 {
+				actual[fields[0]] = fields[1]
+			} else {
+				actual[fields[0]] = ""
+			}
+		}
+	}
+
+	for key, expected := range FilterConf {
+		if actual[key] != expected {
+			drift = append(drift, ConfDrift{Key: key, Expected: expected, Actual: actual[key]})
+		}
+	}
+
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Key < drift[j].Key })
+	return drift, nil
+}
+
+//RepairFilter restores the settings of FilterConf that drifted and, if any
+//did, pulls HEAD such that files that were checked out as pointers get
+//their content back, a lazy clone leaves them. It returns the drift that
+//was repaired.
+func (repo *Repository) RepairFilter(w io.Writer) (drift []ConfDrift, err error) {
+	ctx, end := repo.trace(context.Background(), "repair-filter")
+	defer end(&err)
+	drift, err = repo.FilterDrift()
+	if err != nil || len(drift) == 0 {
+		return drift, err
+	}
+
+	err = repo.writeFilterConf()
+	if err != nil {
+		return nil, err
+	}
+
+	if repo.conf.Lazy {
+		return drift, nil
+	}
+
+	err = repo.pull(ctx, PullSelection{Refs: []string{"HEAD"}}, w)
+	if err != nil {
+		return drift, fmt.Errorf("failed to pull chunks for HEAD: %v", err)
+	}
+
+	return drift, nil
+}
+
+//writeFilterConf writes FilterConf to the configuration of the repository
+func (repo *Repository) writeFilterConf() (err error) {
+	for k, val := range FilterConf {
+		err := repo.Git(context.Background(), nil, nil, "config", "--local", k, val)
+		if err != nil {
+			return fmt.Errorf("failed to configure filter: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	//secretConfKeys are settings of which the value is never shown
+	secretConfKeys = map[string]bool{
+		"bits.aws-secret-access-key": true,
+		"bits.peer-token":            true,
+		"bits.grpc-token":            true,
+		"bits.pointer-key":           true,
+	}
+)
+
+//EnvSetting is a setting that is in effect and where its value came from
+type EnvSetting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+//confOrigins returns for each 'key=value' configured through git the file
+//or other origin it is set in, later origins override earlier ones
+func (repo *Repository) confOrigins(pattern string) (origins map[string]string) {
+	origins = map[string]string{}
+	buf := bytes.NewBuffer(nil)
+	err := repo.Git(context.Background(), nil, buf, "config", "--show-origin", "--get-regexp", pattern)
+	if err != nil {
+		return origins //nothing configured
+	}
+
+	//<origin> TAB <key> SP <value>
+	s := bufio.NewScanner(buf)
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		key := strings.Fields(fields[1])
+		if len(key) > 0 {
+			origins[key[0]] = strings.TrimPrefix(fields[0], "file:")
+		}
+	}
+
+	return origins
+}
+
+//confValue formats a configuration field as it would be configured
+func confValue(v reflect.Value) string {
+	switch val := v.Interface().(type) {
+	case []string:
+		return strings.Join(val, ",")
+	case time.Duration:
+		return val.String()
+	case os.FileMode:
+		return formatMode(val)
+	case fmt.Stringer:
+		return val.String()
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+//Env returns every setting that is in effect with the source of its value:
+//the bits configuration, what the remote and local storage are and whether
+//git is setup to use git-bits. Secrets are only reported to be set.
+func (repo *Repository) Env() (settings []EnvSetting, err error) {
+	add := func(name, value, source string) {
+		settings = append(settings, EnvSetting{Name: name, Value: value, Source: source})
+	}
+
+	add("git-dir", repo.gitDir, "git")
+	add("root-dir", repo.rootDir, "git")
+	add("chunk-dir", repo.chunkDir, "git-dir")
+
+	switch {
+	case repo.conf.GRPCAddress != "":
+		add("remote", "grpc://"+repo.conf.GRPCAddress, "bits.grpc-address")
+	case repo.conf.AWSS3BucketName != "":
+		add("remote", "s3://"+repo.conf.AWSS3BucketName, "bits.aws-s3-bucket-name")
+	default:
+		add("remote", "none", "default")
+	}
+
+	add("fetch-concurrency", fmt.Sprint(FetchConcurrency), "built-in")
+	add("split-concurrency", fmt.Sprint(SplitConcurrency), "built-in")
+	add("split-flush-interval", SplitFlushInterval.String(), "built-in")
+	add("materialize-readahead", fmt.Sprint(MaterializeReadahead), "built-in")
+	add("replica-latency-ttl", ReplicaLatencyTTL.String(), "built-in")
+
+	//the shared file only provides some keys, git configuration overrides it
+	shared := map[string]bool{}
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "config", "--file", filepath.Join(repo.rootDir, SharedConfFile), "--get-regexp", "^bits")
+	if err == nil {
+		s := bufio.NewScanner(buf)
+		for s.Scan() {
+			if fields := strings.Fields(s.Text()); len(fields) > 0 && sharedConfKeys[fields[0]] {
+				shared[fields[0]] = true
+			}
+		}
+	}
+
+	origins := repo.confOrigins("^bits")
+	cv := reflect.ValueOf(repo.conf).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		key := "bits." + strings.Replace(cv.Type().Field(i).Tag.Get("json"), "_", "-", -1)
+		source := "default"
+		if origin, ok := origins[key]; ok {
+			source = origin
+		} else if shared[key] {
+			source = SharedConfFile
+		}
+
+		value := confValue(cv.Field(i))
+		if secretConfKeys[key] && value != "" {
+			value = "<set>"
+		}
+
+		add(key, value, source)
+	}
+
+	//git needs to be setup to run git-bits as a filter and before pushing
+	filters := repo.confOrigins("^filter\\.bits\\.")
+	for _, key := range []string{"filter.bits.clean", "filter.bits.smudge", "filter.bits.process", "filter.bits.required"} {
+		buf := bytes.NewBuffer(nil)
+		err := repo.Git(context.Background(), nil, buf, "config", "--get", key)
+		if err != nil {
+			add(key, "", "not installed")
+			continue
+		}
+
+		add(key, strings.TrimSpace(buf.String()), filters[key])
+	}
+
+	hooks, err := repo.hooksDir()
+	if err != nil {
+		return nil, err
+	}
+
+	source := repo.confOrigins("^core\\.hookspath$")["core.hookspath"]
+	if source == "" {
+		source = "default"
+	}
+
+	add("hooks-dir", hooks, source)
+	for _, hook := range []struct{ name, cmd, other string }{
+		{"pre-push", "git-bits push", "not pushing chunks"},
+		{"pre-commit", "git-bits track", "not checking staged files"},
+	} {
+		hookp := filepath.Join(hooks, hook.name)
+		script, err := ioutil.ReadFile(hookp)
+		switch {
+		case os.IsNotExist(err):
+			add("hooks."+hook.name, "missing", hookp)
+		case err != nil:
+			add("hooks."+hook.name, fmt.Sprintf("unreadable: %v", err), hookp)
+		case bytes.Contains(script, []byte(hook.cmd)):
+			add("hooks."+hook.name, "installed", hookp)
+		default:
+			add("hooks."+hook.name, hook.other, hookp)
+		}
+	}
+
+	for _, name := range []string{"OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"} {
+		if val := os.Getenv(name); val != "" {
+			add(name, val, "environment")
+		}
+	}
+
+	return settings, nil
+}
@@ -0,0 +1,91 @@
+package bits
+
+import (
+	"errors"
+)
+
+//ErrorKind classifies errors such that programs that run git-bits, e.g. the
+//commands through their exit code, can react to them
+type ErrorKind int
+
+const (
+	//UnknownError is the kind of errors that are not classified, e.g. git or
+	//file system errors
+	UnknownError ErrorKind = iota
+
+	//ConfigError is the kind of errors in setting up the repository: it is
+	//not a git repository, the configuration is invalid or no remote is
+	//configured
+	ConfigError
+
+	//NetworkError is the kind of errors in reaching the remote
+	NetworkError
+
+	//MissingChunkError is the kind of errors about chunks that are needed
+	//but aren't stored where they should be
+	MissingChunkError
+
+	//VerificationError is the kind of errors about content that doesn't
+	//match what it should be, e.g. a corrupt chunk
+	VerificationError
+
+	//PartialError is the kind of errors that some of the items failed while
+	//others succeeded, the failed ones can be retried
+	PartialError
+
+	//NotConfirmedError is the kind of errors about operations that were
+	//not confirmed, see ErrNotConfirmed
+	NotConfirmedError
+)
+
+//KindError is an error of a certain kind
+type KindError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *KindError) Error() string { return e.Err.Error() }
+
+func (e *KindError) Unwrap() error { return e.Err }
+
+//withKind returns 'err' as an error of kind 'kind', errors that are of a
+//known kind already keep it
+func withKind(kind ErrorKind, err error) error {
+	if err == nil || kind == UnknownError || KindOf(err) != UnknownError {
+		return err
+	}
+
+	return &KindError{Kind: kind, Err: err}
+}
+
+//fetchFailureKind returns the kind of error for fetching chunks of which
+//'failed' of 'total' failed: partial if others were fetched, without a
+//remote the configuration is at fault
+func (repo *Repository) fetchFailureKind(failed, total int) ErrorKind {
+	switch {
+	case repo.currentRemote() == nil:
+		return ConfigError
+	case failed < total:
+		return PartialError
+	default:
+		return NetworkError
+	}
+}
+
+//KindOf returns the kind of 'err', errors that are not classified are of the
+//UnknownError kind
+func KindOf(err error) ErrorKind {
+	var ke *KindError
+	switch {
+	case err == nil:
+		return UnknownError
+	case errors.As(err, &ke):
+		return ke.Kind
+	case errors.Is(err, ErrReadOnly):
+		return ConfigError
+	case errors.Is(err, ErrNotConfirmed):
+		return NotConfirmedError
+	default:
+		return UnknownError
+	}
+}
@@ -0,0 +1,291 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+//evictedFile is a file in the working tree that is replaced by its pointer
+type evictedFile struct {
+	path string
+	blob string
+	ptr  *Pointer
+}
+
+//relPaths returns the paths relative to the root of the working tree, paths
+//that are absolute are made relative
+func (repo *Repository) relPaths(paths []string) (rel []string, err error) {
+	for _, p := range paths {
+		if filepath.IsAbs(p) {
+			abs := p
+			p, err = filepath.Rel(repo.rootDir, abs)
+			if err != nil || strings.HasPrefix(p, "..") {
+				return nil, fmt.Errorf("path '%s' is outside the working tree", abs)
+			}
+		}
+
+		rel = append(rel, filepath.ToSlash(p))
+	}
+
+	return rel, nil
+}
+
+//remoteHasChunk returns whether chunk 'id' is known to be stored remotely:
+//recorded as such in the index or confirmed by the remote
+func (repo *Repository) remoteHasChunk(store *bolt.DB, id chunkID) (ok bool, err error) {
+	err = store.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(IndexBucket).Get(id.storeKey())
+		ok = c != nil && bytes.Equal(c, RemoteChunk)
+		return nil
+	})
+
+	if err != nil || ok {
+		return ok, err
+	}
+
+	if repo.currentRemote() == nil {
+		return false, fmt.Errorf("no remote configured")
+	}
+
+	if haser, hasOk := unwrapRemote(repo.currentRemote()).(chunkHaser); hasOk {
+		return haser.hasChunk(id.v, id.k)
+	}
+
+	rc, err := remoteChunkReader(repo.currentRemote(), id.v, id.k)
+	if err != nil {
+		return false, nil
+	}
+
+	rc.Close()
+	return true, nil
+}
+
+//Evict replaces the split files at the given paths (or in the given
+//directories) with their pointer and marks them 'skip-worktree' such that git
+//doesn't consider them modified. Files are only evicted if all their chunks
+//are stored remotely and the files are not modified. Unless 'keepChunks' is
+//set, the local copies of their chunks are removed as well. Paths are
+//relative to the root of the working tree or absolute. Evicted files are
+//written to 'w', it returns the number of bytes that was freed.
+func (repo *Repository) Evict(w io.Writer, keepChunks bool, paths ...string) (freed int64, err error) {
+	ctx := context.Background()
+	paths, err = repo.relPaths(paths)
+	if err != nil {
+		return 0, err
+	}
+
+	//entry: <mode> SP <object> SP <stage> TAB <file> NUL
+	out := bytes.NewBuffer(nil)
+	err = repo.Git(ctx, nil, out, append([]string{"--literal-pathspecs", "ls-files", "--stage", "-z", "--"}, paths...)...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	blobs := []string{}
+	byBlob := map[string][]string{}
+	for _, entry := range bytes.Split(out.Bytes(), []byte{0}) {
+		tfields := bytes.SplitN(entry, []byte("\t"), 2)
+		fields := bytes.Fields(tfields[0])
+		if len(tfields) != 2 || len(fields) != 3 {
+			continue
+		}
+
+		blob := string(fields[1])
+		if _, ok := byBlob[blob]; !ok {
+			blobs = append(blobs, blob)
+		}
+
+		byBlob[blob] = append(byBlob[blob], string(tfields[1]))
+	}
+
+	if len(blobs) == 0 {
+		return 0, fmt.Errorf("no tracked files match: %s", strings.Join(paths, ", "))
+	}
+
+	files := []evictedFile{}
+	err = repo.readPointers(blobs, func(blob string, ptr *Pointer) {
+		for _, p := range byBlob[blob] {
+			files = append(files, evictedFile{path: p, blob: blob, ptr: ptr})
+		}
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	//modified files would lose their changes
+	out.Reset()
+	err = repo.Git(ctx, nil, out, append([]string{"--literal-pathspecs", "diff-files", "--name-only", "-z", "--"}, paths...)...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check for modified files: %v", err)
+	}
+
+	modified := map[string]bool{}
+	for _, p := range bytes.Split(out.Bytes(), []byte{0}) {
+		modified[string(p)] = true
+	}
+
+	evicted := []string{}
+	removable := map[chunkID]bool{}
+	err = repo.withStore(func(store *bolt.DB) error {
+		for _, f := range files {
+			if modified[f.path] {
+				fmt.Fprintf(w, "skip '%s': it is modified\n", f.path)
+				continue
+			}
+
+			missing := 0
+			for _, c := range f.ptr.Chunks {
+				ok, err := repo.remoteHasChunk(store, c.id())
+				if err != nil {
+					return fmt.Errorf("failed to check whether chunk '%s' is stored remotely: %v", c.id(), err)
+				}
+
+				if !ok {
+					missing++
+				}
+			}
+
+			if missing > 0 {
+				fmt.Fprintf(w, "skip '%s': %d of its chunks are not pushed\n", f.path, missing)
+				continue
+			}
+
+			n, err := repo.evictFile(f)
+			if err != nil {
+				return err
+			}
+
+			if n < 0 {
+				continue //already evicted
+			}
+
+			freed += n
+			evicted = append(evicted, f.path)
+			for _, c := range f.ptr.Chunks {
+				removable[c.id()] = true
+			}
+
+			fmt.Fprintf(w, "evicted '%s'\n", f.path)
+		}
+
+		return nil
+	})
+
+	if err != nil || len(evicted) == 0 {
+		return freed, err
+	}
+
+	in := bytes.NewBufferString(strings.Join(evicted, "\x00") + "\x00")
+	err = repo.Git(ctx, in, nil, "update-index", "--skip-worktree", "-z", "--stdin")
+	if err != nil {
+		return freed, fmt.Errorf("failed to mark evicted files: %v", err)
+	}
+
+	if keepChunks {
+		return freed, nil
+	}
+
+	for id := range removable {
+		p, err := repo.chunkPath(id.v, id.k, false)
+		if err != nil {
+			return freed, err
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+
+		err = os.Remove(p)
+		if err != nil {
+			return freed, fmt.Errorf("failed to remove chunk '%s': %v", id, err)
+		}
+
+		freed += fi.Size()
+	}
+
+	return freed, nil
+}
+
+//evictFile replaces the file with the content of its blob, it returns the
+//size of the file it replaced or -1 if it was replaced already
+func (repo *Repository) evictFile(f evictedFile) (size int64, err error) {
+	fpath := filepath.Join(repo.rootDir, f.path)
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat '%s': %v", f.path, err)
+	}
+
+	hdr := make([]byte, len(repo.header))
+	if file, err := os.Open(fpath); err == nil {
+		io.ReadFull(file, hdr)
+		file.Close()
+		if repo.hasHeader(hdr) {
+			return -1, nil
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "cat-file", "blob", f.blob)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read pointer of '%s': %v", f.path, err)
+	}
+
+	//the pointer is written next to the file and moved over it, such that
+	//an interruption never leaves a partial file
+	tmpf, err := ioutil.TempFile(filepath.Dir(fpath), ".bits_evict_")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+
+	defer os.Remove(tmpf.Name())
+	_, err = tmpf.Write(buf.Bytes())
+	tmpf.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to write pointer of '%s': %v", f.path, err)
+	}
+
+	err = os.Chmod(tmpf.Name(), fi.Mode())
+	if err != nil {
+		return 0, fmt.Errorf("failed to modify temp file permissions: %v", err)
+	}
+
+	err = os.Rename(tmpf.Name(), fpath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to replace '%s' with its pointer: %v", f.path, err)
+	}
+
+	return fi.Size(), nil
+}
+
+//Restore clears the 'skip-worktree' mark of evicted files at the given paths
+//and pulls the chunks of all files in the working tree that are pointers
+func (repo *Repository) Restore(w io.Writer, paths ...string) (err error) {
+	paths, err = repo.relPaths(paths)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	files := bytes.NewBuffer(nil)
+	err = repo.Git(ctx, nil, files, append([]string{"--literal-pathspecs", "ls-files", "-z", "--"}, paths...)...)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %v", err)
+	}
+
+	err = repo.Git(ctx, files, nil, "update-index", "--no-skip-worktree", "-z", "--stdin")
+	if err != nil {
+		return fmt.Errorf("failed to unmark evicted files: %v", err)
+	}
+
+	return repo.Pull(PullSelection{Refs: []string{"HEAD"}}, w)
+}
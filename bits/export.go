@@ -0,0 +1,281 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//IndexExportFormats lists the formats that ExportIndex can write
+	IndexExportFormats = []string{"json", "csv"}
+)
+
+//IndexEntry describes a chunk that is known to this clone
+type IndexEntry struct {
+
+	//hex encoded key of the chunk, as it is listed (see FormatKey)
+	Key string `json:"key"`
+
+	//size of the chunk in bytes, zero if unknown
+	Size int64 `json:"size"`
+
+	//whether the chunk is stored in the local chunk directory
+	Local bool `json:"local"`
+
+	//whether the index records that the remote stores the chunk
+	Remote bool `json:"remote"`
+
+	//number of blobs that are recorded to reference the chunk
+	RefCount int `json:"refcount"`
+
+	//the oldest commit in any local ref that added a referencing blob
+	FirstSeen string `json:"first_seen,omitempty"`
+}
+
+//IndexEntries returns all chunks that are stored locally, recorded in the
+//index or referenced by recorded blobs, sorted by key. Sizes of chunks that
+//are not stored locally and the commits that first referenced chunks are
+//looked up in the history.
+func (repo *Repository) IndexEntries() (entries []IndexEntry, err error) {
+	known := map[chunkID]*IndexEntry{}
+	entry := func(id chunkID) *IndexEntry {
+		e, ok := known[id]
+		if !ok {
+			e = &IndexEntry{Key: id.String()}
+			known[id] = e
+		}
+
+		return e
+	}
+
+	err = repo.walkAllChunks(func(id chunkID, fi os.FileInfo) error {
+		e := entry(id)
+		e.Local = true
+		e.Size = fi.Size()
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk local chunks: %v", err)
+	}
+
+	refs := map[string][]chunkID{}
+	err = repo.withStore(func(store *bolt.DB) error {
+		return store.View(func(tx *bolt.Tx) error {
+			err := tx.Bucket(IndexBucket).ForEach(func(key, v []byte) error {
+				id, _ := parseStoreKey(key)
+				entry(id).Remote = bytes.Equal(v, RemoteChunk)
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			return tx.Bucket(ChunkRefBucket).ForEach(func(key, v []byte) error {
+				id, blob := parseStoreKey(key)
+				entry(id).RefCount++
+				refs[string(blob)] = append(refs[string(blob)], id)
+				return nil
+			})
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the local store: %v", err)
+	}
+
+	//the pointers that still exist tell the size of chunks
+	blobs := []string{}
+	for blob := range refs {
+		blobs = append(blobs, blob)
+	}
+
+	err = repo.readPointers(blobs, func(blob string, ptr *Pointer) {
+		for _, c := range ptr.Chunks {
+			if e := entry(c.id()); e.Size == 0 && c.Size > 0 {
+				e.Size = c.Size
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := repo.firstCommits(refs)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[chunkID]seenCommit{}
+	for blob, commit := range first {
+		for _, id := range refs[blob] {
+			if c, ok := seen[id]; !ok || commit.order < c.order {
+				seen[id] = commit
+			}
+		}
+	}
+
+	for id, c := range seen {
+		entry(id).FirstSeen = c.id
+	}
+
+	for _, e := range known {
+		entries = append(entries, *e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+//readPointers reads the given blobs as pointers, blobs that are missing or
+//are not pointers are skipped
+func (repo *Repository) readPointers(blobs []string, fn func(blob string, ptr *Pointer)) (err error) {
+	in := bytes.NewBuffer(nil)
+	for _, blob := range blobs {
+		fmt.Fprintf(in, "%s\n", blob)
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), in, out, "cat-file", "--batch")
+	if err != nil {
+		return fmt.Errorf("failed to read pointer blobs: %v", err)
+	}
+
+	//each blob is preceded by a '<blob> blob <size>' line
+	br := bufio.NewReader(out)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read pointer blobs: %v", err)
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue //missing object
+		}
+
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected blob description '%s': %v", strings.TrimSpace(line), err)
+		}
+
+		data := make([]byte, size+1)
+		_, err = io.ReadFull(br, data)
+		if err != nil {
+			return fmt.Errorf("failed to read blob '%s': %v", fields[0], err)
+		}
+
+		ptr, err := repo.ReadPointer(bytes.NewReader(data[:size]))
+		if err == nil {
+			fn(fields[0], ptr)
+		}
+	}
+}
+
+//seenCommit is a commit and its position in the history, oldest first
+type seenCommit struct {
+	id    string
+	order int
+}
+
+//firstCommits returns for each of the given blobs the oldest commit of any
+//local ref that added it
+func (repo *Repository) firstCommits(refs map[string][]chunkID) (first map[string]seenCommit, err error) {
+	first = map[string]seenCommit{}
+	if len(refs) == 0 {
+		return first, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(repo.Git(context.Background(), nil, pw, "log", "--all", "--reverse", "--topo-order", "-m", "--raw", "--no-abbrev", "--no-renames", "--format=commit %H"))
+	}()
+
+	defer pr.Close()
+	commit := seenCommit{order: -1}
+	s := bufio.NewScanner(pr)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "commit ") {
+			commit = seenCommit{id: strings.TrimPrefix(line, "commit "), order: commit.order + 1}
+			continue
+		}
+
+		//:<old mode> <new mode> <old blob> <new blob> <status>\t<path>
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		blob := fields[3]
+		if _, ok := refs[blob]; !ok {
+			continue
+		}
+
+		if _, ok := first[blob]; !ok {
+			first[blob] = commit
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+
+	return first, nil
+}
+
+//ExportIndex writes all known chunks (see IndexEntries) to 'w' in the
+//given format
+func (repo *Repository) ExportIndex(w io.Writer, format string) (err error) {
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unsupported export format '%s', expected one of: %v", format, IndexExportFormats)
+	}
+
+	entries, err := repo.IndexEntries()
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if entries == nil {
+			entries = []IndexEntry{}
+		}
+
+		return enc.Encode(entries)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "size", "local", "remote", "refcount", "first_seen"})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.Key,
+			strconv.FormatInt(e.Size, 10),
+			strconv.FormatBool(e.Local),
+			strconv.FormatBool(e.Remote),
+			strconv.Itoa(e.RefCount),
+			e.FirstSeen,
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
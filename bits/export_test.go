@@ -0,0 +1,62 @@
+package bits
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+//KeyVersionTest is a key version that only the tests support, its chunks
+//are encrypted with AES in CTR mode such that reading them as version 0
+//reads garbage
+const KeyVersionTest KeyVersion = 0x7f
+
+func init() {
+	keyVersionStreams[KeyVersionTest] = func(k K) (cipher.Stream, error) {
+		block, err := aes.NewCipher(k[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher for key '%x': %v", k, err)
+		}
+
+		var iv [aes.BlockSize]byte
+		return cipher.NewCTR(block, iv[:]), nil
+	}
+}
+
+//UseS3Server sends the requests for the bucket, and its replicas, to the
+//server at 'addr' over plain http, such that tests can stub s3
+func (s *S3Remote) UseS3Server(addr string) {
+	for _, b := range append([]*s3gof3r.Bucket{s.bucket}, s.replicas...) {
+		b.Scheme = "http"
+		rt := b.Client.Transport
+		if rp, ok := rt.(*requestPayer); ok {
+			rt = rp.next
+		}
+
+		t := rt.(*http.Transport)
+		t.Proxy = nil
+		t.DialContext = func(ctx context.Context, netw, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, netw, addr)
+		}
+	}
+}
+
+//ClaimChunk exposes claimChunk to the tests
+func (s *S3Remote) ClaimChunk(k K) (claimed bool, err error) {
+	return s.claimChunk(KeyVersion0, k)
+}
+
+//ReleaseChunk exposes releaseChunk to the tests
+func (s *S3Remote) ReleaseChunk(k K) error {
+	return s.releaseChunk(KeyVersion0, k)
+}
+
+//ChunkPath exposes chunkPath to the tests
+func (repo *Repository) ChunkPath(v KeyVersion, k K) (p string, err error) {
+	return repo.chunkPath(v, k, false)
+}
@@ -0,0 +1,79 @@
+package bits
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	//FetchLockSuffix is appended to the path of a chunk while a process is
+	//fetching it, other processes that need it wait for the result instead
+	//of downloading it as well
+	FetchLockSuffix = ".lock"
+
+	//FetchLockTimeout is how long a lock can go without being refreshed
+	//before it is considered to be left behind by a process that died
+	FetchLockTimeout = 30 * time.Second
+
+	//FetchLockPoll is how often a waiting process checks whether the chunk
+	//was fetched or the lock released
+	FetchLockPoll = 50 * time.Millisecond
+)
+
+//lockChunk makes sure only a single process fetches the chunk at path 'p'.
+//It either takes the lock, to be released with 'unlock', or waits until
+//the process that holds it is done. 'fetched' reports whether the chunk was
+//stored meanwhile, if the other process failed the lock is taken such that
+//the caller can try on its own.
+func (repo *Repository) lockChunk(p string) (unlock func(), fetched bool, err error) {
+	lockp := p + FetchLockSuffix
+	for {
+		f, err := repo.openFile(lockp, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+		if err == nil {
+			f.Close()
+			return refreshLock(lockp), false, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, false, fmt.Errorf("failed to lock chunk: %v", err)
+		}
+
+		if _, err = os.Stat(p); err == nil {
+			return nil, true, nil
+		}
+
+		//a lock that isn't refreshed is taken over
+		fi, err := os.Stat(lockp)
+		if err == nil && time.Since(fi.ModTime()) > FetchLockTimeout {
+			os.Remove(lockp)
+			continue
+		}
+
+		time.Sleep(FetchLockPoll)
+	}
+}
+
+//refreshLock keeps the lock at 'lockp' from timing out until the returned
+//function is called, which releases it
+func refreshLock(lockp string) (unlock func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(FetchLockTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				os.Chtimes(lockp, now, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		os.Remove(lockp)
+	}
+}
@@ -0,0 +1,159 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+//FsckReport describes the outcome of checking (a sample of) the chunks
+type FsckReport struct {
+
+	//chunks that could have been checked, the population that is sampled
+	Total int
+
+	//chunks that were checked
+	Checked int
+
+	//chunks of which the content doesn't match their key
+	Corrupt int
+
+	//chunks that couldn't be read
+	Missing int
+}
+
+//Bad returns the number of checked chunks that are corrupt or missing
+func (r FsckReport) Bad() int {
+	return r.Corrupt + r.Missing
+}
+
+//Estimate extrapolates how many of all chunks are bad from the sample,
+//with the upper bound of its 95% (Wilson score) confidence interval
+func (r FsckReport) Estimate() (bad, upper float64) {
+	if r.Checked == 0 {
+		return 0, 0
+	}
+
+	n := float64(r.Checked)
+	p := float64(r.Bad()) / n
+	z := 1.96
+	center := (p + z*z/(2*n)) / (1 + z*z/n)
+	margin := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n)) / (1 + z*z/n)
+	return p * float64(r.Total), math.Min(1, center+margin) * float64(r.Total)
+}
+
+//Fsck checks that chunks decrypt to content that hashes to their key. It
+//checks the chunks in the local chunk directory or, with 'remote', those
+//in the remote that are referenced by any local branch or tag. Only a
+//random 'sample' percentage of them is downloaded and checked, bad chunks
+//are written to 'w'. It checks up to 'concurrency' chunks in parallel, if
+//its zero FetchConcurrency is used.
+func (repo *Repository) Fsck(w io.Writer, remote bool, sample float64, concurrency int) (report FsckReport, err error) {
+	_, end := repo.trace(context.Background(), "fsck", SpanAttr{"remote", remote}, SpanAttr{"sample", sample})
+	defer end(&err)
+	if sample <= 0 || sample > 100 {
+		return report, fmt.Errorf("invalid sample percentage %v, expected more than 0 and at most 100", sample)
+	}
+
+	if remote && repo.currentRemote() == nil {
+		return report, fmt.Errorf("unable to check the remote, no remote configured")
+	}
+
+	if concurrency < 1 {
+		concurrency = FetchConcurrency
+	}
+
+	ids := []chunkID{}
+	if remote {
+		buf := bytes.NewBuffer(nil)
+		err = repo.ScanAll(buf)
+		if err != nil {
+			return report, fmt.Errorf("failed to scan for referenced chunks: %v", err)
+		}
+
+		err = repo.forEachChunk(buf, func(c PointerChunk) error {
+			ids = append(ids, c.id())
+			return nil
+		})
+	} else {
+		err = repo.walkAllChunks(func(id chunkID, fi os.FileInfo) error {
+			ids = append(ids, id)
+			return nil
+		})
+	}
+
+	if err != nil {
+		return report, fmt.Errorf("failed to list chunks: %v", err)
+	}
+
+	//check a random selection, but at least one chunk
+	report.Total = len(ids)
+	n := int(math.Ceil(float64(len(ids)) * sample / 100))
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	rnd.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	ids = ids[:n]
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	idCh := make(chan chunkID)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range idCh {
+				missing, err := repo.fsckChunk(id, remote)
+				mu.Lock()
+				report.Checked++
+				if err != nil {
+					if missing {
+						report.Missing++
+						fmt.Fprintf(w, "%s missing: %v\n", id, err)
+					} else {
+						report.Corrupt++
+						fmt.Fprintf(w, "%s corrupt: %v\n", id, err)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, id := range ids {
+		idCh <- id
+	}
+
+	close(idCh)
+	wg.Wait()
+	return report, nil
+}
+
+//fsckChunk reads chunk 'id' locally or from the remote and verifies its
+//content, 'missing' reports whether it couldn't be read at all
+func (repo *Repository) fsckChunk(id chunkID, remote bool) (missing bool, err error) {
+	var rc io.ReadCloser
+	if remote {
+		rc, err = remoteChunkReader(repo.currentRemote(), id.v, id.k)
+	} else {
+		p, _ := repo.chunkPath(id.v, id.k, false)
+		rc, err = os.Open(p)
+	}
+
+	if err != nil {
+		return true, err
+	}
+
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return true, fmt.Errorf("failed to read chunk: %v", err)
+	}
+
+	return false, verifyChunk(id.v, id.k, data)
+}
@@ -0,0 +1,292 @@
+package bits
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	//GatewayMaxKeys is the most objects a single listing returns, s3 clients
+	//ask for the next page with a continuation token
+	GatewayMaxKeys = 1000
+)
+
+//Gateway serves the chunks that the files in the tree of a ref are made of
+//over a minimal S3-compatible API, such that tools that only speak S3 can
+//read them. The chunk keys (as FormatKey lists them) are the object names
+//of a single bucket. Chunks
+//are served raw (encrypted, as stored in the remote) or decrypted, those
+//that are not stored locally are fetched from the remote first. The
+//gateway is read-only and doesn't authenticate requests.
+type Gateway struct {
+	repo    *Repository
+	ref     string
+	bucket  string
+	decrypt bool
+
+	//the chunks in the tree of the ref with their plain-text sizes, by
+	//object name
+	chunks map[string]PointerChunk
+	names  []string
+}
+
+//NewGateway lists the chunks in the tree of 'ref' and sets up a http handler
+//that serves them as the objects of bucket 'bucket'. With 'decrypt' the
+//plain-text content of chunks is served.
+func NewGateway(repo *Repository, ref, bucket string, decrypt bool) (gw *Gateway, err error) {
+	gw = &Gateway{repo: repo, ref: ref, bucket: bucket, decrypt: decrypt, chunks: map[string]PointerChunk{}}
+	err = repo.ForEachPointer(ref, nil, func(p string, ptr *Pointer) error {
+		for _, c := range ptr.Chunks {
+			name := FormatKey(c.Version, c.K)
+			if _, ok := gw.chunks[name]; ok {
+				continue
+			}
+
+			//encryption doesn't change the size, only chunks of pointers
+			//that don't record it need to be fetched for it
+			if c.Size < 0 {
+				c.Size, err = repo.localChunkSize(c.Version, c.K)
+				if err != nil {
+					return err
+				}
+			}
+
+			gw.chunks[name] = c
+			gw.names = append(gw.names, name)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks of '%s': %v", ref, err)
+	}
+
+	sort.Strings(gw.names)
+	return gw, nil
+}
+
+//Serve serves the gateway on listener 'l' until the context is cancelled
+func (gw *Gateway) Serve(ctx context.Context, l net.Listener) (err error) {
+	srv := &http.Server{Handler: gw}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return srv.Shutdown(context.Background())
+	case err = <-errCh:
+		return err
+	}
+}
+
+//Len returns how many chunks the gateway serves
+func (gw *Gateway) Len() int {
+	return len(gw.names)
+}
+
+//s3Error is the body of error responses
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+//writeError writes an error response in the format s3 clients expect
+func (gw *Gateway) writeError(w http.ResponseWriter, r *http.Request, code int, s3code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(s3Error{Code: s3code, Message: msg, Resource: r.URL.Path})
+}
+
+//ServeHTTP serves the bucket listing at /<bucket> and the chunks at
+///<bucket>/<hex key>, only GET and HEAD are allowed
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		gw.writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "the gateway is read-only")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != gw.bucket {
+		gw.writeError(w, r, http.StatusNotFound, "NoSuchBucket", fmt.Sprintf("the gateway only serves bucket '%s'", gw.bucket))
+		return
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		gw.serveListing(w, r)
+		return
+	}
+
+	c, ok := gw.chunks[strings.ToLower(parts[1])]
+	if !ok {
+		gw.writeError(w, r, http.StatusNotFound, "NoSuchKey", fmt.Sprintf("'%s' is not a chunk of '%s'", parts[1], gw.ref))
+		return
+	}
+
+	gw.serveChunk(w, r, c)
+}
+
+//serveChunk writes chunk 'c', raw or decrypted, fetching it if necessary
+func (gw *Gateway) serveChunk(w http.ResponseWriter, r *http.Request, c PointerChunk) {
+	k := c.K
+	err := gw.repo.fetchChunks(context.Background(), c)
+	if err != nil {
+		gw.writeError(w, r, http.StatusBadGateway, "InternalError", fmt.Sprintf("failed to fetch chunk: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, FormatKey(c.Version, k)))
+	if !gw.decrypt {
+		p, _ := gw.repo.chunkPath(c.Version, k, false)
+		f, err := os.Open(p)
+		if err != nil {
+			gw.writeError(w, r, http.StatusInternalServerError, "InternalError", "failed to open chunk")
+			return
+		}
+
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			gw.writeError(w, r, http.StatusInternalServerError, "InternalError", "failed to stat chunk")
+			return
+		}
+
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+		return
+	}
+
+	//decrypted content can't be seeked so ranges are not supported
+	w.Header().Set("Content-Length", strconv.FormatInt(c.Size, 10))
+	if r.Method == "HEAD" {
+		return
+	}
+
+	rc, err := gw.repo.chunkReader(c.Version, k)
+	if err != nil {
+		gw.writeError(w, r, http.StatusInternalServerError, "InternalError", "failed to open chunk")
+		return
+	}
+
+	defer rc.Close()
+	io.Copy(w, rc)
+}
+
+//serveListing writes a page of the chunks of the ref in the format of
+//ListObjectsV2, or of ListObjects when 'list-type' isn't 2
+func (gw *Gateway) serveListing(w http.ResponseWriter, r *http.Request) {
+	type object struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+
+	v := struct {
+		XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name                  string   `xml:"Name"`
+		Prefix                string   `xml:"Prefix"`
+		Marker                *string  `xml:"Marker,omitempty"`
+		NextMarker            string   `xml:"NextMarker,omitempty"`
+		KeyCount              *int     `xml:"KeyCount,omitempty"`
+		MaxKeys               int      `xml:"MaxKeys"`
+		IsTruncated           bool     `xml:"IsTruncated"`
+		ContinuationToken     string   `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+		Contents              []object `xml:"Contents"`
+	}{Name: gw.bucket}
+
+	q := r.URL.Query()
+	v.Prefix = q.Get("prefix")
+	v.MaxKeys = GatewayMaxKeys
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			gw.writeError(w, r, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("invalid max-keys '%s'", mk))
+			return
+		}
+
+		if n < v.MaxKeys {
+			v.MaxKeys = n
+		}
+	}
+
+	v2 := q.Get("list-type") == "2"
+	after := q.Get("marker")
+	if v2 {
+		v.ContinuationToken = q.Get("continuation-token")
+		after = q.Get("start-after")
+		if v.ContinuationToken != "" {
+			after = v.ContinuationToken
+		}
+	} else {
+		v.Marker = &after
+	}
+
+	//chunks don't change while the gateway runs, so any time will do
+	modified := time.Unix(0, 0).UTC().Format("2006-01-02T15:04:05.000Z")
+	i := sort.SearchStrings(gw.names, after)
+	for ; i < len(gw.names); i++ {
+		name := gw.names[i]
+		if name <= after || !strings.HasPrefix(name, v.Prefix) {
+			continue
+		}
+
+		if len(v.Contents) == v.MaxKeys {
+			v.IsTruncated = true
+			break
+		}
+
+		v.Contents = append(v.Contents, object{
+			Key:          name,
+			LastModified: modified,
+			ETag:         fmt.Sprintf(`"%s"`, name),
+			Size:         gw.chunks[name].Size,
+			StorageClass: "STANDARD",
+		})
+	}
+
+	if v.IsTruncated && len(v.Contents) > 0 {
+		last := v.Contents[len(v.Contents)-1].Key
+		if v2 {
+			v.NextContinuationToken = last
+		} else {
+			v.NextMarker = last
+		}
+	}
+
+	if v2 {
+		n := len(v.Contents)
+		v.KeyCount = &n
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	io.WriteString(w, xml.Header)
+	err := xml.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Fprintf(gw.repo.output, "failed to write listing of '%s': %v\n", gw.ref, err)
+	}
+}
@@ -0,0 +1,354 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//ChunkRefBucket records which blobs reference each chunk, keyed by the
+	//store key of the chunk followed by the id of the blob, with the time it
+	//was recorded. The number of keys with a chunk's prefix is its
+	//reference count.
+	ChunkRefBucket = []byte("chunk-refs")
+
+	//GCGracePeriod is how long references are kept after they are recorded,
+	//the blob of a file that was just split may not be written yet
+	GCGracePeriod = time.Hour
+)
+
+//touchChunk records that the chunk file at 'p' was used, the access time
+//isn't relied upon as file systems are often mounted without it
+func touchChunk(p string) {
+	now := time.Now()
+	os.Chtimes(p, now, now)
+}
+
+//chunkRefKey returns the key under which the reference of 'blob' to chunk
+//'id' is recorded
+func chunkRefKey(id chunkID, blob string) []byte {
+	return append(id.storeKey(), blob...)
+}
+
+//recordRefs records that the given blobs reference the chunks
+func (repo *Repository) recordRefs(store *bolt.DB, refs map[string][]chunkID) (err error) {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	now := []byte(time.Now().UTC().Format(time.RFC3339))
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ChunkRefBucket)
+		for blob, ids := range refs {
+			for _, id := range ids {
+				err := b.Put(chunkRefKey(id, blob), now)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to record chunk references: %v", err)
+	}
+
+	return nil
+}
+
+//flushRefs records the references of the blobs that were scanned since
+//the last flush, and folds in the staged log as the store may have been
+//open while files were split
+func (repo *Repository) flushRefs(store *bolt.DB) (err error) {
+	err = repo.foldStagedLog(store)
+	if err != nil {
+		return err
+	}
+
+	repo.refsMu.Lock()
+	refs := repo.scannedRefs
+	repo.scannedRefs = nil
+	repo.refsMu.Unlock()
+	return repo.recordRefs(store, refs)
+}
+
+//blobID returns the id git gives to a blob with the given content, using
+//the object format of the repository
+func (repo *Repository) blobID(data []byte) (id string, err error) {
+	repo.objectFormatOnce.Do(func() {
+		buf := bytes.NewBuffer(nil)
+		err := repo.Git(context.Background(), nil, buf, "rev-parse", "--show-object-format")
+		repo.objectFormat = strings.TrimSpace(buf.String())
+		if err != nil || repo.objectFormat == "" {
+			repo.objectFormat = "sha1" //git versions that predate other formats
+		}
+	})
+
+	var h hash.Hash
+	switch repo.objectFormat {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return "", fmt.Errorf("unsupported object format '%s'", repo.objectFormat)
+	}
+
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//missingBlobs returns which of the given blobs git no longer stores
+func (repo *Repository) missingBlobs(blobs []string) (missing map[string]bool, err error) {
+	in := bytes.NewBuffer(nil)
+	for _, blob := range blobs {
+		fmt.Fprintf(in, "%s\n", blob)
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), in, out, "cat-file", "--batch-check")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check blobs: %v", err)
+	}
+
+	missing = map[string]bool{}
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[1] == "missing" {
+			missing[fields[0]] = true
+		}
+	}
+
+	return missing, s.Err()
+}
+
+//GC removes local chunks that are no longer referenced: all blobs that
+//referenced them, as recorded when splitting and scanning, were removed
+//by git (e.g. by 'git gc'). References that were recorded and chunks that
+//were staged less than GCGracePeriod ago are kept. Chunks that were never
+//split or scanned in this clone are kept as well, as are chunks that are
+//staged but not pushed: they are not stored anywhere else. With 'bits.cache-ttl'
+//configured, chunks that weren't used for that long are also removed if
+//the index confirms the remote stores them. With 'dryRun' chunks are only
+//listed. It returns the number of chunks removed and bytes freed.
+func (repo *Repository) GC(w io.Writer, dryRun bool) (removed int, freed int64, err error) {
+	store, release, err := repo.sharedStore()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer release()
+	err = repo.foldStagedLog(store)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	//reference counts and who references them, from the bucket alone
+	counts := map[chunkID]int{}
+	refs := map[string][][]byte{}
+	expired := map[string]bool{}
+	err = store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ChunkRefBucket).ForEach(func(key, v []byte) error {
+			id, rest := parseStoreKey(key)
+			blob := string(rest)
+			counts[id]++
+			refs[blob] = append(refs[blob], append([]byte{}, key...))
+
+			recorded, err := time.Parse(time.RFC3339, string(v))
+			if err != nil || time.Since(recorded) > GCGracePeriod {
+				expired[blob] = true
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read chunk references: %v", err)
+	}
+
+	staged, err := repo.stagedChunks(store)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	blobs := []string{}
+	for blob := range refs {
+		if expired[blob] {
+			blobs = append(blobs, blob)
+		}
+	}
+
+	missing, err := repo.missingBlobs(blobs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	//references of removed blobs are dropped, chunks that have none left
+	//are removed
+	stale := map[chunkID][][]byte{}
+	for blob := range missing {
+		for _, key := range refs[blob] {
+			id, _ := parseStoreKey(key)
+			counts[id]--
+			stale[id] = append(stale[id], key)
+		}
+	}
+
+	gone := map[chunkID]bool{}
+	for id, n := range counts {
+		if n > 0 {
+			continue
+		}
+
+		//the references are kept such that it is removed once pushed
+		if staged[id] {
+			delete(stale, id)
+			continue
+		}
+
+		p, err := repo.chunkPath(id.v, id.k, false)
+		if err != nil {
+			return removed, freed, err
+		}
+
+		fi, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, freed, fmt.Errorf("failed to stat chunk '%s': %v", id, err)
+		}
+
+		//the references are kept such that it is removed by a later run
+		if time.Since(fi.ModTime()) < GCGracePeriod {
+			delete(stale, id)
+			continue
+		}
+
+		err = repo.removeChunk(w, id, p, dryRun)
+		if err != nil {
+			return removed, freed, err
+		}
+
+		gone[id] = true
+		removed++
+		freed += fi.Size()
+	}
+
+	if repo.conf.CacheTTL > 0 {
+		var n int
+		var size int64
+		n, size, err = repo.evictStale(store, w, dryRun, gone)
+		removed += n
+		freed += size
+		if err != nil {
+			return removed, freed, err
+		}
+	}
+
+	if dryRun {
+		return removed, freed, nil
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ChunkRefBucket)
+		for _, keys := range stale {
+			for _, key := range keys {
+				err := b.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return removed, freed, fmt.Errorf("failed to drop chunk references: %v", err)
+	}
+
+	return removed, freed, nil
+}
+
+//removeChunk removes the local chunk 'id' at path 'p' and writes its key
+//to 'w', with 'dryRun' it is only written
+func (repo *Repository) removeChunk(w io.Writer, id chunkID, p string, dryRun bool) (err error) {
+	fmt.Fprintf(w, "%s\n", id)
+	if dryRun {
+		return nil
+	}
+
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove chunk '%s': %v", id, err)
+	}
+
+	return nil
+}
+
+//evictStale removes local chunks that were not used for the configured
+//cache ttl, only if the index confirms that the remote stores them. Chunks
+//in 'gone' were removed already.
+func (repo *Repository) evictStale(store *bolt.DB, w io.Writer, dryRun bool, gone map[chunkID]bool) (removed int, freed int64, err error) {
+	stale := map[chunkID]os.FileInfo{}
+	err = repo.walkAllChunks(func(id chunkID, fi os.FileInfo) error {
+		if !gone[id] && time.Since(fi.ModTime()) > repo.conf.CacheTTL {
+			stale[id] = fi
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to walk local chunks: %v", err)
+	}
+
+	err = store.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(IndexBucket)
+		for id := range stale {
+			if c := b.Get(id.storeKey()); c == nil || !bytes.Equal(c, RemoteChunk) {
+				delete(stale, id)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read index: %v", err)
+	}
+
+	for id, fi := range stale {
+		p, err := repo.chunkPath(id.v, id.k, false)
+		if err != nil {
+			return removed, freed, err
+		}
+
+		err = repo.removeChunk(w, id, p, dryRun)
+		if err != nil {
+			return removed, freed, err
+		}
+
+		removed++
+		freed += fi.Size()
+	}
+
+	return removed, freed, nil
+}
@@ -0,0 +1,63 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+//Get fetches chunk 'k' of key version 'v' into the local chunk directory
+//unless it is stored there already, with 'force' a local copy (e.g. a
+//corrupt one) is replaced. The chunk is verified against its key and, if
+//'w' is not nil, its decrypted content is written to it. The local path of
+//the chunk is returned.
+func (repo *Repository) Get(v KeyVersion, k K, force bool, w io.Writer) (p string, err error) {
+	ctx, end := repo.trace(context.Background(), "get", SpanAttr{"chunk.key", FormatKey(v, k)})
+	defer end(&err)
+	p, err = repo.chunkPath(v, k, false)
+	if err != nil {
+		return "", err
+	}
+
+	if force {
+		err = os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to remove local chunk '%x': %v", k, err)
+		}
+	}
+
+	err = repo.fetch(ctx, bytes.NewBufferString(FormatKey(v, k)+"\n"), ioutil.Discard)
+	if err != nil {
+		return "", withKind(KindOf(err), fmt.Errorf("failed to fetch chunk '%x': %v", k, err))
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to read chunk '%x': %v", k, err)
+	}
+
+	err = verifyChunk(v, k, data)
+	if err != nil {
+		return p, withKind(VerificationError, fmt.Errorf("chunk '%x' at '%s' is corrupt, fetch it again with --force: %v", k, p, err))
+	}
+
+	if w == nil {
+		return p, nil
+	}
+
+	rc, err := repo.chunkReader(v, k)
+	if err != nil {
+		return p, err
+	}
+
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		return p, fmt.Errorf("failed to write chunk '%x': %v", k, err)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,522 @@
+package bits
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/nerdalize/git-bits/bits/chunkpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	//GRPCPartSize is the size of the parts that chunks are streamed in
+	GRPCPartSize = 256 * 1024
+
+	//GRPCListBatchSize is how many keys are sent per message when listing
+	GRPCListBatchSize = 1000
+)
+
+//GRPCRemote uses a grpc chunk service as the remote, such that chunks can
+//be stored behind a service that authenticates clients in its own way
+//@see chunkpb/chunks.proto
+type GRPCRemote struct {
+	conn   *grpc.ClientConn
+	client chunkpb.ChunksClient
+}
+
+//NewGRPCRemote connects to the chunk service at the configured address. It
+//uses tls, trusting the configured ca bundle, unless plaintext is configured
+//and sends the configured token with every call.
+func NewGRPCRemote(conf *Conf) (remote *GRPCRemote, err error) {
+	opts := []grpc.DialOption{}
+	if conf.GRPCPlaintext {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		tlsConf, err := conf.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
+	}
+
+	if conf.GRPCToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken{token: conf.GRPCToken, secure: !conf.GRPCPlaintext}))
+	}
+
+	conn, err := grpc.Dial(conf.GRPCAddress, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to chunk service '%s': %v", conf.GRPCAddress, err)
+	}
+
+	return &GRPCRemote{conn: conn, client: chunkpb.NewChunksClient(conn)}, nil
+}
+
+//Close closes the connection to the chunk service
+func (g *GRPCRemote) Close() error {
+	return g.conn.Close()
+}
+
+//ChunkReader returns the content of the chunk with the given key
+func (g *GRPCRemote) ChunkReader(k K) (rc io.ReadCloser, err error) {
+	return g.chunkReaderFrom(k, 0)
+}
+
+//chunkReaderFrom streams the content of the chunk starting at offset 'off'
+func (g *GRPCRemote) chunkReaderFrom(k K, off int64) (rc io.ReadCloser, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := g.client.Get(ctx, &chunkpb.GetRequest{Key: k[:], Offset: off})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to get chunk '%x': %v", k, err)
+	}
+
+	//the first part is received right away such that a missing chunk is
+	//reported here instead of when reading
+	r := &grpcChunkReader{stream: stream, cancel: cancel}
+	err = r.recv()
+	if err != nil && err != io.EOF {
+		cancel()
+		return nil, fmt.Errorf("failed to get chunk '%x': %v", k, err)
+	}
+
+	return r, nil
+}
+
+//ChunkWriter returns a writer that streams the chunk to the service, it is
+//stored once the writer is closed
+func (g *GRPCRemote) ChunkWriter(k K) (wc io.WriteCloser, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := g.client.Put(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to put chunk '%x': %v", k, err)
+	}
+
+	return &grpcChunkWriter{stream: stream, cancel: cancel, k: k}, nil
+}
+
+//ListChunks writes the keys of all stored chunks to 'w', one per line
+func (g *GRPCRemote) ListChunks(w io.Writer) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := g.client.List(ctx, &chunkpb.ListRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list chunks: %v", err)
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to list chunks: %v", err)
+		}
+
+		for _, k := range resp.Keys {
+			_, err = fmt.Fprintf(w, "%x\n", k)
+			if err != nil {
+				return fmt.Errorf("failed to write key: %v", err)
+			}
+		}
+	}
+}
+
+//DeleteChunks is not supported by the chunk service, chunks are only
+//removed by whoever runs it
+func (g *GRPCRemote) DeleteChunks(ks []K) (err error) {
+	return ErrDeleteNotSupported
+}
+
+//hasChunk returns whether the service stores the chunk, it only stores
+//chunks of version 0
+func (g *GRPCRemote) hasChunk(v KeyVersion, k K) (ok bool, err error) {
+	if v != KeyVersion0 {
+		return false, nil
+	}
+
+	resp, err := g.client.Has(context.Background(), &chunkpb.HasRequest{Key: k[:]})
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Stored, nil
+}
+
+//grpcChunkReader reads the parts of a chunk from the stream
+type grpcChunkReader struct {
+	stream chunkpb.Chunks_GetClient
+	cancel func()
+	buf    []byte
+}
+
+func (r *grpcChunkReader) recv() error {
+	part, err := r.stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	r.buf = part.Data
+	return nil
+}
+
+func (r *grpcChunkReader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		err = r.recv()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *grpcChunkReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+//grpcChunkWriter sends what is written in parts of at most GRPCPartSize,
+//the first part holds the key of the chunk
+type grpcChunkWriter struct {
+	stream chunkpb.Chunks_PutClient
+	cancel func()
+	k      K
+	sent   bool
+}
+
+func (w *grpcChunkWriter) send(data []byte) error {
+	req := &chunkpb.PutRequest{Data: data}
+	if !w.sent {
+		req.Key = w.k[:]
+	}
+
+	w.sent = true
+	return w.stream.Send(req)
+}
+
+func (w *grpcChunkWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		part := p
+		if len(part) > GRPCPartSize {
+			part = part[:GRPCPartSize]
+		}
+
+		err = w.send(part)
+		if err != nil {
+			return n, fmt.Errorf("failed to send chunk '%x': %v", w.k, err)
+		}
+
+		n += len(part)
+		p = p[len(part):]
+	}
+
+	return n, nil
+}
+
+func (w *grpcChunkWriter) Close() (err error) {
+	defer w.cancel()
+	if !w.sent {
+		err = w.send(nil)
+		if err != nil {
+			return fmt.Errorf("failed to send chunk '%x': %v", w.k, err)
+		}
+	}
+
+	_, err = w.stream.CloseAndRecv()
+	if err != nil {
+		return fmt.Errorf("failed to store chunk '%x': %v", w.k, err)
+	}
+
+	return nil
+}
+
+//bearerToken sends a token with every call
+type bearerToken struct {
+	token  string
+	secure bool
+}
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+//GRPCChunkServer implements the chunk service on top of another remote,
+//e.g. a DirRemote
+type GRPCChunkServer struct {
+	chunkpb.UnimplementedChunksServer
+	remote  Remote
+	token   string
+	metrics *Metrics
+}
+
+//NewGRPCChunkServer serves the chunks of 'remote', if 'token' is not empty
+//clients must send it as a bearer token
+func NewGRPCChunkServer(remote Remote, token string) *GRPCChunkServer {
+	return &GRPCChunkServer{remote: remote, token: token}
+}
+
+//SetMetrics makes the server count the calls it handles in 'm'
+func (srv *GRPCChunkServer) SetMetrics(m *Metrics) {
+	srv.metrics = m
+}
+
+//count records a handled call in the metrics
+func (srv *GRPCChunkServer) count(method string, err error) {
+	code := status.Code(err)
+	srv.metrics.Add("git_bits_requests_total", 1, "mode", "serve-grpc", "method", method, "code", code.String())
+	if code == codes.Internal || code == codes.Unknown {
+		srv.metrics.Add("git_bits_errors_total", 1, "mode", "serve-grpc")
+	}
+}
+
+//Serve serves the chunk service on listener 'l' until the context is
+//cancelled, connections use tls if 'tlsConf' is not nil
+func (srv *GRPCChunkServer) Serve(ctx context.Context, l net.Listener, tlsConf *tls.Config) (err error) {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			var resp interface{}
+			err := srv.authorize(ctx)
+			if err == nil {
+				resp, err = handler(ctx, req)
+			}
+
+			srv.count(path.Base(info.FullMethod), err)
+			return resp, err
+		}),
+		grpc.StreamInterceptor(func(s interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			err := srv.authorize(ss.Context())
+			if err == nil {
+				err = handler(s, ss)
+			}
+
+			srv.count(path.Base(info.FullMethod), err)
+			return err
+		}),
+	}
+
+	if tlsConf != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+	}
+
+	s := grpc.NewServer(opts...)
+	chunkpb.RegisterChunksServer(s, srv)
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+
+	return s.Serve(l)
+}
+
+//authorize checks the bearer token of a call
+func (srv *GRPCChunkServer) authorize(ctx context.Context) error {
+	if srv.token == "" {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if auth == "Bearer "+srv.token {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+}
+
+//parseKey returns the key in a request
+func parseKey(data []byte) (k K, err error) {
+	if len(data) != KeySize {
+		return k, status.Errorf(codes.InvalidArgument, "expected a key of %d bytes, got %d", KeySize, len(data))
+	}
+
+	copy(k[:], data)
+	return k, nil
+}
+
+//Get streams the content of a chunk
+func (srv *GRPCChunkServer) Get(req *chunkpb.GetRequest, stream chunkpb.Chunks_GetServer) (err error) {
+	k, err := parseKey(req.Key)
+	if err != nil {
+		return err
+	}
+
+	if has, ok := unwrapRemote(srv.remote).(chunkHaser); ok {
+		stored, err := has.hasChunk(KeyVersion0, k)
+		if err == nil && !stored {
+			srv.metrics.Add("git_bits_cache_misses_total", 1, "mode", "serve-grpc")
+			return status.Errorf(codes.NotFound, "chunk '%x' is not stored", k)
+		}
+	}
+
+	var rc io.ReadCloser
+	if rr, ok := unwrapRemote(srv.remote).(chunkRangeReader); ok {
+		rc, err = rr.chunkReaderFrom(k, req.Offset)
+	} else {
+		rc, err = srv.remote.ChunkReader(k)
+		if err == nil {
+			_, err = io.CopyN(ioutil.Discard, rc, req.Offset)
+		}
+	}
+
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read chunk '%x': %v", k, err)
+	}
+
+	defer rc.Close()
+	srv.metrics.Add("git_bits_cache_hits_total", 1, "mode", "serve-grpc")
+	buf := make([]byte, GRPCPartSize)
+	for {
+		n, err := io.ReadFull(rc, buf)
+		if n > 0 {
+			serr := stream.Send(&chunkpb.ChunkData{Data: buf[:n]})
+			if serr != nil {
+				return serr
+			}
+
+			srv.metrics.Add("git_bits_bytes_sent_total", float64(n), "mode", "serve-grpc")
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read chunk '%x': %v", k, err)
+		}
+	}
+}
+
+//Put stores a chunk once all its parts are received
+func (srv *GRPCChunkServer) Put(stream chunkpb.Chunks_PutServer) (err error) {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	k, err := parseKey(req.Key)
+	if err != nil {
+		return err
+	}
+
+	wc, err := srv.remote.ChunkWriter(k)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to write chunk '%x': %v", k, err)
+	}
+
+	for {
+		srv.metrics.Add("git_bits_bytes_received_total", float64(len(req.Data)), "mode", "serve-grpc")
+		_, err = wc.Write(req.Data)
+		if err != nil {
+			wc.Close()
+			return status.Errorf(codes.Internal, "failed to write chunk '%x': %v", k, err)
+		}
+
+		req, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		//the writer isn't closed, such that a partial chunk isn't stored
+		if err != nil {
+			return err
+		}
+	}
+
+	err = wc.Close()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to store chunk '%x': %v", k, err)
+	}
+
+	return stream.SendAndClose(&chunkpb.PutResponse{})
+}
+
+//List streams the keys of all stored chunks in batches
+func (srv *GRPCChunkServer) List(req *chunkpb.ListRequest, stream chunkpb.Chunks_ListServer) (err error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(srv.remote.ListChunks(pw))
+	}()
+
+	defer pr.Close()
+	resp := &chunkpb.ListResponse{}
+	s := bufio.NewScanner(pr)
+	for s.Scan() {
+		data, err := hex.DecodeString(strings.TrimSpace(s.Text()))
+		if err != nil || (len(data) != KeySize && len(data) != KeySize+1) {
+			return status.Errorf(codes.Internal, "unexpected key '%s' listed", s.Text())
+		}
+
+		//the service only stores chunks of version 0
+		if len(data) != KeySize {
+			continue
+		}
+
+		resp.Keys = append(resp.Keys, data)
+		if len(resp.Keys) >= GRPCListBatchSize {
+			err = stream.Send(resp)
+			if err != nil {
+				return err
+			}
+
+			resp = &chunkpb.ListResponse{}
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return status.Errorf(codes.Internal, "failed to list chunks: %v", err)
+	}
+
+	if len(resp.Keys) > 0 {
+		return stream.Send(resp)
+	}
+
+	return nil
+}
+
+//Has returns whether a chunk is stored
+func (srv *GRPCChunkServer) Has(ctx context.Context, req *chunkpb.HasRequest) (resp *chunkpb.HasResponse, err error) {
+	k, err := parseKey(req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if has, ok := unwrapRemote(srv.remote).(chunkHaser); ok {
+		stored, err := has.hasChunk(KeyVersion0, k)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check chunk '%x': %v", k, err)
+		}
+
+		return &chunkpb.HasResponse{Stored: stored}, nil
+	}
+
+	rc, err := srv.remote.ChunkReader(k)
+	if err != nil {
+		return &chunkpb.HasResponse{Stored: false}, nil
+	}
+
+	rc.Close()
+	return &chunkpb.HasResponse{Stored: true}, nil
+}
@@ -0,0 +1,101 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//RawPointer is a staged file that holds a pointer which git-bits didn't
+//write for it, committing it would spread a file that other clones check
+//out as a pointer instead of its content
+type RawPointer struct {
+	Path   string
+	Reason string
+}
+
+//StagedRawPointers returns the files that are added or modified in the index
+//and start with the pointer header while the clean filter didn't run for
+//them: their path isn't split according to .gitattributes, the filter
+//configuration drifted (see FilterDrift) or the pointer doesn't parse, e.g.
+//because it was edited by hand.
+func (repo *Repository) StagedRawPointers() (raw []RawPointer, err error) {
+	paths, objects, err := repo.stagedBlobs()
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+
+	reasons := map[string]string{}
+	err = repo.catBlobs(func(w io.Writer) error {
+		for i, p := range paths {
+			fmt.Fprintf(w, "%s %s\n", objects[i], p)
+		}
+
+		return nil
+	}, func(blob, path string, content io.Reader) error {
+		_, perr := repo.ReadPointer(content)
+		if perr != nil {
+			reasons[path] = fmt.Sprintf("it isn't a valid pointer: %v", perr)
+		} else {
+			reasons[path] = ""
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staged files: %v", err)
+	}
+
+	if len(reasons) == 0 {
+		return nil, nil
+	}
+
+	//output: <path> NUL <attribute> NUL <value> NUL
+	attrs := bytes.NewBuffer(nil)
+	for p := range reasons {
+		fmt.Fprintf(attrs, "%s\x00", p)
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), attrs, out, "check-attr", "-z", "--stdin", "filter")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check which files are split: %v", err)
+	}
+
+	split := map[string]bool{}
+	fields := bytes.Split(out.Bytes(), []byte{0})
+	for i := 0; i+2 < len(fields); i += 3 {
+		split[string(fields[i])] = string(fields[i+2]) == "bits"
+	}
+
+	drift, err := repo.FilterDrift()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range paths {
+		reason, ok := reasons[p]
+		switch {
+		case !ok:
+			continue
+		case !split[p]:
+			reason = "its path isn't split, no pattern in .gitattributes gives it the 'bits' filter"
+		case len(drift) > 0:
+			keys := []string{}
+			for _, d := range drift {
+				keys = append(keys, d.Key)
+			}
+
+			reason = fmt.Sprintf("the filter didn't run, its configuration drifted (%s)", strings.Join(keys, ", "))
+		case reason == "":
+			continue
+		}
+
+		raw = append(raw, RawPointer{Path: p, Reason: reason})
+	}
+
+	return raw, nil
+}
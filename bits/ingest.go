@@ -0,0 +1,62 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+//Ingest splits every regular file below directory 'dir' into the local chunk
+//directory as if git's clean filter was run on it, without the files being
+//part of a repository, e.g. to pre-seed the chunk caches of build agents.
+//The pointer of each file is handed to 'fn' with its path relative to
+//'dir', in the order the directory is walked. Git directories and files
+//that aren't regular (e.g. symlinks) are skipped. The chunks are staged
+//like those of files that are committed. It returns the number of files
+//and bytes that were split.
+func (repo *Repository) Ingest(dir string, fn func(path string, ptr []byte) error) (files int, size int64, err error) {
+	_, end := repo.trace(context.Background(), "ingest", SpanAttr{"dir", dir})
+	defer end(&err)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("failed to open '%s': %v", rel, err)
+		}
+
+		defer f.Close()
+		ptr := bytes.NewBuffer(nil)
+		err = repo.Split(f, ptr)
+		if err != nil {
+			return fmt.Errorf("failed to split '%s': %v", rel, err)
+		}
+
+		files++
+		size += fi.Size()
+		return fn(filepath.ToSlash(rel), ptr.Bytes())
+	})
+
+	if err != nil {
+		return files, size, fmt.Errorf("failed to ingest '%s': %v", dir, err)
+	}
+
+	return files, size, nil
+}
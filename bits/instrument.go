@@ -0,0 +1,231 @@
+package bits
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+//RemoteMiddleware wraps a remote to add behaviour to each of its
+//operations, such as an http.RoundTripper that wraps another, without
+//changing the backend itself
+type RemoteMiddleware func(Remote) Remote
+
+//RemoteOp describes an operation on a remote: "read", "write", "list" or
+//"delete" and the chunk it is about, if any
+type RemoteOp struct {
+	Method string
+	K      K
+	Start  time.Time
+
+	//set once the operation finished: how long it took, how many bytes of
+	//chunk content (or keys when listing) were transferred and the error it
+	//ended with, nil if it succeeded
+	Duration time.Duration
+	Bytes    int64
+	Err      error
+}
+
+//RemoteObserver is told when operations on a remote start and finish, e.g.
+//to count them as metrics or to log them. It is called concurrently.
+type RemoteObserver interface {
+	RemoteStarted(op RemoteOp)
+	RemoteFinished(op RemoteOp)
+}
+
+//ObserveRemote returns middleware that reports each operation on the remote
+//to 'o'. Reading and writing a chunk finishes when it is closed. Other
+//capabilities of the remote, e.g. checking whether it stores a chunk, are
+//used as is and not reported.
+func ObserveRemote(o RemoteObserver) RemoteMiddleware {
+	return func(r Remote) Remote {
+		return &observedRemote{remote: r, o: o}
+	}
+}
+
+//UseRemoteMiddleware wraps the configured remote, the remotes of routed
+//buckets and those that are set later on, with 'mw' in the order given. It is not safe to call while
+//operations run.
+func (repo *Repository) UseRemoteMiddleware(mw ...RemoteMiddleware) {
+	repo.remoteMu.Lock()
+	defer repo.remoteMu.Unlock()
+	repo.middleware = append(repo.middleware, mw...)
+	if repo.remote != nil {
+		repo.remote = wrapRemote(repo.remote, mw)
+	}
+
+	for bucket, remote := range repo.routes {
+		repo.routes[bucket] = wrapRemote(remote, mw)
+	}
+}
+
+//wrapRemote wraps 'r' with each of 'mw', the first is innermost
+func wrapRemote(r Remote, mw []RemoteMiddleware) Remote {
+	for _, m := range mw {
+		r = m(r)
+	}
+
+	return r
+}
+
+//remoteUnwrapper is implemented by middleware that wraps another remote
+type remoteUnwrapper interface {
+	Unwrap() Remote
+}
+
+//unwrapRemote returns the remote that all middleware wraps, optional
+//capabilities (e.g. chunkHaser) are looked up on it
+func unwrapRemote(r Remote) Remote {
+	for {
+		u, ok := r.(remoteUnwrapper)
+		if !ok {
+			return r
+		}
+
+		r = u.Unwrap()
+	}
+}
+
+//observedRemote reports the operations on 'remote' to an observer
+type observedRemote struct {
+	remote Remote
+	o      RemoteObserver
+}
+
+//Unwrap returns the remote that is observed
+func (or *observedRemote) Unwrap() Remote {
+	return or.remote
+}
+
+//start reports the start of an operation and returns a function that
+//reports it finished, only the first call does
+func (or *observedRemote) start(method string, k K) (finish func(n int64, err error)) {
+	op := RemoteOp{Method: method, K: k, Start: time.Now()}
+	or.o.RemoteStarted(op)
+	var once sync.Once
+	return func(n int64, err error) {
+		once.Do(func() {
+			op.Duration = time.Since(op.Start)
+			op.Bytes = n
+			op.Err = err
+			or.o.RemoteFinished(op)
+		})
+	}
+}
+
+func (or *observedRemote) ChunkReader(k K) (rc io.ReadCloser, err error) {
+	finish := or.start("read", k)
+	rc, err = or.remote.ChunkReader(k)
+	if err != nil {
+		finish(0, err)
+		return nil, err
+	}
+
+	return &observedReader{ReadCloser: rc, finish: finish}, nil
+}
+
+func (or *observedRemote) ChunkWriter(k K) (wc io.WriteCloser, err error) {
+	finish := or.start("write", k)
+	wc, err = or.remote.ChunkWriter(k)
+	if err != nil {
+		finish(0, err)
+		return nil, err
+	}
+
+	return &observedWriter{WriteCloser: wc, finish: finish}, nil
+}
+
+func (or *observedRemote) ListChunks(w io.Writer) (err error) {
+	finish := or.start("list", K{})
+	cw := &countWriter{w: w}
+	err = or.remote.ListChunks(cw)
+	finish(cw.n, err)
+	return err
+}
+
+func (or *observedRemote) DeleteChunks(ks []K) (err error) {
+	finish := or.start("delete", K{})
+	err = or.remote.DeleteChunks(ks)
+	finish(0, err)
+	return err
+}
+
+//observedReader reports the read finished when it is closed, with the
+//first error reading ran into
+type observedReader struct {
+	io.ReadCloser
+	n      int64
+	err    error
+	finish func(n int64, err error)
+}
+
+func (r *observedReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+
+	return n, err
+}
+
+func (r *observedReader) Close() (err error) {
+	err = r.ReadCloser.Close()
+	if r.err == nil {
+		r.err = err
+	}
+
+	r.finish(r.n, r.err)
+	return err
+}
+
+//observedWriter reports the write finished when it is closed, with the
+//first error writing ran into
+type observedWriter struct {
+	io.WriteCloser
+	n      int64
+	err    error
+	finish func(n int64, err error)
+}
+
+func (w *observedWriter) Write(p []byte) (n int, err error) {
+	n, err = w.WriteCloser.Write(p)
+	w.n += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+
+	return n, err
+}
+
+func (w *observedWriter) Close() (err error) {
+	err = w.WriteCloser.Close()
+	if w.err == nil {
+		w.err = err
+	}
+
+	w.finish(w.n, w.err)
+	return err
+}
+
+//ETag returns the entity tag the remote assigned to the written chunk, empty
+//if it doesn't assign them
+func (w *observedWriter) ETag() string {
+	if t, ok := w.WriteCloser.(interface{ ETag() string }); ok {
+		return t.ETag()
+	}
+
+	return ""
+}
+
+//countWriter counts the bytes written to 'w'
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,117 @@
+package bits
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//PointerVersionJSON is the version of pointers that are encoded as a single
+//line of canonical json (members in sorted order, no whitespace) such that
+//other tools can parse them without knowing the line format. They are
+//written when 'bits.pointer-format' is 'json'.
+const PointerVersionJSON = 4
+
+var (
+	//MaxJSONPointerSize is the size of the largest json pointer that is read
+	//from a listing of keys, enough for files of hundreds of gigabytes
+	MaxJSONPointerSize = 64 * 1024 * 1024
+
+	//PointerFormats are the formats that new pointers can be written in, the
+	//first is the default. Pointers of all formats are always read.
+	PointerFormats = []string{"lines", "json"}
+
+	//jsonPointerHeads are what json pointers start with: the algorithm of a
+	//known key hash followed by the chunk list
+	jsonPointerHeads = func() (heads [][]byte) {
+		for _, h := range KeyHashes() {
+			heads = append(heads, []byte(fmt.Sprintf(`{"algorithm":"%s","chunks":[`, h)))
+		}
+
+		return heads
+	}()
+)
+
+//jsonPointer is a pointer as it is encoded in json, members are declared in
+//sorted order such that encoding it is canonical
+type jsonPointer struct {
+	Algorithm string             `json:"algorithm"`
+	Chunks    []jsonPointerChunk `json:"chunks"`
+	Size      int64              `json:"size"`
+	Version   int                `json:"version"`
+}
+
+//jsonPointerChunk is a chunk of a json pointer: its key and plain-text size
+type jsonPointerChunk struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+//ParsePointerFormat checks the name of a format that pointers can be
+//written in, see PointerFormats
+func ParsePointerFormat(name string) (format string, err error) {
+	for _, f := range PointerFormats {
+		if f == name {
+			return f, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown pointer format '%s', expected one of: %v", name, PointerFormats)
+}
+
+//isJSONPointer returns whether 'b' starts like a json pointer, it doesn't
+//allocate such that key listings are checked for them cheaply
+func isJSONPointer(b []byte) bool {
+	if len(b) == 0 || b[0] != '{' {
+		return false
+	}
+
+	for _, head := range jsonPointerHeads {
+		if bytes.HasPrefix(b, head) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//parseJSONPointer decodes a json pointer, members that it doesn't know are
+//ignored such that later versions can add them
+func parseJSONPointer(data []byte) (ptr *Pointer, err error) {
+	v := jsonPointer{}
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode json pointer: %v", err)
+	}
+
+	if v.Version > PointerVersionJSON {
+		return nil, fmt.Errorf("pointer has version %d but only versions up to %d are supported, upgrade git-bits", v.Version, PointerVersionJSON)
+	}
+
+	if v.Version != PointerVersionJSON {
+		return nil, fmt.Errorf("json pointer has version %d, expected %d", v.Version, PointerVersionJSON)
+	}
+
+	ptr = &Pointer{Version: v.Version, FileSize: v.Size}
+	ptr.KeyHash, err = ParseKeyHash(v.Algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("pointer keys were computed with unknown algorithm '%s', upgrade git-bits", v.Algorithm)
+	}
+
+	for _, jc := range v.Chunks {
+		if jc.Size < 0 || strings.ContainsAny(jc.OID, " \t\r\n") {
+			return nil, fmt.Errorf("unexpected chunk '%s' of %d bytes in json pointer", jc.OID, jc.Size)
+		}
+
+		c, err := ParseKeyLine([]byte(jc.OID))
+		if err != nil {
+			return nil, err
+		}
+
+		c.Size = jc.Size
+		ptr.Chunks = append(ptr.Chunks, c)
+	}
+
+	return ptr, ptr.check(int64(len(ptr.Chunks)))
+}
@@ -0,0 +1,180 @@
+package bits
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+//KeyVersion identifies how the chunk of a key is encrypted and stored, such
+//that chunks of a future hash or encryption scheme can coexist with those
+//of older ones and each is combined by the scheme it was written with. It is
+//embedded in listed keys as a leading byte, keys without it are version 0.
+type KeyVersion byte
+
+const (
+	//KeyVersion0 chunks are encrypted with AES in OFB mode with the key as
+	//the cipher key and a zero IV, as chunks were before keys were versioned
+	KeyVersion0 KeyVersion = 0
+)
+
+//CurrentKeyVersion is the version of the keys that split files are written
+//with. Chunks of versions other than 0 are stored under names of their own
+//(see namespace), as the keys of the same content would otherwise collide.
+var CurrentKeyVersion = KeyVersion0
+
+//keyVersionStreams returns for each supported version the cipher stream
+//that chunk 'k' is encrypted and decrypted with
+var keyVersionStreams = map[KeyVersion]func(k K) (cipher.Stream, error){
+	KeyVersion0: func(k K) (cipher.Stream, error) {
+		block, err := aes.NewCipher(k[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher for key '%x': %v", k, err)
+		}
+
+		//@TODO use GCM cipher mode
+		//@TODO	If the key is unique for each ciphertext, then it's ok to use a zero IV.
+		var iv [aes.BlockSize]byte
+		return cipher.NewOFB(block, iv[:]), nil
+	},
+}
+
+//checkKeyVersion returns an error if keys of version 'v' are not supported
+func checkKeyVersion(v KeyVersion) error {
+	if _, ok := keyVersionStreams[v]; !ok {
+		return fmt.Errorf("key has version %d but only versions up to %d are supported, upgrade git-bits", v, len(keyVersionStreams)-1)
+	}
+
+	return nil
+}
+
+//stream returns the cipher stream that chunk 'k' of this version is
+//encrypted and decrypted with
+func (v KeyVersion) stream(k K) (cipher.Stream, error) {
+	err := checkKeyVersion(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyVersionStreams[v](k)
+}
+
+//FormatKey returns the hex encoding of key 'k' of version 'v' as it is
+//listed in pointers and key streams: keys of version 0 are listed as is,
+//others are preceded by their version byte
+func FormatKey(v KeyVersion, k K) string {
+	if v == KeyVersion0 {
+		return hex.EncodeToString(k[:])
+	}
+
+	return hex.EncodeToString(append([]byte{byte(v)}, k[:]...))
+}
+
+//namespace returns the directory that chunks of this version are stored
+//under, locally and remotely. Version 0 chunks are stored at the top, as
+//they were before keys were versioned.
+func (v KeyVersion) namespace() string {
+	if v == KeyVersion0 {
+		return ""
+	}
+
+	return fmt.Sprintf("v%d", v)
+}
+
+//chunkID identifies a chunk by its key and the version of its key, chunks
+//of the same content but of other versions are different chunks
+type chunkID struct {
+	v KeyVersion
+	k K
+}
+
+//id returns the chunk that the listed key identifies
+func (c PointerChunk) id() chunkID {
+	return chunkID{c.Version, c.K}
+}
+
+//String returns the key of the chunk as it is listed, see FormatKey
+func (id chunkID) String() string {
+	return FormatKey(id.v, id.k)
+}
+
+//storeKey returns the key that the chunk is recorded under in the buckets
+//of the local store: version 0 chunks under their key, as they were before
+//keys were versioned, others under their key preceded by the version byte
+func (id chunkID) storeKey() []byte {
+	if id.v == KeyVersion0 {
+		return append([]byte{}, id.k[:]...)
+	}
+
+	return append([]byte{byte(id.v)}, id.k[:]...)
+}
+
+//parseStoreKey returns the chunk of a record key that starts with the store
+//key of a chunk and the rest of it, e.g. the hex encoded id of the blob that
+//references it. As that rest is of even length, a store key is versioned if
+//an odd number of bytes follows the key size.
+func parseStoreKey(key []byte) (id chunkID, rest []byte) {
+	if len(key) > KeySize && (len(key)-KeySize)%2 == 1 {
+		id.v, key = KeyVersion(key[0]), key[1:]
+	}
+
+	copy(id.k[:], key)
+	if len(key) < KeySize {
+		return id, nil
+	}
+
+	return id, key[KeySize:]
+}
+
+//versionedChunker is implemented by remotes that can store the chunks of
+//keys of other versions than 0, under the names of their version
+type versionedChunker interface {
+	versionedChunkReader(v KeyVersion, k K) (rc io.ReadCloser, err error)
+	versionedChunkWriter(v KeyVersion, k K) (wc io.WriteCloser, err error)
+	deleteVersionedChunks(v KeyVersion, ks []K) (err error)
+}
+
+//remoteChunkReader opens chunk 'k' of version 'v' on 'remote'
+func remoteChunkReader(remote Remote, v KeyVersion, k K) (rc io.ReadCloser, err error) {
+	if v == KeyVersion0 {
+		return remote.ChunkReader(k)
+	}
+
+	vc, ok := unwrapRemote(remote).(versionedChunker)
+	if !ok {
+		return nil, fmt.Errorf("the remote doesn't store chunks of key version %d", v)
+	}
+
+	return vc.versionedChunkReader(v, k)
+}
+
+//remoteChunkWriter is like remoteChunkReader but opens the chunk for
+//writing
+func remoteChunkWriter(remote Remote, v KeyVersion, k K) (wc io.WriteCloser, err error) {
+	if v == KeyVersion0 {
+		return remote.ChunkWriter(k)
+	}
+
+	vc, ok := unwrapRemote(remote).(versionedChunker)
+	if !ok {
+		return nil, fmt.Errorf("the remote doesn't store chunks of key version %d", v)
+	}
+
+	return vc.versionedChunkWriter(v, k)
+}
+
+//remoteDeleteChunks is like remoteChunkReader but removes the chunks 'ks'
+func remoteDeleteChunks(remote Remote, v KeyVersion, ks []K) (err error) {
+	if v == KeyVersion0 {
+		return remote.DeleteChunks(ks)
+	}
+
+	vc, ok := unwrapRemote(remote).(versionedChunker)
+	if !ok {
+		return fmt.Errorf("the remote doesn't store chunks of key version %d", v)
+	}
+
+	return vc.deleteVersionedChunks(v, ks)
+}
@@ -0,0 +1,92 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//MaterializeOnOpen materializes the files that a lazy checkout left as
+//pointers when they are first opened, until the context is cancelled. The
+//open waits until the file holds its content, such that it never reads the
+//pointer. Opens by git itself (e.g. to compare the working tree with the
+//index) and opens while git holds the index lock (e.g. for a checkout) are
+//let through as is. This is currently only supported on linux, where it
+//requires CAP_SYS_ADMIN.
+func (repo *Repository) MaterializeOnOpen(ctx context.Context) (err error) {
+	lock := filepath.Join(repo.gitDir, "index.lock")
+
+	//opens of a file that is being materialized wait for the first
+	var mu sync.Mutex
+	materializing := map[string]chan struct{}{}
+	return repo.holdOpens(ctx, func(p string) {
+		if _, err := os.Stat(lock); err == nil {
+			return
+		}
+
+		mu.Lock()
+		if done, ok := materializing[p]; ok {
+			mu.Unlock()
+			<-done
+			return
+		}
+
+		done := make(chan struct{})
+		materializing[p] = done
+		mu.Unlock()
+
+		err := repo.materializeOpened(ctx, p)
+		if err != nil {
+			fmt.Fprintf(repo.output, "failed to materialize '%s' on open: %v\n", p, err)
+		}
+
+		mu.Lock()
+		delete(materializing, p)
+		mu.Unlock()
+		close(done)
+	})
+}
+
+//materializeOpened materializes the file at 'p' if it holds a pointer and
+//refreshes its index entry, such that git sees no change
+func (repo *Repository) materializeOpened(ctx context.Context, p string) (err error) {
+	f, err := os.Open(filepath.Join(repo.rootDir, p))
+	if err != nil {
+		return nil //e.g. removed meanwhile
+	}
+
+	defer f.Close()
+	hdr := make([]byte, hex.EncodedLen(KeySize))
+	_, err = io.ReadFull(f, hdr)
+	if err != nil || (!repo.isHeaderLine(hdr) && !isJSONPointer(hdr)) {
+		return nil //shorter than a pointer or not one
+	}
+
+	data, err := ioutil.ReadAll(io.MultiReader(bytes.NewReader(hdr), f))
+	if err != nil {
+		return fmt.Errorf("failed to read pointer: %v", err)
+	}
+
+	ptr, err := repo.ReadPointer(bytes.NewReader(data))
+	if err != nil {
+		return nil //content that merely starts like a pointer
+	}
+
+	materialized, err := repo.pullFile(ctx, p, ptr)
+	if err != nil || !materialized {
+		return err
+	}
+
+	err = repo.Git(ctx, bytes.NewBufferString(filepath.Join(repo.rootDir, p)+"\n"), nil, "update-index", "-q", "--refresh", "--stdin")
+	if err != nil {
+		return fmt.Errorf("failed to update index: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+// +build linux
+
+package bits
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	//HoldOpensRescanInterval is how often we check whether the index changed,
+	//after which directories that a checkout created are watched as well
+	HoldOpensRescanInterval = time.Second
+)
+
+//holdOpens calls 'fn' with the path (relative to the root of the working
+//tree) of each file that another process opens until the context is
+//cancelled, the open waits until 'fn' returns. It uses fanotify permission
+//events on each directory outside of the git directory. Opens by git itself
+//don't wait.
+func (repo *Repository) holdOpens(ctx context.Context, fn func(p string)) (err error) {
+	root, err := filepath.EvalSymlinks(repo.rootDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve '%s': %v", repo.rootDir, err)
+	}
+
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_CONTENT|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK, unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to setup fanotify, this requires CAP_SYS_ADMIN: %v", err)
+	}
+
+	//a non-blocking file is read through the runtime poller, such that
+	//closing it stops the read below. Closing it allows all opens that
+	//still wait.
+	var mu sync.Mutex
+	closed := false
+	f := os.NewFile(uintptr(fd), "fanotify")
+	go func() {
+		<-ctx.Done()
+		mu.Lock()
+		closed = true
+		f.Close()
+		mu.Unlock()
+	}()
+
+	mark := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return nil
+		}
+
+		return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return nil //e.g. removed meanwhile
+			}
+
+			if p == repo.gitDir || fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			err = unix.FanotifyMark(fd, unix.FAN_MARK_ADD, unix.FAN_OPEN_PERM|unix.FAN_EVENT_ON_CHILD, unix.AT_FDCWD, p)
+			if err != nil {
+				return fmt.Errorf("failed to watch '%s': %v", p, err)
+			}
+
+			return nil
+		})
+	}
+
+	err = mark()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	//a checkout writes the index, it may have created directories
+	go func() {
+		index := filepath.Join(repo.gitDir, "index")
+		last := time.Time{}
+		if fi, err := os.Stat(index); err == nil {
+			last = fi.ModTime()
+		}
+
+		ticker := time.NewTicker(HoldOpensRescanInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			fi, err := os.Stat(index)
+			if err != nil || fi.ModTime().Equal(last) {
+				continue
+			}
+
+			last = fi.ModTime()
+			err = mark()
+			if err != nil {
+				fmt.Fprintf(repo.output, "%v\n", err)
+			}
+		}
+	}()
+
+	//@see man 7 fanotify, each open waits for the response to its event
+	respond := func(evfd int32) {
+		resp := make([]byte, unsafe.Sizeof(unix.FanotifyResponse{}))
+		binary.LittleEndian.PutUint32(resp[0:], uint32(evfd))
+		binary.LittleEndian.PutUint32(resp[4:], unix.FAN_ALLOW)
+		f.Write(resp)
+		unix.Close(int(evfd))
+	}
+
+	self := int32(os.Getpid())
+	buf := make([]byte, 4096)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read fanotify events: %v", err)
+		}
+
+		for off := 0; off+int(unsafe.Sizeof(unix.FanotifyEventMetadata{})) <= n; {
+			ev := *(*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[off]))
+			off += int(ev.Event_len)
+			if ev.Vers != unix.FANOTIFY_METADATA_VERSION {
+				return fmt.Errorf("unexpected fanotify metadata version %d", ev.Vers)
+			}
+
+			if ev.Fd < 0 {
+				continue //the queue overflowed
+			}
+
+			//our own opens, e.g. to materialize, and those of git pass at once
+			if ev.Pid == self || gitProcess(ev.Pid) {
+				respond(ev.Fd)
+				continue
+			}
+
+			go func(ev unix.FanotifyEventMetadata) {
+				defer respond(ev.Fd)
+				p, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(int(ev.Fd)))
+				if err != nil {
+					return
+				}
+
+				rel, err := filepath.Rel(root, p)
+				if err != nil || strings.HasPrefix(rel, "..") {
+					return
+				}
+
+				fn(filepath.ToSlash(rel))
+			}(ev)
+		}
+	}
+}
+
+//gitProcess returns whether the process with the given pid is git or one
+//of its commands, e.g. git-bits
+func gitProcess(pid int32) bool {
+	comm, err := ioutil.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/comm")
+	if err != nil {
+		return false
+	}
+
+	name := strings.TrimSpace(string(comm))
+	return name == "git" || strings.HasPrefix(name, "git-")
+}
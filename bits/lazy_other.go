@@ -0,0 +1,15 @@
+// +build !linux
+
+package bits
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+//holdOpens calls 'fn' with the path of each file that is opened before the
+//open completes, this is currently only supported on linux
+func (repo *Repository) holdOpens(ctx context.Context, fn func(p string)) (err error) {
+	return fmt.Errorf("materializing files when they are opened is not supported on %s, read them through 'git bits mount' instead", runtime.GOOS)
+}
@@ -0,0 +1,267 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+var (
+	//ManifestNamespace is the ssh signature namespace of manifests, such
+	//that signatures made for other purposes (e.g. commits) don't verify
+	ManifestNamespace = "git-bits-manifest"
+
+	//ManifestSignatureSuffix is appended to the path of a manifest for the
+	//file its signature is written to
+	ManifestSignatureSuffix = ".sig"
+
+	//manifestHeader is the first line of every manifest
+	manifestHeader = "git-bits manifest 1"
+)
+
+//Manifest lists the chunks of a release: the distinct chunks of the split
+//files in the tree of a tag, with their sizes, in key order. Signed by the
+//publisher it proves a downloaded dataset matches the release.
+type Manifest struct {
+	Tag    string
+	Commit string
+	Chunks []PointerChunk
+}
+
+//Manifest lists the chunks of the split files in the tree of 'tag'. Chunks
+//of pointers that don't record their size are fetched to determine it.
+func (repo *Repository) Manifest(tag string) (m *Manifest, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "rev-parse", "--verify", tag+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve '%s' to a commit: %v", tag, err)
+	}
+
+	m = &Manifest{Tag: tag, Commit: strings.TrimSpace(buf.String())}
+	chunks := map[K]PointerChunk{}
+	err = repo.ForEachPointer(m.Commit, nil, func(p string, ptr *Pointer) error {
+		for _, c := range ptr.Chunks {
+			if prev, ok := chunks[c.K]; !ok || prev.Size < 0 {
+				chunks[c.K] = c
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pointers of '%s': %v", tag, err)
+	}
+
+	for _, c := range chunks {
+		if c.Size < 0 {
+			c.Size, err = repo.localChunkSize(c.Version, c.K)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		m.Chunks = append(m.Chunks, c)
+	}
+
+	sort.Slice(m.Chunks, func(i, j int) bool { return bytes.Compare(m.Chunks[i].K[:], m.Chunks[j].K[:]) < 0 })
+	return m, nil
+}
+
+//WriteTo writes the manifest in its text format: a header, the tag and its
+//commit, then a line with the key and size of each chunk
+func (m *Manifest) WriteTo(w io.Writer) (n int64, err error) {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "%s\ntag %s\ncommit %s\n", manifestHeader, m.Tag, m.Commit)
+	for _, c := range m.Chunks {
+		fmt.Fprintf(buf, "%s %d\n", FormatKey(c.Version, c.K), c.Size)
+	}
+
+	return buf.WriteTo(w)
+}
+
+//ReadManifest reads a manifest in the format that WriteTo writes
+func ReadManifest(r io.Reader) (m *Manifest, err error) {
+	m = &Manifest{}
+	s := bufio.NewScanner(r)
+	for i := 0; s.Scan(); i++ {
+		line := s.Text()
+		switch {
+		case i == 0:
+			if line != manifestHeader {
+				return nil, fmt.Errorf("unexpected manifest header '%s', expected '%s'", line, manifestHeader)
+			}
+		case i == 1 && strings.HasPrefix(line, "tag "):
+			m.Tag = strings.TrimPrefix(line, "tag ")
+		case i == 2 && strings.HasPrefix(line, "commit "):
+			m.Commit = strings.TrimPrefix(line, "commit ")
+		case i > 2:
+			c, err := ParseKeyLine([]byte(line))
+			if err != nil || c.Size < 0 {
+				return nil, fmt.Errorf("unexpected manifest line %d '%s', expected a key and a size", i+1, line)
+			}
+
+			m.Chunks = append(m.Chunks, c)
+		default:
+			return nil, fmt.Errorf("unexpected manifest line %d '%s'", i+1, line)
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	if m.Commit == "" {
+		return nil, fmt.Errorf("manifest doesn't describe a tag and commit")
+	}
+
+	return m, nil
+}
+
+//SignManifest signs manifest 'data' with the ssh private key in file 'key',
+//as with git's ssh commit signing the key may also be held by an agent when
+//'key' is a public key. The signature is returned in the armored format of
+//'ssh-keygen -Y sign'.
+func SignManifest(data []byte, key string) (sig []byte, err error) {
+	out := bytes.NewBuffer(nil)
+	err = sshKeygen(bytes.NewReader(data), out, "-Y", "sign", "-n", ManifestNamespace, "-f", key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign manifest with '%s': %v", key, err)
+	}
+
+	return out.Bytes(), nil
+}
+
+//VerifyManifestSignature verifies that 'sig' is a signature of manifest
+//'data' by 'identity', a principal in the 'allowedSigners' file (see
+//ALLOWED SIGNERS in ssh-keygen(1)). It returns a VerificationError if not.
+func VerifyManifestSignature(data, sig []byte, allowedSigners, identity string) (err error) {
+	f, err := ioutil.TempFile("", "git-bits-manifest-sig")
+	if err != nil {
+		return fmt.Errorf("failed to create signature file: %v", err)
+	}
+
+	defer os.Remove(f.Name())
+	_, err = f.Write(sig)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write signature file: %v", err)
+	}
+
+	err = sshKeygen(bytes.NewReader(data), ioutil.Discard, "-Y", "verify", "-n", ManifestNamespace, "-f", allowedSigners, "-I", identity, "-s", f.Name())
+	if err != nil {
+		return withKind(VerificationError, fmt.Errorf("manifest signature is not valid for '%s': %v", identity, err))
+	}
+
+	return nil
+}
+
+//sshKeygen runs ssh-keygen with input 'in' and output 'out', what it
+//writes to stderr is included in the error
+func sshKeygen(in io.Reader, out io.Writer, args ...string) (err error) {
+	exe, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		return withKind(ConfigError, fmt.Errorf("ssh-keygen couldn't be found in your PATH: %v", err))
+	}
+
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+//VerifyManifest checks that the dataset in this clone matches manifest 'm':
+//that its tag resolves to the commit of the manifest, that the split files
+//in its tree consist of exactly the chunks of the manifest and that each
+//chunk is stored locally with the listed size and content that hashes to
+//its key. Mismatches are written to 'w', if any a VerificationError (or a
+//MissingChunkError if chunks are only missing) is returned.
+func (repo *Repository) VerifyManifest(m *Manifest, w io.Writer) (err error) {
+	_, end := repo.trace(context.Background(), "verify-manifest", SpanAttr{"tag", m.Tag})
+	defer end(&err)
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "rev-parse", "--verify", m.Tag+"^{commit}")
+	if err != nil {
+		return withKind(VerificationError, fmt.Errorf("tag '%s' of the manifest doesn't exist: %v", m.Tag, err))
+	}
+
+	if commit := strings.TrimSpace(buf.String()); commit != m.Commit {
+		return withKind(VerificationError, fmt.Errorf("tag '%s' points to '%s' but the manifest lists '%s'", m.Tag, commit, m.Commit))
+	}
+
+	_, keys, err := repo.refChunks(m.Commit)
+	if err != nil {
+		return err
+	}
+
+	listed := map[K]bool{}
+	for _, c := range m.Chunks {
+		listed[c.K] = true
+	}
+
+	mismatch := 0
+	for _, k := range keys {
+		if !listed[k] {
+			mismatch++
+			fmt.Fprintf(w, "%x is referenced by the tag but not listed in the manifest\n", k)
+		}
+
+		delete(listed, k)
+	}
+
+	for k := range listed {
+		mismatch++
+		fmt.Fprintf(w, "%x is listed in the manifest but not referenced by the tag\n", k)
+	}
+
+	missing := 0
+	for _, c := range m.Chunks {
+		p, _ := repo.chunkPath(c.Version, c.K, false)
+		data, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			missing++
+			fmt.Fprintf(w, "%x is missing, pull the tag first\n", c.K)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read chunk '%x': %v", c.K, err)
+		}
+
+		if int64(len(data)) != c.Size {
+			mismatch++
+			fmt.Fprintf(w, "%x has %d bytes but the manifest lists %d\n", c.K, len(data), c.Size)
+			continue
+		}
+
+		err = verifyChunk(c.Version, c.K, data)
+		if err != nil {
+			mismatch++
+			fmt.Fprintf(w, "%x is corrupt: %v\n", c.K, err)
+		}
+	}
+
+	switch {
+	case mismatch > 0:
+		return withKind(VerificationError, fmt.Errorf("%d chunks don't match the manifest of '%s'", mismatch, m.Tag))
+	case missing > 0:
+		return withKind(MissingChunkError, fmt.Errorf("%d of %d chunks of the manifest of '%s' are not stored locally", missing, len(m.Chunks), m.Tag))
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package bits
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+var (
+	//MaterializeReadahead determines how many chunks after the one that is
+	//being written are fetched in the background when a file is
+	//materialized, chunks further ahead wait such that the start of the
+	//file is downloaded first
+	MaterializeReadahead = 8
+)
+
+//Materialize takes the keys (or pointer) of a file on reader 'r' and writes
+//its original content to 'w' in file order as soon as each chunk is stored
+//locally, instead of fetching all chunks before combining them. Up to
+//MaterializeReadahead chunks after the one that is written are fetched in
+//parallel, such that tools that read the start (or tail) of the file can
+//start before the download completes. It stops at the first chunk that
+//fails to fetch, that chunk is recorded for retrying.
+func (repo *Repository) Materialize(r io.Reader, w io.Writer) (err error) {
+	return repo.materialize(context.Background(), r, w)
+}
+
+//materialize writes the content of the keys on 'r' to 'w' as part of the
+//operation of 'ctx', see Materialize
+func (repo *Repository) materialize(ctx context.Context, r io.Reader, w io.Writer) (err error) {
+	ctx, end := repo.trace(ctx, "materialize")
+	defer end(&err)
+	defer repo.flushAudit(&err)
+	defer repo.flushUsage(nil)
+	readahead := MaterializeReadahead
+	if readahead < 0 {
+		readahead = 0
+	}
+
+	//reader: starts fetching chunks in file order, the buffer of 'ordered'
+	//limits how far it gets ahead of the writer
+	ordered := make(chan *fetchJob, readahead)
+	stop := make(chan struct{})
+	var readErr error
+	go func() {
+		defer close(ordered)
+		readErr = repo.forEachChunk(r, func(c PointerChunk) error {
+			job := &fetchJob{k: c.K, v: c.Version, done: make(chan struct{})}
+			select {
+			case ordered <- job:
+			case <-stop:
+				return fmt.Errorf("materializing was stopped")
+			}
+
+			go func() {
+				job.err = repo.fetchChunk(ctx, job.v, job.k)
+				close(job.done)
+			}()
+
+			return nil
+		})
+	}()
+
+	//writer: copies each chunk as soon as it and those before it are stored
+	for job := range ordered {
+		<-job.done
+		err = job.err
+		if err != nil {
+			rerr := repo.recordFailedFetches(PointerChunk{K: job.k, Version: job.v})
+			if rerr != nil {
+				fmt.Fprintf(repo.output, "failed to record chunks for retrying: %v\n", rerr)
+			}
+
+			err = withKind(KindOf(err), fmt.Errorf("failed to fetch chunk '%x', retry with 'git bits fetch --retry-failed': %v", job.k, err))
+			break
+		}
+
+		err = repo.writeChunk(job.v, job.k, w)
+		if err != nil {
+			break
+		}
+	}
+
+	//chunks that are being fetched ahead complete before returning
+	close(stop)
+	for job := range ordered {
+		<-job.done
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return readErr
+}
+
+//writeChunk writes the decrypted content of the locally stored chunk 'k'
+//of version 'v' to 'w' and flushes it if it can be
+func (repo *Repository) writeChunk(v KeyVersion, k K, w io.Writer) (err error) {
+	rc, err := repo.chunkReader(v, k)
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+	n, err := io.Copy(w, rc)
+	if err != nil {
+		return fmt.Errorf("failed to copy chunk '%x' content after %d bytes: %v", k, n, err)
+	}
+
+	if f, ok := w.(flusher); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
@@ -0,0 +1,367 @@
+package bits
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	//PeerService is the mdns service name under which peers announce that they serve chunks
+	PeerService = "_git-bits._tcp.local."
+
+	//PeerDiscoveryTimeout determines how long we wait for peers to answer a discovery query
+	PeerDiscoveryTimeout = 1 * time.Second
+)
+
+var (
+	//mdnsGroup is the multicast address mdns queries and answers are send to
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+)
+
+const (
+	dnsTypePTR = 12
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+
+	//answers are cached by peers for this many seconds
+	dnsTTL = 120
+)
+
+//dnsQuestion asks for records of a certain type
+type dnsQuestion struct {
+	Name string
+	Type uint16
+}
+
+//dnsRecord holds the PTR and SRV records we care about, other record types
+//are decoded with only their name and type
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	Target string
+	Port   uint16
+}
+
+//dnsMessage is a minimal dns message as used by mdns, @see RFC 6762
+type dnsMessage struct {
+	ID        uint16
+	Response  bool
+	Questions []dnsQuestion
+	Answers   []dnsRecord
+}
+
+//DiscoverPeers asks the local network for peers that serve chunks and returns
+//the addresses of those that answered within 'timeout'
+func DiscoverPeers(timeout time.Duration) (addrs []string, err error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open udp socket: %v", err)
+	}
+
+	defer conn.Close()
+	query := &dnsMessage{Questions: []dnsQuestion{{Name: PeerService, Type: dnsTypePTR}}}
+	_, err = conn.WriteToUDP(query.Encode(), mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send mdns query: %v", err)
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %v", err)
+	}
+
+	//peers are addressed by the source of their answer such that they don't
+	//need to know (or publish) their own address
+	seen := map[string]struct{}{}
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				break
+			}
+
+			return addrs, fmt.Errorf("failed to read mdns answer: %v", err)
+		}
+
+		msg, err := decodeDNSMessage(buf[:n])
+		if err != nil || !msg.Response {
+			continue //not for us
+		}
+
+		for _, rec := range msg.Answers {
+			if rec.Type != dnsTypeSRV || !isPeerInstance(rec.Name) {
+				continue
+			}
+
+			addr := net.JoinHostPort(src.IP.String(), fmt.Sprintf("%d", rec.Port))
+			if _, ok := seen[addr]; ok {
+				continue
+			}
+
+			seen[addr] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+//AnnouncePeer answers mdns queries for the PeerService with the given
+//instance name and port until the context is cancelled
+func AnnouncePeer(ctx context.Context, instance string, port int) (err error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("failed to join mdns multicast group: %v", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	host, _ := os.Hostname()
+	answers := []dnsRecord{
+		{Name: PeerService, Type: dnsTypePTR, Target: instance + "." + PeerService},
+		{Name: instance + "." + PeerService, Type: dnsTypeSRV, Target: dnsLabel(host) + ".local.", Port: uint16(port)},
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read mdns query: %v", err)
+		}
+
+		msg, err := decodeDNSMessage(buf[:n])
+		if err != nil || msg.Response {
+			continue //not a query
+		}
+
+		asked := false
+		for _, q := range msg.Questions {
+			if q.Type == dnsTypePTR && strings.EqualFold(q.Name, PeerService) {
+				asked = true
+			}
+		}
+
+		if !asked {
+			continue
+		}
+
+		//queries from other ports than 5353 expect a direct answer that
+		//repeats the query id and questions, @see RFC 6762 section 6.7
+		resp := &dnsMessage{Response: true, Answers: answers}
+		dst := mdnsGroup
+		if src.Port != mdnsGroup.Port {
+			resp.ID = msg.ID
+			resp.Questions = msg.Questions
+			dst = src
+		}
+
+		_, err = conn.WriteToUDP(resp.Encode(), dst)
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("failed to send mdns answer: %v", err)
+		}
+	}
+}
+
+//isPeerInstance returns whether a record name is an instance of the PeerService
+func isPeerInstance(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(PeerService))
+}
+
+//dnsLabel turns 's' into something that can be used as a single dns label
+func dnsLabel(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '-' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '-'
+	}, s)
+
+	if len(s) > 63 {
+		s = s[:63]
+	}
+
+	if s == "" {
+		s = "git-bits"
+	}
+
+	return s
+}
+
+//Encode the message in dns wire format, names are not compressed
+func (msg *dnsMessage) Encode() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:], msg.ID)
+	if msg.Response {
+		binary.BigEndian.PutUint16(b[2:], 0x8400) //response, authoritative
+	}
+
+	binary.BigEndian.PutUint16(b[4:], uint16(len(msg.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(msg.Answers)))
+	for _, q := range msg.Questions {
+		b = appendDNSName(b, q.Name)
+		b = append(b, byte(q.Type>>8), byte(q.Type), 0, dnsClassIN)
+	}
+
+	for _, rec := range msg.Answers {
+		b = appendDNSName(b, rec.Name)
+		b = append(b, byte(rec.Type>>8), byte(rec.Type), 0, dnsClassIN, 0, 0, 0, dnsTTL)
+
+		rdata := []byte{}
+		switch rec.Type {
+		case dnsTypePTR:
+			rdata = appendDNSName(rdata, rec.Target)
+		case dnsTypeSRV:
+			rdata = append(rdata, 0, 0, 0, 0, byte(rec.Port>>8), byte(rec.Port)) //priority, weight, port
+			rdata = appendDNSName(rdata, rec.Target)
+		}
+
+		b = append(b, byte(len(rdata)>>8), byte(len(rdata)))
+		b = append(b, rdata...)
+	}
+
+	return b
+}
+
+//appendDNSName appends the uncompressed wire format of 'name' to 'b'
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+
+	return append(b, 0)
+}
+
+//decodeDNSMessage decodes a message in dns wire format, authority and
+//additional records are ignored
+func decodeDNSMessage(b []byte) (msg *dnsMessage, err error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("message of %d bytes is too short", len(b))
+	}
+
+	msg = &dnsMessage{
+		ID:       binary.BigEndian.Uint16(b[0:]),
+		Response: b[2]&0x80 != 0,
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	ancount := int(binary.BigEndian.Uint16(b[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		q := dnsQuestion{}
+		q.Name, off, err = readDNSName(b, off)
+		if err != nil {
+			return nil, err
+		}
+
+		if off+4 > len(b) {
+			return nil, fmt.Errorf("question is truncated")
+		}
+
+		q.Type = binary.BigEndian.Uint16(b[off:])
+		off += 4
+		msg.Questions = append(msg.Questions, q)
+	}
+
+	for i := 0; i < ancount; i++ {
+		rec := dnsRecord{}
+		rec.Name, off, err = readDNSName(b, off)
+		if err != nil {
+			return nil, err
+		}
+
+		if off+10 > len(b) {
+			return nil, fmt.Errorf("record is truncated")
+		}
+
+		rec.Type = binary.BigEndian.Uint16(b[off:])
+		rdlen := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+rdlen > len(b) {
+			return nil, fmt.Errorf("record data is truncated")
+		}
+
+		switch rec.Type {
+		case dnsTypePTR:
+			rec.Target, _, err = readDNSName(b, off)
+		case dnsTypeSRV:
+			if rdlen < 7 {
+				return nil, fmt.Errorf("srv record is truncated")
+			}
+
+			rec.Port = binary.BigEndian.Uint16(b[off+4:])
+			rec.Target, _, err = readDNSName(b, off+6)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		off += rdlen
+		msg.Answers = append(msg.Answers, rec)
+	}
+
+	return msg, nil
+}
+
+//readDNSName reads a possibly compressed name at offset 'off' and returns it
+//with the offset directly after it
+func readDNSName(b []byte, off int) (name string, next int, err error) {
+	labels := []string{}
+	next = -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, fmt.Errorf("name is truncated")
+		}
+
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, fmt.Errorf("name pointer is truncated")
+			}
+
+			jumps++
+			if jumps > 16 {
+				return "", 0, fmt.Errorf("too many name pointers")
+			}
+
+			if next < 0 {
+				next = off + 2
+			}
+
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(b) {
+				return "", 0, fmt.Errorf("label is truncated")
+			}
+
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
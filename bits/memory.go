@@ -0,0 +1,382 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//MemoryRemote is a remote that keeps chunks in memory, it allows programs
+//that embed git-bits and tests to push and fetch without a remote store. It
+//is safe for concurrent use.
+type MemoryRemote struct {
+	mu     sync.RWMutex
+	chunks map[chunkID][]byte
+	trash  map[chunkID]memoryTrashed
+	claims map[chunkID]time.Time
+	audit  map[string][]byte
+	shared map[string][]byte
+
+	//storage classes of tiered chunks, chunks in cold storage that were
+	//asked to be restored become readable on the next request
+	classes   map[chunkID]string
+	restoring map[chunkID]bool
+}
+
+//memoryTrashed is a chunk in the trash of a memory remote
+type memoryTrashed struct {
+	data    []byte
+	trashed time.Time
+}
+
+//NewMemoryRemote returns an empty in-memory remote
+func NewMemoryRemote() *MemoryRemote {
+	return &MemoryRemote{
+		chunks:    map[chunkID][]byte{},
+		trash:     map[chunkID]memoryTrashed{},
+		claims:    map[chunkID]time.Time{},
+		audit:     map[string][]byte{},
+		shared:    map[string][]byte{},
+		classes:   map[chunkID]string{},
+		restoring: map[chunkID]bool{},
+	}
+}
+
+//ChunkReader returns the content of the chunk with the given key
+func (m *MemoryRemote) ChunkReader(k K) (rc io.ReadCloser, err error) {
+	return m.chunkReaderFrom(k, 0)
+}
+
+//ChunkWriter returns a writer that stores the chunk once it is closed
+func (m *MemoryRemote) ChunkWriter(k K) (wc io.WriteCloser, err error) {
+	return &memoryChunkWriter{remote: m, k: k}, nil
+}
+
+//versionedChunkReader is like ChunkReader for the chunk of key 'k' of
+//version 'v'
+func (m *MemoryRemote) versionedChunkReader(v KeyVersion, k K) (rc io.ReadCloser, err error) {
+	return m.readChunk(chunkID{v, k}, 0)
+}
+
+//versionedChunkWriter is like ChunkWriter for the chunk of key 'k' of
+//version 'v'
+func (m *MemoryRemote) versionedChunkWriter(v KeyVersion, k K) (wc io.WriteCloser, err error) {
+	return &memoryChunkWriter{remote: m, v: v, k: k}, nil
+}
+
+//ListChunks writes the keys of all stored chunks to 'w', one per line
+func (m *MemoryRemote) ListChunks(w io.Writer) (err error) {
+	for _, id := range m.chunkIDs() {
+		_, err = fmt.Fprintf(w, "%s\n", id)
+		if err != nil {
+			return fmt.Errorf("failed to write key: %v", err)
+		}
+	}
+
+	return nil
+}
+
+//Keys returns the keys of all stored chunks of version 0 in order
+func (m *MemoryRemote) Keys() (keys []K) {
+	for _, id := range m.chunkIDs() {
+		if id.v == KeyVersion0 {
+			keys = append(keys, id.k)
+		}
+	}
+
+	return keys
+}
+
+//chunkIDs returns all stored chunks in order of their listed key
+func (m *MemoryRemote) chunkIDs() (ids []chunkID) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for id := range m.chunks {
+		ids = append(ids, id)
+	}
+
+	sortChunkIDs(ids)
+	return ids
+}
+
+//sortChunkIDs sorts chunks in order of their listed key
+func sortChunkIDs(ids []chunkID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+}
+
+//chunkReaderFrom returns the content of the chunk starting at offset 'off'
+func (m *MemoryRemote) chunkReaderFrom(k K, off int64) (rc io.ReadCloser, err error) {
+	return m.readChunk(chunkID{KeyVersion0, k}, off)
+}
+
+//readChunk returns the content of chunk 'id' starting at offset 'off'
+func (m *MemoryRemote) readChunk(id chunkID, off int64) (rc io.ReadCloser, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.chunks[id]
+	if !ok {
+		return nil, fmt.Errorf("chunk '%s' is not stored", id)
+	}
+
+	if isColdClass(m.classes[id]) && !m.restoring[id] {
+		return nil, &coldChunkError{id: id, err: fmt.Errorf("chunk is stored as %s", m.classes[id]), thaw: func() (bool, error) { return m.thawChunk(id.v, id.k) }}
+	}
+
+	if off > int64(len(data)) {
+		return nil, fmt.Errorf("offset %d is beyond the %d bytes of chunk '%s'", off, len(data), id)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data[off:])), nil
+}
+
+//DeleteChunks removes the chunks, removing a chunk that isn't stored is a
+//no-op
+func (m *MemoryRemote) DeleteChunks(ks []K) error {
+	return m.deleteVersionedChunks(KeyVersion0, ks)
+}
+
+//deleteVersionedChunks is like DeleteChunks for the chunks of keys 'ks' of
+//version 'v'
+func (m *MemoryRemote) deleteVersionedChunks(v KeyVersion, ks []K) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range ks {
+		delete(m.chunks, chunkID{v, k})
+	}
+
+	return nil
+}
+
+//hasChunk returns whether the chunk is stored
+func (m *MemoryRemote) hasChunk(v KeyVersion, k K) (ok bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok = m.chunks[chunkID{v, k}]
+	return ok, nil
+}
+
+//trashChunk moves the chunk to the trash, a chunk that isn't stored is
+//ignored
+func (m *MemoryRemote) trashChunk(v KeyVersion, k K) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := chunkID{v, k}
+	data, ok := m.chunks[id]
+	if !ok {
+		return nil
+	}
+
+	m.trash[id] = memoryTrashed{data: data, trashed: time.Now()}
+	delete(m.chunks, id)
+	return nil
+}
+
+//restoreChunk moves a trashed chunk back
+func (m *MemoryRemote) restoreChunk(v KeyVersion, k K) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := chunkID{v, k}
+	t, ok := m.trash[id]
+	if !ok {
+		return fmt.Errorf("chunk '%s' is not in the trash", id)
+	}
+
+	m.chunks[id] = t.data
+	delete(m.trash, id)
+	return nil
+}
+
+//trashedChunks calls 'fn' for each chunk in the trash in order of its key
+func (m *MemoryRemote) trashedChunks(fn func(v KeyVersion, k K, trashed time.Time) error) error {
+	m.mu.RLock()
+	trash := map[chunkID]time.Time{}
+	ids := []chunkID{}
+	for id, t := range m.trash {
+		trash[id] = t.trashed
+		ids = append(ids, id)
+	}
+
+	m.mu.RUnlock()
+	sortChunkIDs(ids)
+	for _, id := range ids {
+		err := fn(id.v, id.k, trash[id])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//purgeChunks deletes chunks in the trash
+func (m *MemoryRemote) purgeChunks(ids []chunkID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.trash, id)
+	}
+
+	return nil
+}
+
+//claimChunk claims the upload of a chunk unless another claim is recent
+func (m *MemoryRemote) claimChunk(v KeyVersion, k K) (claimed bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := chunkID{v, k}
+	if t, ok := m.claims[id]; ok && time.Since(t) < ClaimTimeout {
+		return false, nil
+	}
+
+	m.claims[id] = time.Now()
+	return true, nil
+}
+
+//releaseChunk removes the claim on a chunk
+func (m *MemoryRemote) releaseChunk(v KeyVersion, k K) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.claims, chunkID{v, k})
+	return nil
+}
+
+//writeAuditLog stores an audit log, existing logs are never overwritten
+func (m *MemoryRemote) writeAuditLog(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.audit[name]; ok {
+		return fmt.Errorf("audit log '%s' already exists", name)
+	}
+
+	m.audit[name] = append([]byte{}, data...)
+	return nil
+}
+
+//writeSharedObject creates an object of the shared index
+func (m *MemoryRemote) writeSharedObject(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.shared[name]; ok {
+		return fmt.Errorf("shared object '%s' already exists", name)
+	}
+
+	m.shared[name] = append([]byte{}, data...)
+	return nil
+}
+
+//readSharedObject returns the content of an object of the shared index
+func (m *MemoryRemote) readSharedObject(name string) (data []byte, ok bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok = m.shared[name]
+	return data, ok, nil
+}
+
+//sharedObjects calls 'fn' for each object of the shared index that starts
+//with 'prefix', in order
+func (m *MemoryRemote) sharedObjects(prefix string, fn func(name string) error) error {
+	m.mu.RLock()
+	names := []string{}
+	for name := range m.shared {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	m.mu.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		err := fn(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//deleteSharedObjects removes objects of the shared index
+func (m *MemoryRemote) deleteSharedObjects(names []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		delete(m.shared, name)
+	}
+
+	return nil
+}
+
+//tierChunk moves a chunk to storage class 'class'
+func (m *MemoryRemote) tierChunk(v KeyVersion, k K, class string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := chunkID{v, k}
+	if _, ok := m.chunks[id]; !ok {
+		return fmt.Errorf("chunk '%s' is not stored", id)
+	}
+
+	m.classes[id] = class
+	delete(m.restoring, id)
+	return nil
+}
+
+//thawChunk requests a chunk in cold storage to be restored, like a restore
+//from glacier it isn't ready when it is requested but can be read after
+func (m *MemoryRemote) thawChunk(v KeyVersion, k K) (ready bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := chunkID{v, k}
+	ready = m.restoring[id]
+	m.restoring[id] = true
+	return ready, nil
+}
+
+//StorageClass returns the storage class a chunk of version 0 was moved to,
+//empty if it wasn't moved
+func (m *MemoryRemote) StorageClass(k K) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.classes[chunkID{KeyVersion0, k}]
+}
+
+//AuditLog returns the content of all audit logs, ordered by name
+func (m *MemoryRemote) AuditLog() (data []byte) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := []string{}
+	for name := range m.audit {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		data = append(data, m.audit[name]...)
+	}
+
+	return data
+}
+
+//memoryChunkWriter buffers a chunk until it is closed, such that readers
+//never see part of it
+type memoryChunkWriter struct {
+	remote *MemoryRemote
+	v      KeyVersion
+	k      K
+	buf    bytes.Buffer
+}
+
+func (w *memoryChunkWriter) Write(p []byte) (n int, err error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryChunkWriter) Close() error {
+	w.remote.mu.Lock()
+	defer w.remote.mu.Unlock()
+	w.remote.chunks[chunkID{w.v, w.k}] = w.buf.Bytes()
+	return nil
+}
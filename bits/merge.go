@@ -0,0 +1,193 @@
+package bits
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	//ErrMergeConflict is returned when both sides changed a split file in a way
+	//that cannot be merged automatically
+	ErrMergeConflict = fmt.Errorf("both sides changed the file and the changes cannot be merged automatically")
+)
+
+//Merge performs a three-way merge of the pointer content in 'base', 'ours' and
+//'theirs' and writes the result to 'w'. If only one side changed the file its
+//pointer is selected, if both sides only appended to the base file the result
+//holds the content of 'ours' followed by what was appended in 'theirs'. In any
+//other case ErrMergeConflict is returned and nothing is written.
+func (repo *Repository) Merge(base, ours, theirs io.Reader, w io.Writer) (err error) {
+	oursData, err := ioutil.ReadAll(ours)
+	if err != nil {
+		return fmt.Errorf("failed to read our side: %v", err)
+	}
+
+	theirsData, err := ioutil.ReadAll(theirs)
+	if err != nil {
+		return fmt.Errorf("failed to read their side: %v", err)
+	}
+
+	oursPtr, err := repo.ReadPointer(bytes.NewReader(oursData))
+	if err != nil {
+		return fmt.Errorf("failed to read our pointer: %v", err)
+	}
+
+	theirsPtr, err := repo.ReadPointer(bytes.NewReader(theirsData))
+	if err != nil {
+		return fmt.Errorf("failed to read their pointer: %v", err)
+	}
+
+	//both sides ended up with the same content
+	if sameChunks(oursPtr, theirsPtr) {
+		_, err = w.Write(oursData)
+		return err
+	}
+
+	//without a base (added on both sides) there is nothing to compare against
+	baseData, err := ioutil.ReadAll(base)
+	if err != nil {
+		return fmt.Errorf("failed to read merge base: %v", err)
+	}
+
+	if len(baseData) == 0 {
+		return ErrMergeConflict
+	}
+
+	basePtr, err := repo.ReadPointer(bytes.NewReader(baseData))
+	if err != nil {
+		return fmt.Errorf("failed to read base pointer: %v", err)
+	}
+
+	//only one side changed the file
+	if sameChunks(basePtr, oursPtr) {
+		_, err = w.Write(theirsData)
+		return err
+	}
+
+	if sameChunks(basePtr, theirsPtr) {
+		_, err = w.Write(oursData)
+		return err
+	}
+
+	//both sides changed, we can only merge appends
+	oursAppend, err := repo.isAppend(basePtr, oursPtr)
+	if err != nil {
+		return fmt.Errorf("failed to compare our side to the base: %v", err)
+	}
+
+	theirsAppend, err := repo.isAppend(basePtr, theirsPtr)
+	if err != nil {
+		return fmt.Errorf("failed to compare their side to the base: %v", err)
+	}
+
+	if !oursAppend || !theirsAppend {
+		return ErrMergeConflict
+	}
+
+	baseSize, err := repo.pointerSize(basePtr)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := repo.readPointerAt(oursPtr, 0, -1, pw)
+		if err == nil {
+			err = repo.readPointerAt(theirsPtr, baseSize, -1, pw)
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	err = repo.Split(pr, w)
+	if err != nil {
+		return fmt.Errorf("failed to split merged content: %v", err)
+	}
+
+	return nil
+}
+
+//sameChunks returns whether two pointers list the same chunks
+func sameChunks(a, b *Pointer) bool {
+	if len(a.Chunks) != len(b.Chunks) {
+		return false
+	}
+
+	for i := range a.Chunks {
+		if a.Chunks[i].K != b.Chunks[i].K {
+			return false
+		}
+	}
+
+	return true
+}
+
+//isAppend returns whether the content of pointer 'p' starts with the complete
+//content of pointer 'base' and is larger. Content defined chunking causes an
+//append to only change the last chunk of the base so we compare chunk keys up
+//to that chunk and only compare the actual bytes of the last one.
+func (repo *Repository) isAppend(base, p *Pointer) (ok bool, err error) {
+	baseSize, err := repo.pointerSize(base)
+	if err != nil {
+		return false, err
+	}
+
+	size, err := repo.pointerSize(p)
+	if err != nil {
+		return false, err
+	}
+
+	if size <= baseSize {
+		return false, nil
+	}
+
+	if len(base.Chunks) == 0 {
+		return true, nil
+	}
+
+	last := len(base.Chunks) - 1
+	if len(p.Chunks) < last {
+		return false, nil
+	}
+
+	for i := 0; i < last; i++ {
+		if base.Chunks[i].K != p.Chunks[i].K {
+			return false, nil
+		}
+	}
+
+	lastSize := base.Chunks[last].Size
+	baseSum := sha256.New()
+	err = repo.readPointerAt(base, baseSize-lastSize, lastSize, baseSum)
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha256.New()
+	err = repo.readPointerAt(p, baseSize-lastSize, lastSize, sum)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(baseSum.Sum(nil), sum.Sum(nil)), nil
+}
+
+//pointerSize returns the plain-text size of the file described by 'ptr', chunks
+//that have no recorded size are fetched and their size is stored in the pointer
+func (repo *Repository) pointerSize(ptr *Pointer) (size int64, err error) {
+	for i, c := range ptr.Chunks {
+		if c.Size < 0 {
+			ptr.Chunks[i].Size, err = repo.localChunkSize(c.Version, c.K)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		size += ptr.Chunks[i].Size
+	}
+
+	return size, nil
+}
@@ -0,0 +1,152 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	//MetricsPath is the http path under which metrics are served
+	MetricsPath = "/metrics"
+
+	//metricHelp describes each metric that is exposed
+	metricHelp = map[string]string{
+		"git_bits_requests_total":       "Requests handled, by mode, method and response code.",
+		"git_bits_errors_total":         "Requests or operations that failed on our side, by mode.",
+		"git_bits_bytes_sent_total":     "Bytes of chunk content sent to clients or the remote, by mode.",
+		"git_bits_bytes_received_total": "Bytes of chunk content received from clients, by mode.",
+		"git_bits_cache_hits_total":     "Chunks that were asked for and stored locally, by mode.",
+		"git_bits_cache_misses_total":   "Chunks that were asked for but not stored locally, by mode.",
+		"git_bits_chunks_pushed_total":  "Chunks that were uploaded to the remote, by mode.",
+	}
+)
+
+//Metrics counts what the long-running modes (serve, serve-grpc and daemon)
+//do, such that they can be scraped by prometheus and alerted on. A nil
+//Metrics counts nothing.
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]map[string]float64
+}
+
+//NewMetrics returns metrics without any counts
+func NewMetrics() *Metrics {
+	return &Metrics{counters: map[string]map[string]float64{}}
+}
+
+//seriesKey returns the labels of a series as they are written, sorted by name
+func seriesKey(labels ...string) string {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+//Add adds 'v' to the counter with the given name and label pairs, e.g.
+//Add("git_bits_requests_total", 1, "mode", "serve", "code", "200")
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.counters[name]
+	if !ok {
+		series = map[string]float64{}
+		m.counters[name] = series
+	}
+
+	series[seriesKey(labels...)] += v
+}
+
+//Value returns the current value of a counter, labels are given as in Add
+func (m *Metrics) Value(name string, labels ...string) float64 {
+	if m == nil {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name][seriesKey(labels...)]
+}
+
+//escapeLabel escapes a label value for the prometheus text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+//WriteTo writes all counters in the prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := []string{}
+	for name := range m.counters {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	buf := bytes.NewBuffer(nil)
+	for _, name := range names {
+		if help, ok := metricHelp[name]; ok {
+			fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+		}
+
+		fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+		series := []string{}
+		for labels := range m.counters[name] {
+			series = append(series, labels)
+		}
+
+		sort.Strings(series)
+		for _, labels := range series {
+			if labels == "" {
+				fmt.Fprintf(buf, "%s %v\n", name, m.counters[name][labels])
+				continue
+			}
+
+			fmt.Fprintf(buf, "%s{%s} %v\n", name, labels, m.counters[name][labels])
+		}
+	}
+
+	return buf.WriteTo(w)
+}
+
+//ServeHTTP serves the metrics at MetricsPath
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != MetricsPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+//ServeMetrics serves the metrics on listener 'l' until the context is
+//cancelled
+func ServeMetrics(ctx context.Context, l net.Listener, m *Metrics) (err error) {
+	srv := &http.Server{Handler: m}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return srv.Shutdown(context.Background())
+	case err = <-errCh:
+		return err
+	}
+}
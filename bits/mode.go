@@ -0,0 +1,147 @@
+package bits
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var (
+	//DefaultFileMode is the mode of files that git-bits creates when no
+	//'bits.file-mode' is configured, it is masked by the umask
+	DefaultFileMode os.FileMode = 0666
+
+	//DefaultDirMode is the mode of directories that git-bits creates when no
+	//'bits.dir-mode' is configured, it is masked by the umask
+	DefaultDirMode os.FileMode = 0777
+)
+
+//ParseMode parses an octal mode as chmod takes it (e.g. 0660 or 2770), the
+//setuid, setgid and sticky bits are supported
+func ParseMode(s string) (mode os.FileMode, err error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("expected an octal mode (e.g. 0660)")
+	}
+
+	mode = os.FileMode(n & 0777)
+	if n&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+
+	if n&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+
+	if n&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode, nil
+}
+
+//formatMode formats a mode like ParseMode parses it
+func formatMode(mode os.FileMode) string {
+	n := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		n |= 04000
+	}
+
+	if mode&os.ModeSetgid != 0 {
+		n |= 02000
+	}
+
+	if mode&os.ModeSticky != 0 {
+		n |= 01000
+	}
+
+	return fmt.Sprintf("%04o", n)
+}
+
+//fileMode returns the mode of files that are created in the chunk directory
+func (repo *Repository) fileMode() os.FileMode {
+	if repo.conf == nil || repo.conf.FileMode == 0 {
+		return DefaultFileMode
+	}
+
+	return repo.conf.FileMode
+}
+
+//dirMode returns the mode of directories that are created in the chunk
+//directory
+func (repo *Repository) dirMode() os.FileMode {
+	if repo.conf == nil || repo.conf.DirMode == 0 {
+		return DefaultDirMode
+	}
+
+	return repo.conf.DirMode
+}
+
+//applyMode gives the file or directory at 'p' exactly 'mode' if a mode is
+//configured, such that the umask doesn't restrict it. Paths that are owned
+//by other users of a shared clone are left alone.
+func applyMode(p string, mode os.FileMode, configured bool) error {
+	if !configured {
+		return nil
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) == mode {
+		return nil
+	}
+
+	err = os.Chmod(p, mode)
+	if err != nil && !os.IsPermission(err) {
+		return err
+	}
+
+	return nil
+}
+
+//mkdirAll creates directory 'dir' and its parents with the configured
+//'bits.dir-mode'
+func (repo *Repository) mkdirAll(dir string) error {
+	err := os.MkdirAll(dir, repo.dirMode())
+	if err != nil {
+		return err
+	}
+
+	return applyMode(dir, repo.dirMode(), repo.conf != nil && repo.conf.DirMode != 0)
+}
+
+//openFile is like os.OpenFile but files that are created get the configured
+//'bits.file-mode'
+func (repo *Repository) openFile(p string, flag int) (f *os.File, err error) {
+	f, err = os.OpenFile(p, flag, repo.fileMode())
+	if err != nil || flag&os.O_CREATE == 0 {
+		return f, err
+	}
+
+	err = applyMode(p, repo.fileMode(), repo.conf != nil && repo.conf.FileMode != 0)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to set mode of '%s': %v", p, err)
+	}
+
+	return f, nil
+}
+
+//writeFile is like ioutil.WriteFile but the file gets the configured
+//'bits.file-mode'
+func (repo *Repository) writeFile(p string, data []byte) error {
+	f, err := repo.openFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
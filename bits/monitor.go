@@ -0,0 +1,361 @@
+package bits
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	//MonitorSocket is the unix socket in the chunk directory on which the
+	//transfers of a running push, fetch, pull or daemon are served
+	MonitorSocket = "monitor.sock"
+
+	//MonitorRecent is how many of the most recently completed transfers are
+	//kept for the monitor
+	MonitorRecent = 10
+)
+
+//Monitor follows the transfers of chunks while they happen: which worker
+//moves which chunk at what rate, how many chunks are queued and how many
+//were retried. Each transfer that is in progress occupies a worker slot,
+//slots are reused such that parallel workers keep their number. A nil
+//Monitor follows nothing.
+type Monitor struct {
+	mu      sync.Mutex
+	since   time.Time
+	workers []*monitorWorker
+	queued  map[Op]int
+	retries map[Op]int
+	recent  []TransferredChunk
+}
+
+//monitorWorker holds the totals of a worker slot and its current transfer
+type monitorWorker struct {
+	chunks int
+	bytes  int64
+	busy   time.Duration
+	cur    *monitorTransfer
+}
+
+//monitorTransfer is a transfer that occupies a worker slot
+type monitorTransfer struct {
+	m       *Monitor
+	slot    int
+	op      Op
+	k       K
+	started time.Time
+	n       int64 //updated atomically while data is copied
+}
+
+//MonitorSnapshot is the state of the monitor at a point in time
+type MonitorSnapshot struct {
+	Since   time.Time          `json:"since"`
+	Workers []WorkerStatus     `json:"workers"`
+	Queued  map[Op]int         `json:"queued"`
+	Retries map[Op]int         `json:"retries"`
+	Recent  []TransferredChunk `json:"recent"`
+}
+
+//WorkerStatus describes a worker slot, Op and Key are empty while it idles
+type WorkerStatus struct {
+	ID     int     `json:"id"`
+	Op     Op      `json:"op,omitempty"`
+	Key    string  `json:"key,omitempty"`
+	Bytes  int64   `json:"bytes"` //of the current transfer
+	Rate   float64 `json:"rate"`  //bytes per second of the current transfer, or on average when idle
+	Chunks int     `json:"chunks"`
+	Total  int64   `json:"total_bytes"`
+}
+
+//TransferredChunk is a transfer that completed
+type TransferredChunk struct {
+	Op       Op            `json:"op"`
+	Key      string        `json:"key"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"error,omitempty"`
+}
+
+//NewMonitor returns a monitor without any transfers
+func NewMonitor() *Monitor {
+	return &Monitor{since: time.Now(), queued: map[Op]int{}, retries: map[Op]int{}}
+}
+
+//begin occupies the first idle worker slot with the transfer of chunk 'k'
+func (m *Monitor) begin(op Op, k K) *monitorTransfer {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &monitorTransfer{m: m, slot: -1, op: op, k: k, started: time.Now()}
+	for i, w := range m.workers {
+		if w.cur == nil {
+			t.slot = i
+			break
+		}
+	}
+
+	if t.slot < 0 {
+		t.slot = len(m.workers)
+		m.workers = append(m.workers, &monitorWorker{})
+	}
+
+	m.workers[t.slot].cur = t
+	return t
+}
+
+//queue changes the number of chunks that wait for a worker by 'delta'
+func (m *Monitor) queue(op Op, delta int) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued[op] += delta
+}
+
+//retry counts a transfer that is attempted again
+func (m *Monitor) retry(op Op) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries[op]++
+}
+
+//add counts 'n' bytes that were transferred
+func (t *monitorTransfer) add(n int64) {
+	if t == nil {
+		return
+	}
+
+	atomic.AddInt64(&t.n, n)
+}
+
+//reader counts the bytes that are read from 'r' as transferred
+func (t *monitorTransfer) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+
+	return &monitorReader{Reader: r, t: t}
+}
+
+//end frees the worker slot and records the transfer as completed
+func (t *monitorTransfer) end(err error) {
+	if t == nil {
+		return
+	}
+
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	n, d := atomic.LoadInt64(&t.n), time.Since(t.started)
+	w := t.m.workers[t.slot]
+	w.cur = nil
+	w.busy += d
+	if err == nil {
+		w.chunks++
+		w.bytes += n
+	}
+
+	done := TransferredChunk{Op: t.op, Key: hex.EncodeToString(t.k[:]), Bytes: n, Duration: d}
+	if err != nil {
+		done.Err = err.Error()
+	}
+
+	t.m.recent = append(t.m.recent, done)
+	if len(t.m.recent) > MonitorRecent {
+		t.m.recent = t.m.recent[len(t.m.recent)-MonitorRecent:]
+	}
+}
+
+//monitorReader counts what is read as transferred
+type monitorReader struct {
+	io.Reader
+	t *monitorTransfer
+}
+
+func (r *monitorReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.t.add(int64(n))
+	return n, err
+}
+
+//Snapshot returns the current state of the monitor
+func (m *Monitor) Snapshot() (snap MonitorSnapshot) {
+	snap = MonitorSnapshot{Queued: map[Op]int{}, Retries: map[Op]int{}, Recent: []TransferredChunk{}}
+	if m == nil {
+		return snap
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap.Since = m.since
+	for i, w := range m.workers {
+		ws := WorkerStatus{ID: i, Chunks: w.chunks, Total: w.bytes}
+		if w.busy > 0 {
+			ws.Rate = float64(w.bytes) / w.busy.Seconds()
+		}
+
+		if t := w.cur; t != nil {
+			ws.Op, ws.Key, ws.Bytes = t.op, hex.EncodeToString(t.k[:]), atomic.LoadInt64(&t.n)
+			if d := time.Since(t.started); d > 0 {
+				ws.Rate = float64(ws.Bytes) / d.Seconds()
+			}
+		}
+
+		snap.Workers = append(snap.Workers, ws)
+	}
+
+	for op, n := range m.queued {
+		snap.Queued[op] = n
+	}
+
+	for op, n := range m.retries {
+		snap.Retries[op] = n
+	}
+
+	for i := len(m.recent) - 1; i >= 0; i-- {
+		snap.Recent = append(snap.Recent, m.recent[i])
+	}
+
+	return snap
+}
+
+//ServeHTTP serves the snapshot of the monitor as json
+func (m *Monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Snapshot())
+}
+
+//SetMonitor makes the transfers of chunks be followed by 'm', it should be
+//set before operations run
+func (repo *Repository) SetMonitor(m *Monitor) {
+	repo.monitor = m
+}
+
+//ServeMonitor follows transfers with a new monitor and serves it on the
+//MonitorSocket of the chunk directory until 'stop' is called, such that
+//'git bits top' can attach to it. Only one process serves the monitor of a
+//repository at a time, if another one does it returns an error.
+func (repo *Repository) ServeMonitor() (stop func(), err error) {
+	p := filepath.Join(repo.chunkDir, MonitorSocket)
+	if c, err := net.Dial("unix", p); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("the monitor is already served by another process")
+	}
+
+	os.Remove(p) //left behind by a process that didn't stop
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on '%s': %v", p, err)
+	}
+
+	m := NewMonitor()
+	repo.SetMonitor(m)
+	srv := &http.Server{Handler: m}
+	go srv.Serve(l)
+	return func() {
+		srv.Shutdown(context.Background())
+		os.Remove(p)
+	}, nil
+}
+
+//AttachMonitor returns the snapshot of the monitor that a running process
+//serves for this repository
+func (repo *Repository) AttachMonitor() (snap MonitorSnapshot, err error) {
+	p := filepath.Join(repo.chunkDir, MonitorSocket)
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, netw, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", p)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://git-bits/")
+	if err != nil {
+		return snap, fmt.Errorf("no push, fetch, pull or daemon is running: %v", err)
+	}
+
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&snap)
+	if err != nil {
+		return snap, fmt.Errorf("failed to decode monitor: %v", err)
+	}
+
+	return snap, nil
+}
+
+//WriteMonitor writes a snapshot as a table of the workers, the queued and
+//retried chunks per operation and the transfers that completed recently
+func WriteMonitor(w io.Writer, snap MonitorSnapshot) (err error) {
+	ops := []string{}
+	for op := range snap.Queued {
+		ops = append(ops, string(op))
+	}
+
+	for op := range snap.Retries {
+		if _, ok := snap.Queued[op]; !ok {
+			ops = append(ops, string(op))
+		}
+	}
+
+	sort.Strings(ops)
+	fmt.Fprintf(w, "transfers since %s\n", snap.Since.Format(time.Stamp))
+	for _, op := range ops {
+		fmt.Fprintf(w, "%s: %d queued, %d retried\n", op, snap.Queued[Op(op)], snap.Retries[Op(op)])
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nWORKER\tOP\tCHUNK\tRATE\tCHUNKS\tTOTAL\n")
+	for _, ws := range snap.Workers {
+		op, key := "idle", "-"
+		if ws.Op != "" {
+			op, key = string(ws.Op), shortKey(ws.Key)
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s/s\t%d\t%s\n", ws.ID, op, key, humanize.Bytes(uint64(ws.Rate)), ws.Chunks, humanize.Bytes(uint64(ws.Total)))
+	}
+
+	fmt.Fprintf(tw, "\nRECENT\tOP\tCHUNK\tSIZE\tTOOK\t\n")
+	for i, tc := range snap.Recent {
+		took := tc.Duration.Round(time.Millisecond).String()
+		if tc.Err != "" {
+			took = "failed"
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t\n", i+1, tc.Op, shortKey(tc.Key), humanize.Bytes(uint64(tc.Bytes)), took)
+	}
+
+	return tw.Flush()
+}
+
+//shortKey abbreviates a hex encoded key for display
+func shortKey(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+
+	return key
+}
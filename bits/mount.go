@@ -0,0 +1,284 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	//MountReadahead determines how many chunks after a read are fetched in
+	//the background, such that sequential reads rarely wait for the remote
+	MountReadahead = 2
+)
+
+//mountNode is a file or directory in the tree of a mounted ref
+type mountNode struct {
+	id   uint64
+	name string
+	mode os.FileMode
+
+	//git object that holds the content and its size, for split files
+	//the size is that of the original file (-1 when yet unknown)
+	obj  string
+	size int64
+	ptr  *Pointer
+
+	//directory entries, sorted by name
+	children []*mountNode
+
+	//content of files that are not split, read when first opened
+	mu      sync.Mutex
+	content []byte
+}
+
+//child returns the directory entry with the given name, or nil
+func (n *mountNode) child(name string) *mountNode {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].name >= name })
+	if i < len(n.children) && n.children[i].name == name {
+		return n.children[i]
+	}
+
+	return nil
+}
+
+//mountFS is the read-only filesystem view of a ref that is used by the
+//platform specific mount implementation
+type mountFS struct {
+	repo  *Repository
+	nodes []*mountNode //indexed by node id-1, the root is node 1
+	mtime time.Time
+
+	//chunks that are being fetched, such that readahead and reads of the
+	//same chunk wait on each other instead of reading a partial file
+	fetchMu  sync.Mutex
+	fetching map[K]chan struct{}
+}
+
+//newMountFS lists the tree of 'ref' and the pointers in it
+func (repo *Repository) newMountFS(ref string) (fs *mountFS, err error) {
+	fs = &mountFS{repo: repo, fetching: map[K]chan struct{}{}}
+	root := &mountNode{id: 1, name: "", mode: os.ModeDir | 0555}
+	fs.nodes = append(fs.nodes, root)
+
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, "log", "-1", "--format=%ct", ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commit time of '%s': %v", ref, err)
+	}
+
+	ts, err := strconv.ParseInt(strings.TrimSpace(buf.String()), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected commit time '%s': %v", buf.String(), err)
+	}
+
+	fs.mtime = time.Unix(ts, 0)
+
+	ptrs := map[string]*Pointer{}
+	err = repo.ForEachPointer(ref, nil, func(p string, ptr *Pointer) error {
+		ptrs[p] = ptr
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	//@see https://git-scm.com/docs/git-ls-tree
+	//line : <mode> SP <type> SP <object> SP <size> TAB <file> NUL
+	buf = bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, "ls-tree", "-r", "-t", "-l", "-z", "--full-tree", ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree of '%s': %v", ref, err)
+	}
+
+	dirs := map[string]*mountNode{"": root}
+	for _, entry := range bytes.Split(buf.Bytes(), []byte{0}) {
+		tfields := bytes.SplitN(entry, []byte("\t"), 2)
+		fields := bytes.Fields(entry)
+		if len(fields) < 5 || len(tfields) != 2 {
+			continue
+		}
+
+		p := string(tfields[1])
+		parent := dirs[path.Dir(p)]
+		if path.Dir(p) == "." {
+			parent = root
+		}
+
+		if parent == nil {
+			return nil, fmt.Errorf("unexpected tree entry '%s' before its directory", p)
+		}
+
+		n := &mountNode{
+			id:   uint64(len(fs.nodes) + 1),
+			name: path.Base(p),
+			obj:  string(fields[2]),
+		}
+
+		switch string(fields[0]) {
+		case "040000", "160000": //trees and submodules
+			n.mode = os.ModeDir | 0555
+			dirs[p] = n
+		case "120000":
+			n.mode = os.ModeSymlink | 0777
+		case "100755":
+			n.mode = 0555
+		default:
+			n.mode = 0444
+		}
+
+		if !n.mode.IsDir() {
+			n.size, err = strconv.ParseInt(string(fields[3]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected object size in '%s': %v", entry, err)
+			}
+		}
+
+		if ptr, ok := ptrs[p]; ok && n.mode.IsRegular() {
+			n.ptr = ptr
+			n.size = ptr.Size()
+		}
+
+		fs.nodes = append(fs.nodes, n)
+		parent.children = append(parent.children, n)
+	}
+
+	for _, dir := range dirs {
+		sort.Slice(dir.children, func(i, j int) bool { return dir.children[i].name < dir.children[j].name })
+	}
+
+	return fs, nil
+}
+
+//node returns the node with the given id, or nil
+func (fs *mountFS) node(id uint64) *mountNode {
+	if id < 1 || id > uint64(len(fs.nodes)) {
+		return nil
+	}
+
+	return fs.nodes[id-1]
+}
+
+//size returns the size of the node's content, for split files without
+//recorded chunk sizes this requires the chunks to be fetched
+func (fs *mountFS) size(n *mountNode) (size int64, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.size >= 0 {
+		return n.size, nil
+	}
+
+	for _, c := range n.ptr.Chunks {
+		err = fs.fetch(c)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n.size, err = fs.repo.pointerSize(n.ptr)
+	return n.size, err
+}
+
+//read returns up to 'size' bytes of the node's content at offset 'off'
+func (fs *mountFS) read(n *mountNode, off int64, size int) (data []byte, err error) {
+	if n.ptr == nil {
+		content, err := fs.content(n)
+		if err != nil {
+			return nil, err
+		}
+
+		if off >= int64(len(content)) {
+			return nil, nil
+		}
+
+		end := off + int64(size)
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+
+		return content[off:end], nil
+	}
+
+	//fetch the chunks right after the range in the background
+	last := -1
+	pos := int64(0)
+	for i, c := range n.ptr.Chunks {
+		if c.Size < 0 || pos >= off+int64(size) {
+			break
+		}
+
+		last = i
+		pos += c.Size
+	}
+
+	for i := last + 1; last >= 0 && i <= last+MountReadahead && i < len(n.ptr.Chunks); i++ {
+		go fs.fetch(n.ptr.Chunks[i])
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	err = fs.repo.readPointerAtWith(n.ptr, off, int64(size), buf, fs.fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+//content returns the content of a file that is not split or the target
+//of a symlink, it is read from git when first asked for
+func (fs *mountFS) content(n *mountNode) (content []byte, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.content != nil {
+		return n.content, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, n.size))
+	err = fs.repo.Git(nil, nil, buf, "cat-file", "blob", n.obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object '%s': %v", n.obj, err)
+	}
+
+	n.content = buf.Bytes()
+	return n.content, nil
+}
+
+//fetch makes sure chunk 'c' is stored locally, concurrent calls for the
+//same chunk wait for the first to complete
+func (fs *mountFS) fetch(c PointerChunk) (err error) {
+	k := c.K
+	fs.fetchMu.Lock()
+	if done, ok := fs.fetching[k]; ok {
+		fs.fetchMu.Unlock()
+		<-done
+		return nil
+	}
+
+	//chunks that are stored already are not reported as skipped on every read
+	p, _ := fs.repo.chunkPath(c.Version, k, false)
+	if _, err = os.Stat(p); err == nil {
+		fs.fetchMu.Unlock()
+		return nil
+	}
+
+	done := make(chan struct{})
+	fs.fetching[k] = done
+	fs.fetchMu.Unlock()
+
+	err = fs.repo.fetchChunk(context.Background(), c.Version, k)
+	fs.repo.flushUsage(nil)
+
+	fs.fetchMu.Lock()
+	delete(fs.fetching, k)
+	fs.fetchMu.Unlock()
+	close(done)
+	return err
+}
@@ -0,0 +1,88 @@
+// +build darwin
+
+package bits
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+//MountPollInterval is how often we check whether the directory was
+//unmounted by someone else
+var MountPollInterval = 2 * time.Second
+
+//Mount exposes the tree of 'ref' as a read-only filesystem at directory
+//'dir' until the context is cancelled or the filesystem is unmounted. The
+//tree is served over NFSv3 on a loopback port and mounted with the nfs
+//client of the system, see ServeNFS.
+func (repo *Repository) Mount(ctx context.Context, ref, dir string) (err error) {
+	fs, err := repo.newMountFS(ref)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen for nfs connections: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- newNFSServer(fs).serve(ctx, l)
+	}()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	opts := fmt.Sprintf("vers=3,tcp,port=%d,mountport=%d,rdonly,locallocks,nobrowse", port, port)
+	out, err := exec.Command("mount_nfs", "-o", opts, "127.0.0.1:/", dir).CombinedOutput()
+	if err != nil {
+		cancel()
+		<-served
+		return fmt.Errorf("failed to mount '%s': %v: %s", dir, err, out)
+	}
+
+	ticker := time.NewTicker(MountPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err = <-served:
+			exec.Command("umount", "-f", dir).Run()
+			return err
+		case <-ctx.Done():
+			out, err = exec.Command("umount", dir).CombinedOutput()
+			if err != nil {
+				out, err = exec.Command("umount", "-f", dir).CombinedOutput()
+			}
+
+			cancel()
+			<-served
+			if err != nil {
+				return fmt.Errorf("failed to unmount '%s': %v: %s", dir, err, out)
+			}
+
+			return nil
+		case <-ticker.C:
+			if !mounted(dir) {
+				cancel()
+				return <-served
+			}
+		}
+	}
+}
+
+//mounted returns whether a filesystem is mounted at 'dir', i.e. whether it
+//is on another device than its parent
+func mounted(dir string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+
+	return st.Dev != parent.Dev
+}
@@ -0,0 +1,424 @@
+// +build linux
+
+package bits
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+//@see https://www.kernel.org/doc/html/latest/filesystems/fuse.html and
+//include/uapi/linux/fuse.h for the protocol between the kernel and us
+const (
+	fuseOpLookup      = 1
+	fuseOpForget      = 2
+	fuseOpGetattr     = 3
+	fuseOpReadlink    = 5
+	fuseOpOpen        = 14
+	fuseOpRead        = 15
+	fuseOpStatfs      = 17
+	fuseOpRelease     = 18
+	fuseOpFlush       = 25
+	fuseOpInit        = 26
+	fuseOpOpendir     = 27
+	fuseOpReaddir     = 28
+	fuseOpReleasedir  = 29
+	fuseOpAccess      = 34
+	fuseOpInterrupt   = 36
+	fuseOpDestroy     = 38
+	fuseOpBatchForget = 42
+
+	//we speak version 7.19 of the protocol, the kernel adapts to it
+	fuseMajor = 7
+	fuseMinor = 19
+
+	//the largest read we ask the kernel for, requests need some room for headers
+	fuseMaxRead   = 128 * 1024
+	fuseBufSize   = fuseMaxRead + 4096
+	fuseInHeader  = 40
+	fuseOutHeader = 16
+	fuseAttrSize  = 88
+
+	//the tree of a ref never changes so the kernel may cache it for long
+	fuseValidSecs = 3600
+
+	//asks the kernel to keep cached file content when a file is opened again
+	fuseOpenKeepCache = 1 << 1
+)
+
+//native byte order of the fuse protocol
+var fuseOrder = binary.LittleEndian
+
+//Mount exposes the tree of 'ref' as a read-only filesystem at directory
+//'dir' until the context is cancelled or the filesystem is unmounted. The
+//content of split files is fetched and decrypted when it is read.
+func (repo *Repository) Mount(ctx context.Context, ref, dir string) (err error) {
+	fs, err := repo.newMountFS(ref)
+	if err != nil {
+		return err
+	}
+
+	dev, unmount, err := fuseMount(dir)
+	if err != nil {
+		return fmt.Errorf("failed to mount '%s': %v", dir, err)
+	}
+
+	defer dev.Close()
+	go func() {
+		<-ctx.Done()
+		unmount()
+	}()
+
+	srv := &fuseServer{fs: fs, fd: int(dev.Fd())}
+	return srv.serve()
+}
+
+//fuseMount mounts a fuse filesystem at 'dir' and returns the device that
+//requests are read from. Privileged users mount directly, others use the
+//setuid fusermount helper
+func fuseMount(dir string) (dev *os.File, unmount func() error, err error) {
+	dev, err = os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err == nil {
+		opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d", dev.Fd(), os.Getuid(), os.Getgid())
+		err = syscall.Mount("git-bits", dir, "fuse.git-bits", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, opts)
+		if err == nil {
+			return dev, func() error { return syscall.Unmount(dir, syscall.MNT_DETACH) }, nil
+		}
+
+		dev.Close()
+	}
+
+	helper, lerr := exec.LookPath("fusermount3")
+	if lerr != nil {
+		helper, lerr = exec.LookPath("fusermount")
+		if lerr != nil {
+			return nil, nil, fmt.Errorf("not permitted to mount (%v) and fusermount is not installed", err)
+		}
+	}
+
+	//fusermount sends the device back over a socket
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create socket pair: %v", err)
+	}
+
+	local := os.NewFile(uintptr(fds[0]), "fusermount-local")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount-remote")
+	defer local.Close()
+	defer remote.Close()
+
+	cmd := exec.Command(helper, "-o", "ro,nosuid,nodev,fsname=git-bits,subtype=git-bits", "--", dir)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to run '%s': %v", helper, err)
+	}
+
+	buf := make([]byte, 32)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(fds[0], buf, oob, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to receive fuse device: %v", err)
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, nil, fmt.Errorf("unexpected message from fusermount: %v", err)
+	}
+
+	devfds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(devfds) != 1 {
+		return nil, nil, fmt.Errorf("unexpected rights from fusermount: %v", err)
+	}
+
+	return os.NewFile(uintptr(devfds[0]), "/dev/fuse"), func() error {
+		return exec.Command(helper, "-u", "-z", dir).Run()
+	}, nil
+}
+
+//fuseServer answers the requests of the kernel
+type fuseServer struct {
+	fs *mountFS
+	fd int
+}
+
+//serve reads requests until the filesystem is unmounted, reads are
+//handled concurrently as they may need to wait for the remote
+func (srv *fuseServer) serve() (err error) {
+	for {
+		buf := make([]byte, fuseBufSize)
+		n, err := syscall.Read(srv.fd, buf)
+		if err != nil {
+			switch err {
+			case syscall.EINTR, syscall.EAGAIN, syscall.ENOENT:
+				continue //interrupted or aborted requests
+			case syscall.ENODEV:
+				return nil //unmounted
+			}
+
+			return fmt.Errorf("failed to read fuse request: %v", err)
+		}
+
+		if n < fuseInHeader {
+			return fmt.Errorf("fuse request of %d bytes is too short", n)
+		}
+
+		op := fuseOrder.Uint32(buf[4:])
+		switch op {
+		case fuseOpRead:
+			go srv.handle(op, buf[:n])
+		case fuseOpDestroy:
+			srv.reply(fuseOrder.Uint64(buf[8:]), 0, nil)
+			return nil
+		default:
+			srv.handle(op, buf[:n])
+		}
+	}
+}
+
+//handle answers a single request
+func (srv *fuseServer) handle(op uint32, req []byte) {
+	unique := fuseOrder.Uint64(req[8:])
+	nodeid := fuseOrder.Uint64(req[16:])
+	in := req[fuseInHeader:]
+
+	switch op {
+	case fuseOpForget, fuseOpBatchForget, fuseOpInterrupt:
+		return //these expect no reply
+	case fuseOpInit:
+		srv.reply(unique, 0, srv.initOut(in))
+		return
+	case fuseOpStatfs:
+		out := make([]byte, 80)
+		fuseOrder.PutUint32(out[40:], 4096) //bsize
+		fuseOrder.PutUint32(out[44:], 255)  //namelen
+		fuseOrder.PutUint32(out[48:], 4096) //frsize
+		srv.reply(unique, 0, out)
+		return
+	case fuseOpRelease, fuseOpReleasedir, fuseOpFlush:
+		srv.reply(unique, 0, nil)
+		return
+	}
+
+	n := srv.fs.node(nodeid)
+	if n == nil {
+		srv.reply(unique, syscall.ENOENT, nil)
+		return
+	}
+
+	switch op {
+	case fuseOpLookup:
+		child := n.child(cstring(in))
+		if child == nil {
+			srv.reply(unique, syscall.ENOENT, nil)
+			return
+		}
+
+		attr, errno := srv.attr(child)
+		if errno != 0 {
+			srv.reply(unique, errno, nil)
+			return
+		}
+
+		out := make([]byte, 40, 40+fuseAttrSize)
+		fuseOrder.PutUint64(out[0:], child.id)
+		fuseOrder.PutUint64(out[16:], fuseValidSecs) //entry_valid
+		fuseOrder.PutUint64(out[24:], fuseValidSecs) //attr_valid
+		srv.reply(unique, 0, append(out, attr...))
+	case fuseOpGetattr:
+		attr, errno := srv.attr(n)
+		if errno != 0 {
+			srv.reply(unique, errno, nil)
+			return
+		}
+
+		out := make([]byte, 16, 16+fuseAttrSize)
+		fuseOrder.PutUint64(out[0:], fuseValidSecs)
+		srv.reply(unique, 0, append(out, attr...))
+	case fuseOpReadlink:
+		if n.mode&os.ModeSymlink == 0 {
+			srv.reply(unique, syscall.EINVAL, nil)
+			return
+		}
+
+		target, err := srv.fs.content(n)
+		if err != nil {
+			srv.fail(unique, err)
+			return
+		}
+
+		srv.reply(unique, 0, target)
+	case fuseOpOpen, fuseOpOpendir:
+		if len(in) >= 4 && fuseOrder.Uint32(in)&syscall.O_ACCMODE != syscall.O_RDONLY {
+			srv.reply(unique, syscall.EROFS, nil)
+			return
+		}
+
+		out := make([]byte, 16)
+		if op == fuseOpOpen {
+			fuseOrder.PutUint32(out[8:], fuseOpenKeepCache)
+		}
+
+		srv.reply(unique, 0, out)
+	case fuseOpRead:
+		if len(in) < 24 {
+			srv.reply(unique, syscall.EINVAL, nil)
+			return
+		}
+
+		off := int64(fuseOrder.Uint64(in[8:]))
+		size := int(fuseOrder.Uint32(in[16:]))
+		data, err := srv.fs.read(n, off, size)
+		if err != nil {
+			srv.fail(unique, err)
+			return
+		}
+
+		srv.reply(unique, 0, data)
+	case fuseOpReaddir:
+		if len(in) < 24 {
+			srv.reply(unique, syscall.EINVAL, nil)
+			return
+		}
+
+		off := int(fuseOrder.Uint64(in[8:]))
+		size := int(fuseOrder.Uint32(in[16:]))
+		srv.reply(unique, 0, srv.dirents(n, off, size))
+	case fuseOpAccess:
+		if len(in) >= 4 && fuseOrder.Uint32(in)&2 != 0 { //W_OK
+			srv.reply(unique, syscall.EROFS, nil)
+			return
+		}
+
+		srv.reply(unique, 0, nil)
+	default:
+		srv.reply(unique, syscall.ENOSYS, nil)
+	}
+}
+
+//initOut negotiates the protocol version and limits
+func (srv *fuseServer) initOut(in []byte) []byte {
+	out := make([]byte, 24)
+	fuseOrder.PutUint32(out[0:], fuseMajor)
+	fuseOrder.PutUint32(out[4:], fuseMinor)
+	if len(in) >= 12 {
+		copy(out[8:12], in[8:12]) //max_readahead as proposed by the kernel
+	}
+
+	fuseOrder.PutUint16(out[16:], 16)          //max_background
+	fuseOrder.PutUint16(out[18:], 12)          //congestion_threshold
+	fuseOrder.PutUint32(out[20:], fuseMaxRead) //max_write
+	return out
+}
+
+//attr encodes the attributes of a node
+func (srv *fuseServer) attr(n *mountNode) (attr []byte, errno syscall.Errno) {
+	size := int64(0)
+	mode := uint32(n.mode.Perm())
+	nlink := uint32(1)
+	switch {
+	case n.mode.IsDir():
+		mode |= syscall.S_IFDIR
+		nlink = 2
+	case n.mode&os.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+		size = n.size
+	default:
+		mode |= syscall.S_IFREG
+		if n.ptr == nil {
+			size = n.size
+			break
+		}
+
+		var err error
+		size, err = srv.fs.size(n)
+		if err != nil {
+			fmt.Fprintf(srv.fs.repo.output, "failed to determine size of '%s': %v\n", n.name, err)
+			return nil, syscall.EIO
+		}
+	}
+
+	attr = make([]byte, fuseAttrSize)
+	mtime := uint64(srv.fs.mtime.Unix())
+	fuseOrder.PutUint64(attr[0:], n.id)
+	fuseOrder.PutUint64(attr[8:], uint64(size))
+	fuseOrder.PutUint64(attr[16:], uint64((size+511)/512))
+	fuseOrder.PutUint64(attr[24:], mtime) //atime
+	fuseOrder.PutUint64(attr[32:], mtime) //mtime
+	fuseOrder.PutUint64(attr[40:], mtime) //ctime
+	fuseOrder.PutUint32(attr[60:], mode)
+	fuseOrder.PutUint32(attr[64:], nlink)
+	fuseOrder.PutUint32(attr[68:], uint32(os.Getuid()))
+	fuseOrder.PutUint32(attr[72:], uint32(os.Getgid()))
+	fuseOrder.PutUint32(attr[80:], 4096) //blksize
+	return attr, 0
+}
+
+//dirents encodes the entries of a directory starting at entry 'off' that fit
+//in 'size' bytes, the first two entries are '.' and '..'
+func (srv *fuseServer) dirents(n *mountNode, off, size int) []byte {
+	out := []byte{}
+	for i := off; i < len(n.children)+2; i++ {
+		name, ino, typ := ".", n.id, uint32(syscall.DT_DIR)
+		if i == 1 {
+			name = ".."
+		} else if i > 1 {
+			c := n.children[i-2]
+			name, ino, typ = c.name, c.id, syscall.DT_REG
+			if c.mode.IsDir() {
+				typ = syscall.DT_DIR
+			} else if c.mode&os.ModeSymlink != 0 {
+				typ = syscall.DT_LNK
+			}
+		}
+
+		//each entry is padded to 8 bytes
+		entlen := (24 + len(name) + 7) &^ 7
+		if len(out)+entlen > size {
+			break
+		}
+
+		ent := make([]byte, entlen)
+		fuseOrder.PutUint64(ent[0:], ino)
+		fuseOrder.PutUint64(ent[8:], uint64(i+1)) //offset of the next entry
+		fuseOrder.PutUint32(ent[16:], uint32(len(name)))
+		fuseOrder.PutUint32(ent[20:], typ)
+		copy(ent[24:], name)
+		out = append(out, ent...)
+	}
+
+	return out
+}
+
+//fail reports an error that occured while handling a request
+func (srv *fuseServer) fail(unique uint64, err error) {
+	fmt.Fprintf(srv.fs.repo.output, "failed to handle filesystem request: %v\n", err)
+	srv.reply(unique, syscall.EIO, nil)
+}
+
+//reply writes the answer to request 'unique' to the device in a single write
+func (srv *fuseServer) reply(unique uint64, errno syscall.Errno, data []byte) {
+	out := make([]byte, fuseOutHeader+len(data))
+	fuseOrder.PutUint32(out[0:], uint32(len(out)))
+	fuseOrder.PutUint32(out[4:], uint32(-int32(errno)))
+	fuseOrder.PutUint64(out[8:], unique)
+	copy(out[fuseOutHeader:], data)
+	syscall.Write(srv.fd, out)
+}
+
+//cstring returns the NUL terminated string at the start of 'b'
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+
+	return string(b)
+}
@@ -0,0 +1,791 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+//@see https://tools.ietf.org/html/rfc5531 for the rpc messages and
+//https://tools.ietf.org/html/rfc1813 for version 3 of the nfs and mount
+//protocols, both are served on the same port such that clients don't need
+//a portmapper
+const (
+	rpcCall        = 0
+	rpcReply       = 1
+	rpcVersion     = 2
+	rpcAccepted    = 0
+	rpcDenied      = 1
+	rpcMismatch    = 0
+	rpcSuccess     = 0
+	rpcProgUnavail = 1
+	rpcProgMismat  = 2
+	rpcProcUnavail = 3
+	rpcGarbageArgs = 4
+	rpcAuthNone    = 0
+	rpcAuthSys     = 1
+
+	//the largest request we accept, clients only send small ones as we
+	//don't allow writes
+	rpcMaxRecord = 64 * 1024
+
+	nfsProgram   = 100003
+	mountProgram = 100005
+	nfsVersion   = 3
+
+	mountProcNull    = 0
+	mountProcMnt     = 1
+	mountProcDump    = 2
+	mountProcUmnt    = 3
+	mountProcUmntAll = 4
+	mountProcExport  = 5
+
+	nfsProcNull        = 0
+	nfsProcGetattr     = 1
+	nfsProcSetattr     = 2
+	nfsProcLookup      = 3
+	nfsProcAccess      = 4
+	nfsProcReadlink    = 5
+	nfsProcRead        = 6
+	nfsProcWrite       = 7
+	nfsProcCreate      = 8
+	nfsProcMkdir       = 9
+	nfsProcSymlink     = 10
+	nfsProcMknod       = 11
+	nfsProcRemove      = 12
+	nfsProcRmdir       = 13
+	nfsProcRename      = 14
+	nfsProcLink        = 15
+	nfsProcReaddir     = 16
+	nfsProcReaddirplus = 17
+	nfsProcFsstat      = 18
+	nfsProcFsinfo      = 19
+	nfsProcPathconf    = 20
+	nfsProcCommit      = 21
+
+	nfsOK           = 0
+	nfsErrNoEnt     = 2
+	nfsErrIO        = 5
+	nfsErrNotDir    = 20
+	nfsErrInval     = 22
+	nfsErrROFS      = 30
+	nfsErrStale     = 70
+	nfsErrBadHandle = 10001
+	nfsErrTooSmall  = 10005
+
+	mountErrNoEnt = 2
+
+	nfsTypeReg = 1
+	nfsTypeDir = 2
+	nfsTypeLnk = 5
+
+	nfsAccessRead    = 0x01
+	nfsAccessLookup  = 0x02
+	nfsAccessExecute = 0x20
+
+	//file handles are the node id
+	nfsHandleSize = 8
+
+	//the largest read we serve, clients pick their size below it
+	nfsMaxRead = 128 * 1024
+
+	//the tree of a ref never changes so clients may cache it for long
+	nfsValidSecs = 3600
+
+	//encoded sizes of the attributes and of the fixed part of directory
+	//entries, used to fit entries in the size the client asks for
+	nfsAttrSize      = 84
+	nfsEntrySize     = 24
+	nfsEntryPlusSize = nfsEntrySize + 4 + nfsAttrSize + 4 + 4 + nfsHandleSize
+)
+
+//xdrOrder is the byte order of all numbers in rpc messages
+var xdrOrder = binary.BigEndian
+
+//xdrReader decodes the arguments of a call, decoding past the end records
+//an error such that arguments are checked once after decoding
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+func (r *xdrReader) fixed(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	b := r.fixed(4)
+	if b == nil {
+		return 0
+	}
+
+	return xdrOrder.Uint32(b)
+}
+
+func (r *xdrReader) uint64() uint64 {
+	b := r.fixed(8)
+	if b == nil {
+		return 0
+	}
+
+	return xdrOrder.Uint64(b)
+}
+
+//opaque decodes variable length data of at most 'max' bytes, padded to 4
+func (r *xdrReader) opaque(max int) []byte {
+	n := int(r.uint32())
+	if n > max {
+		r.err = fmt.Errorf("opaque data of %d bytes is larger than %d", n, max)
+		return nil
+	}
+
+	b := r.fixed((n + 3) &^ 3)
+	if b == nil {
+		return nil
+	}
+
+	return b[:n]
+}
+
+//xdrWriter encodes a reply
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	var b [4]byte
+	xdrOrder.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	var b [8]byte
+	xdrOrder.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+		return
+	}
+
+	w.uint32(0)
+}
+
+//opaque encodes variable length data, padded to 4 bytes
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.Write(b)
+	w.Write(make([]byte, (4-len(b)%4)%4))
+}
+
+//ServeNFS serves the tree of 'ref' as a read-only NFSv3 filesystem to the
+//connections accepted on 'l' until the context is cancelled, the mount
+//protocol is served on the same port and exports the tree as '/'. This is
+//how the tree is mounted on platforms without FUSE, e.g. on macOS with
+//'mount_nfs -o vers=3,tcp,port=<port>,mountport=<port> 127.0.0.1:/ <dir>'.
+func (repo *Repository) ServeNFS(ctx context.Context, ref string, l net.Listener) (err error) {
+	fs, err := repo.newMountFS(ref)
+	if err != nil {
+		return err
+	}
+
+	return newNFSServer(fs).serve(ctx, l)
+}
+
+//nfsServer answers the calls of nfs clients
+type nfsServer struct {
+	fs *mountFS
+
+	//the directory each node is in, the root is its own parent
+	parents map[uint64]*mountNode
+}
+
+func newNFSServer(fs *mountFS) *nfsServer {
+	srv := &nfsServer{fs: fs, parents: map[uint64]*mountNode{}}
+	for _, n := range fs.nodes {
+		for _, c := range n.children {
+			srv.parents[c.id] = n
+		}
+	}
+
+	srv.parents[1] = fs.node(1)
+	return srv
+}
+
+//serve accepts connections until the context is cancelled
+func (srv *nfsServer) serve(ctx context.Context, l net.Listener) (err error) {
+	var wg sync.WaitGroup
+	conns := map[net.Conn]struct{}{}
+	var mu sync.Mutex
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to accept nfs connection: %v", err)
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serveConn(ctx, conn)
+
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+//serveConn reads calls until the client disconnects, calls are handled
+//concurrently as reads may need to wait for the remote
+func (srv *nfsServer) serveConn(ctx context.Context, conn net.Conn) {
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	r := bufio.NewReader(conn)
+	for {
+		call, err := readRecord(r)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				fmt.Fprintf(srv.fs.repo.output, "failed to read nfs call: %v\n", err)
+			}
+
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := srv.handle(call)
+			if reply == nil {
+				return
+			}
+
+			wmu.Lock()
+			defer wmu.Unlock()
+			conn.Write(reply)
+		}()
+	}
+}
+
+//readRecord reads a call, which is send as one or more fragments that are
+//each prefixed with their size and whether they are the last
+func readRecord(r io.Reader) (rec []byte, err error) {
+	var hdr [4]byte
+	for {
+		_, err = io.ReadFull(r, hdr[:])
+		if err != nil {
+			return nil, err
+		}
+
+		n := int(xdrOrder.Uint32(hdr[:]) &^ (1 << 31))
+		if len(rec)+n > rpcMaxRecord {
+			return nil, fmt.Errorf("call of more than %d bytes", rpcMaxRecord)
+		}
+
+		frag := make([]byte, n)
+		_, err = io.ReadFull(r, frag)
+		if err != nil {
+			return nil, err
+		}
+
+		rec = append(rec, frag...)
+		if xdrOrder.Uint32(hdr[:])&(1<<31) != 0 {
+			return rec, nil
+		}
+	}
+}
+
+//handle answers a single call, it returns the reply as a single fragment
+//or nil if the call should be ignored
+func (srv *nfsServer) handle(call []byte) []byte {
+	r := &xdrReader{b: call}
+	xid := r.uint32()
+	typ := r.uint32()
+	rpcvers := r.uint32()
+	prog := r.uint32()
+	vers := r.uint32()
+	proc := r.uint32()
+	r.uint32() //credential flavor, any is accepted
+	r.opaque(400)
+	r.uint32() //verifier flavor
+	r.opaque(400)
+	if r.err != nil || typ != rpcCall {
+		return nil
+	}
+
+	w := &xdrWriter{}
+	w.Write(make([]byte, 4)) //record marker
+	w.uint32(xid)
+	w.uint32(rpcReply)
+	if rpcvers != rpcVersion {
+		w.uint32(rpcDenied)
+		w.uint32(rpcMismatch)
+		w.uint32(rpcVersion)
+		w.uint32(rpcVersion)
+		return srv.record(w)
+	}
+
+	w.uint32(rpcAccepted)
+	w.uint32(rpcAuthNone)
+	w.uint32(0)
+
+	res := &xdrWriter{}
+	stat := uint32(rpcSuccess)
+	switch {
+	case prog != nfsProgram && prog != mountProgram:
+		stat = rpcProgUnavail
+	case vers != nfsVersion:
+		w.uint32(rpcProgMismat)
+		w.uint32(nfsVersion)
+		w.uint32(nfsVersion)
+		return srv.record(w)
+	case prog == mountProgram:
+		stat = srv.handleMount(proc, r, res)
+	default:
+		stat = srv.handleNFS(proc, r, res)
+	}
+
+	if r.err != nil {
+		stat = rpcGarbageArgs
+	}
+
+	w.uint32(stat)
+	if stat == rpcSuccess {
+		w.Write(res.Bytes())
+	}
+
+	return srv.record(w)
+}
+
+//record sets the marker of a reply that is send as a single fragment
+func (srv *nfsServer) record(w *xdrWriter) []byte {
+	b := w.Bytes()
+	xdrOrder.PutUint32(b, uint32(len(b)-4)|1<<31)
+	return b
+}
+
+//handleMount answers calls of the mount protocol, only the root of the tree
+//is exported
+func (srv *nfsServer) handleMount(proc uint32, r *xdrReader, w *xdrWriter) (stat uint32) {
+	switch proc {
+	case mountProcNull, mountProcUmnt, mountProcUmntAll:
+	case mountProcMnt:
+		dir := string(r.opaque(1024))
+		if dir != "/" {
+			w.uint32(mountErrNoEnt)
+			break
+		}
+
+		w.uint32(nfsOK)
+		w.opaque(srv.fh(1))
+		w.uint32(2)
+		w.uint32(rpcAuthSys)
+		w.uint32(rpcAuthNone)
+	case mountProcDump:
+		w.bool(false)
+	case mountProcExport:
+		w.bool(true)
+		w.opaque([]byte("/"))
+		w.bool(false) //no groups
+		w.bool(false)
+	default:
+		return rpcProcUnavail
+	}
+
+	return rpcSuccess
+}
+
+//handleNFS answers calls of the nfs protocol, anything that would modify
+//the tree fails as it is read-only
+func (srv *nfsServer) handleNFS(proc uint32, r *xdrReader, w *xdrWriter) (stat uint32) {
+	switch proc {
+	case nfsProcNull:
+		return rpcSuccess
+	case nfsProcSetattr, nfsProcWrite, nfsProcCreate, nfsProcMkdir, nfsProcSymlink, nfsProcMknod, nfsProcRemove, nfsProcRmdir, nfsProcCommit:
+		w.uint32(nfsErrROFS)
+		w.bool(false) //no attributes before
+		w.bool(false) //or after
+		return rpcSuccess
+	case nfsProcRename:
+		w.uint32(nfsErrROFS)
+		for i := 0; i < 4; i++ {
+			w.bool(false)
+		}
+
+		return rpcSuccess
+	case nfsProcLink:
+		w.uint32(nfsErrROFS)
+		for i := 0; i < 3; i++ {
+			w.bool(false)
+		}
+
+		return rpcSuccess
+	case nfsProcGetattr, nfsProcLookup, nfsProcAccess, nfsProcReadlink, nfsProcRead, nfsProcReaddir, nfsProcReaddirplus, nfsProcFsstat, nfsProcFsinfo, nfsProcPathconf:
+	default:
+		return rpcProcUnavail
+	}
+
+	n, status := srv.node(r.opaque(64))
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+
+	if status != nfsOK {
+		w.uint32(status)
+		if proc != nfsProcGetattr {
+			w.bool(false)
+		}
+
+		return rpcSuccess
+	}
+
+	switch proc {
+	case nfsProcGetattr:
+		attr, status := srv.attr(n)
+		w.uint32(status)
+		w.Write(attr)
+	case nfsProcLookup:
+		name := string(r.opaque(1024))
+		if r.err != nil {
+			return rpcGarbageArgs
+		}
+
+		if !n.mode.IsDir() {
+			w.uint32(nfsErrNotDir)
+			srv.postOpAttr(w, n)
+			break
+		}
+
+		child := n.child(name)
+		switch name {
+		case ".":
+			child = n
+		case "..":
+			child = srv.parents[n.id]
+		}
+
+		if child == nil {
+			w.uint32(nfsErrNoEnt)
+			srv.postOpAttr(w, n)
+			break
+		}
+
+		attr, status := srv.attr(child)
+		if status != nfsOK {
+			w.uint32(status)
+			srv.postOpAttr(w, n)
+			break
+		}
+
+		w.uint32(nfsOK)
+		w.opaque(srv.fh(child.id))
+		w.bool(true)
+		w.Write(attr)
+		srv.postOpAttr(w, n)
+	case nfsProcAccess:
+		access := r.uint32()
+		if r.err != nil {
+			return rpcGarbageArgs
+		}
+
+		allowed := uint32(nfsAccessRead)
+		if n.mode.IsDir() {
+			allowed |= nfsAccessLookup
+		}
+
+		if n.mode&0111 != 0 {
+			allowed |= nfsAccessExecute
+		}
+
+		w.uint32(nfsOK)
+		srv.postOpAttr(w, n)
+		w.uint32(access & allowed)
+	case nfsProcReadlink:
+		if n.mode&os.ModeSymlink == 0 {
+			w.uint32(nfsErrInval)
+			srv.postOpAttr(w, n)
+			break
+		}
+
+		target, err := srv.fs.content(n)
+		if err != nil {
+			srv.fail(w, err)
+			break
+		}
+
+		w.uint32(nfsOK)
+		srv.postOpAttr(w, n)
+		w.opaque(target)
+	case nfsProcRead:
+		off := r.uint64()
+		count := int(r.uint32())
+		if r.err != nil {
+			return rpcGarbageArgs
+		}
+
+		if !n.mode.IsRegular() {
+			w.uint32(nfsErrInval)
+			srv.postOpAttr(w, n)
+			break
+		}
+
+		if count > nfsMaxRead {
+			count = nfsMaxRead
+		}
+
+		size, err := srv.size(n)
+		if err != nil {
+			srv.fail(w, err)
+			break
+		}
+
+		data, err := srv.fs.read(n, int64(off), count)
+		if err != nil {
+			srv.fail(w, err)
+			break
+		}
+
+		w.uint32(nfsOK)
+		srv.postOpAttr(w, n)
+		w.uint32(uint32(len(data)))
+		w.bool(int64(off)+int64(len(data)) >= size)
+		w.opaque(data)
+	case nfsProcReaddir, nfsProcReaddirplus:
+		cookie := r.uint64()
+		r.fixed(8) //the verifier, the tree never changes
+		size := int(r.uint32())
+		if proc == nfsProcReaddirplus {
+			size = int(r.uint32()) //the maximum size of the reply
+		}
+
+		if r.err != nil {
+			return rpcGarbageArgs
+		}
+
+		if !n.mode.IsDir() {
+			w.uint32(nfsErrNotDir)
+			srv.postOpAttr(w, n)
+			break
+		}
+
+		srv.dirents(w, n, cookie, size, proc == nfsProcReaddirplus)
+	case nfsProcFsstat:
+		w.uint32(nfsOK)
+		srv.postOpAttr(w, n)
+		w.uint64(0)                         //total bytes
+		w.uint64(0)                         //free bytes
+		w.uint64(0)                         //available bytes
+		w.uint64(uint64(len(srv.fs.nodes))) //total files
+		w.uint64(0)                         //free files
+		w.uint64(0)                         //available files
+		w.uint32(nfsValidSecs)              //seconds the values won't change
+	case nfsProcFsinfo:
+		w.uint32(nfsOK)
+		srv.postOpAttr(w, n)
+		w.uint32(nfsMaxRead) //rtmax
+		w.uint32(nfsMaxRead) //rtpref
+		w.uint32(4096)       //rtmult
+		w.uint32(0)          //wtmax
+		w.uint32(0)          //wtpref
+		w.uint32(0)          //wtmult
+		w.uint32(nfsMaxRead) //dtpref
+		w.uint64(1<<63 - 1)  //maxfilesize
+		w.uint32(1)          //time_delta, in seconds
+		w.uint32(0)
+		w.uint32(0x0a) //symlinks are supported, the properties are the same for all files
+	case nfsProcPathconf:
+		w.uint32(nfsOK)
+		srv.postOpAttr(w, n)
+		w.uint32(1)   //linkmax
+		w.uint32(255) //name_max
+		w.bool(true)  //no_trunc
+		w.bool(true)  //chown_restricted
+		w.bool(false) //case_insensitive
+		w.bool(true)  //case_preserving
+	}
+
+	return rpcSuccess
+}
+
+//fh returns the file handle of node 'id'
+func (srv *nfsServer) fh(id uint64) []byte {
+	fh := make([]byte, nfsHandleSize)
+	xdrOrder.PutUint64(fh, id)
+	return fh
+}
+
+//node returns the node of file handle 'fh'
+func (srv *nfsServer) node(fh []byte) (n *mountNode, status uint32) {
+	if len(fh) != nfsHandleSize {
+		return nil, nfsErrBadHandle
+	}
+
+	n = srv.fs.node(xdrOrder.Uint64(fh))
+	if n == nil {
+		return nil, nfsErrStale
+	}
+
+	return n, nfsOK
+}
+
+//size returns the size of the node's content
+func (srv *nfsServer) size(n *mountNode) (size int64, err error) {
+	if n.ptr == nil {
+		return n.size, nil
+	}
+
+	return srv.fs.size(n)
+}
+
+//attr encodes the attributes of a node
+func (srv *nfsServer) attr(n *mountNode) (attr []byte, status uint32) {
+	typ, nlink := uint32(nfsTypeReg), uint32(1)
+	switch {
+	case n.mode.IsDir():
+		typ, nlink = nfsTypeDir, 2
+	case n.mode&os.ModeSymlink != 0:
+		typ = nfsTypeLnk
+	}
+
+	size := int64(0)
+	if !n.mode.IsDir() {
+		var err error
+		size, err = srv.size(n)
+		if err != nil {
+			fmt.Fprintf(srv.fs.repo.output, "failed to determine size of '%s': %v\n", n.name, err)
+			return nil, nfsErrIO
+		}
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid < 0 {
+		uid, gid = 0, 0
+	}
+
+	w := &xdrWriter{}
+	w.uint32(typ)
+	w.uint32(uint32(n.mode.Perm()))
+	w.uint32(nlink)
+	w.uint32(uint32(uid))
+	w.uint32(uint32(gid))
+	w.uint64(uint64(size))
+	w.uint64(uint64((size + 4095) &^ 4095)) //used
+	w.uint64(0)                             //rdev
+	w.uint64(1)                             //fsid
+	w.uint64(n.id)                          //fileid
+	mtime := uint32(srv.fs.mtime.Unix())
+	for i := 0; i < 3; i++ { //atime, mtime and ctime
+		w.uint32(mtime)
+		w.uint32(0)
+	}
+
+	return w.Bytes(), nfsOK
+}
+
+//postOpAttr encodes the attributes of a node that are optionally returned
+//with the result of most calls
+func (srv *nfsServer) postOpAttr(w *xdrWriter, n *mountNode) {
+	attr, status := srv.attr(n)
+	if status != nfsOK {
+		w.bool(false)
+		return
+	}
+
+	w.bool(true)
+	w.Write(attr)
+}
+
+//dirents encodes the entries of a directory after entry 'cookie' that fit in
+//'size' bytes, the first two entries are '.' and '..'. With 'plus' the
+//attributes and handle of each entry are included.
+func (srv *nfsServer) dirents(w *xdrWriter, n *mountNode, cookie uint64, size int, plus bool) {
+	entries := &xdrWriter{}
+	left := size - 4*4 - nfsAttrSize - 8 //status, attributes, verifier and eof
+	eof := true
+	for i := cookie; i < uint64(len(n.children)+2); i++ {
+		name, c := ".", n
+		if i == 1 {
+			name, c = "..", srv.parents[n.id]
+		} else if i > 1 {
+			c = n.children[i-2]
+			name = c.name
+		}
+
+		entlen := nfsEntrySize + (len(name)+3)&^3
+		if plus {
+			entlen = nfsEntryPlusSize + (len(name)+3)&^3
+		}
+
+		if entlen > left {
+			eof = false
+			break
+		}
+
+		left -= entlen
+		entries.bool(true)
+		entries.uint64(c.id)
+		entries.opaque([]byte(name))
+		entries.uint64(i + 1) //the cookie of the next entry
+		if plus {
+			srv.postOpAttr(entries, c)
+			entries.bool(true)
+			entries.opaque(srv.fh(c.id))
+		}
+	}
+
+	if entries.Len() == 0 && !eof {
+		w.uint32(nfsErrTooSmall)
+		srv.postOpAttr(w, n)
+		return
+	}
+
+	w.uint32(nfsOK)
+	srv.postOpAttr(w, n)
+	w.uint64(0) //verifier
+	w.Write(entries.Bytes())
+	w.bool(false) //no more entries follow
+	w.bool(eof)
+}
+
+//fail reports an error that occured while handling a call
+func (srv *nfsServer) fail(w *xdrWriter, err error) {
+	fmt.Fprintf(srv.fs.repo.output, "failed to handle filesystem request: %v\n", err)
+	w.uint32(nfsErrIO)
+	w.bool(false)
+}
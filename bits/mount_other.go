@@ -0,0 +1,17 @@
+// +build !linux,!darwin
+// +build !windows !amd64,!arm64
+
+package bits
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+//Mount exposes the tree of 'ref' as a read-only filesystem at directory
+//'dir', this is only supported on linux, macOS and 64-bit Windows. Elsewhere the tree can be
+//served with ServeNFS and mounted with the nfs client of the system.
+func (repo *Repository) Mount(ctx context.Context, ref, dir string) (err error) {
+	return fmt.Errorf("mounting is not supported on %s, serve the tree with 'git bits mount --nfs <addr> <ref>' and mount it with the nfs client instead", runtime.GOOS)
+}
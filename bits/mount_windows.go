@@ -0,0 +1,499 @@
+// +build windows
+// +build amd64 arm64
+
+package bits
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+//ProjFS (Windows Projected File System) asks us for directory listings,
+//file metadata and file content as they are first accessed. The files that
+//it wrote stay in the directory as regular files after that.
+//@see https://docs.microsoft.com/en-us/windows/win32/api/projectedfslib/
+var (
+	projfs = syscall.NewLazyDLL("ProjectedFSLib.dll")
+
+	prjMarkDirectoryAsPlaceholder = projfs.NewProc("PrjMarkDirectoryAsPlaceholder")
+	prjStartVirtualizing          = projfs.NewProc("PrjStartVirtualizing")
+	prjStopVirtualizing           = projfs.NewProc("PrjStopVirtualizing")
+	prjFillDirEntryBuffer         = projfs.NewProc("PrjFillDirEntryBuffer")
+	prjWritePlaceholderInfo       = projfs.NewProc("PrjWritePlaceholderInfo")
+	prjAllocateAlignedBuffer      = projfs.NewProc("PrjAllocateAlignedBuffer")
+	prjFreeAlignedBuffer          = projfs.NewProc("PrjFreeAlignedBuffer")
+	prjWriteFileData              = projfs.NewProc("PrjWriteFileData")
+	prjFileNameMatch              = projfs.NewProc("PrjFileNameMatch")
+	prjFileNameCompare            = projfs.NewProc("PrjFileNameCompare")
+)
+
+const (
+	hresultOK                 = 0
+	hresultFileNotFound       = 0x80070002 //HRESULT_FROM_WIN32(ERROR_FILE_NOT_FOUND)
+	hresultInsufficientBuffer = 0x8007007A //HRESULT_FROM_WIN32(ERROR_INSUFFICIENT_BUFFER)
+	hresultIODevice           = 0x8007045D //HRESULT_FROM_WIN32(ERROR_IO_DEVICE)
+	hresultInvalidArg         = 0x80070057 //E_INVALIDARG
+
+	prjFlagRestartScan = 0x1 //PRJ_CB_DATA_FLAG_ENUM_RESTART_SCAN
+
+	fileAttributeReadonly  = 0x1
+	fileAttributeDirectory = 0x10
+
+	//projfsWriteSize is the most content that is written at once
+	projfsWriteSize = 1024 * 1024
+)
+
+//prjGUID mirrors GUID
+type prjGUID struct {
+	Data1 uint32
+	Data2 uint16
+	Data3 uint16
+	Data4 [8]byte
+}
+
+//prjCallbacks mirrors PRJ_CALLBACKS
+type prjCallbacks struct {
+	StartDirectoryEnumeration uintptr
+	EndDirectoryEnumeration   uintptr
+	GetDirectoryEnumeration   uintptr
+	GetPlaceholderInfo        uintptr
+	GetFileData               uintptr
+	QueryFileName             uintptr
+	Notification              uintptr
+	CancelCommand             uintptr
+}
+
+//prjCallbackData mirrors PRJ_CALLBACK_DATA
+type prjCallbackData struct {
+	Size                           uint32
+	Flags                          uint32
+	NamespaceVirtualizationContext uintptr
+	CommandID                      int32
+	FileID                         prjGUID
+	DataStreamID                   prjGUID
+	FilePathName                   *uint16
+	VersionInfo                    uintptr
+	TriggeringProcessID            uint32
+	TriggeringProcessImageFileName *uint16
+	InstanceContext                uintptr
+}
+
+//prjFileBasicInfo mirrors PRJ_FILE_BASIC_INFO
+type prjFileBasicInfo struct {
+	IsDirectory    bool
+	FileSize       int64
+	CreationTime   int64
+	LastAccessTime int64
+	LastWriteTime  int64
+	ChangeTime     int64
+	FileAttributes uint32
+}
+
+//prjPlaceholderInfo mirrors PRJ_PLACEHOLDER_INFO without extended
+//attributes, security descriptors or alternate streams
+type prjPlaceholderInfo struct {
+	FileBasicInfo prjFileBasicInfo
+	EaInformation [2]uint32
+	Security      [2]uint32
+	Streams       [2]uint32
+	ProviderID    [128]byte
+	ContentID     [128]byte
+	VariableData  [1]byte
+}
+
+//projfsEnum is a directory enumeration that ProjFS asks entries of in
+//one or more calls
+type projfsEnum struct {
+	entries []*mountNode
+	next    int
+	pattern *uint16
+}
+
+//projfsSession serves the tree of one mount to ProjFS
+type projfsSession struct {
+	fs   *mountFS
+	ctx  uintptr
+	time int64
+
+	mu    sync.Mutex
+	enums map[prjGUID]*projfsEnum
+}
+
+var (
+	//sessions by the instance context that ProjFS passes to callbacks, such
+	//that no Go pointers are handed to it
+	projfsMu       sync.Mutex
+	projfsSessions = map[uintptr]*projfsSession{}
+	projfsNext     uintptr
+
+	//callbacks can't be released, all mounts of the process share them
+	projfsOnce      sync.Once
+	projfsCallbacks prjCallbacks
+)
+
+//Mount exposes the tree of 'ref' as a read-only filesystem at directory
+//'dir' until the context is cancelled. The directory is projected with
+//ProjFS, which has to be enabled as the optional Windows feature
+//'Client-ProjFS'. It must not exist or be empty, it is removed again
+//when the mount ends.
+func (repo *Repository) Mount(ctx context.Context, ref, dir string) (err error) {
+	err = projfs.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load ProjFS, enable the Windows feature 'Client-ProjFS': %v", err)
+	}
+
+	fs, err := repo.newMountFS(ref)
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(dir, 0777)
+	if os.IsExist(err) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return fmt.Errorf("failed to open '%s': %v", dir, err)
+		}
+
+		names, _ := f.Readdirnames(1)
+		f.Close()
+		if len(names) > 0 {
+			return fmt.Errorf("directory '%s' is not empty, ProjFS can only project into an empty directory", dir)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to create '%s': %v", dir, err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	root, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return fmt.Errorf("invalid directory '%s': %v", dir, err)
+	}
+
+	var id prjGUID
+	_, err = rand.Read((*[16]byte)(unsafe.Pointer(&id))[:])
+	if err != nil {
+		return fmt.Errorf("failed to generate virtualization instance id: %v", err)
+	}
+
+	hr, _, _ := prjMarkDirectoryAsPlaceholder.Call(uintptr(unsafe.Pointer(root)), 0, 0, uintptr(unsafe.Pointer(&id)))
+	if uint32(hr) != hresultOK {
+		return fmt.Errorf("failed to mark '%s' as virtualization root: HRESULT 0x%08X", dir, uint32(hr))
+	}
+
+	projfsOnce.Do(func() {
+		projfsCallbacks = prjCallbacks{
+			StartDirectoryEnumeration: syscall.NewCallback(projfsStartEnum),
+			EndDirectoryEnumeration:   syscall.NewCallback(projfsEndEnum),
+			GetDirectoryEnumeration:   syscall.NewCallback(projfsGetEnum),
+			GetPlaceholderInfo:        syscall.NewCallback(projfsGetPlaceholderInfo),
+			GetFileData:               syscall.NewCallback(projfsGetFileData),
+		}
+	})
+
+	s := &projfsSession{
+		fs:    fs,
+		time:  fs.mtime.UnixNano()/100 + 116444736000000000, //100ns intervals since 1601
+		enums: map[prjGUID]*projfsEnum{},
+	}
+
+	projfsMu.Lock()
+	projfsNext++
+	instance := projfsNext
+	projfsSessions[instance] = s
+	projfsMu.Unlock()
+
+	defer func() {
+		projfsMu.Lock()
+		delete(projfsSessions, instance)
+		projfsMu.Unlock()
+	}()
+
+	hr, _, _ = prjStartVirtualizing.Call(
+		uintptr(unsafe.Pointer(root)),
+		uintptr(unsafe.Pointer(&projfsCallbacks)),
+		instance,
+		0,
+		uintptr(unsafe.Pointer(&s.ctx)),
+	)
+
+	if uint32(hr) != hresultOK {
+		return fmt.Errorf("failed to start projecting '%s': HRESULT 0x%08X", dir, uint32(hr))
+	}
+
+	<-ctx.Done()
+	prjStopVirtualizing.Call(s.ctx)
+	return nil
+}
+
+//projfsSessionOf returns the session that a callback is for
+func projfsSessionOf(data *prjCallbackData) *projfsSession {
+	projfsMu.Lock()
+	defer projfsMu.Unlock()
+	return projfsSessions[data.InstanceContext]
+}
+
+//lookup returns the node at a path relative to the root, names are
+//compared the way the file system does: without regard to case
+func (s *projfsSession) lookup(p string) *mountNode {
+	n := s.fs.node(1)
+	for _, name := range strings.Split(p, `\`) {
+		if name == "" {
+			continue
+		}
+
+		var next *mountNode
+		for _, c := range n.children {
+			if projfsCompare(c.name, name) == 0 {
+				next = c
+				break
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+
+		n = next
+	}
+
+	return n
+}
+
+//basicInfo describes node 'n' to ProjFS, symlinks are projected as files
+//that hold their target like Git does without symlink support
+func (s *projfsSession) basicInfo(n *mountNode) (info prjFileBasicInfo, err error) {
+	info = prjFileBasicInfo{
+		CreationTime:   s.time,
+		LastAccessTime: s.time,
+		LastWriteTime:  s.time,
+		ChangeTime:     s.time,
+		FileAttributes: fileAttributeReadonly,
+	}
+
+	if n.mode.IsDir() {
+		info.IsDirectory = true
+		info.FileAttributes |= fileAttributeDirectory
+		return info, nil
+	}
+
+	if n.ptr != nil {
+		info.FileSize, err = s.fs.size(n)
+		return info, err
+	}
+
+	info.FileSize = n.size
+	return info, nil
+}
+
+func projfsStartEnum(data *prjCallbackData, enumID *prjGUID) uintptr {
+	s := projfsSessionOf(data)
+	if s == nil {
+		return hresultInvalidArg
+	}
+
+	n := s.lookup(utf16PtrToString(data.FilePathName))
+	if n == nil || !n.mode.IsDir() {
+		return hresultFileNotFound
+	}
+
+	//entries are listed in the order the file system sorts names in
+	entries := append([]*mountNode{}, n.children...)
+	sort.Slice(entries, func(i, j int) bool { return projfsCompare(entries[i].name, entries[j].name) < 0 })
+
+	s.mu.Lock()
+	s.enums[*enumID] = &projfsEnum{entries: entries}
+	s.mu.Unlock()
+	return hresultOK
+}
+
+func projfsEndEnum(data *prjCallbackData, enumID *prjGUID) uintptr {
+	s := projfsSessionOf(data)
+	if s == nil {
+		return hresultInvalidArg
+	}
+
+	s.mu.Lock()
+	delete(s.enums, *enumID)
+	s.mu.Unlock()
+	return hresultOK
+}
+
+func projfsGetEnum(data *prjCallbackData, enumID *prjGUID, pattern *uint16, handle uintptr) uintptr {
+	s := projfsSessionOf(data)
+	if s == nil {
+		return hresultInvalidArg
+	}
+
+	s.mu.Lock()
+	enum := s.enums[*enumID]
+	s.mu.Unlock()
+	if enum == nil {
+		return hresultInvalidArg
+	}
+
+	//the pattern is given with the first call and when restarting
+	if data.Flags&prjFlagRestartScan != 0 || enum.next == 0 {
+		enum.next = 0
+		enum.pattern = nil
+		if pattern != nil && *pattern != 0 {
+			enum.pattern = syscall.StringToUTF16Ptr(utf16PtrToString(pattern))
+		}
+	}
+
+	filled := 0
+	for ; enum.next < len(enum.entries); enum.next++ {
+		n := enum.entries[enum.next]
+		name := syscall.StringToUTF16Ptr(n.name)
+		if enum.pattern != nil {
+			match, _, _ := prjFileNameMatch.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(enum.pattern)))
+			if byte(match) == 0 {
+				continue
+			}
+		}
+
+		info, err := s.basicInfo(n)
+		if err != nil {
+			return hresultIODevice
+		}
+
+		hr, _, _ := prjFillDirEntryBuffer.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&info)), handle)
+		if uint32(hr) == hresultInsufficientBuffer {
+			break
+		}
+
+		if uint32(hr) != hresultOK {
+			return hr
+		}
+
+		filled++
+	}
+
+	//entries that didn't fit are asked for with the next call
+	if filled == 0 && enum.next < len(enum.entries) {
+		return hresultInsufficientBuffer
+	}
+
+	return hresultOK
+}
+
+func projfsGetPlaceholderInfo(data *prjCallbackData) uintptr {
+	s := projfsSessionOf(data)
+	if s == nil {
+		return hresultInvalidArg
+	}
+
+	p := utf16PtrToString(data.FilePathName)
+	n := s.lookup(p)
+	if n == nil {
+		return hresultFileNotFound
+	}
+
+	var info prjPlaceholderInfo
+	var err error
+	info.FileBasicInfo, err = s.basicInfo(n)
+	if err != nil {
+		return hresultIODevice
+	}
+
+	//the placeholder is written with the name that the tree holds
+	names := strings.Split(p, `\`)
+	names[len(names)-1] = n.name
+	name := syscall.StringToUTF16Ptr(strings.Join(names, `\`))
+	hr, _, _ := prjWritePlaceholderInfo.Call(data.NamespaceVirtualizationContext, uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info))
+	return hr
+}
+
+func projfsGetFileData(data *prjCallbackData, off uint64, length uint32) uintptr {
+	s := projfsSessionOf(data)
+	if s == nil {
+		return hresultInvalidArg
+	}
+
+	n := s.lookup(utf16PtrToString(data.FilePathName))
+	if n == nil || n.mode.IsDir() {
+		return hresultFileNotFound
+	}
+
+	end := off + uint64(length)
+	for off < end {
+		size := end - off
+		if size > projfsWriteSize {
+			size = projfsWriteSize
+		}
+
+		content, err := s.fs.read(n, int64(off), int(size))
+		if err != nil {
+			fmt.Fprintf(s.fs.repo.output, "failed to read '%s' for ProjFS: %v\n", n.name, err)
+			return hresultIODevice
+		}
+
+		if len(content) == 0 {
+			break
+		}
+
+		hr := projfsWrite(data, content, off)
+		if uint32(hr) != hresultOK {
+			return hr
+		}
+
+		off += uint64(len(content))
+	}
+
+	return hresultOK
+}
+
+//projfsWrite hands content at offset 'off' to ProjFS, it must be written
+//from a buffer that ProjFS aligned
+func projfsWrite(data *prjCallbackData, content []byte, off uint64) uintptr {
+	buf, _, _ := prjAllocateAlignedBuffer.Call(data.NamespaceVirtualizationContext, uintptr(len(content)))
+	if buf == 0 {
+		return hresultIODevice
+	}
+
+	//the buffer is not managed by Go, it is reinterpreted instead of converted
+	defer prjFreeAlignedBuffer.Call(buf)
+	ptr := *(*unsafe.Pointer)(unsafe.Pointer(&buf))
+	copy((*[1 << 30]byte)(ptr)[:len(content):len(content)], content)
+	hr, _, _ := prjWriteFileData.Call(
+		data.NamespaceVirtualizationContext,
+		uintptr(unsafe.Pointer(&data.DataStreamID)),
+		buf,
+		uintptr(off),
+		uintptr(len(content)),
+	)
+
+	return hr
+}
+
+//projfsCompare compares names the way the file system does
+func projfsCompare(a, b string) int {
+	r, _, _ := prjFileNameCompare.Call(
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(a))),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(b))),
+	)
+
+	return int(int32(r))
+}
+
+//utf16PtrToString reads a NUL terminated UTF-16 string
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+
+	chars := (*[1 << 29]uint16)(unsafe.Pointer(p))
+	n := 0
+	for chars[n] != 0 {
+		n++
+	}
+
+	return syscall.UTF16ToString(chars[:n:n])
+}
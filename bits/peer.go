@@ -0,0 +1,375 @@
+package bits
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	//PeerTimeout limits how long we wait for a single chunk from a peer
+	PeerTimeout = 10 * time.Second
+
+	//ChunkPathPrefix is the http path under which chunks are served
+	ChunkPathPrefix = "/chunks/"
+)
+
+//ChunkServer serves the encrypted chunks in the local chunk space over http
+//such that peers on the same network can fetch them. Chunks can only be
+//decrypted by those that know the key so they are served as-is. Once tokens
+//are issued every request must carry one, storing chunks always requires a
+//token with the write scope.
+type ChunkServer struct {
+	repo *Repository
+}
+
+//NewChunkServer sets up a http handler for the repositories local chunks
+func NewChunkServer(repo *Repository) *ChunkServer {
+	return &ChunkServer{repo: repo}
+}
+
+//ServeHTTP serves chunk files at /chunks/<hex key>, they are fetched with
+//GET (or HEAD) and stored with PUT
+func (srv *ChunkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := srv.repo.metrics
+	if m != nil {
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		defer func() {
+			m.Add("git_bits_requests_total", 1, "mode", "serve", "method", r.Method, "code", strconv.Itoa(sw.code))
+			m.Add("git_bits_bytes_sent_total", float64(sw.n), "mode", "serve")
+			if sw.code >= 500 {
+				m.Add("git_bits_errors_total", 1, "mode", "serve")
+			}
+		}()
+
+		w = sw
+	}
+
+	scope := ReadScope
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		scope = WriteScope
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !srv.authorize(w, r, scope) {
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, ChunkPathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, ChunkPathPrefix))
+	if err != nil || len(data) != KeySize {
+		http.Error(w, "invalid chunk key", http.StatusBadRequest)
+		return
+	}
+
+	k := K{}
+	copy(k[:], data)
+	if r.Method == "PUT" {
+		srv.storeChunk(w, r, k)
+		return
+	}
+
+	p, _ := srv.repo.Path(k, false)
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			m.Add("git_bits_cache_misses_total", 1, "mode", "serve")
+			http.NotFound(w, r)
+			return
+		}
+
+		http.Error(w, "failed to open chunk", http.StatusInternalServerError)
+		return
+	}
+
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to stat chunk", http.StatusInternalServerError)
+		return
+	}
+
+	m.Add("git_bits_cache_hits_total", 1, "mode", "serve")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+//statusWriter remembers the status code and counts the bytes of a response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	n    int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (n int, err error) {
+	n, err = w.ResponseWriter.Write(p)
+	w.n += n
+	return n, err
+}
+
+//authorize checks the bearer token of the request against the issued
+//tokens, it writes an error response and returns false if it may not
+//continue. Without issued tokens chunks can be read by anyone.
+func (srv *ChunkServer) authorize(w http.ResponseWriter, r *http.Request, scope TokenScope) bool {
+	tokens, err := srv.repo.Tokens()
+	if err != nil {
+		http.Error(w, "failed to read tokens", http.StatusInternalServerError)
+		return false
+	}
+
+	if len(tokens) == 0 && scope == ReadScope {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return false
+	}
+
+	t, ok := lookupToken(tokens, strings.TrimPrefix(auth, "Bearer "))
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+		return false
+	}
+
+	if !t.Scope.allows(scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+		http.Error(w, fmt.Sprintf("token '%s' doesn't have the %s scope", t.Name, scope), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+//storeChunk stores the encrypted chunk in the request body, it must hash to
+//the key such that stored chunks can't be overwritten with other content
+func (srv *ChunkServer) storeChunk(w http.ResponseWriter, r *http.Request, k K) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(ChunkBufferSize)+1))
+	if err != nil {
+		http.Error(w, "failed to read chunk", http.StatusBadRequest)
+		return
+	}
+
+	if len(data) > ChunkBufferSize {
+		http.Error(w, "chunk is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	srv.repo.metrics.Add("git_bits_bytes_received_total", float64(len(data)), "mode", "serve")
+	err = verifyChunk(KeyVersion0, k, data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid chunk: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	p, err := srv.repo.Path(k, true)
+	if err != nil {
+		http.Error(w, "failed to create chunk directory", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = os.Stat(p); err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+PartialChunkSuffix)
+	if err != nil {
+		http.Error(w, "failed to create chunk file", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		http.Error(w, "failed to write chunk file", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+//Serve serves local chunks to peers on listener 'l' until the context is
+//cancelled, optionally announcing itself on the local network using mdns
+func (repo *Repository) Serve(ctx context.Context, l net.Listener, announce bool) (err error) {
+	srv := &http.Server{Handler: NewChunkServer(repo)}
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+
+	if announce {
+		port := 0
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+		}
+
+		host, _ := os.Hostname()
+		go func() {
+			err := AnnouncePeer(ctx, fmt.Sprintf("%s-%d", dnsLabel(host), port), port)
+			if err != nil {
+				errCh <- fmt.Errorf("failed to announce: %v", err)
+			}
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return srv.Shutdown(context.Background())
+	case err = <-errCh:
+		srv.Close()
+		return err
+	}
+}
+
+//Peers returns the addresses of peers that are asked for chunks before the
+//remote, these are configured and (optionally) discovered when first asked
+func (repo *Repository) Peers() []string {
+	repo.peersOnce.Do(func() {
+		peers := append([]string{}, repo.conf.Peers...)
+		if repo.conf.PeerDiscovery {
+			found, err := DiscoverPeers(PeerDiscoveryTimeout)
+			if err != nil {
+				fmt.Fprintf(repo.output, "failed to discover peers: %v\n", err)
+			}
+
+			peers = append(peers, found...)
+		}
+
+		repo.peerMu.Lock()
+		repo.peers = peers
+		repo.peerMu.Unlock()
+	})
+
+	repo.peerMu.Lock()
+	defer repo.peerMu.Unlock()
+	return append([]string{}, repo.peers...)
+}
+
+//peerChunk asks each peer for the encrypted chunk 'k' of version 'v' and
+//returns the first that verifies. Peers that can't be reached are not asked
+//again. Peers only serve chunks of version 0.
+func (repo *Repository) peerChunk(v KeyVersion, k K) (data []byte, err error) {
+	peers := repo.Peers()
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers")
+	}
+
+	if v != KeyVersion0 {
+		return nil, fmt.Errorf("peers don't serve chunks of key version %d", v)
+	}
+
+	errs := []string{}
+	client := &http.Client{Timeout: PeerTimeout}
+	for _, peer := range peers {
+		data, err = repo.peerChunkFrom(client, peer, k)
+		if err == nil {
+			return data, nil
+		}
+
+		errs = append(errs, err.Error())
+	}
+
+	return nil, fmt.Errorf("no peer provided chunk '%x': \n %s", k, strings.Join(errs, "\n\t"))
+}
+
+//peerChunkFrom fetches the encrypted chunk 'k' from a single peer
+func (repo *Repository) peerChunkFrom(client *http.Client, peer string, k K) (data []byte, err error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s%x", peer, ChunkPathPrefix, k), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for peer '%s': %v", peer, err)
+	}
+
+	if repo.conf.PeerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+repo.conf.PeerToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		repo.dropPeer(peer)
+		return nil, fmt.Errorf("failed to request chunk from peer '%s': %v", peer, err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer '%s' responded with: %s", peer, resp.Status)
+	}
+
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, int64(ChunkBufferSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk from peer '%s': %v", peer, err)
+	}
+
+	//peers are not trusted, the content must hash to the key
+	err = verifyChunk(KeyVersion0, k, data)
+	if err != nil {
+		return nil, fmt.Errorf("peer '%s' served an invalid chunk: %v", peer, err)
+	}
+
+	return data, nil
+}
+
+//dropPeer stops asking 'peer' for chunks
+func (repo *Repository) dropPeer(peer string) {
+	repo.peerMu.Lock()
+	defer repo.peerMu.Unlock()
+	for i, p := range repo.peers {
+		if p == peer {
+			repo.peers = append(repo.peers[:i], repo.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+//verifyChunk checks that encrypted chunk 'data' decrypts, as key version
+//'v' encrypts it, to content that hashes to key 'k' with any of the key
+//hashes
+func verifyChunk(v KeyVersion, k K, data []byte) (err error) {
+	stream, err := v.stream(k)
+	if err != nil {
+		return err
+	}
+
+	plain := make([]byte, len(data))
+	stream.XORKeyStream(plain, data)
+	for h := range keyHashNames {
+		if h.Sum(plain) == k {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("content hashes to '%x'", SHA256.Sum(plain))
+}
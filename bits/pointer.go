@@ -0,0 +1,476 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+//PointerVersion is the version of the pointer format that is written, pointers
+//without a version line are considered to be version 0 and are still read
+const PointerVersion = 1
+
+//PointerVersionKeyHash is the version of pointers that record the hash their
+//keys were computed with. It is only written for keys that are not computed
+//with SHA256, such that other pointers remain readable by older versions.
+const PointerVersionKeyHash = 2
+
+//PointerVersionSealed is the version of pointers of which the key list is
+//encrypted with the configured 'bits.pointer-key'. The header and version
+//remain readable such that they are still recognized as pointers.
+const PointerVersionSealed = 3
+
+var (
+	//pointerMetaVersion is written right after the header
+	pointerMetaVersion = []byte("version")
+
+	//pointerMetaHash follows the version for keys not computed with SHA256
+	pointerMetaHash = []byte("hash")
+
+	//pointerMetaSize and pointerMetaChunks are written right before the footer
+	//such that keys can be streamed while the file is being split
+	pointerMetaSize   = []byte("size")
+	pointerMetaChunks = []byte("chunks")
+
+	//pointerMetaSealed prefixes the lines of an encrypted key list, which
+	//holds the keys and the metadata that is written before the footer
+	pointerMetaSealed = []byte("sealed")
+)
+
+//Pointer describes the content that is stored in git instead of the
+//actual file content: the keys of the chunks that make up the file
+type Pointer struct {
+	//Version of the format the pointer was read from
+	Version int
+
+	//KeyHash is the algorithm the keys of the chunks were computed with
+	KeyHash KeyHash
+
+	//FileSize is the plain-text size of the original file, -1 if unknown
+	FileSize int64
+
+	//Chunks in the order they make up the original file
+	Chunks []PointerChunk
+}
+
+//PointerChunk describes a single chunk of a pointer file, Size holds the
+//plain-text size of the chunk or -1 if it wasn't recorded
+type PointerChunk struct {
+	K       K
+	Version KeyVersion
+	Size    int64
+}
+
+//ParseKeyLine decodes a single line of a key listing: a hex encoded key that is
+//optionally followed by the plain-text size of the chunk it refers to. The
+//key may be preceded by its version byte (see FormatKey), keys of versions
+//that are not supported fail to parse.
+func ParseKeyLine(line []byte) (c PointerChunk, err error) {
+	c.Size = -1
+	key, rest := nextField(line)
+	size, rest := nextField(rest)
+	if len(key) == 0 || len(bytes.TrimSpace(rest)) > 0 {
+		return c, fmt.Errorf("unexpected key line '%s'", line)
+	}
+
+	//decoded on the stack, such that listings are parsed without allocating
+	var buf [KeySize + 1]byte
+	if hex.DecodedLen(len(key)) > len(buf) {
+		return c, fmt.Errorf("decoded chunk key '%s' has an invalid length %d, expected %d", key, hex.DecodedLen(len(key)), KeySize)
+	}
+
+	n, err := hex.Decode(buf[:], key)
+	if err != nil {
+		return c, fmt.Errorf("failed to decode '%x' as hex: %v", key, err)
+	}
+
+	data := buf[:n]
+	if len(data) == KeySize+1 {
+		c.Version, data = KeyVersion(data[0]), data[1:]
+		err = checkKeyVersion(c.Version)
+		if err != nil {
+			return c, fmt.Errorf("failed to decode chunk key '%s': %v", key[2:], err)
+		}
+	}
+
+	if len(data) != KeySize {
+		return c, fmt.Errorf("decoded chunk key '%s' has an invalid length %d, expected %d", key, len(data), KeySize)
+	}
+
+	copy(c.K[:], data)
+	if len(size) > 0 {
+		var ok bool
+		c.Size, ok = parseCount(size)
+		if !ok {
+			return c, fmt.Errorf("unexpected chunk size '%s' for key '%x'", size, c.K)
+		}
+	}
+
+	return c, nil
+}
+
+//parseMetaLine returns the name and value of a pointer metadata line, ok
+//is false if the line doesn't hold metadata
+func parseMetaLine(line []byte) (name []byte, val int64, ok bool, err error) {
+	name, rest := nextField(line)
+	value, rest := nextField(rest)
+	if len(value) == 0 || len(bytes.TrimSpace(rest)) > 0 {
+		return nil, 0, false, nil
+	}
+
+	if !bytes.Equal(name, pointerMetaVersion) &&
+		!bytes.Equal(name, pointerMetaHash) &&
+		!bytes.Equal(name, pointerMetaSize) &&
+		!bytes.Equal(name, pointerMetaChunks) {
+		return nil, 0, false, nil
+	}
+
+	val, ok = parseCount(value)
+	if !ok {
+		return nil, 0, false, fmt.Errorf("unexpected value for pointer metadata '%s'", line)
+	}
+
+	return name, val, true, nil
+}
+
+//nextField returns the first whitespace separated field of 'line' and what
+//follows it, without allocating like bytes.Fields does
+func nextField(line []byte) (field, rest []byte) {
+	i := 0
+	for i < len(line) && isSpace(line[i]) {
+		i++
+	}
+
+	j := i
+	for j < len(line) && !isSpace(line[j]) {
+		j++
+	}
+
+	return line[i:j], line[j:]
+}
+
+//isSpace returns whether 'c' is ascii whitespace
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+//parseCount parses a non-negative decimal number without allocating
+func parseCount(b []byte) (n int64, ok bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+
+		d := int64(c - '0')
+		if n > (math.MaxInt64-d)/10 {
+			return 0, false
+		}
+
+		n = n*10 + d
+	}
+
+	return n, true
+}
+
+//Size returns the total plain-text size of the file the pointer describes,
+//it returns -1 if the size of any of the chunks wasn't recorded
+func (ptr *Pointer) Size() (size int64) {
+	if ptr.FileSize >= 0 {
+		return ptr.FileSize
+	}
+
+	for _, c := range ptr.Chunks {
+		if c.Size < 0 {
+			return -1
+		}
+
+		size += c.Size
+	}
+
+	return size
+}
+
+//ReadPointer parses pointer content from 'r', it fails if the content doesn't
+//start with the repository header or is not a json pointer. Pointers of
+//version 0 are read without any metadata, for newer versions the metadata is
+//checked against the chunks
+func (repo *Repository) ReadPointer(r io.Reader) (ptr *Pointer, err error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(hex.EncodedLen(KeySize) + 1); isJSONPointer(head) {
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pointer: %v", err)
+		}
+
+		return parseJSONPointer(data)
+	}
+
+	ptr = &Pointer{FileSize: -1}
+	s := bufio.NewScanner(br)
+	if !s.Scan() || !repo.isHeaderLine(s.Bytes()) {
+		if err = s.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read pointer header: %v", err)
+		}
+
+		return nil, fmt.Errorf("content doesn't start with the git-bits header, is the file split?")
+	}
+
+	count := int64(-1)
+	handle := func(line []byte) error {
+		name, val, ok, err := parseMetaLine(line)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			switch {
+			case bytes.Equal(name, pointerMetaVersion):
+				if val > PointerVersionSealed {
+					return fmt.Errorf("pointer has version %d but only versions up to %d are supported, upgrade git-bits", val, PointerVersionSealed)
+				}
+
+				ptr.Version = int(val)
+			case bytes.Equal(name, pointerMetaHash):
+				ptr.KeyHash = KeyHash(val)
+				if _, ok := keyHashNames[ptr.KeyHash]; !ok {
+					return fmt.Errorf("pointer keys were computed with unknown hash %d, upgrade git-bits", val)
+				}
+			case bytes.Equal(name, pointerMetaSize):
+				ptr.FileSize = val
+			case bytes.Equal(name, pointerMetaChunks):
+				count = val
+			}
+
+			return nil
+		}
+
+		c, err := ParseKeyLine(line)
+		if err != nil {
+			return err
+		}
+
+		ptr.Chunks = append(ptr.Chunks, c)
+		return nil
+	}
+
+	sealed := []byte{}
+	for s.Scan() {
+		if repo.isFooterLine(s.Bytes()) {
+			if len(sealed) > 0 {
+				plain, err := repo.openKeyList(sealed)
+				if err != nil {
+					return nil, err
+				}
+
+				ls := bufio.NewScanner(bytes.NewReader(plain))
+				for ls.Scan() {
+					err = handle(ls.Bytes())
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			return ptr, ptr.check(count)
+		}
+
+		if enc, ok := sealedLine(s.Bytes()); ok {
+			sealed = append(sealed, enc...)
+			continue
+		}
+
+		err = handle(s.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pointer: %v", err)
+	}
+
+	return nil, fmt.Errorf("pointer content ended without a footer")
+}
+
+//check verifies the recorded metadata against the chunks of the pointer
+func (ptr *Pointer) check(count int64) error {
+	if ptr.Version < 1 {
+		return nil
+	}
+
+	if count != int64(len(ptr.Chunks)) {
+		return fmt.Errorf("pointer records %d chunks but lists %d", count, len(ptr.Chunks))
+	}
+
+	size := int64(0)
+	for _, c := range ptr.Chunks {
+		if c.Size < 0 {
+			return fmt.Errorf("pointer of version %d doesn't record the size of chunk '%x'", ptr.Version, c.K)
+		}
+
+		size += c.Size
+	}
+
+	if size != ptr.FileSize {
+		return fmt.Errorf("pointer records a file size of %d bytes but its chunks add up to %d", ptr.FileSize, size)
+	}
+
+	return nil
+}
+
+//WritePointer writes the content of pointer 'ptr' to writer 'w' using the
+//current version of the pointer format
+func (repo *Repository) WritePointer(w io.Writer, ptr *Pointer) (err error) {
+	pw, err := repo.newPointerWriter(w, ptr.KeyHash)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range ptr.Chunks {
+		if c.Size < 0 {
+			return fmt.Errorf("size of chunk '%x' is unknown", c.K)
+		}
+
+		err = pw.writeChunk(c.Version, c.K, c.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return pw.Close()
+}
+
+//pointerWriter writes pointer content as chunks become available, the
+//metadata that is only known at the end is written right before the footer
+type pointerWriter struct {
+	w      io.Writer
+	footer []byte
+	size   int64
+	count  int64
+
+	//with a pointer key the key list is buffered and sealed when closed
+	aead     cipher.AEAD
+	nonceKey []byte
+	keys     *bytes.Buffer
+
+	//whether the pointer is written as json instead of lines
+	json bool
+}
+
+//newPointerWriter writes the header and version to 'w' and returns a writer
+//that the chunks can be written to, it should be closed to write the footer.
+//The key hash is only recorded if the keys weren't computed with SHA256. If
+//a pointer key is configured the key list is sealed, else the pointer is
+//written as json if that format is configured.
+func (repo *Repository) newPointerWriter(w io.Writer, h KeyHash) (pw *pointerWriter, err error) {
+	pw = &pointerWriter{w: w, footer: repo.footer}
+	pw.aead, pw.nonceKey, err = repo.keyListAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	if pw.aead == nil && repo.conf.PointerFormat == "json" {
+		pw.json = true
+		_, err = fmt.Fprintf(w, `{"algorithm":"%s","chunks":[`, h)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write pointer header: %v", err)
+		}
+
+		return pw, nil
+	}
+
+	version := PointerVersion
+	switch {
+	case pw.aead != nil:
+		version = PointerVersionSealed
+		pw.keys = bytes.NewBuffer(nil)
+	case h != SHA256:
+		version = PointerVersionKeyHash
+	}
+
+	if h == SHA256 {
+		_, err = fmt.Fprintf(w, "%s%s %d\n", repo.header, pointerMetaVersion, version)
+	} else {
+		_, err = fmt.Fprintf(w, "%s%s %d\n%s %d\n", repo.header, pointerMetaVersion, version, pointerMetaHash, h)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pointer header: %v", err)
+	}
+
+	return pw, nil
+}
+
+//WriteChunk writes the key and plain-text size of the next chunk, which was
+//written with the current key version
+func (pw *pointerWriter) WriteChunk(k K, size int64) (err error) {
+	return pw.writeChunk(CurrentKeyVersion, k, size)
+}
+
+//writeChunk writes the key of version 'v' and plain-text size of the next
+//chunk
+func (pw *pointerWriter) writeChunk(v KeyVersion, k K, size int64) (err error) {
+	switch {
+	case pw.json && pw.count > 0:
+		_, err = fmt.Fprintf(pw.w, `,{"oid":"%s","size":%d}`, FormatKey(v, k), size)
+	case pw.json:
+		_, err = fmt.Fprintf(pw.w, `{"oid":"%s","size":%d}`, FormatKey(v, k), size)
+	default:
+		_, err = fmt.Fprintf(pw.list(), "%s %d\n", FormatKey(v, k), size)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write key to output: %v", err)
+	}
+
+	pw.size += size
+	pw.count++
+	return nil
+}
+
+//list returns where the key list is written to
+func (pw *pointerWriter) list() io.Writer {
+	if pw.keys != nil {
+		return pw.keys
+	}
+
+	return pw.w
+}
+
+//Close writes the metadata trailer and the footer, for sealed pointers the
+//key list and trailer are encrypted first. Json pointers end with the size
+//and version instead.
+func (pw *pointerWriter) Close() (err error) {
+	if pw.json {
+		_, err = fmt.Fprintf(pw.w, "],\"size\":%d,\"version\":%d}\n", pw.size, PointerVersionJSON)
+		if err != nil {
+			return fmt.Errorf("failed to write pointer footer: %v", err)
+		}
+
+		return nil
+	}
+
+	_, err = fmt.Fprintf(pw.list(), "%s %d\n%s %d\n", pointerMetaSize, pw.size, pointerMetaChunks, pw.count)
+	if err == nil && pw.keys != nil {
+		_, err = pw.w.Write(sealKeyList(pw.aead, pw.nonceKey, pw.keys.Bytes()))
+	}
+
+	if err == nil {
+		_, err = pw.w.Write(pw.footer)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write pointer footer: %v", err)
+	}
+
+	return nil
+}
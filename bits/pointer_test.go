@@ -0,0 +1,332 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nerdalize/git-bits/bits"
+	"github.com/nerdalize/git-bits/bits/bitstest"
+)
+
+func TestPointerReadWrite(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	ptr := &bits.Pointer{Chunks: []bits.PointerChunk{
+		{K: bits.K{0x01}, Size: 10},
+		{K: bits.K{0x02}, Size: 20},
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	err := repo1.WritePointer(buf, ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr2, err := repo1.ReadPointer(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr2.Version != bits.PointerVersion {
+		t.Errorf("expected version %d, got: %d", bits.PointerVersion, ptr2.Version)
+	}
+
+	if ptr2.Size() != 30 || len(ptr2.Chunks) != 2 {
+		t.Errorf("expected 2 chunks with a total of 30 bytes, got: %+v", ptr2)
+	}
+
+	for i, c := range ptr.Chunks {
+		if ptr2.Chunks[i] != c {
+			t.Errorf("expected chunk %d to equal %+v, got: %+v", i, c, ptr2.Chunks[i])
+		}
+	}
+}
+
+func TestPointerKeyHash(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	ptr := &bits.Pointer{KeyHash: bits.BLAKE3, Chunks: []bits.PointerChunk{
+		{K: bits.K{0x01}, Size: 10},
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	err := repo1.WritePointer(buf, ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr2, err := repo1.ReadPointer(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr2.Version != bits.PointerVersionKeyHash || ptr2.KeyHash != bits.BLAKE3 {
+		t.Errorf("expected a version %d pointer with blake3 keys, got: %+v", bits.PointerVersionKeyHash, ptr2)
+	}
+}
+
+func TestPointerSealed(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	wd2, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	key, err := bits.NewPointerKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{"bits.pointer-key": key})
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr := &bits.Pointer{Chunks: []bits.PointerChunk{}}
+	for i := 0; i < 100; i++ {
+		ptr.Chunks = append(ptr.Chunks, bits.PointerChunk{K: bits.K{byte(i), 0xab}, Size: 10})
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.WritePointer(buf, ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if !strings.HasPrefix(buf.String(), "--- to use this file decode it with the 'git-bits' extension ---\nversion 3\n") {
+		t.Errorf("expected a recognizable header and version, got: %s", data)
+	}
+
+	if strings.Contains(buf.String(), "01ab") || strings.Contains(buf.String(), "size ") {
+		t.Errorf("expected keys and metadata to be encrypted, got: %s", data)
+	}
+
+	buf2 := bytes.NewBuffer(nil)
+	err = repo1.WritePointer(buf2, ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, buf2.Bytes()) {
+		t.Errorf("expected writing the same pointer twice to result in the same content")
+	}
+
+	ptr2, err := repo1.ReadPointer(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr2.Version != bits.PointerVersionSealed || ptr2.Size() != 1000 || len(ptr2.Chunks) != 100 || ptr2.Chunks[1] != ptr.Chunks[1] {
+		t.Errorf("expected the sealed pointer to be read back, got: %+v", ptr2)
+	}
+
+	n := 0
+	err = repo1.ForEach(bytes.NewReader(append(data, data...)), func(k bits.K) error {
+		if k != ptr.Chunks[n%100].K {
+			t.Errorf("expected key %d to be '%x', got: '%x'", n, ptr.Chunks[n%100].K, k)
+		}
+
+		n++
+		return nil
+	})
+
+	if err != nil || n != 200 {
+		t.Errorf("expected 200 keys of two sealed pointers, got: %d, %v", n, err)
+	}
+
+	_, err = repo2.ReadPointer(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "bits.pointer-key") {
+		t.Errorf("expected reading without the key to fail, got: %v", err)
+	}
+
+	other, _ := bits.NewPointerKey()
+	bitstest.GitConfigure(t, ctx, repo2, map[string]string{"bits.pointer-key": other})
+	repo2, err = bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo2.ReadPointer(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Errorf("expected reading with another key to fail, got: %v", err)
+	}
+}
+
+func TestPointerJSON(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{"bits.pointer-format": "json"})
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr := &bits.Pointer{KeyHash: bits.BLAKE3, Chunks: []bits.PointerChunk{
+		{K: bits.K{0x01}, Size: 10},
+		{K: bits.K{0x02}, Size: 20},
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.WritePointer(buf, ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fmt.Sprintf(`{"algorithm":"blake3","chunks":[{"oid":"%s","size":10},{"oid":"%s","size":20}],"size":30,"version":4}`+"\n", bits.FormatKey(bits.CurrentKeyVersion, bits.K{0x01}), bits.FormatKey(bits.CurrentKeyVersion, bits.K{0x02}))
+	if buf.String() != expected {
+		t.Fatalf("expected canonical json pointer:\n%s got:\n%s", expected, buf.String())
+	}
+
+	//other tools parse it as json, it is already in canonical form
+	v := map[string]interface{}{}
+	err = json.Unmarshal(buf.Bytes(), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	canonical, _ := json.Marshal(v)
+	if string(canonical)+"\n" != expected {
+		t.Errorf("expected re-encoding the pointer not to change it, got: %s", canonical)
+	}
+
+	//clones that write lines read it, also among other keys
+	ptr2, err := repo2.ReadPointer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr2.Version != bits.PointerVersionJSON || ptr2.KeyHash != bits.BLAKE3 || ptr2.Size() != 30 || len(ptr2.Chunks) != 2 || ptr2.Chunks[1] != ptr.Chunks[1] {
+		t.Errorf("expected the json pointer to be read back, got: %+v", ptr2)
+	}
+
+	lines := bytes.NewBuffer(nil)
+	err = repo2.WritePointer(lines, &bits.Pointer{Chunks: []bits.PointerChunk{{K: bits.K{0x03}, Size: 30}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []bits.K{}
+	for k, err := range repo2.Keys(io.MultiReader(bytes.NewReader(buf.Bytes()), lines)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, k)
+	}
+
+	if len(keys) != 3 || keys[0] != (bits.K{0x01}) || keys[2] != (bits.K{0x03}) {
+		t.Errorf("expected the keys of both formats in order, got: %x", keys)
+	}
+
+	//splitting writes json and leaves json pointers as they are
+	split := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(bits.BenchContent(3*1024*1024, 1)), split)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(split.String(), `{"algorithm":"sha256","chunks":[{"oid":"`) || strings.Count(split.String(), "\n") != 1 {
+		t.Errorf("expected splitting to write a json pointer, got: %s", split.String())
+	}
+
+	again := bytes.NewBuffer(nil)
+	err = repo2.Split(bytes.NewReader(split.Bytes()), again)
+	if err != nil || !bytes.Equal(again.Bytes(), split.Bytes()) {
+		t.Errorf("expected a json pointer not to be split again, got: %s, %v", again.String(), err)
+	}
+
+	for _, data := range []string{
+		`{"algorithm":"sha256","chunks":[],"size":0,"version":5}`,
+		`{"algorithm":"sha256","chunks":[{"oid":"01","size":1}],"size":1,"version":4}`,
+		`{"algorithm":"sha256","chunks":[],"size":10,"version":4}`,
+	} {
+		_, err = repo2.ReadPointer(strings.NewReader(data))
+		if err == nil {
+			t.Errorf("expected reading '%s' to fail", data)
+		}
+	}
+}
+
+func TestPointerReadV0(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	v0 := "--- to use this file decode it with the 'git-bits' extension ---\n" +
+		strings.Repeat("01", bits.KeySize) + "\n" +
+		"----------------------- end of chunks --------------------------\n"
+
+	ptr, err := repo1.ReadPointer(strings.NewReader(v0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr.Version != 0 || len(ptr.Chunks) != 1 || ptr.Size() != -1 {
+		t.Errorf("expected a version 0 pointer with a single chunk of unknown size, got: %+v", ptr)
+	}
+}
+
+func TestKeyVersion(t *testing.T) {
+	k := bits.K{0x01}
+	for _, c := range []struct {
+		line    string
+		version bits.KeyVersion
+		ok      bool
+	}{
+		{line: bits.FormatKey(bits.KeyVersion0, k) + " 10", version: bits.KeyVersion0, ok: true},
+		{line: "00" + strings.Repeat("01", bits.KeySize) + " 10", version: bits.KeyVersion0, ok: true},
+		{line: "63" + strings.Repeat("01", bits.KeySize) + " 10"},
+	} {
+		pc, err := bits.ParseKeyLine([]byte(c.line))
+		if !c.ok {
+			if err == nil || !strings.Contains(err.Error(), "upgrade git-bits") {
+				t.Errorf("expected key line '%s' of an unknown version to fail, got: %v", c.line, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pc.Version != c.version || pc.Size != 10 {
+			t.Errorf("expected key line '%s' to have version %d, got: %+v", c.line, c.version, pc)
+		}
+	}
+
+	//keys of the current version are listed as before keys were versioned
+	if bits.FormatKey(bits.CurrentKeyVersion, k) != "01"+strings.Repeat("00", bits.KeySize-1) {
+		t.Errorf("expected keys of the current version to be plain hex, got: %s", bits.FormatKey(bits.CurrentKeyVersion, k))
+	}
+}
+
+func TestPointerReadInconsistent(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	for _, content := range []string{
+		"version 1\n" + strings.Repeat("01", bits.KeySize) + " 10\nsize 11\nchunks 1\n",
+		"version 1\n" + strings.Repeat("01", bits.KeySize) + " 10\nsize 10\nchunks 2\n",
+		"version 99\n",
+		"version 2\nhash 99\n",
+	} {
+		ptr := "--- to use this file decode it with the 'git-bits' extension ---\n" + content +
+			"----------------------- end of chunks --------------------------\n"
+
+		_, err := repo1.ReadPointer(strings.NewReader(ptr))
+		if err == nil {
+			t.Errorf("expected reading pointer to fail for: %s", content)
+		}
+	}
+}
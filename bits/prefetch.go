@@ -0,0 +1,89 @@
+package bits
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+//Prefetch makes sure all chunks of the split files in 'ref' are stored locally
+//such that a later checkout doesn't need to wait for the remote. It can be
+//limited to certain paths and fetches up to 'concurrency' chunks in parallel,
+//if its zero FetchConcurrency is used. The chunks of the files that were
+//accessed most on the current branch are fetched first.
+func (repo *Repository) Prefetch(ref string, paths []string, concurrency int) (err error) {
+	ctx, end := repo.trace(context.Background(), "prefetch", SpanAttr{"ref", ref})
+	defer end(&err)
+	defer repo.flushAudit(&err)
+	defer repo.flushUsage(nil)
+	if concurrency < 1 {
+		concurrency = FetchConcurrency
+	}
+
+	ptrs := map[string]*Pointer{}
+	files := []string{}
+	err = repo.ForEachPointer(ref, paths, func(p string, ptr *Pointer) error {
+		ptrs[p] = ptr
+		files = append(files, p)
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to list chunks in '%s': %v", ref, err)
+	}
+
+	//the chunks of files that are used most on this branch are fetched first
+	repo.orderByAccess(files)
+	keys := []PointerChunk{}
+	seen := map[PointerChunk]struct{}{}
+	for _, p := range files {
+		for _, c := range ptrs[p].Chunks {
+			c.Size = 0
+			if _, ok := seen[c]; ok {
+				continue
+			}
+
+			seen[c] = struct{}{}
+			keys = append(keys, c)
+		}
+	}
+
+	//fetch chunks in parallel while collecting errors
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := []string{}
+	failed := []PointerChunk{}
+	keyCh := make(chan PointerChunk)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range keyCh {
+				err := repo.fetchChunk(ctx, c.Version, c.K)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err.Error())
+					failed = append(failed, c)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, c := range keys {
+		keyCh <- c
+	}
+
+	close(keyCh)
+	wg.Wait()
+	if len(errs) > 0 {
+		err = repo.recordFailedFetches(failed...)
+		if err != nil {
+			fmt.Fprintf(repo.output, "failed to record chunks for retrying: %v\n", err)
+		}
+
+		return withKind(repo.fetchFailureKind(len(errs), len(keys)), fmt.Errorf("failed to fetch %d of %d chunks, retry with 'git bits fetch --retry-failed': \n %s", len(errs), len(keys), summarizeErrors(errs)))
+	}
+
+	return nil
+}
@@ -0,0 +1,377 @@
+package bits
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+//maxPktData is the most data a single pkt-line can hold
+const maxPktData = 65516
+
+//readPkt reads a single pkt-line, 'flush' reports a flush packet
+//@see https://git-scm.com/docs/protocol-common#_pkt_line_format
+func readPkt(r io.Reader) (data []byte, flush bool, err error) {
+	hdr := make([]byte, 4)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	n, err := strconv.ParseUint(string(hdr), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid pkt-line length '%s': %v", hdr, err)
+	}
+
+	if n == 0 {
+		return nil, true, nil
+	}
+
+	if n < 4 {
+		return nil, false, fmt.Errorf("invalid pkt-line length %d", n)
+	}
+
+	data = make([]byte, n-4)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read pkt-line: %v", err)
+	}
+
+	return data, false, nil
+}
+
+//readPktList reads text pkt-lines until a flush packet
+func readPktList(r io.Reader) (lines []string, err error) {
+	for {
+		data, flush, err := readPkt(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if flush {
+			return lines, nil
+		}
+
+		lines = append(lines, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+//writePktList writes each line as a text pkt-line followed by a flush
+func writePktList(w io.Writer, lines ...string) (err error) {
+	for _, line := range lines {
+		_, err = fmt.Fprintf(w, "%04x%s\n", len(line)+5, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "0000")
+	return err
+}
+
+//pktReader reads the data of pkt-lines until a flush packet
+type pktReader struct {
+	r    io.Reader
+	buf  []byte
+	done bool
+}
+
+func (pr *pktReader) Read(p []byte) (n int, err error) {
+	for len(pr.buf) == 0 {
+		if pr.done {
+			return 0, io.EOF
+		}
+
+		pr.buf, pr.done, err = readPkt(pr.r)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, pr.buf)
+	pr.buf = pr.buf[n:]
+	return n, nil
+}
+
+//pktWriter writes data as pkt-lines
+type pktWriter struct {
+	w io.Writer
+}
+
+func (pw *pktWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		data := p
+		if len(data) > maxPktData {
+			data = data[:maxPktData]
+		}
+
+		_, err = fmt.Fprintf(pw.w, "%04x", len(data)+4)
+		if err != nil {
+			return n, err
+		}
+
+		_, err = pw.w.Write(data)
+		if err != nil {
+			return n, err
+		}
+
+		n += len(data)
+		p = p[len(data):]
+	}
+
+	return n, nil
+}
+
+//Flush flushes the underlying writer if it buffers, such that git receives
+//the pkt-lines that were written so far
+func (pw *pktWriter) Flush() error {
+	if f, ok := pw.w.(flusher); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+//FilterProcess runs git's long-running filter protocol on 'r' and 'w' such
+//that a single process cleans and smudges all files of a checkout instead
+//of starting a pipeline for each. Files are split like Split, pointers are
+//smudged by a single fetch and combine stream (see FetchStream).
+//@see https://git-scm.com/docs/gitattributes#_long_running_filter_process
+func (repo *Repository) FilterProcess(r io.Reader, w io.Writer) (err error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	welcome, err := readPktList(br)
+	if err != nil {
+		return fmt.Errorf("failed to read welcome: %v", err)
+	}
+
+	if len(welcome) < 2 || welcome[0] != "git-filter-client" || !containsLine(welcome[1:], "version=2") {
+		return fmt.Errorf("unexpected welcome from git: %v", welcome)
+	}
+
+	err = writePktList(bw, "git-filter-server", "version=2")
+	if err != nil {
+		return err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	offered, err := readPktList(br)
+	if err != nil {
+		return fmt.Errorf("failed to read capabilities: %v", err)
+	}
+
+	caps := []string{}
+	for _, c := range []string{"capability=clean", "capability=smudge"} {
+		if containsLine(offered, c) {
+			caps = append(caps, c)
+		}
+	}
+
+	err = writePktList(bw, caps...)
+	if err != nil {
+		return err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	//pointers are written into one fetch and combine stream
+	fetchr, fetchw := io.Pipe()
+	combiner, combinew := io.Pipe()
+	outr, outw := io.Pipe()
+	defer fetchw.Close()
+	go func() { combinew.CloseWithError(repo.FetchStream(fetchr, combinew)) }()
+	go func() { outw.CloseWithError(repo.CombineStream(combiner, outw)) }()
+	content := bufio.NewReader(outr)
+
+	for {
+		req, err := readPktList(br)
+		if err == io.EOF {
+			return nil //git is done
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read request: %v", err)
+		}
+
+		command, path := "", ""
+		for _, line := range req {
+			switch {
+			case strings.HasPrefix(line, "command="):
+				command = strings.TrimPrefix(line, "command=")
+			case strings.HasPrefix(line, "pathname="):
+				path = strings.TrimPrefix(line, "pathname=")
+			}
+		}
+
+		//the content is always read completely, to get to the next request
+		in := &pktReader{r: br}
+		switch command {
+		case "clean":
+			err = repo.processClean(in, bw)
+		case "smudge":
+			err = repo.processSmudge(in, bw, path, fetchw, content)
+		default:
+			io.Copy(ioutil.Discard, in)
+			err = writePktList(bw, "status=error")
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to %s '%s': %v", command, path, err)
+		}
+
+		err = bw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//processClean splits the content and streams its pointer in the response
+//as chunks complete, a failure to split is reported with the status that
+//follows the content. Errors of writing the response are returned.
+func (repo *Repository) processClean(in io.Reader, w io.Writer) (err error) {
+	err = writePktList(w, "status=success")
+	if err != nil {
+		return err
+	}
+
+	ew := &errWriter{w: &pktWriter{w}}
+	serr := repo.Split(in, ew)
+	io.Copy(ioutil.Discard, in)
+	if ew.err != nil {
+		return ew.err
+	}
+
+	err = writePktList(w)
+	if err != nil {
+		return err
+	}
+
+	if serr != nil {
+		fmt.Fprintf(repo.output, "failed to split: %v\n", serr)
+		return writePktList(w, "status=error")
+	}
+
+	return writePktList(w)
+}
+
+//errWriter remembers whether writing to git failed, such that it can be
+//told apart from a failure to split
+type errWriter struct {
+	w   *pktWriter
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (n int, err error) {
+	n, err = ew.w.Write(p)
+	if err != nil && ew.err == nil {
+		ew.err = err
+	}
+
+	return n, err
+}
+
+func (ew *errWriter) Flush() (err error) {
+	err = ew.w.Flush()
+	if err != nil && ew.err == nil {
+		ew.err = err
+	}
+
+	return err
+}
+
+//writePktContent writes content that is known in full, followed by a flush
+//and an empty list that keeps the status successful
+func writePktContent(w io.Writer, data []byte) (err error) {
+	_, err = (&pktWriter{w}).Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = writePktList(w)
+	if err != nil {
+		return err
+	}
+
+	return writePktList(w)
+}
+
+//processSmudge writes the pointer to the fetch stream and responds with the
+//content that is read from the combine stream, errors of writing the
+//response are returned
+func (repo *Repository) processSmudge(in io.Reader, w io.Writer, path string, fetchw io.Writer, content *bufio.Reader) (err error) {
+	ptr, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	//content that was committed before it was split is checked out as is
+	if !repo.hasHeader(ptr) {
+		err = writePktList(w, "status=success")
+		if err != nil {
+			return err
+		}
+
+		return writePktContent(w, ptr)
+	}
+
+	//a lazy clone leaves the pointer until the content is used
+	if repo.conf.Lazy && !repo.storedLocally(ptr) {
+		err = writePktList(w, "status=success")
+		if err != nil {
+			return err
+		}
+
+		return writePktContent(w, ptr)
+	}
+
+	err = WriteStreamFile(fetchw, path, ptr)
+	if err != nil {
+		return fmt.Errorf("failed to write to fetch stream: %v", err)
+	}
+
+	err = writePktList(w, "status=success")
+	if err != nil {
+		return err
+	}
+
+	_, cerr := ReadStreamContent(content, &pktWriter{w})
+	if cerr == io.EOF {
+		return fmt.Errorf("combine stream ended unexpectedly")
+	}
+
+	//the content is followed by a flush and the final status, an empty
+	//list keeps it successful
+	err = writePktList(w)
+	if err != nil {
+		return err
+	}
+
+	if cerr != nil {
+		fmt.Fprintf(repo.output, "failed to smudge '%s': %v\n", path, cerr)
+		return writePktList(w, "status=error")
+	}
+
+	return writePktList(w)
+}
+
+//containsLine returns whether 'line' is one of 'lines'
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+
+	return false
+}
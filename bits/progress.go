@@ -0,0 +1,226 @@
+package bits
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	//ProgressSinks lists how progress can be reported: 'auto' picks 'tty'
+	//when the output is a terminal and 'plain' otherwise
+	ProgressSinks = []string{"auto", "quiet", "plain", "tty", "json"}
+)
+
+//ProgressSink reports the progress of operations, KeyProgress is called for
+//each chunk that is handled with the moving average of the throughput and
+//PullProgress after each split file that is pulled. If it implements
+//io.Closer it is closed when the repository is.
+type ProgressSink interface {
+	KeyProgress(kop KeyOp, throughput float64)
+	PullProgress(p PullProgress)
+}
+
+//NewProgressSink returns the sink with the given name (see ProgressSinks)
+//that writes to 'w', an empty name is 'auto'
+func NewProgressSink(name string, w io.Writer) (sink ProgressSink, err error) {
+	switch name {
+	case "", "auto":
+		if isTerminal(w) {
+			return &ttyProgress{w: w}, nil
+		}
+
+		return &plainProgress{w: w}, nil
+	case "quiet":
+		return quietProgress{}, nil
+	case "plain":
+		return &plainProgress{w: w}, nil
+	case "tty":
+		return &ttyProgress{w: w}, nil
+	case "json":
+		return &jsonProgress{enc: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unexpected progress '%s', expected one of: %v", name, ProgressSinks)
+	}
+}
+
+//SetProgress makes 'sink' report the progress of operations by setting
+//KeyProgressFn and PullProgressFn, it should be set before operations run
+func (repo *Repository) SetProgress(sink ProgressSink) {
+	repo.progressSink = sink
+	repo.KeyProgressFn = sink.KeyProgress
+	repo.PullProgressFn = sink.PullProgress
+}
+
+//isTerminal returns whether 'w' writes to a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+//lockedWriter serializes the writes to 'w', such that sinks and git can
+//share the output of the repository
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (n int, err error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+//quietProgress reports nothing
+type quietProgress struct{}
+
+func (quietProgress) KeyProgress(KeyOp, float64) {}
+func (quietProgress) PullProgress(PullProgress) {}
+
+//plainProgress writes a line for each chunk and pulled file, chunks that
+//are indexed are summarized
+type plainProgress struct {
+	w       io.Writer
+	indexed int
+}
+
+func (s *plainProgress) KeyProgress(kop KeyOp, tp float64) {
+	indexBucketMax := 500
+	if kop.Op == IndexOp {
+		s.indexed++
+		if s.indexed%indexBucketMax == 0 {
+			fmt.Fprintf(s.w, "indexed %d remote chunks, total: ~%s\n", indexBucketMax, humanize.FormatInteger("#.", s.indexed))
+		}
+
+		return
+	}
+
+	if s.indexed > 0 {
+		fmt.Fprintf(s.w, "indexing of remote chunks ended, total: ~%s\n", humanize.FormatInteger("#.", s.indexed))
+		s.indexed = 0
+	}
+
+	if kop.Skipped {
+		fmt.Fprintf(s.w, "%x (skip: already %s)\n", kop.K, pastTense(kop.Op))
+	} else {
+		fmt.Fprintf(s.w, "%x (%s) %s/s\n", kop.K, string(kop.Op), humanize.Bytes(uint64(tp)))
+	}
+}
+
+func (s *plainProgress) PullProgress(p PullProgress) {
+	fmt.Fprintf(s.w, "pulled '%s' (%d/%d files, %s/%s)\n", p.Path, p.File, p.Files, humanize.Bytes(uint64(p.Bytes)), humanize.Bytes(uint64(p.TotalBytes)))
+}
+
+//pastTense returns e.g. 'pushed' for the push operation
+func pastTense(op Op) string {
+	return strings.Replace(fmt.Sprintf("%sed", string(op)), "ee", "e", 1)
+}
+
+//ttyProgress keeps a single line up to date with the number of chunks of
+//the current operation, a line is finished when another operation starts
+type ttyProgress struct {
+	mu      sync.Mutex
+	w       io.Writer
+	op      Op
+	chunks  int
+	skipped int
+	bytes   int64
+	dirty   bool
+}
+
+func (s *ttyProgress) KeyProgress(kop KeyOp, tp float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kop.Op != s.op {
+		s.finish()
+		s.op, s.chunks, s.skipped, s.bytes = kop.Op, 0, 0, 0
+	}
+
+	s.chunks++
+	s.bytes += kop.CopyN
+	if kop.Skipped {
+		s.skipped++
+	}
+
+	s.update(fmt.Sprintf("%s %d chunks (%d skipped), %s, %s/s", pastTense(kop.Op), s.chunks, s.skipped, humanize.Bytes(uint64(s.bytes)), humanize.Bytes(uint64(tp))))
+}
+
+func (s *ttyProgress) PullProgress(p PullProgress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(fmt.Sprintf("pulled %d/%d files, %s/%s: %s", p.File, p.Files, humanize.Bytes(uint64(p.Bytes)), humanize.Bytes(uint64(p.TotalBytes)), p.Path))
+	if p.File == p.Files {
+		s.finish()
+	}
+}
+
+//Close finishes the line that is kept up to date
+func (s *ttyProgress) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finish()
+	return nil
+}
+
+//update replaces the current line with 'line'
+func (s *ttyProgress) update(line string) {
+	fmt.Fprintf(s.w, "\r\x1b[K%s", line)
+	s.dirty = true
+}
+
+//finish moves to a new line if the current one was written
+func (s *ttyProgress) finish() {
+	if s.dirty {
+		fmt.Fprintln(s.w)
+		s.dirty = false
+	}
+}
+
+//jsonProgress writes a json object per line for each chunk and pulled file
+type jsonProgress struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+//jsonProgressEvent is a line that is written by the json progress sink,
+//'op' is 'pull' for pulled files
+type jsonProgressEvent struct {
+	Op         string  `json:"op"`
+	Key        string  `json:"key,omitempty"`
+	Skipped    bool    `json:"skipped,omitempty"`
+	Bytes      int64   `json:"bytes"`
+	Throughput float64 `json:"throughput,omitempty"`
+	Path       string  `json:"path,omitempty"`
+	File       int     `json:"file,omitempty"`
+	Files      int     `json:"files,omitempty"`
+	Total      int64   `json:"total_bytes,omitempty"`
+}
+
+func (s *jsonProgress) KeyProgress(kop KeyOp, tp float64) {
+	s.write(jsonProgressEvent{Op: string(kop.Op), Key: hex.EncodeToString(kop.K[:]), Skipped: kop.Skipped, Bytes: kop.CopyN, Throughput: tp})
+}
+
+func (s *jsonProgress) PullProgress(p PullProgress) {
+	s.write(jsonProgressEvent{Op: "pull", Path: p.Path, File: p.File, Files: p.Files, Bytes: p.Bytes, Total: p.TotalBytes})
+}
+
+func (s *jsonProgress) write(ev jsonProgressEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.Encode(ev) //progress is best effort
+}
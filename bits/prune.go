@@ -0,0 +1,190 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//PrunePolicy determines which local chunks PruneLocal keeps, besides those
+//of HEAD
+type PrunePolicy struct {
+
+	//patterns of refs of which the chunks are kept, matched with path.Match
+	//against the full name of the ref (e.g. 'refs/heads/main' or
+	//'refs/tags/v*')
+	KeepRefs []string
+
+	//chunks of refs that were committed or tagged less than this long ago
+	//are kept, zero keeps no refs by age
+	KeepUpdated time.Duration
+}
+
+//PrunePolicy returns the policy that is configured with 'bits.prune-keep-ref'
+//and 'bits.prune-keep-days'
+func (repo *Repository) PrunePolicy() PrunePolicy {
+	return PrunePolicy{
+		KeepRefs:    append([]string{}, repo.conf.PruneKeepRefs...),
+		KeepUpdated: repo.conf.PruneKeepAge,
+	}
+}
+
+//keeps returns whether the policy keeps the chunks of ref 'name' that was
+//last committed or tagged at 'updated'
+func (pol PrunePolicy) keeps(name string, updated time.Time) bool {
+	for _, pattern := range pol.KeepRefs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return pol.KeepUpdated > 0 && !updated.IsZero() && time.Since(updated) < pol.KeepUpdated
+}
+
+//keptRefs returns the objects of HEAD and of the branches, remote branches
+//and tags the policy keeps, each object once
+func (repo *Repository) keptRefs(pol PrunePolicy) (refs []string, err error) {
+	ctx := context.Background()
+	seen := map[string]bool{}
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(ctx, nil, buf, "rev-parse", "--verify", "-q", "HEAD")
+	if err == nil {
+		head := strings.TrimSpace(buf.String())
+		seen[head] = true
+		refs = append(refs, head)
+	}
+
+	//line: <object> SP <ref> SP <timestamp> SP <zone>
+	buf.Reset()
+	err = repo.Git(ctx, nil, buf, "for-each-ref", "--format=%(objectname) %(refname) %(creatordate:raw)", "refs/heads/", "refs/remotes/", "refs/tags/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %v", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || seen[fields[0]] {
+			continue
+		}
+
+		//specialty branches hold no files
+		if path.Base(fields[1]) == ChunkIndexBranch || strings.HasSuffix(fields[1], RemoteBranchSuffix) {
+			continue
+		}
+
+		updated := time.Time{}
+		if len(fields) > 2 {
+			if sec, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				updated = time.Unix(sec, 0)
+			}
+		}
+
+		if pol.keeps(fields[1], updated) {
+			seen[fields[0]] = true
+			refs = append(refs, fields[0])
+		}
+	}
+
+	return refs, nil
+}
+
+//PruneLocal removes local chunks that the policy doesn't keep: chunks of
+//the files in the trees of HEAD and of the refs that 'pol' selects are
+//kept, others are removed if the index confirms the remote stores them.
+//Chunks that are staged but not pushed and chunks that were used less than
+//GCGracePeriod ago are never removed. With 'dryRun' chunks are only
+//listed. It returns the number of chunks removed and bytes freed.
+func (repo *Repository) PruneLocal(w io.Writer, pol PrunePolicy, dryRun bool) (removed int, freed int64, err error) {
+	_, end := repo.trace(context.Background(), "prune-local")
+	defer end(&err)
+	refs, err := repo.keptRefs(pol)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	kept := map[chunkID]bool{}
+	for _, ref := range refs {
+		err = repo.ForEachPointer(ref, nil, func(p string, ptr *Pointer) error {
+			for _, c := range ptr.Chunks {
+				kept[c.id()] = true
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read pointers of '%s': %v", ref, err)
+		}
+	}
+
+	remote := map[chunkID]bool{}
+	err = repo.withStore(func(store *bolt.DB) error {
+		staged, err := repo.stagedChunks(store)
+		if err != nil {
+			return err
+		}
+
+		for id := range staged {
+			kept[id] = true
+		}
+
+		return store.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(IndexBucket).ForEach(func(key, v []byte) error {
+				if id, rest := parseStoreKey(key); len(rest) == 0 && bytes.Equal(v, RemoteChunk) {
+					remote[id] = true
+				}
+
+				return nil
+			})
+		})
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read local store: %v", err)
+	}
+
+	unpushed := 0
+	err = repo.walkAllChunks(func(id chunkID, fi os.FileInfo) error {
+		if kept[id] || time.Since(fi.ModTime()) < GCGracePeriod {
+			return nil
+		}
+
+		//without another copy the chunk would be lost
+		if !remote[id] {
+			unpushed++
+			return nil
+		}
+
+		p, err := repo.chunkPath(id.v, id.k, false)
+		if err != nil {
+			return err
+		}
+
+		err = repo.removeChunk(w, id, p, dryRun)
+		if err != nil {
+			return err
+		}
+
+		removed++
+		freed += fi.Size()
+		return nil
+	})
+
+	if err != nil {
+		return removed, freed, fmt.Errorf("failed to walk local chunks: %v", err)
+	}
+
+	if unpushed > 0 {
+		fmt.Fprintf(repo.output, "kept %d chunks that are not known to be stored remotely, 'git bits push --all' indexes the remote\n", unpushed)
+	}
+
+	return removed, freed, nil
+}
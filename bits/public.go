@@ -0,0 +1,262 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//PublicRemote reads chunks anonymously over http from a public bucket or a
+//cdn path, such that external users can clone and check out a published
+//dataset without any credentials. Chunks are encrypted with the hash of
+//their content, anyone who can read the pointers in the repository can
+//decrypt them. It can't write, list or delete chunks.
+type PublicRemote struct {
+	base   *url.URL
+	client *http.Client
+
+	//levels of directories chunk names are sharded in
+	depth int
+}
+
+//NewPublicRemote sets up anonymous reading of chunks below url 'base'
+func NewPublicRemote(base string, depth int, client *http.Client) (pub *PublicRemote, err error) {
+	pub = &PublicRemote{client: client, depth: depth}
+	pub.base, err = url.Parse(strings.TrimSuffix(base, "/"))
+	if err != nil || (pub.base.Scheme != "http" && pub.base.Scheme != "https") {
+		return nil, fmt.Errorf("invalid public url '%s', expected an http(s) url", base)
+	}
+
+	if pub.client == nil {
+		pub.client = http.DefaultClient
+	}
+
+	return pub, nil
+}
+
+//loc returns the url of chunk 'k'
+func (pub *PublicRemote) loc(k K) string {
+	return pub.base.String() + "/" + ChunkObjectName(KeyVersion0, k, pub.depth)
+}
+
+//get requests chunk 'k' with headers 'h', it fails unless the response has
+//status 'code'
+func (pub *PublicRemote) get(method string, k K, h http.Header, code int) (resp *http.Response, err error) {
+	req, err := http.NewRequest(method, pub.loc(k), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %v", method, err)
+	}
+
+	for name, v := range h {
+		req.Header[name] = v
+	}
+
+	resp, err = pub.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request chunk '%x': %v", k, err)
+	}
+
+	if resp.StatusCode != code {
+		resp.Body.Close()
+		return resp, fmt.Errorf("unexpected response for chunk '%x': %s", k, resp.Status)
+	}
+
+	return resp, nil
+}
+
+//ChunkReader returns the content of the chunk with the given key
+func (pub *PublicRemote) ChunkReader(k K) (rc io.ReadCloser, err error) {
+	resp, err := pub.get("GET", k, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+//chunkReaderFrom returns the content of the chunk starting at offset 'off'
+func (pub *PublicRemote) chunkReaderFrom(k K, off int64) (rc io.ReadCloser, err error) {
+	resp, err := pub.get("GET", k, http.Header{"Range": {fmt.Sprintf("bytes=%d-", off)}}, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+//hasChunk asks whether the chunk is published without reading it, only
+//chunks of version 0 are published
+func (pub *PublicRemote) hasChunk(v KeyVersion, k K) (ok bool, err error) {
+	if v != KeyVersion0 {
+		return false, nil
+	}
+
+	resp, err := pub.get("HEAD", k, nil, http.StatusOK)
+	if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden) {
+		return false, nil //public buckets that can't be listed deny missing objects
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	resp.Body.Close()
+	return true, nil
+}
+
+//ChunkWriter always fails, chunks are published with 'git bits publish'
+func (pub *PublicRemote) ChunkWriter(k K) (wc io.WriteCloser, err error) {
+	return nil, ErrReadOnly
+}
+
+//ListChunks always fails, public urls can't be listed
+func (pub *PublicRemote) ListChunks(w io.Writer) (err error) {
+	return fmt.Errorf("chunks of the public url '%s' can't be listed", pub.base)
+}
+
+//DeleteChunks always fails, chunks can't be deleted anonymously
+func (pub *PublicRemote) DeleteChunks(ks []K) error {
+	return ErrDeleteNotSupported
+}
+
+//Publish uploads the chunks of the split files in the trees of 'refs' to
+//remote 'to', e.g. a public bucket from which they are read anonymously
+//through 'bits.public-url'. Chunks are uploaded as they are stored: they
+//can be decrypted by anyone who reads the pointers of the published refs
+//but not by those who only read the bucket. Chunks are read locally or
+//from the configured remote, those that 'to' lists already are skipped.
+//It uploads up to 'concurrency' chunks in parallel, if its zero
+//FetchConcurrency is used.
+func (repo *Repository) Publish(to Remote, refs []string, concurrency int) (published, skipped int, err error) {
+	_, end := repo.trace(context.Background(), "publish")
+	defer end(&err)
+	if concurrency < 1 {
+		concurrency = FetchConcurrency
+	}
+
+	keys := []K{}
+	seen := map[K]bool{}
+	for _, ref := range refs {
+		_, ks, err := repo.refChunks(ref)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		for _, k := range ks {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = to.ListChunks(buf)
+	if err != nil {
+		return 0, 0, withKind(NetworkError, fmt.Errorf("failed to list chunks that are published already: %v", err))
+	}
+
+	existing := map[K]bool{}
+	err = repo.ForEach(buf, func(k K) error {
+		existing[k] = true
+		return nil
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read chunks that are published already: %v", err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := []string{}
+	keyCh := make(chan K)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keyCh {
+				err := repo.publishChunk(to, k)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err.Error())
+				} else {
+					published++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, k := range keys {
+		if existing[k] {
+			skipped++
+			continue
+		}
+
+		keyCh <- k
+	}
+
+	close(keyCh)
+	wg.Wait()
+	if len(errs) > 0 {
+		return published, skipped, withKind(repo.fetchFailureKind(len(errs), len(keys)-skipped), fmt.Errorf("failed to publish %d of %d chunks: \n %s", len(errs), len(keys)-skipped, summarizeErrors(errs)))
+	}
+
+	return published, skipped, nil
+}
+
+//publishChunk uploads chunk 'k' to 'to', from the local chunk directory or
+//else from the configured remote
+func (repo *Repository) publishChunk(to Remote, k K) (err error) {
+	p, _ := repo.Path(k, false)
+	f, err := os.Open(p)
+	if err == nil {
+		return copyChunk(&localChunks{f: f}, to, KeyVersion0, k)
+	}
+
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open chunk '%x': %v", k, err)
+	}
+
+	if repo.currentRemote() == nil {
+		return withKind(MissingChunkError, fmt.Errorf("chunk '%x' isn't stored locally and no remote is configured", k))
+	}
+
+	return copyChunk(repo.currentRemote(), to, KeyVersion0, k)
+}
+
+//localChunks hands an opened local chunk file to copyChunk as if it was
+//read from a remote, copyChunk closes it
+type localChunks struct {
+	Remote
+	f *os.File
+}
+
+func (l *localChunks) ChunkReader(k K) (rc io.ReadCloser, err error) {
+	return l.f, nil
+}
+
+//SharePublicURL records the url that chunks are published at in the shared
+//configuration file, such that clones without credentials read them there
+func (repo *Repository) SharePublicURL(w io.Writer, loc string) (err error) {
+	_, err = NewPublicRemote(loc, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(repo.rootDir, SharedConfFile)
+	err = repo.Git(nil, nil, nil, "config", "--file", p, "bits.public-url", loc)
+	if err != nil {
+		return fmt.Errorf("failed to record public url in '%s': %v", p, err)
+	}
+
+	fmt.Fprintf(w, "recorded the public url in '%s', commit it such that clones without credentials read chunks there\n", SharedConfFile)
+	return nil
+}
@@ -0,0 +1,99 @@
+package bits
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+//PullSelection selects the files that are pulled: split files in the trees
+//of Refs (HEAD if there are none) of which the path matches any of the
+//Include patterns, if there are any, and none of the Exclude patterns.
+//Patterns are matched with path.Match against the path and, if they hold
+//no slash, against the file name. Files outside the sparse checkout of the
+//working tree are not selected unless IgnoreSparse is set, their chunks are
+//then fetched without being written to the working tree.
+type PullSelection struct {
+	Refs         []string
+	Include      []string
+	Exclude      []string
+	IgnoreSparse bool
+}
+
+//CheckPatterns returns an error if any of the patterns is malformed
+func (sel PullSelection) CheckPatterns() error {
+	for _, pattern := range append(append([]string{}, sel.Include...), sel.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+//refs returns the refs of the selection, HEAD if there are none
+func (sel PullSelection) refs() []string {
+	if len(sel.Refs) == 0 {
+		return []string{"HEAD"}
+	}
+
+	return sel.Refs
+}
+
+//selects returns whether the file at 'p' is selected by the patterns
+func (sel PullSelection) selects(p string) bool {
+	if len(sel.Include) > 0 && !matchAny(sel.Include, p) {
+		return false
+	}
+
+	return !matchAny(sel.Exclude, p)
+}
+
+//matchAny returns whether any of the patterns matches the path 'p' or, if
+//it holds no slash, its file name
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+
+		if strings.Contains(pattern, "/") {
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, path.Base(p)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+//selectedFiles returns the paths of the split files that are selected in the
+//order git lists them, with their pointers. Files that are in multiple refs
+//are listed once, with the pointer of the first ref.
+func (repo *Repository) selectedFiles(sel PullSelection) (paths []string, ptrs map[string]*Pointer, err error) {
+	inside, err := repo.sparseFilter()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ptrs = map[string]*Pointer{}
+	for _, ref := range sel.refs() {
+		refPaths, refPtrs, err := repo.splitFiles(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, p := range refPaths {
+			if _, ok := ptrs[p]; ok || !sel.selects(p) || !(sel.IgnoreSparse || inside(p)) {
+				continue
+			}
+
+			paths = append(paths, p)
+			ptrs[p] = refPtrs[p]
+		}
+	}
+
+	return paths, ptrs, nil
+}
@@ -0,0 +1,97 @@
+package bits
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//CorruptStoreSuffix is appended to the name of a chunks database that is
+//corrupted when it is moved aside
+var CorruptStoreSuffix = ".corrupt"
+
+//openStore opens the chunks database at 'dbpath' and creates the necessary
+//buckets. It reports whether the database is corrupted, such that opening it
+//again won't help: bolt detects some corruption and panics on the rest.
+func (repo *Repository) openStore(dbpath string) (db *bolt.DB, corrupt bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			db, corrupt, err = nil, true, fmt.Errorf("chunks database '%s' is corrupted: %v", dbpath, r)
+		}
+	}()
+
+	db, err = bolt.Open(dbpath, repo.fileMode(), &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		corrupt = err == bolt.ErrInvalid || err == bolt.ErrVersionMismatch || err == bolt.ErrChecksum
+		return nil, corrupt, fmt.Errorf("failed to open chunks database '%s': %v", dbpath, err)
+	}
+
+	err = applyMode(dbpath, repo.fileMode(), repo.conf != nil && repo.conf.FileMode != 0)
+	if err != nil {
+		db.Close()
+		return nil, false, fmt.Errorf("failed to set mode of chunks database '%s': %v", dbpath, err)
+	}
+
+	for _, name := range [][]byte{IndexBucket, ETagBucket, StagedBucket, WatermarkBucket, PendingWatermarkBucket, ChunkRefBucket, UsageBucket, CommitBlobsBucket, AccessBucket, TierBucket, AbsentBucket} {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fmt.Errorf("failed to create bucket: %s", err)
+			}
+			return nil
+		})
+
+		if err != nil {
+			db.Close()
+			return nil, false, fmt.Errorf("failed to create bucket '%s': %v", string(name), err)
+		}
+	}
+
+	return db, false, nil
+}
+
+//repairStore moves the corrupted chunks database at 'dbpath' aside and
+//rebuilds what can be recovered: the remote listing tells which chunks are
+//stored remotely, other chunks in the local chunk directory are recorded as
+//staged such that they are pushed and gc keeps them. Chunk references and
+//watermarks are lost, the next push scans all history again.
+func (repo *Repository) repairStore(dbpath string, cause error) (db *bolt.DB, err error) {
+	aside := fmt.Sprintf("%s%s-%d", dbpath, CorruptStoreSuffix, time.Now().Unix())
+	err = os.Rename(dbpath, aside)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move corrupted chunks database aside (%v): %v", cause, err)
+	}
+
+	fmt.Fprintf(repo.output, "warning: %v, it was moved to '%s' and is rebuilt\n", cause, aside)
+	db, _, err = repo.openStore(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if repo.currentRemote() != nil {
+		err = repo.indexRemote(context.Background(), db)
+		if err != nil {
+			fmt.Fprintf(repo.output, "warning: failed to list the remote, all local chunks are considered to be unpushed: %v\n", err)
+		}
+	}
+
+	ids := []chunkID{}
+	err = repo.walkAllChunks(func(id chunkID, fi os.FileInfo) error {
+		ids = append(ids, id)
+		return nil
+	})
+
+	if err == nil {
+		err = repo.recordStaged(db, ids)
+	}
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to rebuild chunks database: %v", err)
+	}
+
+	return db, nil
+}
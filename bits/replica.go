@@ -0,0 +1,163 @@
+package bits
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+var (
+	//ReplicaLatencyTTL determines how long the measured latency of a bucket
+	//and its replicas is used before it is measured again
+	ReplicaLatencyTTL = time.Hour
+
+	//ReplicaProbes is the number of requests with which the latency of a
+	//bucket is measured, the fastest counts
+	ReplicaProbes = 2
+)
+
+//replicaLatencyFile holds the latencies that were measured, in the git dir
+const replicaLatencyFile = "bits-replica-latency"
+
+//replicaLatency is the measured latency of a bucket
+type replicaLatency struct {
+	Latency  time.Duration `json:"latency"`
+	Measured time.Time     `json:"measured"`
+}
+
+//parseReplica parses a configured replica: the name of a bucket at the
+//endpoint of the primary bucket, or '<endpoint>/<bucket>' for a bucket in
+//another region (e.g. 's3.eu-west-1.amazonaws.com/my-bucket-eu')
+func parseReplica(s string) (domain, bucket string, err error) {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		domain, bucket = s[:i], s[i+1:]
+		if domain == "" || strings.Contains(domain, "://") {
+			return "", "", fmt.Errorf("expected an endpoint without scheme, e.g. 's3.eu-west-1.amazonaws.com/<bucket>'")
+		}
+	} else {
+		bucket = s
+	}
+
+	if bucket == "" {
+		return "", "", fmt.Errorf("expected the name of a bucket")
+	}
+
+	return domain, bucket, nil
+}
+
+//replicaName identifies bucket 'b' in the latencies that were measured
+func replicaName(b *s3gof3r.Bucket) string {
+	return b.Domain + "/" + b.Name
+}
+
+//readBucket returns the bucket that chunks are read from: of the bucket and
+//its replicas the one with the lowest latency, the earliest configured if
+//they are equally fast. Chunks are always written to the bucket itself.
+func (s *S3Remote) readBucket() *s3gof3r.Bucket {
+	s.readerOnce.Do(func() {
+		s.reader = s.bucket
+		if len(s.replicas) == 0 {
+			return
+		}
+
+		buckets := append([]*s3gof3r.Bucket{s.bucket}, s.replicas...)
+		latencies := s.repo.replicaLatencies(buckets, s.measureLatency)
+		for _, b := range buckets[1:] {
+			l, ok := latencies[replicaName(b)]
+			if !ok {
+				continue
+			}
+
+			if cur, ok := latencies[replicaName(s.reader)]; !ok || l.Latency < cur.Latency {
+				s.reader = b
+			}
+		}
+	})
+
+	return s.reader
+}
+
+//measureLatency returns the time it takes bucket 'b' to respond to the
+//fastest of ReplicaProbes requests, any response counts as it is only
+//about the round trip
+func (s *S3Remote) measureLatency(b *s3gof3r.Bucket) (latency time.Duration, err error) {
+	for i := 0; i < ReplicaProbes || i == 0; i++ {
+		start := time.Now()
+		resp, err := s.requestTo(b, "HEAD", "", nil, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		resp.Body.Close()
+		if d := time.Since(start); i == 0 || d < latency {
+			latency = d
+		}
+	}
+
+	return latency, nil
+}
+
+//replicaLatencies returns the latency of each of the buckets, latencies
+//that were measured less than ReplicaLatencyTTL ago are read from the git
+//dir, others are measured in parallel with 'measure' and written there.
+//Buckets that can't be reached are left out.
+func (repo *Repository) replicaLatencies(buckets []*s3gof3r.Bucket, measure func(*s3gof3r.Bucket) (time.Duration, error)) (latencies map[string]replicaLatency) {
+	p := filepath.Join(repo.gitDir, replicaLatencyFile)
+	latencies = map[string]replicaLatency{}
+	data, err := ioutil.ReadFile(p)
+	if err == nil {
+		err = json.Unmarshal(data, &latencies)
+		if err != nil {
+			latencies = map[string]replicaLatency{} //measured again
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	measured := false
+	for _, b := range buckets {
+		name := replicaName(b)
+		if l, ok := latencies[name]; ok && time.Since(l.Measured) < ReplicaLatencyTTL {
+			continue
+		}
+
+		measured = true
+		delete(latencies, name)
+		wg.Add(1)
+		go func(b *s3gof3r.Bucket) {
+			defer wg.Done()
+			latency, err := measure(b)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(repo.output, "failed to measure the latency of '%s', not reading from it: %v\n", replicaName(b), err)
+				return
+			}
+
+			latencies[replicaName(b)] = replicaLatency{Latency: latency, Measured: time.Now()}
+		}(b)
+	}
+
+	wg.Wait()
+	if !measured {
+		return latencies
+	}
+
+	data, err = json.Marshal(latencies)
+	if err == nil {
+		err = repo.writeFile(p, data)
+	}
+
+	if err != nil {
+		fmt.Fprintf(repo.output, "failed to record measured replica latencies: %v\n", err)
+	}
+
+	return latencies
+}
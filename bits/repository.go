@@ -4,16 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"iter"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,7 +23,6 @@ import (
 
 	"github.com/VividCortex/ewma"
 	"github.com/boltdb/bolt"
-	"github.com/dustin/go-humanize"
 	"github.com/restic/chunker"
 )
 
@@ -30,23 +31,62 @@ var RemoteChunk = []byte{}
 
 var (
 	ErrAlreadyPushed = fmt.Errorf("chunk is already pushed to the remote")
+
+	//ErrReadOnly is returned by operations that would write to the remote
+	//when the repository is configured with 'bits.readonly'
+	ErrReadOnly = fmt.Errorf("repository is read-only ('bits.readonly'), chunks can't be written to the remote")
+
+	//ErrDeleteNotSupported is returned by remotes that can't remove chunks
+	ErrDeleteNotSupported = fmt.Errorf("the remote doesn't support deleting chunks")
 )
 
 var (
-	//ChunkBufferSize determines the size of the buffer that wil hold each chunk
+	//ChunkBufferSize determines the size of the buffer that wil hold each
+	//chunk, unless another size is configured with 'bits.chunk-buffer'
 	ChunkBufferSize = 8 * 1024 * 1024 //8MiB
 
+	//PartialChunkSuffix is appended to the path of chunks that are being
+	//downloaded, such that an interrupted download can be resumed
+	PartialChunkSuffix = ".part"
+
+	//SplitConcurrency determines how many chunks are hashed and encrypted in
+	//parallel, splitting holds up to 2*SplitConcurrency+2 chunk buffers
+	SplitConcurrency = runtime.NumCPU()
+
+	//SplitFlushInterval determines how often the keys that splitting writes
+	//are flushed to its output, such that git sees keys as chunks complete
+	//instead of once the whole file is split. Zero flushes every key.
+	SplitFlushInterval = 100 * time.Millisecond
+
+	//FetchConcurrency determines how many chunks are fetched in parallel
+	FetchConcurrency = 8
+
 	//RemoteBranchSuffix identifies the specialty branches used for persisting remote information
 	RemoteBranchSuffix = "bits-remote"
+
+	//ChunkIndexBranch is the specialty branch that holds the chunk index, its
+	//blobs are never scanned for keys
+	ChunkIndexBranch = "bits_chunk_idx"
 )
 
 var (
 	//IndexBucket holds remotely whether chunks are stored remotely
 	IndexBucket = []byte("index")
+
+	//ETagBucket holds the entity tags the remote assigned to pushed chunks
+	ETagBucket = []byte("etags")
+
+	//StagedBucket holds the chunks that were staged by splitting but are not
+	//known to be stored remotely yet, other local chunks are cached copies
+	StagedBucket = []byte("staged")
 )
 
 //Repository provides an abstraction on top of a Git repository for a
-//certain directory that is queried by git commands
+//certain directory that is queried by git commands. It is safe for use by
+//multiple goroutines, e.g. to fetch and push at the same time, as long as
+//the exported fields and what is set with SetMetrics and SetTracer are set
+//before operations run. Operations that run at the same time share the
+//local store. Close it to stop handling the progress of operations.
 type Repository struct {
 	//Path the to the Git executable we're using
 	exe string
@@ -69,24 +109,88 @@ type Repository struct {
 	//Footer Key allows us to recognize the end of a key listing
 	footer []byte
 
-	//remotes hold the remote chunk store we're using
-	remote Remote
+	//headers and footers that are recognized when reading, see setupSentinels
+	headers [][]byte
+	footers [][]byte
+
+	//remotes hold the remote chunk store we're using, it can be replaced
+	//while operations run
+	remote   Remote
+	remoteMu sync.RWMutex
+
+	//wraps each remote that is set, see UseRemoteMiddleware
+	middleware []RemoteMiddleware
+
+	//remotes of the buckets that refs are routed to, see 'bits.route'
+	routes map[string]Remote
 
 	//bits specific configuration
 	conf *Conf
 
-	//this channel receives any chunk Key that is hanled in an any operation
-	keyProgressCh chan KeyOp
+	//this channel receives any chunk Key that is hanled in an any operation,
+	//until the repository is closed
+	keyProgressCh  chan KeyOp
+	progressMu     sync.RWMutex
+	progressClosed bool
+	progressDone   chan struct{}
 
 	//is called when a chunk was handled in any operation, can be called
 	//concurrently
 	KeyProgressFn func(KeyOp, float64)
+	progressSink  ProgressSink
+
+	//is called after each split file that is pulled
+	PullProgressFn func(PullProgress)
+
+	//inspects the content of chunks before they are pushed or stored after
+	//fetching, can be called concurrently
+	ChunkHook ChunkHook
+
+	//peers on the local network that are asked for chunks before the remote
+	peers     []string
+	peersOnce sync.Once
+	peerMu    sync.Mutex
+
+	//counts what the chunk server and daemon do, nil when not exposed
+	metrics *Metrics
+
+	//follows the transfers of chunks for 'git bits top', nil when not served
+	monitor *Monitor
+
+	//records spans of operations and remote calls, nil when not tracing
+	tracer *Tracer
+
+	//local store that is shared by the operations that use it at the same
+	//time, it is closed when the last is done unless it was lent to us
+	storeMu    sync.Mutex
+	store      *bolt.DB
+	storeUsers int
+	storeLent  bool
+
+	//audit entries that are not yet written and who they are recorded for
+	auditMu      sync.Mutex
+	auditPending []AuditEntry
+	auditOnce    sync.Once
+	auditWho     string
+
+	//hash algorithm git computes object ids with
+	objectFormatOnce sync.Once
+	objectFormat     string
+
+	//chunks referenced by scanned blobs that are not yet recorded
+	refsMu      sync.Mutex
+	scannedRefs map[string][]chunkID
+
+	//bytes transferred per remote that are not yet recorded
+	usageMu      sync.Mutex
+	usagePending map[string]*RemoteUsage
 }
 
 //NewRepository sets up an interface on top of a Git repository in the
 //provided directory. It will fail if the get executable is not in
 //the shells PATH or if the directory doesnt seem to be a Git repository
 func NewRepository(dir string, output io.Writer) (repo *Repository, err error) {
+	defer func() { err = withKind(ConfigError, err) }()
 	repo = &Repository{}
 	repo.exe, err = exec.LookPath("git")
 	if err != nil {
@@ -116,18 +220,10 @@ func NewRepository(dir string, output io.Writer) (repo *Repository, err error) {
 		repo.output = os.Stderr
 	}
 
-	//for now, store chunks in the .git directory
-	repo.chunkDir = filepath.Join(repo.gitDir, "chunks")
-	err = os.MkdirAll(repo.chunkDir, 0777)
-	if err != nil {
-		return nil, fmt.Errorf("couldnt setup chunk directory at '%s': %v", repo.chunkDir, err)
-	}
-
-	//setup header and footers
-	repo.header = []byte("--- to use this file decode it with the 'git-bits' extension ---\n")
-	repo.footer = []byte("----------------------- end of chunks --------------------------\n")
-	if len(repo.header) != (hex.EncodedLen(KeySize)+1) || len(repo.footer) != (hex.EncodedLen(KeySize)+1) {
-		return nil, fmt.Errorf("repository header and footer size are not '%d': header: %d, footer: %d", hex.EncodedLen(KeySize)+1, len(repo.header), len(repo.footer))
+	//git and the progress of operations write to it concurrently, files can
+	//take that but other writers may not
+	if _, ok := repo.output.(*os.File); !ok {
+		repo.output = &lockedWriter{w: repo.output}
 	}
 
 	//setup configuration
@@ -137,11 +233,34 @@ func NewRepository(dir string, output io.Writer) (repo *Repository, err error) {
 		return nil, fmt.Errorf("failed to load bits configuration from git: %v", err)
 	}
 
-	//if a bucket is configured we will attempt to configured
-	if repo.conf.AWSS3BucketName != "" {
+	//setup header and footers
+	err = repo.setupSentinels()
+	if err != nil {
+		return nil, fmt.Errorf("invalid pointer sentinels: %v", err)
+	}
+
+	//for now, store chunks in the .git directory
+	repo.chunkDir = filepath.Join(repo.gitDir, "chunks")
+	err = repo.mkdirAll(repo.chunkDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldnt setup chunk directory at '%s': %v", repo.chunkDir, err)
+	}
+
+	repo.tracer, err = NewTracerFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup tracing: %v", err)
+	}
+
+	//a grpc chunk service takes precedence over a bucket
+	if repo.conf.GRPCAddress != "" {
+		repo.remote, err = NewGRPCRemote(repo.conf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup chunk remote: %v", err)
+		}
+	} else if repo.conf.AWSS3BucketName != "" {
 		repo.remote, err = NewS3Remote(
 			repo,
-			"origin",
+			repo.conf.remoteName(),
 			repo.conf.AWSS3BucketName,
 			repo.conf.AWSAccessKeyID,
 			repo.conf.AWSSecretAccessKey,
@@ -150,37 +269,35 @@ func NewRepository(dir string, output io.Writer) (repo *Repository, err error) {
 		if err != nil {
 			return nil, fmt.Errorf("unable to setup chunk remote: %v", err)
 		}
-	}
-
-	//default output function will do basic logging of key progress
-	indexBucketMax := 500
-	indexedTotalKeys := 0
-	repo.KeyProgressFn = func(kop KeyOp, tp float64) {
-		if kop.Op == IndexOp {
-			indexedTotalKeys++
-			if indexedTotalKeys%indexBucketMax == 0 {
-				fmt.Fprintf(repo.output, "indexed %d remote chunks, total: ~%s\n", indexBucketMax, humanize.FormatInteger("#.", indexedTotalKeys))
-			}
-
-			return
+	} else if repo.conf.PublicURL != "" {
+		client, err := repo.conf.HTTPClient()
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup chunk remote: %v", err)
 		}
 
-		if kop.Op != IndexOp && indexedTotalKeys > 0 {
-			fmt.Fprintf(repo.output, "indexing of remote chunks ended, total: ~%s\n", humanize.FormatInteger("#.", indexedTotalKeys))
-			indexedTotalKeys = 0
+		repo.remote, err = NewPublicRemote(repo.conf.PublicURL, repo.conf.KeyShardDepth, client)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup chunk remote: %v", err)
 		}
 
-		if kop.Skipped {
-			fmt.Fprintf(repo.output, "%x (skip: already %s)\n", kop.K, strings.Replace(fmt.Sprintf("%sed", string(kop.Op)), "ee", "e", 1))
-		} else {
-			fmt.Fprintf(repo.output, "%x (%s) %s/s\n", kop.K, string(kop.Op), humanize.Bytes(uint64(tp)))
-		}
+		//without credentials nothing can be written
+		repo.conf.ReadOnly = true
+	}
+
+	//progress is reported as configured, commands can override it
+	sink, err := NewProgressSink(repo.conf.Progress, repo.output)
+	if err != nil {
+		return nil, err
 	}
 
+	repo.SetProgress(sink)
+
 	//we start handling key events while keeping a moving
 	//average for the number of bytes moving through
 	repo.keyProgressCh = make(chan KeyOp, 1)
+	repo.progressDone = make(chan struct{})
 	go func() {
+		defer close(repo.progressDone)
 		lastT := time.Now()
 		e := ewma.NewMovingAverage()
 		for kop := range repo.keyProgressCh {
@@ -199,6 +316,65 @@ func NewRepository(dir string, output io.Writer) (repo *Repository, err error) {
 	return repo, nil
 }
 
+//SetRemote replaces the remote that chunks are pushed to and fetched from,
+//programs that embed git-bits and tests can use a MemoryRemote. It is
+//wrapped with the middleware that is in use.
+func (repo *Repository) SetRemote(remote Remote) {
+	repo.remoteMu.Lock()
+	defer repo.remoteMu.Unlock()
+	repo.remote = wrapRemote(remote, repo.middleware)
+}
+
+//currentRemote returns the remote that chunks are pushed to and fetched
+//from, nil if none is configured
+func (repo *Repository) currentRemote() Remote {
+	repo.remoteMu.RLock()
+	defer repo.remoteMu.RUnlock()
+	return repo.remote
+}
+
+//progress hands key operation 'kop' to KeyProgressFn, operations that end
+//after the repository is closed are not reported
+func (repo *Repository) progress(kop KeyOp) {
+	repo.progressMu.RLock()
+	defer repo.progressMu.RUnlock()
+	if repo.progressClosed {
+		return
+	}
+
+	repo.keyProgressCh <- kop
+}
+
+//Close stops handling the progress of operations once the progress of those
+//that are running is handled, and closes the progress sink. Closing it more than once is a no-op.
+func (repo *Repository) Close() error {
+	repo.progressMu.Lock()
+	if repo.progressClosed {
+		repo.progressMu.Unlock()
+		return nil
+	}
+
+	repo.progressClosed = true
+	close(repo.keyProgressCh)
+	repo.progressMu.Unlock()
+	<-repo.progressDone
+	if closer, ok := repo.progressSink.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+//SetMetrics makes the chunk server and daemon count what they do in 'm'
+func (repo *Repository) SetMetrics(m *Metrics) {
+	repo.metrics = m
+}
+
+//SetTracer makes operations and remote calls record spans with 't'
+func (repo *Repository) SetTracer(t *Tracer) {
+	repo.tracer = t
+}
+
 //Git runs the git executable with the working directory set to the repository director
 func (repo *Repository) Git(ctx context.Context, in io.Reader, out io.Writer, args ...string) (err error) {
 	if ctx == nil {
@@ -211,6 +387,11 @@ func (repo *Repository) Git(ctx context.Context, in io.Reader, out io.Writer, ar
 	cmd.Stdin = in
 	cmd.Stdout = out
 
+	//filters and hooks that git runs continue the trace of the operation
+	if tp := spanFrom(ctx).Traceparent(); tp != "" {
+		cmd.Env = append(os.Environ(), "TRACEPARENT="+tp)
+	}
+
 	err = cmd.Run()
 	if err != nil {
 		return fmt.Errorf("failed to run `git %v`: %v", strings.Join(args, " "), err)
@@ -220,17 +401,58 @@ func (repo *Repository) Git(ctx context.Context, in io.Reader, out io.Writer, ar
 }
 
 //Install will prepare a git repository for usage with git bits, it configures
-//filters, installs hooks and pulls chunks to write files in the current
+//filters and the merge and diff drivers, installs hooks and pulls chunks to write files in the current
 //working tree. A configuration struct can be provided to populate local
 //git configuration got future bits commands
 func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 	ctx := context.Background()
 
-	//configure filter
-	gconf := map[string]string{
-		"filter.bits.clean":    "git bits split",
-		"filter.bits.smudge":   "git bits fetch | git bits combine",
-		"filter.bits.required": "true",
+	//configure filter, settings that other tools changed are restored
+	drift, err := repo.FilterDrift()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range drift {
+		if d.Actual != "" {
+			fmt.Fprintf(repo.output, "restoring '%s' to '%s', it was '%s'\n", d.Key, d.Expected, d.Actual)
+		}
+	}
+
+	err = repo.writeFilterConf()
+	if err != nil {
+		return err
+	}
+
+	gconf := map[string]string{}
+
+	//a clone that is read-only stays so, also when installed again
+	readonly := repo.conf.ReadOnly || (conf != nil && conf.ReadOnly)
+	if readonly {
+		gconf["bits.readonly"] = "true"
+	}
+
+	//commits of pointers that the filter didn't write are refused optionally
+	precommit := `git-bits track --auto`
+	reject := repo.conf.RejectRawPointers || (conf != nil && conf.RejectRawPointers)
+	if reject {
+		gconf["bits.reject-raw-pointers"] = "true"
+		precommit += ` && git-bits check-staged`
+	}
+
+	//a lazy clone stays so, also when installed again
+	if repo.conf.Lazy || (conf != nil && conf.Lazy) {
+		gconf["bits.lazy"] = "true"
+	}
+
+	//a clone keeps the key that its sealed pointers are read with
+	pointerKey := repo.conf.PointerKey
+	if pointerKey == "" && conf != nil {
+		pointerKey = conf.PointerKey
+	}
+
+	if pointerKey != "" {
+		gconf["bits.pointer-key"] = pointerKey
 	}
 
 	//add bits configuration
@@ -239,6 +461,19 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 			gconf["bits.aws-s3-bucket-name"] = conf.AWSS3BucketName
 		}
 
+		//chunks stay with the remote they were configured for
+		if conf.Remote == "" {
+			conf.Remote = repo.conf.Remote
+		}
+
+		if conf.Remote != "" {
+			gconf["bits.remote"] = conf.Remote
+		}
+
+		if len(conf.AWSS3Replicas) > 0 {
+			gconf["bits.aws-s3-replicas"] = strings.Join(conf.AWSS3Replicas, ",")
+		}
+
 		if conf.AWSAccessKeyID != "" {
 			gconf["bits.aws-access-key-id"] = conf.AWSAccessKeyID
 		}
@@ -247,17 +482,50 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 			gconf["bits.aws-secret-access-key"] = conf.AWSSecretAccessKey
 		}
 
-		if conf.DeduplicationScope != 0 {
-			gconf["bits.deduplication-scope"] = strconv.FormatUint(conf.DeduplicationScope, 10)
+		//repositories that share a bucket must split files the same way
+		var shared sharedIndexer
+		if conf.SharedRepository != "" {
+			gconf["bits.shared-repository"] = conf.SharedRepository
+			shared, err = repo.adoptSharedScope(conf)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = repo.shareConf(w, conf)
+		if err != nil {
+			return err
+		}
+
+		if shared != nil {
+			err = repo.recordSharedScope(w, shared, conf)
+			if err != nil {
+				return err
+			}
+		}
+
+		if conf.RequesterPays {
+			gconf["bits.requester-pays"] = "true"
 		}
 
+		if conf.CABundle != "" {
+			gconf["bits.ca-bundle"] = conf.CABundle
+		}
+
+		if conf.InsecureSkipVerify {
+			gconf["bits.insecure-skip-verify"] = "true"
+		}
+
+		conf.ReadOnly = readonly
+		conf.RejectRawPointers = reject
+		conf.PointerKey = pointerKey
 		repo.conf = conf
 
 		//@TODO init can complete remote configuration
 		//@TODO obvious code duplication with constructor
-		repo.remote, err = NewS3Remote(
+		remote, err := NewS3Remote(
 			repo,
-			"origin",
+			repo.conf.remoteName(),
 			repo.conf.AWSS3BucketName,
 			repo.conf.AWSAccessKeyID,
 			repo.conf.AWSSecretAccessKey,
@@ -266,6 +534,8 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 		if err != nil {
 			return fmt.Errorf("unable to setup default chunk remote: %v", err)
 		}
+
+		repo.SetRemote(remote)
 	}
 
 	//write configuration
@@ -276,28 +546,22 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 		}
 	}
 
-	//write hook if doesnt exist yet
-	hookp := filepath.Join(repo.gitDir, "hooks", "pre-push")
-	f, err := os.OpenFile(hookp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0777)
-	if err != nil {
-		if os.IsExist(err) {
-			fmt.Fprintf(repo.output, "a file already exists at '%s' already, skip writing git-bits hook\n", hookp)
-		} else {
-			return fmt.Errorf("couldnt setup hook: %v", err)
-		}
+	//write hooks if they dont exist yet, read-only clones never push chunks
+	if readonly {
+		fmt.Fprintf(repo.output, "repository is read-only, skip writing git-bits hook\n")
 	} else {
-		defer f.Close()
-		_, err = f.WriteString(`#!/bin/sh
-			command -v git-bits >/dev/null 2>&1 || { echo >&2 "This project was setup with git-bits but it can (no longer) be found in your PATH: $PATH."; exit 0; }
-			git-bits scan | git-bits push
-	`)
-
+		err = repo.writeHook("pre-push", `git-bits scan "$1" | git-bits push "$1"`)
 		if err != nil {
-			return fmt.Errorf("failed to git hook: %v", err)
+			return err
 		}
 	}
 
-	err = repo.Pull("HEAD", w)
+	err = repo.writeHook("pre-commit", precommit)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Pull(PullSelection{Refs: []string{"HEAD"}}, w)
 	if err != nil {
 		return fmt.Errorf("failed to pull chunks for HEAD: %v", err)
 	}
@@ -305,221 +569,1003 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 	return nil
 }
 
-//ForEach is a convenient method for running logic for each chunk
-//key in stream 'r', it will skip the chunk header and footer
-func (repo *Repository) ForEach(r io.Reader, fn func(K) error) error {
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-
-		//and in any case skip it
-		if bytes.Equal(s.Bytes(), repo.header[:len(repo.header)-1]) ||
-			bytes.Equal(s.Bytes(), repo.footer[:len(repo.footer)-1]) {
-			continue
-		}
-
-		//decode the actual keys
-		data := make([]byte, hex.DecodedLen(len(s.Bytes())))
-		_, err := hex.Decode(data, s.Bytes())
-		if err != nil {
-			return fmt.Errorf("failed to decode '%x' as hex: %v", s.Bytes(), err)
-		}
-
-		//check key length
-		k := K{}
-		if len(k) != len(data) {
-			return fmt.Errorf("decoded chunk key '%x' has an invalid length %d, expected %d", data, len(data), len(k))
-		}
-
-		//fill K and hand it over
-		copy(k[:], data[:KeySize])
-		err = fn(k)
-		if err != nil {
-			return fmt.Errorf("failed to handle key '%x': %v", k, err)
-		}
+//Init configures the bucket that chunks of the git remote named 'remote'
+//are stored in and installs the repository like Install does, without
+//asking for anything. Credentials are taken from AWS_ACCESS_KEY_ID and
+//AWS_SECRET_ACCESS_KEY when they are set, configured ones are kept otherwise.
+func (repo *Repository) Init(w io.Writer, remote, bucket string) (err error) {
+	if bucket == "" {
+		return withKind(ConfigError, fmt.Errorf("no bucket to store chunks in was given"))
 	}
 
-	if err := s.Err(); err != nil {
-		return fmt.Errorf("failed to scan chunk keys: %v", err)
+	err = repo.Git(context.Background(), nil, ioutil.Discard, "config", "--get", "remote."+remote+".url")
+	if err != nil {
+		return withKind(ConfigError, fmt.Errorf("git remote '%s' is not configured", remote))
 	}
 
-	return nil
+	conf := DefaultConf()
+	conf.Remote = remote
+	conf.AWSS3BucketName = bucket
+	conf.AWSAccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	conf.AWSSecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+
+	//the scope recorded in the repository is used, or a random one
+	conf.DeduplicationScope = 0
+	return repo.Install(w, conf)
 }
 
-//Push takes a list of chunk keys on reader 'r' and moves each chunk from
-//the local storage to the remote store with name 'remote'. Prior to pushing
-//the local index of the remote is updated so chunks are not uploaded twice.
-func (repo *Repository) Push(store *bolt.DB, r io.Reader, remoteName string) (err error) {
-	if repo.remote == nil {
-		return fmt.Errorf("unable to push, no remote configured")
+//writeHook writes a git hook that runs 'script' if git-bits is available,
+//a hook that already exists is left alone
+func (repo *Repository) writeHook(name, script string) (err error) {
+	dir, err := repo.hooksDir()
+	if err != nil {
+		return err
 	}
 
-	//err handling
-	errs := []string{}
-	errCh := make(chan error)
-	defer close(errCh)
-	go func() {
-		for err := range errCh {
-			errs = append(errs, fmt.Sprintf("%v", err))
-		}
-	}()
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return fmt.Errorf("failed to create hooks directory '%s': %v", dir, err)
+	}
 
-	//ask the remote to fetch all chunk keys
-	pr, pw := io.Pipe()
-	go func() {
-		err = repo.remote.ListChunks(pw)
-		defer pw.Close()
-		if err != nil {
-			errCh <- fmt.Errorf("failed to list remote chunk keys: %v", err)
+	hookp := filepath.Join(dir, name)
+	f, err := os.OpenFile(hookp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0777)
+	if err != nil {
+		if os.IsExist(err) {
+			fmt.Fprintf(repo.output, "a file already exists at '%s', skip writing git-bits hook. To add it to the existing hook (or hook manager) run: %s\n", hookp, script)
+			return nil
 		}
-	}()
 
-	//stream remote keys 500 at a time and write to local index concurrently
-	//allowing some to be oppertunisticly combined to increase performance
-	var wg sync.WaitGroup
-	repo.ForEach(pr, func(k K) error {
-		go func() {
-			err = store.Batch(func(tx *bolt.Tx) error {
-				wg.Add(1)
-				defer wg.Done()
-				b := tx.Bucket(IndexBucket)
-				err = b.Put(k[:], RemoteChunk)
-				if err != nil {
-					return fmt.Errorf("failed to put '%x': %v", k, err)
-				}
+		return fmt.Errorf("couldnt setup hook: %v", err)
+	}
 
-				repo.keyProgressCh <- KeyOp{IndexOp, k, false, 0}
-				return nil
-			})
+	defer f.Close()
+	_, err = fmt.Fprintf(f, `#!/bin/sh
+			command -v git-bits >/dev/null 2>&1 || { echo >&2 "This project was setup with git-bits but it can (no longer) be found in your PATH: $PATH."; exit 0; }
+			%s
+	`, script)
 
-			if err != nil {
-				errCh <- fmt.Errorf("failed to batch indexed remote keys: %v", err)
-			}
-		}()
+	if err != nil {
+		return fmt.Errorf("failed to git hook: %v", err)
+	}
 
-		return nil
-	})
+	return nil
+}
 
-	//wait for all concurrent batch transactions to complete
-	wg.Wait()
-	if len(errs) > 0 {
-		return fmt.Errorf("there were errors while indexing: \n %s", strings.Join(errs, "\n\t"))
+//hooksDir returns the directory git runs hooks from: '.git/hooks' unless
+//'core.hooksPath' is configured, e.g. by hook managers. Husky runs its own
+//scripts from '.husky/_' which run the project's hooks from '.husky', the
+//latter is returned in that case.
+func (repo *Repository) hooksDir() (dir string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", fmt.Errorf("failed to determine hooks directory: %v", err)
 	}
 
-	//scan for chunk keys
-	err = repo.ForEach(r, func(k K) (ferr error) {
-		err = store.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket(IndexBucket)
-			c := b.Get(k[:])
-			if c == nil {
-				return nil //doesnt exist
-			}
+	dir = strings.TrimSpace(buf.String())
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(repo.rootDir, dir)
+	}
 
-			if bytes.Equal(c, RemoteChunk) {
-				return ErrAlreadyPushed
-			}
+	if filepath.Base(dir) == "_" && filepath.Base(filepath.Dir(dir)) == ".husky" {
+		dir = filepath.Dir(dir)
+	}
 
-			return nil
-		})
+	return dir, nil
+}
 
-		//already pushed err is a good think, we can skip uploading this chunk!
-		if err == ErrAlreadyPushed {
-			repo.keyProgressCh <- KeyOp{PushOp, k, true, 0}
-			return nil
-		}
+//ForEach is a convenient method for running logic for each chunk
+//key in stream 'r', it will skip the chunk header, footer and pointer metadata
+func (repo *Repository) ForEach(r io.Reader, fn func(K) error) error {
+	return repo.forEachChunk(r, func(c PointerChunk) error { return fn(c.K) })
+}
 
+//forEachChunk is like ForEach but also hands over the size that is listed
+//with each key, -1 if it isn't
+func (repo *Repository) forEachChunk(r io.Reader, fn func(PointerChunk) error) error {
+	for c, err := range repo.chunks(r) {
 		if err != nil {
-			return fmt.Errorf("failed to read index: %v", err)
+			return err
 		}
 
-		//open local chunk file
-		p, _ := repo.Path(k, false)
-		f, err := os.OpenFile(p, os.O_RDONLY, 0666)
+		err = fn(c)
 		if err != nil {
-			return fmt.Errorf("failed to open chunk '%x' at '%s' for pushing: %v", k, p, err)
+			return fmt.Errorf("failed to handle key '%x': %v", c.K, err)
 		}
+	}
 
-		//get remote writer
-		defer f.Close()
-		wc, err := repo.remote.ChunkWriter(k)
-		if err != nil {
-			return fmt.Errorf("failed to get chunk writer: %v", err)
-		}
+	return nil
+}
 
-		//start upload
-		defer wc.Close()
-		n, err := io.Copy(wc, f)
-		if err != nil {
-			return fmt.Errorf("failed to copy file '%s' to remote writer after %d bytes: %v", f.Name(), n, err)
+//Keys returns an iterator over the chunk keys in stream 'r' that skips the
+//header, footer and metadata of pointers like ForEach does. Keys are decoded
+//without allocating, such that long listings produce no garbage. An error
+//ends the iteration.
+func (repo *Repository) Keys(r io.Reader) iter.Seq2[K, error] {
+	return func(yield func(K, error) bool) {
+		for c, err := range repo.chunks(r) {
+			if !yield(c.K, err) {
+				return
+			}
 		}
-
-		//indicate we pushed the chunk
-		repo.keyProgressCh <- KeyOp{PushOp, k, false, n}
-		return nil
-	})
-
-	if err != nil {
-		return fmt.Errorf("failed to loop over each key: %v", err)
 	}
+}
 
-	return nil
+//chunks is like Keys but yields the size that is listed with each key as
+//well, -1 if it isn't
+func (repo *Repository) chunks(r io.Reader) iter.Seq2[PointerChunk, error] {
+	return repo.routedChunks(r, nil)
 }
 
-//Fetch takes a list of chunk keys on reader 'r' and will try to fetch chunks
-//that are not yet stored locally. Chunks that are already stored locally should
-//result in a no-op, all keys (fetched or not) will be written to 'w'.
-func (repo *Repository) Fetch(r io.Reader, w io.Writer) (err error) {
-	printk := func(k K) error {
-		_, err := fmt.Fprintf(w, "%x\n", k)
-		return err
-	}
+//routedChunks is like chunks but calls 'route' with the ref that a line
+//names before the chunks that follow it are yielded, see 'bits.route'
+func (repo *Repository) routedChunks(r io.Reader, route func(ref string)) iter.Seq2[PointerChunk, error] {
+	return func(yield func(PointerChunk, error) bool) {
 
-	return repo.ForEach(r, func(k K) error {
+		//handle yields the chunk on 'line', it returns false once iterating
+		//should stop
+		handle := func(line []byte) bool {
 
-		//setup chunk path
-		p, err := repo.Path(k, true)
-		if err != nil {
-			return fmt.Errorf("failed to create chunk path for key '%x': %v", k, err)
-		}
+			//pointer metadata is not a key either
+			_, _, meta, err := parseMetaLine(line)
+			if err != nil {
+				yield(PointerChunk{}, err)
+				return false
+			}
 
-		//attempt to open, if its already assume it was written concurrently
-		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
-		if err != nil {
-			if os.IsExist(err) {
-				repo.keyProgressCh <- KeyOp{FetchOp, k, true, 0}
-				return printk(k)
+			if meta {
+				return true
 			}
 
-			return fmt.Errorf("failed to open chunk file '%s' for writing: %v", p, err)
-		}
+			//decode the actual keys
+			c, err := ParseKeyLine(line)
+			if err != nil {
+				yield(PointerChunk{}, err)
+				return false
+			}
 
-		if repo.remote == nil {
-			return fmt.Errorf("key '%x' isn't stored locally, but no remote is configured", k)
+			return yield(c, nil)
 		}
 
-		rc, err := repo.remote.ChunkReader(k)
-		if err != nil {
-			return fmt.Errorf("failed to get chunk reader for key '%x': %v", k, err)
-		}
+		//the encrypted key list of a sealed pointer is handled at its end
+		sealed := []byte{}
+		unseal := func() bool {
+			if len(sealed) == 0 {
+				return true
+			}
 
-		defer rc.Close()
-		n, err := io.Copy(f, rc)
+			plain, err := repo.openKeyList(sealed)
+			if err != nil {
+				yield(PointerChunk{}, err)
+				return false
+			}
+
+			sealed = sealed[:0]
+			ls := bufio.NewScanner(bytes.NewReader(plain))
+			for ls.Scan() {
+				if !handle(ls.Bytes()) {
+					return false
+				}
+			}
+
+			return true
+		}
+
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, MaxJSONPointerSize) //json pointers are one, long, line
+		for s.Scan() {
+			if enc, ok := sealedLine(s.Bytes()); ok {
+				sealed = append(sealed, enc...)
+				continue
+			}
+
+			if !unseal() {
+				return
+			}
+
+			//json pointers list all their chunks at once
+			if isJSONPointer(s.Bytes()) {
+				ptr, err := parseJSONPointer(s.Bytes())
+				if err != nil {
+					yield(PointerChunk{}, err)
+					return
+				}
+
+				for _, c := range ptr.Chunks {
+					if !yield(c, nil) {
+						return
+					}
+				}
+
+				continue
+			}
+
+			//and in any case skip it
+			if repo.isHeaderLine(s.Bytes()) || repo.isFooterLine(s.Bytes()) {
+				continue
+			}
+
+			if ref, ok := routeLine(s.Bytes()); ok {
+				if route != nil {
+					route(ref)
+				}
+
+				continue
+			}
+
+			if !handle(s.Bytes()) {
+				return
+			}
+		}
+
+		if err := s.Err(); err != nil {
+			yield(PointerChunk{}, fmt.Errorf("failed to scan chunk keys: %v", err))
+			return
+		}
+
+		unseal()
+	}
+}
+
+//Push takes a list of chunk keys on reader 'r' and moves each chunk from
+//the local storage to the remote store with name 'remote'. Prior to pushing
+//the local index of the remote is updated so chunks are not uploaded twice.
+//Chunks that are neither stored locally nor remotely fail the push after
+//the others are uploaded, such that they are listed together. Keys that
+//follow a line naming a ref that is routed to another bucket (see
+//'bits.route') are pushed to that bucket instead.
+func (repo *Repository) Push(store *bolt.DB, r io.Reader, remoteName string) (err error) {
+	return repo.push(context.Background(), store, r, remoteName)
+}
+
+//push pushes the keys on 'r' as part of the operation of 'ctx', see Push
+func (repo *Repository) push(ctx context.Context, store *bolt.DB, r io.Reader, remoteName string) (err error) {
+	ctx, end := repo.trace(ctx, "push", SpanAttr{"remote", remoteName})
+	defer end(&err)
+	defer repo.lendStore(store)()
+	defer repo.flushAudit(&err)
+	defer repo.flushUsage(store)
+	if repo.conf.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if repo.currentRemote() == nil {
+		return withKind(ConfigError, fmt.Errorf("unable to push, no remote configured"))
+	}
+
+	err = repo.indexRemote(ctx, store)
+	if err != nil {
+		return withKind(NetworkError, err)
+	}
+
+	//scan for chunk keys, chunks that are neither stored locally nor remotely
+	//are reported together
+	unreachable := []string{}
+	kind := UnknownError
+	shared := []chunkID{}
+	push := func(v KeyVersion, k K) (err error) {
+		id := chunkID{v, k}
+		if repo.sharing() {
+			shared = append(shared, id)
+		}
+
+		err = store.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(IndexBucket)
+			c := b.Get(id.storeKey())
+			if c == nil {
+				return nil //not known to be stored remotely
+			}
+
+			if bytes.Equal(c, RemoteChunk) {
+				return ErrAlreadyPushed
+			}
+
+			return nil
+		})
+
+		//already pushed err is a good think, we can skip uploading this chunk!
+		if err == ErrAlreadyPushed {
+			repo.progress(KeyOp{PushOp, k, true, 0})
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read index: %v", err)
+		}
+
+		local, remote, err := repo.locateChunk(v, k)
+		if err != nil {
+			return err
+		}
+
+		if !local {
+			if !remote {
+				unreachable = append(unreachable, id.String())
+				return nil
+			}
+
+			err = repo.markRemote(store, id)
+			if err != nil {
+				return err
+			}
+
+			repo.progress(KeyOp{PushOp, k, true, 0})
+			return nil
+		}
+
+		n, etag, err := repo.pushChunk(ctx, v, k)
+		if err == ErrAlreadyPushed {
+			err = repo.markRemote(store, id)
+			if err != nil {
+				return err
+			}
+
+			repo.progress(KeyOp{PushOp, k, true, 0})
+			return nil
+		}
+
+		if err != nil {
+			kind = NetworkError
+			return err
+		}
+
+		err = repo.markRemote(store, id)
+		if err != nil {
+			return err
+		}
+
+		err = repo.recordETags(store, map[chunkID]string{id: etag})
+		if err != nil {
+			return err
+		}
+
+		//indicate we pushed the chunk
+		repo.progress(KeyOp{PushOp, k, false, n})
+		return nil
+	}
+
+	//keys are pushed as they are read, those that follow a line naming a ref
+	//that is routed to a bucket are pushed there instead
+	bucket := ""
+	route := func(ref string) {
+		bucket, _ = repo.routeBucket(ref)
+	}
+
+	routedUnreachable := map[string][]string{}
+	for c, err := range repo.routedChunks(r, route) {
+		if err == nil && bucket != "" {
+			missing, err := repo.pushRouted(ctx, bucket, c)
+			if err != nil {
+				return err
+			}
+
+			if missing {
+				routedUnreachable[bucket] = append(routedUnreachable[bucket], c.id().String())
+			}
+
+			continue
+		}
+
+		if err == nil {
+			err = push(c.Version, c.K)
+			if err != nil {
+				err = fmt.Errorf("failed to handle key '%x': %v", c.K, err)
+			}
+		}
+
+		if err != nil {
+			return withKind(kind, fmt.Errorf("failed to loop over each key: %v", err))
+		}
+	}
+
+	if len(unreachable) > 0 {
+		return withKind(MissingChunkError, fmt.Errorf("%d chunks are neither stored locally nor remotely, the pushed commits would reference content that can't be fetched (was it split on another machine and never pushed?): \n %s", len(unreachable), summarizeErrors(unreachable)))
+	}
+
+	buckets := []string{}
+	for bucket := range routedUnreachable {
+		buckets = append(buckets, bucket)
+	}
+
+	sort.Strings(buckets)
+	errs := []string{}
+	for _, bucket := range buckets {
+		missing := routedUnreachable[bucket]
+		errs = append(errs, fmt.Sprintf("%d chunks of refs routed to bucket '%s' are neither stored locally nor in the bucket: \n %s", len(missing), bucket, summarizeErrors(missing)))
+	}
+
+	if len(errs) > 0 {
+		return withKind(MissingChunkError, fmt.Errorf("%s", strings.Join(errs, "\n")))
+	}
+
+	//other repositories that share the bucket must keep these chunks
+	err = repo.shareKeys(shared)
+	if err != nil {
+		return err
+	}
+
+	//all scanned chunks are stored remotely, the next scan can stop here
+	return repo.promoteWatermarks(store, remoteName)
+}
+
+//locateChunk returns whether chunk 'k' of version 'v' is stored locally
+//and, if it isn't, whether the remote stores it while the index doesn't
+//know about it yet
+func (repo *Repository) locateChunk(v KeyVersion, k K) (local, remote bool, err error) {
+	p, err := repo.chunkPath(v, k, false)
+	if err != nil {
+		return false, false, err
+	}
+
+	_, err = os.Stat(p)
+	if err == nil {
+		return true, false, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return false, false, fmt.Errorf("failed to stat chunk '%x': %v", k, err)
+	}
+
+	if haser, ok := unwrapRemote(repo.currentRemote()).(chunkHaser); ok {
+		remote, err = haser.hasChunk(v, k)
+		if err != nil {
+			return false, false, fmt.Errorf("failed to check whether the remote stores chunk '%x': %v", k, err)
+		}
+	}
+
+	return false, remote, nil
+}
+
+//PushAll pushes the chunks of split files in every local branch and tag. It
+//doesn't trust earlier records of what is stored remotely, only what the
+//remote lists, such that it can be used to seed a new remote.
+func (repo *Repository) PushAll(store *bolt.DB, remoteName string) (err error) {
+	ctx, end := repo.trace(context.Background(), "push-all", SpanAttr{"remote", remoteName})
+	defer end(&err)
+	defer repo.lendStore(store)()
+	if repo.conf.ReadOnly {
+		return ErrReadOnly
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo.scanAll(store, buf)
+	if err != nil {
+		return fmt.Errorf("failed to scan all refs: %v", err)
+	}
+
+	err = repo.flushRefs(store)
+	if err != nil {
+		return err
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(IndexBucket)
 		if err != nil {
-			return fmt.Errorf("failed to clone chunk '%x' from remote: %v", err)
+			return err
+		}
+
+		_, err = tx.CreateBucket(IndexBucket)
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to reset index: %v", err)
+	}
+
+	return repo.push(ctx, store, buf, remoteName)
+}
+
+//indexRemote asks the remote for all chunk keys it stores and records them
+//in the local index. Keys are streamed and written to the index concurrently
+//allowing some to be oppertunisticly combined to increase performance
+func (repo *Repository) indexRemote(ctx context.Context, store *bolt.DB) (err error) {
+	sp := repo.startSpan(ctx, "remote.list")
+	defer func() { sp.End(err) }()
+
+	//err handling
+	errs := []string{}
+	errCh := make(chan error)
+	errDone := make(chan struct{})
+	go func() {
+		for err := range errCh {
+			errs = append(errs, fmt.Sprintf("%v", err))
+		}
+
+		close(errDone)
+	}()
+
+	//ask the remote to fetch all chunk keys
+	nkeys := 0
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(repo.currentRemote().ListChunks(pw))
+	}()
+
+	var wg sync.WaitGroup
+	err = repo.forEachChunk(pr, func(c PointerChunk) error {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := c.id().storeKey()
+			err := store.Batch(func(tx *bolt.Tx) error {
+				b := tx.Bucket(IndexBucket)
+				err := b.Put(key, RemoteChunk)
+				if err != nil {
+					return fmt.Errorf("failed to put '%s': %v", c.id(), err)
+				}
+
+				return tx.Bucket(StagedBucket).Delete(key)
+			})
+
+			if err != nil {
+				errCh <- fmt.Errorf("failed to batch indexed remote keys: %v", err)
+				return
+			}
+
+			repo.progress(KeyOp{IndexOp, c.K, false, 0})
+		}()
+
+		nkeys++
+		return nil
+	})
+
+	sp.SetAttr("chunk.count", nkeys)
+
+	//wait for all concurrent batch transactions to complete
+	wg.Wait()
+	close(errCh)
+	<-errDone
+	if err != nil {
+		return fmt.Errorf("failed to list remote chunk keys: %v", err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("there were errors while indexing: \n %s", strings.Join(errs, "\n\t"))
+	}
+
+	return nil
+}
+
+//markRemote records in the local index that the given chunks are stored
+//remotely, such that they are no longer staged
+func (repo *Repository) markRemote(store *bolt.DB, ids ...chunkID) (err error) {
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(IndexBucket)
+		for _, id := range ids {
+			key := id.storeKey()
+			err := b.Put(key, RemoteChunk)
+			if err != nil {
+				return fmt.Errorf("failed to put '%s': %v", id, err)
+			}
+
+			err = tx.Bucket(StagedBucket).Delete(key)
+			if err != nil {
+				return fmt.Errorf("failed to unstage '%s': %v", id, err)
+			}
+
+			err = tx.Bucket(AbsentBucket).Delete(key)
+			if err != nil {
+				return fmt.Errorf("failed to forget that '%s' was absent: %v", id, err)
+			}
 		}
 
-		//indicate we fetched a key
-		repo.keyProgressCh <- KeyOp{FetchOp, k, false, n}
-		return printk(k)
+		return nil
 	})
+
+	if err != nil {
+		return fmt.Errorf("failed to update index: %v", err)
+	}
+
+	return nil
+}
+
+//recordETags stores the entity tags of pushed chunks such that they can be
+//verified against the remote later
+func (repo *Repository) recordETags(store *bolt.DB, etags map[chunkID]string) (err error) {
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ETagBucket)
+		for id, etag := range etags {
+			if etag == "" {
+				continue
+			}
+
+			err := b.Put(id.storeKey(), []byte(etag))
+			if err != nil {
+				return fmt.Errorf("failed to put '%s': %v", id, err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to record etags: %v", err)
+	}
+
+	return nil
+}
+
+//pushChunk uploads the locally stored chunk 'k' of version 'v' to the
+//remote, it returns the number of bytes that were uploaded and the entity
+//tag the remote assigned to it, if any. It returns ErrAlreadyPushed if the
+//remote turned out to store the chunk already.
+func (repo *Repository) pushChunk(ctx context.Context, v KeyVersion, k K) (n int64, etag string, err error) {
+	return repo.pushChunkTo(ctx, repo.currentRemote(), v, k)
+}
+
+//pushChunkTo is like pushChunk but uploads to 'remote'
+func (repo *Repository) pushChunkTo(ctx context.Context, remote Remote, v KeyVersion, k K) (n int64, etag string, err error) {
+
+	//open local chunk file
+	p, _ := repo.chunkPath(v, k, false)
+	f, err := os.OpenFile(p, os.O_RDONLY, 0666)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open chunk '%x' at '%s' for pushing: %v", k, p, err)
+	}
+
+	//other machines may be pushing the same chunk, only one uploads it
+	defer f.Close()
+	release, err := repo.claimUpload(v, k)
+	if err != nil {
+		return 0, "", err
+	}
+
+	//get remote writer
+	defer release()
+	if repo.conf.ReadOnly {
+		return 0, "", ErrReadOnly
+	}
+
+	//content that is refused by the hooks never leaves the machine
+	err = repo.inspectChunk(PushOp, v, k, func() (io.ReadCloser, error) { return os.Open(p) })
+	if err != nil {
+		return 0, "", err
+	}
+
+	sp := repo.startSpan(ctx, "remote.upload", SpanAttr{"chunk.key", fmt.Sprintf("%x", k)})
+	defer func() {
+		sp.SetAttr("chunk.bytes", n)
+		sp.End(err)
+	}()
+
+	t := repo.monitor.begin(PushOp, k)
+	defer func() { t.end(err) }()
+	wc, err := remoteChunkWriter(remote, v, k)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get chunk writer: %v", err)
+	}
+
+	//start upload
+	n, err = io.Copy(wc, t.reader(f))
+	if err != nil {
+		wc.Close()
+		return n, "", fmt.Errorf("failed to copy file '%s' to remote writer after %d bytes: %v", f.Name(), n, err)
+	}
+
+	//the upload only completes when the writer is closed
+	err = wc.Close()
+	if err != nil {
+		return n, "", fmt.Errorf("failed to complete upload of chunk '%x': %v", k, err)
+	}
+
+	if t, ok := wc.(interface{ ETag() string }); ok {
+		etag = t.ETag()
+	}
+
+	repo.audit("push", k, n, "")
+	repo.countTransfer(PushOp, repo.remoteName(remote), n)
+	return n, etag, nil
+}
+
+//fetchJob is handed from the key reader to the fetch workers and to the
+//writer that outputs keys, it allows keys to be written in their original
+//order while chunks are fetched concurrently
+type fetchJob struct {
+	k      K
+	v      KeyVersion
+	remote Remote
+	err    error
+	done   chan struct{}
+}
+
+//Fetch takes a list of chunk keys on reader 'r' and will try to fetch chunks
+//that are not yet stored locally. Chunks that are already stored locally should
+//result in a no-op, all keys (fetched or not) will be written to 'w'. Chunks
+//that fail to fetch don't stop the others from being fetched, they are
+//reported together and recorded such that they can be retried later. Up to
+//FetchConcurrency chunks are fetched in parallel but keys are always written
+//in the order they were read, such that the output can be combined. Keys
+//that follow a line naming a ref are fetched from the bucket that the ref
+//is routed to first (see 'bits.route').
+func (repo *Repository) Fetch(r io.Reader, w io.Writer) (err error) {
+	return repo.fetch(context.Background(), r, w)
+}
+
+//fetch fetches the keys on 'r' as part of the operation of 'ctx', see Fetch
+func (repo *Repository) fetch(ctx context.Context, r io.Reader, w io.Writer) (err error) {
+	ctx, end := repo.trace(ctx, "fetch")
+	defer end(&err)
+	defer repo.flushAudit(&err)
+	defer repo.flushUsage(nil)
+	jobs := make(chan *fetchJob, FetchConcurrency)
+	ordered := make(chan *fetchJob, FetchConcurrency*2)
+	stop := make(chan struct{})
+
+	//reader: hands each key to the writer (in order) and the workers
+	var readErr error
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+
+		remote, rerr := repo.readRemote("")
+		route := func(ref string) {
+			if rerr == nil {
+				remote, rerr = repo.readRemote(ref)
+			}
+		}
+
+		for c, err := range repo.routedChunks(r, route) {
+			if err == nil {
+				err = rerr
+			}
+
+			if err != nil {
+				readErr = err
+				return
+			}
+
+			job := &fetchJob{k: c.K, v: c.Version, remote: remote, done: make(chan struct{})}
+			select {
+			case ordered <- job:
+			case <-stop:
+				readErr = fmt.Errorf("failed to handle key '%x': fetch was stopped", c.K)
+				return
+			}
+
+			repo.monitor.queue(FetchOp, 1)
+			jobs <- job
+		}
+	}()
+
+	//workers: fetch chunks that are not stored locally
+	for i := 0; i < FetchConcurrency; i++ {
+		go func() {
+			for job := range jobs {
+				repo.monitor.queue(FetchOp, -1)
+				job.err = repo.fetchChunkFrom(ctx, job.remote, job.v, job.k)
+				close(job.done)
+			}
+		}()
+	}
+
+	//writer: output keys in the order they were read, keys of chunks that
+	//failed are written as well, such that combining fails instead of
+	//leaving out their content
+	failed := []PointerChunk{}
+	errs := []string{}
+	total := 0
+	for job := range ordered {
+		<-job.done
+		total++
+		if job.err != nil {
+			failed = append(failed, PointerChunk{K: job.k, Version: job.v})
+			errs = append(errs, job.err.Error())
+		}
+
+		_, err = fmt.Fprintf(w, "%s\n", FormatKey(job.v, job.k))
+		if err != nil {
+			close(stop)
+			return fmt.Errorf("failed to handle key '%x': %v", job.k, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		rerr := repo.recordFailedFetches(failed...)
+		if rerr != nil {
+			fmt.Fprintf(repo.output, "failed to record chunks for retrying: %v\n", rerr)
+		}
+
+		ferr := fmt.Errorf("failed to fetch %d of %d chunks, retry with 'git bits fetch --retry-failed': \n %s", len(failed), total, summarizeErrors(errs))
+		if readErr != nil {
+			//not all keys were read, which is the first thing to resolve
+			return withKind(KindOf(readErr), fmt.Errorf("%v, before that: %v", readErr, ferr))
+		}
+
+		return withKind(repo.fetchFailureKind(len(failed), total), ferr)
+	}
+
+	return readErr
+}
+
+//fetchChunk makes sure chunk 'k' of version 'v' is stored locally, it is
+//fetched from the remote if it isn't. A chunk file that couldn't be fetched
+//completely is removed again.
+func (repo *Repository) fetchChunk(ctx context.Context, v KeyVersion, k K) (err error) {
+	remote, err := repo.readRemote("")
+	if err != nil {
+		return err
+	}
+
+	return repo.fetchChunkFrom(ctx, remote, v, k)
+}
+
+//fetchChunkFrom is like fetchChunk but fetches from 'remote'
+func (repo *Repository) fetchChunkFrom(ctx context.Context, remote Remote, v KeyVersion, k K) (err error) {
+
+	//setup chunk path
+	p, err := repo.chunkPath(v, k, true)
+	if err != nil {
+		return fmt.Errorf("failed to create chunk path for key '%x': %v", k, err)
+	}
+
+	//if its already there assume it was written concurrently
+	if _, err = os.Stat(p); err == nil {
+		repo.progress(KeyOp{FetchOp, k, true, 0})
+		return nil
+	}
+
+	//other processes (e.g. smudge filters that run in parallel) that need
+	//the same chunk wait for a single download
+	unlock, fetched, err := repo.lockChunk(p)
+	if err != nil {
+		return fmt.Errorf("failed to lock chunk '%x' for fetching: %v", k, err)
+	}
+
+	if !fetched {
+		defer unlock()
+		_, err = os.Stat(p)
+		fetched = err == nil
+	}
+
+	if fetched {
+		repo.progress(KeyOp{FetchOp, k, true, 0})
+		return nil
+	}
+
+	//chunks are downloaded next to their final path and only moved there
+	//once complete, such that an interrupted download can be resumed
+	part := p + PartialChunkSuffix
+	sp := repo.startSpan(ctx, "fetch-chunk", SpanAttr{"chunk.key", fmt.Sprintf("%x", k)})
+	defer func() { sp.End(err) }()
+	t := repo.monitor.begin(FetchOp, k)
+	defer func() { t.end(err) }()
+
+	//peers on the local network are often faster then the remote
+	data, perr := repo.peerChunk(v, k)
+	if perr == nil {
+		err = repo.inspectChunk(FetchOp, v, k, func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(data)), nil })
+		if err != nil {
+			return err
+		}
+
+		t.add(int64(len(data)))
+		err = repo.writeFile(part, data)
+		if err != nil {
+			return fmt.Errorf("failed to write chunk '%x' from peer: %v", k, err)
+		}
+
+		err = os.Rename(part, p)
+		if err != nil {
+			return fmt.Errorf("failed to move chunk '%x' into place: %v", k, err)
+		}
+
+		sp.SetAttr("chunk.source", "peer")
+		sp.SetAttr("chunk.bytes", len(data))
+		repo.audit("fetch", k, int64(len(data)), "peer")
+		repo.countTransfer(FetchOp, PeerUsageName, int64(len(data)))
+		repo.progress(KeyOp{FetchOp, k, false, int64(len(data))})
+		return nil
+	}
+
+	sp.SetAttr("chunk.source", "remote")
+	if remote == nil {
+		return fmt.Errorf("key '%x' isn't stored locally, but no remote is configured", k)
+	}
+
+	//a chunk that the remote didn't store a moment ago isn't asked for again
+	if ago, ok := repo.knownAbsent(v, k); ok {
+		return withKind(MissingChunkError, fmt.Errorf("chunk '%x' isn't stored remotely, the remote confirmed %s ago and is asked again after %s ('bits.absent-ttl')", k, ago.Round(time.Second), repo.conf.AbsentTTL))
+	}
+
+	f, err := repo.openFile(part, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+	if err != nil {
+		return fmt.Errorf("failed to open chunk file '%s' for writing: %v", part, err)
+	}
+
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat chunk file '%s': %v", part, err)
+	}
+
+	//resume a partial download if the remote supports it, else start over
+	var rc io.ReadCloser
+	sp.SetAttr("chunk.offset", fi.Size())
+	if rr, ok := unwrapRemote(remote).(chunkRangeReader); ok && fi.Size() > 0 && v == KeyVersion0 {
+		repo.monitor.retry(FetchOp)
+		rc, err = rr.chunkReaderFrom(k, fi.Size())
+		if err != nil {
+			rc = nil
+		}
+	}
+
+	if rc == nil {
+		err = f.Truncate(0)
+		if err != nil {
+			return fmt.Errorf("failed to truncate chunk file '%s': %v", part, err)
+		}
+
+		//chunks in cold storage are restored first
+		rc, err = remoteChunkReader(remote, v, k)
+		if err != nil {
+			rc, err = repo.readColdChunk(remote, v, k, err)
+		}
+
+		if err != nil {
+			repo.recordAbsent(remote, v, k)
+
+			return fmt.Errorf("failed to get chunk reader for key '%x': %v", k, err)
+		}
+	}
+
+	defer rc.Close()
+	n, err := io.Copy(f, t.reader(rc))
+	sp.SetAttr("chunk.bytes", n)
+	if err != nil {
+		return fmt.Errorf("failed to clone chunk '%x' from remote, the partial download is resumed on the next fetch: %v", k, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close chunk file '%s': %v", part, err)
+	}
+
+	//a corrupt partial download is discarded, retrying starts over
+	data, err = ioutil.ReadFile(part)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk file '%s': %v", part, err)
+	}
+
+	err = verifyChunk(v, k, data)
+	if err != nil {
+		os.Remove(part)
+		return fmt.Errorf("chunk '%x' from remote is invalid: %v", k, err)
+	}
+
+	//content that is refused by the hooks is never stored
+	err = repo.inspectChunk(FetchOp, v, k, func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(data)), nil })
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	err = os.Rename(part, p)
+	if err != nil {
+		return fmt.Errorf("failed to move chunk '%x' into place: %v", k, err)
+	}
+
+	repo.audit("fetch", k, int64(len(data)), "remote")
+	repo.countTransfer(FetchOp, repo.remoteName(remote), n)
+
+	//indicate we fetched a key
+	repo.progress(KeyOp{FetchOp, k, false, n})
+	return nil
 }
 
 //Path returns the local path to the chunk file based on the key, it can
 //create required directories when 'mkdir' is set to true, in that case
-//err might container directory creation failure.
+//err might container directory creation failure. Keys are taken to be of
+//version 0, see chunkPath.
 func (repo *Repository) Path(k K, mkdir bool) (p string, err error) {
-	dir := filepath.Join(repo.chunkDir, fmt.Sprintf("%x", k[:2]))
+	return repo.chunkPath(KeyVersion0, k, mkdir)
+}
+
+//chunkPath is like Path for a key of version 'v', chunks of other versions
+//than 0 are stored in a directory of their version
+func (repo *Repository) chunkPath(v KeyVersion, k K, mkdir bool) (p string, err error) {
+	dir := filepath.Join(repo.chunkDir, v.namespace(), fmt.Sprintf("%x", k[:2]))
 	if mkdir {
-		err = os.MkdirAll(dir, 0777)
+		err = repo.mkdirAll(dir)
 		if err != nil {
 			return "", fmt.Errorf("failed to create chunk dir '%s': %v", dir, err)
 		}
@@ -530,215 +1576,309 @@ func (repo *Repository) Path(k K, mkdir bool) (p string, err error) {
 
 //LocalStore will return the local chunk store, creating it in the
 //repositories chunk directory if it doesnt exist yet. It creates
-//the necessary buckets if they dont exist yet
+//the necessary buckets if they dont exist yet. A store that is corrupted
+//is moved aside and rebuilt (see repairStore). The chunks that splitting
+//logged since it was last opened are recorded in it. The store is locked
+//while it is open, operations that are handed it (e.g. Push) share it with
+//those that run at the same time.
 func (repo *Repository) LocalStore() (db *bolt.DB, err error) {
 	dbpath := filepath.Join(repo.chunkDir, "a.chunks")
-	db, err = bolt.Open(dbpath, 0666, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		return nil, fmt.Errorf("failed to open chunks database '%s': %v", dbpath, err)
+	db, corrupt, err := repo.openStore(dbpath)
+	if corrupt {
+		db, err = repo.repairStore(dbpath, err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(IndexBucket)
-		if err != nil {
-			return fmt.Errorf("failed to create bucket: %s", err)
-		}
-		return nil
-	})
+	if err != nil {
+		return nil, err
+	}
 
+	err = repo.foldStagedLog(db)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create bucket '%s': %v", string(IndexBucket), err)
+		db.Close()
+		return nil, fmt.Errorf("failed to fold the staged log into the chunks database: %v", err)
 	}
 
 	return db, nil
 }
 
-//Pull get all file paths of blobs that hold chunk keys in the provided ref
+//Pull get all file paths of blobs that hold chunk keys in the selected refs
 //and combine the chunks in them into their original file, fetching any chunks
-//not currently available in the local store
-func (repo *Repository) Pull(ref string, w io.Writer) (err error) {
+//not currently available in the local store. Only files that the selection's
+//patterns select are pulled. Pointers are read from the trees of the refs,
+//files in the working tree are only materialized if they hold the same
+//pointer: of other files (e.g. of a ref that isn't checked out) only the
+//chunks are fetched. How many files and bytes are pulled is determined
+//first, progress is reported to PullProgressFn after each file. Each file
+//is materialized in place (see Materialize): its content is written as
+//chunks arrive in file order, if it fails the pointer is put back. Files
+//outside the sparse checkout are skipped (see PullSelection). The files
+//that were accessed most on the current branch are pulled first (see
+//RecordAccess).
+func (repo *Repository) Pull(sel PullSelection, w io.Writer) (err error) {
+	return repo.pull(context.Background(), sel, w)
+}
 
-	// ls-tree -r -l | f1 | f2 | git update-index -q --refresh --stdin
-	ctx := context.Background()
-	r1, w1 := io.Pipe()
-	r2, w2 := io.Pipe()
-	r3, w3 := io.Pipe()
+//pull pulls the selection as part of the operation of 'ctx', see Pull
+func (repo *Repository) pull(ctx context.Context, sel PullSelection, w io.Writer) (err error) {
+	refs := sel.refs()
+	ctx, end := repo.trace(ctx, "pull", SpanAttr{"ref", strings.Join(refs, " ")})
+	defer end(&err)
+	paths, ptrs, err := repo.selectedFiles(sel)
+	if err != nil {
+		return fmt.Errorf("failed to determine what to pull: %v", err)
+	}
 
+	plan, total := repo.pullPlan(paths, ptrs)
+	progress := PullProgress{Files: len(plan), TotalBytes: total}
+	inside, err := repo.sparseFilter()
+	if err != nil {
+		return err
+	}
+
+	//the files that are used most on this branch are pulled first
+	paths = append([]string{}, paths...)
+	repo.orderByAccess(paths)
+
+	//files that failed don't stop the others from being pulled
 	errs := []string{}
-	errCh := make(chan error)
-	defer close(errCh)
-	go func() {
-		for err := range errCh {
-			errs = append(errs, fmt.Sprintf("%v", err))
+	updated := bytes.NewBuffer(nil)
+	for _, p := range paths {
+		if !inside(p) {
+			continue
 		}
-	}()
 
-	go func() {
-		defer w1.Close()
-		err = repo.Git(ctx, nil, w1, "ls-tree", "-r", "-l", ref)
+		materialized, err := repo.pullFile(ctx, p, ptrs[p])
 		if err != nil {
-			//@TODO this will error if the repository is empty (no commits yet)
-			//probaly throw a warning instead
-			// errCh <- err
+			errs = append(errs, fmt.Sprintf("failed to pull '%s': %v", p, err))
+			continue
 		}
-	}()
 
-	go func() {
-		defer w2.Close()
-		s := bufio.NewScanner(r1)
-		for s.Scan() {
-
-			//@see https://git-scm.com/docs/git-ls-tree
-			//line : <mode> SP <type> SP <object> TAB <file>, we use the
-			//tab to be able to clearly seperate the file name as it may contain
-			//field seperating characters
-			tfields := bytes.SplitN(s.Bytes(), []byte("\t"), 2)
-			fields := bytes.Fields(s.Bytes())
-			if len(fields) < 5 || len(tfields) != 2 || !bytes.Equal(fields[1], []byte("blob")) {
-				continue
-			}
-
-			objSize, err := strconv.ParseInt(string(fields[3]), 10, 64)
-			if err != nil {
-				errCh <- err
-				continue
-			}
+		if materialized {
+			fmt.Fprintf(updated, "%s\n", filepath.Join(repo.rootDir, p))
+		}
 
-			//all key files have a size that is the exact multiple of
-			//33 bytes: 32 bytes hex encoded hashes with a newline character
-			if objSize%int64(hex.EncodedLen(KeySize)+1) != 0 {
-				continue
-			}
+		progress.Path = p
+		progress.File++
+		progress.FileBytes = plan[p]
+		progress.Bytes += plan[p]
+		repo.PullProgressFn(progress)
+	}
 
-			fmt.Fprintf(w2, "%s\n", tfields[1])
-		}
+	err = repo.Git(ctx, updated, nil, "update-index", "-q", "--refresh", "--stdin")
+	if err != nil {
+		return fmt.Errorf("failed to update index: %v", err)
+	}
 
-		if err = s.Err(); err != nil {
-			errCh <- err
+	//files outside the sparse checkout only have their chunks fetched
+	if sel.IgnoreSparse {
+		err = repo.fetchOutsideSparse(ctx, sel, inside, plan, &progress)
+		if err != nil {
+			return err
 		}
-	}()
+	}
 
-	go func() {
-		defer w3.Close()
-		s := bufio.NewScanner(r2)
-		for s.Scan() {
-			err = func() error {
-				fpath := filepath.Join(repo.rootDir, s.Text())
-				tmpfpath := ""
-
-				err = func() error {
-					f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0666)
-					if err != nil {
-						return err
-					}
+	if len(errs) > 0 {
+		return withKind(PartialError, fmt.Errorf("there were pulling errors: \n %s", strings.Join(errs, "\n\t")))
+	}
 
-					defer f.Close()
-					hdr := make([]byte, hex.EncodedLen(KeySize))
-					_, err = f.Read(hdr)
-					if err != nil {
-						//if we cant even read a complete header, its not gonna contain chunks
-						return nil
-					}
+	return nil
+}
 
-					offs, err := f.Seek(0, 0)
-					if err != nil || offs != 0 {
-						return fmt.Errorf("failed to seek files: %v", err)
-					}
+//pullFile materializes the file at 'p' in the working tree if it holds
+//pointer 'ptr', else only the chunks of the pointer are fetched: the file
+//doesn't exist or holds other content, e.g. that of another ref. Files
+//are never created. It returns whether the file was materialized.
+func (repo *Repository) pullFile(ctx context.Context, p string, ptr *Pointer) (materialized bool, err error) {
+	fetch := func() (bool, error) {
+		return false, repo.fetchChunks(ctx, ptr.Chunks...)
+	}
 
-					if !bytes.Equal(hdr, repo.header[:len(repo.header)-1]) {
-						return nil
-					}
+	f, err := os.OpenFile(filepath.Join(repo.rootDir, p), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return fetch()
+	}
 
-					//We know its a chunks file that needs filling
-					tmpf, err := ioutil.TempFile("", "bits_tmp_")
-					if err != nil {
-						return err
-					}
+	if err != nil {
+		return false, err
+	}
 
-					tmpfpath = tmpf.Name()
-					defer tmpf.Close()
-					fi, err := f.Stat()
-					if err != nil {
-						return fmt.Errorf("failed to stat original file for permissions: %v", err)
-					}
+	defer f.Close()
+	hdr := make([]byte, hex.EncodedLen(KeySize))
+	_, err = io.ReadFull(f, hdr)
+	if err != nil || (!repo.isHeaderLine(hdr) && !isJSONPointer(hdr)) {
+		return fetch() //shorter than a pointer or not one
+	}
 
-					//mod the tempfile as the original
-					err = os.Chmod(tmpfpath, fi.Mode())
-					if err != nil {
-						return fmt.Errorf("failed to modify temp file permissions: %v", err)
-					}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return false, fmt.Errorf("failed to seek file: %v", err)
+	}
 
-					pr, pw := io.Pipe()
-					go func() {
-						defer pw.Close()
-						err = repo.Fetch(f, pw)
-						if err != nil {
-							errCh <- err
-						}
-					}()
-
-					err = repo.Combine(pr, tmpf)
-					if err != nil {
-						return fmt.Errorf("failed to combine: %v", err)
-					}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return false, fmt.Errorf("failed to read pointer: %v", err)
+	}
 
-					return nil
-				}()
+	wt, err := repo.ReadPointer(bytes.NewReader(data))
+	if err != nil || !samePointer(wt, ptr) {
+		return fetch()
+	}
 
-				if err != nil {
-					return err
-				}
+	//the content is written into the file itself as chunks are fetched,
+	//such that it can be read before it is complete
+	err = rewriteFile(f, nil)
+	if err != nil {
+		return false, err
+	}
 
-				//no tmpfpath means we have no files to move, wer're done here
-				if tmpfpath == "" {
-					return nil
-				}
+	err = repo.materialize(ctx, bytes.NewReader(data), f)
+	if err != nil {
+		rerr := rewriteFile(f, data)
+		if rerr != nil {
+			return false, fmt.Errorf("failed to combine: %v, and failed to restore the pointer: %v", err, rerr)
+		}
 
-				err = os.Remove(fpath)
-				if err != nil {
-					return fmt.Errorf("failed to remove original file '%s': %v", fpath, err)
-				}
+		return false, fmt.Errorf("failed to combine: %v", err)
+	}
 
-				err = os.Rename(tmpfpath, fpath)
-				if err != nil {
-					return fmt.Errorf("failed to move '%s' to '%s'", tmpfpath, s.Text())
-				}
+	return true, nil
+}
 
-				fmt.Fprintf(w3, "%s\n", fpath)
-				return nil
-			}()
+//samePointer returns whether pointers 'a' and 'b' list the same chunks
+func samePointer(a, b *Pointer) bool {
+	if len(a.Chunks) != len(b.Chunks) {
+		return false
+	}
 
-			if err != nil {
-				errCh <- fmt.Errorf("failed to check file '%s' for header content: %v", err)
-			}
+	for i := range a.Chunks {
+		if a.Chunks[i].K != b.Chunks[i].K || a.Chunks[i].Version != b.Chunks[i].Version {
+			return false
 		}
-	}()
+	}
+
+	return true
+}
 
-	err = repo.Git(ctx, r3, nil, "update-index", "-q", "--refresh", "--stdin")
+//rewriteFile truncates file 'f' and writes 'data' to it
+func rewriteFile(f *os.File, data []byte) (err error) {
+	err = f.Truncate(0)
 	if err != nil {
-		return fmt.Errorf("failed to update index: %v", err)
+		return fmt.Errorf("failed to truncate '%s': %v", f.Name(), err)
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("there were scanning errors: \n %s", strings.Join(errs, "\n\t"))
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek '%s': %v", f.Name(), err)
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write '%s': %v", f.Name(), err)
 	}
 
 	return nil
 }
 
-func (repo *Repository) ScanEach(r io.Reader, w io.Writer) (err error) {
+//ZeroSHA is reported by git for the missing side of a ref that is created or deleted
+const ZeroSHA = "0000000000000000000000000000000000000000"
+
+//pushedRef is a ref update as reported to the pre-push hook
+//@see https://git-scm.com/docs/githooks#_pre_push
+//line: <local ref> SP <local sha1> SP <remote ref> SP <remote sha1> LF
+type pushedRef struct {
+	localRef  string
+	localSHA  string
+	remoteRef string
+	remoteSHA string
+}
+
+//parsePushedRef parses the fields of a pre-push hook line
+func parsePushedRef(fields [][]byte) (p pushedRef, err error) {
+	if len(fields) != 4 {
+		return p, fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+
+	p = pushedRef{string(fields[0]), string(fields[1]), string(fields[2]), string(fields[3])}
+	for _, sha := range []string{p.localSHA, p.remoteSHA} {
+		if len(sha) != len(ZeroSHA) || strings.Trim(sha, "0123456789abcdef") != "" {
+			return p, fmt.Errorf("invalid object name '%s'", sha)
+		}
+	}
+
+	return p, nil
+}
+
+//deleted returns whether the remote ref is deleted by the push
+func (p pushedRef) deleted() bool { return p.localSHA == ZeroSHA }
+
+//created returns whether the remote ref is created by the push
+func (p pushedRef) created() bool { return p.remoteSHA == ZeroSHA }
+
+//ScanEach scans the commits that are pushed to the remote for keys, the
+//commits are read from 'r' in the format of the pre-push hook or as refs.
+//For the hook only the commits that the remote doesn't have are scanned:
+//deleted and excluded refs are skipped and commits of the remote's refs, as last
+//fetched, are not traversed. Unless 'full' is set, scanning also stops at
+//commits that were pushed to the remote before, the scanned commits become
+//such watermarks once the push completes. Keys of all lines are written
+//once, after every line was scanned. Keys of refs that are routed to
+//another bucket (see 'bits.route') are written after a line that names the
+//ref, such that Push uploads them there.
+func (repo *Repository) ScanEach(r io.Reader, w io.Writer, remote string, full bool) (err error) {
+	_, end := repo.trace(context.Background(), "scan", SpanAttr{"remote", remote}, SpanAttr{"full", full})
+	defer end(&err)
+	excludes := []string{}
+	if !full {
+		err = repo.withStore(func(store *bolt.DB) (err error) {
+			excludes, err = repo.watermarks(store, remote)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	var remoteHeads []string
+	pending := map[string]string{}
+	keys := bytes.NewBuffer(nil)
+	routed := map[string]*bytes.Buffer{}
+	routedRefs := []string{}
 	s := bufio.NewScanner(r)
 	for s.Scan() {
 		fields := bytes.Fields(s.Bytes())
 		left := ""
 		right := ""
+		ref := ""
+		exclude := append([]string{}, excludes...)
 
 		switch len(fields) {
 		case 4: //push hook format
-			right = string(fields[1])
-			left = string(fields[3])
-			if left == "0000000000000000000000000000000000000000" {
-				left = ""
+			pushed, err := parsePushedRef(fields)
+			if err != nil {
+				return fmt.Errorf("unexpected push hook input '%s': %v", s.Text(), err)
+			}
+
+			//deleting a ref doesn't upload anything
+			if pushed.deleted() || repo.scanExcluded(pushed.localRef) || repo.scanExcluded(pushed.remoteRef) {
+				continue
+			}
+
+			if remoteHeads == nil {
+				remoteHeads, err = repo.remoteHeads(remote)
+				if err != nil {
+					return err
+				}
+			}
+
+			//the remote's commit may be unknown locally, it is excluded like
+			//the others such that it is ignored when missing
+			right = pushed.localSHA
+			ref = pushed.remoteRef
+			pending[pushed.remoteRef] = right
+			exclude = append(exclude, remoteHeads...)
+			if !pushed.created() {
+				exclude = append(exclude, pushed.remoteSHA)
 			}
 		case 1: //scan refs (left empty)
 			right = string(fields[0])
@@ -749,24 +1889,297 @@ func (repo *Repository) ScanEach(r io.Reader, w io.Writer) (err error) {
 			return fmt.Errorf("unexpected input for scanning: %s", s.Text())
 		}
 
-		return repo.Scan(left, right, w)
+		if len(fields) < 4 && repo.scanExcluded(right) {
+			continue
+		}
+
+		if len(fields) < 4 {
+			ref = right
+		}
+
+		out := keys
+		if _, ok := repo.routeBucket(ref); ok {
+			if routed[ref] == nil {
+				routed[ref] = bytes.NewBuffer(nil)
+				routedRefs = append(routedRefs, ref)
+			}
+
+			out = routed[ref]
+		}
+
+		err = repo.Scan(left, right, out, exclude...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return fmt.Errorf("failed to read scan input: %v", err)
+	}
+
+	//refs often share history, each key is written once
+	writeKeys := func(keys *bytes.Buffer) {
+		seen := map[string]struct{}{}
+		for _, k := range strings.Fields(keys.String()) {
+			if _, ok := seen[k]; ok {
+				continue
+			}
+
+			seen[k] = struct{}{}
+			fmt.Fprintf(w, "%s\n", k)
+		}
+	}
+
+	writeKeys(keys)
+	for _, ref := range routedRefs {
+		fmt.Fprintf(w, "%s%s\n", routeLinePrefix, ref)
+		writeKeys(routed[ref])
+	}
+
+	return repo.withStore(func(store *bolt.DB) error {
+		err := repo.flushRefs(store)
+		if err != nil || len(pending) == 0 {
+			return err
+		}
+
+		return repo.recordPendingWatermarks(store, remote, pending)
+	})
+}
+
+//remoteHeads returns the commits of the remote tracking refs of 'remote'
+func (repo *Repository) remoteHeads(remote string) (commits []string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "for-each-ref", "--format=%(objectname)", "refs/remotes/"+remote+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs of remote '%s': %v", remote, err)
+	}
+
+	return strings.Fields(buf.String()), nil
+}
+
+//Scan will traverse git objects between commit 'left' and 'right', it will
+//look for blobs larger then 32 bytes that are also in the clean log. These
+//blobs should contain keys that are written to writer 'w'. Commits reachable
+//from 'excludes' are not traversed, excludes that don't exist are ignored.
+func (repo *Repository) Scan(left, right string, w io.Writer, excludes ...string) (err error) {
+	_, end := repo.trace(context.Background(), "scan-range", SpanAttr{"left", left}, SpanAttr{"right", right})
+	defer end(&err)
+	revs := []string{right}
+	if left != "" {
+		revs = append(revs, "^"+left)
+	}
+
+	if len(excludes) > 0 {
+		revs = append(revs, "--ignore-missing")
+		for _, ex := range excludes {
+			revs = append(revs, "^"+ex)
+		}
+	}
+
+	return repo.scanRevs(nil, revs, w)
+}
+
+//ScanRevs writes the keys of the chunks that are introduced by the commits
+//that git rev-list selects with 'revs' (e.g. 'v1.0..v2.0', '--all' or
+//'--author=<name>'), excluding the history of the refs in 'not'. With
+//'since' (e.g. '2024-07-01' or '3 months ago') only commits after that
+//date are scanned and files that the commits before it already held are
+//not reported, such that the keys of chunks that were introduced since
+//then are written.
+func (repo *Repository) ScanRevs(revs []string, since string, not []string, w io.Writer) (err error) {
+	_, end := repo.trace(context.Background(), "scan-revs", SpanAttr{"revs", strings.Join(revs, " ")}, SpanAttr{"since", since})
+	defer end(&err)
+
+	//specialty branches are left out of options such as --all
+	args := []string{"--exclude=*/" + ChunkIndexBranch, "--exclude=*" + RemoteBranchSuffix}
+	for _, ref := range not {
+		args = append(args, "^"+ref)
+	}
+
+	//the commits just before the date are excluded such that the files
+	//they hold are not reported by the commits after it
+	if since != "" {
+		buf := bytes.NewBuffer(nil)
+		err = repo.Git(context.Background(), nil, buf, append(append([]string{"rev-list", "--boundary", "--since=" + since}, args...), revs...)...)
+		if err != nil {
+			return fmt.Errorf("failed to list commits since '%s': %v", since, err)
+		}
+
+		for _, line := range strings.Fields(buf.String()) {
+			if strings.HasPrefix(line, "-") {
+				args = append(args, "^"+strings.TrimPrefix(line, "-"))
+			}
+		}
+
+		args = append(args, "--since="+since)
+	}
+
+	err = repo.scanRevs(nil, append(args, revs...), w)
+	if err != nil {
+		return err
+	}
+
+	return repo.withStore(repo.flushRefs)
+}
+
+//ScanAll scans the history of every local branch and tag for keys, except
+//those of excluded refs
+func (repo *Repository) ScanAll(w io.Writer) (err error) {
+	return repo.scanAll(nil, w)
+}
+
+//scanAll scans every local branch and tag, with the local store opened if
+//'store' is nil
+func (repo *Repository) scanAll(store *bolt.DB, w io.Writer) (err error) {
+	_, end := repo.trace(context.Background(), "scan-all")
+	defer end(&err)
+	revs, err := repo.ScanRefs()
+	if err != nil {
+		return err
+	}
+
+	if len(revs) == 0 {
+		return nil
+	}
+
+	return repo.scanRevs(store, revs, w)
+}
+
+//ScanRefs returns the commits of every local branch and tag that is
+//scanned, excluded refs are left out
+func (repo *Repository) ScanRefs() (revs []string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads/", "refs/tags/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %v", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || repo.scanExcluded(fields[1]) {
+			continue
+		}
+
+		revs = append(revs, fields[0])
+	}
+
+	return revs, nil
+}
+
+//scanExcluded returns whether the ref is never scanned for keys: the
+//specialty branches of git-bits and refs that match a configured pattern
+func (repo *Repository) scanExcluded(ref string) bool {
+	if path.Base(ref) == ChunkIndexBranch || strings.HasSuffix(ref, RemoteBranchSuffix) {
+		return true
+	}
+
+	if repo.conf == nil {
+		return false
+	}
+
+	for _, pattern := range repo.conf.ScanExclude {
+		if ok, _ := path.Match(pattern, ref); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+//scanRevs writes the keys in the pointer blobs that the commits selected by
+//rev-list arguments 'revs' introduce. What each commit introduces is kept
+//in the local store (see commitBlobs), it is opened if 'store' is nil.
+func (repo *Repository) scanRevs(store *bolt.DB, revs []string, w io.Writer) (err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, append([]string{"rev-list"}, revs...)...)
+	if err != nil {
+		return fmt.Errorf("failed to list commits: %v", err)
+	}
+
+	commits := strings.Fields(buf.String())
+	introduced, err := repo.commitBlobs(store, commits)
+	if err != nil {
+		return err
+	}
+
+	//the blobs are read in the order of the commits, each once
+	list := bytes.NewBuffer(nil)
+	seen := map[string]bool{}
+	for _, commit := range commits {
+		for _, b := range introduced[commit] {
+			if !seen[b.Blob] {
+				seen[b.Blob] = true
+				fmt.Fprintf(list, "%s %s\n", b.Blob, b.Path)
+			}
+		}
+	}
+
+	scanned := map[chunkID]struct{}{}
+	refs := map[string][]chunkID{}
+	err = repo.catBlobs(func(w io.Writer) error {
+		_, err := io.Copy(w, list)
+		return err
+	}, func(blob, path string, content io.Reader) error {
+
+		//output each key on a new line, but only if we didn't output it before
+		err := repo.forEachChunk(content, func(c PointerChunk) error {
+			id := c.id()
+			refs[blob] = append(refs[blob], id)
+			if _, ok := scanned[id]; !ok {
+				fmt.Fprintf(w, "%s\n", id)
+				scanned[id] = struct{}{}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to parse key blob: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	repo.refsMu.Lock()
+	defer repo.refsMu.Unlock()
+	if repo.scannedRefs == nil {
+		repo.scannedRefs = map[string][]chunkID{}
+	}
+
+	for blob, ks := range refs {
+		repo.scannedRefs[blob] = ks
 	}
 
-	return s.Err()
+	return nil
 }
 
-//Scan will traverse git objects between commit 'left' and 'right', it will
-//look for blobs larger then 32 bytes that are also in the clean log. These
-//blobs should contain keys that are written to writer 'w'
-func (repo *Repository) Scan(left, right string, w io.Writer) (err error) {
+//scanBlobs calls 'fn' with the content of each blob that starts with the
+//pointer header in the commits selected by rev-list arguments 'revs'. Each
+//blob is passed once, with the first path rev-list reports for it.
+func (repo *Repository) scanBlobs(revs []string, fn func(blob, path string, content io.Reader) error) (err error) {
+	return repo.catBlobs(func(w io.Writer) error {
+		return repo.Git(context.Background(), nil, w, append([]string{"rev-list", "--objects"}, revs...)...)
+	}, fn)
+}
+
+//catBlobs calls 'fn' with the content of each blob that starts with the
+//pointer header of the objects that 'list' writes as '<object> <path>'
+//lines, in the order they are listed.
+func (repo *Repository) catBlobs(list func(w io.Writer) error, fn func(blob, path string, content io.Reader) error) (err error) {
 
-	// rev-list --objects <right> ^<left> | f1 | cat-file --batch-check | f2 | cat-file --batch | f3
+	// list | cat-file --batch-check | f1 | cat-file --batch | fn
+	//the path that is listed after each object is passed along by cat-file
+	//as the %(rest) of the line
 	ctx := context.Background()
+	format := "%(objectname) %(objecttype) %(objectsize) %(rest)"
 	r1, w1 := io.Pipe()
 	r2, w2 := io.Pipe()
 	r3, w3 := io.Pipe()
 	r4, w4 := io.Pipe()
-	r5, w5 := io.Pipe()
 
 	errs := []string{}
 	errCh := make(chan error)
@@ -779,12 +2192,7 @@ func (repo *Repository) Scan(left, right string, w io.Writer) (err error) {
 
 	go func() {
 		defer w1.Close()
-		args := []string{"rev-list", "--objects", right}
-		if left != "" {
-			args = append(args, "^"+left)
-		}
-
-		err = repo.Git(ctx, nil, w1, args...)
+		err := list(w1)
 		if err != nil {
 			errCh <- err
 		}
@@ -792,95 +2200,102 @@ func (repo *Repository) Scan(left, right string, w io.Writer) (err error) {
 
 	go func() {
 		defer w2.Close()
-		s := bufio.NewScanner(r1)
-		for s.Scan() {
-			fields := bytes.Fields(s.Bytes())
-			if len(fields) < 1 {
-				continue
-			}
-
-			fmt.Fprintf(w2, "%s\n", fields[0])
-		}
-
-		if err = s.Err(); err != nil {
-			errCh <- err
-		}
-	}()
-
-	go func() {
-		defer w3.Close()
-		err = repo.Git(ctx, r2, w3, "cat-file", "--batch-check")
+		err := repo.Git(ctx, r1, w2, "cat-file", "--batch-check="+format)
 		if err != nil {
 			errCh <- err
 		}
 	}()
 
 	go func() {
-		defer w4.Close()
-		s := bufio.NewScanner(r3)
+		defer w3.Close()
+		s := bufio.NewScanner(r2)
 		for s.Scan() {
-			fields := bytes.Fields(s.Bytes())
+			fields := strings.SplitN(s.Text(), " ", 4)
 
 			//dont consider non-blobs
-			if len(fields) < 3 || !bytes.Equal(fields[1], []byte("blob")) {
+			if len(fields) < 3 || fields[1] != "blob" {
 				continue
 			}
 
 			//parse object size for filtering by blob size
-			objSize, err := strconv.ParseInt(string(fields[2]), 10, 64)
+			objSize, err := strconv.ParseInt(fields[2], 10, 64)
 			if err != nil {
 				errCh <- err
 				continue
 			}
 
-			//all key files have a size that is the exact multiple of
-			//33 bytes: 32 bytes hex encoded hashes with a newline character
-			if objSize%int64(hex.EncodedLen(KeySize)+1) != 0 {
+			//key files hold at least a header and a footer
+			if objSize < int64(len(repo.header)+len(repo.footer)) {
 				continue
 			}
 
-			fmt.Fprintf(w4, "%s\n", string(fields[0]))
+			rest := ""
+			if len(fields) > 3 {
+				rest = fields[3]
+			}
+
+			fmt.Fprintf(w3, "%s %s\n", fields[0], rest)
 		}
 
-		if err = s.Err(); err != nil {
+		if err := s.Err(); err != nil {
 			errCh <- err
 		}
 	}()
 
 	go func() {
-		defer w5.Close()
-		err = repo.Git(ctx, r4, w5, "cat-file", "--batch")
+		defer w4.Close()
+		err := repo.Git(ctx, r3, w4, "cat-file", "--batch="+format)
 		if err != nil {
 			errCh <- err
 		}
 	}()
 
-	scanned := map[string]struct{}{}
-	recording := false
-	s := bufio.NewScanner(r5)
-	for s.Scan() {
-		if bytes.Equal(s.Bytes(), repo.header[:len(repo.header)-1]) {
-			recording = true
-			continue
+	//each blob is preceded by a '<blob> blob <size> <path>' line, only the
+	//content of blobs that start with a header is read
+	br := bufio.NewReader(r4)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			break
 		}
 
-		if bytes.Equal(s.Bytes(), repo.footer[:len(repo.footer)-1]) {
-			recording = false
-			continue
+		if err != nil {
+			return fmt.Errorf("failed to scan key blobs: %v", err)
+		}
+
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+		if len(fields) < 3 || fields[1] != "blob" {
+			continue //missing object
+		}
+
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected blob description '%s': %v", strings.TrimSpace(line), err)
+		}
+
+		path := ""
+		if len(fields) > 3 {
+			path = strings.TrimSpace(fields[3])
 		}
 
-		//if we found keys, output each key on a new line
-		//but only if we didn't output it before
-		if recording {
-			if _, ok := scanned[s.Text()]; !ok {
-				fmt.Fprintf(w, "%s\n", s.Text())
-				scanned[s.Text()] = struct{}{}
+		content := io.LimitReader(br, size)
+		hdr, _ := br.Peek(len(repo.header))
+		if repo.hasHeader(hdr) {
+			err = fn(fields[0], path, content)
+			if err != nil {
+				return err
 			}
 		}
-	}
 
-	if err = s.Err(); err != nil {
-		return fmt.Errorf("failed to scan key blobs: %v", err)
+		//skip what is left of the blob and the newline that follows it
+		_, err = io.Copy(ioutil.Discard, content)
+		if err == nil {
+			_, err = br.Discard(1)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to scan key blobs: %v", err)
+		}
 	}
 
 	if len(errs) > 0 {
@@ -890,19 +2305,35 @@ func (repo *Repository) Scan(left, right string, w io.Writer) (err error) {
 	return nil
 }
 
+//splitJob is handed from the chunker to the staging workers and to the
+//writer that outputs keys, it allows keys to be written in file order
+//while chunks are hashed and encrypted concurrently
+type splitJob struct {
+	buf  []byte
+	data []byte
+	k    K
+	err  error
+	done chan struct{}
+}
+
 //Split turns a plain bytes from 'r' into encrypted, deduplicated and persisted chunks
 //while outputting keys for those chunks on writer 'w'. Chunks are written to a local chunk
-//space, pushing these to a remote store happens at a later time (pre-push hook)
+//space, pushing these to a remote store happens at a later time (pre-push hook). Splitting
+//happens in a pipeline: the chunker streams chunks to multiple workers that hash, encrypt
+//and write them concurrently while keys are still written to 'w' in the original file order
 func (repo *Repository) Split(r io.Reader, w io.Writer) (err error) {
+	_, end := repo.trace(context.Background(), "split")
+	defer end(&err)
 	if repo.conf.DeduplicationScope == 0 {
-		return fmt.Errorf("no deduplication scope configured, please run init", err)
+		return fmt.Errorf("no deduplication scope configured, please run init")
 	}
 
 	//create a buffer that allows us to peek if this is a file that
-	//is already spit, if so: simply copy over the bytes, nothing to split
-	bufr := bufio.NewReader(r)
+	//is already spit, if so: simply copy over the bytes, nothing to split.
+	//It holds enough to tell whether the content is small text.
+	bufr := bufio.NewReaderSize(r, SmallTextSize)
 	hdr, _ := bufr.Peek(hex.EncodedLen(KeySize) + 1)
-	if bytes.Equal(hdr, repo.header) {
+	if repo.hasHeader(hdr) {
 		_, err := io.Copy(w, bufr)
 		if err != nil {
 			return fmt.Errorf("failed to copy already chunked file content: %v", err)
@@ -911,128 +2342,501 @@ func (repo *Repository) Split(r io.Reader, w io.Writer) (err error) {
 		return nil
 	}
 
+	err = repo.checkText(bufr)
+	if err != nil {
+		return err
+	}
+
 	//it is a feel that needs splitting, start
-	//writing header and footer
-	w.Write(repo.header)
-	defer w.Write(repo.footer)
+	//writing the pointer header
+	ptr := bytes.NewBuffer(nil)
+	fw := newFlushWriter(w, SplitFlushInterval)
+	pw, err := repo.newPointerWriter(io.MultiWriter(fw, ptr), repo.conf.KeyHash)
+	if err != nil {
+		return err
+	}
+
+	ids := []chunkID{}
+	err = repo.splitChunks(bufr, true, func(k K, size int64) error {
+		ids = append(ids, chunkID{CurrentKeyVersion, k})
+		return pw.writeChunk(CurrentKeyVersion, k, size)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = pw.Close()
+	if err != nil {
+		return err
+	}
+
+	err = fw.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write pointer: %v", err)
+	}
+
+	//the pointer is stored by git as a blob that references the chunks
+	blob, err := repo.blobID(ptr.Bytes())
+	if err != nil {
+		return err
+	}
+
+	//another process may hold the local store, the chunks are logged such
+	//that it is folded in when it is opened next
+	return repo.logStaged(blob, ids)
+}
+
+//flusher is implemented by writers that buffer what is written to them
+type flusher interface {
+	Flush() error
+}
+
+//flushWriter buffers what is written to it and flushes it at most every
+//interval, writers it writes to that buffer themselves are flushed along
+type flushWriter struct {
+	bw       *bufio.Writer
+	w        io.Writer
+	interval time.Duration
+	last     time.Time
+}
+
+//newFlushWriter buffers writes to 'w' for up to 'interval'
+func newFlushWriter(w io.Writer, interval time.Duration) *flushWriter {
+	return &flushWriter{bw: bufio.NewWriter(w), w: w, interval: interval, last: time.Now()}
+}
+
+func (fw *flushWriter) Write(p []byte) (n int, err error) {
+	n, err = fw.bw.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if time.Since(fw.last) >= fw.interval {
+		err = fw.Flush()
+	}
+
+	return n, err
+}
+
+//Flush writes what is buffered to the underlying writer and flushes it
+func (fw *flushWriter) Flush() (err error) {
+	fw.last = time.Now()
+	err = fw.bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if f, ok := fw.w.(flusher); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+//Describe returns a pointer for the content read from 'r' without storing any
+//chunks. If the content is a pointer already it is simply parsed.
+func (repo *Repository) Describe(r io.Reader) (ptr *Pointer, err error) {
+	if repo.conf.DeduplicationScope == 0 {
+		return nil, fmt.Errorf("no deduplication scope configured, please run init")
+	}
+
+	bufr := bufio.NewReader(r)
+	hdr, _ := bufr.Peek(hex.EncodedLen(KeySize) + 1)
+	if repo.hasHeader(hdr) {
+		return repo.ReadPointer(bufr)
+	}
+
+	ptr = &Pointer{Version: PointerVersion, KeyHash: repo.conf.KeyHash, FileSize: 0}
+	err = repo.splitChunks(bufr, false, func(k K, size int64) error {
+		ptr.Chunks = append(ptr.Chunks, PointerChunk{K: k, Size: size})
+		ptr.FileSize += size
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ptr, nil
+}
+
+//splitChunks runs the pipeline that splits the content of 'r' into chunks:
+//the chunker streams chunks to multiple workers that hash them and, if 'store'
+//is true, encrypt and write them to the local chunk space. Function 'fn' is
+//called with the key and size of each chunk in the original file order
+func (repo *Repository) splitChunks(r io.Reader, store bool, fn func(K, int64) error) (err error) {
+	//chunk buffers are recycled once the writer is done with them. Chunks
+	//wait for the writer in the ordered channel, while it hands one over
+	//the chunker fills the next: no more than 2*SplitConcurrency+2 buffers
+	//are in memory at once. Configurations that were not read from git have
+	//no size set.
+	size := repo.conf.ChunkBufferSize
+	if size < chunker.MaxSize {
+		size = ChunkBufferSize
+	}
+
+	limit := SplitConcurrency*2 + 2
+	free := make(chan []byte, limit)
+	for i := 0; i < limit; i++ {
+		free <- nil //allocated when first needed
+	}
+
+	//putting a buffer back never blocks, no more buffers exist than fit
+	put := func(buf []byte) { free <- buf }
+	jobs := make(chan *splitJob, SplitConcurrency)
+	ordered := make(chan *splitJob, SplitConcurrency*2)
+	stop := make(chan struct{})
+
+	//next fills a free buffer with the next chunk, the buffer is put back
+	//unless a job took it over. It returns nil at the end of the content
+	//or once the writer stopped.
+	chunkr := chunker.New(r, chunker.Pol(repo.conf.DeduplicationScope))
+	next := func() (job *splitJob, err error) {
+		var buf []byte
+		select {
+		case buf = <-free:
+		case <-stop:
+			return nil, nil
+		}
+
+		if buf == nil {
+			buf = make([]byte, size)
+		}
+
+		defer func() {
+			if job == nil {
+				put(buf)
+			}
+		}()
 
-	//write actual chunks
-	chunkr := chunker.New(bufr, chunker.Pol(repo.conf.DeduplicationScope))
-	buf := make([]byte, ChunkBufferSize)
-	for {
 		chunk, err := chunkr.Next(buf)
 		if err == io.EOF {
-			break
+			return nil, nil
 		}
 
 		if err != nil {
-			return fmt.Errorf("Failed to write chunk (%d bytes) to buffer (size %d bytes): %v", chunk.Length, ChunkBufferSize, err)
+			return nil, fmt.Errorf("Failed to write chunk (%d bytes) to buffer (size %d bytes): %v", chunk.Length, size, err)
 		}
 
-		//@TODO use hmac(SHA256) with the deduplication scope as a key
-		k := sha256.Sum256(chunk.Data)
-		printk := func(k K) error {
-			_, err = fmt.Fprintf(w, "%x\n", k)
-			if err != nil {
-				return fmt.Errorf("failed to write key to output: %v", err)
+		return &splitJob{buf: buf, data: chunk.Data, done: make(chan struct{})}, nil
+	}
+
+	//chunker: hands each chunk to the writer (in order) and the workers
+	var chunkErr error
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+		for {
+			job, err := next()
+			if job == nil {
+				chunkErr = err
+				return
 			}
 
-			return nil
+			select {
+			case ordered <- job:
+			case <-stop:
+				return
+			}
+
+			jobs <- job
 		}
+	}()
 
-		err = func() error {
+	//workers: hash, encrypt and write chunks to the local chunk space
+	for i := 0; i < SplitConcurrency; i++ {
+		go func() {
+			for job := range jobs {
+				//@TODO use hmac(SHA256) with the deduplication scope as a key
+				job.k = repo.conf.KeyHash.Sum(job.data)
+				if store {
+					job.err = repo.stage(job.k, job.data)
+				}
 
-			//formulate path
-			p, err := repo.Path(k, true)
-			if err != nil {
-				return fmt.Errorf("failed to create chunk dir for '%x': %v", k, err)
+				close(job.done)
 			}
+		}()
+	}
 
-			//attempt to open, create if nont existing
-			f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
-			if err != nil {
+	//writer: hand over keys (and chunk sizes) in the order the chunker
+	//produced them, the buffer of each is put back once it is handled
+	write := func(job *splitJob) error {
+		<-job.done
+		defer put(job.buf)
+		if job.err != nil {
+			return fmt.Errorf("Failed to split chunk '%x': %v", job.k, job.err)
+		}
 
-				//if its already written, all good; output key
-				if os.IsExist(err) {
-					repo.keyProgressCh <- KeyOp{StageOp, k, true, 0}
-					return printk(k)
-				}
+		return fn(job.k, int64(len(job.data)))
+	}
 
-				return fmt.Errorf("Failed to open chunk file '%s' for writing: %v", p, err)
-			}
+	for job := range ordered {
+		err = write(job)
+		if err != nil {
+			close(stop)
+			return err
+		}
+	}
 
-			//aes encryption with
-			block, err := aes.NewCipher(k[:])
-			if err != nil {
-				return fmt.Errorf("failed to create cipher for key '%x': %v", k, err)
-			}
+	return chunkErr
+}
 
-			//create encrypt writer
-			//@TODO use GCM cipher mode
-			//@TODO	If the key is unique for each ciphertext, then it's ok to use a zero IV.
-			defer f.Close()
-			var iv [aes.BlockSize]byte
-			stream := cipher.NewOFB(block, iv[:])
-			encryptw := &cipher.StreamWriter{S: stream, W: f}
+//stage encrypts chunk 'data' with key 'k' and writes it to the local chunk
+//space, chunks that were staged before are skipped
+func (repo *Repository) stage(k K, data []byte) (err error) {
 
-			//encrypt and write to file
-			n, err := encryptw.Write(chunk.Data)
-			if err != nil {
-				return fmt.Errorf("Failed to write chunk '%x' (wrote %d bytes): %v", k, n, err)
-			}
+	//formulate path, chunks are written with the current key version
+	v := CurrentKeyVersion
+	p, err := repo.chunkPath(v, k, true)
+	if err != nil {
+		return fmt.Errorf("failed to create chunk dir for '%x': %v", k, err)
+	}
 
-			//report staging and output key
-			repo.keyProgressCh <- KeyOp{StageOp, k, false, int64(n)}
-			return printk(k)
-		}()
+	//attempt to open, create if nont existing
+	f, err := repo.openFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+	if err != nil {
 
-		if err != nil {
-			return fmt.Errorf("Failed to split chunk '%x': %v", k, err)
+		//if its already written, all good. It is used again so it must
+		//not be garbage collected meanwhile
+		if os.IsExist(err) {
+			touchChunk(p)
+			repo.progress(KeyOp{StageOp, k, true, 0})
+			return nil
 		}
+
+		return fmt.Errorf("Failed to open chunk file '%s' for writing: %v", p, err)
+	}
+
+	//encrypt as the key version does
+	defer f.Close()
+	stream, err := v.stream(k)
+	if err != nil {
+		return err
+	}
+
+	encryptw := &cipher.StreamWriter{S: stream, W: f}
+
+	//encrypt and write to file
+	n, err := encryptw.Write(data)
+	if err != nil {
+		return fmt.Errorf("Failed to write chunk '%x' (wrote %d bytes): %v", k, n, err)
 	}
 
+	//report staging
+	repo.progress(KeyOp{StageOp, k, false, int64(n)})
 	return nil
 }
 
 //Combine turns a newline seperated list of chunk keys from 'r' by reading the the
 //projects local store. Chunks are then decrypted and combined in the original
-//file and written to writer 'w'
+//file and written to writer 'w'. If 'w' is a regular file and the pointer
+//records the size of each chunk, the file is preallocated and chunks are
+//written at their offset in parallel.
 func (repo *Repository) Combine(r io.Reader, w io.Writer) (err error) {
-	err = repo.ForEach(r, func(k K) error {
+	if t, ok := parallelTarget(w); ok {
+		r, err = repo.combineParallel(r, t)
+		if r == nil || err != nil {
+			return err
+		}
+	}
+
+	kind := UnknownError
+	write := func(c PointerChunk) error {
 
-		//open chunk file
-		p, _ := repo.Path(k, false)
-		f, err := os.OpenFile(p, os.O_RDONLY, 0666)
+		//open chunk for decryption, as the version of its key requires
+		rc, err := repo.chunkReader(c.Version, c.K)
 		if err != nil {
-			return fmt.Errorf("failed to open chunk '%x' locally at '%s': %v", k, p, err)
+			kind = KindOf(err)
+			return err
 		}
 
-		//setup aes cipher
-		block, err := aes.NewCipher(k[:])
+		//copy chunk bytes to output
+		defer rc.Close()
+		n, err := io.Copy(w, rc)
 		if err != nil {
-			return fmt.Errorf("failed to create cipher: %v", err)
+			return fmt.Errorf("failed to copy chunk '%x' content after %d bytes: %v", c.K, n, err)
 		}
 
-		//setup the read stream
-		//@TODO use GCM cipher mode
-		//@TODO	If the key is unique for each ciphertext, then it's ok to use a zero IV.
-		var iv [aes.BlockSize]byte
-		stream := cipher.NewOFB(block, iv[:])
-		decryptr := &cipher.StreamReader{S: stream, R: f}
+		return nil
+	}
+
+	for c, err := range repo.chunks(r) {
+		if err == nil {
+			err = write(c)
+			if err != nil {
+				err = fmt.Errorf("failed to handle key '%x': %v", c.K, err)
+			}
+		}
 
-		//copy chunk bytes to output
-		defer f.Close()
-		n, err := io.Copy(w, decryptr)
 		if err != nil {
-			return fmt.Errorf("failed to copy chunk '%x' content after %d bytes: %v", k, n, err)
+			return withKind(kind, fmt.Errorf("failed to loop over keys: %v", err))
 		}
+	}
 
-		return nil
+	return nil
+}
+
+//ReadAt writes 'n' bytes of the original content of the file at 'path' in
+//'ref' to writer 'w', starting at offset 'off'. A negative 'n' reads until
+//the end of the file. Only the chunks that overlap the range are fetched
+func (repo *Repository) ReadAt(ref, path string, off, n int64, w io.Writer) (err error) {
+	defer repo.flushAudit(&err)
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, "cat-file", "blob", ref+":"+path)
+	if err != nil {
+		return fmt.Errorf("failed to read '%s' in '%s': %v", path, ref, err)
+	}
+
+	ptr, err := repo.ReadPointer(buf)
+	if err != nil {
+		return fmt.Errorf("failed to read pointer for '%s': %v", path, err)
+	}
+
+	return repo.readPointerAt(ptr, off, n, w)
+}
+
+//readPointerAt writes 'n' bytes of the content described by pointer 'ptr' to
+//writer 'w' starting at offset 'off', a negative 'n' reads until the end
+func (repo *Repository) readPointerAt(ptr *Pointer, off, n int64, w io.Writer) (err error) {
+	return repo.readPointerAtWith(ptr, off, n, w, func(c PointerChunk) error {
+		return repo.fetchChunks(context.Background(), c)
 	})
+}
+
+//readPointerAtWith works like readPointerAt but calls 'fetch' to make sure
+//each chunk that overlaps the range is stored locally
+func (repo *Repository) readPointerAtWith(ptr *Pointer, off, n int64, w io.Writer, fetch func(PointerChunk) error) (err error) {
+	if off < 0 {
+		return fmt.Errorf("invalid negative offset %d", off)
+	}
+
+	pos := int64(0)
+	for _, c := range ptr.Chunks {
+		if n >= 0 && pos >= off+n {
+			break
+		}
+
+		//without a recorded size we need the chunk itself to know where it ends
+		size := c.Size
+		if size < 0 {
+			size, err = repo.localChunkSize(c.Version, c.K)
+			if err != nil {
+				return err
+			}
+		}
+
+		if pos+size <= off {
+			pos += size
+			continue
+		}
+
+		err = func() error {
+			err = fetch(c)
+			if err != nil {
+				return err
+			}
+
+			rc, err := repo.chunkReader(c.Version, c.K)
+			if err != nil {
+				return err
+			}
+
+			//the stream cipher requires us to decrypt any bytes we skip
+			defer rc.Close()
+			skip := int64(0)
+			if off > pos {
+				skip = off - pos
+			}
+
+			_, err = io.CopyN(ioutil.Discard, rc, skip)
+			if err != nil {
+				return fmt.Errorf("failed to skip %d bytes of chunk '%x': %v", skip, c.K, err)
+			}
+
+			take := size - skip
+			if n >= 0 && pos+size > off+n {
+				take = off + n - pos - skip
+			}
+
+			_, err = io.CopyN(w, rc, take)
+			if err != nil {
+				return fmt.Errorf("failed to copy %d bytes of chunk '%x': %v", take, c.K, err)
+			}
+
+			return nil
+		}()
+
+		if err != nil {
+			return err
+		}
+
+		pos += size
+	}
+
+	return nil
+}
 
+//fetchChunks makes sure the given chunks are stored locally
+func (repo *Repository) fetchChunks(ctx context.Context, cs ...PointerChunk) (err error) {
+	buf := bytes.NewBuffer(nil)
+	for _, c := range cs {
+		fmt.Fprintf(buf, "%s\n", FormatKey(c.Version, c.K))
+	}
+
+	err = repo.fetch(ctx, buf, ioutil.Discard)
 	if err != nil {
-		return fmt.Errorf("failed to loop over keys: %v", err)
+		return fmt.Errorf("failed to fetch chunks: %v", err)
 	}
 
 	return nil
 }
+
+//localChunkSize returns the plain-text size of chunk 'k' of version 'v',
+//fetching it if its not stored locally. Chunks are encrypted with a stream
+//cipher so the size on disk equals the plain-text size
+func (repo *Repository) localChunkSize(v KeyVersion, k K) (size int64, err error) {
+	err = repo.fetchChunks(context.Background(), PointerChunk{K: k, Version: v})
+	if err != nil {
+		return 0, err
+	}
+
+	p, _ := repo.chunkPath(v, k, false)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat chunk '%x': %v", k, err)
+	}
+
+	return fi.Size(), nil
+}
+
+//chunkReader opens the locally stored chunk 'k' of version 'v' for reading
+//its decrypted content, as that version encrypts it. The user is expected
+//to close it when finished
+func (repo *Repository) chunkReader(v KeyVersion, k K) (rc io.ReadCloser, err error) {
+	stream, err := v.stream(k)
+	if err != nil {
+		return nil, err
+	}
+
+	//open chunk file
+	p, _ := repo.chunkPath(v, k, false)
+	f, err := os.OpenFile(p, os.O_RDONLY, 0666)
+	if os.IsNotExist(err) {
+		return nil, withKind(MissingChunkError, fmt.Errorf("failed to open chunk '%x' locally at '%s': %v", k, p, err))
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open chunk '%x' locally at '%s': %v", k, p, err)
+	}
+
+	touchChunk(p)
+	return &chunkReadCloser{
+		Reader: &cipher.StreamReader{S: stream, R: f},
+		Closer: f,
+	}, nil
+}
+
+//chunkReadCloser reads decrypted chunk content and closes the underlying file
+type chunkReadCloser struct {
+	io.Reader
+	io.Closer
+}
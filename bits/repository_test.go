@@ -1,257 +1,9274 @@
 package bits_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
 	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/nerdalize/git-bits/bits"
+	"github.com/nerdalize/git-bits/bits/bitstest"
 )
 
-func GitInitRemote(t *testing.T) (dir string) {
-	dir, err := ioutil.TempDir("", "test_remote_")
+func TestNewRepository(t *testing.T) {
+	_, err := bits.NewRepository("/tmp/my-bogus-repo", nil)
+	if err == nil {
+		t.Errorf("creating repo in non-existing directory should fail")
+	} else {
+		if !strings.Contains(err.Error(), "git repository") {
+			t.Errorf("creating repo should fail with non existing dir error, got: %v", err)
+		}
+	}
+
+	tdir, _ := ioutil.TempDir("", "test_wdir_")
+	_, err = bits.NewRepository(tdir, nil)
+	if err == nil {
+		t.Errorf("creating repo in non-git directory should fail")
+	} else {
+		if !strings.Contains(err.Error(), "git repository") {
+			t.Errorf("creating repo should fail with exit code, got: %v", err)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_version_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	//builds record their version the way make.sh does
+	bin := filepath.Join(dir, "git-bits")
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", bin, "-ldflags", "-X main.version=1.2.3 -X main.commit=abc1234 -X main.date=2026-01-02T03:04:05Z")
+	cmd.Dir = filepath.Join(os.Getenv("GOPATH"), "src", "github.com", "nerdalize", "git-bits")
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("failed to build git-bits: %v", err)
+	}
+
+	hashes := []string{}
+	for _, h := range bits.KeyHashes() {
+		hashes = append(hashes, h.String())
+	}
+
+	exp := []string{
+		"git-bits 1.2.3",
+		"commit:     abc1234",
+		"built:      2026-01-02T03:04:05Z",
+		"key hashes: " + strings.Join(hashes, ", "),
+		"backends:   " + strings.Join(bits.RemoteBackends, ", "),
+	}
+
+	//the flag and the command write the same to stdout and succeed
+	outs := []string{}
+	for _, args := range [][]string{{"--version"}, {"version"}} {
+		stdout := bytes.NewBuffer(nil)
+		cmd = exec.CommandContext(ctx, bin, args...)
+		cmd.Stdout = stdout
+		err = cmd.Run()
+		if err != nil {
+			t.Fatalf("expected '%s' to succeed, got: %v", strings.Join(args, " "), err)
+		}
+
+		for _, line := range exp {
+			if !strings.Contains(stdout.String(), line+"\n") {
+				t.Errorf("expected '%s' to write '%s', got: %s", strings.Join(args, " "), line, stdout.String())
+			}
+		}
+
+		outs = append(outs, stdout.String())
+	}
+
+	if outs[0] != outs[1] {
+		t.Errorf("expected the flag and the command to write the same, got: %s and %s", outs[0], outs[1])
+	}
+
+	for i, h := range bits.KeyHashes() {
+		if p, err := bits.ParseKeyHash(h.String()); err != nil || p != h || int(h) != i {
+			t.Errorf("expected key hash '%s' to be listed by its number %d, got: %d (%v)", h, i, p, err)
+		}
+	}
+}
+
+//test basic file splitting and combining
+func TestSplitCombineScan(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx) //@TODO this is terrible for unit testing
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	lstore1, err := repo1.LocalStore()
+	if err != nil {
+		t.Error(err)
+	}
+
+	fmt.Println(lstore1.Path())
+	defer lstore1.Close()
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err = repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Error(err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f1 := bitstest.WriteRandomFile(t, fpath, 5*1024*1024)
+	f1.Close()
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	if err != nil {
+		t.Error(err)
+	}
+
+	c0buf := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, c0buf, "rev-parse", "HEAD")
+	if err != nil {
+		t.Error(err)
+	}
+
+	c0 := strings.TrimSpace(c0buf.String())
+	originalContent := bytes.NewBuffer(nil)
+
+	f2, err := os.OpenFile(fpath, os.O_RDWR, 0666)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = io.Copy(originalContent, f2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = f2.WriteAt([]byte{0x00}, 5)
+	if err != nil {
+		t.Error(err)
+	}
+
+	f2.Close()
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "commit", "-m", "c1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	c1buf := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, c1buf, "rev-parse", "HEAD")
+	if err != nil {
+		t.Error(err)
+	}
+
+	c1 := strings.TrimSpace(c1buf.String())
+
+	err = repo1.Git(ctx, nil, nil, "checkout", c0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	newContent, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(originalContent.Bytes(), newContent) {
+		t.Error("after checkout, file content should be equal to content before edit")
+	}
+
+	scanbuf := bytes.NewBuffer(nil)
+	err = repo1.Scan(c0, c1, scanbuf)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(scanbuf.Bytes())%(hex.EncodedLen(bits.KeySize)+1) != 0 {
+		t.Errorf("expected a multitude keys to be returned but got: %s", scanbuf.String())
+	}
+}
+
+//test that scanning for a push stops at commits that were pushed before
+func TestScanWatermark(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commits := []string{}
+	for i := 0; i < 2; i++ {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+
+		commits = append(commits, bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i)))
+	}
+
+	//c0 was pushed before, the commit of a deleted branch is gone
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bits.WatermarkBucket)
+		err := b.Put([]byte("origin\x00refs/heads/master"), []byte(commits[0]))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("origin\x00refs/heads/gone"), []byte(strings.Repeat("f", 40)))
+	})
+
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := fmt.Sprintf("refs/heads/master %s refs/heads/master %s\n", commits[1], strings.Repeat("0", 40))
+	for _, c := range []struct {
+		full bool
+		left string
+	}{
+		{false, commits[0]},
+		{true, ""},
+	} {
+		expected := bytes.NewBuffer(nil)
+		err = repo1.Scan(c.left, commits[1], expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual := bytes.NewBuffer(nil)
+		err = repo1.ScanEach(strings.NewReader(line), actual, "origin", c.full)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.String() != expected.String() || actual.Len() == 0 {
+			t.Errorf("full=%v: expected scanned keys:\n%s\ngot:\n%s", c.full, expected.String(), actual.String())
+		}
+	}
+
+	//the scanned commit becomes a watermark once the push completes
+	store, err = repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+	err = store.View(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(bits.PendingWatermarkBucket).Get([]byte("origin\x00refs/heads/master"))
+		if string(pending) != commits[1] {
+			t.Errorf("expected pending watermark '%s', got: '%s'", commits[1], pending)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterDrift(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := repo1.FilterDrift()
+	if err != nil || len(drift) != 0 {
+		t.Fatalf("expected no drift after installing, got: %v, %v", drift, err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f := bitstest.WriteRandomFile(t, fpath, 1024*1024)
+	f.Close()
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	//another tool rewrites the configuration, files are checked out as pointers
+	for _, args := range [][]string{
+		{"config", "--remove-section", "filter.bits"},
+		{"config", "filter.bits.clean", "cat"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.Remove(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "checkout", "--", "file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err = repo1.FilterDrift()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(drift) != 4 || drift[0].Key != "filter.bits.clean" || drift[0].Actual != "cat" || drift[3].Key != "filter.bits.smudge" || drift[3].Actual != "" {
+		t.Fatalf("expected the changed and removed settings to drift, got: %v", drift)
+	}
+
+	drift, err = repo1.RepairFilter(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(drift) != 4 {
+		t.Errorf("expected 4 settings to be restored, got: %v", drift)
+	}
+
+	actual, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(actual, content) {
+		t.Errorf("expected the file that was checked out as a pointer to get its content back")
+	}
+
+	drift, err = repo1.FilterDrift()
+	if err != nil || len(drift) != 0 {
+		t.Errorf("expected no drift after repairing, got: %v, %v", drift, err)
+	}
+}
+
+func TestLazyCheckout(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	conf := bits.DefaultConf()
+	conf.Lazy = true
+	err := repo1.Install(os.Stderr, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f := bitstest.WriteRandomFile(t, fpath, 1024*1024)
+	f.Close()
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks are only stored remotely
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		return os.Remove(p)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the checkout leaves the pointer and git sees no change
+	err = os.Remove(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "checkout", "--", "file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(actual, ptr.Bytes()) {
+		t.Fatalf("expected a lazy checkout to leave the pointer, got %d bytes", len(actual))
+	}
+
+	status := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, status, "status", "--porcelain")
+	if err != nil || status.Len() != 0 {
+		t.Errorf("expected no changes after a lazy checkout, got: %s, %v", status, err)
+	}
+
+	//the file is downloaded once it is pulled
+	err = repo1.Pull(bits.PullSelection{Include: []string{"file1.bin"}}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err = ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(actual, content) {
+		t.Errorf("expected the pulled file to hold its content")
+	}
+
+	//with its chunks stored locally a checkout writes the content
+	err = os.Remove(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "checkout", "--", "file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err = ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(actual, content) {
+		t.Errorf("expected a file of which the chunks are stored locally to be checked out with its content")
+	}
+}
+
+//opening a file that a lazy checkout left as a pointer materializes it
+func TestLazyOpen(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	conf := bits.DefaultConf()
+	conf.Lazy = true
+	err := repo1.Install(os.Stderr, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(wd1, "assets"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpath := filepath.Join(wd1, "assets", "file1.bin")
+	f := bitstest.WriteRandomFile(t, fpath, 1024*1024)
+	f.Close()
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:assets/file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks are only stored remotely, the checkout leaves the pointer
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		return os.Remove(p)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "checkout", "--", "assets/file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wctx, wcancel := context.WithCancel(ctx)
+	werr := make(chan error, 1)
+	go func() {
+		werr <- repo1.MaterializeOnOpen(wctx)
+	}()
+
+	//another process that opens the file reads its content, the open
+	//waits until it is materialized. Until the directory is watched it
+	//still reads the pointer.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		select {
+		case err = <-werr:
+			if err != nil && strings.Contains(err.Error(), "CAP_SYS_ADMIN") {
+				t.Skipf("fanotify is not available: %v", err)
+			}
+
+			t.Fatal(err)
+		default:
+		}
+
+		out, err := exec.CommandContext(ctx, "cat", fpath).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Equal(out, content) {
+			break
+		}
+
+		if !bytes.Equal(out, ptr.Bytes()) || time.Now().After(deadline) {
+			t.Fatalf("expected opening the file to read its content, got %d bytes", len(out))
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	status := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, status, "status", "--porcelain")
+	if err != nil || status.Len() != 0 {
+		t.Errorf("expected no changes after materializing on open, got: %s, %v", status, err)
+	}
+
+	wcancel()
+	err = <-werr
+	if err != nil {
+		t.Errorf("expected materializing on open to stop without error, got: %v", err)
+	}
+}
+
+func TestStagedRawPointers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	conf := bits.DefaultConf()
+	conf.RejectRawPointers = true
+	err := repo1.Install(os.Stderr, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook, err := ioutil.ReadFile(filepath.Join(wd1, ".git", "hooks", "pre-commit"))
+	if err != nil || !strings.Contains(string(hook), "git-bits check-staged") {
+		t.Errorf("expected the pre-commit hook to check staged files, got: %s, %v", hook, err)
+	}
+
+	f := bitstest.WriteRandomFile(t, filepath.Join(wd1, "file1.bin"), 1024*1024)
+	f.Close()
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, ptr, "show", "HEAD:file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//files that the filter splits are fine
+	f = bitstest.WriteRandomFile(t, filepath.Join(wd1, "file2.bin"), 1024*1024)
+	f.Close()
+	err = ioutil.WriteFile(filepath.Join(wd1, "copy of ptr.txt"), ptr.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := repo1.StagedRawPointers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(raw) != 1 || raw[0].Path != "copy of ptr.txt" || !strings.Contains(raw[0].Reason, "isn't split") {
+		t.Fatalf("expected the pointer outside split paths to be refused, got: %+v", raw)
+	}
+
+	//without the filter pointers are staged as is
+	err = repo1.Git(ctx, nil, nil, "reset", "-q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "config", "--remove-section", "filter.bits")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "file2.bin"), ptr.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "file2.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err = repo1.StagedRawPointers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(raw) != 1 || raw[0].Path != "file2.bin" || !strings.Contains(raw[0].Reason, "filter.bits.clean") {
+		t.Errorf("expected the pointer that the filter didn't write to be refused, got: %+v", raw)
+	}
+}
+
+//test that scanning for the pre-push hook only scans the pushed commits
+func TestScanPushedRefs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//c0 is on the remote already, c1 is pushed to a new branch
+	commits := []string{}
+	for i := 0; i < 2; i++ {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+
+		commits = append(commits, bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i)))
+		if i == 0 {
+			err = repo1.Git(ctx, nil, nil, "push", "--no-verify", "origin", "HEAD:refs/heads/master")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expected := bytes.NewBuffer(nil)
+	err = repo1.Scan(commits[0], commits[1], expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		input    string
+		expected string
+		err      bool
+	}{
+		{"created", fmt.Sprintf("refs/heads/feature %s refs/heads/feature %s\n", commits[1], bits.ZeroSHA), expected.String(), false},
+		{"updated", fmt.Sprintf("HEAD %s refs/heads/master %s\n", commits[1], commits[0]), expected.String(), false},
+		{"unknown remote commit", fmt.Sprintf("HEAD %s refs/heads/master %s\n", commits[1], strings.Repeat("f", 40)), expected.String(), false},
+		{"deleted", fmt.Sprintf("(delete) %s refs/heads/feature %s\n", bits.ZeroSHA, commits[1]), "", false},
+		{"invalid", fmt.Sprintf("HEAD %s refs/heads/master xyz\n", commits[1]), "", true},
+	} {
+		buf := bytes.NewBuffer(nil)
+		err = repo1.ScanEach(strings.NewReader(c.input), buf, "origin", true)
+		if (err != nil) != c.err {
+			t.Errorf("%s: expected error to be %v, got: %v", c.name, c.err, err)
+		}
+
+		if buf.String() != c.expected {
+			t.Errorf("%s: expected scanned keys:\n%s\ngot:\n%s", c.name, c.expected, buf.String())
+		}
+	}
+}
+
+//test that scanning for a push of multiple refs scans each of them
+func TestScanEachMultipleRefs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//both branches share a file of the first commit
+	commits := map[string]string{}
+	for i, branch := range []string{"master", "a", "b"} {
+		if i > 0 {
+			err = repo1.Git(ctx, nil, nil, "checkout", "-b", branch, commits["master"])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("%s.bin", branch)), 1024*1024)
+		f.Close()
+
+		commits[branch] = bitstest.GitCommit(t, ctx, repo1, branch)
+	}
+
+	expected := map[string]struct{}{}
+	for _, branch := range []string{"a", "b"} {
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Scan("", commits[branch], buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, k := range strings.Fields(buf.String()) {
+			expected[k] = struct{}{}
+		}
+	}
+
+	input := fmt.Sprintf("refs/heads/a %s refs/heads/a %s\nrefs/heads/b %s refs/heads/b %s\n", commits["a"], bits.ZeroSHA, commits["b"], bits.ZeroSHA)
+	buf := bytes.NewBuffer(nil)
+	err = repo1.ScanEach(strings.NewReader(input), buf, "origin", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := strings.Fields(buf.String())
+	if len(actual) != len(expected) {
+		t.Errorf("expected %d keys, got %d: %v", len(expected), len(actual), actual)
+	}
+
+	for _, k := range actual {
+		if _, ok := expected[k]; !ok {
+			t.Errorf("unexpected key '%s'", k)
+		}
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+	err = store.View(func(tx *bolt.Tx) error {
+		for _, branch := range []string{"a", "b"} {
+			pending := tx.Bucket(bits.PendingWatermarkBucket).Get([]byte("origin\x00refs/heads/" + branch))
+			if string(pending) != commits[branch] {
+				t.Errorf("expected pending watermark '%s' for %s, got: '%s'", commits[branch], branch, pending)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//test that chunks of routed refs are pushed to and fetched from their bucket
+func TestRoutes(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commits := map[string]string{}
+	for i, branch := range []string{"master", "release/1", "feature"} {
+		if i > 0 {
+			err = repo1.Git(ctx, nil, nil, "checkout", "-b", branch, commits["master"])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		name := path.Base(branch) + ".bin"
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), 1024*1024)
+		f.Close()
+
+		commits[branch] = bitstest.GitCommit(t, ctx, repo1, branch)
+	}
+
+	fileKeys := func(branch, name string) (keys []bits.K) {
+		buf := bytes.NewBuffer(nil)
+		err := repo1.Git(ctx, nil, buf, "show", commits[branch]+":"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, err := range repo1.Keys(buf) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys = append(keys, k)
+		}
+
+		return keys
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.route": "release/* archive",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, archive := bits.NewMemoryRemote(), bits.NewMemoryRemote()
+	repo1.SetRemote(def)
+	repo1.SetRouteRemote("archive", archive)
+
+	input := fmt.Sprintf("refs/heads/release/1 %s refs/heads/release/1 %s\nrefs/heads/feature %s refs/heads/feature %s\n", commits["release/1"], bits.ZeroSHA, commits["feature"], bits.ZeroSHA)
+	keys := bytes.NewBuffer(nil)
+	err = repo1.ScanEach(strings.NewReader(input), keys, "origin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(keys.String(), "\nref refs/heads/release/1\n") {
+		t.Fatalf("expected the keys of the release branch to be routed, got:\n%s", keys.String())
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func(remote *bits.MemoryRemote, k bits.K) bool {
+		for _, rk := range remote.Keys() {
+			if rk == k {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	release := fileKeys("release/1", "1.bin")
+	for _, k := range release {
+		if !stored(archive, k) || stored(def, k) {
+			t.Errorf("expected chunk '%x' of the release branch to be pushed to the archive only", k)
+		}
+	}
+
+	for _, k := range fileKeys("feature", "feature.bin") {
+		if stored(archive, k) || !stored(def, k) {
+			t.Errorf("expected chunk '%x' of the feature branch to be pushed to the configured remote only", k)
+		}
+	}
+
+	//routed chunks are fetched from the archive, with or without the ref
+	for _, listing := range []string{"ref refs/heads/release/1\n", ""} {
+		for _, k := range release {
+			p, _ := repo1.Path(k, false)
+			os.Remove(p)
+			listing += fmt.Sprintf("%x\n", k)
+		}
+
+		err = repo1.Fetch(strings.NewReader(listing), ioutil.Discard)
+		if err != nil {
+			t.Fatalf("expected routed chunks to be fetched, got: %v", err)
+		}
+	}
+
+	//keys are pushed as they are read, before the list is complete
+	streamed := bits.NewMemoryRemote()
+	repo1.SetRouteRemote("archive", streamed)
+	pr, pw := io.Pipe()
+	go func() {
+		fmt.Fprintf(pw, "ref refs/heads/release/1\n%x\n", release[0])
+		deadline := time.Now().Add(5 * time.Second)
+		for !stored(streamed, release[0]) {
+			if time.Now().After(deadline) {
+				pw.CloseWithError(fmt.Errorf("chunk '%x' wasn't pushed before the list was complete", release[0]))
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		for _, k := range release[1:] {
+			fmt.Fprintf(pw, "%x\n", k)
+		}
+
+		pw.Close()
+	}()
+
+	store, err = repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, pr, "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range release {
+		if !stored(streamed, k) {
+			t.Errorf("expected chunk '%x' of the release branch to be pushed to the archive", k)
+		}
+	}
+}
+
+//test that specialty branches and configured refs are not scanned
+func TestScanExcludedRefs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.scan-exclude": "refs/heads/archive/*,refs/tags/old-*",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, args := range [][]string{
+		{"checkout", "-b", "master"},
+		{"checkout", "-b", bits.ChunkIndexBranch},
+		{"checkout", "-b", "master-" + bits.RemoteBranchSuffix, "master"},
+		{"checkout", "-b", "archive/2017", "master"},
+		{"checkout", "--detach", "master"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+	}
+
+	err = repo1.Git(ctx, nil, nil, "tag", "old-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bytes.NewBuffer(nil)
+	err = repo1.Scan("", "master", expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := bytes.NewBuffer(nil)
+	err = repo1.ScanAll(actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual.String() != expected.String() || actual.Len() == 0 {
+		t.Errorf("expected only keys of master:\n%s\ngot:\n%s", expected.String(), actual.String())
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, buf, "rev-parse", bits.ChunkIndexBranch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual = bytes.NewBuffer(nil)
+	input := fmt.Sprintf("refs/heads/%s %s refs/heads/%s %s\n", bits.ChunkIndexBranch, strings.TrimSpace(buf.String()), bits.ChunkIndexBranch, bits.ZeroSHA)
+	err = repo1.ScanEach(strings.NewReader(input), actual, "origin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual.Len() != 0 {
+		t.Errorf("expected the chunk index branch not to be scanned, got:\n%s", actual.String())
+	}
+}
+
+//test that scanning revisions finds the keys of the commits they select, limited by date and excluded commits
+func TestScanRevs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//an old commit and a recent one that keeps the old file
+	keys := []map[string]bool{}
+	for i, date := range []string{"2020-01-01T00:00:00", ""} {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+
+		if date != "" {
+			os.Setenv("GIT_COMMITTER_DATE", date)
+		}
+
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+		os.Unsetenv("GIT_COMMITTER_DATE")
+
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, buf, "cat-file", "blob", fmt.Sprintf("HEAD:file%d.bin", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ks := map[string]bool{}
+		err = repo1.ForEach(buf, func(k bits.K) error {
+			ks[fmt.Sprintf("%x", k)] = true
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, ks)
+	}
+
+	for _, c := range []struct {
+		revs  []string
+		since string
+		not   []string
+		files []int
+	}{
+		{revs: []string{"--all"}, files: []int{0, 1}},
+		{revs: []string{"HEAD"}, since: "2021-01-01", files: []int{1}},
+		{revs: []string{"HEAD"}, not: []string{"HEAD~1"}, files: []int{1}},
+		{revs: []string{"HEAD~1..HEAD"}, files: []int{1}},
+		{revs: []string{"HEAD"}, since: "2030-01-01"},
+	} {
+		buf := bytes.NewBuffer(nil)
+		err = repo1.ScanRevs(c.revs, c.since, c.not, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]bool{}
+		for _, i := range c.files {
+			for k := range keys[i] {
+				expected[k] = true
+			}
+		}
+
+		scanned := strings.Fields(buf.String())
+		if len(scanned) != len(expected) {
+			t.Errorf("expected %d keys for %v since '%s' not %v, got: %d", len(expected), c.revs, c.since, c.not, len(scanned))
+		}
+
+		for _, k := range scanned {
+			if !expected[k] {
+				t.Errorf("expected key '%s' not to be scanned for %v since '%s' not %v", k, c.revs, c.since, c.not)
+			}
+		}
+	}
+}
+
+func TestScanCache(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commits := []string{}
+	for i := 0; i < 2; i++ {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, buf, "rev-parse", "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		commits = append(commits, strings.TrimSpace(buf.String()))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.ScanAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := strings.Fields(buf.String())
+	if len(all) == 0 {
+		t.Fatal("expected keys to be scanned")
+	}
+
+	//each commit is recorded with the pointer it introduces
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bits.CommitBlobsBucket)
+		for i, commit := range commits {
+			v := b.Get([]byte(commit))
+			if !bytes.Contains(v, []byte(fmt.Sprintf("file%d.bin", i))) || bytes.Count(v, []byte(`"blob"`)) != 1 {
+				t.Errorf("expected commit %d to be recorded with the pointer of file%d.bin, got: %s", i, i, v)
+			}
+		}
+
+		//a scan trusts what is recorded
+		return b.Put([]byte(commits[1]), []byte("[]"))
+	})
+
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf = bytes.NewBuffer(nil)
+	err = repo1.ScanAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanned := strings.Fields(buf.String())
+	if len(scanned) == 0 || len(scanned) >= len(all) {
+		t.Errorf("expected only the keys of the first commit to be scanned, got %d of %d", len(scanned), len(all))
+	}
+}
+
+//test that scanning all refs finds the keys of every branch and tag
+func TestScanAll(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a commit on master, one on another branch and a tagged one on neither
+	for i, args := range [][]string{
+		{"checkout", "-b", "master"},
+		{"checkout", "-b", "side"},
+		{"checkout", "--detach", "master"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+	}
+
+	err = repo1.Git(ctx, nil, nil, "tag", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "checkout", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]struct{}{}
+	for _, ref := range []string{"side", "v1"} {
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Scan("", ref, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, k := range strings.Fields(buf.String()) {
+			expected[k] = struct{}{}
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.ScanAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := map[string]struct{}{}
+	for _, k := range strings.Fields(buf.String()) {
+		actual[k] = struct{}{}
+	}
+
+	if len(expected) == 0 || len(actual) != len(expected) {
+		t.Fatalf("expected %d keys, got %d", len(expected), len(actual))
+	}
+
+	for k := range expected {
+		if _, ok := actual[k]; !ok {
+			t.Errorf("expected key '%s' to be scanned", k)
+		}
+	}
+}
+
+//test reading byte ranges of a split file
+func TestReadAt(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Error(err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f1 := bitstest.WriteRandomFile(t, fpath, 5*1024*1024)
+	f1.Close()
+
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		off int64
+		n   int64
+	}{
+		{0, 10},
+		{1024*1024 - 5, 2 * 1024 * 1024},
+		{int64(len(content)) - 10, -1},
+		{int64(len(content)) - 10, 100},
+	} {
+		buf := bytes.NewBuffer(nil)
+		err = repo1.ReadAt("HEAD", "file1.bin", c.off, c.n, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		end := c.off + c.n
+		if c.n < 0 || end > int64(len(content)) {
+			end = int64(len(content))
+		}
+
+		if !bytes.Equal(buf.Bytes(), content[c.off:end]) {
+			t.Errorf("range %d:%d should equal the original content, got %d bytes", c.off, c.n, buf.Len())
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f1 := bitstest.WriteRandomFile(t, fpath, 3*1024*1024)
+	f1.Close()
+
+	err = os.Mkdir(filepath.Join(wd1, "dir"), 0777)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(wd1, "dir", "small.txt"), []byte("not split"), 0666)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the chunks are only stored remotely, archiving fetches them
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, ptr, "show", "HEAD:file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		return os.Remove(p)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.Archive("HEAD", "tar", "prefix/", nil, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			files[hdr.Name] = data
+		}
+	}
+
+	if !bytes.Equal(files["prefix/file1.bin"], content) {
+		t.Errorf("expected the split file to be archived with its original content, got %d bytes", len(files["prefix/file1.bin"]))
+	}
+
+	if string(files["prefix/dir/small.txt"]) != "not split" {
+		t.Errorf("expected the file that isn't split to be archived as is, got: %q", files["prefix/dir/small.txt"])
+	}
+
+	//zip archives can be limited to some paths
+	buf.Reset()
+	err = repo1.Archive("HEAD", "zip", "", []string{"file1.bin"}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(zr.File) != 1 || zr.File[0].Name != "file1.bin" {
+		t.Fatalf("expected only the split file in the archive, got: %d files", len(zr.File))
+	}
+
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("expected the zipped split file to hold its original content: %v", err)
+	}
+
+	err = repo1.Archive("HEAD", "rar", "", nil, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "unsupported archive format") {
+		t.Errorf("expected an unsupported format to fail, got: %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		_, err := rand.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return data
+	}
+
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	split := func(data []byte) []byte {
+		if data == nil {
+			return nil
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err := repo1.Split(bytes.NewReader(data), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.Bytes()
+	}
+
+	base := random(3 * 1024 * 1024)
+	x := random(1024 * 1024)
+	y := random(1024 * 1024)
+	rewritten := concat(base[:1024*1024], random(1024*1024), base[2*1024*1024:])
+
+	for _, c := range []struct {
+		name   string
+		base   []byte
+		ours   []byte
+		theirs []byte
+		exp    []byte
+	}{
+		{"ours changed", base, concat(base, x), base, concat(base, x)},
+		{"theirs changed", base, base, rewritten, rewritten},
+		{"identical changes", base, rewritten, rewritten, rewritten},
+		{"both appended", base, concat(base, x), concat(base, y), concat(base, x, y)},
+		{"added on both sides", nil, concat(base, x), concat(base, x), concat(base, x)},
+		{"rewritten and appended", base, rewritten, concat(base, y), nil},
+		{"both rewritten", base, rewritten, concat(x, base), nil},
+		{"added differently on both sides", nil, base, concat(base, y), nil},
+	} {
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Merge(bytes.NewReader(split(c.base)), bytes.NewReader(split(c.ours)), bytes.NewReader(split(c.theirs)), buf)
+		if c.exp == nil {
+			if err != bits.ErrMergeConflict {
+				t.Errorf("%s: expected a merge conflict, got: %v", c.name, err)
+			}
+
+			if buf.Len() != 0 {
+				t.Errorf("%s: expected nothing to be written on conflict, got %d bytes", c.name, buf.Len())
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: failed to merge: %v", c.name, err)
+			continue
+		}
+
+		out := bytes.NewBuffer(nil)
+		err = repo1.Combine(buf, out)
+		if err != nil {
+			t.Errorf("%s: failed to combine merge result: %v", c.name, err)
+			continue
+		}
+
+		if !bytes.Equal(out.Bytes(), c.exp) {
+			t.Errorf("%s: expected merged content of %d bytes, got %d bytes that differ", c.name, len(c.exp), out.Len())
+		}
+	}
+}
+
+func TestDescribeDelta(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := make([]byte, 8*1024*1024)
+	_, err = rand.Read(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tail := make([]byte, 2*1024*1024)
+	_, err = rand.Read(tail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appended := append(append([]byte{}, base...), tail...)
+	describe := func(data []byte) *bits.Pointer {
+		ptr, err := repo1.Describe(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ptr
+	}
+
+	//describing content doesn't store its chunks, but describes the same
+	//chunks as splitting it does
+	oldPtr := describe(base)
+	for _, c := range oldPtr.Chunks {
+		p, err := repo1.Path(c.K, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected describing to not store chunk '%x', got: %v", c.K, err)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(base), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if split := describe(buf.Bytes()); !reflect.DeepEqual(split.Chunks, oldPtr.Chunks) {
+		t.Errorf("expected describing a pointer to return the chunks it was split into")
+	}
+
+	newPtr := describe(appended)
+	d := bits.Delta(oldPtr, newPtr)
+	if d.OldSize != int64(len(base)) || d.NewSize != int64(len(appended)) || d.OldChunks != len(oldPtr.Chunks) || d.NewChunks != len(newPtr.Chunks) {
+		t.Errorf("expected the delta to describe both files, got: %+v", d)
+	}
+
+	//only the chunks at the end change, their share is the added ratio
+	if d.Added < 1 || d.Added >= d.NewChunks || d.Removed > 1 || d.AddedRatio() < 0.2 || d.AddedRatio() >= 0.9 {
+		t.Errorf("expected an append to add few chunks, got: %+v (%.2f)", d, d.AddedRatio())
+	}
+
+	if d = bits.Delta(oldPtr, oldPtr); d.Added != 0 || d.Removed != 0 || d.AddedRatio() != 0 {
+		t.Errorf("expected no changes between equal pointers, got: %+v", d)
+	}
+
+	if d = bits.Delta(nil, newPtr); d.Added != len(newPtr.Chunks) || d.AddedRatio() != 1 || d.OldSize != 0 {
+		t.Errorf("expected all chunks of an added file to be added, got: %+v", d)
+	}
+
+	if d = bits.Delta(oldPtr, nil); d.Removed != len(oldPtr.Chunks) || d.NewSize != 0 {
+		t.Errorf("expected all chunks of a removed file to be removed, got: %+v", d)
+	}
+}
+
+func TestMount(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("mounting is not supported on %s", runtime.GOOS)
+	}
+
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Error(err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f1 := bitstest.WriteRandomFile(t, fpath, 5*1024*1024)
+	f1.Close()
+
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+
+	mnt, err := ioutil.TempDir("", "test_mount_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountCtx, unmount := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- repo1.Mount(mountCtx, "HEAD", mnt)
+	}()
+
+	//wait for the mount to show the tree, the mount is read from another
+	//process as the runtime may need the filesystem's goroutines to progress
+	var content []byte
+	for i := 0; i < 50; i++ {
+		select {
+		case err = <-errCh:
+			t.Skipf("unable to mount in this environment: %v", err)
+		default:
+		}
+
+		content, err = exec.CommandContext(ctx, "cat", filepath.Join(mnt, "file1.bin")).Output()
+		if err == nil {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	unmount()
+	if err != nil {
+		t.Fatalf("failed to read split file from mount: %v", err)
+	}
+
+	expected, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(content, expected) {
+		t.Errorf("mounted file should equal the original content, got %d bytes", len(content))
+	}
+
+	err = <-errCh
+	if err != nil {
+		t.Errorf("mount should end without error when unmounted, got: %v", err)
+	}
+}
+
+//nfsClient sends rpc calls to an nfs server, arguments are encoded as xdr
+//and the result of a successful call is returned for decoding
+type nfsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	xid  uint32
+}
+
+func (c *nfsClient) call(prog, proc uint32, args ...interface{}) *bytes.Reader {
+	buf := bytes.NewBuffer(make([]byte, 4))
+	put := func(v interface{}) {
+		switch v := v.(type) {
+		case uint32:
+			binary.Write(buf, binary.BigEndian, v)
+		case uint64:
+			binary.Write(buf, binary.BigEndian, v)
+		case string:
+			binary.Write(buf, binary.BigEndian, uint32(len(v)))
+			buf.WriteString(v + strings.Repeat("\x00", (4-len(v)%4)%4))
+		case []byte:
+			binary.Write(buf, binary.BigEndian, uint32(len(v)))
+			buf.Write(append(v, make([]byte, (4-len(v)%4)%4)...))
+		}
+	}
+
+	c.xid++
+	vers := uint32(3)
+	for _, v := range []interface{}{c.xid, uint32(0), uint32(2), prog, vers, proc, uint32(1), []byte{}, uint32(0), []byte{}} {
+		put(v)
+	}
+
+	for _, v := range args {
+		put(v)
+	}
+
+	msg := buf.Bytes()
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4)|1<<31)
+	_, err := c.conn.Write(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	var hdr uint32
+	err = binary.Read(c.r, binary.BigEndian, &hdr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	reply := make([]byte, hdr&^(1<<31))
+	_, err = io.ReadFull(c.r, reply)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	r := bytes.NewReader(reply)
+	xid, typ, stat := xdrUint32(r), xdrUint32(r), xdrUint32(r)
+	xdrUint32(r) //verifier
+	xdrOpaque(r)
+	if accept := xdrUint32(r); xid != c.xid || typ != 1 || stat != 0 || accept != 0 {
+		c.t.Fatalf("unexpected reply to call %d of procedure %d: %d %d %d %d", c.xid, proc, xid, typ, stat, accept)
+	}
+
+	return r
+}
+
+func xdrUint32(r *bytes.Reader) (v uint32) {
+	binary.Read(r, binary.BigEndian, &v)
+	return v
+}
+
+func xdrUint64(r *bytes.Reader) (v uint64) {
+	binary.Read(r, binary.BigEndian, &v)
+	return v
+}
+
+func xdrOpaque(r *bytes.Reader) []byte {
+	n := xdrUint32(r)
+	b := make([]byte, (n+3)&^3)
+	r.Read(b)
+	return b[:n]
+}
+
+//nfsAttr decodes the type, size and file id of optional attributes
+func nfsAttr(r *bytes.Reader) (typ uint32, size, fileid uint64) {
+	if xdrUint32(r) == 0 {
+		return 0, 0, 0
+	}
+
+	typ = xdrUint32(r)
+	r.Seek(16, io.SeekCurrent) //mode, nlink, uid and gid
+	size = xdrUint64(r)
+	r.Seek(24, io.SeekCurrent) //used, rdev and fsid
+	fileid = xdrUint64(r)
+	r.Seek(24, io.SeekCurrent) //times
+	return typ, size, fileid
+}
+
+func TestServeNFS(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f1 := bitstest.WriteRandomFile(t, fpath, 5*1024*1024)
+	f1.Close()
+
+	err = os.Mkdir(filepath.Join(wd1, "dir"), 0777)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(wd1, "dir", "small.txt"), []byte("not split"), 0666)
+	}
+
+	if err == nil {
+		err = os.Symlink("dir/small.txt", filepath.Join(wd1, "link"))
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveCtx, stop := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- repo1.ServeNFS(serveCtx, "HEAD", l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	c := &nfsClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	const nfs, mount = uint32(100003), uint32(100005)
+
+	//only the root of the tree is exported
+	r := c.call(mount, 1, "/other")
+	if status := xdrUint32(r); status != 2 {
+		t.Errorf("expected mounting an unknown export to fail, got: %d", status)
+	}
+
+	r = c.call(mount, 1, "/")
+	if status := xdrUint32(r); status != 0 {
+		t.Fatalf("expected to mount the root, got: %d", status)
+	}
+
+	root := xdrOpaque(r)
+
+	//lookup returns the handle and attributes of an entry
+	lookup := func(dir []byte, name string) (fh []byte, typ uint32, size, fileid uint64, status uint32) {
+		r := c.call(nfs, 3, dir, name)
+		status = xdrUint32(r)
+		if status != 0 {
+			return nil, 0, 0, 0, status
+		}
+
+		fh = xdrOpaque(r)
+		typ, size, fileid = nfsAttr(r)
+		return fh, typ, size, fileid, 0
+	}
+
+	//read returns the content of a file in reads of 'n' bytes
+	read := func(fh []byte, n uint32) []byte {
+		content := []byte{}
+		for {
+			r := c.call(nfs, 6, fh, uint64(len(content)), n)
+			if status := xdrUint32(r); status != 0 {
+				t.Fatalf("failed to read at %d: %d", len(content), status)
+			}
+
+			nfsAttr(r)
+			xdrUint32(r) //count
+			eof := xdrUint32(r)
+			content = append(content, xdrOpaque(r)...)
+			if eof != 0 {
+				return content
+			}
+		}
+	}
+
+	expected, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, typ, size, _, status := lookup(root, "file1.bin")
+	if status != 0 || typ != 1 || size != uint64(len(expected)) {
+		t.Fatalf("expected the split file to be found with its original size, got: %d %d %d", status, typ, size)
+	}
+
+	if content := read(fh, 128*1024); !bytes.Equal(content, expected) {
+		t.Errorf("served split file should equal the original content, got %d bytes", len(content))
+	}
+
+	dir, typ, _, _, status := lookup(root, "dir")
+	if status != 0 || typ != 2 {
+		t.Fatalf("expected the directory to be found, got: %d %d", status, typ)
+	}
+
+	small, _, _, _, status := lookup(dir, "small.txt")
+	if status != 0 || string(read(small, 4)) != "not split" {
+		t.Errorf("expected the file that isn't split to be served as is, got: %d", status)
+	}
+
+	if parent, _, _, _, status := lookup(dir, ".."); status != 0 || !bytes.Equal(parent, root) {
+		t.Errorf("expected the parent of the directory to be the root, got: %d", status)
+	}
+
+	link, typ, _, _, status := lookup(root, "link")
+	if status != 0 || typ != 5 {
+		t.Fatalf("expected the symlink to be found, got: %d %d", status, typ)
+	}
+
+	r = c.call(nfs, 5, link)
+	if status := xdrUint32(r); status != 0 {
+		t.Fatalf("failed to read link: %d", status)
+	}
+
+	nfsAttr(r)
+	if target := string(xdrOpaque(r)); target != "dir/small.txt" {
+		t.Errorf("expected the target of the symlink, got: %s", target)
+	}
+
+	if _, _, _, _, status = lookup(root, "missing"); status != 2 {
+		t.Errorf("expected a missing entry to not be found, got: %d", status)
+	}
+
+	//entries are listed over several calls when they don't fit in one
+	for _, plus := range []bool{false, true} {
+		names := []string{}
+		cookie := uint64(0)
+		for eof := uint32(0); eof == 0; {
+			if plus {
+				r = c.call(nfs, 17, root, cookie, uint64(0), uint32(512), uint32(320))
+			} else {
+				r = c.call(nfs, 16, root, cookie, uint64(0), uint32(150))
+			}
+
+			if status := xdrUint32(r); status != 0 {
+				t.Fatalf("failed to read directory after %d: %d", cookie, status)
+			}
+
+			nfsAttr(r)
+			xdrUint64(r) //verifier
+			for xdrUint32(r) != 0 {
+				xdrUint64(r) //fileid
+				names = append(names, string(xdrOpaque(r)))
+				cookie = xdrUint64(r)
+				if plus {
+					nfsAttr(r)
+					if xdrUint32(r) != 0 {
+						xdrOpaque(r)
+					}
+				}
+			}
+
+			eof = xdrUint32(r)
+		}
+
+		if strings.Join(names, " ") != ". .. .bitsconfig .gitattributes dir file1.bin link" {
+			t.Errorf("expected all entries to be listed (plus: %v), got: %v", plus, names)
+		}
+	}
+
+	//anything that modifies the tree is refused
+	r = c.call(nfs, 7, fh, uint64(0), uint32(1), uint32(0), []byte{0x01})
+	if status := xdrUint32(r); status != 30 {
+		t.Errorf("expected writes to fail as the filesystem is read-only, got: %d", status)
+	}
+
+	r = c.call(nfs, 1, make([]byte, 8))
+	if status := xdrUint32(r); status != 70 {
+		t.Errorf("expected an unknown handle to be stale, got: %d", status)
+	}
+
+	stop()
+	err = <-errCh
+	if err != nil {
+		t.Errorf("serving should end without error when stopped, got: %v", err)
+	}
+}
+
+func TestInstallSharedScope(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	wd2, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	conf1 := bits.DefaultConf()
+	conf1.DeduplicationScope = 0
+	err := repo1.Install(ioutil.Discard, conf1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = bits.ParseDeduplicationScope(fmt.Sprintf("%d", conf1.DeduplicationScope)); err != nil {
+		t.Fatalf("expected a random scope to be generated, got: %v", err)
+	}
+
+	//the shared configuration is normally committed and pulled by others
+	data, err := ioutil.ReadFile(filepath.Join(wd1, bits.SharedConfFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd2, bits.SharedConfFile), data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo2.Install(ioutil.Discard, bits.DefaultConf())
+	if err == nil {
+		t.Errorf("expected a scope that conflicts with the shared scope to fail")
+	}
+
+	conf2 := bits.DefaultConf()
+	conf2.DeduplicationScope = 0
+	err = repo2.Install(ioutil.Discard, conf2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf2.DeduplicationScope != conf1.DeduplicationScope {
+		t.Errorf("expected the shared scope %d to be used, got: %d", conf1.DeduplicationScope, conf2.DeduplicationScope)
+	}
+
+	//configuration is read when the repository is setup
+	repo2, err = bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys1 := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys2 := bytes.NewBuffer(nil)
+	err = repo2.Split(bytes.NewReader(content), keys2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(keys1.Bytes(), keys2.Bytes()) {
+		t.Errorf("expected clones that share the scope to split files the same way")
+	}
+}
+
+func TestSplitStreamsKeys(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	prev := bits.SplitFlushInterval
+	bits.SplitFlushInterval = 0
+	defer func() { bits.SplitFlushInterval = prev }()
+
+	content := bits.BenchContent(24*1024*1024, 1)
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := repo1.Split(inr, outw)
+		outw.CloseWithError(err)
+		errCh <- err
+	}()
+
+	go inw.Write(content[:16*1024*1024])
+
+	//the first keys are written while the content is still being read
+	s := bufio.NewScanner(outr)
+	lines := []string{}
+	for len(lines) < 3 && s.Scan() {
+		lines = append(lines, s.Text())
+	}
+
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "version ") {
+		t.Fatalf("expected the header, version and first key before the content ended, got: %v, %v", lines, s.Err())
+	}
+
+	_, err := bits.ParseKeyLine([]byte(lines[2]))
+	if err != nil {
+		t.Errorf("expected a key line, got: %v", err)
+	}
+
+	go func() {
+		inw.Write(content[16*1024*1024:])
+		inw.Close()
+	}()
+
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := repo1.ReadPointer(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr.Size() != int64(len(content)) {
+		t.Errorf("expected the streamed pointer to describe all content, got: %d bytes", ptr.Size())
+	}
+}
+
+func TestSplitConcurrency(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	prev := bits.SplitConcurrency
+	defer func() { bits.SplitConcurrency = prev }()
+
+	content := make([]byte, 24*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks hashed and encrypted out of order are still written in order, and
+	//each chunk is stored again as the local chunks are removed in between
+	var expected []byte
+	for _, concurrency := range []int{1, 3, 16} {
+		bits.SplitConcurrency = concurrency
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected == nil {
+			expected = ptr.Bytes()
+		}
+
+		if !bytes.Equal(ptr.Bytes(), expected) {
+			t.Errorf("expected splitting with %d workers to write the same pointer as with 1, got:\n%s", concurrency, ptr.String())
+		}
+
+		out := bytes.NewBuffer(nil)
+		err = repo1.Combine(bytes.NewReader(ptr.Bytes()), out)
+		if err != nil || !bytes.Equal(out.Bytes(), content) {
+			t.Errorf("expected chunks split with %d workers to combine into the original content: %v", concurrency, err)
+		}
+
+		err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+			p, err := repo1.Path(k, false)
+			if err != nil {
+				return err
+			}
+
+			return os.Remove(p)
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPointerSentinels(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	content := bits.BenchContent(2*1024*1024, 1)
+	old := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(content), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.pointer-header": "--- ACME CONFIDENTIAL: decode with git-bits ---",
+	})
+
+	_, err = bits.NewRepository(wd1, nil)
+	if err == nil || !strings.Contains(err.Error(), "must be exactly 64") {
+		t.Fatalf("expected a sentinel of the wrong length to be refused, got: %v", err)
+	}
+
+	header := "--- ACME CONFIDENTIAL: decode this file with git-bits ----------"
+	footer := "======================== end of ACME chunks ===================="
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.pointer-header": header,
+		"bits.pointer-footer": footer,
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(ptr.String(), header+"\n") || !strings.HasSuffix(ptr.String(), footer+"\n") {
+		t.Errorf("expected the pointer to use the configured sentinels, got:\n%s", ptr.String())
+	}
+
+	//pointers with the default sentinels are still read
+	for _, p := range []string{ptr.String(), old.String()} {
+		out := bytes.NewBuffer(nil)
+		err = repo1.Combine(strings.NewReader(p), out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out.Bytes(), content) {
+			t.Errorf("expected the pointer to combine into the original content")
+		}
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.strict-sentinels": "true",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo1.ReadPointer(bytes.NewReader(old.Bytes()))
+	if err == nil {
+		t.Errorf("expected the default sentinels to be no longer recognized")
+	}
+
+	_, err = repo1.ReadPointer(bytes.NewReader(ptr.Bytes()))
+	if err != nil {
+		t.Errorf("expected the configured sentinels to be recognized, got: %v", err)
+	}
+}
+
+func TestCombineParallel(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := bits.BenchContent(20*1024*1024, 1)
+	keys := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//content is written after what the file holds already, also when it
+	//is appended to
+	for _, flag := range []int{os.O_TRUNC, os.O_APPEND} {
+		fpath := filepath.Join(wd1, "combined.bin")
+		f, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|flag, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.Write([]byte("before"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo1.Combine(bytes.NewReader(keys.Bytes()), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.Write([]byte("after"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Close()
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove(fpath)
+		expected := append(append([]byte("before"), content...), []byte("after")...)
+		if !bytes.Equal(data, expected) {
+			t.Errorf("expected the combined file to equal the original content (flag %d), got %d bytes", flag, len(data))
+		}
+	}
+
+	//a pointer without chunk sizes is combined in order
+	sizeless := bytes.NewBuffer(nil)
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		_, err := fmt.Fprintf(sizeless, "%x\n", k)
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "combined")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+	err = repo1.Combine(sizeless, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, content) {
+		t.Errorf("expected keys without sizes to combine into the original content, got %d bytes", len(data))
+	}
+}
+
+func TestChunkBufferSize(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunk-buffer": "4MiB",
+	})
+
+	_, err := bits.NewRepository(wd1, nil)
+	if err == nil || !strings.Contains(err.Error(), "smaller than the largest chunk") {
+		t.Fatalf("expected a buffer smaller than the largest chunk to be refused, got: %v", err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunk-buffer": "32MiB",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bits.BenchContent(20*1024*1024, 1)
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = repo1.Combine(keys, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("expected content split with a larger buffer to combine into the original")
+	}
+}
+
+func TestReplicaConf(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.aws-s3-bucket-name": "data",
+		"bits.aws-s3-replicas":    "https://s3.eu-west-1.amazonaws.com/data-eu",
+	})
+
+	_, err := bits.NewRepository(wd1, nil)
+	if err == nil || !strings.Contains(err.Error(), "without scheme") {
+		t.Fatalf("expected a replica with a scheme to be refused, got: %v", err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.aws-s3-replicas": "data-us,s3.eu-west-1.amazonaws.com/data-eu",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := repo1.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range settings {
+		if s.Name == "bits.aws-s3-replicas" && s.Value != "data-us,s3.eu-west-1.amazonaws.com/data-eu" {
+			t.Errorf("expected the replicas in order, got: %s", s.Value)
+		}
+	}
+}
+
+func TestSplitBLAKE3(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.key-hash": "blake3",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := repo1.ReadPointer(bytes.NewReader(keys.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr.KeyHash != bits.BLAKE3 || len(ptr.Chunks) < 1 {
+		t.Fatalf("expected pointer to record blake3 keys, got: %+v", ptr)
+	}
+
+	if ptr.Chunks[0].K != bits.BLAKE3.Sum(content[:ptr.Chunks[0].Size]) {
+		t.Errorf("expected the first key to be the blake3 hash of the first chunk")
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = repo1.Combine(bytes.NewReader(keys.Bytes()), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("combined chunks should equal the original content")
+	}
+}
+
+func TestFetchFromPeer(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	wd2, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 3*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(bits.NewChunkServer(repo1))
+	defer srv.Close()
+
+	bitstest.GitConfigure(t, ctx, repo2, map[string]string{
+		"bits.peers": srv.Listener.Addr().String(),
+	})
+
+	//configuration is read when the repository is setup
+	repo2, err = bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo2.Fetch(bytes.NewReader(keys.Bytes()), ioutil.Discard)
+	if err != nil {
+		t.Fatalf("fetching from peer without a remote should succeed, got: %v", err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = repo2.Combine(bytes.NewReader(keys.Bytes()), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("combined chunks from peer should equal the original content")
+	}
+}
+
+func TestFetchRetryFailed(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	wd2, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 3*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//without a remote or peers all chunks fail, but all keys are passed on
+	out := bytes.NewBuffer(nil)
+	err = repo2.Fetch(bytes.NewReader(keys.Bytes()), out)
+	if err == nil || !strings.Contains(err.Error(), "--retry-failed") {
+		t.Errorf("fetching without a remote should fail with a hint to retry, got: %v", err)
+	}
+
+	nkeys := 0
+	err = repo2.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		nkeys++
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(out.String(), "\n"); lines != nkeys {
+		t.Errorf("expected all %d keys to be written after failures, got %d", nkeys, lines)
+	}
+
+	//keys that fail to be read are reported before the chunks that failed
+	pr, pw := io.Pipe()
+	pw.CloseWithError(fmt.Errorf("connection reset"))
+	err = repo2.Fetch(io.MultiReader(bytes.NewReader(keys.Bytes()), pr), ioutil.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to scan chunk keys: connection reset") || !strings.Contains(err.Error(), "--retry-failed") {
+		t.Errorf("expected the read error to be reported together with the failed chunks, got: %v", err)
+	}
+
+	//once a peer provides the chunks, retrying fetches all of them
+	srv := httptest.NewServer(bits.NewChunkServer(repo1))
+	defer srv.Close()
+
+	bitstest.GitConfigure(t, ctx, repo2, map[string]string{
+		"bits.peers": srv.Listener.Addr().String(),
+	})
+
+	repo2, err = bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetched, remaining, err := repo2.RetryFailedFetches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched != nkeys || remaining != 0 {
+		t.Errorf("expected %d chunks to be fetched on retry and none to remain, got %d and %d", nkeys, fetched, remaining)
+	}
+
+	fetched, _, err = repo2.RetryFailedFetches()
+	if err != nil || fetched != 0 {
+		t.Errorf("expected nothing to retry after a successful retry, got: %d, %v", fetched, err)
+	}
+}
+
+func TestFetchAbsent(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	wd2, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	ptr := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(bits.BenchContent(2*1024*1024, 1)), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo2, map[string]string{
+		"bits.absent-ttl": "500ms",
+	})
+
+	repo2, err = bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obs := &recordingObserver{}
+	mem := bits.NewMemoryRemote()
+	repo2.SetRemote(mem)
+	repo2.UseRemoteMiddleware(bits.ObserveRemote(obs))
+	reads := func() (n int) {
+		obs.mu.Lock()
+		defer obs.mu.Unlock()
+		for _, op := range obs.started {
+			if op.Method == "read" {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	//the chunks were never pushed, the remote is only asked once
+	err = repo2.Fetch(bytes.NewReader(ptr.Bytes()), ioutil.Discard)
+	if err == nil {
+		t.Fatal("expected fetching chunks that were never pushed to fail")
+	}
+
+	asked := reads()
+	if asked == 0 {
+		t.Fatal("expected the remote to be asked for the chunks")
+	}
+
+	err = repo2.Fetch(bytes.NewReader(ptr.Bytes()), ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "bits.absent-ttl") {
+		t.Errorf("expected fetching again to fail without asking the remote, got: %v", err)
+	}
+
+	if reads() != asked {
+		t.Errorf("expected the remote not to be asked again, it was asked %d times instead of %d", reads(), asked)
+	}
+
+	//once another machine pushed them they are fetched after the ttl
+	repo1.SetRemote(mem)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	err = repo2.Fetch(bytes.NewReader(ptr.Bytes()), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkServerTokens(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var k bits.K
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(key bits.K) error {
+		k = key
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := repo1.Path(k, false)
+	chunk, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(bits.NewChunkServer(repo2))
+	defer srv.Close()
+
+	do := func(method, token string, body []byte) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s%x", srv.URL, bits.ChunkPathPrefix, k), bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	//without tokens chunks can be read but not stored
+	if code := do("PUT", "", chunk); code != http.StatusUnauthorized {
+		t.Errorf("storing without a token should be unauthorized, got: %d", code)
+	}
+
+	if code := do("GET", "", nil); code != http.StatusNotFound {
+		t.Errorf("reading a missing chunk without tokens issued should be not found, got: %d", code)
+	}
+
+	ci, err := repo2.IssueToken("ci", bits.ReadScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := repo2.IssueToken("dev", bits.WriteScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo2.IssueToken("ci", bits.WriteScope)
+	if err == nil {
+		t.Errorf("issuing a token with a name that is taken should fail")
+	}
+
+	if code := do("PUT", ci, chunk); code != http.StatusForbidden {
+		t.Errorf("storing with a read token should be forbidden, got: %d", code)
+	}
+
+	if code := do("PUT", dev, chunk[1:]); code != http.StatusBadRequest {
+		t.Errorf("storing content that doesn't hash to the key should be a bad request, got: %d", code)
+	}
+
+	if code := do("PUT", dev, chunk); code != http.StatusCreated {
+		t.Errorf("storing with a write token should create the chunk, got: %d", code)
+	}
+
+	if code := do("GET", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("reading without a token once tokens are issued should be unauthorized, got: %d", code)
+	}
+
+	if code := do("GET", ci, nil); code != http.StatusOK {
+		t.Errorf("reading with a read token should succeed, got: %d", code)
+	}
+
+	rotated, err := repo2.RotateToken("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := do("GET", ci, nil); code != http.StatusUnauthorized {
+		t.Errorf("reading with a rotated token should be unauthorized, got: %d", code)
+	}
+
+	//peers send the configured token
+	wd3, repo3 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.GitConfigure(t, ctx, repo3, map[string]string{
+		"bits.peers":      srv.Listener.Addr().String(),
+		"bits.peer-token": rotated,
+	})
+
+	repo3, err = bits.NewRepository(wd3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo3.Fetch(strings.NewReader(fmt.Sprintf("%x\n", k)), ioutil.Discard)
+	if err != nil {
+		t.Errorf("fetching from a peer with a read token should succeed, got: %v", err)
+	}
+
+	err = repo2.RevokeToken("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := repo2.Tokens()
+	if err != nil || len(tokens) != 1 || tokens[0].Name != "ci" {
+		t.Errorf("expected only the ci token to remain, got: %v, %v", tokens, err)
+	}
+}
+
+func TestChunkServerMetrics(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var k bits.K
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(key bits.K) error {
+		k = key
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := bits.NewMetrics()
+	repo1.SetMetrics(m)
+	srv := httptest.NewServer(bits.NewChunkServer(repo1))
+	defer srv.Close()
+
+	for _, key := range []bits.K{k, {}} {
+		resp, err := http.Get(fmt.Sprintf("%s%s%x", srv.URL, bits.ChunkPathPrefix, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	p, _ := repo1.Path(k, false)
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := m.Value("git_bits_bytes_sent_total", "mode", "serve"); n < float64(fi.Size()) {
+		t.Errorf("expected at least the chunk's %d bytes to be counted as sent, got: %v", fi.Size(), n)
+	}
+
+	msrv := httptest.NewServer(m)
+	defer msrv.Close()
+
+	resp, err := http.Get(msrv.URL + bits.MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"# TYPE git_bits_requests_total counter",
+		`git_bits_requests_total{code="200",method="GET",mode="serve"} 1`,
+		`git_bits_requests_total{code="404",method="GET",mode="serve"} 1`,
+		`git_bits_cache_hits_total{mode="serve"} 1`,
+		`git_bits_cache_misses_total{mode="serve"} 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected metrics to contain '%s', got: \n%s", line, body)
+		}
+	}
+}
+
+//spanRecorder keeps the spans it is asked to export
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []bits.SpanData
+}
+
+func (rec *spanRecorder) ExportSpans(spans []bits.SpanData) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.spans = append(rec.spans, spans...)
+	return nil
+}
+
+//named returns the recorded spans with the given name
+func (rec *spanRecorder) named(name string) (spans []bits.SpanData) {
+	for _, sp := range rec.spans {
+		if sp.Name == name {
+			spans = append(spans, sp)
+		}
+	}
+
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 3*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &spanRecorder{}
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	repo1.SetTracer(bits.NewTracer(rec))
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.named("split")) != 1 {
+		t.Errorf("expected a split span, got: %+v", rec.spans)
+	}
+
+	push := rec.named("push")
+	if len(push) != 1 || push[0].ParentSpanID != [8]byte{} {
+		t.Fatalf("expected a single root push span, got: %+v", push)
+	}
+
+	uploads := rec.named("remote.upload")
+	if len(uploads) != len(mem.Keys()) || len(rec.named("remote.list")) != 1 {
+		t.Errorf("expected a list span and an upload span per chunk (%d), got: %+v", len(mem.Keys()), rec.spans)
+	}
+
+	for _, sp := range append(uploads, rec.named("remote.list")...) {
+		if sp.TraceID != push[0].TraceID || sp.ParentSpanID != push[0].SpanID {
+			t.Errorf("expected remote call '%s' to be a child of the push span", sp.Name)
+		}
+	}
+
+	//the otlp exporter is configured through the environment
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("X-Tenant") != "bits" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "X-Tenant=bits")
+	t.Setenv("TRACEPARENT", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	tracer, err := bits.NewTracerFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo2.SetRemote(mem)
+	repo2.SetTracer(tracer)
+	err = repo2.Fetch(bytes.NewReader(keys.Bytes()), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, part := range []string{`"resourceSpans"`, `"name":"fetch-chunk"`, `"traceId":"0af7651916cd43dd8448eb211c80319c"`, `"parentSpanId":"b7ad6b7169203331"`} {
+		if !strings.Contains(string(body), part) {
+			t.Errorf("expected the exported spans to contain %s, got: %s", part, body)
+		}
+	}
+}
+
+func TestTracingConcurrent(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	remote := &slowRemote{MemoryRemote: bits.NewMemoryRemote()}
+	repo1.SetRemote(remote)
+	keys := []*bytes.Buffer{}
+	chunks := map[string]int{}
+	for i := 0; i < 2; i++ {
+		content := make([]byte, 3*1024*1024)
+		_, err := rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store, err := repo1.LocalStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo1.Push(store, bytes.NewReader(buf.Bytes()), "origin")
+		store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo1.ForEach(bytes.NewReader(buf.Bytes()), func(k bits.K) error {
+			chunks[fmt.Sprintf("%x", k)] = i
+			p, err := repo1.Path(k, false)
+			if err != nil {
+				return err
+			}
+
+			return os.Remove(p)
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, buf)
+	}
+
+	//both fetches are in flight at the same time, as the remote reads slowly
+	rec := &spanRecorder{}
+	repo1.SetTracer(bits.NewTracer(rec))
+	var wg sync.WaitGroup
+	errs := make(chan error, len(keys))
+	for _, buf := range keys {
+		wg.Add(1)
+		go func(buf *bytes.Buffer) {
+			defer wg.Done()
+			errs <- repo1.Fetch(bytes.NewReader(buf.Bytes()), ioutil.Discard)
+		}(buf)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetches := rec.named("fetch")
+	if len(fetches) != 2 {
+		t.Fatalf("expected both fetch spans to be exported, got: %+v", fetches)
+	}
+
+	for _, sp := range fetches {
+		if sp.ParentSpanID != [8]byte{} {
+			t.Errorf("expected each fetch to be a root span, got: %+v", sp)
+		}
+	}
+
+	//each chunk span belongs to the fetch of the content it is part of
+	fetchedBy := map[[8]byte]int{}
+	fetched := rec.named("fetch-chunk")
+	if len(fetched) != len(chunks) {
+		t.Fatalf("expected a span for each of the %d chunks, got: %d", len(chunks), len(fetched))
+	}
+
+	for _, sp := range fetched {
+		parent := -1
+		for i, f := range fetches {
+			if sp.TraceID == f.TraceID && sp.ParentSpanID == f.SpanID {
+				parent = i
+			}
+		}
+
+		if parent < 0 || len(sp.Attrs) < 1 {
+			t.Fatalf("expected chunk span to be a child of one of the fetches, got: %+v", sp)
+		}
+
+		content, ok := chunks[fmt.Sprint(sp.Attrs[0].Value)]
+		if !ok {
+			t.Fatalf("unexpected chunk span: %+v", sp)
+		}
+
+		if i, ok := fetchedBy[fetches[parent].SpanID]; ok && i != content {
+			t.Errorf("expected the chunks of a fetch to be of the same content, got: %+v", sp)
+		}
+
+		fetchedBy[fetches[parent].SpanID] = content
+	}
+
+	//an operation that starts afterwards is a root of its own and is exported
+	err := repo1.Fetch(bytes.NewReader(keys[0].Bytes()), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches = rec.named("fetch")
+	if len(fetches) != 3 || fetches[2].ParentSpanID != [8]byte{} {
+		t.Errorf("expected a third root fetch span to be exported, got: %+v", fetches)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"user.email":        "auditor@example.com",
+		"bits.audit-log":    "bits-audit.log",
+		"bits.audit-remote": "true",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := ioutil.ReadFile(filepath.Join(wd1, ".git", "bits-audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//both logs hold an entry for each pushed chunk
+	for _, log := range [][]byte{local, mem.AuditLog()} {
+		entries := []bits.AuditEntry{}
+		dec := json.NewDecoder(bytes.NewReader(log))
+		for dec.More() {
+			e := bits.AuditEntry{}
+			err = dec.Decode(&e)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries = append(entries, e)
+		}
+
+		if len(entries) != len(mem.Keys()) {
+			t.Fatalf("expected an entry for each of the %d pushed chunks, got: %s", len(mem.Keys()), log)
+		}
+
+		for _, e := range entries {
+			if e.Op != "push" || e.User != "auditor@example.com" || e.Bytes == 0 || len(e.Key) != 64 || e.Time.IsZero() {
+				t.Errorf("unexpected audit entry: %+v", e)
+			}
+		}
+	}
+
+	//fetches aren't recorded unless configured
+	repo2.SetRemote(mem)
+	err = repo2.Fetch(bytes.NewReader(keys.Bytes()), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := bytes.Count(mem.AuditLog(), []byte(`"op":"fetch"`)); n != 0 {
+		t.Errorf("expected no fetches to be recorded by a clone without auditing, got %d", n)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	get := func(conf *bits.Conf) error {
+		tlsConf, err := conf.TLSConfig()
+		if err != nil {
+			return err
+		}
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}
+
+	err := get(&bits.Conf{})
+	if err == nil {
+		t.Errorf("expected a self-signed certificate to be refused by default")
+	}
+
+	err = get(&bits.Conf{InsecureSkipVerify: true})
+	if err != nil {
+		t.Errorf("expected certificate to be accepted without verification, got: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "test_ca_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = get(&bits.Conf{CABundle: bundle})
+	if err != nil {
+		t.Errorf("expected certificate in the ca bundle to be trusted, got: %v", err)
+	}
+
+	_, err = (&bits.Conf{CABundle: filepath.Join(dir, "missing.pem")}).TLSConfig()
+	if err == nil {
+		t.Errorf("expected a missing ca bundle to fail")
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.read-timeout":       "200ms",
+		"bits.max-conns-per-host": "1",
+	})
+
+	conf := bits.DefaultConf()
+	err := conf.OverwriteFromGit(repo1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.ReadTimeout != 200*time.Millisecond || conf.MaxConnsPerHost != 1 {
+		t.Fatalf("expected the timeout and limit to be configured, got: %s and %d", conf.ReadTimeout, conf.MaxConnsPerHost)
+	}
+
+	client, err := conf.HTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var active, most int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stall":
+			time.Sleep(time.Second)
+		case "/trickle":
+
+			//a transfer that takes longer than the timeout, but never stalls
+			for i := 0; i < 6; i++ {
+				w.Write([]byte("x"))
+				w.(http.Flusher).Flush()
+				time.Sleep(100 * time.Millisecond)
+			}
+		default:
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+
+	defer srv.Close()
+	get := func(path string) (data []byte, err error) {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			return nil, err
+		}
+
+		defer resp.Body.Close()
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	_, err = get("/stall")
+	if err == nil {
+		t.Errorf("expected a stalled response to time out")
+	}
+
+	data, err := get("/trickle")
+	if err != nil || len(data) != 6 {
+		t.Errorf("expected a slow transfer that doesn't stall to complete, got %d bytes: %v", len(data), err)
+	}
+
+	//requests wait for the single connection that is allowed
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := get("/")
+			if err != nil {
+				t.Errorf("expected request to succeed, got: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	if most != 1 {
+		t.Errorf("expected at most 1 request to be served at a time, got: %d", most)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.read-timeout": "soon",
+	})
+
+	err = bits.DefaultConf().OverwriteFromGit(repo1)
+	if err == nil || !strings.Contains(err.Error(), "expected a duration") {
+		t.Errorf("expected an invalid timeout to be refused, got: %v", err)
+	}
+}
+
+func TestCDNChunkReader(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "test_cdn_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "pk.pem")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the edge verifies the signature over the canned policy
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		resource := "http://" + r.Host + r.URL.Path
+		policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%s}}}]}`, resource, q.Get("Expires"))
+		sig, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(q.Get("Signature")))
+		sum := sha1.Sum([]byte(policy))
+		if err != nil || q.Get("Key-Pair-Id") != "APKAEXAMPLE" || rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, sum[:], sig) != nil {
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+
+		fmt.Fprintf(w, "chunk %s", strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+
+	defer srv.Close()
+	cdn, err := bits.NewCDN(srv.URL+"/", "APKAEXAMPLE", keyFile, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := cdn.ChunkReader(bits.K{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != fmt.Sprintf("chunk %x", bits.K{0x01}) {
+		t.Errorf("unexpected chunk from cdn: %s", data)
+	}
+
+	cdn, err = bits.NewCDN(srv.URL, "APKAOTHER", keyFile, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cdn.ChunkReader(bits.K{0x01})
+	if err == nil {
+		t.Errorf("expected a url signed for another key pair to be refused")
+	}
+}
+
+//s3Stub serves the objects of a bucket from memory, it honours conditional
+//writes and records the requests it received
+type s3Stub struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	requests []*http.Request
+	corrupt  bool
+}
+
+func newS3Stub() *s3Stub {
+	return &s3Stub{objects: map[string][]byte{}, modified: map[string]time.Time{}}
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r)
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	data, ok := s.objects[name]
+	switch r.Method {
+	case "PUT":
+		if ok && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		//like s3 the content is checked against the digest that was sent
+		if s.corrupt && len(body) > 0 {
+			body[0] ^= 0xff
+		}
+
+		sum := md5.Sum(body)
+		if digest := r.Header.Get("Content-Md5"); digest != "" && digest != base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<Error><Code>BadDigest</Code><Message>The Content-MD5 you specified did not match what we received.</Message></Error>")
+			return
+		}
+
+		s.objects[name] = body
+		s.modified[name] = time.Now()
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum))
+	case "GET", "HEAD":
+		if r.URL.Query().Get("list-type") == "2" {
+			s.list(w, r.URL.Query().Get("prefix"))
+			return
+		}
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Last-Modified", s.modified[name].UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.Write(data)
+	case "DELETE":
+		delete(s.objects, name)
+		delete(s.modified, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+//list writes a listing of the objects of which the name starts with 'prefix'
+func (s *s3Stub) list(w http.ResponseWriter, prefix string) {
+	names := []string{}
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	fmt.Fprintf(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+	for _, name := range names {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified></Contents>", name, s.modified[name].UTC().Format(time.RFC3339))
+	}
+
+	fmt.Fprintf(w, "</ListBucketResult>")
+}
+
+//object returns the object stored under 'name'
+func (s *s3Stub) object(name string) (data []byte, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok = s.objects[name]
+	return data, ok
+}
+
+//s3StubRemote returns a remote for a bucket that is served by a new stub
+func s3StubRemote(t *testing.T, repo *bits.Repository) (remote *bits.S3Remote, stub *s3Stub, close func()) {
+	stub = newS3Stub()
+	srv := httptest.NewServer(stub)
+	remote, err := bits.NewS3Remote(repo, "origin", "bucket", "access-key", "secret-key")
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	remote.UseS3Server(srv.Listener.Addr().String())
+	return remote, stub, srv.Close
+}
+
+func TestS3ClaimChunk(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	remote, stub, closeStub := s3StubRemote(t, repo1)
+	defer closeStub()
+
+	k := bits.K{0x01}
+	claim := fmt.Sprintf(".claims/%x", k)
+
+	//a chunk that nobody claimed is claimed
+	claimed, err := remote.ClaimChunk(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := stub.object(claim); !claimed || !ok {
+		t.Fatalf("expected a fresh claim to succeed and be stored, got: %v", claimed)
+	}
+
+	//a live claim by another writer is respected
+	claimed, err = remote.ClaimChunk(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed {
+		t.Errorf("expected a live claim to not be taken over")
+	}
+
+	//a claim older then the timeout is taken over
+	stub.mu.Lock()
+	stub.modified[claim] = time.Now().Add(-bits.ClaimTimeout - time.Minute)
+	stub.mu.Unlock()
+	claimed, err = remote.ClaimChunk(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !claimed {
+		t.Errorf("expected an abandoned claim to be taken over")
+	}
+
+	stub.mu.Lock()
+	age := time.Since(stub.modified[claim])
+	stub.mu.Unlock()
+	if age > time.Minute {
+		t.Errorf("expected the claim to be renewed when taken over, it is %s old", age)
+	}
+
+	//releasing the claim allows a fresh claim again
+	err = remote.ReleaseChunk(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := stub.object(claim); ok {
+		t.Errorf("expected the claim to be removed on release")
+	}
+
+	claimed, err = remote.ClaimChunk(k)
+	if err != nil || !claimed {
+		t.Errorf("expected a released chunk to be claimed again, got: %v (%v)", claimed, err)
+	}
+}
+
+//test that s3 requests ask the requester to pay only when configured
+func TestS3RequesterPays(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	for _, pays := range []bool{false, true} {
+		bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+			"bits.requester-pays": fmt.Sprint(pays),
+		})
+
+		repo, err := bits.NewRepository(wd1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remote, stub, closeStub := s3StubRemote(t, repo)
+		k := bits.K{0x01}
+		_, err = remote.ClaimChunk(k)
+		if err == nil {
+			err = remote.ReleaseChunk(k)
+		}
+
+		closeStub()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//the header is only sent, and signed, when the requester pays
+		if len(stub.requests) == 0 {
+			t.Fatalf("expected requests to be sent to the bucket")
+		}
+
+		for _, r := range stub.requests {
+			header := r.Header.Get("x-amz-request-payer")
+			signed := strings.Contains(r.Header.Get("Authorization"), "x-amz-request-payer")
+			if pays && (header != "requester" || !signed) {
+				t.Errorf("expected %s request to acknowledge and sign the charges, got header '%s' (signed: %v)", r.Method, header, signed)
+			}
+
+			if !pays && (header != "" || signed) {
+				t.Errorf("expected %s request not to acknowledge charges, got header '%s'", r.Method, header)
+			}
+		}
+	}
+}
+
+func TestS3ChunkChecksums(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 3*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, stub, closeStub := s3StubRemote(t, repo1)
+	defer closeStub()
+
+	repo1.SetRemote(remote)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//each chunk is uploaded with digests of its content
+	puts := 0
+	for _, r := range stub.requests {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		data, ok := stub.object(name)
+		if r.Method != "PUT" || !ok || strings.HasSuffix(name, ".md5") {
+			continue
+		}
+
+		puts++
+		md5sum := md5.Sum(data)
+		shasum := sha256.Sum256(data)
+		if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(md5sum[:]) {
+			t.Errorf("expected chunk '%s' to be uploaded with its md5, got: '%s'", name, r.Header.Get("Content-Md5"))
+		}
+
+		if r.Header.Get("X-Amz-Checksum-Sha256") != base64.StdEncoding.EncodeToString(shasum[:]) {
+			t.Errorf("expected chunk '%s' to be uploaded with its sha256, got: '%s'", name, r.Header.Get("X-Amz-Checksum-Sha256"))
+		}
+	}
+
+	//the etags s3 responded with are recorded for each chunk
+	etags := 0
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		data, ok := stub.object(bits.ChunkObjectName(bits.KeyVersion0, k, 0))
+		if !ok {
+			return fmt.Errorf("expected chunk '%x' to be uploaded", k)
+		}
+
+		return store.View(func(tx *bolt.Tx) error {
+			etag := tx.Bucket(bits.ETagBucket).Get(k[:])
+			if sum := md5.Sum(data); string(etag) != fmt.Sprintf("%x", sum) {
+				t.Errorf("expected the etag of chunk '%x' to be recorded, got: '%s'", k, etag)
+			}
+
+			etags++
+			return nil
+		})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if puts == 0 || puts != etags {
+		t.Errorf("expected a checked upload for each of the %d chunks, got: %d", etags, puts)
+	}
+
+	//content that is corrupted in flight is rejected
+	stub.mu.Lock()
+	stub.corrupt = true
+	stub.mu.Unlock()
+	wc, err := remote.ChunkWriter(bits.K{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wc.Write(content[:1024])
+	err = wc.Close()
+	if err == nil || !strings.Contains(err.Error(), "BadDigest") {
+		t.Errorf("expected an upload that was corrupted in flight to fail, got: %v", err)
+	}
+}
+
+//test pushing and fetching chunks without a remote store
+func TestPushFetchMemory(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f1 := bitstest.WriteRandomFile(t, fpath, 5*1024*1024)
+	f1.Close()
+
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Scan("", "HEAD", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mem.Keys()) != len(strings.Fields(keys.String())) {
+		t.Fatalf("expected %d chunks in the remote, got %d", len(strings.Fields(keys.String())), len(mem.Keys()))
+	}
+
+	err = repo1.Git(ctx, nil, nil, "push", "--no-verify", "origin", "HEAD:refs/heads/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the clone fetches chunks from the same remote to combine the file
+	wd2, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+	repo2.SetRemote(mem)
+	ptr, err := ioutil.ReadFile(filepath.Join(wd2, "file1.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := bytes.NewBuffer(nil)
+	err = repo2.Fetch(bytes.NewReader(ptr), fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	combined := bytes.NewBuffer(nil)
+	err = repo2.Combine(fetched, combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orgContent, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(orgContent, combined.Bytes()) {
+		t.Errorf("expected combined content to equal the original, original has %d bytes combined has %d bytes", len(orgContent), combined.Len())
+	}
+}
+
+func TestGRPCRemote(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_grpc_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	store, err := bits.NewDirRemote(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go bits.NewGRPCChunkServer(store, "secret").Serve(ctx, l, nil)
+	remote, err := bits.NewGRPCRemote(&bits.Conf{GRPCAddress: l.Addr().String(), GRPCPlaintext: true, GRPCToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer remote.Close()
+
+	//chunks are larger then the parts they are streamed in
+	data := make([]byte, 3*bits.GRPCPartSize+10)
+	_, err = rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := bits.K{0x01, 0x02}
+	wc, err := remote.ChunkWriter(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wc.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := remote.ChunkReader(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(read, data) {
+		t.Errorf("expected to read the %d bytes that were written, got %d", len(data), len(read))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = remote.ListChunks(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != fmt.Sprintf("%x\n", k) {
+		t.Errorf("expected the chunk to be listed, got: %s", buf.String())
+	}
+
+	_, err = remote.ChunkReader(bits.K{0x03})
+	if err == nil || !strings.Contains(err.Error(), "NotFound") {
+		t.Errorf("expected reading a chunk that isn't stored to fail as not found, got: %v", err)
+	}
+
+	//calls without the token are refused
+	other, err := bits.NewGRPCRemote(&bits.Conf{GRPCAddress: l.Addr().String(), GRPCPlaintext: true, GRPCToken: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+	err = other.ListChunks(ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "Unauthenticated") {
+		t.Errorf("expected an invalid token to be refused, got: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	conf := bits.DefaultConf()
+	conf.ReadOnly = true
+	err := repo1.Install(ioutil.Discard, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//no hook is installed that would push chunks
+	_, err = os.Stat(filepath.Join(wd1, ".git", "hooks", "pre-push"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected no pre-push hook, got: %v", err)
+	}
+
+	//the setting is kept in the git config
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(make([]byte, 1024)), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	if err != bits.ErrReadOnly {
+		t.Fatalf("expected push to fail with %v, got: %v", bits.ErrReadOnly, err)
+	}
+
+	err = repo1.PushAll(store, "origin")
+	if err != bits.ErrReadOnly {
+		t.Fatalf("expected push all to fail with %v, got: %v", bits.ErrReadOnly, err)
+	}
+
+	if len(mem.Keys()) != 0 {
+		t.Fatalf("expected no chunks to be written, got: %d", len(mem.Keys()))
+	}
+}
+
+func TestChunkObjectName(t *testing.T) {
+	k := bits.K{0xab, 0xcd, 0xef}
+	for depth, expected := range []string{
+		fmt.Sprintf("%x", k),
+		fmt.Sprintf("ab/%x", k),
+		fmt.Sprintf("ab/cd/%x", k),
+		fmt.Sprintf("ab/cd/ef/%x", k),
+	} {
+		name := bits.ChunkObjectName(bits.KeyVersion0, k, depth)
+		if name != expected {
+			t.Errorf("expected chunk name at depth %d to be '%s', got: '%s'", depth, expected, name)
+		}
+	}
+
+	if name := bits.ChunkObjectName(1, k, 1); name != fmt.Sprintf("v1/ab/%x", k) {
+		t.Errorf("expected chunks of other key versions to be named under their version, got: '%s'", name)
+	}
+}
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a commit on master and one on a branch that is deleted
+	for i, args := range [][]string{
+		{"checkout", "-b", "master"},
+		{"checkout", "-b", "side"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+	}
+
+	keys := [][]bits.K{}
+	for _, obj := range []string{"master:file0.bin", "side:file1.bin"} {
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ks := []bits.K{}
+		err = repo1.ForEach(ptr, func(k bits.K) error {
+			ks = append(ks, k)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, ks)
+	}
+
+	//chunks that are not pushed are never removed
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ks := range keys {
+		buf := bytes.NewBuffer(nil)
+		for _, k := range ks {
+			fmt.Fprintf(buf, "%x\n", k)
+		}
+
+		err = repo1.Push(store, buf, "origin")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.Close()
+	defer func(grace time.Duration) { bits.GCGracePeriod = grace }(bits.GCGracePeriod)
+	bits.GCGracePeriod = 0
+
+	//nothing is removed while the blobs exist
+	removed, _, err := repo1.GC(ioutil.Discard, false)
+	if err != nil || removed != 0 {
+		t.Fatalf("expected no chunks to be removed, got: %d (%v)", removed, err)
+	}
+
+	for _, args := range [][]string{
+		{"checkout", "master"},
+		{"branch", "-D", "side"},
+		{"reflog", "expire", "--expire=now", "--all"},
+		{"gc", "--prune=now", "--quiet"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, freed, err := repo1.GC(ioutil.Discard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != len(keys[1]) || freed < 1024*1024 {
+		t.Errorf("expected the %d chunks of the deleted branch to be removed, got: %d (%d bytes)", len(keys[1]), removed, freed)
+	}
+
+	for i, ks := range keys {
+		for _, k := range ks {
+			p, err := repo1.Path(k, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = os.Stat(p)
+			if i == 0 && err != nil {
+				t.Errorf("expected chunk '%x' of master to be kept, got: %v", k, err)
+			} else if i == 1 && !os.IsNotExist(err) {
+				t.Errorf("expected chunk '%x' of the deleted branch to be removed, got: %v", k, err)
+			}
+		}
+	}
+}
+
+func TestPruneLocal(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//each branch adds a file, master is checked out again at the end
+	for i, args := range [][]string{
+		{"checkout", "-b", "master"},
+		{"checkout", "-b", "keep", "master"},
+		{"checkout", "-b", "drop", "master"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+	}
+
+	err = repo1.Git(ctx, nil, nil, "checkout", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string][]bits.K{}
+	for _, obj := range []string{"master:file0.bin", "keep:file1.bin", "drop:file2.bin"} {
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo1.ForEach(ptr, func(k bits.K) error {
+			keys[obj] = append(keys[obj], k)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(grace time.Duration) { bits.GCGracePeriod = grace }(bits.GCGracePeriod)
+	bits.GCGracePeriod = 0
+
+	//chunks that are not pushed are never removed
+	removed, _, err := repo1.PruneLocal(ioutil.Discard, bits.PrunePolicy{}, false)
+	if err != nil || removed != 0 {
+		t.Fatalf("expected no unpushed chunks to be removed, got: %d (%v)", removed, err)
+	}
+
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ks := range keys {
+		buf := bytes.NewBuffer(nil)
+		for _, k := range ks {
+			fmt.Fprintf(buf, "%x\n", k)
+		}
+
+		err = repo1.Push(store, buf, "origin")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.Close()
+
+	//refs that were committed recently are kept by age
+	removed, _, err = repo1.PruneLocal(ioutil.Discard, bits.PrunePolicy{KeepUpdated: 24 * time.Hour}, false)
+	if err != nil || removed != 0 {
+		t.Fatalf("expected the chunks of recent refs to be kept, got: %d (%v)", removed, err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.prune-keep-ref": "refs/heads/kee*",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, freed, err := repo1.PruneLocal(ioutil.Discard, repo1.PrunePolicy(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != len(keys["drop:file2.bin"]) || freed < 1024*1024 {
+		t.Errorf("expected the %d chunks of the dropped branch to be removed, got: %d (%d bytes)", len(keys["drop:file2.bin"]), removed, freed)
+	}
+
+	for obj, ks := range keys {
+		for _, k := range ks {
+			p, err := repo1.Path(k, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = os.Stat(p)
+			if obj != "drop:file2.bin" && err != nil {
+				t.Errorf("expected chunk '%x' of '%s' to be kept, got: %v", k, obj, err)
+			} else if obj == "drop:file2.bin" && !os.IsNotExist(err) {
+				t.Errorf("expected chunk '%x' of '%s' to be removed, got: %v", k, obj, err)
+			}
+		}
+	}
+}
+
+func TestPruneRemote(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a commit on master and one on a branch that is deleted
+	for i, args := range [][]string{
+		{"checkout", "-b", "master"},
+		{"checkout", "-b", "side"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, fmt.Sprintf("file%d.bin", i)), 1024*1024)
+		f.Close()
+
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+	}
+
+	side := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, side, "rev-parse", "side")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.PushAll(store, "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushed := len(mem.Keys())
+	for _, args := range [][]string{
+		{"checkout", "master"},
+		{"branch", "-D", "side"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//chunks of the deleted branch are only moved to the trash
+	report, err := repo1.PruneRemote(ioutil.Discard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Trashed == 0 || report.Purged != 0 || len(mem.Keys()) != pushed-report.Trashed {
+		t.Fatalf("expected the chunks of the deleted branch to be trashed, got: %+v with %d of %d chunks left", report, len(mem.Keys()), pushed)
+	}
+
+	//a branch that references them again restores them
+	err = repo1.Git(ctx, nil, nil, "branch", "side", strings.TrimSpace(side.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = repo1.PruneRemote(ioutil.Discard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Restored == 0 || report.Trashed != 0 || len(mem.Keys()) != pushed {
+		t.Fatalf("expected the trashed chunks to be restored, got: %+v with %d of %d chunks left", report, len(mem.Keys()), pushed)
+	}
+
+	//only after the trash period they are deleted for good
+	err = repo1.Git(ctx, nil, nil, "branch", "-D", "side")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(period time.Duration) { bits.RemoteTrashPeriod = period }(bits.RemoteTrashPeriod)
+	bits.RemoteTrashPeriod = 0
+	trashed := 0
+	for i := 0; i < 2; i++ {
+		report, err = repo1.PruneRemote(ioutil.Discard, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trashed += report.Trashed
+	}
+
+	if report.Purged != trashed || len(mem.Keys()) != pushed-trashed {
+		t.Errorf("expected the %d trashed chunks to be purged, got: %+v with %d of %d chunks left", trashed, report, len(mem.Keys()), pushed)
+	}
+}
+
+//failingRemote fails writing the chunks in 'fail'
+type failingRemote struct {
+	*bits.MemoryRemote
+	fail map[bits.K]struct{}
+}
+
+func (r *failingRemote) ChunkWriter(k bits.K) (wc io.WriteCloser, err error) {
+	if _, ok := r.fail[k]; ok {
+		return nil, fmt.Errorf("failed to write chunk '%x'", k)
+	}
+
+	return r.MemoryRemote.ChunkWriter(k)
+}
+
+func TestCopyChunks(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 16*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := bits.NewMemoryRemote()
+	repo1.SetRemote(from)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := from.Keys()
+	if len(all) < 3 {
+		t.Fatalf("expected at least 3 chunks to copy, got: %d", len(all))
+	}
+
+	//equal checks that each chunk in 'from' is stored byte-identical in 'to'
+	equal := func(to bits.Remote) {
+		for _, k := range all {
+			if !bytes.Equal(readChunk(t, to, k), readChunk(t, from, k)) {
+				t.Errorf("expected chunk '%x' to be copied byte-identical", k)
+			}
+		}
+	}
+
+	//a full copy into an empty remote
+	to := bits.NewMemoryRemote()
+	copied, skipped, err := repo1.CopyChunks(from, to, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied != len(all) || skipped != 0 {
+		t.Errorf("expected all %d chunks to be copied, got: %d copied and %d skipped", len(all), copied, skipped)
+	}
+
+	equal(to)
+
+	//chunks the destination already stores are skipped
+	to = bits.NewMemoryRemote()
+	wc, err := to.ChunkWriter(all[0])
+	if err == nil {
+		_, err = wc.Write(readChunk(t, from, all[0]))
+		if err == nil {
+			err = wc.Close()
+		}
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, skipped, err = repo1.CopyChunks(from, to, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied != len(all)-1 || skipped != 1 {
+		t.Errorf("expected %d chunks to be copied and 1 skipped, got: %d copied and %d skipped", len(all)-1, copied, skipped)
+	}
+
+	equal(to)
+
+	//a partial failure copies the other chunks, a retry only the failed one
+	to = bits.NewMemoryRemote()
+	failing := &failingRemote{MemoryRemote: to, fail: map[bits.K]struct{}{all[1]: {}}}
+	copied, skipped, err = repo1.CopyChunks(from, failing, "", 2)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("failed to copy 1 of %d chunks", len(all))) {
+		t.Errorf("expected the copy of one chunk to fail, got: %v", err)
+	}
+
+	if copied != len(all)-1 || skipped != 0 {
+		t.Errorf("expected %d chunks to be copied, got: %d copied and %d skipped", len(all)-1, copied, skipped)
+	}
+
+	if len(to.Keys()) != len(all)-1 {
+		t.Errorf("expected %d chunks in the destination, got: %d", len(all)-1, len(to.Keys()))
+	}
+
+	copied, skipped, err = repo1.CopyChunks(from, to, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied != 1 || skipped != len(all)-1 {
+		t.Errorf("expected only the failed chunk to be copied on retry, got: %d copied and %d skipped", copied, skipped)
+	}
+
+	equal(to)
+}
+
+func readChunk(t *testing.T, remote bits.Remote, k bits.K) []byte {
+	rc, err := remote.ChunkReader(k)
+	if err != nil {
+		t.Fatalf("failed to read chunk '%x': %v", k, err)
+	}
+
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read chunk '%x': %v", k, err)
+	}
+
+	return data
+}
+
+func TestTier(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//an old tag with a file that the branch removed since and a file it kept
+	for _, name := range []string{"old.bin", "kept.bin"} {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), 1024*1024)
+		f.Close()
+	}
+
+	os.Setenv("GIT_COMMITTER_DATE", "2020-01-01T00:00:00")
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+	os.Unsetenv("GIT_COMMITTER_DATE")
+
+	err = repo1.Git(ctx, nil, nil, "tag", "v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptrs := map[string][]byte{}
+	for _, name := range []string{"old.bin", "kept.bin"} {
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, buf, "cat-file", "blob", "v0:"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptrs[name] = buf.Bytes()
+	}
+
+	err = repo1.Git(ctx, nil, nil, "rm", "old.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(append(append([]byte{}, ptrs["old.bin"]...), ptrs["kept.bin"]...)), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(name string) (ks []bits.K) {
+		for k, err := range repo1.Keys(bytes.NewReader(ptrs[name])) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ks = append(ks, k)
+		}
+
+		return ks
+	}
+
+	//a tag that isn't old enough is left alone
+	report, err := repo1.Tier(ioutil.Discard, 100*365*24*time.Hour, "GLACIER", false)
+	if err != nil || report.Tags != 0 || report.Tiered != 0 {
+		t.Fatalf("expected no tags to be old enough, got: %+v, %v", report, err)
+	}
+
+	age, err := bits.ParseAge("1y")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := bytes.NewBuffer(nil)
+	report, err = repo1.Tier(listed, age, "GLACIER", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Tags != 1 || report.Tiered != len(keys("old.bin")) || mem.StorageClass(keys("old.bin")[0]) != "" {
+		t.Fatalf("expected a dry run to list the %d chunks of the old file only, got: %+v", len(keys("old.bin")), report)
+	}
+
+	report, err = repo1.Tier(ioutil.Discard, age, "GLACIER", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Tiered != len(keys("old.bin")) {
+		t.Errorf("expected %d chunks to be moved, got: %+v", len(keys("old.bin")), report)
+	}
+
+	for _, k := range keys("old.bin") {
+		if class := mem.StorageClass(k); class != "GLACIER" || !strings.Contains(listed.String(), fmt.Sprintf("%x", k)) {
+			t.Errorf("expected chunk '%x' of the old tag to be listed and moved to glacier, got: '%s'", k, class)
+		}
+	}
+
+	for _, k := range keys("kept.bin") {
+		if class := mem.StorageClass(k); class != "" {
+			t.Errorf("expected chunk '%x' of the branch to stay where it is, got: '%s'", k, class)
+		}
+	}
+
+	report, err = repo1.Tier(ioutil.Discard, age, "GLACIER", false)
+	if err != nil || report.Tiered != 0 || report.Skipped != len(keys("old.bin")) {
+		t.Errorf("expected the moved chunks to be skipped the second time, got: %+v, %v", report, err)
+	}
+
+	//fetching a chunk in cold storage restores it, it can be fetched once
+	//the restore completed
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+	repo2.SetRemote(mem)
+	err = repo2.Fetch(bytes.NewReader(ptrs["old.bin"]), ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "being restored") {
+		t.Fatalf("expected the first fetch to request a restore, got: %v", err)
+	}
+
+	err = repo2.Fetch(bytes.NewReader(ptrs["old.bin"]), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedBucket(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	//two unrelated repositories that share a bucket and a base asset
+	mem := bits.NewMemoryRemote()
+	base := make([]byte, 2*1024*1024)
+	_, err := rand.Read(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wds, repos, confs := []string{}, []*bits.Repository{}, []*bits.Conf{}
+	for _, name := range []string{"org/a", "org/b"} {
+		wd, repo := bitstest.GitCloneWorkspace(bitstest.GitInitRemote(t), t)
+		bitstest.WriteGitAttrFile(t, wd, map[string]string{
+			"*.bin": "filter=bits",
+		})
+
+		conf := bits.DefaultConf()
+		conf.DeduplicationScope = 0
+		conf.SharedRepository = name
+		repo.SetRemote(mem)
+		err = repo.Install(ioutil.Discard, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repo.SetRemote(mem) //install configures the bucket
+		wds, repos, confs = append(wds, wd), append(repos, repo), append(confs, conf)
+	}
+
+	if confs[1].DeduplicationScope != confs[0].DeduplicationScope {
+		t.Fatalf("expected the second repository to adopt scope %d of the bucket, got: %d", confs[0].DeduplicationScope, confs[1].DeduplicationScope)
+	}
+
+	conf := bits.DefaultConf()
+	conf.SharedRepository = "org/c"
+	_, repo3 := bitstest.GitCloneWorkspace(bitstest.GitInitRemote(t), t)
+	repo3.SetRemote(mem)
+	err = repo3.Install(ioutil.Discard, conf)
+	if err == nil || !strings.Contains(err.Error(), "share the bucket") {
+		t.Errorf("expected a scope that conflicts with the bucket to fail, got: %v", err)
+	}
+
+	//the first only references the base asset from a branch that is deleted
+	for i, repo := range repos {
+		if i == 0 {
+			err = ioutil.WriteFile(filepath.Join(wds[i], "README"), []byte("assets"), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bitstest.GitCommit(t, ctx, repo, "init")
+			err = repo.Git(ctx, nil, nil, "checkout", "-b", "side")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = ioutil.WriteFile(filepath.Join(wds[i], "base.bin"), base, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := bitstest.WriteRandomFile(t, filepath.Join(wds[i], "own.bin"), 1024*1024)
+		f.Close()
+
+		bitstest.GitCommit(t, ctx, repo, "c0")
+	}
+
+	fileKeys := func(repo *bits.Repository, object string) (keys []bits.K) {
+		ptr := bytes.NewBuffer(nil)
+		err := repo.Git(ctx, nil, ptr, "cat-file", "blob", object)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, err := range repo.Keys(ptr) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys = append(keys, k)
+		}
+
+		return keys
+	}
+
+	baseKeys, own0, own1 := fileKeys(repos[0], "side:base.bin"), fileKeys(repos[0], "side:own.bin"), fileKeys(repos[1], "HEAD:own.bin")
+	pushed := []int{}
+	for _, repo := range repos {
+		store, err := repo.LocalStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := len(mem.Keys())
+		err = repo.PushAll(store, "origin")
+		store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pushed = append(pushed, len(mem.Keys())-before)
+	}
+
+	if pushed[0] != len(baseKeys)+len(own0) || pushed[1] != len(own1) {
+		t.Fatalf("expected the second repository to reuse the %d chunks of the base asset, pushed: %v", len(baseKeys), pushed)
+	}
+
+	err = repos[0].Git(ctx, nil, nil, "checkout", "master")
+	if err == nil {
+		err = repos[0].Git(ctx, nil, nil, "branch", "-D", "side")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//pruning the first keeps the base asset that the second references
+	report, err := repos[0].PruneRemote(ioutil.Discard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Trashed != len(own0) || report.Shared != len(baseKeys)+len(own1) {
+		t.Errorf("expected only the chunks of the first's own file to be trashed, got: %+v", report)
+	}
+
+	stored := map[bits.K]bool{}
+	for _, k := range mem.Keys() {
+		stored[k] = true
+	}
+
+	for _, k := range baseKeys {
+		if !stored[k] {
+			t.Errorf("expected chunk '%x' of the base asset to be kept", k)
+		}
+	}
+
+	//pruning the second, which recorded its chunks when pushing, keeps them too
+	report, err = repos[1].PruneRemote(ioutil.Discard, false)
+	if err != nil || report.Trashed != 0 {
+		t.Errorf("expected the second repository to trash nothing, got: %+v, %v", report, err)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.cache-ttl": "7",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks of the first file are pushed, those of the second aren't
+	keys := []*bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		content := make([]byte, 1024*1024)
+		_, err = rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, buf)
+	}
+
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys[0].Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//none of the chunks were used for longer than the ttl
+	paths := [][]string{}
+	for _, buf := range keys {
+		ps := []string{}
+		err = repo1.ForEach(bytes.NewReader(buf.Bytes()), func(k bits.K) error {
+			p, err := repo1.Path(k, false)
+			if err != nil {
+				return err
+			}
+
+			ps = append(ps, p)
+			old := time.Now().Add(-8 * 24 * time.Hour)
+			return os.Chtimes(p, old, old)
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		paths = append(paths, ps)
+	}
+
+	removed, _, err := repo1.GC(ioutil.Discard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != len(paths[0]) {
+		t.Errorf("expected the %d pushed chunks to be evicted, got: %d", len(paths[0]), removed)
+	}
+
+	for i, ps := range paths {
+		for _, p := range ps {
+			_, err = os.Stat(p)
+			if i == 0 && !os.IsNotExist(err) {
+				t.Errorf("expected pushed chunk '%s' to be evicted, got: %v", p, err)
+			} else if i == 1 && err != nil {
+				t.Errorf("expected chunk '%s' that isn't pushed to be kept, got: %v", p, err)
+			}
+		}
+	}
+}
+
+func TestFsckSample(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 5*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the pointer is committed as is, such that its chunks are referenced
+	f, err := os.Create(filepath.Join(wd1, "file1.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), io.MultiWriter(f, keys))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//corrupt one of the chunks in the remote
+	stored := mem.Keys()
+	wc, err := mem.ChunkWriter(stored[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(wc, "garbage")
+	wc.Close()
+
+	report, err := repo1.Fsck(ioutil.Discard, true, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Total != len(stored) || report.Checked != len(stored) || report.Corrupt != 1 || report.Missing != 0 {
+		t.Errorf("expected all %d chunks to be checked and one to be corrupt, got: %+v", len(stored), report)
+	}
+
+	report, err = repo1.Fsck(ioutil.Discard, true, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Checked != (len(stored)+1)/2 {
+		t.Errorf("expected half of %d chunks to be checked, got: %+v", len(stored), report)
+	}
+
+	bad, upper := report.Estimate()
+	if bad > upper || upper > float64(report.Total) {
+		t.Errorf("expected the estimate of %v bad chunks to be at most %v and %d", bad, upper, report.Total)
+	}
+}
+
+func TestIndexExport(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := bitstest.WriteRandomFile(t, filepath.Join(wd1, "file1.bin"), 1024*1024)
+	f.Close()
+	commit := bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]bool{}
+	err = repo1.ForEach(ptr, func(k bits.K) error {
+		keys[fmt.Sprintf("%x", k)] = true
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.ExportIndex(buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []bits.IndexEntry{}
+	err = json.Unmarshal(buf.Bytes(), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != len(keys) {
+		t.Fatalf("expected %d chunks to be exported, got: %+v", len(keys), entries)
+	}
+
+	for _, e := range entries {
+		if !keys[e.Key] || !e.Local || e.Remote || e.Size == 0 || e.RefCount != 1 || e.FirstSeen != commit {
+			t.Errorf("expected a local chunk of file1 that was first seen in %s, got: %+v", commit, e)
+		}
+	}
+
+	buf = bytes.NewBuffer(nil)
+	err = repo1.ExportIndex(buf, "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != len(keys)+1 || lines[0] != "key,size,local,remote,refcount,first_seen" {
+		t.Errorf("expected a header and a line per chunk, got: %s", buf.String())
+	}
+}
+
+func TestEnv(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	conf := bits.DefaultConf()
+	conf.AWSSecretAccessKey = "very-secret"
+	err := repo1.Install(os.Stderr, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := repo1.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bits.EnvSetting{}
+	for _, s := range settings {
+		if strings.Contains(s.Value, "very-secret") {
+			t.Errorf("expected secret to be redacted, got: %+v", s)
+		}
+
+		found[s.Name] = s
+	}
+
+	secret := found["bits.aws-secret-access-key"]
+	if secret.Value != "<set>" || !strings.HasSuffix(filepath.ToSlash(secret.Source), ".git/config") {
+		t.Errorf("expected secret to be set in the git config, got: %+v", secret)
+	}
+
+	if hash := found["bits.key-hash"]; hash.Value != conf.KeyHash.String() {
+		t.Errorf("expected key hash '%s', got: %+v", conf.KeyHash, hash)
+	}
+
+	if hook := found["hooks.pre-push"]; hook.Value != "installed" {
+		t.Errorf("expected pre-push hook to be installed, got: %+v", hook)
+	}
+
+	if chunks := found["chunk-dir"]; !strings.HasPrefix(chunks.Value, filepath.Join(wd1, ".git")) {
+		t.Errorf("expected chunk dir in the git dir, got: %+v", chunks)
+	}
+}
+
+func TestConfirmDownload(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.confirm-threshold": "100KB",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := bitstest.WriteRandomFile(t, filepath.Join(wd1, "file1.bin"), 1024*1024)
+	f.Close()
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	//all chunks are stored locally after splitting
+	chunks, size, err := repo1.PullSize(bits.PullSelection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chunks != 0 || size != 0 {
+		t.Fatalf("expected nothing to download, got %d chunks (%d bytes)", chunks, size)
+	}
+
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+		n++
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		return os.Remove(p)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, size, err = repo1.PullSize(bits.PullSelection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chunks != n || size != 1024*1024 {
+		t.Fatalf("expected %d chunks (%d bytes) to download, got %d chunks (%d bytes)", n, 1024*1024, chunks, size)
+	}
+
+	keys, fchunks, fsize, err := repo1.FetchSize(bytes.NewReader(ptr.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fchunks != chunks || fsize != size {
+		t.Errorf("expected fetching to download as much as pulling, got %d chunks (%d bytes)", fchunks, fsize)
+	}
+
+	if data, _ := ioutil.ReadAll(keys); !bytes.Equal(data, ptr.Bytes()) {
+		t.Errorf("expected keys to be returned for fetching")
+	}
+
+	err = repo1.ConfirmDownload(chunks, size, func(string) bool { return false })
+	if err != bits.ErrNotConfirmed {
+		t.Errorf("expected download to not be confirmed, got: %v", err)
+	}
+
+	err = repo1.ConfirmDownload(chunks, size, nil)
+	if err != bits.ErrNotConfirmed {
+		t.Errorf("expected download without a way to ask to not be confirmed, got: %v", err)
+	}
+
+	asked := false
+	err = repo1.ConfirmDownload(chunks, size, func(string) bool { asked = true; return true })
+	if err != nil || !asked {
+		t.Errorf("expected confirmed download, got: %v", err)
+	}
+
+	err = repo1.ConfirmDownload(1, 1024, nil)
+	if err != nil {
+		t.Errorf("expected download below the threshold to not need confirmation, got: %v", err)
+	}
+}
+
+func TestAutoTrack(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.auto-track-size": "100KB",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, size := range map[string]int64{"large.dat": 1024 * 1024, "small.dat": 1024, "split.bin": 1024 * 1024} {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), size)
+		f.Close()
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	files, err := repo1.AutoTrack(buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].Path != "large.dat" || files[0].Size != 1024*1024 {
+		t.Fatalf("expected only the large file that isn't split, got: %+v", files)
+	}
+
+	if !strings.Contains(buf.String(), "large.dat") {
+		t.Errorf("expected a warning about the large file, got: %s", buf.String())
+	}
+
+	attrs, err := ioutil.ReadFile(filepath.Join(wd1, ".gitattributes"))
+	if err != nil || strings.Contains(string(attrs), "*.dat") {
+		t.Fatalf("expected warning to leave .gitattributes alone, got: %s (%v)", attrs, err)
+	}
+
+	//the pre-commit hook adds a pattern and splits the file before committing
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.auto-track": "add",
+	})
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	attrs, err = ioutil.ReadFile(filepath.Join(wd1, ".gitattributes"))
+	if err != nil || !strings.Contains(string(attrs), "*.dat\tfilter=bits") {
+		t.Fatalf("expected pattern for the large file in .gitattributes, got: %s (%v)", attrs, err)
+	}
+
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:large.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = repo1.ReadPointer(ptr); err != nil {
+		t.Errorf("expected large file to be committed split, got: %v", err)
+	}
+
+	if pattern := bits.TrackPattern("my dir/big file"); pattern != "/my[[:space:]]dir/big[[:space:]]file" {
+		t.Errorf("unexpected pattern for file without extension: %s", pattern)
+	}
+}
+
+func TestTextCheck(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	source := []byte("package main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n")
+	binary := make([]byte, 64*1024)
+	_, err := rand.Read(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary[0] = 0
+
+	//progress is written to the output in the background, it is read once
+	//the repository is closed
+	split := func(content []byte) (out string, err error) {
+		buf := bytes.NewBuffer(nil)
+		repo, err := bits.NewRepository(wd1, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo.Split(bytes.NewReader(content), ioutil.Discard)
+		repo.Close()
+		return buf.String(), err
+	}
+
+	out, err := split(binary)
+	if err != nil || strings.Contains(out, "warning") {
+		t.Fatalf("expected binary content to be split without a warning, got: %s (%v)", out, err)
+	}
+
+	out, err = split(source)
+	if err != nil || !strings.Contains(out, "warning") {
+		t.Fatalf("expected a warning when splitting text, got: %s (%v)", out, err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.text-check": "error",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Split(bytes.NewReader(source), ioutil.Discard)
+	if err != bits.ErrTextContent {
+		t.Errorf("expected splitting text to be refused, got: %v", err)
+	}
+
+	err = repo1.Split(bytes.NewReader(binary), ioutil.Discard)
+	if err != nil {
+		t.Errorf("expected binary content to be split, got: %v", err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpath := filepath.Join(wd1, "file1.bin")
+	f := bitstest.WriteRandomFile(t, fpath, 1024*1024)
+	f.Close()
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := bits.NewMemoryRemote()
+	repo1.SetRemote(remote)
+
+	//chunks that are not pushed would be lost
+	freed, err := repo1.Evict(ioutil.Discard, false, "file1.bin")
+	if err != nil || freed != 0 {
+		t.Fatalf("expected nothing to be evicted, freed %d bytes: %v", freed, err)
+	}
+
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freed, err = repo1.Evict(ioutil.Discard, false, fpath)
+	if err != nil || freed < 1024*1024 {
+		t.Fatalf("expected file and chunks to be evicted, freed %d bytes: %v", freed, err)
+	}
+
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil || !bytes.Equal(data, ptr.Bytes()) {
+		t.Fatalf("expected file to be replaced with its pointer: %v", err)
+	}
+
+	status := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, status, "status", "--porcelain")
+	if err != nil || status.Len() != 0 {
+		t.Fatalf("expected evicted file to not be modified, got: %s (%v)", status.String(), err)
+	}
+
+	err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+		p, _ := repo1.Path(k, false)
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected chunk '%x' to be removed", k)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Restore(ioutil.Discard, "file1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = ioutil.ReadFile(fpath)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("expected file to be restored: %v", err)
+	}
+
+	flags := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, flags, "ls-files", "-v", "file1.bin")
+	if err != nil || !strings.HasPrefix(flags.String(), "H ") {
+		t.Errorf("expected skip-worktree to be cleared, got: %s (%v)", flags.String(), err)
+	}
+}
+
+//slowRemote counts the chunks that are read and reads them slowly
+type slowRemote struct {
+	*bits.MemoryRemote
+	reads int32
+}
+
+func (r *slowRemote) ChunkReader(k bits.K) (rc io.ReadCloser, err error) {
+	atomic.AddInt32(&r.reads, 1)
+	time.Sleep(200 * time.Millisecond)
+	return r.MemoryRemote.ChunkReader(k)
+}
+
+func TestFetchSingleFlight(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 64*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &slowRemote{MemoryRemote: bits.NewMemoryRemote()}
+	repo1.SetRemote(remote.MemoryRemote)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		n++
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		return os.Remove(p)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//each repository stands in for a separate smudge process
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		repo, err := bits.NewRepository(wd1, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repo.SetRemote(remote)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- repo.Fetch(bytes.NewReader(keys.Bytes()), ioutil.Discard)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if reads := atomic.LoadInt32(&remote.reads); reads != int32(n) {
+		t.Errorf("expected each of the %d chunks to be downloaded once, got %d downloads", n, reads)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.Combine(bytes.NewReader(keys.Bytes()), buf)
+	if err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("expected fetched chunks to combine into the original content: %v", err)
+	}
+}
+
+//interruptingRemote fails the write of the third chunk and, while
+//'interrupt' is set, cuts chunk reads short halfway. It counts the chunks
+//that are written and read from the start, ranged reads are served by the
+//embedded remote.
+type interruptingRemote struct {
+	*bits.MemoryRemote
+	mu        sync.Mutex
+	writes    int
+	reads     int
+	interrupt bool
+}
+
+func (r *interruptingRemote) ChunkWriter(k bits.K) (wc io.WriteCloser, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes++
+	if r.writes == 3 {
+		return nil, fmt.Errorf("connection reset")
+	}
+
+	return r.MemoryRemote.ChunkWriter(k)
+}
+
+func (r *interruptingRemote) ChunkReader(k bits.K) (rc io.ReadCloser, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reads++
+	rc, err = r.MemoryRemote.ChunkReader(k)
+	if err != nil || !r.interrupt {
+		return rc, err
+	}
+
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	pw.CloseWithError(fmt.Errorf("connection reset"))
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(data[:len(data)/2]), pr)), nil
+}
+
+func TestResumeTransfer(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 16*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		n++
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n < 3 {
+		t.Fatalf("expected at least 3 chunks, got: %d", n)
+	}
+
+	remote := &interruptingRemote{MemoryRemote: bits.NewMemoryRemote()}
+	repo1.SetRemote(remote)
+	push := func() error {
+		store, err := repo1.LocalStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer store.Close()
+		return repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	}
+
+	//the push is interrupted at the third chunk, resuming it only sends the
+	//chunks that were not yet transferred
+	err = push()
+	if err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("expected the push to be interrupted, got: %v", err)
+	}
+
+	if len(remote.Keys()) != 2 {
+		t.Fatalf("expected 2 chunks to be pushed before the interruption, got: %d", len(remote.Keys()))
+	}
+
+	remote.writes = 3
+	err = push()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remote.writes != 3+n-2 {
+		t.Errorf("expected the resumed push to send the %d remaining chunks, got: %d", n-2, remote.writes-3)
+	}
+
+	if len(remote.Keys()) != n {
+		t.Errorf("expected all %d chunks to be pushed, got: %d", n, len(remote.Keys()))
+	}
+
+	sizes := map[bits.K]int64{}
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		sizes[k] = fi.Size()
+		return os.Remove(p)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the fetch is interrupted halfway each chunk, resuming it only reads the
+	//other half of each chunk
+	remote.interrupt = true
+	err = repo1.Fetch(bytes.NewReader(keys.Bytes()), ioutil.Discard)
+	if err == nil {
+		t.Fatal("expected the fetch to be interrupted")
+	}
+
+	if remote.reads != n {
+		t.Errorf("expected each of the %d chunks to be read once, got: %d", n, remote.reads)
+	}
+
+	remote.interrupt = false
+	err = repo1.Fetch(bytes.NewReader(keys.Bytes()), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remote.reads != n {
+		t.Errorf("expected the resumed fetch to not read chunks from the start, got %d reads", remote.reads-n)
+	}
+
+	remaining := int64(0)
+	for _, size := range sizes {
+		remaining += size - size/2
+	}
+
+	usage, err := repo1.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(usage) != 1 || usage[0].DownloadedBytes != remaining {
+		t.Errorf("expected the resumed fetch to only download the remaining %d bytes, got: %+v", remaining, usage)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.Combine(bytes.NewReader(keys.Bytes()), buf)
+	if err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("expected resumed transfers to combine into the original content: %v", err)
+	}
+}
+
+func TestFetchCombineStream(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	contents := [][]byte{}
+	ptrs := [][]byte{}
+	for i := 0; i < 2; i++ {
+		content := make([]byte, 512*1024)
+		_, err := rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents = append(contents, content)
+		ptrs = append(ptrs, ptr.Bytes())
+	}
+
+	//the file in the middle references a chunk that doesn't exist
+	in := bytes.NewBuffer(nil)
+	for _, f := range []struct {
+		path string
+		ptr  []byte
+	}{
+		{"a dir/file1.bin", ptrs[0]},
+		{"missing.bin", []byte(fmt.Sprintf("%x\n", make([]byte, bits.KeySize)))},
+		{"file2.bin", ptrs[1]},
+	} {
+		err := bits.WriteStreamFile(in, f.path, f.ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err := repo1.FetchStream(in, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = repo1.CombineStream(keys, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(out)
+	for i, expected := range []struct {
+		path    string
+		content []byte
+		fail    bool
+	}{
+		{"a dir/file1.bin", contents[0], false},
+		{"missing.bin", nil, true},
+		{"file2.bin", contents[1], false},
+	} {
+		buf := bytes.NewBuffer(nil)
+		path, err := bits.ReadStreamContent(br, buf)
+		if path != expected.path {
+			t.Fatalf("expected file %d to be '%s', got: '%s'", i, expected.path, path)
+		}
+
+		if expected.fail {
+			if err == nil {
+				t.Errorf("expected '%s' to fail", path)
+			}
+
+			continue
+		}
+
+		if err != nil || !bytes.Equal(buf.Bytes(), expected.content) {
+			t.Errorf("expected content of '%s' to be combined: %v", path, err)
+		}
+	}
+
+	_, err = bits.ReadStreamContent(br, ioutil.Discard)
+	if err != io.EOF {
+		t.Errorf("expected stream to end, got: %v", err)
+	}
+}
+
+func TestPushUnreachable(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 512*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a chunk that was split elsewhere and a chunk that is only stored remotely
+	unknown := bits.K{}
+	unknown[0] = 0xab
+	stored := bits.K{}
+	stored[0] = 0xcd
+
+	remote := bits.NewMemoryRemote()
+	wc, err := remote.ChunkWriter(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wc.Close()
+	repo1.SetRemote(remote)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+	fmt.Fprintf(keys, "%x\n%x\n", unknown, stored)
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%x", unknown)) || strings.Contains(err.Error(), fmt.Sprintf("%x", stored)) {
+		t.Fatalf("expected push to fail listing only the unreachable chunk, got: %v", err)
+	}
+
+	//the chunks that could be pushed are
+	n := 0
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		if k == unknown || k == stored {
+			return nil
+		}
+
+		n++
+		if rc, err := remote.ChunkReader(k); err != nil {
+			t.Errorf("expected chunk '%x' to be pushed: %v", k, err)
+		} else {
+			rc.Close()
+		}
+
+		return nil
+	})
+
+	if err != nil || n == 0 {
+		t.Fatalf("expected local chunks to be checked: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	err := repo1.Watch(context.Background(), time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "no remote configured") {
+		t.Fatalf("expected watching without a remote to fail, got: %v", err)
+	}
+
+	split := func() (keys []bits.K) {
+		content := make([]byte, 2*1024*1024)
+		_, err := rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo1.ForEach(buf, func(k bits.K) error {
+			keys = append(keys, k)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return keys
+	}
+
+	remote := bits.NewMemoryRemote()
+	pushed := func(keys []bits.K) bool {
+		for _, k := range keys {
+			rc, err := remote.ChunkReader(k)
+			if err != nil {
+				return false
+			}
+
+			rc.Close()
+		}
+
+		return true
+	}
+
+	defer func(d time.Duration) { bits.WatchSettleTime = d }(bits.WatchSettleTime)
+	bits.WatchSettleTime = 0
+
+	//chunks staged before and while watching are uploaded
+	keys1 := split()
+	repo1.SetRemote(remote)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- repo1.Watch(ctx, 10*time.Millisecond)
+	}()
+
+	keys2 := split()
+	deadline := time.Now().Add(5 * time.Second)
+	for !pushed(keys1) || !pushed(keys2) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected all %d staged chunks to be uploaded while watching", len(keys1)+len(keys2))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	err = <-done
+	if err != nil {
+		t.Errorf("expected watching to stop without error, got: %v", err)
+	}
+
+	//the local store isn't held after watching stopped
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Close()
+}
+
+//corruptingRemote reads back every chunk with its first byte flipped
+type corruptingRemote struct {
+	*bits.MemoryRemote
+}
+
+func (r *corruptingRemote) ChunkReader(k bits.K) (rc io.ReadCloser, err error) {
+	rc, err = r.MemoryRemote.ChunkReader(k)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	data[0] ^= 0xff
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestCheckRemote(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	err := repo1.CheckRemote(ioutil.Discard)
+	if bits.KindOf(err) != bits.ConfigError {
+		t.Fatalf("expected checking without a remote to be a config error, got: %v", err)
+	}
+
+	//each step is reported and the probe chunk is removed afterwards
+	remote := bits.NewMemoryRemote()
+	repo1.SetRemote(remote)
+	out := bytes.NewBuffer(nil)
+	err = repo1.CheckRemote(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []string{"list:   ok, 0 chunks", "put:    ok", "get:    ok", "delete: ok"} {
+		if !strings.Contains(out.String(), step) {
+			t.Errorf("expected the check to report '%s', got: %s", step, out.String())
+		}
+	}
+
+	listing := bytes.NewBuffer(nil)
+	err = remote.ListChunks(listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if listing.Len() != 0 {
+		t.Errorf("expected the probe chunk to be deleted, got: %s", listing.String())
+	}
+
+	//a probe that reads back differently fails the check before deleting
+	repo1.SetRemote(&corruptingRemote{remote})
+	out.Reset()
+	err = repo1.CheckRemote(out)
+	if bits.KindOf(err) != bits.VerificationError {
+		t.Errorf("expected a corrupted probe to be a verification error, got: %v", err)
+	}
+
+	if !strings.Contains(out.String(), "put:    ok") || strings.Contains(out.String(), "get:") {
+		t.Errorf("expected the check to end at reading the probe, got: %s", out.String())
+	}
+}
+
+//reorderRemote reads the chunk 'slow' slowly while tracking how many chunks
+//are read at the same time, such that fetches complete out of order
+type reorderRemote struct {
+	*bits.MemoryRemote
+	slow    bits.K
+	reading int32
+	most    int32
+}
+
+func (r *reorderRemote) ChunkReader(k bits.K) (rc io.ReadCloser, err error) {
+	n := atomic.AddInt32(&r.reading, 1)
+	defer atomic.AddInt32(&r.reading, -1)
+	for {
+		most := atomic.LoadInt32(&r.most)
+		if n <= most || atomic.CompareAndSwapInt32(&r.most, most, n) {
+			break
+		}
+	}
+
+	if k == r.slow {
+		time.Sleep(300 * time.Millisecond)
+	} else {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return r.MemoryRemote.ChunkReader(k)
+}
+
+func TestFetchOrder(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 6*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []bits.K{}
+	err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+		keys = append(keys, k)
+		return nil
+	})
+
+	if err != nil || len(keys) < 3 {
+		t.Fatalf("expected several chunks, got %d: %v", len(keys), err)
+	}
+
+	remote := &reorderRemote{MemoryRemote: bits.NewMemoryRemote(), slow: keys[0]}
+	repo1.SetRemote(remote.MemoryRemote)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range keys {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Remove(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the first chunk arrives last, its key must still be written first
+	repo1.SetRemote(remote)
+	fetched := bytes.NewBuffer(nil)
+	err = repo1.Fetch(bytes.NewReader(ptr.Bytes()), fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&remote.most) < 2 {
+		t.Errorf("expected chunks to be fetched in parallel")
+	}
+
+	expected := bytes.NewBuffer(nil)
+	for _, k := range keys {
+		fmt.Fprintf(expected, "%x\n", k)
+	}
+
+	if fetched.String() != expected.String() {
+		t.Fatalf("expected keys in their original order, got:\n%s\nexpected:\n%s", fetched, expected)
+	}
+
+	combined := bytes.NewBuffer(nil)
+	err = repo1.Combine(fetched, combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Fatal("expected fetched keys to combine into the original content")
+	}
+}
+
+func TestSplitWhileStoreHeld(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	//another operation (e.g. a push) holds the local store
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bits.BenchContent(1024*1024, 1)
+	err = repo1.Split(bytes.NewReader(content), ioutil.Discard)
+	if err != nil {
+		store.Close()
+		t.Fatalf("expected splitting not to wait for the local store, got: %v", err)
+	}
+
+	store.Close()
+	status, err := repo1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Staged == 0 || status.StagedSize < int64(len(content)) {
+		t.Fatalf("expected the logged chunks to be staged once the store is opened, got: %+v", status)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := repo1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Staged == 0 || status.StagedSize < int64(len(content)) || status.Cached != 0 {
+		t.Fatalf("expected split chunks to be staged, got: %+v", status)
+	}
+
+	//the blob of the pointer is never written, gc would consider the
+	//chunks unreferenced if they weren't staged
+	defer func(grace time.Duration) { bits.GCGracePeriod = grace }(bits.GCGracePeriod)
+	bits.GCGracePeriod = 0
+	removed, _, err := repo1.GC(ioutil.Discard, false)
+	if err != nil || removed != 0 {
+		t.Fatalf("expected staged chunks to be kept, got: %d (%v)", removed, err)
+	}
+
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushed, err := repo1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pushed.Staged != 0 || pushed.Cached != status.Staged {
+		t.Fatalf("expected pushed chunks to be cached, got: %+v", pushed)
+	}
+
+	removed, _, err = repo1.GC(ioutil.Discard, false)
+	if err != nil || removed != status.Staged {
+		t.Fatalf("expected pushed chunks to be removed, got: %d (%v)", removed, err)
+	}
+}
+
+func TestRepairStore(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	repo1.SetRemote(bits.NewMemoryRemote())
+
+	//chunks of the first file are pushed, those of the second aren't
+	keys := []*bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		content := make([]byte, 1024*1024)
+		_, err := rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, buf)
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys[0].Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := repo1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbpath := filepath.Join(wd1, ".git", "chunks", "a.chunks")
+	garbage := make([]byte, 32*1024)
+	rand.Read(garbage)
+	err = ioutil.WriteFile(dbpath, garbage, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = repo1.LocalStore()
+	if err != nil {
+		t.Fatalf("expected the corrupted store to be repaired, got: %v", err)
+	}
+
+	store.Close()
+	aside, _ := filepath.Glob(dbpath + bits.CorruptStoreSuffix + "*")
+	if len(aside) != 1 {
+		t.Errorf("expected the corrupted store to be moved aside, got: %v", aside)
+	}
+
+	after, err := repo1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after != before {
+		t.Errorf("expected staged and cached chunks to be recovered as %+v, got: %+v", before, after)
+	}
+}
+
+func TestPullProgress(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the copy shares its chunks with the first file
+	contents := map[string][]byte{}
+	for _, name := range []string{"file1.bin", "file2.bin"} {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), 1024*1024)
+		f.Close()
+		contents[name], err = ioutil.ReadFile(filepath.Join(wd1, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents["file3.bin"] = contents["file1.bin"]
+	err = ioutil.WriteFile(filepath.Join(wd1, "file3.bin"), contents["file3.bin"], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	//chunks are only stored remotely and the files are pointers
+	repo1.SetRemote(bits.NewMemoryRemote())
+	keys := bytes.NewBuffer(nil)
+	for name := range contents {
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(wd1, name), ptr.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys.Write(ptr.Bytes())
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		os.Remove(p)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []bits.PullProgress{}
+	repo1.PullProgressFn = func(p bits.PullProgress) { events = append(events, p) }
+	err = repo1.Pull(bits.PullSelection{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected progress for 3 files, got: %+v", events)
+	}
+
+	last := events[len(events)-1]
+	if last.File != 3 || last.Files != 3 || last.TotalBytes != 2*1024*1024 || last.Bytes != last.TotalBytes {
+		t.Errorf("expected all 3 files and 2MiB to be pulled, got: %+v", last)
+	}
+
+	for _, e := range events {
+		if e.Path == "file3.bin" && e.FileBytes != 0 {
+			t.Errorf("expected the chunks of the copy to be counted once, got: %+v", e)
+		}
+	}
+
+	for name, content := range contents {
+		data, err := ioutil.ReadFile(filepath.Join(wd1, name))
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("expected '%s' to be pulled: %v", name, err)
+		}
+	}
+}
+
+func TestPullSelection(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//two files on master, a third one on a side branch
+	for i, names := range [][]string{{"x/a.bin", "c.bin"}, {"y/d.bin"}} {
+		if i == 1 {
+			err = repo1.Git(ctx, nil, nil, "checkout", "-b", "side")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range names {
+			os.MkdirAll(filepath.Dir(filepath.Join(wd1, name)), 0777)
+			f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), 1024*1024)
+			f.Close()
+		}
+
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+	}
+
+	err = repo1.Git(ctx, nil, nil, "checkout", "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks are only stored remotely and the files of master are pointers
+	contents := map[string][]byte{}
+	repo1.SetRemote(bits.NewMemoryRemote())
+	keys := bytes.NewBuffer(nil)
+	for _, obj := range []string{"HEAD:x/a.bin", "HEAD:c.bin", "side:y/d.bin"} {
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys.Write(ptr.Bytes())
+		if strings.HasPrefix(obj, "HEAD:") {
+			name := filepath.Join(wd1, strings.TrimPrefix(obj, "HEAD:"))
+			contents[name], err = ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ioutil.WriteFile(name, ptr.Bytes(), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		os.Remove(p)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		sel  bits.PullSelection
+		size int64
+	}{
+		{bits.PullSelection{}, 2 * 1024 * 1024},
+		{bits.PullSelection{Refs: []string{"HEAD", "side"}}, 3 * 1024 * 1024},
+		{bits.PullSelection{Include: []string{"x/*"}}, 1024 * 1024},
+		{bits.PullSelection{Include: []string{"c.bin"}}, 1024 * 1024},
+		{bits.PullSelection{Refs: []string{"HEAD", "side"}, Exclude: []string{"*.bin"}}, 0},
+	} {
+		_, size, err := repo1.PullSize(c.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size != c.size {
+			t.Errorf("expected %+v to download %d bytes, got: %d", c.sel, c.size, size)
+		}
+	}
+
+	err = repo1.Pull(bits.PullSelection{Include: []string{"x/*"}}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range contents {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pulled := bytes.Equal(data, content)
+		if strings.HasSuffix(name, "a.bin") != pulled {
+			t.Errorf("expected only the included file to be pulled, '%s' pulled: %v", name, pulled)
+		}
+	}
+}
+
+func TestPullOtherRef(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//c.bin differs between master and side, d.bin is only on side
+	for i, names := range [][]string{{"c.bin"}, {"c.bin", "d.bin"}} {
+		if i == 1 {
+			err = repo1.Git(ctx, nil, nil, "checkout", "-b", "side")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range names {
+			f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), 1024*1024)
+			f.Close()
+		}
+
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
+	}
+
+	err = repo1.Git(ctx, nil, nil, "checkout", "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks are only stored remotely and c.bin is a pointer
+	repo1.SetRemote(bits.NewMemoryRemote())
+	keys := bytes.NewBuffer(nil)
+	ptrs := map[string][]byte{}
+	for _, obj := range []string{"HEAD:c.bin", "side:c.bin", "side:d.bin"} {
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys.Write(ptr.Bytes())
+		ptrs[obj] = ptr.Bytes()
+	}
+
+	cpath := filepath.Join(wd1, "c.bin")
+	content, err := ioutil.ReadFile(cpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(cpath, ptrs["HEAD:c.bin"], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := func(obj string) (n int) {
+		repo1.ForEach(bytes.NewReader(ptrs[obj]), func(k bits.K) error {
+			p, _ := repo1.Path(k, false)
+			if _, err := os.Stat(p); err == nil {
+				n++
+			}
+
+			return nil
+		})
+
+		return n
+	}
+
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		os.Remove(p)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//pulling side fetches its chunks but leaves the working tree of master
+	err = repo1.Pull(bits.PullSelection{Refs: []string{"side"}}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(wd1, "d.bin")); !os.IsNotExist(err) {
+		t.Errorf("expected a file that is only on the pulled ref not to be created, got: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(cpath)
+	if err != nil || !bytes.Equal(data, ptrs["HEAD:c.bin"]) {
+		t.Errorf("expected the file of the checked out ref to hold its pointer, got %d bytes: %v", len(data), err)
+	}
+
+	if local("side:c.bin") == 0 || local("side:d.bin") == 0 || local("HEAD:c.bin") != 0 {
+		t.Errorf("expected only the chunks of the pulled ref to be fetched, got: %d, %d and %d", local("side:c.bin"), local("side:d.bin"), local("HEAD:c.bin"))
+	}
+
+	err = repo1.Pull(bits.PullSelection{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = ioutil.ReadFile(cpath)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("expected pulling HEAD to materialize its file, got %d bytes: %v", len(data), err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.bin", "b.bin"} {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), 1024*1024)
+		f.Close()
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	//chunks are only stored remotely
+	remote := bits.NewMemoryRemote()
+	repo1.SetRemote(remote)
+	keys := bytes.NewBuffer(nil)
+	ptrs := map[string][]byte{}
+	for _, name := range []string{"a.bin", "b.bin"} {
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys.Write(ptr.Bytes())
+		ptrs[name] = ptr.Bytes()
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removeLocal := func() {
+		err := repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+			p, err := repo1.Path(k, false)
+			if err != nil {
+				return err
+			}
+
+			os.Remove(p)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	local := func(name string) (n, total int) {
+		repo1.ForEach(bytes.NewReader(ptrs[name]), func(k bits.K) error {
+			total++
+			p, _ := repo1.Path(k, false)
+			if _, err := os.Stat(p); err == nil {
+				n++
+			}
+
+			return nil
+		})
+
+		return n, total
+	}
+
+	//limited to a path only the chunks of that file are fetched
+	removeLocal()
+	err = repo1.Prefetch("HEAD", []string{"a.bin"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, total := local("a.bin"); n != total {
+		t.Errorf("expected all %d chunks of the prefetched file to be stored locally, got: %d", total, n)
+	}
+
+	if n, _ := local("b.bin"); n != 0 {
+		t.Errorf("expected no chunks of other files to be fetched, got: %d", n)
+	}
+
+	//without paths the chunks of all files are fetched, stored ones are skipped
+	err = repo1.Prefetch("HEAD", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if n, total := local(name); n != total {
+			t.Errorf("expected all %d chunks of '%s' to be stored locally, got: %d", total, name, n)
+		}
+	}
+
+	//a prefetch without a remote fails and records the chunks for retrying
+	removeLocal()
+	repo1.SetRemote(nil)
+	err = repo1.Prefetch("HEAD", nil, 0)
+	if err == nil || !strings.Contains(err.Error(), "--retry-failed") {
+		t.Fatalf("expected prefetching without a remote to fail with a retry hint, got: %v", err)
+	}
+
+	repo1.SetRemote(remote)
+	fetched, remaining, err := repo1.RetryFailedFetches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, na := local("a.bin")
+	_, nb := local("b.bin")
+	if fetched != na+nb || remaining != 0 {
+		t.Errorf("expected retrying to fetch all %d chunks, got: %d fetched and %d remaining", na+nb, fetched, remaining)
+	}
+}
+
+func TestPullSparse(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"x/a.bin", "y/b.bin", "c.bin"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(wd1, name)), 0777)
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), 1024*1024)
+		f.Close()
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+	err = repo1.Git(ctx, nil, nil, "sparse-checkout", "set", "--cone", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks are only stored remotely and the files in the cone are pointers
+	contents := map[string][]byte{}
+	repo1.SetRemote(bits.NewMemoryRemote())
+	keys := bytes.NewBuffer(nil)
+	outside := bytes.NewBuffer(nil)
+	for _, name := range []string{"x/a.bin", "y/b.bin", "c.bin"} {
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys.Write(ptr.Bytes())
+		fpath := filepath.Join(wd1, name)
+		if name == "y/b.bin" {
+			outside.Write(ptr.Bytes())
+			if _, err = os.Stat(fpath); !os.IsNotExist(err) {
+				t.Fatalf("expected '%s' outside the sparse checkout to be absent, got: %v", name, err)
+			}
+
+			continue
+		}
+
+		contents[fpath], err = ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(fpath, ptr.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := func(r io.Reader) (n int) {
+		err := repo1.ForEach(r, func(k bits.K) error {
+			p, err := repo1.Path(k, false)
+			if err != nil {
+				return err
+			}
+
+			if _, err = os.Stat(p); err == nil {
+				n++
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		os.Remove(p)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		sel  bits.PullSelection
+		size int64
+	}{
+		{bits.PullSelection{}, 2 * 1024 * 1024},
+		{bits.PullSelection{IgnoreSparse: true}, 3 * 1024 * 1024},
+	} {
+		_, size, err := repo1.PullSize(c.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size != c.size {
+			t.Errorf("expected %+v to download %d bytes, got: %d", c.sel, c.size, size)
+		}
+	}
+
+	err = repo1.Pull(bits.PullSelection{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range contents {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, content) {
+			t.Errorf("expected '%s' in the sparse checkout to be pulled", name)
+		}
+	}
+
+	if n := local(bytes.NewReader(outside.Bytes())); n != 0 {
+		t.Errorf("expected no chunks of the file outside the sparse checkout to be fetched, got: %d", n)
+	}
+
+	err = repo1.Pull(bits.PullSelection{IgnoreSparse: true}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := local(bytes.NewReader(outside.Bytes())); n == 0 {
+		t.Errorf("expected the chunks of the file outside the sparse checkout to be fetched")
+	}
+
+	if _, err = os.Stat(filepath.Join(wd1, "y", "b.bin")); !os.IsNotExist(err) {
+		t.Errorf("expected the file outside the sparse checkout to stay absent, got: %v", err)
+	}
+}
+
+func TestAccessHints(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"a.bin", "b.bin", "c.bin"}
+	for _, name := range names {
+		f := bitstest.WriteRandomFile(t, filepath.Join(wd1, name), 1024*1024)
+		f.Close()
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+
+	//the daemon counts files that are opened
+	if runtime.GOOS == "linux" {
+		prev := bits.AccessFlushInterval
+		bits.AccessFlushInterval = 50 * time.Millisecond
+		defer func() { bits.AccessFlushInterval = prev }()
+
+		wctx, wcancel := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() { done <- repo1.WatchAccess(wctx) }()
+
+		var hints map[string]bits.FileAccess
+		for i := 0; i < 100 && hints["a.bin"].Count == 0; i++ {
+			_, err = ioutil.ReadFile(filepath.Join(wd1, "a.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			hints, err = repo1.AccessHints("master")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		wcancel()
+		err = <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hints["a.bin"].Count == 0 || hints["b.bin"].Count != 0 {
+			t.Fatalf("expected only the opened file to be counted, got: %v", hints)
+		}
+	}
+
+	//chunks are only stored remotely and the files are pointers
+	repo1.SetRemote(bits.NewMemoryRemote())
+	keys := bytes.NewBuffer(nil)
+	for _, name := range names {
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Git(ctx, nil, ptr, "cat-file", "blob", "HEAD:"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys.Write(ptr.Bytes())
+		err = ioutil.WriteFile(filepath.Join(wd1, name), ptr.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.ForEach(bytes.NewReader(keys.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		return os.Remove(p)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//c.bin is used most, then b.bin, a.bin isn't counted outside linux
+	err = repo1.RecordAccess("c.bin", "c.bin", "c.bin", "c.bin", "b.bin", "b.bin", "b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pulled := []string{}
+	repo1.PullProgressFn = func(p bits.PullProgress) { pulled = append(pulled, p.Path) }
+	err = repo1.Pull(bits.PullSelection{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(pulled, " ") != "c.bin b.bin a.bin" {
+		t.Errorf("expected files that are used most to be pulled first, got: %v", pulled)
+	}
+
+	//hints are kept per branch
+	hints, err := repo1.AccessHints("other")
+	if err != nil || len(hints) != 0 {
+		t.Errorf("expected no hints for another branch, got: %v, %v", hints, err)
+	}
+}
+
+func TestInstallHooksPath(t *testing.T) {
+	ctx := context.Background()
+	for hooksPath, dir := range map[string]string{
+		".githooks": ".githooks",
+		".husky/_":  ".husky",
+	} {
+		remote1 := bitstest.GitInitRemote(t)
+		wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+		bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+			"core.hooksPath": hooksPath,
+		})
+
+		err := repo1.Install(ioutil.Discard, bits.DefaultConf())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"pre-push", "pre-commit"} {
+			_, err = os.Stat(filepath.Join(wd1, dir, name))
+			if err != nil {
+				t.Errorf("expected %s hook in '%s' with hooks path '%s', got: %v", name, dir, hooksPath, err)
+			}
+
+			_, err = os.Stat(filepath.Join(wd1, ".git", "hooks", name))
+			if !os.IsNotExist(err) {
+				t.Errorf("expected no %s hook in .git/hooks with hooks path '%s', got: %v", name, hooksPath, err)
+			}
+		}
+
+		settings, err := repo1.Env()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range settings {
+			if s.Name == "hooks.pre-push" && s.Value != "installed" {
+				t.Errorf("expected pre-push hook to be reported as installed, got: %+v", s)
+			}
+		}
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.file-mode": "0660",
+		"bits.dir-mode":  "2770",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the umask doesn't restrict configured modes
+	err = repo1.ForEach(keys, func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		if err != nil {
+			return err
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode() != 0660 {
+			t.Errorf("expected chunk file mode 0660, got: %v", fi.Mode())
+		}
+
+		di, err := os.Stat(filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+
+		if di.Mode().Perm() != 0770 || di.Mode()&os.ModeSetgid == 0 {
+			t.Errorf("expected chunk dir mode 2770, got: %v", di.Mode())
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(wd1, ".git", "chunks", bits.StagedLogFile))
+	if err != nil || fi.Mode() != 0660 {
+		t.Errorf("expected staged log mode 0660, got: %v (%v)", fi, err)
+	}
+
+	//splitting only logs its chunks, the database is created when opened
+	_, err = repo1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err = os.Stat(filepath.Join(wd1, ".git", "chunks", "a.chunks"))
+	if err != nil || fi.Mode() != 0660 {
+		t.Errorf("expected chunks database mode 0660, got: %v (%v)", fi, err)
+	}
+
+	settings, err := repo1.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range settings {
+		if s.Name == "bits.dir-mode" && s.Value != "2770" {
+			t.Errorf("expected dir mode to be reported as configured, got: %+v", s)
+		}
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 512*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	store.Close()
+	if kind := bits.KindOf(err); kind != bits.ConfigError {
+		t.Fatalf("expected pushing without a remote to be a config error, got kind %d: %v", kind, err)
+	}
+
+	missing := bits.K{}
+	missing[0] = 0xab
+	err = repo1.Combine(strings.NewReader(fmt.Sprintf("%x\n", missing)), ioutil.Discard)
+	if kind := bits.KindOf(err); kind != bits.MissingChunkError {
+		t.Fatalf("expected combining an unknown chunk to be a missing chunk error, got kind %d: %v", kind, err)
+	}
+
+	//the local chunks are fetched, the unknown one isn't stored remotely
+	repo1.SetRemote(bits.NewMemoryRemote())
+	fetch := keys.String() + fmt.Sprintf("%x\n", missing)
+	err = repo1.Fetch(strings.NewReader(fetch), ioutil.Discard)
+	if kind := bits.KindOf(err); kind != bits.PartialError {
+		t.Fatalf("expected fetching some chunks to be a partial error, got kind %d: %v", kind, err)
+	}
+}
+
+func TestDeleteChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_delete_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	dremote, err := bits.NewDirRemote(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, remote := range []bits.Remote{bits.NewMemoryRemote(), dremote} {
+		keys := []bits.K{{0x01}, {0x02}, {0x03}}
+		for _, k := range keys {
+			wc, err := remote.ChunkWriter(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fmt.Fprintf(wc, "chunk %x", k)
+			err = wc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		//chunks that aren't stored are ignored
+		err = remote.DeleteChunks([]bits.K{keys[0], keys[2], {0xff}})
+		if err != nil {
+			t.Fatalf("expected deleting to succeed, got: %v", err)
+		}
+
+		listed := bytes.NewBuffer(nil)
+		err = remote.ListChunks(listed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if listed.String() != fmt.Sprintf("%x\n", keys[1]) {
+			t.Errorf("expected only the second chunk to remain, got: %s", listed.String())
+		}
+	}
+}
+
+func TestDedupReport(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the second version of the texture only changes its end, the model
+	//shares nothing
+	v1 := bits.BenchContent(6*1024*1024, 1)
+	v2 := append(append([]byte{}, v1[:5*1024*1024]...), bits.BenchContent(1024*1024, 2)...)
+	for name, content := range map[string][]byte{"texture_v1.bin": v1, "model.bin": bits.BenchContent(2*1024*1024, 3)} {
+		err = ioutil.WriteFile(filepath.Join(wd1, name), content, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "v1")
+	err = ioutil.WriteFile(filepath.Join(wd1, "texture_v2.bin"), v2, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "v2")
+	report, err := repo1.DedupReport([]string{"HEAD"}, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Files != 3 || report.Paths != 3 || report.UniqueChunks >= report.Chunks || report.UniqueBytes >= report.Bytes {
+		t.Fatalf("expected 3 files that share chunks, got: %+v", report)
+	}
+
+	if len(report.Shares) != 2 {
+		t.Fatalf("expected the textures to share chunks both ways, got: %+v", report.Shares)
+	}
+
+	for _, share := range report.Shares {
+		if share.File.Path == "model.bin" || share.Other.Path == "model.bin" || share.Share < 0.5 || share.Share >= 1 {
+			t.Errorf("expected the textures to share most chunks, got: %s shares %.2f with %s", share.File.Path, share.Share, share.Other.Path)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 3*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []bits.K{}
+	err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		keys = append(keys, k)
+		if err == nil {
+			err = os.Remove(p)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the chunks are fetched again and decrypt to the original content
+	plain := bytes.NewBuffer(nil)
+	for _, k := range keys {
+		_, err = repo1.Get(bits.KeyVersion0, k, false, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(plain.Bytes(), content) {
+		t.Fatalf("expected the chunks to decrypt to the original content")
+	}
+
+	//a corrupt chunk is reported until it is fetched again
+	p, err := repo1.Get(bits.KeyVersion0, keys[0], false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(p, []byte("corrupt"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo1.Get(bits.KeyVersion0, keys[0], false, nil)
+	if bits.KindOf(err) != bits.VerificationError {
+		t.Fatalf("expected a corrupt chunk to fail verification, got: %v", err)
+	}
+
+	_, err = repo1.Get(bits.KeyVersion0, keys[0], true, nil)
+	if err != nil {
+		t.Fatalf("expected forcing to fetch the chunk again, got: %v", err)
+	}
+
+	_, err = repo1.Get(bits.KeyVersion0, bits.K{0xff}, false, nil)
+	if err == nil {
+		t.Fatalf("expected getting an unknown chunk to fail")
+	}
+}
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 3*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the pointer is committed as-is, without a filter
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "file1.bin"), ptr.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+
+	//chunks that are only stored remotely are fetched when read
+	repo1.SetRemote(bits.NewMemoryRemote())
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []bits.K{}
+	err = repo1.ForEach(bytes.NewReader(ptr.Bytes()), func(k bits.K) error {
+		p, err := repo1.Path(k, false)
+		keys = append(keys, k)
+		if err == nil {
+			err = os.Remove(p)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw, err := bits.NewGateway(repo1, "HEAD", "renders", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	prev := bits.GatewayMaxKeys
+	bits.GatewayMaxKeys = 1
+	defer func() { bits.GatewayMaxKeys = prev }()
+
+	//every chunk is listed, a page at a time
+	listed := map[string]bool{}
+	token := ""
+	for i := 0; i <= len(keys); i++ {
+		resp, err := http.Get(srv.URL + "/renders?list-type=2&continuation-token=" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v := struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct{ Key string }
+		}{}
+
+		err = xml.NewDecoder(resp.Body).Decode(&v)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, obj := range v.Contents {
+			listed[obj.Key] = true
+		}
+
+		if !v.IsTruncated {
+			break
+		}
+
+		token = v.NextContinuationToken
+	}
+
+	if len(listed) != len(keys) {
+		t.Fatalf("expected %d chunks to be listed, got: %v", len(keys), listed)
+	}
+
+	plain := bytes.NewBuffer(nil)
+	for _, k := range keys {
+		resp, err := http.Get(fmt.Sprintf("%s/renders/%x", srv.URL, k))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected chunk '%x' to be served, got: %s", k, resp.Status)
+		}
+
+		io.Copy(plain, resp.Body)
+		resp.Body.Close()
+	}
+
+	if !bytes.Equal(plain.Bytes(), content) {
+		t.Fatalf("expected the decrypted chunks to make up the original content")
+	}
+
+	for path, code := range map[string]int{
+		"/renders/" + strings.Repeat("ff", bits.KeySize): http.StatusNotFound,
+		"/other":           http.StatusNotFound,
+		"/renders/notakey": http.StatusNotFound,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("expected '%s' to respond with %d, got: %s", path, code, resp.Status)
+		}
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%s/renders/%x", srv.URL, keys[0]), "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected the gateway to be read-only, got: %s", resp.Status)
+	}
+}
+
+func TestKeyVersionReaders(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 3*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//chunks of this version are neither encrypted nor named as those of
+	//version 0, a reader that ignores the version can't read them
+	bits.CurrentKeyVersion = bits.KeyVersionTest
+	defer func() { bits.CurrentKeyVersion = bits.KeyVersion0 }()
+	buf := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), buf)
+	bits.CurrentKeyVersion = bits.KeyVersion0
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := repo1.ReadPointer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range ptr.Chunks {
+		if c.Version != bits.KeyVersionTest {
+			t.Fatalf("expected chunks to be split with the current key version, got: %+v", c)
+		}
+
+		p, _ := repo1.Path(c.K, false)
+		if _, err = os.Stat(p); err == nil {
+			t.Errorf("expected chunk '%x' to be stored under its version, found it at '%s'", c.K, p)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "file1.bin"), buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	err = repo1.Git(ctx, nil, nil, "push", "origin", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(buf.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := mem.Keys(); len(keys) != 0 {
+		t.Errorf("expected no chunks to be pushed under version 0 names, got: %x", keys)
+	}
+
+	//each reader runs in a clone that has none of the chunks
+	for name, read := range map[string]func(repo *bits.Repository) ([]byte, error){
+		"fetch and combine": func(repo *bits.Repository) ([]byte, error) {
+			keys := bytes.NewBuffer(nil)
+			err := repo.Fetch(bytes.NewReader(buf.Bytes()), keys)
+			if err != nil {
+				return nil, err
+			}
+
+			out := bytes.NewBuffer(nil)
+			err = repo.Combine(keys, out)
+			return out.Bytes(), err
+		},
+		"materialize": func(repo *bits.Repository) ([]byte, error) {
+			out := bytes.NewBuffer(nil)
+			err := repo.Materialize(bytes.NewReader(buf.Bytes()), out)
+			return out.Bytes(), err
+		},
+		"read at": func(repo *bits.Repository) ([]byte, error) {
+			out := bytes.NewBuffer(nil)
+			err := repo.ReadAt("HEAD", "file1.bin", 0, -1, out)
+			return out.Bytes(), err
+		},
+		"get": func(repo *bits.Repository) ([]byte, error) {
+			out := bytes.NewBuffer(nil)
+			for _, c := range ptr.Chunks {
+				_, err := repo.Get(c.Version, c.K, false, out)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			return out.Bytes(), nil
+		},
+		"retry failed fetches": func(repo *bits.Repository) ([]byte, error) {
+			repo.SetRemote(nil)
+			err := repo.Fetch(bytes.NewReader(buf.Bytes()), ioutil.Discard)
+			if err == nil {
+				return nil, fmt.Errorf("expected fetching without a remote to fail")
+			}
+
+			repo.SetRemote(mem)
+			_, remaining, err := repo.RetryFailedFetches()
+			if err != nil || remaining != 0 {
+				return nil, fmt.Errorf("expected all chunks to be fetched on retry, %d remain: %v", remaining, err)
+			}
+
+			out := bytes.NewBuffer(nil)
+			err = repo.Combine(bytes.NewReader(buf.Bytes()), out)
+			return out.Bytes(), err
+		},
+		"gateway": func(repo *bits.Repository) ([]byte, error) {
+			gw, err := bits.NewGateway(repo, "HEAD", "renders", true)
+			if err != nil {
+				return nil, err
+			}
+
+			srv := httptest.NewServer(gw)
+			defer srv.Close()
+			out := bytes.NewBuffer(nil)
+			for _, c := range ptr.Chunks {
+				resp, err := http.Get(srv.URL + "/renders/" + bits.FormatKey(c.Version, c.K))
+				if err != nil {
+					return nil, err
+				}
+
+				io.Copy(out, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+				}
+			}
+
+			return out.Bytes(), nil
+		},
+	} {
+		_, repo := bitstest.GitCloneWorkspace(remote1, t)
+		repo.SetRemote(mem)
+		data, err := read(repo)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if !bytes.Equal(data, content) {
+			t.Errorf("%s: expected the original content to be read", name)
+		}
+	}
+}
+
+//chunks of another key version keep it when they are staged, scanned,
+//pushed to s3, fetched and collected
+func TestKeyVersionGC(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 3*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bits.CurrentKeyVersion = bits.KeyVersionTest
+	defer func() { bits.CurrentKeyVersion = bits.KeyVersion0 }()
+	buf := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := repo1.ReadPointer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for _, c := range ptr.Chunks {
+		keys = append(keys, bits.FormatKey(c.Version, c.K))
+	}
+
+	status, err := repo1.Status()
+	if err != nil || status.Staged != len(keys) {
+		t.Fatalf("expected the %d split chunks to be staged, got: %+v (%v)", len(keys), status, err)
+	}
+
+	//the pointer is committed on a branch that is deleted later
+	err = ioutil.WriteFile(filepath.Join(wd1, "README"), []byte("hello"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c0")
+	err = repo1.Git(ctx, nil, nil, "checkout", "-b", "side")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "file1.bin"), buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	scanned := bytes.NewBuffer(nil)
+	err = repo1.ScanAll(scanned)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Fields(scanned.String()); !reflect.DeepEqual(got, keys) {
+		t.Fatalf("expected the keys to be scanned with their version, got: %v", got)
+	}
+
+	stub := newS3Stub()
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	s3Remote := func(repo *bits.Repository) *bits.S3Remote {
+		remote, err := bits.NewS3Remote(repo, "origin", "bucket", "access-key", "secret-key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remote.UseS3Server(srv.Listener.Addr().String())
+		return remote
+	}
+
+	repo1.SetRemote(s3Remote(repo1))
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(scanned.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range ptr.Chunks {
+		if _, ok := stub.object(bits.ChunkObjectName(c.Version, c.K, 0)); !ok {
+			t.Errorf("expected chunk '%s' to be pushed under the name of its version", bits.FormatKey(c.Version, c.K))
+		}
+
+		if _, ok := stub.object(fmt.Sprintf("%x", c.K)); ok {
+			t.Errorf("expected chunk '%s' not to be pushed under a version 0 name", bits.FormatKey(c.Version, c.K))
+		}
+	}
+
+	status, err = repo1.Status()
+	if err != nil || status.Staged != 0 || status.Cached != len(keys) {
+		t.Fatalf("expected the %d pushed chunks to be cached, got: %+v (%v)", len(keys), status, err)
+	}
+
+	//a clone fetches the chunks under their version
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+	repo2.SetRemote(s3Remote(repo2))
+	err = repo2.Fetch(bytes.NewReader(scanned.Bytes()), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = repo2.Materialize(bytes.NewReader(buf.Bytes()), out)
+	if err != nil || !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("expected the fetched chunks to combine into the content, got %d bytes (%v)", out.Len(), err)
+	}
+
+	defer func(grace time.Duration) { bits.GCGracePeriod = grace }(bits.GCGracePeriod)
+	bits.GCGracePeriod = 0
+	removed, _, err := repo1.GC(ioutil.Discard, false)
+	if err != nil || removed != 0 {
+		t.Fatalf("expected no chunks to be removed while the blob exists, got: %d (%v)", removed, err)
+	}
+
+	for _, args := range [][]string{
+		{"checkout", "master"},
+		{"branch", "-D", "side"},
+		{"reflog", "expire", "--expire=now", "--all"},
+		{"gc", "--prune=now", "--quiet"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collected := bytes.NewBuffer(nil)
+	removed, _, err = repo1.GC(collected, false)
+	if err != nil || removed != len(keys) {
+		t.Fatalf("expected the %d chunks of the deleted branch to be removed, got: %d (%v)", len(keys), removed, err)
+	}
+
+	got := strings.Fields(collected.String())
+	sort.Strings(got)
+	want := append([]string{}, keys...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the removed keys to be written with their version, got: %v", got)
+	}
+
+	for _, c := range ptr.Chunks {
+		p, err := repo1.ChunkPath(c.Version, c.K)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected chunk '%s' to be removed, got: %v", bits.FormatKey(c.Version, c.K), err)
+		}
+	}
+}
+
+func TestVerifyRef(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	repo1.SetRemote(bits.NewMemoryRemote())
+
+	//the pointers are committed as-is, without a filter
+	ptrs := map[string][]byte{}
+	for _, name := range []string{"pushed.bin", "unpushed.bin"} {
+		content := make([]byte, 3*1024*1024)
+		_, err := rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptrs[name] = ptr.Bytes()
+		err = ioutil.WriteFile(filepath.Join(wd1, name), ptr.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	report, err := repo1.VerifyRef("HEAD", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Files != 2 || report.Local != report.Chunks || report.Remote != 0 {
+		t.Fatalf("expected all chunks to be stored locally, got: %+v", report)
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptrs["pushed.bin"]), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//pushed chunks are only stored remotely, one unpushed chunk is lost
+	removeChunks := func(ptr []byte, n int) {
+		err = repo1.ForEach(bytes.NewReader(ptr), func(k bits.K) error {
+			if n == 0 {
+				return nil
+			}
+
+			n--
+			p, _ := repo1.Path(k, false)
+			return os.Remove(p)
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeChunks(ptrs["pushed.bin"], -1)
+	removeChunks(ptrs["unpushed.bin"], 1)
+
+	out := bytes.NewBuffer(nil)
+	report, err = repo1.VerifyRef("HEAD", out)
+	if bits.KindOf(err) != bits.MissingChunkError {
+		t.Fatalf("expected a missing chunk error, got: %v", err)
+	}
+
+	if len(report.Missing) != 1 || report.Remote == 0 || len(report.Broken) != 1 || report.Broken[0].Path != "unpushed.bin" {
+		t.Fatalf("expected only the unpushed file to be broken, got: %+v", report)
+	}
+
+	if !strings.HasPrefix(out.String(), "unpushed.bin: 1 of") {
+		t.Fatalf("expected the broken file to be reported, got: %s", out.String())
+	}
+}
+
+func TestCICheck(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	repo1.SetRemote(bits.NewMemoryRemote())
+
+	//the pointers are committed as-is, without a filter
+	ptrs := map[string][]byte{}
+	for _, name := range []string{"a.bin", "b.bin"} {
+		ptr := bytes.NewBuffer(nil)
+		err := repo1.Split(bytes.NewReader(bits.BenchContent(2*1024*1024, int64(len(ptrs)))), ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptrs[name] = ptr.Bytes()
+		err = ioutil.WriteFile(filepath.Join(wd1, name), ptr.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptrs["a.bin"]), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the unpushed file can be reconstructed locally but isn't pushed
+	report, err := repo1.CICheck("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Passed || report.Failures != 1 || len(report.Results) != 4 {
+		t.Fatalf("expected a single failed check, got: %+v", report)
+	}
+
+	for _, r := range report.Results {
+		if r.Passed() == (r.Check == "pushed" && r.Path == "b.bin") {
+			t.Errorf("expected only the unpushed file to fail the push check, got: %+v", r)
+		}
+	}
+
+	junit := bytes.NewBuffer(nil)
+	err = bits.WriteCIReport(junit, report, "junit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := struct {
+		Tests    int `xml:"tests,attr"`
+		Failures int `xml:"failures,attr"`
+		Suites   []struct {
+			Name  string `xml:"name,attr"`
+			Cases []struct {
+				Name    string    `xml:"name,attr"`
+				Failure *struct{} `xml:"failure"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}{}
+
+	err = xml.Unmarshal(junit.Bytes(), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Tests != 4 || v.Failures != 1 || len(v.Suites) != 2 || v.Suites[1].Cases[1].Failure == nil {
+		t.Fatalf("expected the junit report to hold the failed check, got: %s", junit.String())
+	}
+
+	js := bytes.NewBuffer(nil)
+	err = bits.WriteCIReport(js, report, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := bits.CIReport{}
+	err = json.Unmarshal(js.Bytes(), &decoded)
+	if err != nil || decoded.Failures != 1 || len(decoded.Results) != 4 {
+		t.Fatalf("expected the json report to decode, got: %+v (%v)", decoded, err)
+	}
+
+	store, err = repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptrs["b.bin"]), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = repo1.CICheck("HEAD")
+	if err != nil || !report.Passed {
+		t.Fatalf("expected all checks to pass once pushed, got: %+v (%v)", report, err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	//the pointer is committed as-is, without a filter
+	ptr := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(bits.BenchContent(3*1024*1024, 1)), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "data.bin"), ptr.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	err = repo1.Git(ctx, nil, nil, "tag", "v1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyp := filepath.Join(t.TempDir(), "id_ed25519")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "publisher", "-f", keyp).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v: %s", err, out)
+	}
+
+	pub, err := ioutil.ReadFile(keyp + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers := filepath.Join(t.TempDir(), "allowed_signers")
+	err = ioutil.WriteFile(signers, append([]byte("publisher@example.com "), pub...), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := repo1.Manifest("v1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.NewBuffer(nil)
+	m.WriteTo(data)
+	sig, err := bits.SignManifest(data.Bytes(), keyp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bits.VerifyManifestSignature(data.Bytes(), sig, signers, "publisher@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Replace(data.Bytes(), []byte("v1.0"), []byte("v1.1"), 1)
+	err = bits.VerifyManifestSignature(tampered, sig, signers, "publisher@example.com")
+	if bits.KindOf(err) != bits.VerificationError {
+		t.Fatalf("expected a tampered manifest to fail verification, got: %v", err)
+	}
+
+	read, err := bits.ReadManifest(bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.Tag != "v1.0" || read.Commit != m.Commit || len(read.Chunks) != len(m.Chunks) || len(m.Chunks) < 2 {
+		t.Fatalf("expected the manifest to read back, got: %+v", read)
+	}
+
+	err = repo1.VerifyManifest(read, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := repo1.Path(m.Chunks[0].K, false)
+	err = os.Remove(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.VerifyManifest(read, ioutil.Discard)
+	if bits.KindOf(err) != bits.MissingChunkError {
+		t.Fatalf("expected a missing chunk to be reported, got: %v", err)
+	}
+
+	err = ioutil.WriteFile(p, make([]byte, m.Chunks[0].Size), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := bytes.NewBuffer(nil)
+	err = repo1.VerifyManifest(read, report)
+	if bits.KindOf(err) != bits.VerificationError || !strings.Contains(report.String(), "corrupt") {
+		t.Fatalf("expected a corrupt chunk to be reported, got: %v: %s", err, report.String())
+	}
+}
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	//the public bucket is served anonymously over http
+	public := bits.NewMemoryRemote()
+	srv := httptest.NewServer(http.StripPrefix("/dataset/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := bits.ParseKeyLine([]byte(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		rc, err := public.ChunkReader(c.K)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		defer rc.Close()
+		io.Copy(w, rc)
+	})))
+
+	defer srv.Close()
+
+	content := bits.BenchContent(3*1024*1024, 1)
+	ptr := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the pointer is committed as-is, without a filter
+	err = ioutil.WriteFile(filepath.Join(wd1, "data.bin"), ptr.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.SharePublicURL(ioutil.Discard, srv.URL+"/dataset/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "c1")
+	err = repo1.Git(ctx, nil, nil, "push", "origin", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published, skipped, err := repo1.Publish(public, []string{"HEAD"}, 0)
+	if err != nil || published == 0 || skipped != 0 {
+		t.Fatalf("expected all chunks to be published, got %d (skipped %d): %v", published, skipped, err)
+	}
+
+	published, skipped, err = repo1.Publish(public, []string{"HEAD"}, 0)
+	if err != nil || published != 0 || skipped == 0 {
+		t.Fatalf("expected published chunks to be skipped, got %d (skipped %d): %v", published, skipped, err)
+	}
+
+	//a clone without credentials reads the dataset anonymously
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+	buf := bytes.NewBuffer(nil)
+	err = repo2.ReadAt("HEAD", "data.bin", 0, -1, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Fatalf("expected the published file to be read back")
+	}
+
+	store, err := repo2.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo2.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != bits.ErrReadOnly {
+		t.Fatalf("expected a clone that reads the public url to be read-only, got: %v", err)
+	}
+}
+
+func TestCloneAndMaterialize(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	public := bits.NewMemoryRemote()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := bits.ParseKeyLine([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		rc, err := public.ChunkReader(c.K)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		defer rc.Close()
+		io.Copy(w, rc)
+	}))
+
+	defer srv.Close()
+
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.SharePublicURL(ioutil.Discard, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//pointers are committed as-is, without a filter
+	contents := map[string][]byte{}
+	for i, branch := range []string{"master", "other"} {
+		if branch != "master" {
+			err = repo1.Git(ctx, nil, nil, "checkout", "-b", branch)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		contents[branch] = bits.BenchContent(2*1024*1024, int64(i))
+		ptr := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(contents[branch]), ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(wd1, "data.bin"), ptr.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bitstest.GitCommit(t, ctx, repo1, branch)
+		err = repo1.Git(ctx, nil, nil, "push", "origin", branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, err = repo1.Publish(public, []string{"master", "other"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tdir, _ := ioutil.TempDir("", "test_clone_")
+	dir := filepath.Join(tdir, "clone")
+	repo2, err := bits.CloneAndMaterialize(ctx, remote1, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	if err != nil || !bytes.Equal(data, contents["master"]) {
+		t.Fatalf("expected the clone to hold the content of the split file, got %d bytes: %v", len(data), err)
+	}
+
+	err = repo2.MaterializeRef(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	if err != nil || !bytes.Equal(data, contents["other"]) {
+		t.Fatalf("expected the content of the other branch, got %d bytes: %v", len(data), err)
+	}
+
+	_, err = bits.CloneAndMaterialize(ctx, filepath.Join(remote1, "missing"), filepath.Join(tdir, "clone2"), nil)
+	if err == nil {
+		t.Errorf("expected cloning a repository that doesn't exist to fail")
+	}
+}
+
+func TestBenchClone(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	public := bits.NewMemoryRemote()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := bits.ParseKeyLine([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		rc, err := public.ChunkReader(c.K)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		defer rc.Close()
+		io.Copy(w, rc)
+	}))
+
+	defer srv.Close()
+
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
+		"*.bin": "filter=bits",
+	})
+
+	err := repo1.SharePublicURL(ioutil.Discard, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bits.BenchContent(2*1024*1024, 1)
+	ptr := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "data.bin"), ptr.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitCommit(t, ctx, repo1, "master")
+	err = repo1.Git(ctx, nil, nil, "push", "origin", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = repo1.Publish(public, []string{"master"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tdir, _ := ioutil.TempDir("", "test_bench_clone_")
+	dir := filepath.Join(tdir, "clone")
+	res, err := bits.BenchClone(ctx, remote1, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Files != 1 || res.Bytes != int64(len(content)) || res.Chunks < 1 {
+		t.Errorf("expected 1 file of %d bytes, got %d files of %d bytes in %d chunks", len(content), res.Files, res.Bytes, res.Chunks)
+	}
+
+	names := []string{}
+	total := time.Duration(0)
+	for _, p := range res.Phases {
+		names = append(names, p.Name)
+		total += p.Duration
+	}
+
+	if strings.Join(names, " ") != strings.Join(bits.ClonePhases, " ") || total > res.Duration {
+		t.Errorf("expected phases %v that add up to at most %s, got: %v", bits.ClonePhases, res.Duration, res.Phases)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("expected the clone to hold the content of the split file, got %d bytes: %v", len(data), err)
+	}
+}
+
+func TestChunkHooks(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	wd2, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := bits.BenchContent(3*1024*1024, 1)
+	copy(content[1000:], "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR")
+	ptr := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	repo1.ChunkHook = func(op bits.Op, k bits.K, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if op != bits.PushOp || bits.SHA256.Sum(data) != k {
+			t.Errorf("expected the plain-text content of a pushed chunk, got op '%s'", op)
+		}
+
+		if bytes.Contains(data, []byte("EICAR")) {
+			return fmt.Errorf("infected")
+		}
+
+		return nil
+	}
+
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	if err == nil || !strings.Contains(err.Error(), "infected") {
+		t.Fatalf("expected the infected chunk to be refused, got: %v", err)
+	}
+
+	first, err := bits.ParseKeyLine([]byte(strings.Split(ptr.String(), "\n")[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range mem.Keys() {
+		if k == first.K {
+			t.Fatalf("expected the infected chunk not to be pushed")
+		}
+	}
+
+	repo1.ChunkHook = nil
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo2, map[string]string{
+		"bits.fetch-hook": "test \"$GIT_BITS_OP\" = fetch && ! grep -q EICAR",
+	})
+
+	repo2, err = bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo2.SetRemote(mem)
+	err = repo2.Fetch(bytes.NewReader(ptr.Bytes()), ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "refused by the fetch hook") {
+		t.Fatalf("expected the infected chunk to be refused, got: %v", err)
+	}
+
+	p, _ := repo2.Path(first.K, false)
+	if _, err = os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected the refused chunk not to be stored, got: %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := bits.BenchContent(3*1024*1024, 1)
+	ptr := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := repo1.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(usage) != 1 || usage[0].Remote != "memory" || usage[0].UploadedBytes < int64(len(content)) || usage[0].UploadedChunks != int64(len(mem.Keys())) || usage[0].DownloadedBytes != 0 {
+		t.Fatalf("expected the pushed chunks to be counted for the memory remote, got: %+v", usage)
+	}
+
+	repo2.SetRemote(mem)
+	for i := 0; i < 2; i++ {
+		err = repo2.Fetch(bytes.NewReader(ptr.Bytes()), ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err = repo2.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(usage) != 1 || usage[0].DownloadedBytes < int64(len(content)) || usage[0].DownloadedChunks != int64(len(mem.Keys())) || usage[0].UploadedBytes != 0 {
+		t.Fatalf("expected chunks that were fetched once to be counted, got: %+v", usage)
+	}
+
+	if usage[0].Since.IsZero() || usage[0].Last.Before(usage[0].Since) {
+		t.Errorf("expected the period of the usage to be recorded, got: %+v", usage[0])
+	}
+}
+
+//gatedRemote holds reads of all but the first chunk until 'open' is closed
+//and records how many chunks are read at the same time
+type gatedRemote struct {
+	*bits.MemoryRemote
+	first   bits.K
+	open    chan struct{}
+	reading int32
+	most    int32
+}
+
+func (r *gatedRemote) ChunkReader(k bits.K) (rc io.ReadCloser, err error) {
+	n := atomic.AddInt32(&r.reading, 1)
+	defer atomic.AddInt32(&r.reading, -1)
+	for {
+		most := atomic.LoadInt32(&r.most)
+		if n <= most || atomic.CompareAndSwapInt32(&r.most, most, n) {
+			break
+		}
+	}
+
+	if k != r.first {
+		select {
+		case <-r.open:
+		case <-time.After(5 * time.Second):
+			return nil, fmt.Errorf("chunk '%x' was read before the first chunk was written", k)
+		}
+	}
+
+	return r.MemoryRemote.ChunkReader(k)
+}
+
+//firstWriter closes 'written' on the first write
+type firstWriter struct {
+	buf     bytes.Buffer
+	written chan struct{}
+}
+
+func (w *firstWriter) Write(p []byte) (n int, err error) {
+	if w.buf.Len() == 0 {
+		close(w.written)
+	}
+
+	return w.buf.Write(p)
+}
+
+func TestMaterialize(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	_, repo2 := bitstest.GitCloneWorkspace(remote1, t)
+
+	content := bits.BenchContent(6*1024*1024, 1)
+	ptr := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(content), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := bits.NewMemoryRemote()
+	repo1.SetRemote(mem)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := bits.ParseKeyLine([]byte(strings.Split(ptr.String(), "\n")[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(n int) { bits.MaterializeReadahead = n }(bits.MaterializeReadahead)
+	bits.MaterializeReadahead = 1
+	w := &firstWriter{written: make(chan struct{})}
+	gated := &gatedRemote{MemoryRemote: mem, first: first.K, open: w.written}
+	repo2.SetRemote(gated)
+	err = repo2.Materialize(bytes.NewReader(ptr.Bytes()), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(w.buf.Bytes(), content) {
+		t.Fatalf("expected materialized content to equal the original")
+	}
+
+	if n := len(mem.Keys()); n < 4 || gated.most > 2 {
+		t.Errorf("expected at most 2 of %d chunks to be read at the same time, got: %d", n, gated.most)
+	}
+}
+
+func TestIngest(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	dir, err := ioutil.TempDir("", "test_ingest_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	contents := map[string][]byte{
+		"a.bin":         bits.BenchContent(2*1024*1024, 1),
+		"sub/b.bin":     bits.BenchContent(1024*1024, 2),
+		".git/HEAD.bin": bits.BenchContent(1024*1024, 3),
+	}
+
+	for p, content := range contents {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(dir, p), content, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ptrs := map[string][]byte{}
+	files, size, err := repo1.Ingest(dir, func(p string, ptr []byte) error {
+		ptrs[p] = ptr
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files != 2 || size != 3*1024*1024 || len(ptrs) != 2 {
+		t.Fatalf("expected the two files outside the git directory to be ingested, got: %d (%d bytes) %v", files, size, len(ptrs))
+	}
+
+	for _, p := range []string{"a.bin", "sub/b.bin"} {
+		out := bytes.NewBuffer(nil)
+		err = repo1.Combine(bytes.NewReader(ptrs[p]), out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out.Bytes(), contents[p]) {
+			t.Errorf("expected the pointer of '%s' to combine into its content", p)
+		}
+	}
+
+	status, err := repo1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Staged == 0 {
+		t.Errorf("expected ingested chunks to be staged, got: %+v", status)
+	}
+}
+
+//blockingRemote holds chunk writes until 'open' is closed, 'writing' is
+//closed when the first write starts
+type blockingRemote struct {
+	*bits.MemoryRemote
+	open    chan struct{}
+	writing chan struct{}
+	once    sync.Once
+}
+
+func (r *blockingRemote) ChunkWriter(k bits.K) (wc io.WriteCloser, err error) {
+	r.once.Do(func() { close(r.writing) })
+	<-r.open
+	return r.MemoryRemote.ChunkWriter(k)
+}
+
+func TestConcurrentRepository(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	keys := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(bits.BenchContent(2*1024*1024, 1)), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &blockingRemote{MemoryRemote: bits.NewMemoryRemote(), open: make(chan struct{}), writing: make(chan struct{})}
+	repo1.SetRemote(remote)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushErr := make(chan error)
+	go func() {
+		pushErr <- repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	}()
+
+	//operations that run while the push holds the store share it
+	<-remote.writing
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			err := repo1.Split(bytes.NewReader(bits.BenchContent(64*1024, int64(i+2))), ioutil.Discard)
+			if err == nil && time.Since(start) > 900*time.Millisecond {
+				err = fmt.Errorf("split waited %s for the local store", time.Since(start))
+			}
+
+			errs <- err
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected splitting during a push to succeed, got: %v", err)
+		}
+	}
+
+	repo1.SetRemote(remote)
+	close(remote.open)
+	err = <-pushErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//progress of operations after closing is dropped
+	err = repo1.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	cmd := exec.Command("git", "init", "--bare")
-	cmd.Dir = dir
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	err = repo1.Split(bytes.NewReader(bits.BenchContent(64*1024, 9)), ioutil.Discard)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	return dir
+	err = repo1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func GitCloneWorkspace(remote string, t *testing.T) (dir string, repo *bits.Repository) {
-	dir, err := ioutil.TempDir("", "test_remote_")
+func TestProgressSinks(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.progress": "fancy",
+	})
+
+	_, err := bits.NewRepository(wd1, nil)
+	if err == nil || !strings.Contains(err.Error(), "expected one of") {
+		t.Fatalf("expected an unknown progress sink to be refused, got: %v", err)
+	}
+
+	bitstest.GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.progress": "json",
+	})
+
+	out := bytes.NewBuffer(nil)
+	repo1, err = bits.NewRepository(wd1, out)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	cmd := exec.Command("git", "clone", remote, dir)
-	cmd.Dir = dir
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	err = repo1.Split(bytes.NewReader(bits.BenchContent(2*1024*1024, 1)), ioutil.Discard)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	repo, err = bits.NewRepository(dir, nil)
+	err = repo1.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	return dir, repo
-}
+	reported := out.String()
+	s := bufio.NewScanner(out)
+	events := 0
+	for s.Scan() {
+		ev := struct {
+			Op  string `json:"op"`
+			Key string `json:"key"`
+		}{}
 
-func GitConfigure(t *testing.T, ctx context.Context, repo *bits.Repository, conf map[string]string) {
-	for k, val := range conf {
-		err := repo.Git(ctx, nil, nil, "config", "--local", k, val)
+		err = json.Unmarshal(s.Bytes(), &ev)
 		if err != nil {
-			t.Fatal(err)
+			t.Fatalf("expected each line to be json, got '%s': %v", s.Text(), err)
 		}
-	}
-}
 
-func WriteGitAttrFile(t *testing.T, dir string, attr map[string]string) {
-	f, err := os.Create(filepath.Join(dir, ".gitattributes"))
-	if err != nil {
-		t.Fatal(err)
-	}
+		if ev.Op != string(bits.StageOp) || len(ev.Key) != 64 {
+			t.Errorf("expected a staged chunk, got: %s", s.Text())
+		}
 
-	defer f.Close()
-	for pattern, attr := range attr {
-		fmt.Fprintf(f, "%s\t%s\n", pattern, attr)
+		events++
 	}
-}
 
-func BuildBinaryInPath(t *testing.T, ctx context.Context) {
-	gopath := os.Getenv("GOPATH")
-	if gopath == "" {
-		t.Fatalf("GOPATH not set for building git-bits for integration test, env: %+v", os.Environ())
+	if events == 0 {
+		t.Errorf("expected staged chunks to be reported, got: %q", reported)
 	}
 
-	cmd := exec.CommandContext(ctx, "go", "build", "-o", filepath.Join(gopath, "bin", "git-bits"))
-	cmd.Dir = filepath.Join(gopath, "src", "github.com", "nerdalize", "git-bits")
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	//commands can override the configured sink
+	out.Reset()
+	repo1, err = bits.NewRepository(wd1, out)
 	if err != nil {
-		t.Fatalf("failed to build git-bits, make sure this project is in $GOPATH/src/github.com/nerdalize/git-bits: %v", err)
+		t.Fatal(err)
 	}
 
-}
+	quiet, err := bits.NewProgressSink("quiet", out)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func WriteRandomFile(t *testing.T, path string, size int64) (f *os.File) {
-	f, err := os.Create(path)
+	repo1.SetProgress(quiet)
+	err = repo1.Split(bytes.NewReader(bits.BenchContent(2*1024*1024, 2)), ioutil.Discard)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	randr := io.LimitReader(rand.Reader, size)
-	_, err = io.Copy(f, randr)
+	err = repo1.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	return f
+	if out.Len() != 0 {
+		t.Errorf("expected nothing to be reported, got: %s", out.String())
+	}
 }
 
-func TestNewRepository(t *testing.T) {
-	_, err := bits.NewRepository("/tmp/my-bogus-repo", nil)
-	if err == nil {
-		t.Errorf("creating repo in non-existing directory should fail")
-	} else {
-		if !strings.Contains(err.Error(), "git repository") {
-			t.Errorf("creating repo should fail with non existing dir error, got: %v", err)
-		}
+//recordingObserver keeps the remote operations it is told about
+type recordingObserver struct {
+	mu       sync.Mutex
+	started  []bits.RemoteOp
+	finished []bits.RemoteOp
+}
+
+func (o *recordingObserver) RemoteStarted(op bits.RemoteOp) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.started = append(o.started, op)
+}
+
+func (o *recordingObserver) RemoteFinished(op bits.RemoteOp) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.finished = append(o.finished, op)
+}
+
+func TestObserveRemote(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	ptr := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(bits.BenchContent(2*1024*1024, 1)), ptr)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	tdir, _ := ioutil.TempDir("", "test_wdir_")
-	_, err = bits.NewRepository(tdir, nil)
-	if err == nil {
-		t.Errorf("creating repo in non-git directory should fail")
-	} else {
-		if !strings.Contains(err.Error(), "git repository") {
-			t.Errorf("creating repo should fail with exit code, got: %v", err)
+	keys := []bits.K{}
+	for k, err := range repo1.Keys(bytes.NewReader(ptr.Bytes())) {
+		if err != nil {
+			t.Fatal(err)
 		}
+
+		keys = append(keys, k)
 	}
-}
 
-//test basic file splitting and combining
-func TestSplitCombineScan(t *testing.T) {
-	ctx := context.Background()
-	ctx, _ = context.WithTimeout(ctx, time.Second*10)
+	obs := &recordingObserver{}
+	remote := bits.NewMemoryRemote()
+	repo1.SetRemote(remote)
+	repo1.UseRemoteMiddleware(bits.ObserveRemote(obs))
 
-	BuildBinaryInPath(t, ctx) //@TODO this is terrible for unit testing
+	store, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	remote1 := GitInitRemote(t)
-	wd1, repo1 := GitCloneWorkspace(remote1, t)
-	lstore1, err := repo1.LocalStore()
+	err = repo1.Push(store, bytes.NewReader(ptr.Bytes()), "origin")
+	store.Close()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	fmt.Println(lstore1.Path())
-	defer lstore1.Close()
-	WriteGitAttrFile(t, wd1, map[string]string{
-		"*.bin": "filter=bits",
-	})
+	for _, k := range keys {
+		p, _ := repo1.Path(k, false)
+		os.Remove(p)
+	}
 
-	err = repo1.Install(os.Stderr, bits.DefaultConf())
+	err = repo1.Fetch(bytes.NewReader(ptr.Bytes()), ioutil.Discard)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	fpath := filepath.Join(wd1, "file1.bin")
-	f1 := WriteRandomFile(t, fpath, 5*1024*1024)
-	f1.Close()
+	err = repo1.Fetch(strings.NewReader(fmt.Sprintf("%x\n", bits.K{})), ioutil.Discard)
+	if err == nil {
+		t.Fatal("expected fetching a chunk the remote doesn't store to fail")
+	}
 
-	err = repo1.Git(ctx, nil, nil, "add", "-A")
-	if err != nil {
-		t.Error(err)
+	if len(obs.started) != len(obs.finished) {
+		t.Fatalf("expected each started operation to finish, got %d started and %d finished", len(obs.started), len(obs.finished))
 	}
 
-	err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
-	if err != nil {
-		t.Error(err)
+	transferred := map[string]int64{}
+	ops := map[string]int{}
+	failed := 0
+	for _, op := range obs.finished {
+		ops[op.Method]++
+		transferred[op.Method] += op.Bytes
+		if op.Err != nil {
+			failed++
+		}
 	}
 
-	c0buf := bytes.NewBuffer(nil)
-	err = repo1.Git(ctx, nil, c0buf, "rev-parse", "HEAD")
-	if err != nil {
-		t.Error(err)
+	if ops["write"] != len(keys) || ops["read"] < len(keys) {
+		t.Errorf("expected %d chunks to be written and read, got: %v", len(keys), ops)
 	}
 
-	c0 := strings.TrimSpace(c0buf.String())
-	originalContent := bytes.NewBuffer(nil)
+	if transferred["write"] == 0 || transferred["read"] != transferred["write"] {
+		t.Errorf("expected the written bytes to be read back, got: %v", transferred)
+	}
 
-	f2, err := os.OpenFile(fpath, os.O_RDWR, 0666)
-	if err != nil {
-		t.Error(err)
+	if failed == 0 {
+		t.Errorf("expected reading a chunk that isn't stored to be reported as failed")
 	}
 
-	_, err = io.Copy(originalContent, f2)
-	if err != nil {
-		t.Error(err)
+	//operations on the remote that is set later on are observed as well
+	n := len(obs.finished)
+	p, _ := repo1.Path(keys[0], false)
+	os.Remove(p)
+	repo1.SetRemote(bits.NewMemoryRemote())
+	err = repo1.Fetch(strings.NewReader(fmt.Sprintf("%x\n", keys[0])), ioutil.Discard)
+	if err == nil || len(obs.finished) == n {
+		t.Errorf("expected the new remote to be observed, got: %v", err)
 	}
+}
 
-	_, err = f2.WriteAt([]byte{0x00}, 5)
+func TestMonitor(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	repo1.KeyProgressFn = func(bits.KeyOp, float64) {}
+
+	keys := bytes.NewBuffer(nil)
+	err := repo1.Split(bytes.NewReader(bits.BenchContent(2*1024*1024, 1)), keys)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	f2.Close()
+	stop, err := repo1.ServeMonitor()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	//top runs as another process
+	top, err := bits.NewRepository(wd1, nil)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	err = repo1.Git(ctx, nil, nil, "commit", "-m", "c1")
+	_, err = top.ServeMonitor()
+	if err == nil || !strings.Contains(err.Error(), "already served") {
+		t.Errorf("expected a single process to serve the monitor, got: %v", err)
+	}
+
+	remote := &blockingRemote{MemoryRemote: bits.NewMemoryRemote(), open: make(chan struct{}), writing: make(chan struct{})}
+	repo1.SetRemote(remote)
+	store, err := repo1.LocalStore()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	c1buf := bytes.NewBuffer(nil)
-	err = repo1.Git(ctx, nil, c1buf, "rev-parse", "HEAD")
+	defer store.Close()
+	pushErr := make(chan error)
+	go func() {
+		pushErr <- repo1.Push(store, bytes.NewReader(keys.Bytes()), "origin")
+	}()
+
+	<-remote.writing
+	snap, err := top.AttachMonitor()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	c1 := strings.TrimSpace(c1buf.String())
+	if len(snap.Workers) != 1 || snap.Workers[0].Op != bits.PushOp || len(snap.Workers[0].Key) != 64 {
+		t.Errorf("expected a worker that pushes a chunk, got: %+v", snap.Workers)
+	}
 
-	err = repo1.Git(ctx, nil, nil, "checkout", c0)
+	close(remote.open)
+	err = <-pushErr
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	newContent, err := ioutil.ReadFile(fpath)
+	snap, err = top.AttachMonitor()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	if !bytes.Equal(originalContent.Bytes(), newContent) {
-		t.Error("after checkout, file content should be equal to content before edit")
+	if len(snap.Workers) != 1 || snap.Workers[0].Op != "" || snap.Workers[0].Chunks == 0 || snap.Workers[0].Total == 0 {
+		t.Errorf("expected an idle worker that pushed chunks, got: %+v", snap.Workers)
 	}
 
-	scanbuf := bytes.NewBuffer(nil)
-	err = repo1.Scan(c0, c1, scanbuf)
+	if len(snap.Recent) == 0 || snap.Recent[0].Op != bits.PushOp || snap.Recent[0].Err != "" {
+		t.Errorf("expected recently pushed chunks, got: %+v", snap.Recent)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = bits.WriteMonitor(buf, snap)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	if len(scanbuf.Bytes())%(hex.EncodedLen(bits.KeySize)+1) != 0 {
-		t.Errorf("expected a multitude keys to be returned but got: %s", scanbuf.String())
+	if !strings.Contains(buf.String(), snap.Recent[0].Key[:12]) {
+		t.Errorf("expected recent chunks to be shown, got: %s", buf.String())
+	}
+
+	stop()
+	_, err = top.AttachMonitor()
+	if err == nil {
+		t.Errorf("expected attaching to fail once transfers ended")
 	}
 }
 
 //tests pushing and fetching objects from a git remote
 func TestPushFetch(t *testing.T) {
 	ctx := context.Background()
-	ctx, _ = context.WithTimeout(ctx, time.Second*60)
+	ctx, cancel := context.WithTimeout(ctx, time.Second*60)
+	defer cancel()
 
-	remote1 := GitInitRemote(t)
-	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
 	lstore1, err := repo1.LocalStore()
 	if err != nil {
 		t.Error(err)
 	}
 
-	WriteGitAttrFile(t, wd1, map[string]string{
+	bitstest.WriteGitAttrFile(t, wd1, map[string]string{
 		"*.bin": "filter=bits",
 	})
 
@@ -284,7 +9301,7 @@ func TestPushFetch(t *testing.T) {
 	fname := " with space.bin"
 	fsize := int64(5 * 1024 * 1024)
 	fpath := filepath.Join(wd1, fname)
-	f1 := WriteRandomFile(t, fpath, fsize)
+	f1 := bitstest.WriteRandomFile(t, fpath, fsize)
 	err = os.Chmod(f1.Name(), 0755)
 	if err != nil {
 		t.Error(err)
@@ -292,15 +9309,7 @@ func TestPushFetch(t *testing.T) {
 
 	f1.Close()
 
-	err = repo1.Git(ctx, nil, nil, "add", "-A")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = repo1.Git(ctx, nil, nil, "commit", "-m", "base")
-	if err != nil {
-		t.Fatal(err)
-	}
+	bitstest.GitCommit(t, ctx, repo1, "base")
 
 	//Push 1
 	err = repo1.Git(ctx, nil, nil, "push")
@@ -324,15 +9333,7 @@ func TestPushFetch(t *testing.T) {
 			}
 		}()
 
-		err = repo1.Git(ctx, nil, nil, "add", "-A")
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		err = repo1.Git(ctx, nil, nil, "commit", "-m", fmt.Sprintf("c%d", i))
-		if err != nil {
-			t.Fatal(err)
-		}
+		bitstest.GitCommit(t, ctx, repo1, fmt.Sprintf("c%d", i))
 
 	}
 
@@ -347,14 +9348,14 @@ func TestPushFetch(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	wd2, repo2 := GitCloneWorkspace(remote1, t)
+	wd2, repo2 := bitstest.GitCloneWorkspace(remote1, t)
 	lstore2, err := repo2.LocalStore()
 	if err != nil {
 		t.Error(err)
 	}
 
 	defer lstore2.Close()
-	WriteGitAttrFile(t, wd2, map[string]string{
+	bitstest.WriteGitAttrFile(t, wd2, map[string]string{
 		"*.bin": "filter=bits",
 	})
 
@@ -393,6 +9394,261 @@ func TestPushFetch(t *testing.T) {
 	}
 
 	if strings.Contains(buf.String(), " with space.bin") {
-		t.Error("after initi git status shouldnt report files being modified, got: \n %s", buf.String())
+		t.Errorf("after initi git status shouldnt report files being modified, got: \n %s", buf.String())
+	}
+}
+
+//latencyRemote adds a fixed delay to reading and writing chunks, such that
+//benchmarks show the effect of doing so concurrently
+type latencyRemote struct {
+	*bits.MemoryRemote
+	d time.Duration
+}
+
+func (r *latencyRemote) ChunkReader(k bits.K) (rc io.ReadCloser, err error) {
+	time.Sleep(r.d)
+	return r.MemoryRemote.ChunkReader(k)
+}
+
+func (r *latencyRemote) ChunkWriter(k bits.K) (wc io.WriteCloser, err error) {
+	time.Sleep(r.d)
+	return r.MemoryRemote.ChunkWriter(k)
+}
+
+//benchWorkspace splits 'size' bytes of content in a new workspace and
+//returns its pointer and keys
+func benchWorkspace(b *testing.B, size int64) (repo *bits.Repository, ptr []byte, keys []bits.K) {
+	remote1 := bitstest.GitInitRemote(b)
+	_, repo = bitstest.GitCloneWorkspace(remote1, b)
+	repo.KeyProgressFn = func(bits.KeyOp, float64) {}
+
+	buf := bytes.NewBuffer(nil)
+	err := repo.Split(bytes.NewReader(bits.BenchContent(size, 1)), buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = repo.ForEach(bytes.NewReader(buf.Bytes()), func(k bits.K) error {
+		keys = append(keys, k)
+		return nil
+	})
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return repo, buf.Bytes(), keys
+}
+
+func BenchmarkSplit(b *testing.B) {
+	remote1 := bitstest.GitInitRemote(b)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, b)
+	repo1.KeyProgressFn = func(bits.KeyOp, float64) {}
+
+	workers := []int{}
+	for n := 1; n < runtime.NumCPU(); n *= 2 {
+		workers = append(workers, n)
+	}
+
+	data := bits.BenchContent(32*1024*1024, 1)
+	for _, n := range append(workers, runtime.NumCPU()) {
+		b.Run(fmt.Sprintf("workers-%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				_, err := repo1.BenchSplit(data, n)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	//storing encrypts and writes each chunk, new content each iteration
+	//keeps chunks from being deduplicated
+	b.Run("store", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			data := bits.BenchContent(int64(len(data)), int64(i+2))
+			b.StartTimer()
+
+			err := repo1.Split(bytes.NewReader(data), ioutil.Discard)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFetch(b *testing.B) {
+	repo1, ptr, keys := benchWorkspace(b, 16*1024*1024)
+	remote := &latencyRemote{MemoryRemote: bits.NewMemoryRemote(), d: 5 * time.Millisecond}
+	repo1.SetRemote(remote)
+	store, err := repo1.LocalStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = repo1.Push(store, bytes.NewReader(ptr), "origin")
+	store.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	prev := bits.FetchConcurrency
+	defer func() { bits.FetchConcurrency = prev }()
+	for _, n := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("workers-%d", n), func(b *testing.B) {
+			bits.FetchConcurrency = n
+			b.SetBytes(16 * 1024 * 1024)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for _, k := range keys {
+					p, _ := repo1.Path(k, false)
+					os.Remove(p)
+				}
+
+				b.StartTimer()
+				err := repo1.Fetch(bytes.NewReader(ptr), ioutil.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPush(b *testing.B) {
+	b.SetBytes(16 * 1024 * 1024)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		repo1, ptr, _ := benchWorkspace(b, 16*1024*1024)
+		repo1.SetRemote(&latencyRemote{MemoryRemote: bits.NewMemoryRemote(), d: 5 * time.Millisecond})
+		store, err := repo1.LocalStore()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StartTimer()
+		err = repo1.Push(store, bytes.NewReader(ptr), "origin")
+		store.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListChunks(b *testing.B) {
+	memory := bits.NewMemoryRemote()
+	dir, err := bits.NewDirRemote(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < 10000; i++ {
+		k := bits.K{}
+		mrand.Read(k[:])
+		for _, remote := range []bits.Remote{memory, dir} {
+			wc, err := remote.ChunkWriter(k)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			wc.Close()
+		}
+	}
+
+	for name, remote := range map[string]bits.Remote{"memory": memory, "dir": dir} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := remote.ListChunks(ioutil.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+//keyListing returns a listing of 'n' random chunk keys with their size
+func keyListing(n int) []byte {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < n; i++ {
+		k := bits.K{}
+		mrand.Read(k[:])
+		fmt.Fprintf(buf, "%x %d\n", k, 1024)
+	}
+
+	return buf.Bytes()
+}
+
+func TestKeysAllocs(t *testing.T) {
+	remote1 := bitstest.GitInitRemote(t)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	count := func(listing []byte) float64 {
+		return testing.AllocsPerRun(10, func() {
+			for _, err := range repo1.Keys(bytes.NewReader(listing)) {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+
+	small, large := count(keyListing(10)), count(keyListing(10000))
+	if large > small {
+		t.Fatalf("expected allocations not to grow with the number of keys, got %v for 10 keys and %v for 10000", small, large)
+	}
+
+	n := 0
+	for _, err := range repo1.Keys(bytes.NewReader(keyListing(100))) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n++
+		if n == 10 {
+			break
+		}
 	}
+
+	if n != 10 {
+		t.Fatalf("expected iterating to stop after 10 keys, got %d", n)
+	}
+
+	for _, err := range repo1.Keys(strings.NewReader("foo\n")) {
+		if err == nil {
+			t.Fatal("expected an invalid key line to end the iteration with an error")
+		}
+	}
+}
+
+func BenchmarkKeys(b *testing.B) {
+	remote1 := bitstest.GitInitRemote(b)
+	_, repo1 := bitstest.GitCloneWorkspace(remote1, b)
+	listing := keyListing(10000)
+
+	b.Run("keys", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(listing)))
+		for i := 0; i < b.N; i++ {
+			for _, err := range repo1.Keys(bytes.NewReader(listing)) {
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("for-each", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(listing)))
+		for i := 0; i < b.N; i++ {
+			err := repo1.ForEach(bytes.NewReader(listing), func(bits.K) error { return nil })
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
 }
@@ -0,0 +1,114 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	//FetchRetryFile is the file in the chunk directory that lists the keys of
+	//chunks that failed to fetch, one per line
+	FetchRetryFile = "fetch-retry"
+
+	//MaxReportedErrors limits how many errors are listed when many operations fail
+	MaxReportedErrors = 10
+)
+
+//recordFailedFetches appends the keys of chunks 'cs' to the retry file,
+//each call writes all keys at once such that concurrent (smudge) processes
+//don't interleave
+func (repo *Repository) recordFailedFetches(cs ...PointerChunk) (err error) {
+	buf := bytes.NewBuffer(nil)
+	for _, c := range cs {
+		fmt.Fprintf(buf, "%s\n", FormatKey(c.Version, c.K))
+	}
+
+	p := filepath.Join(repo.chunkDir, FetchRetryFile)
+	f, err := repo.openFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %v", p, err)
+	}
+
+	defer f.Close()
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write to '%s': %v", p, err)
+	}
+
+	return nil
+}
+
+//RetryFailedFetches fetches the chunks that failed to fetch earlier, chunks
+//that fail again remain listed in the retry file. It returns how many
+//chunks were fetched and how many remain.
+func (repo *Repository) RetryFailedFetches() (fetched, remaining int, err error) {
+	defer repo.flushAudit(&err)
+	defer repo.flushUsage(nil)
+	p := filepath.Join(repo.chunkDir, FetchRetryFile)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+
+		return 0, 0, fmt.Errorf("failed to read '%s': %v", p, err)
+	}
+
+	//the file is replaced by one that lists the chunks that still fail
+	keys := []PointerChunk{}
+	seen := map[PointerChunk]struct{}{}
+	err = repo.forEachChunk(bytes.NewReader(data), func(c PointerChunk) error {
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			keys = append(keys, c)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read keys from '%s': %v", p, err)
+	}
+
+	err = os.Remove(p)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to remove '%s': %v", p, err)
+	}
+
+	failed := []PointerChunk{}
+	errs := []string{}
+	for _, c := range keys {
+		repo.monitor.retry(FetchOp)
+		ferr := repo.fetchChunk(context.Background(), c.Version, c.K)
+		if ferr != nil {
+			failed = append(failed, c)
+			errs = append(errs, ferr.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		err = repo.recordFailedFetches(failed...)
+		if err != nil {
+			return len(keys) - len(failed), len(failed), err
+		}
+
+		return len(keys) - len(failed), len(failed), withKind(repo.fetchFailureKind(len(failed), len(keys)), fmt.Errorf("failed to fetch %d of %d chunks: \n %s", len(failed), len(keys), summarizeErrors(errs)))
+	}
+
+	return len(keys), 0, nil
+}
+
+//summarizeErrors joins error messages for reporting, listing only the first
+//MaxReportedErrors of them
+func summarizeErrors(errs []string) string {
+	if len(errs) <= MaxReportedErrors {
+		return strings.Join(errs, "\n\t")
+	}
+
+	return fmt.Sprintf("%s\n\t... and %d more", strings.Join(errs[:MaxReportedErrors], "\n\t"), len(errs)-MaxReportedErrors)
+}
@@ -0,0 +1,243 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	//routeLinePrefix starts a line in a list of keys that names the ref the
+	//keys that follow it belong to, e.g. 'ref refs/heads/release/1.0'. Such
+	//lines route the keys to the bucket of the ref, see 'bits.route'
+	routeLinePrefix = []byte("ref ")
+)
+
+//parseRoute parses a configured route: a ref pattern and the bucket that
+//chunks of matching refs are stored in, e.g. 'release/* archive-bucket'
+func parseRoute(s string) (pattern, bucket string, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("expected a ref pattern and a bucket, e.g. 'release/* <bucket>'")
+	}
+
+	if _, err = path.Match(fields[0], ""); err != nil {
+		return "", "", fmt.Errorf("invalid ref pattern '%s': %v", fields[0], err)
+	}
+
+	return fields[0], fields[1], nil
+}
+
+//routeLine returns the ref that a line of keys names, if it does
+func routeLine(line []byte) (ref string, ok bool) {
+	if !bytes.HasPrefix(line, routeLinePrefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(string(line[len(routeLinePrefix):])), true
+}
+
+//shortRef returns the name of a branch or tag without its prefix
+func shortRef(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+
+	return ref
+}
+
+//routeBucket returns the bucket that the first route matching 'ref' names,
+//patterns are matched against the full and the short name of the ref
+func (repo *Repository) routeBucket(ref string) (bucket string, ok bool) {
+	for _, route := range repo.conf.Routes {
+		pattern, bucket, err := parseRoute(route)
+		if err != nil {
+			continue //checked when configured
+		}
+
+		for _, name := range []string{ref, shortRef(ref)} {
+			if ok, _ := path.Match(pattern, name); ok {
+				return bucket, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+//SetRouteRemote replaces the remote of a bucket that refs are routed to,
+//programs that embed git-bits and tests can use a MemoryRemote. It is
+//wrapped with the middleware that is in use.
+func (repo *Repository) SetRouteRemote(bucket string, remote Remote) {
+	repo.remoteMu.Lock()
+	defer repo.remoteMu.Unlock()
+	if repo.routes == nil {
+		repo.routes = map[string]Remote{}
+	}
+
+	repo.routes[bucket] = wrapRemote(remote, repo.middleware)
+}
+
+//routeRemote returns the remote of a bucket that refs are routed to, it is
+//accessed with the configured credentials
+func (repo *Repository) routeRemote(bucket string) (remote Remote, err error) {
+	repo.remoteMu.Lock()
+	defer repo.remoteMu.Unlock()
+	if remote, ok := repo.routes[bucket]; ok {
+		return remote, nil
+	}
+
+	s3, err := NewS3Remote(repo, repo.conf.remoteName(), bucket, repo.conf.AWSAccessKeyID, repo.conf.AWSSecretAccessKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup remote for bucket '%s': %v", bucket, err)
+	}
+
+	if repo.routes == nil {
+		repo.routes = map[string]Remote{}
+	}
+
+	repo.routes[bucket] = wrapRemote(s3, repo.middleware)
+	return repo.routes[bucket], nil
+}
+
+//RemoteForRef returns the remote that chunks of 'ref' are pushed to: the
+//bucket of the first route that matches it or else the configured remote
+func (repo *Repository) RemoteForRef(ref string) (remote Remote, err error) {
+	bucket, ok := repo.routeBucket(ref)
+	if !ok {
+		return repo.currentRemote(), nil
+	}
+
+	return repo.routeRemote(bucket)
+}
+
+//readRemote returns the remote that chunks of 'ref' are fetched from: the
+//remote it is routed to, chunks that it doesn't store are read from the
+//configured remote and the other routed buckets. Without a ref the
+//configured remote is read first.
+func (repo *Repository) readRemote(ref string) (remote Remote, err error) {
+	remote = repo.currentRemote()
+	if len(repo.conf.Routes) == 0 {
+		return remote, nil
+	}
+
+	if ref != "" {
+		remote, err = repo.RemoteForRef(ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fr := &fallbackRemote{Remote: remote}
+	candidates := []Remote{repo.currentRemote()}
+	for _, route := range repo.conf.Routes {
+		_, bucket, err := parseRoute(route)
+		if err != nil {
+			continue //checked when configured
+		}
+
+		other, err := repo.routeRemote(bucket)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates = append(candidates, other)
+	}
+
+	seen := map[Remote]bool{remote: true}
+	for _, other := range candidates {
+		if other != nil && !seen[other] {
+			seen[other] = true
+			fr.others = append(fr.others, other)
+		}
+	}
+
+	if remote == nil || len(fr.others) == 0 {
+		return remote, nil
+	}
+
+	return fr, nil
+}
+
+//fallbackRemote reads chunks that its remote doesn't store from the others,
+//everything else is left to its remote
+type fallbackRemote struct {
+	Remote
+	others []Remote
+}
+
+//Unwrap returns the remote that is read first
+func (fr *fallbackRemote) Unwrap() Remote {
+	return fr.Remote
+}
+
+//ChunkReader reads the chunk from the first remote that stores it, if one
+//stores it in cold storage that error is returned such that it is restored
+func (fr *fallbackRemote) ChunkReader(k K) (rc io.ReadCloser, err error) {
+	rc, err = fr.Remote.ChunkReader(k)
+	for _, other := range fr.others {
+		if err == nil {
+			break
+		}
+
+		var oerr error
+		rc, oerr = other.ChunkReader(k)
+		if _, cold := oerr.(*coldChunkError); oerr == nil || cold {
+			err = oerr
+		}
+	}
+
+	return rc, err
+}
+
+//pushRouted pushes chunk 'c' to the bucket that its ref is routed to. The
+//local index only describes the configured remote, the routed remote is
+//asked whether it stores the chunk instead. It returns whether the chunk is
+//neither stored locally nor in the bucket.
+func (repo *Repository) pushRouted(ctx context.Context, bucket string, c PointerChunk) (unreachable bool, err error) {
+	remote, err := repo.routeRemote(bucket)
+	if err != nil {
+		return false, withKind(ConfigError, err)
+	}
+
+	k := c.K
+	if haser, ok := unwrapRemote(remote).(chunkHaser); ok {
+		stored, err := haser.hasChunk(c.Version, k)
+		if err != nil {
+			return false, withKind(NetworkError, fmt.Errorf("failed to check whether bucket '%s' stores chunk '%x': %v", bucket, k, err))
+		}
+
+		if stored {
+			repo.progress(KeyOp{PushOp, k, true, 0})
+			return false, nil
+		}
+	}
+
+	p, err := repo.chunkPath(c.Version, k, false)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err = os.Stat(p); err != nil {
+		return true, nil
+	}
+
+	n, _, err := repo.pushChunkTo(ctx, remote, c.Version, k)
+	if err == ErrAlreadyPushed {
+		repo.progress(KeyOp{PushOp, k, true, 0})
+		return false, nil
+	}
+
+	if err != nil {
+		return false, withKind(NetworkError, fmt.Errorf("failed to push chunk '%x' to bucket '%s': %v", k, bucket, err))
+	}
+
+	repo.progress(KeyOp{PushOp, k, false, n})
+	return false, nil
+}
@@ -1,20 +1,44 @@
 package bits
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rlmcpherson/s3gof3r"
 )
 
+var (
+	//S3DeleteBatchSize is the most objects that are removed with a single
+	//multi-object delete request, s3 allows up to 1000
+	S3DeleteBatchSize = 1000
+)
+
 type S3Remote struct {
 	gitRemote string
 	bucket    *s3gof3r.Bucket
 	repo      *Repository
+	cdn       *CDN
+
+	//levels of directories chunk names are sharded in
+	depth int
+
+	//replicas of the bucket that chunks can be read from, the closest is
+	//selected on the first read
+	replicas   []*s3gof3r.Bucket
+	readerOnce sync.Once
+	reader     *s3gof3r.Bucket
 }
 
 func NewS3Remote(repo *Repository, remote, bucket, accessKey, secretKey string) (s3 *S3Remote, err error) {
@@ -23,20 +47,173 @@ func NewS3Remote(repo *Repository, remote, bucket, accessKey, secretKey string)
 		gitRemote: remote,
 	}
 
-	s3.bucket = s3gof3r.New("", s3gof3r.Keys{
+	keys := s3gof3r.Keys{
 		AccessKey: accessKey,
 		SecretKey: secretKey,
-	}).Bucket(bucket)
+	}
+
+	s3.bucket = s3gof3r.New("", keys).Bucket(bucket)
+	if repo.conf == nil {
+		return s3, nil
+	}
+
+	s3.depth = repo.conf.KeyShardDepth
+	err = s3.configureBucket(s3.bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, replica := range repo.conf.AWSS3Replicas {
+		domain, name, err := parseReplica(replica)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup replica '%s': %v", replica, err)
+		}
+
+		if domain == "" {
+			domain = s3.bucket.Domain
+		}
+
+		b := s3gof3r.New(domain, keys).Bucket(name)
+		err = s3.configureBucket(b)
+		if err != nil {
+			return nil, err
+		}
+
+		s3.replicas = append(s3.replicas, b)
+	}
+
+	//the cdn gets its own client as it doesn't expect s3 request signing
+	if repo.conf.CDNURL != "" {
+		client, err := repo.conf.HTTPClient()
+		if err != nil {
+			return nil, err
+		}
+
+		s3.cdn, err = NewCDN(repo.conf.CDNURL, repo.conf.CDNKeyPairID, repo.conf.CDNPrivateKey, client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup cdn: %v", err)
+		}
+	}
 
 	return s3, nil
 }
 
+//configureBucket sets up the http client that requests to bucket 'b' are
+//sent with
+func (s *S3Remote) configureBucket(b *s3gof3r.Bucket) (err error) {
+	client, err := s.repo.conf.HTTPClient()
+	if err != nil {
+		return err
+	}
+
+	//requester-pays buckets refuse requests that don't acknowledge the charges
+	if s.repo.conf.RequesterPays {
+		client.Transport = &requestPayer{bucket: b, next: client.Transport}
+	}
+
+	conf := *s3gof3r.DefaultConfig
+	conf.Client = client
+	b.Config = &conf
+	return nil
+}
+
+//requestPayer adds the header that acknowledges requester-pays charges to
+//each request. The header must be signed so requests are signed again.
+type requestPayer struct {
+	bucket *s3gof3r.Bucket
+	next   http.RoundTripper
+}
+
+func (rp *requestPayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = http.Header{}
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+
+	r.Header.Set("x-amz-request-payer", "requester")
+	rp.bucket.Sign(r)
+
+	next := rp.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return next.RoundTrip(r)
+}
+
 func (s3 *S3Remote) Name() string {
 	return s3.gitRemote
 }
 
-//ListChunks will write all chunks in the bucket to writer w
+//objectName returns the name the chunk with the given key is stored under
+func (s *S3Remote) objectName(k K) string {
+	return s.versionedName(KeyVersion0, k)
+}
+
+//versionedName returns the name the chunk of key 'k' of version 'v' is
+//stored under
+func (s *S3Remote) versionedName(v KeyVersion, k K) string {
+	return ChunkObjectName(v, k, s.depth)
+}
+
+//ListChunks will write all chunks in the bucket to writer w, chunks are
+//listed whatever depth their names are sharded at
 func (s *S3Remote) ListChunks(w io.Writer) (err error) {
+	return s.listObjects("", func(name string, modified time.Time) error {
+		v, k, _, ok := parseChunkObjectName(name)
+		if !ok {
+			return nil
+		}
+
+		_, err := fmt.Fprintf(w, "%s\n", FormatKey(v, k))
+		return err
+	})
+}
+
+//misplacedChunks calls 'fn' for each chunk that is stored under a name of
+//another depth than is configured
+func (s *S3Remote) misplacedChunks(fn func(v KeyVersion, k K, name string) error) (err error) {
+	return s.listObjects("", func(name string, modified time.Time) error {
+		v, k, depth, ok := parseChunkObjectName(name)
+		if !ok || depth == s.depth {
+			return nil
+		}
+
+		return fn(v, k, name)
+	})
+}
+
+//reshardChunk copies the chunk and its checksum to the names of the
+//configured depth, the old names are only removed once both are copied
+func (s *S3Remote) reshardChunk(v KeyVersion, k K, name string) (err error) {
+	to := s.versionedName(v, k)
+	for _, names := range [][2]string{{name, to}, {md5Name(name), md5Name(to)}} {
+		err = s.copyObject(s, names[0], names[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, old := range []string{name, md5Name(name)} {
+		err = s.bucket.Delete(old)
+		if err != nil {
+			return fmt.Errorf("failed to delete '%s': %v", old, err)
+		}
+	}
+
+	return nil
+}
+
+//md5Name returns where s3gof3r stores the checksum of an object
+func md5Name(name string) string {
+	return fmt.Sprintf(".md5/%s.md5", name)
+}
+
+//listObjects calls 'fn' with the name and modification time of each object
+//in the bucket of which the name starts with 'prefix'
+func (s *S3Remote) listObjects(prefix string, fn func(name string, modified time.Time) error) (err error) {
 
 	// <?xml version="1.0" encoding="UTF-8"?>
 	// <ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
@@ -60,7 +237,8 @@ func (s *S3Remote) ListChunks(w io.Writer) (err error) {
 		IsTruncated           bool     `xml:"IsTruncated"`
 		NextContinuationToken string   `xml:"NextContinuationToken"`
 		Contents              []struct {
-			Key string `xml:"Key"`
+			Key          string    `xml:"Key"`
+			LastModified time.Time `xml:"LastModified"`
 		} `xml:"Contents"`
 	}{}
 
@@ -69,6 +247,10 @@ func (s *S3Remote) ListChunks(w io.Writer) (err error) {
 		q := url.Values{}
 		q.Set("list-type", "2")
 		q.Set("max-keys", "500")
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+
 		if next != "" {
 			q.Set("continuation-token", next)
 		}
@@ -86,18 +268,21 @@ func (s *S3Remote) ListChunks(w io.Writer) (err error) {
 		}
 
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return s.respError(resp)
+		}
+
 		dec := xml.NewDecoder(resp.Body)
 		err = dec.Decode(&v)
 		if err != nil {
-			return fmt.Errorf("failed to decode s3 xml: %v")
+			return fmt.Errorf("failed to decode s3 xml: %v", err)
 		}
 
 		for _, obj := range v.Contents {
-			if len(obj.Key) != hex.EncodedLen(KeySize) {
-				continue
+			err = fn(obj.Key, obj.LastModified)
+			if err != nil {
+				return err
 			}
-
-			fmt.Fprintf(w, "%s\n", obj.Key)
 		}
 
 		v.Contents = nil
@@ -114,12 +299,548 @@ func (s *S3Remote) ListChunks(w io.Writer) (err error) {
 //ChunkReader returns a file handle that the chunk with the given
 //key can be read from, the user is expected to close it when finished
 func (s *S3Remote) ChunkReader(k K) (rc io.ReadCloser, err error) {
-	rc, _, err = s.bucket.GetReader(fmt.Sprintf("%x", k), nil)
+	return s.versionedChunkReader(KeyVersion0, k)
+}
+
+//versionedChunkReader is like ChunkReader for the chunk of key 'k' of
+//version 'v'
+func (s *S3Remote) versionedChunkReader(v KeyVersion, k K) (rc io.ReadCloser, err error) {
+	if s.cdn != nil {
+		rc, err = s.cdn.objectReader(s.versionedName(v, k))
+		if err == nil {
+			return rc, nil
+		}
+
+		fmt.Fprintf(s.repo.output, "failed to fetch chunk '%x' from cdn, falling back to the bucket: %v\n", k, err)
+	}
+
+	//a replica may not have received the chunk yet
+	if b := s.readBucket(); b != s.bucket {
+		rc, err = s.objectReader(b, v, k)
+		if err == nil {
+			return rc, nil
+		}
+
+		if rerr, ok := err.(*s3gof3r.RespError); !ok || rerr.StatusCode != http.StatusNotFound {
+			fmt.Fprintf(s.repo.output, "failed to fetch chunk '%x' from replica '%s', falling back to the bucket: %v\n", k, b.Name, err)
+		}
+	}
+
+	return s.objectReader(s.bucket, v, k)
+}
+
+//objectReader reads the object of chunk 'k' of version 'v' from bucket 'b'
+func (s *S3Remote) objectReader(b *s3gof3r.Bucket, v KeyVersion, k K) (rc io.ReadCloser, err error) {
+	rc, _, err = b.GetReader(s.versionedName(v, k), nil)
+	if rerr, ok := err.(*s3gof3r.RespError); ok && rerr.StatusCode == http.StatusNotFound && s.depth > 0 {
+		//the bucket may not have been resharded yet
+		rc, _, err = b.GetReader(ChunkObjectName(v, k, 0), nil)
+	}
+
+	//objects in glacier must be restored before they can be read
+	if rerr, ok := err.(*s3gof3r.RespError); ok && rerr.Code == "InvalidObjectState" {
+		return nil, &coldChunkError{id: chunkID{v, k}, err: err, thaw: func() (bool, error) { return s.thawChunk(v, k) }}
+	}
+
 	return rc, err
 }
 
+//chunkReaderFrom returns the content of the chunk with the given key
+//starting at offset 'off', using a single ranged request
+func (s *S3Remote) chunkReaderFrom(k K, off int64) (rc io.ReadCloser, err error) {
+	if b := s.readBucket(); b != s.bucket {
+		rc, err = s.objectReaderFrom(b, k, off)
+		if err == nil {
+			return rc, nil
+		}
+	}
+
+	return s.objectReaderFrom(s.bucket, k, off)
+}
+
+//objectReaderFrom reads the object of chunk 'k' from bucket 'b' starting at
+//offset 'off'
+func (s *S3Remote) objectReaderFrom(b *s3gof3r.Bucket, k K, off int64) (rc io.ReadCloser, err error) {
+	resp, err := s.requestTo(b, "GET", s.objectName(k), http.Header{"Range": {fmt.Sprintf("bytes=%d-", off)}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, s.respError(resp)
+	}
+
+	return resp.Body, nil
+}
+
 //ChunkWriter returns a file handle to which a chunk with give key
 //can be written to, the user is expected to close it when finished.
 func (s *S3Remote) ChunkWriter(k K) (wc io.WriteCloser, err error) {
-	return s.bucket.PutWriter(fmt.Sprintf("%x", k), nil, nil)
+	return s.versionedChunkWriter(KeyVersion0, k)
+}
+
+//versionedChunkWriter is like ChunkWriter for the chunk of key 'k' of
+//version 'v'
+func (s *S3Remote) versionedChunkWriter(v KeyVersion, k K) (wc io.WriteCloser, err error) {
+	return &s3ChunkWriter{remote: s, v: v, k: k, buf: bytes.NewBuffer(nil)}, nil
+}
+
+//s3ChunkWriter buffers a chunk and uploads it in a single request when
+//closed, with checksums such that s3 rejects content that got corrupted
+//in flight
+type s3ChunkWriter struct {
+	remote *S3Remote
+	v      KeyVersion
+	k      K
+	buf    *bytes.Buffer
+	etag   string
+}
+
+func (w *s3ChunkWriter) Write(p []byte) (n int, err error) {
+	return w.buf.Write(p)
+}
+
+//Close uploads the chunk and the md5 that s3gof3r checks when reading it
+func (w *s3ChunkWriter) Close() (err error) {
+	md5sum := md5.Sum(w.buf.Bytes())
+	shasum := sha256.Sum256(w.buf.Bytes())
+	resp, err := w.remote.request("PUT", w.remote.versionedName(w.v, w.k), http.Header{
+		"Content-Md5":           {base64.StdEncoding.EncodeToString(md5sum[:])},
+		"X-Amz-Content-Sha256":  {hex.EncodeToString(shasum[:])},
+		"X-Amz-Checksum-Sha256": {base64.StdEncoding.EncodeToString(shasum[:])},
+	}, w.buf.Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return w.remote.respError(resp)
+	}
+
+	w.etag = strings.Trim(resp.Header.Get("ETag"), `"`)
+
+	sum := []byte(hex.EncodeToString(md5sum[:]))
+	summd5 := md5.Sum(sum)
+	sumsha := sha256.Sum256(sum)
+	resp, err = w.remote.request("PUT", md5Name(w.remote.versionedName(w.v, w.k)), http.Header{
+		"Content-Md5":          {base64.StdEncoding.EncodeToString(summd5[:])},
+		"X-Amz-Content-Sha256": {hex.EncodeToString(sumsha[:])},
+	}, sum)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return w.remote.respError(resp)
+	}
+
+	return nil
+}
+
+//ETag returns the entity tag s3 assigned to the uploaded chunk
+func (w *s3ChunkWriter) ETag() string {
+	return w.etag
+}
+
+//DeleteChunks removes the chunks and their checksums from the bucket with
+//multi-object delete requests of up to S3DeleteBatchSize objects each,
+//chunks that aren't stored are ignored
+func (s *S3Remote) DeleteChunks(ks []K) (err error) {
+	return s.deleteVersionedChunks(KeyVersion0, ks)
+}
+
+//deleteVersionedChunks is like DeleteChunks for the chunks of keys 'ks' of
+//version 'v'
+func (s *S3Remote) deleteVersionedChunks(v KeyVersion, ks []K) (err error) {
+	names := []string{}
+	for _, k := range ks {
+		name := s.versionedName(v, k)
+		names = append(names, name, md5Name(name))
+	}
+
+	return s.deleteAll(names)
+}
+
+//deleteAll removes the objects with the given names in batches of up to
+//S3DeleteBatchSize objects
+func (s *S3Remote) deleteAll(names []string) (err error) {
+	for len(names) > 0 {
+		n := S3DeleteBatchSize
+		if n > len(names) {
+			n = len(names)
+		}
+
+		err = s.deleteObjects(names[:n])
+		if err != nil {
+			return err
+		}
+
+		names = names[n:]
+	}
+
+	return nil
+}
+
+//deleteObjects removes the objects with the given names in a single
+//DeleteObjects request
+//@see http://docs.aws.amazon.com/AmazonS3/latest/API/multiobjectdeleteapi.html
+func (s *S3Remote) deleteObjects(names []string) (err error) {
+	type object struct {
+		Key string `xml:"Key"`
+	}
+
+	req := struct {
+		XMLName xml.Name `xml:"Delete"`
+		Quiet   bool     `xml:"Quiet"`
+		Objects []object `xml:"Object"`
+	}{Quiet: true}
+
+	for _, name := range names {
+		req.Objects = append(req.Objects, object{Key: name})
+	}
+
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode delete request: %v", err)
+	}
+
+	//s3 requires the checksum of the body for multi-object deletes
+	sum := md5.Sum(body)
+	resp, err := s.request("POST", "?delete", http.Header{
+		"Content-Md5":  {base64.StdEncoding.EncodeToString(sum[:])},
+		"Content-Type": {"application/xml"},
+	}, body)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to delete %d objects: %v", len(names), s.respError(resp))
+	}
+
+	//in quiet mode only the objects that couldn't be deleted are listed
+	v := struct {
+		Errors []struct {
+			Key     string `xml:"Key"`
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}{}
+
+	err = xml.NewDecoder(resp.Body).Decode(&v)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to decode delete response: %v", err)
+	}
+
+	if len(v.Errors) > 0 {
+		e := v.Errors[0]
+		return fmt.Errorf("failed to delete %d of %d objects, e.g. '%s': %s (%s)", len(v.Errors), len(names), e.Key, e.Message, e.Code)
+	}
+
+	return nil
+}
+
+//trashName returns the name the chunk of key 'k' of version 'v' is stored
+//under when it is in the trash
+func (s *S3Remote) trashName(v KeyVersion, k K) string {
+	return "trash/" + s.versionedName(v, k)
+}
+
+//trashChunk copies the chunk and its checksum to the trash, the originals
+//are only removed once both are copied
+func (s *S3Remote) trashChunk(v KeyVersion, k K) (err error) {
+	return s.moveObjects(s.versionedName(v, k), s.trashName(v, k))
+}
+
+//restoreChunk copies the chunk and its checksum back from the trash
+func (s *S3Remote) restoreChunk(v KeyVersion, k K) (err error) {
+	return s.moveObjects(s.trashName(v, k), s.versionedName(v, k))
+}
+
+//moveObjects moves the object 'from' and its checksum to 'to'
+func (s *S3Remote) moveObjects(from, to string) (err error) {
+	for _, names := range [][2]string{{from, to}, {md5Name(from), md5Name(to)}} {
+		err = s.copyObject(s, names[0], names[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.deleteObjects([]string{from, md5Name(from)})
+}
+
+//trashedChunks calls 'fn' for each chunk in the trash, the time it was
+//moved there is the time its copy was written
+func (s *S3Remote) trashedChunks(fn func(v KeyVersion, k K, trashed time.Time) error) (err error) {
+	return s.listObjects("trash/", func(name string, modified time.Time) error {
+		v, k, _, ok := parseChunkObjectName(strings.TrimPrefix(name, "trash/"))
+		if !ok {
+			return nil
+		}
+
+		return fn(v, k, modified)
+	})
+}
+
+//purgeChunks deletes the chunks in the trash and their checksums
+func (s *S3Remote) purgeChunks(ids []chunkID) (err error) {
+	names := []string{}
+	for _, id := range ids {
+		name := s.trashName(id.v, id.k)
+		names = append(names, name, md5Name(name))
+	}
+
+	return s.deleteAll(names)
+}
+
+//hasChunk checks whether the bucket stores the chunk of key 'k' of version
+//'v'
+func (s *S3Remote) hasChunk(v KeyVersion, k K) (ok bool, err error) {
+	resp, err := s.request("HEAD", s.versionedName(v, k), nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected response from s3: %s", resp.Status)
+	}
+}
+
+//claimChunk writes a claim object next to the chunk only if there is none
+//yet, a claim that is older then ClaimTimeout is taken over
+func (s *S3Remote) claimChunk(v KeyVersion, k K) (claimed bool, err error) {
+	claim := ".claims/" + FormatKey(v, k)
+	resp, err := s.request("PUT", claim, http.Header{"If-None-Match": {"*"}}, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict: //a concurrent conditional write of the claim
+		return false, nil
+	case http.StatusPreconditionFailed:
+	default:
+		return false, s.respError(resp)
+	}
+
+	//someone claimed the chunk, check whether the claim was abandoned
+	head, err := s.request("HEAD", claim, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	head.Body.Close()
+	modified, err := http.ParseTime(head.Header.Get("Last-Modified"))
+	if head.StatusCode != http.StatusOK || err != nil || time.Since(modified) < ClaimTimeout {
+		return false, nil
+	}
+
+	taken, err := s.request("PUT", claim, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer taken.Body.Close()
+	if taken.StatusCode != http.StatusOK {
+		return false, s.respError(taken)
+	}
+
+	return true, nil
+}
+
+//releaseChunk removes the claim on the chunk
+func (s *S3Remote) releaseChunk(v KeyVersion, k K) (err error) {
+	resp, err := s.request("DELETE", ".claims/"+FormatKey(v, k), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s.respError(resp)
+	}
+
+	return nil
+}
+
+//writeAuditLog stores an audit log under 'name', existing logs are never
+//overwritten
+func (s *S3Remote) writeAuditLog(name string, data []byte) (err error) {
+	resp, err := s.request("PUT", name, http.Header{"If-None-Match": {"*"}, "Content-Type": {"application/x-ndjson"}}, data)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s.respError(resp)
+	}
+
+	return nil
+}
+
+//writeSharedObject creates the object 'name' of the shared index, like audit
+//logs existing objects are never overwritten
+func (s *S3Remote) writeSharedObject(name string, data []byte) (err error) {
+	resp, err := s.request("PUT", name, http.Header{"If-None-Match": {"*"}, "Content-Type": {"text/plain"}}, data)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s.respError(resp)
+	}
+
+	return nil
+}
+
+//readSharedObject returns the content of the object 'name' of the shared
+//index, 'ok' is false if it doesn't exist
+func (s *S3Remote) readSharedObject(name string) (data []byte, ok bool, err error) {
+	resp, err := s.request("GET", name, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, s.respError(resp)
+	}
+
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read '%s': %v", name, err)
+	}
+
+	return data, true, nil
+}
+
+//sharedObjects calls 'fn' for each object of the shared index of which the
+//name starts with 'prefix'
+func (s *S3Remote) sharedObjects(prefix string, fn func(name string) error) (err error) {
+	return s.listObjects(prefix, func(name string, modified time.Time) error {
+		return fn(name)
+	})
+}
+
+//deleteSharedObjects removes objects of the shared index
+func (s *S3Remote) deleteSharedObjects(names []string) (err error) {
+	for _, name := range names {
+		resp, err := s.request("DELETE", name, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to delete '%s': unexpected status %s", name, resp.Status)
+		}
+	}
+
+	return nil
+}
+
+//request sends a signed request for the object at 'key'
+func (s *S3Remote) request(method, key string, h http.Header, body []byte) (resp *http.Response, err error) {
+	return s.requestTo(s.bucket, method, key, h, body)
+}
+
+//requestTo sends a signed request for the object at 'key' in bucket 'b'
+func (s *S3Remote) requestTo(b *s3gof3r.Bucket, method, key string, h http.Header, body []byte) (resp *http.Response, err error) {
+	loc := fmt.Sprintf("%s://%s.%s/%s", b.Scheme, b.Name, b.Domain, key)
+	req, err := http.NewRequest(method, loc, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %v", method, err)
+	}
+
+	for k, v := range h {
+		req.Header[k] = v
+	}
+
+	b.Sign(req)
+	resp, err = b.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request '%s': %v", key, err)
+	}
+
+	return resp, nil
+}
+
+//respError turns an unexpected s3 response into an error that includes the
+//error code and message s3 responded with, if any
+func (s *S3Remote) respError(resp *http.Response) error {
+	v := struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+
+	err := xml.NewDecoder(resp.Body).Decode(&v)
+	if err != nil || v.Code == "" {
+		return fmt.Errorf("unexpected response from s3: %s", resp.Status)
+	}
+
+	return fmt.Errorf("unexpected response from s3: %s: %s (%s)", resp.Status, v.Message, v.Code)
+}
+
+//tierChunk moves the chunk to storage class 'class' by copying it onto
+//itself, which keeps its metadata
+func (s *S3Remote) tierChunk(v KeyVersion, k K, class string) (err error) {
+	name := s.versionedName(v, k)
+	resp, err := s.request("PUT", name, http.Header{
+		"X-Amz-Copy-Source":   {fmt.Sprintf("/%s/%s", s.bucket.Name, name)},
+		"X-Amz-Storage-Class": {class},
+	}, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to copy '%s' to %s: %v", name, class, s.respError(resp))
+	}
+
+	return nil
+}
+
+//thawChunk requests a copy of a chunk in glacier to be restored for
+//ThawDays, it returns whether the chunk can be read already
+//@see https://docs.aws.amazon.com/AmazonS3/latest/API/API_RestoreObject.html
+func (s *S3Remote) thawChunk(v KeyVersion, k K) (ready bool, err error) {
+	body := []byte(fmt.Sprintf("<RestoreRequest><Days>%d</Days><GlacierJobParameters><Tier>Standard</Tier></GlacierJobParameters></RestoreRequest>", ThawDays))
+	resp, err := s.request("POST", s.versionedName(v, k)+"?restore", http.Header{"Content-Type": {"application/xml"}}, body)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK: //restored before
+		return true, nil
+	case http.StatusAccepted, http.StatusConflict: //restore started or in progress
+		return false, nil
+	default:
+		return false, s.respError(resp)
+	}
 }
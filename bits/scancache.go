@@ -0,0 +1,226 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+//CommitBlobsBucket holds for each commit that was scanned the pointer blobs
+//it introduces, keyed by the id of the commit. Commits don't change, such
+//that scans skip the commits they find here.
+var CommitBlobsBucket = []byte("commit-blobs")
+
+//introducedBlob is a pointer blob that a commit introduces, with the path
+//it is introduced at
+type introducedBlob struct {
+	Blob string `json:"blob"`
+	Path string `json:"path"`
+}
+
+//commitBlobs returns the pointer blobs that each of the commits introduces.
+//Commits are looked up in the local store, which is opened if 'store' is
+//nil, and the others are analyzed and recorded there. As it is only a cache
+//failing to read or write it is reported but not returned.
+func (repo *Repository) commitBlobs(store *bolt.DB, commits []string) (introduced map[string][]introducedBlob, err error) {
+	introduced = map[string][]introducedBlob{}
+	read := func(store *bolt.DB) error {
+		return store.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(CommitBlobsBucket)
+			for _, commit := range commits {
+				v := b.Get([]byte(commit))
+				if v == nil {
+					continue
+				}
+
+				blobs := []introducedBlob{}
+				err := json.Unmarshal(v, &blobs)
+				if err != nil {
+					return fmt.Errorf("failed to decode blobs of commit '%s': %v", commit, err)
+				}
+
+				introduced[commit] = blobs
+			}
+
+			return nil
+		})
+	}
+
+	if store == nil {
+		err = repo.withStore(read)
+	} else {
+		err = read(store)
+	}
+
+	if err != nil {
+		fmt.Fprintf(repo.output, "failed to read scanned commits, scanning them again: %v\n", err)
+		introduced = map[string][]introducedBlob{}
+	}
+
+	todo := []string{}
+	for _, commit := range commits {
+		if _, ok := introduced[commit]; !ok {
+			todo = append(todo, commit)
+		}
+	}
+
+	if len(todo) == 0 {
+		return introduced, nil
+	}
+
+	analyzed, err := repo.analyzeCommits(todo)
+	if err != nil {
+		return nil, err
+	}
+
+	write := func(store *bolt.DB) error {
+		return store.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(CommitBlobsBucket)
+			for commit, blobs := range analyzed {
+				data, err := json.Marshal(blobs)
+				if err != nil {
+					return err
+				}
+
+				err = b.Put([]byte(commit), data)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	if store == nil {
+		err = repo.withStore(write)
+	} else {
+		err = write(store)
+	}
+
+	if err != nil {
+		fmt.Fprintf(repo.output, "failed to record scanned commits: %v\n", err)
+	}
+
+	for commit, blobs := range analyzed {
+		introduced[commit] = blobs
+	}
+
+	return introduced, nil
+}
+
+//analyzeCommits determines the pointer blobs that each of the commits
+//introduces: the files it adds or changes compared to its parent, or for a
+//merge the files that differ from every parent, that start with the
+//pointer header. Each commit is in the result, also if it introduces none.
+func (repo *Repository) analyzeCommits(commits []string) (introduced map[string][]introducedBlob, err error) {
+
+	// diff-tree --stdin -r --root -c | f1 | cat-file --batch | fn
+	ctx := context.Background()
+	in := bytes.NewBuffer(nil)
+	introduced = map[string][]introducedBlob{}
+	for _, commit := range commits {
+		fmt.Fprintf(in, "%s\n", commit)
+		introduced[commit] = []introducedBlob{}
+	}
+
+	candidates := map[string][]introducedBlob{}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(repo.Git(ctx, in, w, "diff-tree", "--stdin", "-r", "--root", "-c"))
+	}()
+
+	//each commit is followed by a line for each file it changes, see
+	//'raw output format' in git-diff-tree(1)
+	commit := ""
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, ":") {
+			commit = strings.TrimSpace(line)
+			continue
+		}
+
+		blob, path, ok := parseRawDiff(line)
+		if ok {
+			candidates[commit] = append(candidates[commit], introducedBlob{Blob: blob, Path: path})
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		r.CloseWithError(err)
+		return nil, fmt.Errorf("failed to list the files of commits: %v", err)
+	}
+
+	//the content of each candidate is read once to see if it's a pointer
+	list := bytes.NewBuffer(nil)
+	seen := map[string]bool{}
+	for _, commit := range commits {
+		for _, c := range candidates[commit] {
+			if !seen[c.Blob] {
+				seen[c.Blob] = true
+				fmt.Fprintf(list, "%s %s\n", c.Blob, c.Path)
+			}
+		}
+	}
+
+	pointers := map[string]bool{}
+	err = repo.catBlobs(func(w io.Writer) error {
+		_, err := io.Copy(w, list)
+		return err
+	}, func(blob, path string, content io.Reader) error {
+		pointers[blob] = true
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for commit, cs := range candidates {
+		for _, c := range cs {
+			if pointers[c.Blob] {
+				introduced[commit] = append(introduced[commit], c)
+			}
+		}
+	}
+
+	return introduced, nil
+}
+
+//parseRawDiff returns the blob and path of a line of the raw diff format,
+//if it is a regular file that is in the commit: '<modes> <blobs> <status>
+//TAB <path>' with a mode and blob for each parent and one for the commit
+func parseRawDiff(line string) (blob, path string, ok bool) {
+	parents := len(line) - len(strings.TrimLeft(line, ":"))
+	tab := strings.Index(line, "\t")
+	if tab < 0 {
+		return "", "", false
+	}
+
+	fields := strings.Fields(line[parents:tab])
+	if len(fields) != 2*(parents+1)+1 {
+		return "", "", false
+	}
+
+	mode, blob := fields[parents], fields[2*parents+1]
+	if mode != "100644" && mode != "100755" {
+		return "", "", false //deleted, symlinks and submodules
+	}
+
+	path = line[tab+1:]
+	if strings.HasPrefix(path, `"`) {
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			path = unquoted
+		}
+	}
+
+	return blob, path, true
+}
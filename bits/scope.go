@@ -0,0 +1,115 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/restic/chunker"
+)
+
+var (
+	//SharedConfFile is the file at the root of the repository that holds the
+	//configuration every clone must agree on, it is meant to be committed
+	SharedConfFile = ".bitsconfig"
+
+	//sharedConfKeys are the only keys read from the shared configuration,
+	//others could be used by a malicious repository to redirect chunks. The
+	//public url is only read from and fetched chunks are verified. Routes
+	//only name buckets that are accessed with the configured credentials.
+	sharedConfKeys = map[string]bool{
+		"bits.deduplication-scope": true,
+		"bits.key-hash":            true,
+		"bits.key-shard-depth":     true,
+		"bits.public-url":          true,
+		"bits.pointer-header":      true,
+		"bits.pointer-footer":      true,
+		"bits.strict-sentinels":    true,
+		"bits.pointer-format":      true,
+		"bits.route":               true,
+	}
+)
+
+//GenerateDeduplicationScope returns a random irreducible polynomial that
+//can be used as the deduplication scope, such that unrelated repositories
+//don't split files the same way
+func GenerateDeduplicationScope() (scope uint64, err error) {
+	pol, err := chunker.RandomPolynomial()
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random polynomial: %v", err)
+	}
+
+	return uint64(pol), nil
+}
+
+//ParseDeduplicationScope parses a (base10 or 0x prefixed hex) deduplication
+//scope and checks that it can be used as the chunking polynomial
+func ParseDeduplicationScope(s string) (scope uint64, err error) {
+	scope, err = strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected format for deduplication scope '%s', expected a base10 or hex number", s)
+	}
+
+	pol := chunker.Pol(scope)
+	if pol.Deg() != 53 || !pol.Irreducible() {
+		return 0, fmt.Errorf("deduplication scope '%s' is not an irreducible polynomial of degree 53", s)
+	}
+
+	return scope, nil
+}
+
+//shareConf records the deduplication scope and key hash in the shared
+//configuration file. Values that are recorded already take precedence, a
+//deduplication scope of zero is replaced by a random one.
+func (repo *Repository) shareConf(w io.Writer, conf *Conf) (err error) {
+	p := filepath.Join(repo.rootDir, SharedConfFile)
+	shared := func(key string) (val string, ok bool) {
+		buf := bytes.NewBuffer(nil)
+		err := repo.Git(nil, nil, buf, "config", "--file", p, "--get", key)
+		return strings.TrimSpace(buf.String()), err == nil
+	}
+
+	if val, ok := shared("bits.deduplication-scope"); ok {
+		scope, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected format for deduplication scope '%s' in '%s', expected a base10 number", val, SharedConfFile)
+		}
+
+		if conf.DeduplicationScope != 0 && conf.DeduplicationScope != scope {
+			return fmt.Errorf("deduplication scope '%d' conflicts with scope '%d' that is recorded in '%s'", conf.DeduplicationScope, scope, SharedConfFile)
+		}
+
+		conf.DeduplicationScope = scope
+	} else {
+		if conf.DeduplicationScope == 0 {
+			conf.DeduplicationScope, err = GenerateDeduplicationScope()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = repo.Git(nil, nil, nil, "config", "--file", p, "bits.deduplication-scope", strconv.FormatUint(conf.DeduplicationScope, 10))
+		if err != nil {
+			return fmt.Errorf("failed to record deduplication scope in '%s': %v", p, err)
+		}
+
+		fmt.Fprintf(w, "recorded the deduplication scope in '%s', commit it such that all clones split files the same way\n", SharedConfFile)
+	}
+
+	if val, ok := shared("bits.key-hash"); ok {
+		conf.KeyHash, err = ParseKeyHash(val)
+		if err != nil {
+			return fmt.Errorf("unexpected key hash in '%s': %v", SharedConfFile, err)
+		}
+	} else {
+		err = repo.Git(nil, nil, nil, "config", "--file", p, "bits.key-hash", conf.KeyHash.String())
+		if err != nil {
+			return fmt.Errorf("failed to record key hash in '%s': %v", p, err)
+		}
+	}
+
+	return nil
+}
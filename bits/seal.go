@@ -0,0 +1,126 @@
+package bits
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+//PointerKeySize is the size of the key that the key lists of sealed
+//pointers are encrypted with
+const PointerKeySize = 32
+
+//sealedLineWidth is the number of encoded characters on each sealed line,
+//such that no line of a pointer gets longer than its header
+var sealedLineWidth = 56
+
+//NewPointerKey returns a random hex encoded key for 'bits.pointer-key'
+func NewPointerKey() (key string, err error) {
+	data := make([]byte, PointerKeySize)
+	_, err = rand.Read(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate pointer key: %v", err)
+	}
+
+	return hex.EncodeToString(data), nil
+}
+
+//ParsePointerKey decodes a hex encoded pointer key
+func ParsePointerKey(s string) (key []byte, err error) {
+	key, err = hex.DecodeString(s)
+	if err != nil || len(key) != PointerKeySize {
+		return nil, fmt.Errorf("expected %d hex encoded bytes", PointerKeySize)
+	}
+
+	return key, nil
+}
+
+//keyListAEAD returns the cipher key lists are sealed with, nil if no pointer
+//key is configured. The nonces of key lists are derived with 'nonceKey'.
+func (repo *Repository) keyListAEAD() (aead cipher.AEAD, nonceKey []byte, err error) {
+	if repo.conf.PointerKey == "" {
+		return nil, nil, nil
+	}
+
+	key, err := ParsePointerKey(repo.conf.PointerKey)
+	if err != nil {
+		return nil, nil, withKind(ConfigError, fmt.Errorf("unexpected configured pointer key: %v", err))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	nk := sha256.Sum256(append([]byte("git-bits key list nonce "), key...))
+	return aead, nk[:], nil
+}
+
+//sealKeyList encrypts the key list 'plain' and returns it as the base64
+//encoded lines of a sealed pointer. The nonce is derived from the key list
+//such that splitting a file twice results in the same pointer and git
+//doesn't consider it modified.
+func sealKeyList(aead cipher.AEAD, nonceKey, plain []byte) (lines []byte) {
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(plain)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	enc := base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, nil))
+	for len(enc) > 0 {
+		n := sealedLineWidth
+		if n > len(enc) {
+			n = len(enc)
+		}
+
+		lines = append(lines, fmt.Sprintf("%s %s\n", pointerMetaSealed, enc[:n])...)
+		enc = enc[n:]
+	}
+
+	return lines
+}
+
+//openKeyList decrypts the concatenated base64 payload of the sealed lines
+//of a pointer into its key list
+func (repo *Repository) openKeyList(enc []byte) (plain []byte, err error) {
+	aead, _, err := repo.keyListAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	if aead == nil {
+		return nil, withKind(ConfigError, fmt.Errorf("the key list of the pointer is encrypted, configure 'bits.pointer-key' to read it"))
+	}
+
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(enc)))
+	n, err := base64.StdEncoding.Decode(data, enc)
+	if err != nil || n < aead.NonceSize() {
+		return nil, fmt.Errorf("failed to decode encrypted key list: %v", err)
+	}
+
+	plain, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():n], nil)
+	if err != nil {
+		return nil, withKind(ConfigError, fmt.Errorf("failed to decrypt key list, is 'bits.pointer-key' the key it was encrypted with?"))
+	}
+
+	return plain, nil
+}
+
+//sealedLine returns the encoded payload of a line of a sealed key list
+func sealedLine(line []byte) (enc []byte, ok bool) {
+	n := len(pointerMetaSealed)
+	if len(line) <= n || line[n] != ' ' || !bytes.HasPrefix(line, pointerMetaSealed) {
+		return nil, false
+	}
+
+	return line[n+1:], true
+}
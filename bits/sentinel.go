@@ -0,0 +1,129 @@
+package bits
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+var (
+	//DefaultPointerHeader is the line that pointers start with unless
+	//'bits.pointer-header' is configured
+	DefaultPointerHeader = "--- to use this file decode it with the 'git-bits' extension ---"
+
+	//DefaultPointerFooter is the line that pointers end with unless
+	//'bits.pointer-footer' is configured
+	DefaultPointerFooter = "----------------------- end of chunks --------------------------"
+)
+
+//CheckSentinel returns an error if 's' can't be used as the header or the
+//footer of pointers: it must be exactly as long as a hex encoded key, such
+//that pointers can be recognized by their first bytes, and consist of
+//printable ascii without surrounding whitespace. It must not be mistaken
+//for a key, metadata or a sealed key list.
+func CheckSentinel(s string) error {
+	if len(s) != hex.EncodedLen(KeySize) {
+		return fmt.Errorf("sentinel '%s' is %d characters long, it must be exactly %d", s, len(s), hex.EncodedLen(KeySize))
+	}
+
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("sentinel '%s' holds '%c', only printable ascii is allowed", s, c)
+		}
+	}
+
+	if strings.TrimSpace(s) != s {
+		return fmt.Errorf("sentinel '%s' starts or ends with whitespace", s)
+	}
+
+	line := []byte(s)
+	_, kerr := ParseKeyLine(line)
+	_, _, meta, merr := parseMetaLine(line)
+	_, sealed := sealedLine(line)
+	if kerr == nil || meta || merr != nil || sealed {
+		return fmt.Errorf("sentinel '%s' would be mistaken for a line of the key list", s)
+	}
+
+	return nil
+}
+
+//setupSentinels determines the header and footer that pointers are written
+//with and those that are recognized when reading. Unless strict sentinels
+//are configured the default ones are recognized as well, such that
+//pointers that were written before custom ones were configured still read.
+func (repo *Repository) setupSentinels() (err error) {
+	header, footer := DefaultPointerHeader, DefaultPointerFooter
+	if repo.conf.PointerHeader != "" {
+		header = repo.conf.PointerHeader
+	}
+
+	if repo.conf.PointerFooter != "" {
+		footer = repo.conf.PointerFooter
+	}
+
+	for _, s := range []string{header, footer} {
+		err = CheckSentinel(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if header == footer {
+		return fmt.Errorf("pointer header and footer are both '%s', they must differ", header)
+	}
+
+	repo.header = []byte(header + "\n")
+	repo.footer = []byte(footer + "\n")
+	repo.headers = [][]byte{repo.header}
+	repo.footers = [][]byte{repo.footer}
+	if !repo.conf.StrictSentinels && header != DefaultPointerHeader {
+		repo.headers = append(repo.headers, []byte(DefaultPointerHeader+"\n"))
+	}
+
+	if !repo.conf.StrictSentinels && footer != DefaultPointerFooter {
+		repo.footers = append(repo.footers, []byte(DefaultPointerFooter+"\n"))
+	}
+
+	return nil
+}
+
+//hasHeader returns whether 'b' starts with a header that is recognized, or
+//like a json pointer
+func (repo *Repository) hasHeader(b []byte) bool {
+	if isJSONPointer(b) {
+		return true
+	}
+
+	for _, h := range repo.headers {
+		if bytes.HasPrefix(b, h) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//isHeaderLine returns whether 'line', without its newline, is a header that
+//is recognized
+func (repo *Repository) isHeaderLine(line []byte) bool {
+	for _, h := range repo.headers {
+		if bytes.Equal(line, h[:len(h)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//isFooterLine returns whether 'line', without its newline, is a footer that
+//is recognized
+func (repo *Repository) isFooterLine(line []byte) bool {
+	for _, f := range repo.footers {
+		if bytes.Equal(line, f[:len(f)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
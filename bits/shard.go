@@ -0,0 +1,138 @@
+package bits
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	//MaxKeyShardDepth limits the levels of directories chunk names are
+	//sharded in, each level is named after one byte of the key
+	MaxKeyShardDepth = 4
+)
+
+//chunkResharder is implemented by remotes that store chunks under names
+//that depend on the configured shard depth
+type chunkResharder interface {
+
+	//misplacedChunks calls 'fn' for each chunk that is not stored under
+	//the name of the configured depth
+	misplacedChunks(fn func(v KeyVersion, k K, name string) error) error
+
+	//reshardChunk moves the chunk stored under 'name' such that it is
+	//stored under the name of the configured depth
+	reshardChunk(v KeyVersion, k K, name string) error
+}
+
+//ChunkObjectName returns the name a chunk is stored under in a bucket. It
+//is prefixed with 'depth' levels of directories that are named after the
+//first bytes of the key, e.g. 'ab/cd/abcd...' for a depth of 2. With a
+//depth of 0 the name is the key itself. Chunks of keys of other versions
+//than 0 are stored under a directory of their version, e.g. 'v1/abcd...'.
+func ChunkObjectName(v KeyVersion, k K, depth int) string {
+	name := ""
+	if ns := v.namespace(); ns != "" {
+		name = ns + "/"
+	}
+
+	for i := 0; i < depth && i < len(k); i++ {
+		name += fmt.Sprintf("%02x/", k[i])
+	}
+
+	return name + fmt.Sprintf("%x", k)
+}
+
+//parseChunkObjectName returns the key and key version of the chunk that is
+//stored under 'name' and the depth it is sharded at. It is not ok if the
+//name is not of a chunk, e.g. of checksums or claims that are stored next
+//to them, or of a chunk of a version that isn't supported.
+func parseChunkObjectName(name string) (v KeyVersion, k K, depth int, ok bool) {
+	parts := strings.Split(name, "/")
+	data, err := hex.DecodeString(parts[len(parts)-1])
+	if err != nil || len(data) != KeySize {
+		return v, k, 0, false
+	}
+
+	copy(k[:], data)
+	depth = len(parts) - 1
+	if n, err := fmt.Sscanf(parts[0], "v%d", &v); n == 1 && err == nil && len(parts) > 1 {
+		depth--
+	}
+
+	if checkKeyVersion(v) != nil || depth > MaxKeyShardDepth || name != ChunkObjectName(v, k, depth) {
+		return v, k, 0, false
+	}
+
+	return v, k, depth, true
+}
+
+//ReshardChunks moves the chunks in 'remote' that are stored under names of
+//another depth (e.g. flat names from before 'bits.key-shard-depth' was
+//configured) to names of the configured depth. It moves up to
+//'concurrency' chunks in parallel, if its zero FetchConcurrency is used.
+//If 'remote' is nil the configured remote is resharded.
+func (repo *Repository) ReshardChunks(remote Remote, concurrency int) (moved int, err error) {
+	if repo.conf.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	if remote == nil {
+		remote = repo.currentRemote()
+	}
+
+	resharder, ok := unwrapRemote(remote).(chunkResharder)
+	if !ok {
+		return 0, fmt.Errorf("the remote doesn't store chunks under sharded names")
+	}
+
+	if concurrency < 1 {
+		concurrency = FetchConcurrency
+	}
+
+	//move chunks in parallel while collecting errors
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := []string{}
+	type misplaced struct {
+		v    KeyVersion
+		k    K
+		name string
+	}
+
+	chunkCh := make(chan misplaced)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunkCh {
+				err := resharder.reshardChunk(c.v, c.k, c.name)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("failed to move chunk '%s' from '%s': %v", FormatKey(c.v, c.k), c.name, err))
+				} else {
+					moved++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = resharder.misplacedChunks(func(v KeyVersion, k K, name string) error {
+		chunkCh <- misplaced{v, k, name}
+		return nil
+	})
+
+	close(chunkCh)
+	wg.Wait()
+	if err != nil {
+		return moved, fmt.Errorf("failed to list chunks to move: %v", err)
+	}
+
+	if len(errs) > 0 {
+		return moved, fmt.Errorf("failed to move %d of %d chunks: \n %s", len(errs), len(errs)+moved, summarizeErrors(errs))
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,279 @@
+package bits
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	//SharedIndexPrefix is where repositories that share a bucket record the
+	//deduplication scope they split files with and the chunks each of them
+	//references, such that pruning one never removes chunks of another
+	SharedIndexPrefix = ".shared/"
+
+	//sharedScopeName is the object that holds the deduplication scope and key
+	//hash that all repositories which share the bucket use
+	sharedScopeName = SharedIndexPrefix + "scope"
+
+	//sharedRefsPrefix is where the chunks each repository references are
+	//listed, as '<prefix><repository>/<id>'. Pushes add objects, pruning
+	//replaces those of the repository with one that lists all its chunks.
+	sharedRefsPrefix = SharedIndexPrefix + "refs/"
+)
+
+//sharedIndexer is implemented by remotes that can store the shared index
+//next to the chunks. Objects are created once and never modified.
+type sharedIndexer interface {
+
+	//writeSharedObject creates the object 'name', it fails if it exists
+	writeSharedObject(name string, data []byte) error
+
+	//readSharedObject returns the content of object 'name', 'ok' is false if
+	//it doesn't exist
+	readSharedObject(name string) (data []byte, ok bool, err error)
+
+	//sharedObjects calls 'fn' for the name of each object that starts with
+	//'prefix'
+	sharedObjects(prefix string, fn func(name string) error) error
+
+	//deleteSharedObjects removes the objects, removing an object that
+	//doesn't exist is a no-op
+	deleteSharedObjects(names []string) error
+}
+
+//ParseSharedRepository checks the name that a repository is known by in a
+//shared bucket, e.g. 'design/game-assets'
+func ParseSharedRepository(name string) (repository string, err error) {
+	if name == "" || strings.ContainsAny(name, " \t\n\\") || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return "", fmt.Errorf("unexpected shared repository name '%s', expected e.g. 'design/game-assets'", name)
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("unexpected shared repository name '%s', expected e.g. 'design/game-assets'", name)
+		}
+	}
+
+	return name, nil
+}
+
+//sharing returns whether the bucket is shared with other repositories
+func (repo *Repository) sharing() bool {
+	return repo.conf.SharedRepository != ""
+}
+
+//sharedIndex returns the shared index of 'remote'
+func sharedIndex(remote Remote) (idx sharedIndexer, err error) {
+	if remote == nil {
+		return nil, withKind(ConfigError, fmt.Errorf("a repository that shares a bucket requires a remote"))
+	}
+
+	idx, ok := unwrapRemote(remote).(sharedIndexer)
+	if !ok {
+		return nil, withKind(ConfigError, fmt.Errorf("the remote doesn't support sharing the bucket with other repositories"))
+	}
+
+	return idx, nil
+}
+
+//adoptSharedScope prepares 'conf' for joining the repositories that share
+//the bucket: if they recorded a deduplication scope and key hash in it and
+//none was asked for, those are used. It returns the shared index that the
+//scope is recorded in with recordSharedScope.
+func (repo *Repository) adoptSharedScope(conf *Conf) (idx sharedIndexer, err error) {
+	remote := repo.currentRemote()
+	if remote == nil && conf.AWSS3BucketName != "" {
+		remote, err = NewS3Remote(repo, conf.remoteName(), conf.AWSS3BucketName, conf.AWSAccessKeyID, conf.AWSSecretAccessKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup the shared bucket: %v", err)
+		}
+	}
+
+	idx, err = sharedIndex(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, ok, err := readSharedScope(idx)
+	if err != nil || !ok {
+		return idx, err
+	}
+
+	if conf.DeduplicationScope == 0 {
+		conf.DeduplicationScope = shared.DeduplicationScope
+		conf.KeyHash = shared.KeyHash
+	}
+
+	return idx, nil
+}
+
+//recordSharedScope records the deduplication scope and key hash of 'conf'
+//in the shared bucket if no repository did before, else it checks that
+//they are the same as those of the other repositories
+func (repo *Repository) recordSharedScope(w io.Writer, idx sharedIndexer, conf *Conf) (err error) {
+	shared, ok, err := readSharedScope(idx)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if shared.DeduplicationScope != conf.DeduplicationScope || shared.KeyHash != conf.KeyHash {
+			return withKind(ConfigError, fmt.Errorf("deduplication scope '%d' and key hash '%s' conflict with scope '%d' and key hash '%s' of the repositories that share the bucket, the repository can't deduplicate with them", conf.DeduplicationScope, conf.KeyHash, shared.DeduplicationScope, shared.KeyHash))
+		}
+
+		return nil
+	}
+
+	data := fmt.Sprintf("bits.deduplication-scope %d\nbits.key-hash %s\n", conf.DeduplicationScope, conf.KeyHash)
+	err = idx.writeSharedObject(sharedScopeName, []byte(data))
+	if err != nil {
+		return withKind(NetworkError, fmt.Errorf("failed to record the deduplication scope in the shared bucket: %v", err))
+	}
+
+	fmt.Fprintf(w, "recorded the deduplication scope in the shared bucket, repositories that share it split files the same way\n")
+	return nil
+}
+
+//readSharedScope reads the deduplication scope and key hash that are
+//recorded in the shared bucket, 'ok' is false if none is
+func readSharedScope(idx sharedIndexer) (shared *Conf, ok bool, err error) {
+	data, ok, err := idx.readSharedObject(sharedScopeName)
+	if err != nil {
+		return nil, false, withKind(NetworkError, fmt.Errorf("failed to read the deduplication scope of the shared bucket: %v", err))
+	}
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	shared = &Conf{}
+	err = shared.overwrite(bytes.NewReader(data), map[string]bool{
+		"bits.deduplication-scope": true,
+		"bits.key-hash":            true,
+	})
+
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid deduplication scope in the shared bucket: %v", err)
+	}
+
+	return shared, true, nil
+}
+
+//shareKeys adds the chunks 'ids' to those that the repository references
+//in the shared index, as a new object such that concurrent pushes don't
+//overwrite each other
+func (repo *Repository) shareKeys(ids []chunkID) (err error) {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	idx, err := sharedIndex(repo.currentRemote())
+	if err != nil {
+		return err
+	}
+
+	err = idx.writeSharedObject(sharedRefsName(repo.conf.SharedRepository), formatKeys(ids))
+	if err != nil {
+		return withKind(NetworkError, fmt.Errorf("failed to record the pushed chunks in the shared index: %v", err))
+	}
+
+	return nil
+}
+
+//sharedReferences compacts the objects that list the chunks of this
+//repository into one that lists 'referenced', unless 'dryRun', and adds
+//the chunks that other repositories reference to it. It returns how many
+//chunks only other repositories reference.
+func (repo *Repository) sharedReferences(referenced map[chunkID]bool, dryRun bool) (others int, err error) {
+	idx, err := sharedIndex(repo.currentRemote())
+	if err != nil {
+		return 0, err
+	}
+
+	own := []string{}
+	names := []string{}
+	err = idx.sharedObjects(sharedRefsPrefix, func(name string) error {
+		i := strings.LastIndex(name, "/")
+		if i < len(sharedRefsPrefix) {
+			return nil //not written by us
+		}
+
+		if name[len(sharedRefsPrefix):i] == repo.conf.SharedRepository {
+			own = append(own, name)
+			return nil
+		}
+
+		names = append(names, name)
+		return nil
+	})
+
+	if err != nil {
+		return 0, withKind(NetworkError, fmt.Errorf("failed to list the shared index: %v", err))
+	}
+
+	if !dryRun {
+		ids := make([]chunkID, 0, len(referenced))
+		for id := range referenced {
+			ids = append(ids, id)
+		}
+
+		sortChunkIDs(ids)
+		err = idx.writeSharedObject(sharedRefsName(repo.conf.SharedRepository), formatKeys(ids))
+		if err != nil {
+			return 0, withKind(NetworkError, fmt.Errorf("failed to record the referenced chunks in the shared index: %v", err))
+		}
+
+		err = idx.deleteSharedObjects(own)
+		if err != nil {
+			return 0, withKind(NetworkError, fmt.Errorf("failed to remove compacted objects from the shared index: %v", err))
+		}
+	}
+
+	for _, name := range names {
+		data, ok, err := idx.readSharedObject(name)
+		if err != nil {
+			return others, withKind(NetworkError, fmt.Errorf("failed to read '%s' of the shared index: %v", name, err))
+		}
+
+		if !ok {
+			return others, withKind(NetworkError, fmt.Errorf("'%s' was removed from the shared index while it was read, another repository pruned at the same time: retry", name))
+		}
+
+		err = repo.forEachChunk(bytes.NewReader(data), func(c PointerChunk) error {
+			if id := c.id(); !referenced[id] {
+				referenced[id] = true
+				others++
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return others, fmt.Errorf("invalid object '%s' in the shared index: %v", name, err)
+		}
+	}
+
+	return others, nil
+}
+
+//sharedRefsName returns a new, unique, name for an object that lists chunks
+//of 'repository'
+func sharedRefsName(repository string) string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return fmt.Sprintf("%s%s/%d-%x", sharedRefsPrefix, repository, time.Now().UnixNano(), id)
+}
+
+//formatKeys writes keys one per line
+func formatKeys(ids []chunkID) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(ids)*(KeySize*2+1)))
+	for _, id := range ids {
+		fmt.Fprintf(buf, "%s\n", id)
+	}
+
+	return buf.Bytes()
+}
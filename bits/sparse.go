@@ -0,0 +1,112 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+//sparseFilter returns a function that tells whether the file at path 'p' is
+//inside the sparse checkout of the working tree, every file is if the
+//working tree isn't sparse. In cone mode the directories of 'git
+//sparse-checkout list' hold the files that are inside, with the files at
+//the root and those next to the parents of the directories. Otherwise the
+//patterns are git's to match, files that git skips in the working tree are
+//outside.
+func (repo *Repository) sparseFilter() (inside func(p string) bool, err error) {
+	all := func(p string) bool { return true }
+	if !repo.gitBool("core.sparseCheckout") {
+		return all, nil
+	}
+
+	if !repo.gitBool("core.sparseCheckoutCone") {
+		skipped, err := repo.skippedFiles()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(p string) bool { return !skipped[p] }, nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "sparse-checkout", "list")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the sparse checkout: %v", err)
+	}
+
+	dirs := strings.Fields(buf.String())
+	return func(p string) bool {
+		parent := path.Dir(p)
+		if parent == "." {
+			return true
+		}
+
+		for _, dir := range dirs {
+			if strings.HasPrefix(p, dir+"/") || dir == parent || strings.HasPrefix(dir, parent+"/") {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+//skippedFiles returns the files in the index that git doesn't check out
+//because they are outside the sparse checkout
+func (repo *Repository) skippedFiles() (skipped map[string]bool, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "ls-files", "-t", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files that are skipped: %v", err)
+	}
+
+	//@see https://git-scm.com/docs/git-ls-files
+	//entry: <tag> SP <file> NUL, files that are skipped are tagged 'S'
+	skipped = map[string]bool{}
+	for _, entry := range strings.Split(buf.String(), "\x00") {
+		if strings.HasPrefix(entry, "S ") {
+			skipped[entry[2:]] = true
+		}
+	}
+
+	return skipped, nil
+}
+
+//gitBool returns whether the git configuration 'key' is true, it isn't when
+//it is not set
+func (repo *Repository) gitBool(key string) bool {
+	buf := bytes.NewBuffer(nil)
+	err := repo.Git(context.Background(), nil, buf, "config", "--bool", "--get", key)
+	return err == nil && strings.TrimSpace(buf.String()) == "true"
+}
+
+//fetchOutsideSparse fetches the chunks of the selected files that are
+//outside the sparse checkout, such that widening it doesn't need the remote.
+//Progress is reported after each file as if it was pulled.
+func (repo *Repository) fetchOutsideSparse(ctx context.Context, sel PullSelection, inside func(p string) bool, plan map[string]int64, progress *PullProgress) (err error) {
+	paths, ptrs, err := repo.selectedFiles(sel)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if inside(p) {
+			continue
+		}
+
+		err = repo.fetchChunks(ctx, ptrs[p].Chunks...)
+		if err != nil {
+			return fmt.Errorf("failed to fetch chunks of '%s': %v", p, err)
+		}
+
+		progress.Path = p
+		progress.File++
+		progress.FileBytes = plan[p]
+		progress.Bytes += plan[p]
+		repo.PullProgressFn(*progress)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package bits
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//StagedLogFile is the file in the chunk directory that splitting appends
+	//the chunks of each pointer to, as '<blob> <key>...' lines. The clean
+	//filter doesn't open the local store, as another process may hold it for
+	//long, the log is folded into the store when it is opened next.
+	StagedLogFile = "staged-log"
+
+	//stagedLogFoldingSuffix is appended to the log while it is folded, such
+	//that splits that run meanwhile start a new one
+	stagedLogFoldingSuffix = ".folding"
+)
+
+//logStaged appends the chunks 'ids' of the pointer with blob id 'blob' to
+//the staged log, in a single write such that concurrent (clean) processes
+//don't interleave. Keys are logged as they are listed, with their version.
+func (repo *Repository) logStaged(blob string, ids []chunkID) (err error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(blob)+len(ids)*(hex.EncodedLen(KeySize+1)+1)+1))
+	buf.WriteString(blob)
+	for _, id := range ids {
+		fmt.Fprintf(buf, " %s", id)
+	}
+
+	buf.WriteString("\n")
+	p := filepath.Join(repo.chunkDir, StagedLogFile)
+	f, err := repo.openFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %v", p, err)
+	}
+
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write to '%s': %v", p, err)
+	}
+
+	return nil
+}
+
+//foldStagedLog records the chunks in the staged log as staged and the
+//blobs as referencing them. It is called with the store opened, which
+//no other process holds, such that folds don't run concurrently. The
+//records are written in two transactions before the log is removed, a
+//fold that is cut short leaves the log to be folded again the next time,
+//before the current one is. Folding again is harmless: recordStaged skips
+//chunks that are recorded already and recordRefs puts the same keys again.
+func (repo *Repository) foldStagedLog(store *bolt.DB) (err error) {
+	p := filepath.Join(repo.chunkDir, StagedLogFile)
+	folding := p + stagedLogFoldingSuffix
+	if _, err = os.Stat(folding); os.IsNotExist(err) {
+		err = os.Rename(p, folding)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to move '%s' aside: %v", p, err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(folding)
+	if err != nil {
+		return fmt.Errorf("failed to read '%s': %v", folding, err)
+	}
+
+	staged := []chunkID{}
+	refs := map[string][]chunkID{}
+
+	//the last line is empty, unless a write was cut short
+	lines := bytes.Split(data, []byte("\n"))
+	for _, line := range lines[:len(lines)-1] {
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		blob := string(fields[0])
+		for _, field := range fields[1:] {
+			c, err := ParseKeyLine(field)
+			if err != nil {
+				return fmt.Errorf("unexpected key '%s' in '%s': %v", field, folding, err)
+			}
+
+			staged = append(staged, c.id())
+			refs[blob] = append(refs[blob], c.id())
+		}
+	}
+
+	err = repo.recordStaged(store, staged)
+	if err != nil {
+		return err
+	}
+
+	err = repo.recordRefs(store, refs)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(folding)
+	if err != nil {
+		return fmt.Errorf("failed to remove '%s': %v", folding, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//StoreStatus describes the chunks in the local chunk directory: staged
+//chunks were split in this clone but are not known to be stored remotely,
+//they would be lost if the .git directory was removed. Cached chunks are
+//copies of chunks that the remote stores.
+type StoreStatus struct {
+	Staged     int
+	StagedSize int64
+	Cached     int
+	CachedSize int64
+}
+
+//recordStaged records the chunks that are not known to be stored remotely
+//as staged, with the time they were staged
+func (repo *Repository) recordStaged(store *bolt.DB, ids []chunkID) (err error) {
+	now := []byte(time.Now().UTC().Format(time.RFC3339))
+	err = store.Update(func(tx *bolt.Tx) error {
+		idx := tx.Bucket(IndexBucket)
+		b := tx.Bucket(StagedBucket)
+		for _, id := range ids {
+			key := id.storeKey()
+			if c := idx.Get(key); c != nil && bytes.Equal(c, RemoteChunk) {
+				continue
+			}
+
+			if b.Get(key) != nil {
+				continue
+			}
+
+			err := b.Put(key, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to record staged chunks: %v", err)
+	}
+
+	return nil
+}
+
+//stagedChunks returns the chunks that are recorded as staged
+func (repo *Repository) stagedChunks(store *bolt.DB) (staged map[chunkID]bool, err error) {
+	staged = map[chunkID]bool{}
+	err = store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(StagedBucket).ForEach(func(key, v []byte) error {
+			id, _ := parseStoreKey(key)
+			staged[id] = true
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staged chunks: %v", err)
+	}
+
+	return staged, nil
+}
+
+//Status returns how many chunks in the local chunk directory are staged
+//and how many are cached, with the bytes they hold
+func (repo *Repository) Status() (status StoreStatus, err error) {
+	var staged map[chunkID]bool
+	err = repo.withStore(func(store *bolt.DB) (err error) {
+		err = repo.foldStagedLog(store)
+		if err != nil {
+			return err
+		}
+
+		staged, err = repo.stagedChunks(store)
+		return err
+	})
+
+	if err != nil {
+		return status, err
+	}
+
+	err = repo.walkAllChunks(func(id chunkID, fi os.FileInfo) error {
+		if staged[id] {
+			status.Staged++
+			status.StagedSize += fi.Size()
+		} else {
+			status.Cached++
+			status.CachedSize += fi.Size()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return status, fmt.Errorf("failed to walk local chunks: %v", err)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,223 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//A stream holds the keys or content of several files such that a single
+//'git bits fetch --stream | git bits combine --stream' pipeline can handle
+//all files of a checkout. Each file is framed as:
+//
+//	file "<path>" LF
+//	<pointer or key lines> LF
+//	end LF
+//
+//A file that couldn't be handled is terminated with 'error <message> LF'
+//instead of 'end LF', the stream continues with the next file. Combined
+//content is binary and therefore written in blocks of 'data <n> LF' that
+//are followed by 'n' bytes.
+const (
+	streamFile  = "file "
+	streamData  = "data "
+	streamEnd   = "end"
+	streamError = "error "
+)
+
+//readStreamFile reads the next file frame of lines from the stream, it
+//returns io.EOF if there are no more files. 'ferr' holds the message of a
+//file that is terminated with an error.
+func readStreamFile(br *bufio.Reader) (path string, body []byte, ferr string, err error) {
+	line, err := br.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", nil, "", io.EOF
+	}
+
+	path, err = parseStreamFile(line, err)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return path, nil, "", fmt.Errorf("stream ended before the end of file '%s': %v", path, err)
+		}
+
+		switch {
+		case line == streamEnd+"\n":
+			return path, buf.Bytes(), "", nil
+		case strings.HasPrefix(line, streamError):
+			return path, nil, strings.TrimSpace(strings.TrimPrefix(line, streamError)), nil
+		default:
+			buf.WriteString(line)
+		}
+	}
+}
+
+//parseStreamFile parses the line that starts a file frame
+func parseStreamFile(line string, err error) (path string, perr error) {
+	if err != nil {
+		return "", fmt.Errorf("failed to read file frame: %v", err)
+	}
+
+	if !strings.HasPrefix(line, streamFile) {
+		return "", fmt.Errorf("unexpected line '%s' in stream, expected the start of a file", strings.TrimSpace(line))
+	}
+
+	path, err = strconv.Unquote(strings.TrimSpace(strings.TrimPrefix(line, streamFile)))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse path of file frame '%s': %v", strings.TrimSpace(line), err)
+	}
+
+	return path, nil
+}
+
+//WriteStreamFile writes the pointer (or keys) of the file at 'path' to 'w'
+//as a file frame
+func WriteStreamFile(w io.Writer, path string, ptr []byte) (err error) {
+	if len(ptr) > 0 && !bytes.HasSuffix(ptr, []byte("\n")) {
+		ptr = append(ptr, '\n')
+	}
+
+	_, err = fmt.Fprintf(w, "%s%s\n%s%s\n", streamFile, strconv.Quote(path), ptr, streamEnd)
+	return err
+}
+
+//writeStreamError terminates the frame of a file with the error
+func writeStreamError(w io.Writer, err error) error {
+	_, werr := fmt.Fprintf(w, "%s%s\n", streamError, strings.Replace(err.Error(), "\n", " ", -1))
+	return werr
+}
+
+//ReadStreamContent reads the combined content of the next file from the
+//stream and writes it to 'w'. It returns io.EOF if there are no more files
+//or the error with which the file was terminated.
+func ReadStreamContent(br *bufio.Reader, w io.Writer) (path string, err error) {
+	line, err := br.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", io.EOF
+	}
+
+	path, err = parseStreamFile(line, err)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return path, fmt.Errorf("stream ended before the end of file '%s': %v", path, err)
+		}
+
+		switch {
+		case line == streamEnd+"\n":
+			return path, nil
+		case strings.HasPrefix(line, streamError):
+			return path, fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(line, streamError)))
+		case strings.HasPrefix(line, streamData):
+			n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, streamData)), 10, 64)
+			if err != nil {
+				return path, fmt.Errorf("unexpected data block '%s': %v", strings.TrimSpace(line), err)
+			}
+
+			_, err = io.CopyN(w, br, n)
+			if err != nil {
+				return path, fmt.Errorf("failed to copy content of '%s': %v", path, err)
+			}
+		default:
+			return path, fmt.Errorf("unexpected line '%s' in content of '%s'", strings.TrimSpace(line), path)
+		}
+	}
+}
+
+//streamBlockWriter writes everything as a data block of a stream
+type streamBlockWriter struct {
+	w io.Writer
+}
+
+func (bw *streamBlockWriter) Write(p []byte) (n int, err error) {
+	_, err = fmt.Fprintf(bw.w, "%s%d\n", streamData, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return bw.w.Write(p)
+}
+
+//FetchStream is like Fetch but for a stream of files: it fetches the chunks
+//of each file and writes its keys as a frame to 'w'. A file of which
+//chunks failed to fetch is terminated with an error.
+func (repo *Repository) FetchStream(r io.Reader, w io.Writer) (err error) {
+	br := bufio.NewReader(r)
+	for {
+		path, body, ferr, err := readStreamFile(br)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "%s%s\n", streamFile, strconv.Quote(path))
+		if err != nil {
+			return err
+		}
+
+		if ferr != "" {
+			err = writeStreamError(w, fmt.Errorf("%s", ferr))
+		} else {
+			keys := bytes.NewBuffer(nil)
+			err = repo.Fetch(bytes.NewReader(body), keys)
+			if err != nil {
+				err = writeStreamError(w, err)
+			} else {
+				_, err = fmt.Fprintf(w, "%s%s\n", keys.Bytes(), streamEnd)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to write keys of '%s': %v", path, err)
+		}
+	}
+}
+
+//CombineStream is like Combine but for a stream of files: the content of
+//each file is written as a frame of data blocks to 'w'. A file of which the
+//chunks couldn't be combined is terminated with an error.
+func (repo *Repository) CombineStream(r io.Reader, w io.Writer) (err error) {
+	br := bufio.NewReader(r)
+	for {
+		path, body, ferr, err := readStreamFile(br)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "%s%s\n", streamFile, strconv.Quote(path))
+		if err != nil {
+			return err
+		}
+
+		if ferr != "" {
+			err = writeStreamError(w, fmt.Errorf("%s", ferr))
+		} else if cerr := repo.Combine(bytes.NewReader(body), &streamBlockWriter{w}); cerr != nil {
+			err = writeStreamError(w, cerr)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", streamEnd)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to write content of '%s': %v", path, err)
+		}
+	}
+}
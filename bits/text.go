@@ -0,0 +1,69 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+var (
+	//SmallTextSize is the size below which content that looks like text is
+	//reported when it is split, such files are better stored by git itself
+	SmallTextSize = 1024 * 1024 //1MiB
+
+	//TextCheckSize is the number of bytes that is checked for a NUL byte,
+	//like git does to decide whether content is binary
+	TextCheckSize = 8000
+
+	//TextCheckModes lists what Split can do with content that looks like
+	//small text: warn about it, refuse to split it or not check it at all
+	TextCheckModes = []string{"warn", "error", "off"}
+
+	//ErrTextContent is returned when splitting content that looks like small
+	//text while 'bits.text-check' is set to 'error'
+	ErrTextContent = fmt.Errorf("content looks like a small text file, splitting it prevents git from showing diffs while it doesn't deduplicate, check the 'filter=bits' patterns in .gitattributes (or configure 'bits.text-check')")
+)
+
+//looksLikeText returns whether the content, of which 'data' is the start,
+//is text smaller than SmallTextSize: it ends before that and holds no NUL
+//byte in the first TextCheckSize bytes
+func looksLikeText(data []byte, complete bool) bool {
+	if !complete || len(data) == 0 || len(data) >= SmallTextSize {
+		return false
+	}
+
+	if len(data) > TextCheckSize {
+		data = data[:TextCheckSize]
+	}
+
+	return bytes.IndexByte(data, 0) < 0
+}
+
+//checkText peeks at the content that is about to be split and warns or
+//errors, as configured, if it looks like small text
+func (repo *Repository) checkText(bufr *bufio.Reader) (err error) {
+	if repo.conf.TextCheck == "off" {
+		return nil
+	}
+
+	data, err := bufr.Peek(SmallTextSize)
+	if err != nil && err != io.EOF {
+		if err == bufio.ErrBufferFull {
+			return nil //large enough to split
+		}
+
+		return fmt.Errorf("failed to read content: %v", err)
+	}
+
+	if !looksLikeText(data, err == io.EOF) {
+		return nil
+	}
+
+	if repo.conf.TextCheck == "error" {
+		return ErrTextContent
+	}
+
+	fmt.Fprintf(repo.output, "warning: splitting %d bytes of what looks like text, git can't show diffs of it and it won't deduplicate, check the 'filter=bits' patterns in .gitattributes\n", len(data))
+	return nil
+}
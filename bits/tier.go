@@ -0,0 +1,274 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//TierBucket records the storage class that chunks were moved to on the
+	//remote by Tier
+	TierBucket = []byte("tier")
+
+	//StorageClasses maps the names of storage classes that chunks can be
+	//moved to onto those of s3
+	StorageClasses = map[string]string{
+		"standard":     "STANDARD",
+		"standard-ia":  "STANDARD_IA",
+		"glacier-ir":   "GLACIER_IR",
+		"glacier":      "GLACIER",
+		"deep-archive": "DEEP_ARCHIVE",
+	}
+
+	//ThawDays is how many days a chunk that was restored from cold storage
+	//stays readable before it is only in cold storage again
+	ThawDays = 7
+)
+
+//chunkTierer is implemented by remotes that can move chunks to a cheaper
+//storage class
+type chunkTierer interface {
+
+	//tierChunk moves the chunk to storage class 'class'
+	tierChunk(v KeyVersion, k K, class string) error
+}
+
+//coldChunkError is returned by remotes for chunks in a storage class that
+//must be restored before it can be read, 'thaw' requests the restore and
+//returns whether the chunk can be read already
+type coldChunkError struct {
+	id   chunkID
+	err  error
+	thaw func() (ready bool, err error)
+}
+
+func (e *coldChunkError) Error() string {
+	return fmt.Sprintf("chunk '%s' is in cold storage: %v", e.id, e.err)
+}
+
+//isColdClass returns whether chunks in storage class 'class' must be
+//restored before they can be read
+func isColdClass(class string) bool {
+	return class == "GLACIER" || class == "DEEP_ARCHIVE"
+}
+
+//ParseStorageClass returns the s3 storage class of the given name, e.g.
+//GLACIER for 'glacier'
+func ParseStorageClass(name string) (class string, err error) {
+	class, ok := StorageClasses[strings.ToLower(name)]
+	if !ok {
+		names := []string{}
+		for name := range StorageClasses {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown storage class '%s', expected one of: %s", name, strings.Join(names, ", "))
+	}
+
+	return class, nil
+}
+
+//ParseAge parses an age such as '1y', '90d' or '2w', any duration that
+//time.ParseDuration accepts (e.g. '36h') can be used as well
+func ParseAge(s string) (age time.Duration, err error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+
+	for suffix, unit := range units {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("unexpected age '%s', expected e.g. '1y', '90d' or '2w'", s)
+		}
+
+		return time.Duration(n * float64(unit)), nil
+	}
+
+	age, err = time.ParseDuration(s)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("unexpected age '%s', expected e.g. '1y', '90d' or '2w'", s)
+	}
+
+	return age, nil
+}
+
+//TierReport describes what Tier did to the chunks of old tags
+type TierReport struct {
+	Tags    int //tags that are older than the given age
+	Tiered  int //chunks that were moved to the storage class
+	Skipped int //chunks that were moved to the storage class before
+}
+
+//Tier moves the chunks that are only referenced by tags older than
+//'olderThan' to the cheaper storage class 'class' (see StorageClasses) of
+//the remote. Chunks in the tree of any branch, remote branch or more
+//recent tag stay where they are. The class of each moved chunk is recorded
+//in the TierBucket and its key is written to 'w', with 'dryRun' nothing is
+//moved. Chunks in cold storage are restored when they are fetched.
+func (repo *Repository) Tier(w io.Writer, olderThan time.Duration, class string, dryRun bool) (report TierReport, err error) {
+	_, end := repo.trace(context.Background(), "tier", SpanAttr{"class", class}, SpanAttr{"dry-run", dryRun})
+	defer end(&err)
+	if repo.conf.ReadOnly {
+		return report, ErrReadOnly
+	}
+
+	if repo.currentRemote() == nil {
+		return report, withKind(ConfigError, fmt.Errorf("unable to tier chunks, no remote configured"))
+	}
+
+	tierer, ok := unwrapRemote(repo.currentRemote()).(chunkTierer)
+	if !ok {
+		return report, withKind(ConfigError, fmt.Errorf("the remote doesn't support storage classes"))
+	}
+
+	old, other, err := repo.tierRefs(time.Now().Add(-olderThan))
+	if err != nil {
+		return report, err
+	}
+
+	report.Tags = len(old)
+	keep := map[chunkID]bool{}
+	for _, ref := range other {
+		err = repo.ForEachPointer(ref, nil, func(p string, ptr *Pointer) error {
+			for _, c := range ptr.Chunks {
+				keep[c.id()] = true
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return report, fmt.Errorf("failed to list the chunks of '%s': %v", ref, err)
+		}
+	}
+
+	candidates := []chunkID{}
+	seen := map[chunkID]bool{}
+	for _, ref := range old {
+		err = repo.ForEachPointer(ref, nil, func(p string, ptr *Pointer) error {
+			for _, c := range ptr.Chunks {
+				if id := c.id(); !keep[id] && !seen[id] {
+					seen[id] = true
+					candidates = append(candidates, id)
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return report, fmt.Errorf("failed to list the chunks of '%s': %v", ref, err)
+		}
+	}
+
+	err = repo.withStore(func(store *bolt.DB) error {
+		for _, id := range candidates {
+			var tiered string
+			store.View(func(tx *bolt.Tx) error {
+				tiered = string(tx.Bucket(TierBucket).Get(id.storeKey()))
+				return nil
+			})
+
+			if tiered == class {
+				report.Skipped++
+				continue
+			}
+
+			if !dryRun {
+				err := tierer.tierChunk(id.v, id.k, class)
+				if err != nil {
+					return withKind(NetworkError, fmt.Errorf("failed to move chunk '%s' to %s: %v", id, class, err))
+				}
+
+				err = store.Update(func(tx *bolt.Tx) error {
+					return tx.Bucket(TierBucket).Put(id.storeKey(), []byte(class))
+				})
+
+				if err != nil {
+					return fmt.Errorf("failed to record the storage class of chunk '%s': %v", id, err)
+				}
+			}
+
+			report.Tiered++
+			fmt.Fprintf(w, "%s\n", id)
+		}
+
+		return nil
+	})
+
+	return report, err
+}
+
+//tierRefs returns the tags that were created before 'before' and the other
+//refs: branches, remote branches and more recent tags. Specialty branches
+//are left out.
+func (repo *Repository) tierRefs(before time.Time) (old, other []string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "for-each-ref", "--format=%(refname) %(creatordate:unix)", "refs/heads", "refs/remotes", "refs/tags")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list refs: %v", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		ref := fields[0]
+		if strings.HasSuffix(ref, "/"+ChunkIndexBranch) || strings.HasSuffix(ref, RemoteBranchSuffix) || strings.HasSuffix(ref, "/HEAD") {
+			continue
+		}
+
+		created, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unexpected creation date of '%s': %v", ref, err)
+		}
+
+		if strings.HasPrefix(ref, "refs/tags/") && time.Unix(created, 0).Before(before) {
+			old = append(old, ref)
+			continue
+		}
+
+		other = append(other, ref)
+	}
+
+	return old, other, nil
+}
+
+//readColdChunk handles error 'err' of reading chunk 'k' of version 'v' from
+//'remote': if the chunk is in cold storage its restore is requested and, if
+//it can be read already, it is read. Otherwise the error is returned as is.
+func (repo *Repository) readColdChunk(remote Remote, v KeyVersion, k K, err error) (rc io.ReadCloser, rerr error) {
+	var cold *coldChunkError
+	if !errors.As(err, &cold) {
+		return nil, err
+	}
+
+	ready, err := cold.thaw()
+	if err != nil {
+		return nil, withKind(NetworkError, fmt.Errorf("failed to restore chunk '%s' from cold storage: %v", FormatKey(v, k), err))
+	}
+
+	if !ready {
+		return nil, fmt.Errorf("chunk '%s' is in cold storage and is being restored, this can take hours: retry with 'git bits fetch --retry-failed'", FormatKey(v, k))
+	}
+
+	return remoteChunkReader(remote, v, k)
+}
@@ -0,0 +1,230 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//TokenScope determines what the holder of a token may do with the chunk server
+type TokenScope string
+
+var (
+	//ReadScope allows fetching chunks
+	ReadScope = TokenScope("read")
+
+	//WriteScope allows fetching and storing chunks
+	WriteScope = TokenScope("write")
+)
+
+var (
+	//TokenFile is the file in the chunk directory that lists the tokens the
+	//chunk server accepts. Only hashes of the tokens are stored.
+	TokenFile = "tokens"
+
+	//TokenPrefix is prepended to issued tokens such that they are easy to
+	//recognize, e.g. when they end up in logs
+	TokenPrefix = "bits_"
+)
+
+//ParseTokenScope returns the scope with the given name
+func ParseTokenScope(name string) (scope TokenScope, err error) {
+	switch TokenScope(name) {
+	case ReadScope, WriteScope:
+		return TokenScope(name), nil
+	default:
+		return scope, fmt.Errorf("unknown token scope '%s', expected '%s' or '%s'", name, ReadScope, WriteScope)
+	}
+}
+
+//allows returns whether a token of this scope may be used for 'scope'
+func (s TokenScope) allows(scope TokenScope) bool {
+	return s == scope || s == WriteScope
+}
+
+//Token describes an issued token, the token itself is only known to
+//whom it was issued
+type Token struct {
+	Name  string
+	Scope TokenScope
+	hash  string
+}
+
+//hashToken returns how a token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//Tokens returns the tokens that were issued, sorted by name
+func (repo *Repository) Tokens() (tokens []Token, err error) {
+	p := filepath.Join(repo.chunkDir, TokenFile)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected line in '%s': %s", p, s.Text())
+		}
+
+		scope, err := ParseTokenScope(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected line in '%s': %v", p, err)
+		}
+
+		tokens = append(tokens, Token{Name: fields[0], Scope: scope, hash: fields[2]})
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens, s.Err()
+}
+
+//writeTokens replaces the token file, it is written to a temporary file
+//first such that a running chunk server never reads part of it
+func (repo *Repository) writeTokens(tokens []Token) (err error) {
+	buf := bytes.NewBuffer(nil)
+	for _, t := range tokens {
+		fmt.Fprintf(buf, "%s %s %s\n", t.Name, t.Scope, t.hash)
+	}
+
+	p := filepath.Join(repo.chunkDir, TokenFile)
+	f, err := ioutil.TempFile(repo.chunkDir, TokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to create token file: %v", err)
+	}
+
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write token file: %v", err)
+	}
+
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to move token file into place: %v", err)
+	}
+
+	return nil
+}
+
+//newToken returns a random token
+func newToken() (token string, err error) {
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+
+	return TokenPrefix + hex.EncodeToString(secret), nil
+}
+
+//IssueToken creates a token with the given name and scope, the token is
+//returned once and can't be recovered afterwards
+func (repo *Repository) IssueToken(name string, scope TokenScope) (token string, err error) {
+	if name == "" || strings.IndexFunc(name, func(r rune) bool { return r <= ' ' }) != -1 {
+		return "", fmt.Errorf("invalid token name '%s', it can't be empty or contain whitespace", name)
+	}
+
+	_, err = ParseTokenScope(string(scope))
+	if err != nil {
+		return "", err
+	}
+
+	tokens, err := repo.Tokens()
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range tokens {
+		if t.Name == name {
+			return "", fmt.Errorf("a token named '%s' was already issued, rotate it instead", name)
+		}
+	}
+
+	token, err = newToken()
+	if err != nil {
+		return "", err
+	}
+
+	tokens = append(tokens, Token{Name: name, Scope: scope, hash: hashToken(token)})
+	return token, repo.writeTokens(tokens)
+}
+
+//RotateToken replaces the token with the given name by a new one of the
+//same scope, the old token is no longer accepted
+func (repo *Repository) RotateToken(name string) (token string, err error) {
+	tokens, err := repo.Tokens()
+	if err != nil {
+		return "", err
+	}
+
+	for i, t := range tokens {
+		if t.Name != name {
+			continue
+		}
+
+		token, err = newToken()
+		if err != nil {
+			return "", err
+		}
+
+		tokens[i].hash = hashToken(token)
+		return token, repo.writeTokens(tokens)
+	}
+
+	return "", fmt.Errorf("no token named '%s' was issued", name)
+}
+
+//RevokeToken removes the token with the given name
+func (repo *Repository) RevokeToken(name string) (err error) {
+	tokens, err := repo.Tokens()
+	if err != nil {
+		return err
+	}
+
+	for i, t := range tokens {
+		if t.Name == name {
+			return repo.writeTokens(append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+
+	return fmt.Errorf("no token named '%s' was issued", name)
+}
+
+//lookupToken returns the issued token that matches 'token'
+func lookupToken(tokens []Token, token string) (t Token, ok bool) {
+	h := []byte(hashToken(token))
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(h, []byte(t.hash)) == 1 {
+			return t, true
+		}
+	}
+
+	return t, false
+}
@@ -0,0 +1,453 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	//TraceBatchSize is how many ended spans are buffered before they are
+	//exported, spans are also exported when an operation completes
+	TraceBatchSize = 512
+
+	//TraceExportTimeout limits how long exporting a batch of spans may take
+	TraceExportTimeout = 10 * time.Second
+
+	//TraceScope is the instrumentation scope that spans are reported under
+	TraceScope = "github.com/nerdalize/git-bits/bits"
+)
+
+//SpanAttr is a key and value that describes a span
+type SpanAttr struct {
+	Key   string
+	Value interface{}
+}
+
+//SpanData is what is exported of a span once it ended
+type SpanData struct {
+	Name         string
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Start        time.Time
+	End          time.Time
+	Attrs        []SpanAttr
+	Err          string
+}
+
+//SpanExporter receives the spans that ended in batches
+type SpanExporter interface {
+	ExportSpans(spans []SpanData) error
+}
+
+//Span is a timed part of an operation, a nil span records nothing such
+//that code doesn't need to check whether tracing is enabled
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+}
+
+//SetAttr adds an attribute to the span, values are strings, integers,
+//floats or booleans
+func (sp *Span) SetAttr(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+
+	sp.data.Attrs = append(sp.data.Attrs, SpanAttr{Key: key, Value: value})
+}
+
+//End ends the span, 'err' is recorded as its status if it is not nil
+func (sp *Span) End(err error) {
+	if sp == nil {
+		return
+	}
+
+	sp.data.End = time.Now()
+	if err != nil {
+		sp.data.Err = err.Error()
+	}
+
+	sp.tracer.record(sp.data)
+}
+
+//Tracer creates spans and hands them to an exporter once they end
+type Tracer struct {
+	exporter SpanExporter
+
+	//parent of spans that are started without one, e.g. from $TRACEPARENT
+	traceID  [16]byte
+	parentID [8]byte
+
+	mu    sync.Mutex
+	ended []SpanData
+}
+
+//NewTracer returns a tracer that exports spans to 'exp'
+func NewTracer(exp SpanExporter) *Tracer {
+	return &Tracer{exporter: exp}
+}
+
+//NewTracerFromEnv configures tracing using the standard OpenTelemetry
+//environment variables, it returns nil if tracing is not enabled:
+//
+//  OTEL_TRACES_EXPORTER: 'otlp', 'console' (stderr) or 'none'
+//  OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT: where
+//    spans are sent using OTLP over http with json encoding
+//  OTEL_EXPORTER_OTLP_HEADERS: comma separated key=value headers, e.g. for
+//    authenticating with the collector
+//  OTEL_SERVICE_NAME: the service spans are reported for (git-bits)
+//  TRACEPARENT: a w3c trace context that spans become children of, such
+//    that the processes started by git show up in a single trace
+func NewTracerFromEnv() (t *Tracer, err error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimRight(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+
+	kind := os.Getenv("OTEL_TRACES_EXPORTER")
+	if kind == "" && endpoint != "" {
+		kind = "otlp"
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "git-bits"
+	}
+
+	var exp SpanExporter
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "console":
+		exp = &consoleExporter{w: os.Stderr}
+	case "otlp":
+		if endpoint == "" {
+			endpoint = "http://localhost:4318/v1/traces"
+		}
+
+		headers, err := parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			return nil, err
+		}
+
+		exp = &otlpExporter{
+			url:     endpoint,
+			headers: headers,
+			service: service,
+			client:  &http.Client{Timeout: TraceExportTimeout},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported traces exporter '%s', expected 'otlp', 'console' or 'none'", kind)
+	}
+
+	t = NewTracer(exp)
+	if tp := os.Getenv("TRACEPARENT"); tp != "" {
+		err = t.setParent(tp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+//setParent parses a w3c traceparent, e.g. 00-<trace id>-<span id>-01
+func (t *Tracer) setParent(tp string) (err error) {
+	fields := strings.Split(tp, "-")
+	if len(fields) != 4 {
+		return fmt.Errorf("invalid traceparent '%s'", tp)
+	}
+
+	tid, terr := hex.DecodeString(fields[1])
+	sid, serr := hex.DecodeString(fields[2])
+	if terr != nil || serr != nil || len(tid) != len(t.traceID) || len(sid) != len(t.parentID) {
+		return fmt.Errorf("invalid traceparent '%s'", tp)
+	}
+
+	copy(t.traceID[:], tid)
+	copy(t.parentID[:], sid)
+	return nil
+}
+
+//Start starts a span that is a child of 'parent', spans without a parent
+//start a new trace
+func (t *Tracer) Start(parent *Span, name string, attrs ...SpanAttr) *Span {
+	if t == nil {
+		return nil
+	}
+
+	sp := &Span{tracer: t, data: SpanData{
+		Name:         name,
+		TraceID:      t.traceID,
+		ParentSpanID: t.parentID,
+		Start:        time.Now(),
+		Attrs:        attrs,
+	}}
+
+	if parent != nil {
+		sp.data.TraceID = parent.data.TraceID
+		sp.data.ParentSpanID = parent.data.SpanID
+	} else if sp.data.TraceID == [16]byte{} {
+		rand.Read(sp.data.TraceID[:])
+	}
+
+	rand.Read(sp.data.SpanID[:])
+	return sp
+}
+
+//Traceparent returns the w3c trace context of the span, such that processes
+//it starts can continue the trace
+func (sp *Span) Traceparent() string {
+	if sp == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("00-%x-%x-01", sp.data.TraceID, sp.data.SpanID)
+}
+
+//record buffers an ended span and exports the buffer once it is full
+func (t *Tracer) record(data SpanData) {
+	t.mu.Lock()
+	t.ended = append(t.ended, data)
+	full := len(t.ended) >= TraceBatchSize
+	t.mu.Unlock()
+	if full {
+		t.Flush()
+	}
+}
+
+//Flush exports all spans that ended
+func (t *Tracer) Flush() (err error) {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	spans := t.ended
+	t.ended = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	err = t.exporter.ExportSpans(spans)
+	if err != nil {
+		return fmt.Errorf("failed to export %d spans: %v", len(spans), err)
+	}
+
+	return nil
+}
+
+//consoleExporter writes spans as json, one per line
+type consoleExporter struct {
+	w io.Writer
+}
+
+func (e *consoleExporter) ExportSpans(spans []SpanData) (err error) {
+	enc := json.NewEncoder(e.w)
+	for _, sp := range spans {
+		attrs := map[string]interface{}{}
+		for _, attr := range sp.Attrs {
+			attrs[attr.Key] = attr.Value
+		}
+
+		err = enc.Encode(map[string]interface{}{
+			"name":           sp.Name,
+			"trace_id":       hex.EncodeToString(sp.TraceID[:]),
+			"span_id":        hex.EncodeToString(sp.SpanID[:]),
+			"parent_span_id": hex.EncodeToString(sp.ParentSpanID[:]),
+			"start":          sp.Start,
+			"duration":       sp.End.Sub(sp.Start).String(),
+			"attributes":     attrs,
+			"error":          sp.Err,
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//otlpExporter sends spans to an OpenTelemetry collector using OTLP over
+//http with the json encoding
+type otlpExporter struct {
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+}
+
+//parseOTLPHeaders parses headers in the OTEL_EXPORTER_OTLP_HEADERS format
+func parseOTLPHeaders(s string) (headers map[string]string, err error) {
+	headers = map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid otlp header '%s', expected key=value", pair)
+		}
+
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return headers, nil
+}
+
+//otlpValue encodes an attribute value as an OTLP AnyValue
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+//otlpAttrs encodes attributes as OTLP KeyValues
+func otlpAttrs(attrs []SpanAttr) []map[string]interface{} {
+	kvs := []map[string]interface{}{}
+	for _, attr := range attrs {
+		kvs = append(kvs, map[string]interface{}{"key": attr.Key, "value": otlpValue(attr.Value)})
+	}
+
+	return kvs
+}
+
+func (e *otlpExporter) ExportSpans(spans []SpanData) (err error) {
+	otlpSpans := []map[string]interface{}{}
+	for _, sp := range spans {
+		s := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.TraceID[:]),
+			"spanId":            hex.EncodeToString(sp.SpanID[:]),
+			"name":              sp.Name,
+			"kind":              1, //internal
+			"startTimeUnixNano": strconv.FormatInt(sp.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.End.UnixNano(), 10),
+			"attributes":        otlpAttrs(sp.Attrs),
+		}
+
+		if sp.ParentSpanID != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(sp.ParentSpanID[:])
+		}
+
+		if sp.Err != "" {
+			s["status"] = map[string]interface{}{"code": 2, "message": sp.Err}
+		}
+
+		otlpSpans = append(otlpSpans, s)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs([]SpanAttr{{Key: "service.name", Value: e.service}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": TraceScope},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send spans to '%s': %v", e.url, err)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector at '%s' responded with: %s", e.url, resp.Status)
+	}
+
+	return nil
+}
+
+//spanKey is the key of the span of the running operation in a context
+type spanKey struct{}
+
+//spanFrom returns the span of the operation that 'ctx' belongs to, if any
+func spanFrom(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+
+	sp, _ := ctx.Value(spanKey{}).(*Span)
+	return sp
+}
+
+//startSpan starts a span that is part of the operation that 'ctx' belongs to
+func (repo *Repository) startSpan(ctx context.Context, name string, attrs ...SpanAttr) *Span {
+	return repo.tracer.Start(spanFrom(ctx), name, attrs...)
+}
+
+//trace starts the span of an operation as a child of the operation that
+//'ctx' belongs to, if any. The returned context carries the span such that
+//spans started with it become its children, operations that run at the
+//same time each carry their own. The returned function ends it with the
+//error that 'err' points to, ending an operation that isn't part of
+//another exports the spans, e.g.:
+//
+//  ctx, end := repo.trace(ctx, "push")
+//  defer end(&err)
+func (repo *Repository) trace(ctx context.Context, name string, attrs ...SpanAttr) (context.Context, func(err *error)) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if repo.tracer == nil {
+		return ctx, func(*error) {}
+	}
+
+	parent := spanFrom(ctx)
+	sp := repo.tracer.Start(parent, name, attrs...)
+	return context.WithValue(ctx, spanKey{}, sp), func(err *error) {
+		sp.End(*err)
+		if parent == nil {
+			ferr := repo.tracer.Flush()
+			if ferr != nil {
+				fmt.Fprintf(repo.output, "failed to export traces: %v\n", ferr)
+			}
+		}
+	}
+}
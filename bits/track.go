@@ -0,0 +1,249 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	//AutoTrackModes lists what can be done with large files that are staged
+	//without being split: warn about them or add patterns that split them
+	AutoTrackModes = []string{"warn", "add"}
+)
+
+//LargeFile is a staged file that is not split while it is larger than the
+//configured 'bits.auto-track-size'
+type LargeFile struct {
+	Path string
+	Size int64
+}
+
+//StagedLargeFiles returns the files that are added or modified in the index,
+//are larger than 'threshold' bytes and are not split because no pattern in
+//.gitattributes gives them the 'bits' filter
+func (repo *Repository) StagedLargeFiles(threshold int64) (files []LargeFile, err error) {
+	ctx := context.Background()
+	paths, objs, err := repo.stagedBlobs()
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+
+	objects := bytes.NewBuffer(nil)
+	for _, obj := range objs {
+		fmt.Fprintf(objects, "%s\n", obj)
+	}
+
+	//output: <object> SP <type> SP <size> LF, in the order of the input
+	out := bytes.NewBuffer(nil)
+	err = repo.Git(ctx, objects, out, "cat-file", "--batch-check")
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine sizes of staged files: %v", err)
+	}
+
+	sizes := map[string]int64{}
+	attrs := bytes.NewBuffer(nil)
+	s := bufio.NewScanner(out)
+	for i := 0; s.Scan() && i < len(paths); i++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || size <= threshold {
+			continue
+		}
+
+		sizes[paths[i]] = size
+		fmt.Fprintf(attrs, "%s\x00", paths[i])
+	}
+
+	if len(sizes) == 0 {
+		return nil, nil
+	}
+
+	//output: <path> NUL <attribute> NUL <value> NUL
+	out.Reset()
+	err = repo.Git(ctx, attrs, out, "check-attr", "-z", "--stdin", "filter")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check which files are split: %v", err)
+	}
+
+	fields := bytes.Split(out.Bytes(), []byte{0})
+	for i := 0; i+2 < len(fields); i += 3 {
+		if string(fields[i+2]) == "bits" {
+			continue
+		}
+
+		p := string(fields[i])
+		files = append(files, LargeFile{Path: p, Size: sizes[p]})
+	}
+
+	return files, nil
+}
+
+//stagedBlobs returns the paths of the files that are added or modified in
+//the index with the objects that are staged for them
+func (repo *Repository) stagedBlobs() (paths, objects []string, err error) {
+	ctx := context.Background()
+	out := bytes.NewBuffer(nil)
+	err = repo.Git(ctx, nil, out, "diff", "--cached", "--name-only", "-z", "--diff-filter=AM")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list staged files: %v", err)
+	}
+
+	staged := map[string]bool{}
+	for _, p := range bytes.Split(out.Bytes(), []byte{0}) {
+		if len(p) > 0 {
+			staged[string(p)] = true
+		}
+	}
+
+	if len(staged) == 0 {
+		return nil, nil, nil
+	}
+
+	//entry: <mode> SP <object> SP <stage> TAB <file> NUL
+	out.Reset()
+	err = repo.Git(ctx, nil, out, "ls-files", "--stage", "-z")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read index: %v", err)
+	}
+
+	for _, entry := range bytes.Split(out.Bytes(), []byte{0}) {
+		tfields := bytes.SplitN(entry, []byte("\t"), 2)
+		fields := bytes.Fields(tfields[0])
+		if len(tfields) != 2 || len(fields) != 3 || !staged[string(tfields[1])] {
+			continue
+		}
+
+		paths = append(paths, string(tfields[1]))
+		objects = append(objects, string(fields[1]))
+	}
+
+	return paths, objects, nil
+}
+
+//TrackPattern returns the .gitattributes pattern that matches files like
+//the one at 'p': all files with its extension or, without one, the path
+//itself. Whitespace is matched with a character class as patterns can't
+//contain it.
+func TrackPattern(p string) string {
+	pattern := "/" + p
+	if ext := path.Ext(p); ext != "" && ext != path.Base(p) {
+		pattern = "*" + ext
+	}
+
+	return strings.Join(strings.Fields(pattern), "[[:space:]]")
+}
+
+//Track adds patterns that give matching files the 'bits' filter to the
+//.gitattributes file at the root of the working tree, patterns that are
+//in it already are skipped. It returns the patterns that were added.
+func (repo *Repository) Track(patterns ...string) (added []string, err error) {
+	p := filepath.Join(repo.rootDir, ".gitattributes")
+	data, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read '%s': %v", p, err)
+	}
+
+	existing := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			existing[fields[0]] = true
+		}
+	}
+
+	buf := bytes.NewBuffer(data)
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+
+	for _, pattern := range patterns {
+		if existing[pattern] {
+			continue
+		}
+
+		existing[pattern] = true
+		added = append(added, pattern)
+		fmt.Fprintf(buf, "%s\tfilter=bits\n", pattern)
+	}
+
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	err = ioutil.WriteFile(p, buf.Bytes(), 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write '%s': %v", p, err)
+	}
+
+	return added, nil
+}
+
+//AutoTrack handles staged files that are larger than 'bits.auto-track-size'
+//but are not split, as configured with 'bits.auto-track': they are written
+//to 'w' as a warning or, with 'add', patterns for them are added to
+//.gitattributes and the files are staged again such that they are split.
+//It returns the files that were found.
+func (repo *Repository) AutoTrack(w io.Writer, add bool) (files []LargeFile, err error) {
+	if repo.conf.AutoTrackSize <= 0 {
+		return nil, nil
+	}
+
+	files, err = repo.StagedLargeFiles(repo.conf.AutoTrackSize)
+	if err != nil || len(files) == 0 {
+		return files, err
+	}
+
+	add = add || repo.conf.AutoTrack == "add"
+	if !add {
+		fmt.Fprintf(w, "warning: the following staged files are larger than %s but are not split by git-bits:\n", humanize.Bytes(uint64(repo.conf.AutoTrackSize)))
+		for _, f := range files {
+			fmt.Fprintf(w, "\t%s (%s)\n", f.Path, humanize.Bytes(uint64(f.Size)))
+		}
+
+		fmt.Fprintf(w, "split them with 'git bits track --auto --add' or configure 'bits.auto-track=add' to do so automatically\n")
+		return files, nil
+	}
+
+	patterns := []string{}
+	args := []string{"--literal-pathspecs", "add", "--renormalize", "--"}
+	for _, f := range files {
+		patterns = append(patterns, TrackPattern(f.Path))
+		args = append(args, f.Path)
+	}
+
+	added, err := repo.Track(patterns...)
+	if err != nil {
+		return files, err
+	}
+
+	for _, pattern := range added {
+		fmt.Fprintf(w, "tracking '%s' with git-bits\n", pattern)
+	}
+
+	err = repo.Git(context.Background(), nil, nil, "add", "--", ".gitattributes")
+	if err != nil {
+		return files, fmt.Errorf("failed to stage .gitattributes: %v", err)
+	}
+
+	err = repo.Git(context.Background(), nil, nil, args...)
+	if err != nil {
+		return files, fmt.Errorf("failed to stage files again: %v", err)
+	}
+
+	return files, nil
+}
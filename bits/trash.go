@@ -0,0 +1,182 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//RemoteTrashPeriod is how long chunks that PruneRemote moved to the trash
+	//are kept there before they are deleted for good, it should be longer
+	//than it takes for the branches of others to be pushed
+	RemoteTrashPeriod = 7 * 24 * time.Hour
+)
+
+//chunkTrasher is implemented by remotes that can move chunks aside before
+//deleting them, such that a chunk that turns out to be referenced after all
+//(e.g. by a push from a machine with a stale index) can be restored
+type chunkTrasher interface {
+
+	//trashChunk moves the chunk to the trash
+	trashChunk(v KeyVersion, k K) error
+
+	//restoreChunk moves a trashed chunk back to where chunks are stored
+	restoreChunk(v KeyVersion, k K) error
+
+	//trashedChunks calls 'fn' for each chunk in the trash with the time it
+	//was moved there
+	trashedChunks(fn func(v KeyVersion, k K, trashed time.Time) error) error
+
+	//purgeChunks deletes chunks in the trash for good
+	purgeChunks(ids []chunkID) error
+}
+
+//PruneRemoteReport describes what PruneRemote did to the chunks of the remote
+type PruneRemoteReport struct {
+	Trashed  int //chunks that are no longer referenced and were moved to the trash
+	Restored int //chunks in the trash that are referenced again
+	Purged   int //chunks that were in the trash for RemoteTrashPeriod and were deleted
+	Shared   int //chunks that are kept because only other repositories reference them
+}
+
+//PruneRemote removes chunks from the remote that no branch, remote branch or
+//tag references, in two phases: chunks are first moved to the trash and only
+//deleted once they were there for RemoteTrashPeriod. Chunks in the trash
+//that are referenced again, e.g. because a machine with a stale index
+//pushed a branch without uploading them, are restored. Fetch first such that
+//the branches of others are known. In a bucket that is shared with other
+//repositories the chunks they reference are kept as well. Chunks that are
+//moved are written to 'w' prefixed with 'trash', 'restore' or 'purge', with
+//'dryRun' nothing is moved.
+func (repo *Repository) PruneRemote(w io.Writer, dryRun bool) (report PruneRemoteReport, err error) {
+	_, end := repo.trace(context.Background(), "prune-remote", SpanAttr{"dry-run", dryRun})
+	defer end(&err)
+	if repo.conf.ReadOnly {
+		return report, ErrReadOnly
+	}
+
+	if repo.currentRemote() == nil {
+		return report, fmt.Errorf("unable to prune the remote, no remote configured")
+	}
+
+	trasher, ok := unwrapRemote(repo.currentRemote()).(chunkTrasher)
+	if !ok {
+		return report, fmt.Errorf("the remote doesn't support moving chunks to a trash, chunks are never deleted from it at once")
+	}
+
+	//every ref counts, including the remote branches of others
+	buf := bytes.NewBuffer(nil)
+	err = repo.scanRevs(nil, []string{"--exclude=*/" + ChunkIndexBranch, "--exclude=*" + RemoteBranchSuffix, "--all"}, buf)
+	if err != nil {
+		return report, fmt.Errorf("failed to scan for referenced chunks: %v", err)
+	}
+
+	referenced := map[chunkID]bool{}
+	err = repo.forEachChunk(buf, func(c PointerChunk) error {
+		referenced[c.id()] = true
+		return nil
+	})
+
+	if err != nil {
+		return report, err
+	}
+
+	//in a shared bucket the chunks of other repositories count as well
+	if repo.sharing() {
+		report.Shared, err = repo.sharedReferences(referenced, dryRun)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	//the second phase for chunks that were trashed before
+	purge := []chunkID{}
+	err = trasher.trashedChunks(func(v KeyVersion, k K, trashed time.Time) error {
+		id := chunkID{v, k}
+		switch {
+		case referenced[id]:
+			fmt.Fprintf(w, "restore %s\n", id)
+			report.Restored++
+			if dryRun {
+				return nil
+			}
+
+			return trasher.restoreChunk(v, k)
+		case time.Since(trashed) >= RemoteTrashPeriod:
+			fmt.Fprintf(w, "purge %s\n", id)
+			purge = append(purge, id)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return report, fmt.Errorf("failed to go through the trash: %v", err)
+	}
+
+	report.Purged = len(purge)
+	if !dryRun && len(purge) > 0 {
+		err = trasher.purgeChunks(purge)
+		if err != nil {
+			return report, fmt.Errorf("failed to delete chunks from the trash: %v", err)
+		}
+	}
+
+	//the first phase for chunks that are no longer referenced
+	listed := bytes.NewBuffer(nil)
+	err = repo.currentRemote().ListChunks(listed)
+	if err != nil {
+		return report, fmt.Errorf("failed to list remote chunks: %v", err)
+	}
+
+	trashed := []chunkID{}
+	err = repo.forEachChunk(listed, func(c PointerChunk) error {
+		id := c.id()
+		if referenced[id] {
+			return nil
+		}
+
+		fmt.Fprintf(w, "trash %s\n", id)
+		trashed = append(trashed, id)
+		if dryRun {
+			return nil
+		}
+
+		return trasher.trashChunk(id.v, id.k)
+	})
+
+	report.Trashed = len(trashed)
+	if err != nil {
+		return report, fmt.Errorf("failed to move chunks to the trash: %v", err)
+	}
+
+	if dryRun || len(trashed) == 0 {
+		return report, nil
+	}
+
+	//our own pushes should upload the chunks again
+	err = repo.withStore(func(store *bolt.DB) error {
+		return store.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(IndexBucket)
+			for _, id := range trashed {
+				err := b.Delete(id.storeKey())
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return report, fmt.Errorf("failed to remove trashed chunks from the index: %v", err)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,105 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+//ForEachPointer calls 'fn' for every file in the tree of 'ref' that holds
+//pointer content, optionally limited to the given paths. Paths are relative
+//to the root of the repository.
+func (repo *Repository) ForEachPointer(ref string, paths []string, fn func(path string, ptr *Pointer) error) (err error) {
+
+	// ls-tree -r -l -z <ref> -- <paths> | f1 | cat-file --batch | f2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buf := bytes.NewBuffer(nil)
+	args := append([]string{"ls-tree", "-r", "-l", "-z", "--full-tree", ref, "--"}, paths...)
+	err = repo.Git(ctx, nil, buf, args...)
+	if err != nil {
+		return fmt.Errorf("failed to list tree of '%s': %v", ref, err)
+	}
+
+	//@see https://git-scm.com/docs/git-ls-tree
+	//line : <mode> SP <type> SP <object> SP <size> TAB <file> NUL
+	objs := bytes.NewBuffer(nil)
+	objPaths := [][]byte{}
+	for _, entry := range bytes.Split(buf.Bytes(), []byte{0}) {
+		tfields := bytes.SplitN(entry, []byte("\t"), 2)
+		fields := bytes.Fields(entry)
+		if len(fields) < 5 || len(tfields) != 2 || !bytes.Equal(fields[1], []byte("blob")) {
+			continue
+		}
+
+		objSize, err := strconv.ParseInt(string(fields[3]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected object size in '%s': %v", entry, err)
+		}
+
+		//key files hold at least a header and a footer
+		if objSize < int64(len(repo.header)+len(repo.footer)) {
+			continue
+		}
+
+		fmt.Fprintf(objs, "%s\n", fields[2])
+		objPaths = append(objPaths, tfields[1])
+	}
+
+	if len(objPaths) == 0 {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(repo.Git(ctx, objs, pw, "cat-file", "--batch"))
+	}()
+
+	defer pr.Close()
+	r := bufio.NewReader(pr)
+	for _, p := range objPaths {
+
+		//@see https://git-scm.com/docs/git-cat-file
+		//<sha1> SP <type> SP <size> LF <contents> LF
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read object header for '%s': %v", p, err)
+		}
+
+		fields := bytes.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("unexpected object header for '%s': %s", p, line)
+		}
+
+		size, err := strconv.ParseInt(string(fields[2]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected object size for '%s': %v", p, err)
+		}
+
+		content := make([]byte, size+1)
+		_, err = io.ReadFull(r, content)
+		if err != nil {
+			return fmt.Errorf("failed to read object content for '%s': %v", p, err)
+		}
+
+		if !repo.hasHeader(content) {
+			continue
+		}
+
+		ptr, err := repo.ReadPointer(bytes.NewReader(content[:size]))
+		if err != nil {
+			return fmt.Errorf("failed to read pointer in '%s': %v", p, err)
+		}
+
+		err = fn(string(p), ptr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
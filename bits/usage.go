@@ -0,0 +1,173 @@
+package bits
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//UsageBucket holds the bytes that were transferred to and from each
+	//remote, keyed by the remote's name
+	UsageBucket = []byte("usage")
+
+	//PeerUsageName is the name that chunks fetched from peers on the local
+	//network are accounted under
+	PeerUsageName = "peers"
+)
+
+//RemoteUsage is the cumulative transfer to and from a single remote
+type RemoteUsage struct {
+	Remote           string    `json:"remote"`
+	UploadedBytes    int64     `json:"uploaded_bytes"`
+	UploadedChunks   int64     `json:"uploaded_chunks"`
+	DownloadedBytes  int64     `json:"downloaded_bytes"`
+	DownloadedChunks int64     `json:"downloaded_chunks"`
+	Since            time.Time `json:"since"`
+	Last             time.Time `json:"last"`
+}
+
+//remoteName identifies 'remote' in the accounting, e.g. the bucket rather
+//than the git remote such that it can be attributed to it
+func (repo *Repository) remoteName(remote Remote) string {
+	switch r := unwrapRemote(remote).(type) {
+	case *S3Remote:
+		return "s3://" + r.bucket.Name
+	case *GRPCRemote:
+		return "grpc://" + repo.conf.GRPCAddress
+	case *PublicRemote:
+		return r.base.String()
+	case *DirRemote:
+		return "file://" + r.dir
+	case *MemoryRemote:
+		return "memory"
+	default:
+		return fmt.Sprintf("%T", r)
+	}
+}
+
+//countTransfer records that a chunk of 'n' bytes was pushed to or fetched
+//from 'remote', it is written to the local store with writeUsage
+func (repo *Repository) countTransfer(op Op, remote string, n int64) {
+	repo.usageMu.Lock()
+	defer repo.usageMu.Unlock()
+	if repo.usagePending == nil {
+		repo.usagePending = map[string]*RemoteUsage{}
+	}
+
+	u, ok := repo.usagePending[remote]
+	if !ok {
+		u = &RemoteUsage{Remote: remote}
+		repo.usagePending[remote] = u
+	}
+
+	switch op {
+	case PushOp:
+		u.UploadedBytes += n
+		u.UploadedChunks++
+	case FetchOp:
+		u.DownloadedBytes += n
+		u.DownloadedChunks++
+	}
+}
+
+//writeUsage adds the transfers that were counted since it was last called
+//to the totals in the local store
+func (repo *Repository) writeUsage(store *bolt.DB) (err error) {
+	repo.usageMu.Lock()
+	pending := repo.usagePending
+	repo.usagePending = nil
+	repo.usageMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UsageBucket)
+		for remote, p := range pending {
+			u := RemoteUsage{Remote: remote, Since: now}
+			if data := b.Get([]byte(remote)); data != nil {
+				err := json.Unmarshal(data, &u)
+				if err != nil {
+					return fmt.Errorf("failed to decode usage of '%s': %v", remote, err)
+				}
+			}
+
+			u.UploadedBytes += p.UploadedBytes
+			u.UploadedChunks += p.UploadedChunks
+			u.DownloadedBytes += p.DownloadedBytes
+			u.DownloadedChunks += p.DownloadedChunks
+			u.Last = now
+			data, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put([]byte(remote), data)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to record transfer usage: %v", err)
+	}
+
+	return nil
+}
+
+//flushUsage writes the counted transfers when an operation completes, the
+//local store is only opened if 'store' is nil and anything was counted.
+//Failing to write is only reported as the transfers did complete.
+func (repo *Repository) flushUsage(store *bolt.DB) {
+	repo.usageMu.Lock()
+	counted := len(repo.usagePending) > 0
+	repo.usageMu.Unlock()
+	if !counted {
+		return
+	}
+
+	var err error
+	if store == nil {
+		err = repo.withStore(repo.writeUsage)
+	} else {
+		err = repo.writeUsage(store)
+	}
+
+	if err != nil {
+		fmt.Fprintf(repo.output, "%v\n", err)
+	}
+}
+
+//Usage returns the cumulative transfer to and from each remote that this
+//clone recorded, in order of the remote's name
+func (repo *Repository) Usage() (usage []RemoteUsage, err error) {
+	err = repo.withStore(func(store *bolt.DB) error {
+		return store.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(UsageBucket).ForEach(func(k, v []byte) error {
+				u := RemoteUsage{}
+				err := json.Unmarshal(v, &u)
+				if err != nil {
+					return fmt.Errorf("failed to decode usage of '%s': %v", k, err)
+				}
+
+				usage = append(usage, u)
+				return nil
+			})
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transfer usage: %v", err)
+	}
+
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Remote < usage[j].Remote })
+	return usage, nil
+}
@@ -0,0 +1,226 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+//VerifyReport describes whether the split files in the tree of a ref can be
+//reconstructed from the chunks that are stored locally and remotely
+type VerifyReport struct {
+	//the ref that was verified
+	Ref string
+
+	//split files in the tree of the ref
+	Files int
+
+	//distinct chunks that the files are made of
+	Chunks int
+
+	//chunks that are stored locally
+	Local int
+
+	//chunks that are only stored remotely
+	Remote int
+
+	//chunks that are stored neither locally nor remotely
+	Missing []K
+
+	//files that can't be reconstructed, in path order
+	Broken []BrokenFile
+}
+
+//BrokenFile is a split file of which chunks are missing
+type BrokenFile struct {
+	Path    string
+	Chunks  int
+	Missing int
+}
+
+//VerifyRef checks that every split file in the tree of 'ref' can be
+//reconstructed: that each of its chunks is stored locally or remotely.
+//Chunks are not downloaded, only their existence is checked. Files that
+//can't be reconstructed are written to 'w', if any the returned error is a
+//MissingChunkError.
+func (repo *Repository) VerifyRef(ref string, w io.Writer) (report VerifyReport, err error) {
+	_, end := repo.trace(context.Background(), "verify-ref", SpanAttr{"ref", ref})
+	defer end(&err)
+	report.Ref = ref
+	files, keys, err := repo.refChunks(ref)
+	if err != nil {
+		return report, err
+	}
+
+	report.Files = len(files)
+	report.Chunks = len(keys)
+	notLocal := []K{}
+	for _, k := range keys {
+		local, err := repo.localChunk(k)
+		if err != nil {
+			return report, err
+		}
+
+		if local {
+			report.Local++
+			continue
+		}
+
+		notLocal = append(notLocal, k)
+	}
+
+	stored, err := repo.remoteStores(notLocal)
+	if err != nil {
+		return report, withKind(NetworkError, err)
+	}
+
+	missing := map[K]bool{}
+	for _, k := range notLocal {
+		if stored[k] {
+			report.Remote++
+			continue
+		}
+
+		missing[k] = true
+		report.Missing = append(report.Missing, k)
+	}
+
+	for _, p := range sortedPaths(files) {
+		bf := BrokenFile{Path: p, Chunks: len(files[p])}
+		for _, k := range files[p] {
+			if missing[k] {
+				bf.Missing++
+			}
+		}
+
+		if bf.Missing > 0 {
+			report.Broken = append(report.Broken, bf)
+			fmt.Fprintf(w, "%s: %d of %d chunks missing\n", bf.Path, bf.Missing, bf.Chunks)
+		}
+	}
+
+	if len(report.Missing) > 0 {
+		return report, withKind(MissingChunkError, fmt.Errorf("%d of %d files in '%s' can't be reconstructed, %d chunks are stored neither locally nor remotely", len(report.Broken), report.Files, ref, len(report.Missing)))
+	}
+
+	return report, nil
+}
+
+//refChunks returns the chunks of each split file in the tree of 'ref' and
+//the distinct chunks of all of them, in the order they were first seen
+func (repo *Repository) refChunks(ref string) (files map[string][]K, keys []K, err error) {
+	files = map[string][]K{}
+	seen := map[K]bool{}
+	err = repo.ForEachPointer(ref, nil, func(p string, ptr *Pointer) error {
+		files[p] = []K{}
+		for _, c := range ptr.Chunks {
+			files[p] = append(files[p], c.K)
+			if !seen[c.K] {
+				seen[c.K] = true
+				keys = append(keys, c.K)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read pointers of '%s': %v", ref, err)
+	}
+
+	return files, keys, nil
+}
+
+//sortedPaths returns the paths of 'files' in order
+func sortedPaths(files map[string][]K) (paths []string) {
+	for p := range files {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+//localChunk returns whether chunk 'k' is stored in the local chunk directory
+func (repo *Repository) localChunk(k K) (ok bool, err error) {
+	p, _ := repo.Path(k, false)
+	_, err = os.Stat(p)
+	if err == nil {
+		return true, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to stat chunk '%x': %v", k, err)
+	}
+
+	return false, nil
+}
+
+//remoteStores returns which of the chunks 'ks' the remote stores. Remotes
+//that can tell are asked for each chunk in parallel, others list all their
+//chunks. Without a remote no chunk is stored.
+func (repo *Repository) remoteStores(ks []K) (stored map[K]bool, err error) {
+	stored = map[K]bool{}
+	if repo.currentRemote() == nil || len(ks) == 0 {
+		return stored, nil
+	}
+
+	haser, ok := unwrapRemote(repo.currentRemote()).(chunkHaser)
+	if !ok {
+		buf := bytes.NewBuffer(nil)
+		err = repo.currentRemote().ListChunks(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list remote chunks: %v", err)
+		}
+
+		err = repo.forEachChunk(buf, func(c PointerChunk) error {
+			if c.Version == KeyVersion0 {
+				stored[c.K] = true
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remote chunks: %v", err)
+		}
+
+		return stored, nil
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	keyCh := make(chan K)
+	for i := 0; i < FetchConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keyCh {
+				ok, herr := haser.hasChunk(KeyVersion0, k)
+				mu.Lock()
+				if herr != nil && err == nil {
+					err = fmt.Errorf("failed to check whether the remote stores chunk '%x': %v", k, herr)
+				}
+
+				stored[k] = ok
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, k := range ks {
+		keyCh <- k
+	}
+
+	close(keyCh)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
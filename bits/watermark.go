@@ -0,0 +1,114 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//WatermarkBucket holds for each remote and remote ref the last commit
+	//that was pushed successfully, keyed by '<remote> NUL <ref>'. Everything
+	//reachable from these commits is stored remotely and isn't scanned again.
+	WatermarkBucket = []byte("watermarks")
+
+	//PendingWatermarkBucket holds the commits that were scanned for a push
+	//that didn't complete yet, they become watermarks once it does
+	PendingWatermarkBucket = []byte("pending-watermarks")
+)
+
+//watermarkKey returns the key under which the commit of 'ref' is recorded
+func watermarkKey(remote, ref string) []byte {
+	return []byte(remote + "\x00" + ref)
+}
+
+//watermarks returns the commits that were pushed to the remote before
+func (repo *Repository) watermarks(store *bolt.DB, remote string) (commits []string, err error) {
+	err = store.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(WatermarkBucket).Cursor()
+		prefix := watermarkKey(remote, "")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			commits = append(commits, string(v))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watermarks: %v", err)
+	}
+
+	return commits, nil
+}
+
+//recordPendingWatermarks replaces the pending watermarks of the remote, such
+//that a push that failed earlier doesn't leave behind commits it didn't push
+func (repo *Repository) recordPendingWatermarks(store *bolt.DB, remote string, commits map[string]string) (err error) {
+	err = store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(PendingWatermarkBucket)
+		prefix := watermarkKey(remote, "")
+		stale := [][]byte{}
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			stale = append(stale, append([]byte{}, k...))
+		}
+
+		for _, k := range stale {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		for ref, commit := range commits {
+			err := b.Put(watermarkKey(remote, ref), []byte(commit))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to record pending watermarks: %v", err)
+	}
+
+	return nil
+}
+
+//promoteWatermarks turns the pending watermarks of the remote into
+//watermarks, it is called once all scanned chunks were pushed
+func (repo *Repository) promoteWatermarks(store *bolt.DB, remote string) (err error) {
+	err = store.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(PendingWatermarkBucket)
+		b := tx.Bucket(WatermarkBucket)
+		prefix := watermarkKey(remote, "")
+		promoted := [][]byte{}
+		c := pending.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			err := b.Put(k, v)
+			if err != nil {
+				return err
+			}
+
+			promoted = append(promoted, append([]byte{}, k...))
+		}
+
+		for _, k := range promoted {
+			err := pending.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to record watermarks: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var ArchiveOpts struct {
+	// Format of the archive that is written
+	Format string `long:"format" default:"tar" description:"format of the archive: tar or zip (default=tar)"`
+
+	// Prefix that is prepended to each path in the archive
+	Prefix string `long:"prefix" description:"prepend <prefix>/ to each path in the archive"`
+
+	// Output file, stdout is used if empty
+	Output string `short:"o" long:"output" description:"write the archive to this file instead of stdout"`
+}
+
+type Archive struct {
+	ui cli.Ui
+}
+
+func NewArchive() (cmd cli.Command, err error) {
+	return &Archive{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Archive) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &ArchiveOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Archive) Synopsis() string {
+	return "create an archive of a ref with the content of split files"
+}
+
+// Usage returns a usage description
+func (cmd *Archive) Usage() string {
+	return "git bits archive [options] <ref> [<path>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Archive) Run(args []string) int {
+	args, err := flags.ParseArgs(&ArchiveOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) < 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a ref to archive, got: %v", args))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	out := os.Stdout
+	if ArchiveOpts.Output != "" {
+		out, err = os.Create(ArchiveOpts.Output)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to create output file: %v", err))
+			return exitCode(err)
+		}
+
+		defer out.Close()
+	}
+
+	prefix := ArchiveOpts.Prefix
+	if prefix != "" && prefix[len(prefix)-1] != '/' {
+		prefix = prefix + "/"
+	}
+
+	err = repo.Archive(args[0], ArchiveOpts.Format, prefix, args[1:], out)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to archive: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,135 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var BenchOpts struct {
+	// How much content is split
+	Size int64 `long:"size" default:"256" description:"MiB of pseudo-random content that is split"`
+
+	// Highest number of split workers
+	Concurrency int `long:"concurrency" description:"highest number of split workers, defaults to the number of cpus"`
+
+	// Also list the remote
+	List bool `long:"list" description:"also measure listing the chunks of the remote"`
+}
+
+type Bench struct {
+	ui cli.Ui
+}
+
+func NewBench() (cmd cli.Command, err error) {
+	return &Bench{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Bench) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &BenchOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Splits pseudo-random content with 1, 2, 4, ... workers up to the number
+  of cpus and writes the throughput of each run to stdout. Chunks are
+  hashed but not stored, the content is the same each run such that
+  results can be compared between versions. Combine with the global
+  --cpuprofile and --memprofile flags to find out where time is spent.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Bench) Synopsis() string {
+	return "measure split and list throughput"
+}
+
+// Usage returns a usage description
+func (cmd *Bench) Usage() string {
+	return "git bits bench [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Bench) Run(args []string) int {
+	_, err := flags.ParseArgs(&BenchOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if BenchOpts.Size < 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a size of at least 1 MiB, got: %d", BenchOpts.Size))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	max := BenchOpts.Concurrency
+	if max < 1 {
+		max = bits.SplitConcurrency
+	}
+
+	data := bits.BenchContent(BenchOpts.Size*1024*1024, 1)
+	for n := 1; ; n *= 2 {
+		if n > max {
+			n = max
+		}
+
+		res, err := repo.BenchSplit(data, n)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to benchmark: %v", err))
+			return exitCode(err)
+		}
+
+		fmt.Fprintln(os.Stdout, res)
+		if n == max {
+			break
+		}
+	}
+
+	if BenchOpts.List {
+		res, err := repo.BenchListChunks()
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to benchmark: %v", err))
+			return exitCode(err)
+		}
+
+		fmt.Fprintln(os.Stdout, res)
+	}
+
+	return 0
+}
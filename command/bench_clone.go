@@ -0,0 +1,116 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var BenchCloneOpts struct {
+	// Directory the repository is cloned into
+	Dir string `long:"dir" description:"clone into this directory and keep it, by default a temporary directory is used and removed afterwards"`
+}
+
+type BenchClone struct {
+	ui cli.Ui
+}
+
+func NewBenchClone() (cmd cli.Command, err error) {
+	return &BenchClone{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *BenchClone) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &BenchCloneOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Clones the repository at <url> and materializes the split files of HEAD,
+  measuring the wall time of each phase: the git clone (including installing
+  git-bits), listing the chunks of the split files, fetching them, combining
+  each file and writing it to disk. The result is written to stdout as json
+  with durations in nanoseconds, such that runs can be compared to find out
+  which phase an optimization should target. The remote is configured from
+  what the repository shares, as a clone would.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *BenchClone) Synopsis() string {
+	return "measure the phases of cloning a repository"
+}
+
+// Usage returns a usage description
+func (cmd *BenchClone) Usage() string {
+	return "git bits bench-clone [options] <url>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *BenchClone) Run(args []string) int {
+	args, err := flags.ParseArgs(&BenchCloneOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected the url of a git repository, got: %v", args))
+		return ExitUsage
+	}
+
+	dir := BenchCloneOpts.Dir
+	if dir == "" {
+		tdir, err := ioutil.TempDir("", "git-bits-bench-clone_")
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to create temporary directory: %v", err))
+			return ExitFailure
+		}
+
+		defer os.RemoveAll(tdir)
+		dir = filepath.Join(tdir, "clone")
+	}
+
+	res, err := bits.BenchClone(context.Background(), args[0], dir, nil)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to benchmark: %v", err))
+		return exitCode(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(res)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to write result: %v", err))
+		return ExitFailure
+	}
+
+	return 0
+}
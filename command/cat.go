@@ -0,0 +1,127 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var CatOpts struct {
+	// Byte range of the original file that will be written
+	Range string `long:"range" description:"only write the byte range '<offset>:<length>' of the original file, the length may be omitted to read until the end"`
+}
+
+type Cat struct {
+	ui cli.Ui
+}
+
+func NewCat() (cmd cli.Command, err error) {
+	return &Cat{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Cat) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &CatOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Cat) Synopsis() string {
+	return "write (part of) a split file in a ref to stdout"
+}
+
+// Usage returns a usage description
+func (cmd *Cat) Usage() string {
+	return "git bits cat [--range <offset>:<length>] <ref> <path>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Cat) Run(args []string) int {
+	args, err := flags.ParseArgs(&CatOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) != 2 {
+		cmd.ui.Error(fmt.Sprintf("expected a ref and a path, got: %v", args))
+		return ExitUsage
+	}
+
+	off, n := int64(0), int64(-1)
+	if CatOpts.Range != "" {
+		off, n, err = parseRange(CatOpts.Range)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("invalid range '%s': %v", CatOpts.Range, err))
+			return ExitUsage
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	err = repo.ReadAt(args[0], args[1], off, n, os.Stdout)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to read: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
+
+//parseRange parses '<offset>:<length>', a missing length is returned as -1
+func parseRange(s string) (off, n int64, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	off, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, fmt.Errorf("offset must be a positive number")
+	}
+
+	if len(parts) < 2 || parts[1] == "" {
+		return off, -1, nil
+	}
+
+	n, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("length must be a positive number")
+	}
+
+	return off, n, nil
+}
@@ -0,0 +1,67 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type CheckRemote struct {
+	ui cli.Ui
+}
+
+func NewCheckRemote() (cmd cli.Command, err error) {
+	return &CheckRemote{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *CheckRemote) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Lists the chunks in the remote and writes, reads and deletes a throwaway
+  probe chunk, reporting the time each step took. Exits with a non-zero
+  status at the first step that fails.
+`, cmd.Synopsis())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *CheckRemote) Synopsis() string {
+	return "verify that the remote can be used for pushing"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *CheckRemote) Run(args []string) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	err = repo.CheckRemote(os.Stdout)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("remote check failed: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,81 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type CheckStaged struct {
+	ui cli.Ui
+}
+
+func NewCheckStaged() (cmd cli.Command, err error) {
+	return &CheckStaged{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *CheckStaged) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Refuses files that are staged with content that starts with the pointer
+  header while the clean filter didn't write it: the path isn't split
+  according to .gitattributes, the filter configuration drifted (see 'git
+  bits doctor') or the pointer doesn't parse, e.g. because it was edited by
+  hand. Committed, others would check out such a pointer as is instead of
+  the content. It is run by the pre-commit hook of clones that are
+  installed with --reject-raw-pointers and exits with %d if files are
+  refused.
+`, cmd.Synopsis(), ExitVerification)
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *CheckStaged) Synopsis() string {
+	return "refuse staged pointers the filter didn't write"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *CheckStaged) Run(args []string) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	raw, err := repo.StagedRawPointers()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to check staged files: %v", err))
+		return exitCode(err)
+	}
+
+	if len(raw) == 0 {
+		return 0
+	}
+
+	for _, r := range raw {
+		cmd.ui.Error(fmt.Sprintf("'%s' holds a pointer that git-bits didn't write: %s", r.Path, r.Reason))
+	}
+
+	cmd.ui.Error(fmt.Sprintf("refusing to commit %d files, run 'git bits doctor --fix' to restore the filter configuration and the content of files, add the 'filter=bits' pattern to .gitattributes or unstage the files with 'git reset -- <path>'", len(raw)))
+	return ExitVerification
+}
@@ -0,0 +1,157 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var CICheckOpts struct {
+	// Format the report is written to stdout in
+	Format string `short:"f" long:"format" default:"text" choice:"text" choice:"json" choice:"junit" description:"format the report is written to stdout in"`
+
+	// Files the report is also written to
+	JUnit string `long:"junit" description:"also write the report as junit xml to this file"`
+	JSON  string `long:"json" description:"also write the report as json to this file"`
+}
+
+type CICheck struct {
+	ui cli.Ui
+}
+
+func NewCICheck() (cmd cli.Command, err error) {
+	return &CICheck{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *CICheck) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &CICheckOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Checks every split file in the tree of <ref> (HEAD by default) for use in
+  CI pipelines: 'reconstructible' checks that all of its chunks are stored
+  locally or remotely, like 'git bits verify-ref', and 'pushed' checks that
+  all of them are stored remotely such that others can check it out. Only
+  the existence of chunks is checked, nothing is downloaded.
+
+  The report is written to stdout as text, json or junit xml and can also be
+  written to files with --junit and --json, for pipelines to show the
+  results of. If any check fails the command exits with the missing chunk
+  exit code (4).
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *CICheck) Synopsis() string {
+	return "check that a ref's chunks are pushed, for ci"
+}
+
+// Usage returns a usage description
+func (cmd *CICheck) Usage() string {
+	return "git bits ci-check [options] [<ref>]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *CICheck) Run(args []string) int {
+	args, err := flags.ParseArgs(&CICheckOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) > 1 {
+		cmd.ui.Error(fmt.Sprintf("expected at most one ref, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	ref := "HEAD"
+	if len(args) == 1 {
+		ref = args[0]
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	report, err := repo.CICheck(ref)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to check '%s': %v", ref, err))
+		return exitCode(err)
+	}
+
+	for format, p := range map[string]string{"junit": CICheckOpts.JUnit, "json": CICheckOpts.JSON} {
+		if p == "" {
+			continue
+		}
+
+		err = writeCIReportFile(p, report, format)
+		if err != nil {
+			cmd.ui.Error(err.Error())
+			return ExitFailure
+		}
+	}
+
+	err = bits.WriteCIReport(os.Stdout, report, CICheckOpts.Format)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to write report: %v", err))
+		return ExitFailure
+	}
+
+	if !report.Passed {
+		return ExitMissingChunk
+	}
+
+	return 0
+}
+
+//writeCIReportFile writes the report to the file at 'p' in 'format'
+func writeCIReportFile(p string, report bits.CIReport, format string) (err error) {
+	f, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("failed to create %s report '%s': %v", format, p, err)
+	}
+
+	err = bits.WriteCIReport(f, report, format)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write %s report '%s': %v", format, p, err)
+	}
+
+	return nil
+}
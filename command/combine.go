@@ -1,13 +1,20 @@
 package command
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 
+	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/cli"
 	"github.com/nerdalize/git-bits/bits"
 )
 
+var CombineOpts struct {
+	// Read and write a stream of files
+	Stream bool `long:"stream" description:"read and write a stream of files instead of the keys of a single file"`
+}
+
 type Combine struct {
 	ui cli.Ui
 }
@@ -26,9 +33,27 @@ func NewCombine() (cmd cli.Command, err error) {
 // usage, a brief few sentences explaining the function of the command,
 // and the complete list of flags the command accepts.
 func (cmd *Combine) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &CombineOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
 	return fmt.Sprintf(`
   %s
-`, cmd.Synopsis())
+
+  With --stream, 'git bits fetch --stream | git bits combine --stream'
+  handles any number of files. Each file is framed as a 'file "<path>"'
+  line, its pointer and an 'end' line. The content of each file is written
+  in the same frame as 'data <n>' lines that are followed by n bytes. A file
+  that fails is terminated with an 'error <message>' line instead of 'end',
+  the stream continues with the next file. 'git bits filter-process' uses a
+  single such stream for a whole checkout.
+
+%s`, cmd.Synopsis(), buf.String())
 }
 
 // Synopsis returns a one-line, short synopsis of the command.
@@ -40,23 +65,44 @@ func (cmd *Combine) Synopsis() string {
 // Run runs the actual command with the given CLI instance and
 // command-line arguments. It returns the exit status when it is
 // finished.
+// Usage returns a usage description
+func (cmd *Combine) Usage() string {
+	return "git bits combine [options]"
+}
+
 func (cmd *Combine) Run(args []string) int {
+	_, err := flags.ParseArgs(&CombineOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("Failed to get working directory: %v", err))
-		return 1
+		return ExitFailure
 	}
 
 	repo, err := bits.NewRepository(wd, os.Stderr)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
-		return 2
+		return exitCode(err)
+	}
+
+	if CombineOpts.Stream {
+		err = repo.CombineStream(os.Stdin, os.Stdout)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to combine stream: %v", err))
+			return exitCode(err)
+		}
+
+		return 0
 	}
 
 	err = repo.Combine(os.Stdin, os.Stdout)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to combine: %v", err))
-		return 3
+		return exitCode(err)
 	}
 
 	return 0
@@ -0,0 +1,118 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var CopyOpts struct {
+	// Remote the chunks are copied from
+	From string `long:"from" description:"remote to copy chunks from" required:"true"`
+
+	// Remote the chunks are copied to
+	To string `long:"to" description:"remote to copy chunks to" required:"true"`
+
+	// Only copy chunks of split files in this ref
+	Ref string `long:"ref" description:"only copy the chunks of split files in this ref"`
+
+	// Number of chunks that are copied in parallel
+	Concurrency int `short:"c" long:"concurrency" description:"number of chunks that are copied in parallel"`
+}
+
+type Copy struct {
+	ui cli.Ui
+}
+
+func NewCopy() (cmd cli.Command, err error) {
+	return &Copy{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Copy) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &CopyOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Remotes are the configured remote (origin) or another bucket that is
+  accessible with the configured credentials (s3://<bucket>). Chunks that
+  the destination already stores are skipped, chunks between buckets of the
+  same provider are copied without downloading them.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Copy) Synopsis() string {
+	return "copy chunks from one remote to another"
+}
+
+// Usage returns a usage description
+func (cmd *Copy) Usage() string {
+	return "git bits copy [options] --from <remote> --to <remote>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Copy) Run(args []string) int {
+	_, err := flags.ParseArgs(&CopyOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	from, err := repo.OpenRemote(CopyOpts.From)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open source remote: %v", err))
+		return exitCode(err)
+	}
+
+	to, err := repo.OpenRemote(CopyOpts.To)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open destination remote: %v", err))
+		return exitCode(err)
+	}
+
+	copied, skipped, err := repo.CopyChunks(from, to, CopyOpts.Ref, CopyOpts.Concurrency)
+	cmd.ui.Info(fmt.Sprintf("copied %d chunks, %d were already stored", copied, skipped))
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to copy chunks: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,161 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var DaemonOpts struct {
+	// Time between checks for newly staged chunks
+	Interval time.Duration `short:"i" long:"interval" default:"10s" description:"time between checks for newly staged chunks (default=10s)"`
+
+	// Record which split files are opened
+	RecordAccess bool `long:"record-access" description:"record which split files in the working tree are opened, such that pulls download them first"`
+
+	// Materialize lazily checked out files when they are opened
+	MaterializeOnOpen bool `long:"materialize-on-open" description:"materialize files that a lazy checkout left as pointers when they are first opened"`
+
+	// Address prometheus metrics are served on
+	MetricsListen string `long:"metrics-listen" description:"address to serve prometheus metrics on at /metrics, e.g. :9476"`
+}
+
+type Daemon struct {
+	ui cli.Ui
+}
+
+func NewDaemon() (cmd cli.Command, err error) {
+	return &Daemon{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Daemon) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &DaemonOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Runs until interrupted, chunks that are uploaded in the background are
+  skipped when the pre-push hook runs.
+
+  With --record-access it also records which split files in the working
+  tree are opened on each branch. 'git bits pull' and 'git bits prefetch'
+  download the files that are opened most on the current branch first,
+  such that the files of a common workflow are available soonest after a
+  checkout. Opens by git itself are not counted. Currently only on linux.
+
+  With --materialize-on-open files that a lazy checkout left as pointers
+  are downloaded when they are first opened, the open waits until the file
+  holds its content. Opens by git itself get the pointer. Currently only on
+  linux, as root or with CAP_SYS_ADMIN.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Daemon) Synopsis() string {
+	return "upload newly staged chunks in the background"
+}
+
+// Usage returns a usage description
+func (cmd *Daemon) Usage() string {
+	return "git bits daemon [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Daemon) Run(args []string) int {
+	args, err := flags.ParseArgs(&DaemonOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	if DaemonOpts.MetricsListen != "" {
+		m, err := serveMetrics(ctx, cmd.ui, DaemonOpts.MetricsListen)
+		if err != nil {
+			cmd.ui.Error(err.Error())
+			return exitCode(err)
+		}
+
+		repo.SetMetrics(m)
+	}
+
+	if DaemonOpts.RecordAccess {
+		done := make(chan struct{})
+		defer func() { cancel(); <-done }()
+		go func() {
+			defer close(done)
+			err := repo.WatchAccess(ctx)
+			if err != nil {
+				cmd.ui.Error(fmt.Sprintf("failed to record file access: %v", err))
+			}
+		}()
+	}
+
+	if DaemonOpts.MaterializeOnOpen {
+		done := make(chan struct{})
+		defer func() { cancel(); <-done }()
+		go func() {
+			defer close(done)
+			err := repo.MaterializeOnOpen(ctx)
+			if err != nil {
+				cmd.ui.Error(fmt.Sprintf("failed to materialize files on open: %v", err))
+			}
+		}()
+	}
+
+	defer serveMonitor(repo)()
+	err = repo.Watch(ctx, DaemonOpts.Interval)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to watch: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
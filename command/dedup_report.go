@@ -0,0 +1,165 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var DedupReportOpts struct {
+	// Report on all branches and tags
+	All bool `long:"all" description:"report on the history of every branch and tag instead of the given refs"`
+
+	// Smallest share that is listed
+	MinShare float64 `long:"min-share" default:"10" description:"only list files that share at least this percentage of their chunks"`
+
+	// Most shares that are listed
+	Top int `long:"top" default:"20" description:"list at most this many file pairs, 0 lists all"`
+}
+
+type DedupReport struct {
+	ui cli.Ui
+}
+
+func NewDedupReport() (cmd cli.Command, err error) {
+	return &DedupReport{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *DedupReport) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &DedupReportOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Scans every version of the split files in the history of the given refs
+  (HEAD by default, any rev-list argument works) and writes to stdout how
+  much deduplication saves: the chunks the files reference against the
+  chunks that are actually stored. It then lists which files share chunks,
+  e.g. "texture_v2.psd shares 83%% of its chunks with texture_v1.psd".
+  Versions of the same path are told apart by their blob.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *DedupReport) Synopsis() string {
+	return "report how chunks are shared between files"
+}
+
+// Usage returns a usage description
+func (cmd *DedupReport) Usage() string {
+	return "git bits dedup-report [options] [<ref>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *DedupReport) Run(args []string) int {
+	args, err := flags.ParseArgs(&DedupReportOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if DedupReportOpts.All && len(args) > 0 {
+		cmd.ui.Error(fmt.Sprintf("expected either refs or --all, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	revs := args
+	if DedupReportOpts.All {
+		revs, err = repo.ScanRefs()
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to list refs: %v", err))
+			return exitCode(err)
+		}
+	} else if len(revs) == 0 {
+		revs = []string{"HEAD"}
+	}
+
+	report, err := repo.DedupReport(revs, DedupReportOpts.MinShare/100)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to report: %v", err))
+		return exitCode(err)
+	}
+
+	fmt.Fprintf(os.Stdout, "files:  %d versions of %d paths\n", report.Files, report.Paths)
+	fmt.Fprintf(os.Stdout, "chunks: %d referenced, %d stored (%s)\n", report.Chunks, report.UniqueChunks, percentage(report.UniqueChunks, report.Chunks))
+	if report.Bytes > 0 {
+		fmt.Fprintf(os.Stdout, "bytes:  %s referenced, %s stored (%s)\n", humanize.Bytes(uint64(report.Bytes)), humanize.Bytes(uint64(report.UniqueBytes)), percentage(int(report.UniqueBytes), int(report.Bytes)))
+	}
+
+	//versions of the same path are told apart by their blob
+	versions := map[string]map[string]bool{}
+	for _, s := range report.Shares {
+		for _, f := range []bits.ScannedFile{s.File, s.Other} {
+			if versions[f.Path] == nil {
+				versions[f.Path] = map[string]bool{}
+			}
+
+			versions[f.Path][f.Blob] = true
+		}
+	}
+
+	name := func(f bits.ScannedFile) string {
+		if len(versions[f.Path]) > 1 || f.Path == "" {
+			return fmt.Sprintf("%s (%s)", f.Path, f.Blob[:7])
+		}
+
+		return f.Path
+	}
+
+	shares := report.Shares
+	if DedupReportOpts.Top > 0 && len(shares) > DedupReportOpts.Top {
+		shares = shares[:DedupReportOpts.Top]
+	}
+
+	for _, s := range shares {
+		fmt.Fprintf(os.Stdout, "%s shares %.0f%% of its chunks with %s\n", name(s.File), s.Share*100, name(s.Other))
+	}
+
+	return 0
+}
+
+//percentage formats 'n' as a percentage of 'total'
+func percentage(n, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+
+	return fmt.Sprintf("%.0f%%", float64(n)/float64(total)*100)
+}
@@ -0,0 +1,168 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type DiffDriver struct {
+	ui cli.Ui
+}
+
+func NewDiffDriver() (cmd cli.Command, err error) {
+	return &DiffDriver{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *DiffDriver) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+Usage:
+  %s
+
+  With a single file it acts as a textconv program and lists the chunks of
+  the file, with the arguments of GIT_EXTERNAL_DIFF it summarizes the change
+  in size and chunks between both versions. Install configures both for the
+  'bits' diff driver, enable it by adding 'diff=bits' in .gitattributes.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *DiffDriver) Synopsis() string {
+	return "describe (changes to) split files for git diff"
+}
+
+// Usage returns a usage description
+func (cmd *DiffDriver) Usage() string {
+	return "git bits diff-driver <file> | <path> <old-file> <old-hex> <old-mode> <new-file> <new-hex> <new-mode>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *DiffDriver) Run(args []string) int {
+	if len(args) != 1 && len(args) < 7 {
+		cmd.ui.Error(fmt.Sprintf("expected a single file or the GIT_EXTERNAL_DIFF arguments, got: %v", args))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	if len(args) == 1 {
+		err = cmd.textconv(repo, args[0], os.Stdout)
+	} else {
+		err = cmd.summarize(repo, args[0], args[1], args[4], os.Stdout)
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to describe: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
+
+//describe returns the pointer for the file at 'p', git hands diff drivers
+//the original content so in most cases the chunk keys are computed here
+func (cmd *DiffDriver) describe(repo *bits.Repository, p string) (ptr *bits.Pointer, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %v", p, err)
+	}
+
+	defer f.Close()
+	ptr, err = repo.Describe(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe '%s': %v", p, err)
+	}
+
+	return ptr, nil
+}
+
+//textconv writes a line based description of the file in 'p' such that
+//git shows which chunks were changed
+func (cmd *DiffDriver) textconv(repo *bits.Repository, p string, w io.Writer) (err error) {
+	ptr, err := cmd.describe(repo, p)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "split file of %s in %d chunks\n", formatSize(ptr.Size()), len(ptr.Chunks))
+	for _, c := range ptr.Chunks {
+		fmt.Fprintf(w, "%x %s\n", c.K, formatSize(c.Size))
+	}
+
+	return nil
+}
+
+//summarize writes the change in size and chunks between the old and new
+//version of a split file at 'path'
+func (cmd *DiffDriver) summarize(repo *bits.Repository, path, oldp, newp string, w io.Writer) (err error) {
+	oldPtr, err := cmd.describe(repo, oldp)
+	if err != nil {
+		return err
+	}
+
+	newPtr, err := cmd.describe(repo, newp)
+	if err != nil {
+		return err
+	}
+
+	d := bits.Delta(oldPtr, newPtr)
+	fmt.Fprintf(w, "diff --git-bits a/%s b/%s\n", path, path)
+	fmt.Fprintf(w, "size: %s -> %s", formatSize(d.OldSize), formatSize(d.NewSize))
+	if d.OldSize >= 0 && d.NewSize >= 0 {
+		fmt.Fprintf(w, " (%s)", formatSizeDelta(d.NewSize-d.OldSize))
+	}
+
+	fmt.Fprintf(w, "\nchunks: %d -> %d, %d added, %d removed", d.OldChunks, d.NewChunks, d.Added, d.Removed)
+	if ratio := d.AddedRatio(); ratio >= 0 {
+		fmt.Fprintf(w, ", %.1f%% of the new file is new data (%s)", ratio*100, humanize.Bytes(uint64(d.AddedSize)))
+	}
+
+	fmt.Fprintf(w, "\n")
+	return nil
+}
+
+//formatSize formats a number of bytes for humans, negative sizes are unknown
+func formatSize(size int64) string {
+	if size < 0 {
+		return "unknown size"
+	}
+
+	return humanize.Bytes(uint64(size))
+}
+
+//formatSizeDelta formats a signed difference in bytes for humans
+func formatSizeDelta(d int64) string {
+	if d < 0 {
+		return "-" + humanize.Bytes(uint64(-d))
+	}
+
+	return "+" + humanize.Bytes(uint64(d))
+}
@@ -0,0 +1,130 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var DoctorOpts struct {
+	// Restore the configuration that drifted
+	Fix bool `long:"fix" description:"restore the filter configuration that drifted and pull the content of files in HEAD"`
+}
+
+type Doctor struct {
+	ui cli.Ui
+}
+
+func NewDoctor() (cmd cli.Command, err error) {
+	return &Doctor{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Doctor) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &DoctorOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Checks that the 'filter.bits.*', 'merge.bits.*' and 'diff.bits.*'
+  settings that 'git bits install' writes are still configured as it
+  wrote them, other tools that rewrite the git configuration may remove or
+  change them. Without them git checks out pointers instead of content and
+  commits whatever is in the working tree as is.
+
+  With --fix the settings are restored and the split files in HEAD are
+  pulled, such that files that were checked out as pointers get their
+  content back. Running 'git bits install' again restores them as well.
+  It exits with %d if settings drifted and were not restored.
+
+%s`, cmd.Synopsis(), ExitConfig, buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Doctor) Synopsis() string {
+	return "check and repair the filter configuration"
+}
+
+// Usage returns a usage description
+func (cmd *Doctor) Usage() string {
+	return "git bits doctor [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Doctor) Run(args []string) int {
+	_, err := flags.ParseArgs(&DoctorOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	if !DoctorOpts.Fix {
+		drift, err := repo.FilterDrift()
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to check the filter configuration: %v", err))
+			return exitCode(err)
+		}
+
+		for _, d := range drift {
+			cmd.ui.Warn(d.String())
+		}
+
+		if len(drift) > 0 {
+			cmd.ui.Error("the filter configuration drifted, restore it with 'git bits doctor --fix'")
+			return ExitConfig
+		}
+
+		cmd.ui.Info("the filter configuration is in order")
+		return 0
+	}
+
+	drift, err := repo.RepairFilter(os.Stderr)
+	for _, d := range drift {
+		cmd.ui.Info(fmt.Sprintf("restored '%s' to '%s'", d.Key, d.Expected))
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to repair the filter configuration: %v", err))
+		return exitCode(err)
+	}
+
+	if len(drift) == 0 {
+		cmd.ui.Info("the filter configuration is in order")
+	}
+
+	return 0
+}
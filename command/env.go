@@ -0,0 +1,80 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type Env struct {
+	ui cli.Ui
+}
+
+func NewEnv() (cmd cli.Command, err error) {
+	return &Env{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Env) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Writes every setting that is in effect to stdout, with the file or other
+  source its value came from: the bits configuration, the remote, where
+  chunks are stored locally and whether the filter and pre-push hook are
+  installed. Secrets are only reported to be set, such that the output can
+  be shared when debugging.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Env) Synopsis() string {
+	return "show the effective configuration"
+}
+
+// Usage returns a usage description
+func (cmd *Env) Usage() string {
+	return "git bits env"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Env) Run(args []string) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	settings, err := repo.Env()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to determine configuration: %v", err))
+		return exitCode(err)
+	}
+
+	for _, s := range settings {
+		fmt.Fprintf(os.Stdout, "%s=%s (%s)\n", s.Name, s.Value, s.Source)
+	}
+
+	return 0
+}
@@ -0,0 +1,136 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var EvictOpts struct {
+	// Keep the local copies of chunks
+	KeepChunks bool `long:"keep-chunks" description:"keep the local copies of the chunks of evicted files"`
+
+	// Restore evicted files instead
+	Restore bool `long:"restore" description:"restore evicted files by pulling their chunks again"`
+}
+
+type Evict struct {
+	ui cli.Ui
+}
+
+func NewEvict() (cmd cli.Command, err error) {
+	return &Evict{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Evict) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &EvictOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Replaces split files (or all split files in directories) with their
+  pointer to free disk space without deleting the clone. Files are marked
+  with 'git update-index --skip-worktree' such that git doesn't consider
+  them modified. Only files that are not modified and of which every chunk
+  is stored remotely are evicted, the local copies of their chunks are
+  removed as well. Restore them with --restore.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Evict) Synopsis() string {
+	return "replace split files with their pointer"
+}
+
+// Usage returns a usage description
+func (cmd *Evict) Usage() string {
+	return "git bits evict [options] <path>..."
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Evict) Run(args []string) int {
+	args, err := flags.ParseArgs(&EvictOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) == 0 {
+		cmd.ui.Error(fmt.Sprintf("expected one or more paths, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	//paths are relative to the working directory, git reports the root of
+	//the working tree with symlinks resolved
+	wd, err = filepath.EvalSymlinks(wd)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to resolve working directory: %v", err))
+		return ExitFailure
+	}
+
+	paths := []string{}
+	for _, arg := range args {
+		if !filepath.IsAbs(arg) {
+			arg = filepath.Join(wd, arg)
+		}
+
+		paths = append(paths, arg)
+	}
+
+	if EvictOpts.Restore {
+		err = repo.Restore(os.Stderr, paths...)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to restore: %v", err))
+			return exitCode(err)
+		}
+
+		return 0
+	}
+
+	freed, err := repo.Evict(os.Stderr, EvictOpts.KeepChunks, paths...)
+	cmd.ui.Info(fmt.Sprintf("freed %s", humanize.Bytes(uint64(freed))))
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to evict: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
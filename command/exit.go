@@ -0,0 +1,62 @@
+package command
+
+import (
+	"github.com/nerdalize/git-bits/bits"
+)
+
+//Exit codes of all commands, such that scripts and CI can react to the
+//kind of failure. Codes are never reused for another meaning.
+const (
+	//ExitOK means the command succeeded
+	ExitOK = 0
+
+	//ExitFailure means the command failed for a reason that isn't
+	//classified, e.g. a git or file system error
+	ExitFailure = 1
+
+	//ExitConfig means the repository isn't setup correctly: it is not a git
+	//repository, the configuration is invalid or no remote is configured
+	ExitConfig = 2
+
+	//ExitNetwork means the remote couldn't be reached
+	ExitNetwork = 3
+
+	//ExitMissingChunk means chunks are needed that aren't stored locally or
+	//remotely
+	ExitMissingChunk = 4
+
+	//ExitVerification means content doesn't match what it should be, e.g. a
+	//corrupt chunk
+	ExitVerification = 5
+
+	//ExitPartial means some items failed while others succeeded, running the
+	//command again retries the failed ones
+	ExitPartial = 6
+
+	//ExitNotConfirmed means the operation needed confirmation that wasn't
+	//given
+	ExitNotConfirmed = 7
+
+	//ExitUsage means the command was called with invalid arguments or flags
+	ExitUsage = 128
+)
+
+//exitCode returns the exit code for the kind of error 'err' is
+func exitCode(err error) int {
+	switch bits.KindOf(err) {
+	case bits.ConfigError:
+		return ExitConfig
+	case bits.NetworkError:
+		return ExitNetwork
+	case bits.MissingChunkError:
+		return ExitMissingChunk
+	case bits.VerificationError:
+		return ExitVerification
+	case bits.PartialError:
+		return ExitPartial
+	case bits.NotConfirmedError:
+		return ExitNotConfirmed
+	default:
+		return ExitFailure
+	}
+}
@@ -1,13 +1,31 @@
 package command
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
+	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/cli"
 	"github.com/nerdalize/git-bits/bits"
 )
 
+var FetchOpts struct {
+	// Retry the chunks that failed to fetch earlier
+	RetryFailed bool `long:"retry-failed" description:"fetch the chunks that failed to fetch earlier instead of reading keys from stdin"`
+
+	// Read and write a stream of files
+	Stream bool `long:"stream" description:"read and write a stream of files instead of the keys of a single file, see 'git bits combine --help'"`
+
+	// Skip the confirmation of large downloads
+	Yes bool `short:"y" long:"yes" description:"don't ask for confirmation when more than 'bits.confirm-threshold' bytes are downloaded"`
+
+	// How progress is reported
+	Progress string `long:"progress" description:"how progress is reported: auto, quiet, plain, tty or json (default: 'bits.progress' or auto)"`
+}
+
 type Fetch struct {
 	ui cli.Ui
 }
@@ -26,9 +44,52 @@ func NewFetch() (cmd cli.Command, err error) {
 // usage, a brief few sentences explaining the function of the command,
 // and the complete list of flags the command accepts.
 func (cmd *Fetch) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &FetchOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
 	return fmt.Sprintf(`
   %s
-`, cmd.Synopsis())
+
+  Up to %d chunks are fetched in parallel, keys are still written in the
+  order they are read such that the output can be piped to 'git bits
+  combine'.
+
+  Chunks that fail to fetch don't stop the others, they are recorded in
+  '.git/chunks/%s' such that they can be retried later.
+
+  When the remote confirms that it doesn't store a chunk, e.g. one that
+  was never pushed, that is remembered for %s ('bits.absent-ttl'): fetching
+  or retrying it within that period fails without asking the remote again.
+
+  With routes configured ('bits.route', e.g. 'release/* <bucket>') keys
+  that follow a 'ref <ref>' line are fetched from the bucket of that ref
+  first. Chunks that a bucket doesn't store are read from the configured
+  remote and the other routed buckets.
+
+  Like pushed chunks, fetched chunks are recorded in the audit log when
+  'bits.audit-log' or 'bits.audit-remote' is configured.
+
+  Like 'bits.push-hook' for pushing, 'bits.fetch-hook' is a command that
+  the content of each downloaded chunk is piped to, chunks it refuses are
+  not stored.
+
+  Processes that need the same chunk at the same time, such as smudge
+  filters that git runs in parallel, download it once: the others wait
+  for it while a '%s' file is next to the chunk.
+
+  When 'bits.confirm-threshold' is configured (e.g. 10GB) and the chunks
+  that are not stored locally hold more bytes than that, it asks on the
+  terminal whether to continue first. As a checkout runs this command for
+  each file, it can be skipped there with:
+  'git -c bits.confirm-threshold=0 checkout'.
+
+%s`, cmd.Synopsis(), bits.FetchConcurrency, bits.FetchRetryFile, bits.AbsentTTL, bits.FetchLockSuffix, buf.String())
 }
 
 // Synopsis returns a one-line, short synopsis of the command.
@@ -37,27 +98,111 @@ func (cmd *Fetch) Synopsis() string {
 	return "fetch chunks from the remote store and save each locally"
 }
 
+// Usage returns a usage description
+func (cmd *Fetch) Usage() string {
+	return "git bits fetch [options]"
+}
+
 // Run runs the actual command with the given CLI instance and
 // command-line arguments. It returns the exit status when it is
 // finished.
 func (cmd *Fetch) Run(args []string) int {
+	_, err := flags.ParseArgs(&FetchOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
-		return 1
+		return ExitFailure
 	}
 
 	repo, err := bits.NewRepository(wd, os.Stderr)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
-		return 2
+		return exitCode(err)
 	}
 
-	err = repo.Fetch(os.Stdin, os.Stdout)
+	defer repo.Close()
+	defer serveMonitor(repo)()
+	err = setProgress(repo, FetchOpts.Progress)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if FetchOpts.RetryFailed {
+		fetched, remaining, err := repo.RetryFailedFetches()
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to retry: %v", err))
+			return exitCode(err)
+		}
+
+		cmd.ui.Info(fmt.Sprintf("fetched %d chunks, %d remaining", fetched, remaining))
+		if fetched > 0 {
+			cmd.ui.Info("run 'git bits pull' to restore the original content of affected files")
+		}
+
+		return 0
+	}
+
+	if FetchOpts.Stream {
+		err = repo.FetchStream(os.Stdin, os.Stdout)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to fetch stream: %v", err))
+			return exitCode(err)
+		}
+
+		return 0
+	}
+
+	var keys io.Reader = os.Stdin
+	if !FetchOpts.Yes {
+		var chunks int
+		var size int64
+		keys, chunks, size, err = repo.FetchSize(os.Stdin)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to read keys: %v", err))
+			return exitCode(err)
+		}
+
+		err = repo.ConfirmDownload(chunks, size, confirmOnTerminal)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to fetch: %v", err))
+			return exitCode(err)
+		}
+	}
+
+	err = repo.Fetch(keys, os.Stdout)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to fetch: %v", err))
-		return 3
+		return exitCode(err)
 	}
 
 	return 0
 }
+
+//confirmOnTerminal asks the question on the terminal, stdin and stdout may
+//be used by git. It is not confirmed if no terminal is available.
+func confirmOnTerminal(question string) bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+
+	defer tty.Close()
+	ui := &cli.BasicUi{Reader: tty, Writer: tty, ErrorWriter: tty}
+	answer, err := ui.Ask(question + " [y/N]")
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,77 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type FilterProcess struct {
+	ui cli.Ui
+}
+
+func NewFilterProcess() (cmd cli.Command, err error) {
+	return &FilterProcess{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *FilterProcess) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Git starts this once per command (e.g. a checkout) when it is configured
+  as 'filter.bits.process', which 'git bits install' does. It splits files
+  like 'git bits split' and smudges all pointers through a single fetch and
+  combine stream (see 'git bits combine --help'), instead of starting a
+  'git bits fetch | git bits combine' pipeline for every file. Versions of
+  git without support for it keep using 'filter.bits.smudge'.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *FilterProcess) Synopsis() string {
+	return "clean and smudge files for git in a single process"
+}
+
+// Usage returns a usage description
+func (cmd *FilterProcess) Usage() string {
+	return "git bits filter-process"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *FilterProcess) Run(args []string) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	err = repo.FilterProcess(os.Stdin, os.Stdout)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to run filter process: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
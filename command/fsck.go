@@ -0,0 +1,114 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var FsckOpts struct {
+	// Check the chunks in the remote
+	Remote bool `long:"remote" description:"check chunks in the remote that are referenced by local branches and tags"`
+
+	// Percentage of chunks that is checked
+	Sample float64 `long:"sample" default:"100" description:"percentage of chunks that is randomly selected and checked"`
+
+	// Number of chunks that are checked in parallel
+	Concurrency int `short:"c" long:"concurrency" description:"number of chunks that are checked in parallel"`
+}
+
+type Fsck struct {
+	ui cli.Ui
+}
+
+func NewFsck() (cmd cli.Command, err error) {
+	return &Fsck{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Fsck) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &FsckOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Chunks are decrypted and their content is hashed to check it matches
+  their key. Without --remote the chunks in the local chunk directory are
+  checked. Downloading every chunk of a large bucket is impractical, with
+  --sample only that percentage is checked and the number of bad chunks in
+  the whole bucket is estimated from it. Bad chunks are written to stdout,
+  the command exits with a non-zero status if there are any.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Fsck) Synopsis() string {
+	return "verify the content of (a sample of) chunks"
+}
+
+// Usage returns a usage description
+func (cmd *Fsck) Usage() string {
+	return "git bits fsck [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Fsck) Run(args []string) int {
+	_, err := flags.ParseArgs(&FsckOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	report, err := repo.Fsck(os.Stdout, FsckOpts.Remote, FsckOpts.Sample, FsckOpts.Concurrency)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to check chunks: %v", err))
+		return exitCode(err)
+	}
+
+	cmd.ui.Info(fmt.Sprintf("checked %d of %d chunks: %d corrupt, %d missing", report.Checked, report.Total, report.Corrupt, report.Missing))
+	if report.Checked < report.Total {
+		bad, upper := report.Estimate()
+		cmd.ui.Info(fmt.Sprintf("estimated bad chunks: %.0f (at most %.0f with 95%% confidence)", bad, upper))
+	}
+
+	if report.Bad() > 0 {
+		return ExitVerification
+	}
+
+	return 0
+}
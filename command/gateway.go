@@ -0,0 +1,143 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var GatewayOpts struct {
+	// Address the gateway listens on
+	Listen string `short:"l" long:"listen" default:"127.0.0.1:7476" description:"address to serve the s3 api on (default=127.0.0.1:7476)"`
+
+	// Name of the bucket
+	Bucket string `short:"b" long:"bucket" default:"bits" description:"name of the bucket the chunks are served in (default=bits)"`
+
+	// Serve plain-text content
+	Decrypt bool `long:"decrypt" description:"serve the decrypted content of chunks instead of the encrypted chunks"`
+}
+
+type Gateway struct {
+	ui cli.Ui
+}
+
+func NewGateway() (cmd cli.Command, err error) {
+	return &Gateway{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Gateway) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &GatewayOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Serves the chunks of the files in the tree of <ref> (HEAD by default)
+  over a minimal S3-compatible API until interrupted, such that tools that
+  only speak S3 can read them. The chunks are the objects of a single
+  bucket, named by their hex key: they are listed with ListObjects(V2) and
+  read with GetObject or HeadObject. Chunks that are not stored locally are
+  fetched from the remote when they are read. Chunks are served encrypted,
+  as stored in the remote, unless --decrypt is given.
+
+  The gateway is read-only and doesn't authenticate requests, it listens
+  on localhost unless another address is given with --listen.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Gateway) Synopsis() string {
+	return "serve the chunks of a ref over an s3 api"
+}
+
+// Usage returns a usage description
+func (cmd *Gateway) Usage() string {
+	return "git bits gateway [options] [<ref>]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Gateway) Run(args []string) int {
+	args, err := flags.ParseArgs(&GatewayOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) > 1 {
+		cmd.ui.Error(fmt.Sprintf("expected at most one ref, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	ref := "HEAD"
+	if len(args) == 1 {
+		ref = args[0]
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	gw, err := bits.NewGateway(repo, ref, GatewayOpts.Bucket, GatewayOpts.Decrypt)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup gateway: %v", err))
+		return exitCode(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	l, err := net.Listen("tcp", GatewayOpts.Listen)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to listen on '%s': %v", GatewayOpts.Listen, err))
+		return exitCode(err)
+	}
+
+	cmd.ui.Info(fmt.Sprintf("serving %d chunks of '%s' in bucket '%s' on %s", gw.Len(), ref, GatewayOpts.Bucket, l.Addr()))
+	err = gw.Serve(ctx, l)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to serve: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,116 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var GCOpts struct {
+	// Only list the chunks that would be removed
+	DryRun bool `short:"n" long:"dry-run" description:"only list the chunks that would be removed"`
+
+	// How long recently split chunks are kept
+	Grace time.Duration `long:"grace" default:"1h" description:"keep chunks that were split or referenced more recently than this"`
+}
+
+type GC struct {
+	ui cli.Ui
+}
+
+func NewGC() (cmd cli.Command, err error) {
+	return &GC{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *GC) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &GCOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Splitting and scanning record which blobs reference each chunk. Chunks of
+  which git removed all referencing blobs, e.g. with 'git gc' after their
+  branches were deleted, are removed from the local chunk directory without
+  walking the history again. Chunks that were never split or scanned in this
+  clone are kept, run 'git bits scan' on all refs to record them. Chunks
+  that are staged but not pushed are never removed, 'git bits status'
+  lists them.
+
+  With 'bits.cache-ttl' set to a number of days, chunks that weren't used
+  for that long are removed as well if the remote stores them, such that
+  caches (e.g. of build agents) stay bounded. The keys of removed chunks
+  are written to stdout.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *GC) Synopsis() string {
+	return "remove local chunks that are no longer referenced"
+}
+
+// Usage returns a usage description
+func (cmd *GC) Usage() string {
+	return "git bits gc [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *GC) Run(args []string) int {
+	_, err := flags.ParseArgs(&GCOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	bits.GCGracePeriod = GCOpts.Grace
+	removed, freed, err := repo.GC(os.Stdout, GCOpts.DryRun)
+	if GCOpts.DryRun {
+		cmd.ui.Info(fmt.Sprintf("would remove %d chunks (%s)", removed, humanize.Bytes(uint64(freed))))
+	} else {
+		cmd.ui.Info(fmt.Sprintf("removed %d chunks (%s)", removed, humanize.Bytes(uint64(freed))))
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to collect garbage: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
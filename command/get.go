@@ -0,0 +1,121 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var GetOpts struct {
+	// Write the decrypted content instead of the path
+	Decrypt bool `long:"decrypt" description:"write the decrypted content of the chunk to stdout instead of its path"`
+
+	// Replace the local copy
+	Force bool `short:"f" long:"force" description:"fetch the chunk again even if it is stored locally, e.g. when it is corrupt"`
+}
+
+type Get struct {
+	ui cli.Ui
+}
+
+func NewGet() (cmd cli.Command, err error) {
+	return &Get{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Get) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &GetOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Fetches the chunk with the given hex key into the local chunk directory,
+  unless it is stored there already, and writes its local path to stdout.
+  The chunk is verified against its key: a corrupt chunk exits with a
+  verification error, --force replaces it with a fresh copy from the
+  remote. With --decrypt the plain-text content of the chunk is written
+  instead, e.g. to recover part of a file by hand.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Get) Synopsis() string {
+	return "fetch a single chunk by its key"
+}
+
+// Usage returns a usage description
+func (cmd *Get) Usage() string {
+	return "git bits get [options] <key>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Get) Run(args []string) int {
+	args, err := flags.ParseArgs(&GetOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a single key, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	c, err := bits.ParseKeyLine([]byte(args[0]))
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("invalid key '%s': %v", args[0], err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	if GetOpts.Decrypt {
+		_, err = repo.Get(c.Version, c.K, GetOpts.Force, os.Stdout)
+	} else {
+		var p string
+		p, err = repo.Get(c.Version, c.K, GetOpts.Force, nil)
+		if err == nil {
+			fmt.Fprintln(os.Stdout, p)
+		}
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,97 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var IndexExportOpts struct {
+	// Format the index is written in
+	Format string `short:"f" long:"format" default:"json" choice:"json" choice:"csv" description:"format the index is written in"`
+}
+
+type IndexExport struct {
+	ui cli.Ui
+}
+
+func NewIndexExport() (cmd cli.Command, err error) {
+	return &IndexExport{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *IndexExport) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &IndexExportOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Writes every chunk this clone knows of to stdout: chunks stored locally,
+  recorded in the index of the remote or referenced by split and scanned
+  files. Each has its size, whether it is stored locally and remotely, the
+  number of blobs that reference it and the oldest commit that did, e.g.
+  for storage cost dashboards and audits.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *IndexExport) Synopsis() string {
+	return "export all known chunks as json or csv"
+}
+
+// Usage returns a usage description
+func (cmd *IndexExport) Usage() string {
+	return "git bits index export [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *IndexExport) Run(args []string) int {
+	_, err := flags.ParseArgs(&IndexExportOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	err = repo.ExportIndex(os.Stdout, IndexExportOpts.Format)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to export index: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
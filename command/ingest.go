@@ -0,0 +1,147 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var IngestOpts struct {
+	// Directory pointer files are written to
+	Out string `short:"o" long:"out" description:"write the pointer of each file to the same path in this directory instead of a stream on stdout"`
+}
+
+type Ingest struct {
+	ui cli.Ui
+}
+
+func NewIngest() (cmd cli.Command, err error) {
+	return &Ingest{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Ingest) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &IngestOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Splits every file below the directory into the local chunk directory as
+  git's clean filter would, without adding the files to git. It is meant
+  for pre-seeding the chunk caches of build farms with files that are
+  committed elsewhere: run it in a clone of the repository such that files
+  are split with its deduplication scope. Git directories and symlinks are
+  skipped.
+
+  The pointers of the files are written to stdout as a stream of file
+  frames (see 'git bits combine --help'), or with --out as pointer files at
+  the same paths in another directory. The chunks are staged until they
+  are pushed, e.g. with 'git bits push < <pointer file>'.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Ingest) Synopsis() string {
+	return "split the files of a directory into chunks"
+}
+
+// Usage returns a usage description
+func (cmd *Ingest) Usage() string {
+	return "git bits ingest [options] <dir>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Ingest) Run(args []string) int {
+	args, err := flags.ParseArgs(&IngestOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a directory, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to resolve '%s': %v", args[0], err))
+		return ExitUsage
+	}
+
+	out := ""
+	if IngestOpts.Out != "" {
+		out, err = filepath.Abs(IngestOpts.Out)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to resolve '%s': %v", IngestOpts.Out, err))
+			return ExitUsage
+		}
+
+		//pointers that are written would be ingested as well
+		if rel, err := filepath.Rel(dir, out); err == nil && !strings.HasPrefix(rel, "..") {
+			cmd.ui.Error(fmt.Sprintf("the output directory can't be inside '%s'", args[0]))
+			return ExitUsage
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	files, size, err := repo.Ingest(dir, func(p string, ptr []byte) error {
+		if out == "" {
+			return bits.WriteStreamFile(os.Stdout, p, ptr)
+		}
+
+		dst := filepath.Join(out, filepath.FromSlash(p))
+		err := os.MkdirAll(filepath.Dir(dst), 0777)
+		if err != nil {
+			return fmt.Errorf("failed to create directory for '%s': %v", p, err)
+		}
+
+		return ioutil.WriteFile(dst, ptr, 0666)
+	})
+
+	cmd.ui.Info(fmt.Sprintf("ingested %d files (%s)", files, humanize.Bytes(uint64(size))))
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to ingest: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
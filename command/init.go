@@ -0,0 +1,96 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var InitOpts struct {
+	// Name of the s3 bucket that chunks of the remote are stored in
+	Bucket string `short:"b" long:"bucket" required:"true" description:"name of the s3 bucket used as a chunk remote"`
+
+	// Git remote that the bucket stores chunks for
+	Remote string `short:"r" long:"remote" default:"origin" description:"git remote that will be configured for chunk storage (default=origin)"`
+}
+
+type Init struct {
+	ui cli.Ui
+}
+
+func NewInit() (cmd cli.Command, err error) {
+	return &Init{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Init) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &InitOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Init) Synopsis() string {
+	return "installs with a bucket for a remote, never asks"
+}
+
+// Usage returns a usage description
+func (cmd *Init) Usage() string {
+	return "git bits init --bucket <bucket> [--remote <remote>]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Init) Run(args []string) int {
+	args, err := flags.ParseArgs(&InitOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	err = repo.Init(os.Stdout, InitOpts.Remote, InitOpts.Bucket)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to init: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,92 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits/bitstest"
+)
+
+func TestInit(t *testing.T) {
+	ctx := context.Background()
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+
+	owd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Chdir(owd)
+	err = os.Chdir(wd1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]string{"AWS_ACCESS_KEY_ID": "my-access-key", "AWS_SECRET_ACCESS_KEY": "my-secret"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	config := func(key string) string {
+		buf := bytes.NewBuffer(nil)
+		err := repo1.Git(ctx, nil, buf, "config", "--get", key)
+		if err != nil {
+			t.Fatalf("expected '%s' to be configured, got: %v", key, err)
+		}
+
+		return strings.TrimSpace(buf.String())
+	}
+
+	//without a terminal every question fails, nothing may be asked
+	noTTY := func() *cli.MockUi {
+		return &cli.MockUi{
+			InputReader:  bytes.NewReader(nil),
+			OutputWriter: bytes.NewBuffer(nil),
+			ErrorWriter:  bytes.NewBuffer(nil),
+		}
+	}
+
+	ui := noTTY()
+	exit := (&Init{ui: ui}).Run([]string{"--remote", "upstream", "--bucket", "my-bucket"})
+	if exit != ExitConfig {
+		t.Errorf("expected init for a remote that doesn't exist to exit with %d, got: %d", ExitConfig, exit)
+	}
+
+	ui = noTTY()
+	exit = (&Init{ui: ui}).Run([]string{"--remote", "origin", "--bucket", "my-bucket"})
+	if exit != ExitOK {
+		t.Fatalf("expected init to succeed, got: %d: %s", exit, ui.ErrorWriter.String())
+	}
+
+	for key, exp := range map[string]string{
+		"bits.aws-s3-bucket-name":    "my-bucket",
+		"bits.remote":                "origin",
+		"bits.aws-access-key-id":     "my-access-key",
+		"bits.aws-secret-access-key": "my-secret",
+		"filter.bits.clean":          "git bits split",
+	} {
+		if val := config(key); val != exp {
+			t.Errorf("expected '%s' to be '%s', got: '%s'", key, exp, val)
+		}
+	}
+
+	//install doesn't ask for what the flags and environment provide
+	ui = noTTY()
+	exit = (&Install{ui: ui}).Run([]string{"--bucket", "other-bucket"})
+	if exit != ExitOK {
+		t.Fatalf("expected install to succeed, got: %d: %s", exit, ui.ErrorWriter.String())
+	}
+
+	if ui.OutputWriter.String() != "" {
+		t.Errorf("expected install not to ask anything, got: %s", ui.OutputWriter.String())
+	}
+
+	if val := config("bits.aws-s3-bucket-name"); val != "other-bucket" {
+		t.Errorf("expected install to configure 'other-bucket', got: '%s'", val)
+	}
+}
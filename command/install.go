@@ -14,8 +14,32 @@ var InstallOpts struct {
 	// Name of the s3 bucket that will be configured for the remote
 	Bucket string `short:"b" long:"bucket" description:"name of the s3 bucket used as a chunk remote"`
 
+	// Replicas of the bucket that chunks can be read from
+	Replica []string `long:"replica" description:"replica of the bucket as '<bucket>' or '<endpoint>/<bucket>', can be repeated in order of preference"`
+
 	// Chunk remote will be configured for configuration under this remote
 	Remote string `short:"r" long:"remote" default:"origin" required:"true" description:"git remote that will be configured for chunk storage (default=origin)"`
+
+	// Shared polynomial for repositories that should deduplicate across each other
+	DeduplicationScope string `long:"deduplication-scope" description:"polynomial that files are split with, share it across repositories that should deduplicate chunks (default: random)"`
+
+	// Name of the repository in a bucket that it shares with others
+	SharedRepository string `long:"shared-repository" description:"name of the repository in a bucket that is shared with other repositories, e.g. 'design/game-assets'"`
+
+	// Hash that keys of new chunks are computed with
+	KeyHash string `long:"key-hash" default:"sha256" choice:"sha256" choice:"blake3" description:"hash that keys of new chunks are computed with"`
+
+	// Never write to the chunk remote from this clone
+	ReadOnly bool `long:"readonly" description:"never push chunks from this clone, no pre-push hook is installed"`
+
+	// Refuse commits of pointers that the filter didn't write
+	RejectRawPointers bool `long:"reject-raw-pointers" description:"make the pre-commit hook refuse files that hold a pointer which the clean filter didn't write"`
+
+	// Leave pointers of files whose chunks aren't stored locally
+	Lazy bool `long:"lazy" description:"make checkouts leave the pointers of files of which the chunks are not stored locally"`
+
+	// Encrypt the key lists of new pointers
+	SealPointers bool `long:"seal-pointers" description:"encrypt the key lists of new pointers with a generated 'bits.pointer-key'"`
 }
 
 type Install struct {
@@ -54,12 +78,12 @@ func (cmd *Install) Help() string {
 // Synopsis returns a one-line, short synopsis of the command.
 // This should be less than 50 characters ideally.
 func (cmd *Install) Synopsis() string {
-	return "configures filters, create pre-push hook and pull chunks"
+	return "configures filters, create hooks and pull chunks"
 }
 
 // Usage returns a usage description
 func (cmd *Install) Usage() string {
-	return "git bits init"
+	return "git bits install"
 }
 
 // Run runs the actual command with the given CLI instance and
@@ -69,44 +93,92 @@ func (cmd *Install) Run(args []string) int {
 	args, err := flags.ParseArgs(&InstallOpts, args)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
-		return 1
+		return ExitUsage
 	}
 
 	wd, err := os.Getwd()
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
-		return 2
+		return ExitFailure
 	}
 
 	repo, err := bits.NewRepository(wd, os.Stderr)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
-		return 3
+		return exitCode(err)
 	}
 
 	conf := bits.DefaultConf()
-	conf.AWSS3BucketName, err = cmd.ui.Ask("In which AWS S3 bucket would you like to store chunks? \n")
+	conf.KeyHash, err = bits.ParseKeyHash(InstallOpts.KeyHash)
 	if err != nil {
-		cmd.ui.Error(fmt.Sprintf("failed to get input: %v", err))
-		return 128
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
 	}
 
-	conf.AWSAccessKeyID, err = cmd.ui.Ask("What is your AWS Access Key ID with list, read and write access to the above bucket? \n")
-	if err != nil {
-		cmd.ui.Error(fmt.Sprintf("failed to get input: %v", err))
-		return 128
+	conf.ReadOnly = InstallOpts.ReadOnly
+	conf.RejectRawPointers = InstallOpts.RejectRawPointers
+	conf.Lazy = InstallOpts.Lazy
+	conf.AWSS3Replicas = InstallOpts.Replica
+	if InstallOpts.SharedRepository != "" {
+		conf.SharedRepository, err = bits.ParseSharedRepository(InstallOpts.SharedRepository)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+			return ExitUsage
+		}
 	}
 
-	conf.AWSSecretAccessKey, err = cmd.ui.AskSecret("What is your AWS Secret Key that autorizes the above access key? (input will be hidden)\n")
-	if err != nil {
-		cmd.ui.Error(fmt.Sprintf("failed to get input: %v", err))
-		return 128
+	if InstallOpts.SealPointers {
+		conf.PointerKey, err = bits.NewPointerKey()
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to setup pointer key: %v", err))
+			return ExitFailure
+		}
+	}
+
+	//without a scope the one recorded in the repository is used, or a random one
+	conf.DeduplicationScope = 0
+	if InstallOpts.DeduplicationScope != "" {
+		conf.DeduplicationScope, err = bits.ParseDeduplicationScope(InstallOpts.DeduplicationScope)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+			return ExitUsage
+		}
+	}
+
+	//values that flags or the environment provide aren't asked for, such
+	//that installing works without a terminal
+	conf.Remote = InstallOpts.Remote
+	conf.AWSS3BucketName = InstallOpts.Bucket
+	if conf.AWSS3BucketName == "" {
+		conf.AWSS3BucketName, err = cmd.ui.Ask("In which AWS S3 bucket would you like to store chunks? \n")
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to get input: %v", err))
+			return exitCode(err)
+		}
+	}
+
+	conf.AWSAccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	if conf.AWSAccessKeyID == "" {
+		conf.AWSAccessKeyID, err = cmd.ui.Ask("What is your AWS Access Key ID with list, read and write access to the above bucket? \n")
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to get input: %v", err))
+			return exitCode(err)
+		}
+	}
+
+	conf.AWSSecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if conf.AWSSecretAccessKey == "" {
+		conf.AWSSecretAccessKey, err = cmd.ui.AskSecret("What is your AWS Secret Key that autorizes the above access key? (input will be hidden)\n")
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to get input: %v", err))
+			return exitCode(err)
+		}
 	}
 
 	err = repo.Install(os.Stdout, conf)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to fetch: %v", err))
-		return 4
+		return exitCode(err)
 	}
 
 	return 0
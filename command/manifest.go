@@ -0,0 +1,152 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var ManifestOpts struct {
+	// Key the manifest is signed with
+	Key string `short:"k" long:"key" description:"ssh key the manifest is signed with (default=git config user.signingkey)"`
+
+	// File the manifest is written to
+	Output string `short:"o" long:"output" description:"file the manifest is written to (default=<tag>.manifest), the signature is written next to it with a .sig suffix"`
+}
+
+type Manifest struct {
+	ui cli.Ui
+}
+
+func NewManifest() (cmd cli.Command, err error) {
+	return &Manifest{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Manifest) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &ManifestOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Writes a manifest of the release at <tag>: the keys and sizes of all
+  chunks of the split files in its tree, and signs it with an ssh key the
+  way git signs commits with 'gpg.format=ssh'. Publish the manifest and its
+  signature with the release, those who download the dataset prove it
+  matches with 'git bits verify-manifest'.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Manifest) Synopsis() string {
+	return "write a signed manifest of a tag's chunks"
+}
+
+// Usage returns a usage description
+func (cmd *Manifest) Usage() string {
+	return "git bits manifest [options] <tag>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Manifest) Run(args []string) int {
+	args, err := flags.ParseArgs(&ManifestOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a single tag, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	key := ManifestOpts.Key
+	if key == "" {
+		key = gitConfig(repo, "user.signingkey")
+	}
+
+	if key == "" {
+		cmd.ui.Error("no key to sign the manifest with, provide one with --key or configure git's user.signingkey")
+		return ExitConfig
+	}
+
+	output := ManifestOpts.Output
+	if output == "" {
+		output = strings.Replace(args[0], "/", "-", -1) + ".manifest"
+	}
+
+	m, err := repo.Manifest(args[0])
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to list chunks: %v", err))
+		return exitCode(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	m.WriteTo(buf)
+	sig, err := bits.SignManifest(buf.Bytes(), key)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return exitCode(err)
+	}
+
+	err = ioutil.WriteFile(output, buf.Bytes(), 0666)
+	if err == nil {
+		err = ioutil.WriteFile(output+bits.ManifestSignatureSuffix, sig, 0666)
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to write manifest: %v", err))
+		return ExitFailure
+	}
+
+	cmd.ui.Info(fmt.Sprintf("wrote manifest of %d chunks of '%s' to '%s' and its signature to '%s'", len(m.Chunks), m.Tag, output, output+bits.ManifestSignatureSuffix))
+	return 0
+}
+
+//gitConfig returns the value of git configuration 'key', empty if not set
+func gitConfig(repo *bits.Repository, key string) string {
+	buf := bytes.NewBuffer(nil)
+	err := repo.Git(nil, nil, buf, "config", "--get", key)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(buf.String())
+}
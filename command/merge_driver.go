@@ -0,0 +1,178 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var MergeDriverOpts struct {
+	// Never ask which side to keep, leave conflicts to the user
+	NoPrompt bool `long:"no-prompt" description:"don't ask which side to keep when the pointers conflict"`
+}
+
+type MergeDriver struct {
+	ui cli.Ui
+
+	//ask prompts which side of a conflict in the file at 'path' is kept, ok
+	//is false if the user didn't pick a side
+	ask func(path string) (theirs bool, ok bool)
+}
+
+func NewMergeDriver() (cmd cli.Command, err error) {
+	return &MergeDriver{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+		ask: askTTY,
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *MergeDriver) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &MergeDriverOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Configured by install as the 'bits' merge driver, enable it for split
+  files by adding 'merge=bits' next to 'filter=bits' in .gitattributes.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *MergeDriver) Synopsis() string {
+	return "merge conflicting versions of a split file"
+}
+
+// Usage returns a usage description
+func (cmd *MergeDriver) Usage() string {
+	return "git bits merge-driver <base> <ours> <theirs> [<path>]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *MergeDriver) Run(args []string) int {
+	args, err := flags.ParseArgs(&MergeDriverOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) < 3 {
+		cmd.ui.Error(fmt.Sprintf("expected base, ours and theirs files, got: %v", args))
+		return ExitUsage
+	}
+
+	path := args[1]
+	if len(args) > 3 {
+		path = args[3]
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	files := []*os.File{}
+	for _, p := range args[:3] {
+		f, err := os.Open(p)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to open '%s': %v", p, err))
+			return exitCode(err)
+		}
+
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	//git expects the result of the merge to be written to our side
+	buf := bytes.NewBuffer(nil)
+	err = repo.Merge(files[0], files[1], files[2], buf)
+	if err == bits.ErrMergeConflict {
+		theirs, ok := false, false
+		if !MergeDriverOpts.NoPrompt {
+			theirs, ok = cmd.ask(path)
+		}
+
+		if !ok {
+			cmd.ui.Error(fmt.Sprintf("%s: %v, keeping our version; use 'git checkout --ours' or 'git checkout --theirs' to pick a side", path, err))
+			return ExitFailure
+		}
+
+		if !theirs {
+			return 0
+		}
+
+		_, err = files[2].Seek(0, 0)
+		if err == nil {
+			buf.Reset()
+			_, err = buf.ReadFrom(files[2])
+		}
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to merge '%s': %v", path, err))
+		return exitCode(err)
+	}
+
+	err = ioutil.WriteFile(args[1], buf.Bytes(), 0666)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to write merge result: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
+
+//askTTY prompts on the terminal which side of a conflict should be kept, ok
+//is false if no terminal is available or the user didn't pick a side
+func askTTY(path string) (theirs bool, ok bool) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, false
+	}
+
+	defer tty.Close()
+	ui := &cli.BasicUi{Reader: tty, Writer: tty, ErrorWriter: tty}
+	answer, err := ui.Ask(fmt.Sprintf("both sides changed '%s' and the changes cannot be combined, keep [o]urs or [t]heirs? (anything else leaves a conflict)", path))
+	if err != nil {
+		return false, false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "o", "ours":
+		return false, true
+	case "t", "theirs":
+		return true, true
+	}
+
+	return false, false
+}
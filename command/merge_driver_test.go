@@ -0,0 +1,123 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+	"github.com/nerdalize/git-bits/bits/bitstest"
+)
+
+func TestMergeDriver(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	bitstest.BuildBinaryInPath(t, ctx)
+
+	remote1 := bitstest.GitInitRemote(t)
+	wd1, repo1 := bitstest.GitCloneWorkspace(remote1, t)
+	err := repo1.Install(os.Stderr, bits.DefaultConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Chdir(owd)
+	err = os.Chdir(wd1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the base is changed differently on both sides, which is a conflict
+	pointers := [][]byte{}
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 1024*1024)
+		_, err = rand.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(data), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pointers = append(pointers, buf.Bytes())
+	}
+
+	for _, c := range []struct {
+		name     string
+		noPrompt bool
+		theirs   bool
+		ok       bool
+		asked    bool
+		exit     int
+		exp      []byte
+	}{
+		{"no side picked", false, false, false, true, ExitFailure, pointers[1]},
+		{"ours picked", false, false, true, true, ExitOK, pointers[1]},
+		{"theirs picked", false, true, true, true, ExitOK, pointers[2]},
+		{"no prompt", true, true, true, false, ExitFailure, pointers[1]},
+	} {
+		paths := []string{}
+		for i, name := range []string{"base", "ours", "theirs"} {
+			p := filepath.Join(wd1, ".git", name)
+			err = ioutil.WriteFile(p, pointers[i], 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			paths = append(paths, p)
+		}
+
+		asked := false
+		cmd := &MergeDriver{
+			ui: &cli.MockUi{},
+			ask: func(path string) (theirs bool, ok bool) {
+				if path != "file1.bin" {
+					t.Errorf("%s: expected to be asked about 'file1.bin', got: '%s'", c.name, path)
+				}
+
+				asked = true
+				return c.theirs, c.ok
+			},
+		}
+
+		args := paths
+		if c.noPrompt {
+			args = append([]string{"--no-prompt"}, args...)
+		}
+
+		exit := cmd.Run(append(args, "file1.bin"))
+		MergeDriverOpts.NoPrompt = false
+		if exit != c.exit {
+			t.Errorf("%s: expected exit code %d, got: %d", c.name, c.exit, exit)
+		}
+
+		if asked != c.asked {
+			t.Errorf("%s: expected asked to be %v, got: %v", c.name, c.asked, asked)
+		}
+
+		res, err := ioutil.ReadFile(paths[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(res, c.exp) {
+			t.Errorf("%s: expected our side to hold '%s', got: '%s'", c.name, c.exp, res)
+		}
+	}
+}
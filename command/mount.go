@@ -0,0 +1,140 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var MountOpts struct {
+	// Number of chunks fetched ahead of reads
+	Readahead int `short:"r" long:"readahead" default:"2" description:"number of chunks fetched in the background after each read (default=2)"`
+
+	// Serve the tree over nfs instead of mounting it
+	NFS string `long:"nfs" description:"serve the tree over NFSv3 on this address (e.g. 127.0.0.1:2049) instead of mounting it, for mounting it with the nfs client of the system"`
+}
+
+type Mount struct {
+	ui cli.Ui
+}
+
+func NewMount() (cmd cli.Command, err error) {
+	return &Mount{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Mount) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &MountOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Split files show their original content, chunks are fetched when they
+  are first read. Runs until interrupted or until the directory is
+  unmounted. Uses FUSE on linux, the nfs client on macOS and ProjFS on
+  Windows, elsewhere serve the tree with --nfs and mount it with the nfs
+  client yourself.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Mount) Synopsis() string {
+	return "mount a ref as a read-only filesystem"
+}
+
+// Usage returns a usage description
+func (cmd *Mount) Usage() string {
+	return "git bits mount [options] <ref> [<dir>]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Mount) Run(args []string) int {
+	args, err := flags.ParseArgs(&MountOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if MountOpts.NFS != "" && len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a ref to serve, got: %v", args))
+		return ExitUsage
+	}
+
+	if MountOpts.NFS == "" && len(args) != 2 {
+		cmd.ui.Error(fmt.Sprintf("expected a ref and a directory to mount it on, got: %v", args))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	bits.MountReadahead = MountOpts.Readahead
+	if MountOpts.NFS != "" {
+		l, err := net.Listen("tcp", MountOpts.NFS)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to listen on '%s': %v", MountOpts.NFS, err))
+			return ExitFailure
+		}
+
+		cmd.ui.Info(fmt.Sprintf("serving '%s' over nfs on %s, mount '/' with port and mountport %d", args[0], l.Addr(), l.Addr().(*net.TCPAddr).Port))
+		err = repo.ServeNFS(ctx, args[0], l)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to serve: %v", err))
+			return exitCode(err)
+		}
+
+		return 0
+	}
+
+	err = repo.Mount(ctx, args[0], args[1])
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to mount: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,98 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var PrefetchOpts struct {
+	// Number of chunks that are fetched in parallel
+	Concurrency int `short:"c" long:"concurrency" description:"number of chunks that are fetched in parallel"`
+}
+
+type Prefetch struct {
+	ui cli.Ui
+}
+
+func NewPrefetch() (cmd cli.Command, err error) {
+	return &Prefetch{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Prefetch) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &PrefetchOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Paths are relative to the root of the repository.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Prefetch) Synopsis() string {
+	return "fetch all chunks of split files in a ref ahead of checkout"
+}
+
+// Usage returns a usage description
+func (cmd *Prefetch) Usage() string {
+	return "git bits prefetch [options] <ref> [<path>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Prefetch) Run(args []string) int {
+	args, err := flags.ParseArgs(&PrefetchOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) < 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a ref to prefetch, got: %v", args))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	err = repo.Prefetch(args[0], args[1:], PrefetchOpts.Concurrency)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to prefetch: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
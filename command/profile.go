@@ -0,0 +1,81 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+)
+
+//StartProfiling takes the global --cpuprofile and --memprofile flags from
+//'args' and starts writing a cpu profile if asked for. The returned 'stop'
+//finishes the cpu profile and writes the memory profile, it must be called
+//before exiting.
+func StartProfiling(args []string) (rest []string, stop func(), err error) {
+	cpu, mem := "", ""
+	for i := 0; i < len(args); i++ {
+		var dst *string
+		name := args[i]
+		switch {
+		case name == "--cpuprofile" || strings.HasPrefix(name, "--cpuprofile="):
+			dst = &cpu
+		case name == "--memprofile" || strings.HasPrefix(name, "--memprofile="):
+			dst = &mem
+		default:
+			rest = append(rest, name)
+			continue
+		}
+
+		if idx := strings.Index(name, "="); idx >= 0 {
+			*dst = name[idx+1:]
+		} else if i+1 < len(args) {
+			i++
+			*dst = args[i]
+		}
+
+		if *dst == "" {
+			return nil, nil, fmt.Errorf("expected a file path for '%s'", strings.SplitN(name, "=", 2)[0])
+		}
+	}
+
+	var cpuf *os.File
+	if cpu != "" {
+		cpuf, err = os.Create(cpu)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create cpu profile: %v", err)
+		}
+
+		err = pprof.StartCPUProfile(cpuf)
+		if err != nil {
+			cpuf.Close()
+			return nil, nil, fmt.Errorf("failed to start cpu profile: %v", err)
+		}
+	}
+
+	stop = func() {
+		if cpuf != nil {
+			pprof.StopCPUProfile()
+			cpuf.Close()
+		}
+
+		if mem == "" {
+			return
+		}
+
+		memf, err := os.Create(mem)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create memory profile: %v\n", err)
+			return
+		}
+
+		defer memf.Close()
+		runtime.GC()
+		err = pprof.WriteHeapProfile(memf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write memory profile: %v\n", err)
+		}
+	}
+
+	return rest, stop, nil
+}
@@ -0,0 +1,24 @@
+package command
+
+import (
+	"os"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+//setProgress makes the repository report progress on stderr with the sink
+//that was picked with a --progress flag, the configured one is kept if no
+//sink was picked
+func setProgress(repo *bits.Repository, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	sink, err := bits.NewProgressSink(name, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	repo.SetProgress(sink)
+	return nil
+}
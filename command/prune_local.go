@@ -0,0 +1,129 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var PruneLocalOpts struct {
+	// Only list the chunks that would be removed
+	DryRun bool `short:"n" long:"dry-run" description:"only list the chunks that would be removed"`
+
+	// Refs of which the chunks are kept
+	KeepRef []string `long:"keep-ref" description:"keep the chunks of refs that match this glob (e.g. 'refs/heads/main'), can be repeated, adds to 'bits.prune-keep-ref'"`
+
+	// Keep the chunks of recently updated refs
+	KeepDays int `long:"keep-days" default:"-1" description:"keep the chunks of refs committed or tagged in this many days, overrides 'bits.prune-keep-days'"`
+
+	// How long recently used chunks are kept
+	Grace time.Duration `long:"grace" default:"1h" description:"keep chunks that were used more recently than this"`
+}
+
+type PruneLocal struct {
+	ui cli.Ui
+}
+
+func NewPruneLocal() (cmd cli.Command, err error) {
+	return &PruneLocal{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *PruneLocal) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &PruneLocalOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Removes local chunks by policy instead of by reachability: the chunks of
+  the files in HEAD are always kept, as are those of the branches, remote
+  branches and tags that the policy selects. Refs are selected by glob
+  with --keep-ref or 'bits.prune-keep-ref' (comma separated) and by age
+  with --keep-days or 'bits.prune-keep-days', e.g. to keep HEAD and every
+  ref committed in the last 30 days:
+
+    git config bits.prune-keep-days 30
+    git bits prune-local
+
+  Other chunks are only removed if the index confirms the remote stores
+  them. Chunks that are staged but not pushed are never removed. The keys
+  of removed chunks are written to stdout.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *PruneLocal) Synopsis() string {
+	return "remove local chunks that the policy doesn't keep"
+}
+
+// Usage returns a usage description
+func (cmd *PruneLocal) Usage() string {
+	return "git bits prune-local [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *PruneLocal) Run(args []string) int {
+	_, err := flags.ParseArgs(&PruneLocalOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	pol := repo.PrunePolicy()
+	pol.KeepRefs = append(pol.KeepRefs, PruneLocalOpts.KeepRef...)
+	if PruneLocalOpts.KeepDays >= 0 {
+		pol.KeepUpdated = time.Duration(PruneLocalOpts.KeepDays) * 24 * time.Hour
+	}
+
+	bits.GCGracePeriod = PruneLocalOpts.Grace
+	removed, freed, err := repo.PruneLocal(os.Stdout, pol, PruneLocalOpts.DryRun)
+	if PruneLocalOpts.DryRun {
+		cmd.ui.Info(fmt.Sprintf("would remove %d chunks (%s)", removed, humanize.Bytes(uint64(freed))))
+	} else {
+		cmd.ui.Info(fmt.Sprintf("removed %d chunks (%s)", removed, humanize.Bytes(uint64(freed))))
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to prune: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,125 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var PruneRemoteOpts struct {
+	// Only list the chunks that would be moved
+	DryRun bool `short:"n" long:"dry-run" description:"only list the chunks that would be moved to, restored from or deleted from the trash"`
+
+	// How long chunks are kept in the trash
+	TrashPeriod time.Duration `long:"trash-period" default:"168h" description:"delete chunks that were in the trash for longer than this"`
+}
+
+type PruneRemote struct {
+	ui cli.Ui
+}
+
+func NewPruneRemote() (cmd cli.Command, err error) {
+	return &PruneRemote{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *PruneRemote) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &PruneRemoteOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Removes the chunks from the remote that no branch, remote branch or tag
+  references, in two phases. Chunks are first moved to the 'trash/' prefix
+  of the bucket and are only deleted by a later run once they were there
+  for the trash period. Chunks in the trash that are referenced again, e.g.
+  because a machine with a stale index pushed a branch without uploading
+  them, are restored. Fetch first such that the branches of others are
+  known:
+
+    git fetch --all
+    git bits prune-remote
+
+  Chunks that are moved are written to stdout, prefixed with 'trash',
+  'restore' or 'purge'.
+
+  Repositories that were installed with --shared-repository keep the chunks
+  that the other repositories in the bucket reference as well, according to
+  the shared index that their pushes record. Pruning also compacts the
+  objects that list the chunks of this repository into one.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *PruneRemote) Synopsis() string {
+	return "remove unreferenced chunks from the remote"
+}
+
+// Usage returns a usage description
+func (cmd *PruneRemote) Usage() string {
+	return "git bits prune-remote [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *PruneRemote) Run(args []string) int {
+	_, err := flags.ParseArgs(&PruneRemoteOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	bits.RemoteTrashPeriod = PruneRemoteOpts.TrashPeriod
+	report, err := repo.PruneRemote(os.Stdout, PruneRemoteOpts.DryRun)
+	if PruneRemoteOpts.DryRun {
+		cmd.ui.Info(fmt.Sprintf("would trash %d, restore %d and purge %d chunks", report.Trashed, report.Restored, report.Purged))
+	} else {
+		cmd.ui.Info(fmt.Sprintf("trashed %d, restored %d and purged %d chunks", report.Trashed, report.Restored, report.Purged))
+	}
+
+	if report.Shared > 0 {
+		cmd.ui.Info(fmt.Sprintf("kept %d chunks that only other repositories in the bucket reference", report.Shared))
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to prune the remote: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
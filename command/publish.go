@@ -0,0 +1,128 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var PublishOpts struct {
+	// Remote the chunks are published to
+	To string `long:"to" description:"public bucket to publish chunks to, e.g. s3://<bucket>" required:"true"`
+
+	// Url the chunks are read from anonymously
+	URL string `long:"url" description:"http(s) url of the bucket or cdn path that the chunks are read from anonymously, recorded in .bitsconfig"`
+
+	// Number of chunks that are published in parallel
+	Concurrency int `short:"c" long:"concurrency" description:"number of chunks that are uploaded in parallel"`
+}
+
+type Publish struct {
+	ui cli.Ui
+}
+
+func NewPublish() (cmd cli.Command, err error) {
+	return &Publish{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Publish) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &PublishOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Uploads the chunks of the split files in the given refs to a bucket that
+  allows anonymous reads (e.g. through a bucket policy or a cdn), such that
+  external users can clone and check out a public dataset without any
+  credentials. Chunks are uploaded as they are stored, encrypted with the
+  hash of their content: anyone who can read the pointers in the published
+  refs can decrypt them, those who can only read the bucket can't.
+
+  With --url the url the chunks are read from is recorded in .bitsconfig,
+  commit it with the refs. Clones that don't configure a bucket of their
+  own then fetch chunks anonymously from 'bits.public-url' and can't push.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Publish) Synopsis() string {
+	return "publish the chunks of refs for public reading"
+}
+
+// Usage returns a usage description
+func (cmd *Publish) Usage() string {
+	return "git bits publish [options] --to <remote> <ref>..."
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Publish) Run(args []string) int {
+	args, err := flags.ParseArgs(&PublishOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) < 1 {
+		cmd.ui.Error(fmt.Sprintf("expected at least one ref, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	to, err := repo.OpenRemote(PublishOpts.To)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open destination remote: %v", err))
+		return exitCode(err)
+	}
+
+	published, skipped, err := repo.Publish(to, args, PublishOpts.Concurrency)
+	cmd.ui.Info(fmt.Sprintf("published %d chunks, %d were already published", published, skipped))
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to publish chunks: %v", err))
+		return exitCode(err)
+	}
+
+	if PublishOpts.URL != "" {
+		err = repo.SharePublicURL(os.Stderr, PublishOpts.URL)
+		if err != nil {
+			cmd.ui.Error(err.Error())
+			return ExitFailure
+		}
+	}
+
+	return 0
+}
@@ -1,13 +1,35 @@
 package command
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 
+	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/cli"
 	"github.com/nerdalize/git-bits/bits"
 )
 
+var PullOpts struct {
+	// Skip the confirmation of large downloads
+	Yes bool `short:"y" long:"yes" description:"don't ask for confirmation when more than 'bits.confirm-threshold' bytes are downloaded"`
+
+	// Only pull files that match
+	Include []string `long:"include" description:"only pull files of which the path or name matches this glob, can be repeated"`
+
+	// Don't pull files that match
+	Exclude []string `long:"exclude" description:"don't pull files of which the path or name matches this glob, can be repeated"`
+
+	// Also fetch the chunks of files outside the sparse checkout
+	IgnoreSparse bool `long:"ignore-sparse" description:"also fetch the chunks of files outside the sparse checkout, they are not written to the working tree"`
+
+	// Number of chunks fetched ahead of the content that is written
+	Readahead int `short:"r" long:"readahead" default:"8" description:"number of chunks fetched in the background after the one that is written (default=8)"`
+
+	// How progress is reported
+	Progress string `long:"progress" description:"how progress is reported: auto, quiet, plain, tty or json (default: 'bits.progress' or auto)"`
+}
+
 type Pull struct {
 	ui cli.Ui
 }
@@ -26,9 +48,44 @@ func NewPull() (cmd cli.Command, err error) {
 // usage, a brief few sentences explaining the function of the command,
 // and the complete list of flags the command accepts.
 func (cmd *Pull) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &PullOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
 	return fmt.Sprintf(`
   %s
-`, cmd.Synopsis())
+
+  Split files in the trees of the given refs (HEAD if there are none) are
+  pulled, a file that is in multiple refs is pulled once. Files in the
+  working tree are only written if they hold the pointer of the ref, of
+  other files (e.g. of a branch that isn't checked out) only the chunks are
+  fetched. Files can be selected with '--include' and '--exclude' globs
+  (e.g. '*.bin' or 'assets/*.psd'), globs without a slash also match the
+  file name.
+
+  In a sparse checkout (see 'git sparse-checkout') files outside of it are
+  skipped. With '--ignore-sparse' the chunks of those files are fetched as
+  well, such that widening the checkout doesn't need the remote.
+
+  Chunks of each file are fetched in file order and its content is written
+  into the working tree as they arrive, with '--readahead' chunks being
+  fetched ahead. Tools that read the start or tail of a large file (e.g. to
+  preview a video) can therefore start before it is completely pulled. If
+  a chunk fails to fetch the pointer is put back.
+
+  After each split file it reports how many of the files and how many of
+  the bytes that are not stored locally were pulled.
+
+  When 'bits.confirm-threshold' is configured (e.g. 10GB) and the chunks
+  that are not stored locally hold more bytes than that, it shows how many
+  chunks and bytes will be downloaded and asks whether to continue first.
+
+%s`, cmd.Synopsis(), buf.String())
 }
 
 // Synopsis returns a one-line, short synopsis of the command.
@@ -37,31 +94,67 @@ func (cmd *Pull) Synopsis() string {
 	return "fetch chunks for split files in the working tree and combine"
 }
 
+// Usage returns a usage description
+func (cmd *Pull) Usage() string {
+	return "git bits pull [options] [<ref>...]"
+}
+
 // Run runs the actual command with the given CLI instance and
 // command-line arguments. It returns the exit status when it is
 // finished.
 func (cmd *Pull) Run(args []string) int {
+	args, err := flags.ParseArgs(&PullOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
-		return 1
+		return ExitFailure
 	}
 
 	repo, err := bits.NewRepository(wd, os.Stderr)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
-		return 2
+		return exitCode(err)
 	}
 
-	ref := "HEAD"
-	if len(args) > 0 {
-		ref = args[0]
+	defer repo.Close()
+	defer serveMonitor(repo)()
+	err = setProgress(repo, PullOpts.Progress)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	sel := bits.PullSelection{Refs: args, Include: PullOpts.Include, Exclude: PullOpts.Exclude, IgnoreSparse: PullOpts.IgnoreSparse}
+	err = sel.CheckPatterns()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if !PullOpts.Yes {
+		chunks, size, err := repo.PullSize(sel)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to determine download size: %v", err))
+			return exitCode(err)
+		}
+
+		err = repo.ConfirmDownload(chunks, size, confirmOnTerminal)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to pull: %v", err))
+			return exitCode(err)
+		}
 	}
 
-	err = repo.Pull(ref, os.Stdout)
+	bits.MaterializeReadahead = PullOpts.Readahead
+	err = repo.Pull(sel, os.Stdout)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to scan: %v", err))
-		return 3
+		return exitCode(err)
 	}
 
 	return 0
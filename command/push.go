@@ -1,13 +1,24 @@
 package command
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 
+	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/cli"
 	"github.com/nerdalize/git-bits/bits"
 )
 
+var PushOpts struct {
+	// Push the chunks of all branches and tags instead of those on stdin
+	All bool `long:"all" description:"push the chunks of every local branch and tag instead of the keys on stdin"`
+
+	// How progress is reported
+	Progress string `long:"progress" description:"how progress is reported: auto, quiet, plain, tty or json (default: 'bits.progress' or auto)"`
+}
+
 type Push struct {
 	ui cli.Ui
 }
@@ -26,9 +37,40 @@ func NewPush() (cmd cli.Command, err error) {
 // usage, a brief few sentences explaining the function of the command,
 // and the complete list of flags the command accepts.
 func (cmd *Push) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &PushOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
 	return fmt.Sprintf(`
   %s
-`, cmd.Synopsis())
+
+  Keys are read from stdin, once all chunks are pushed the scanned commits
+  are recorded such that the next scan for the remote (origin by default)
+  stops there. Use --all to seed a new remote with the chunks of the whole
+  repository.
+
+  Chunks of refs that match a route are pushed to the bucket of that route
+  instead of the configured remote. Routes are configured in git or in
+  '.bitsconfig' (such that every clone routes alike), e.g.:
+  'git config --add bits.route "release/* archive-bucket"'. Patterns are
+  matched against the pushed ref with and without its 'refs/heads/' or
+  'refs/tags/' prefix, the first route that matches is used.
+
+  Pushed chunks are recorded with who pushed them when 'bits.audit-log' (a
+  file, relative to the git directory) or 'bits.audit-remote' (objects under
+  '%s' in the bucket) is configured.
+
+  With 'bits.push-hook' configured the plain-text content of each chunk is
+  piped to that command before it is uploaded, with the key and operation
+  in GIT_BITS_CHUNK and GIT_BITS_OP. Chunks of which the command exits
+  non-zero (e.g. because a virus scanner flagged them) are not pushed.
+
+%s`, cmd.Synopsis(), bits.AuditPrefix, buf.String())
 }
 
 // Synopsis returns a one-line, short synopsis of the command.
@@ -37,33 +79,73 @@ func (cmd *Push) Synopsis() string {
 	return "push locally stored chunks to the remote store"
 }
 
+// Usage returns a usage description
+func (cmd *Push) Usage() string {
+	return "git bits push [options] [<remote>]"
+}
+
 // Run runs the actual command with the given CLI instance and
 // command-line arguments. It returns the exit status when it is
 // finished.
 func (cmd *Push) Run(args []string) int {
+	args, err := flags.ParseArgs(&PushOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	remote := "origin"
+	if len(args) > 0 {
+		remote = args[0]
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
-		return 1
+		return ExitFailure
 	}
 
 	repo, err := bits.NewRepository(wd, os.Stderr)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
-		return 2
+		return exitCode(err)
+	}
+
+	defer repo.Close()
+	defer serveMonitor(repo)()
+	err = setProgress(repo, PushOpts.Progress)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	//the scan that writes our input uses the local store as well, only open
+	//it once the scan is done
+	keys := []byte{}
+	if !PushOpts.All {
+		keys, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to read keys: %v", err))
+			return exitCode(err)
+		}
 	}
 
 	store, err := repo.LocalStore()
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
-		return 3
+		return exitCode(err)
 	}
 
 	defer store.Close()
-	err = repo.Push(store, os.Stdin, "origin")
+	if PushOpts.All {
+		err = repo.PushAll(store, remote)
+	} else {
+		err = repo.Push(store, bytes.NewReader(keys), remote)
+	}
+
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to push: %v", err))
-		return 3
+		return exitCode(err)
 	}
 
 	return 0
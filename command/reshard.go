@@ -0,0 +1,111 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var ReshardOpts struct {
+	// Remote whose chunks are moved
+	Remote string `long:"remote" description:"remote to move chunks in, the configured remote if not given"`
+
+	// Number of chunks that are moved in parallel
+	Concurrency int `short:"c" long:"concurrency" description:"number of chunks that are moved in parallel"`
+}
+
+type Reshard struct {
+	ui cli.Ui
+}
+
+func NewReshard() (cmd cli.Command, err error) {
+	return &Reshard{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Reshard) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &ReshardOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  With 'bits.key-shard-depth' configured (e.g. in '%s') chunks are stored
+  under names that are prefixed with that many levels of directories, e.g.
+  'ab/cd/<key>' for a depth of 2. This moves chunks that are stored under
+  names of another depth, such as the flat names of existing buckets.
+  Chunks that can't be found under their sharded name are read from their
+  flat name, such that clones keep working while the bucket is moved.
+
+%s`, cmd.Synopsis(), bits.SharedConfFile, buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Reshard) Synopsis() string {
+	return "move chunks to the configured shard depth"
+}
+
+// Usage returns a usage description
+func (cmd *Reshard) Usage() string {
+	return "git bits reshard [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Reshard) Run(args []string) int {
+	_, err := flags.ParseArgs(&ReshardOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	var remote bits.Remote
+	if ReshardOpts.Remote != "" {
+		remote, err = repo.OpenRemote(ReshardOpts.Remote)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to open remote: %v", err))
+			return exitCode(err)
+		}
+	}
+
+	moved, err := repo.ReshardChunks(remote, ReshardOpts.Concurrency)
+	cmd.ui.Info(fmt.Sprintf("moved %d chunks", moved))
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to reshard chunks: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -1,13 +1,29 @@
 package command
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 
+	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/cli"
 	"github.com/nerdalize/git-bits/bits"
 )
 
+var ScanOpts struct {
+	// Scan all history instead of stopping at commits that were pushed before
+	Full bool `long:"full" description:"scan all history, also of commits that were pushed before"`
+
+	// Treat the arguments as rev-list arguments
+	Revs bool `long:"revs" description:"scan the commits that the arguments select as git rev-list arguments instead of reading them from stdin"`
+
+	// Only report chunks introduced after this date
+	Since string `long:"since" description:"only scan commits after this date (e.g. '2024-07-01' or '3 months ago') and report chunks introduced since, implies --revs"`
+
+	// Leave out the history of these refs
+	Not []string `long:"not" description:"don't scan the history of this ref, can be repeated, implies --revs"`
+}
+
 type Scan struct {
 	ui cli.Ui
 }
@@ -26,9 +42,34 @@ func NewScan() (cmd cli.Command, err error) {
 // usage, a brief few sentences explaining the function of the command,
 // and the complete list of flags the command accepts.
 func (cmd *Scan) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &ScanOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
 	return fmt.Sprintf(`
   %s
-`, cmd.Synopsis())
+
+  Commits are read from stdin in the format of the pre-push hook or as
+  refs. Scanning stops at commits that were pushed to the remote (origin by
+  default) before, use --full when the remote lost chunks.
+
+  With --revs, --since or --not the arguments select the commits that are
+  scanned as git rev-list arguments instead (HEAD if there are none), e.g.
+  to list the chunks that were introduced this quarter or in a release:
+
+    git bits scan --since 2024-07-01 -- --all
+    git bits scan --not v1.0 v2.0
+
+  Options of git rev-list are passed after '--'. With --since, chunks of
+  files that the commits before the date already held are not reported.
+  The keys can be fed into e.g. 'git bits push' or 'git bits fetch'.
+
+%s`, cmd.Synopsis(), buf.String())
 }
 
 // Synopsis returns a one-line, short synopsis of the command.
@@ -37,20 +78,31 @@ func (cmd *Scan) Synopsis() string {
 	return "queries the git database for all chunk keys in blobs"
 }
 
+// Usage returns a usage description
+func (cmd *Scan) Usage() string {
+	return "git bits scan [options] [<remote> | <rev-list argument>...]"
+}
+
 // Run runs the actual command with the given CLI instance and
 // command-line arguments. It returns the exit status when it is
 // finished.
 func (cmd *Scan) Run(args []string) int {
+	args, err := flags.ParseArgs(&ScanOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
-		return 1
+		return ExitFailure
 	}
 
 	repo, err := bits.NewRepository(wd, os.Stderr)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
-		return 2
+		return exitCode(err)
 	}
 
 	// if len(args) < 1 {
@@ -58,10 +110,30 @@ func (cmd *Scan) Run(args []string) int {
 	// 	return 128
 	// }
 
-	err = repo.ScanEach(os.Stdin, os.Stdout)
+	if ScanOpts.Revs || ScanOpts.Since != "" || len(ScanOpts.Not) > 0 {
+		revs := args
+		if len(revs) == 0 {
+			revs = []string{"HEAD"}
+		}
+
+		err = repo.ScanRevs(revs, ScanOpts.Since, ScanOpts.Not, os.Stdout)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to scan: %v", err))
+			return exitCode(err)
+		}
+
+		return 0
+	}
+
+	remote := "origin"
+	if len(args) > 0 {
+		remote = args[0]
+	}
+
+	err = repo.ScanEach(os.Stdin, os.Stdout, remote, ScanOpts.Full)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to scan: %v", err))
-		return 3
+		return exitCode(err)
 	}
 
 	// right := args[0]
@@ -0,0 +1,158 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var ServeOpts struct {
+	// Address the chunk server listens on
+	Listen string `short:"l" long:"listen" default:":7474" description:"address to serve chunks on (default=:7474)"`
+
+	// Don't announce the server on the local network
+	NoAnnounce bool `long:"no-announce" description:"don't announce the server to peers using mdns"`
+
+	// Address prometheus metrics are served on
+	MetricsListen string `long:"metrics-listen" description:"address to serve prometheus metrics on at /metrics, e.g. :9474"`
+}
+
+type Serve struct {
+	ui cli.Ui
+}
+
+func NewServe() (cmd cli.Command, err error) {
+	return &Serve{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Serve) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &ServeOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Serves locally stored chunks to peers on the local network until
+  interrupted. Peers ask for chunks before the remote when they are listed
+  in 'bits.peers' or when 'bits.peer-discovery' is enabled. Chunks are
+  served encrypted, only peers that know a chunk's key can read it.
+
+  Chunks are fetched with GET /chunks/<key> and stored with PUT on the same
+  path, stored chunks must hash to their key. Storing requires a bearer
+  token with the 'write' scope and once any token is issued fetching
+  requires one with the 'read' scope, see 'git bits token issue'. Request
+  counts, bytes sent and received and how often asked for chunks are stored
+  locally can be scraped by prometheus with --metrics-listen.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Serve) Synopsis() string {
+	return "serve local chunks to peers on the network"
+}
+
+// Usage returns a usage description
+func (cmd *Serve) Usage() string {
+	return "git bits daemon [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Serve) Run(args []string) int {
+	args, err := flags.ParseArgs(&ServeOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	l, err := net.Listen("tcp", ServeOpts.Listen)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to listen on '%s': %v", ServeOpts.Listen, err))
+		return exitCode(err)
+	}
+
+	if ServeOpts.MetricsListen != "" {
+		m, err := serveMetrics(ctx, cmd.ui, ServeOpts.MetricsListen)
+		if err != nil {
+			cmd.ui.Error(err.Error())
+			return exitCode(err)
+		}
+
+		repo.SetMetrics(m)
+	}
+
+	cmd.ui.Info(fmt.Sprintf("serving chunks on %s", l.Addr()))
+	err = repo.Serve(ctx, l, !ServeOpts.NoAnnounce)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to serve: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
+
+//serveMetrics serves prometheus metrics on 'addr' until the context is
+//cancelled and returns the metrics that are served
+func serveMetrics(ctx context.Context, ui cli.Ui, addr string) (m *bits.Metrics, err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on '%s' for metrics: %v", addr, err)
+	}
+
+	m = bits.NewMetrics()
+	go func() {
+		err := bits.ServeMetrics(ctx, l, m)
+		if err != nil {
+			ui.Error(fmt.Sprintf("failed to serve metrics: %v", err))
+		}
+	}()
+
+	ui.Info(fmt.Sprintf("serving metrics on %s%s", l.Addr(), bits.MetricsPath))
+	return m, nil
+}
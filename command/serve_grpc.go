@@ -0,0 +1,147 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var ServeGRPCOpts struct {
+	// Address the chunk service listens on
+	Listen string `short:"l" long:"listen" default:":7475" description:"address to serve the chunk service on (default=:7475)"`
+
+	// Directory the chunks are stored in
+	Dir string `short:"d" long:"dir" description:"directory the chunks are stored in" required:"true"`
+
+	// Token clients must send
+	Token string `long:"token" env:"GIT_BITS_GRPC_TOKEN" description:"bearer token that clients must send"`
+
+	// Certificate and key for serving tls
+	TLSCert string `long:"tls-cert" description:"pem file with the certificate to serve tls with"`
+	TLSKey  string `long:"tls-key" description:"pem file with the private key of the certificate"`
+
+	// Address prometheus metrics are served on
+	MetricsListen string `long:"metrics-listen" description:"address to serve prometheus metrics on at /metrics, e.g. :9475"`
+}
+
+type ServeGRPC struct {
+	ui cli.Ui
+}
+
+func NewServeGRPC() (cmd cli.Command, err error) {
+	return &ServeGRPC{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *ServeGRPC) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &ServeGRPCOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Stores chunks in a directory and serves them with the grpc chunk service
+  until interrupted. Repositories use it as their remote when
+  'bits.grpc-address' is configured, with 'bits.grpc-token' and
+  'bits.grpc-plaintext' for servers that require a token or don't serve
+  tls. The service is defined in bits/chunkpb/chunks.proto, such that it can
+  also be implemented in front of other storage.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *ServeGRPC) Synopsis() string {
+	return "serve a directory of chunks over grpc"
+}
+
+// Usage returns a usage description
+func (cmd *ServeGRPC) Usage() string {
+	return "git bits serve-grpc [options] --dir <directory>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *ServeGRPC) Run(args []string) int {
+	_, err := flags.ParseArgs(&ServeGRPCOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	remote, err := bits.NewDirRemote(ServeGRPCOpts.Dir)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup chunk directory: %v", err))
+		return exitCode(err)
+	}
+
+	var tlsConf *tls.Config
+	if ServeGRPCOpts.TLSCert != "" || ServeGRPCOpts.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(ServeGRPCOpts.TLSCert, ServeGRPCOpts.TLSKey)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to load tls certificate: %v", err))
+			return ExitConfig
+		}
+
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	l, err := net.Listen("tcp", ServeGRPCOpts.Listen)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to listen on '%s': %v", ServeGRPCOpts.Listen, err))
+		return exitCode(err)
+	}
+
+	srv := bits.NewGRPCChunkServer(remote, ServeGRPCOpts.Token)
+	if ServeGRPCOpts.MetricsListen != "" {
+		m, err := serveMetrics(ctx, cmd.ui, ServeGRPCOpts.MetricsListen)
+		if err != nil {
+			cmd.ui.Error(err.Error())
+			return exitCode(err)
+		}
+
+		srv.SetMetrics(m)
+	}
+
+	cmd.ui.Info(fmt.Sprintf("serving chunks in '%s' on %s", ServeGRPCOpts.Dir, l.Addr()))
+	err = srv.Serve(ctx, l, tlsConf)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to serve: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
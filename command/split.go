@@ -28,7 +28,17 @@ func NewSplit() (cmd cli.Command, err error) {
 func (cmd *Split) Help() string {
 	return fmt.Sprintf(`
   %s
-`, cmd.Synopsis())
+
+  Content smaller than 1MiB that looks like text (e.g. source code matched
+  by a '* filter=bits' pattern) is split with a warning, as git can no
+  longer show its diffs while it doesn't deduplicate. Configure
+  'bits.text-check' as 'error' to refuse splitting it or 'off' to skip
+  the check.
+
+  Keys are written as chunks complete rather than once the whole file is
+  split, they are flushed every %s such that git (and the long-running
+  filter process) receives them continuously.
+`, cmd.Synopsis(), bits.SplitFlushInterval)
 }
 
 // Synopsis returns a one-line, short synopsis of the command.
@@ -44,19 +54,19 @@ func (cmd *Split) Run(args []string) int {
 	wd, err := os.Getwd()
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("Failed to get working directory: %v", err))
-		return 1
+		return ExitFailure
 	}
 
 	repo, err := bits.NewRepository(wd, os.Stderr)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
-		return 2
+		return exitCode(err)
 	}
 
 	err = repo.Split(os.Stdin, os.Stdout)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to split: %v", err))
-		return 3
+		return exitCode(err)
 	}
 
 	return 0
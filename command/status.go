@@ -0,0 +1,83 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type Status struct {
+	ui cli.Ui
+}
+
+func NewStatus() (cmd cli.Command, err error) {
+	return &Status{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Status) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Chunks in the local chunk directory are either staged: split in this
+  clone but not pushed yet, or cached: copies of chunks that the remote
+  stores. Staged chunks are only stored in the .git directory and would be
+  lost if it was removed, it warns about them until they are pushed. 'git
+  bits gc' never removes staged chunks.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Status) Synopsis() string {
+	return "show staged and cached chunks"
+}
+
+// Usage returns a usage description
+func (cmd *Status) Usage() string {
+	return "git bits status"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Status) Run(args []string) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	status, err := repo.Status()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to determine status: %v", err))
+		return exitCode(err)
+	}
+
+	fmt.Fprintf(os.Stdout, "staged: %d chunks (%s)\n", status.Staged, humanize.Bytes(uint64(status.StagedSize)))
+	fmt.Fprintf(os.Stdout, "cached: %d chunks (%s)\n", status.Cached, humanize.Bytes(uint64(status.CachedSize)))
+	if status.Staged > 0 {
+		cmd.ui.Warn(fmt.Sprintf("warning: %d chunks (%s) are not pushed, they would be lost if the .git directory was removed", status.Staged, humanize.Bytes(uint64(status.StagedSize))))
+	}
+
+	return 0
+}
@@ -0,0 +1,129 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var TierOpts struct {
+	// Only list the chunks that would be moved
+	DryRun bool `short:"n" long:"dry-run" description:"only list the chunks that would be moved"`
+
+	// How old tags must be
+	OlderThan string `long:"older-than" default:"1y" description:"move the chunks of tags that were created longer ago than this, e.g. 1y, 90d or 2w"`
+
+	// The storage class chunks are moved to
+	To string `long:"to" default:"glacier" description:"the storage class chunks are moved to: standard, standard-ia, glacier-ir, glacier or deep-archive"`
+}
+
+type Tier struct {
+	ui cli.Ui
+}
+
+func NewTier() (cmd cli.Command, err error) {
+	return &Tier{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Tier) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &TierOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Moves the chunks that only old tags reference to a cheaper storage class
+  of the bucket. Chunks in the files of any branch, remote branch or more
+  recent tag stay where they are, fetch first such that the branches of
+  others are known:
+
+    git fetch --all
+    git bits tier --older-than 1y --to glacier
+
+  The storage class of each moved chunk is recorded in the local store and
+  its key is written to stdout. Chunks in glacier or deep-archive must be
+  restored before they can be read: fetching such a chunk requests its
+  restore (for %d days) and fails until it completes, which can take hours.
+  Retry with 'git bits fetch --retry-failed' after.
+
+%s`, cmd.Synopsis(), bits.ThawDays, buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Tier) Synopsis() string {
+	return "move chunks of old tags to cold storage"
+}
+
+// Usage returns a usage description
+func (cmd *Tier) Usage() string {
+	return "git bits tier [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Tier) Run(args []string) int {
+	_, err := flags.ParseArgs(&TierOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	age, err := bits.ParseAge(TierOpts.OlderThan)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	class, err := bits.ParseStorageClass(TierOpts.To)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	report, err := repo.Tier(os.Stdout, age, class, TierOpts.DryRun)
+	if TierOpts.DryRun {
+		cmd.ui.Info(fmt.Sprintf("would move %d chunks of %d tags to %s, %d were moved before", report.Tiered, report.Tags, class, report.Skipped))
+	} else {
+		cmd.ui.Info(fmt.Sprintf("moved %d chunks of %d tags to %s, %d were moved before", report.Tiered, report.Tags, class, report.Skipped))
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to tier chunks: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,110 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var TokenIssueOpts struct {
+	// What the token may be used for
+	Scope string `short:"s" long:"scope" default:"read" description:"what the token allows, 'read' or 'write' (default=read)"`
+}
+
+type TokenIssue struct {
+	ui cli.Ui
+}
+
+func NewTokenIssue() (cmd cli.Command, err error) {
+	return &TokenIssue{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stdout,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *TokenIssue) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &TokenIssueOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Issues a token that the chunk server of this repository ('git bits serve')
+  accepts and writes it to STDOUT. Tokens with the 'read' scope can only
+  fetch chunks, tokens with the 'write' scope can also store them. Only a
+  hash of the token is kept, it can't be shown again. Once any token is
+  issued the server no longer serves chunks to clients without one, peers
+  send theirs when it is configured as 'bits.peer-token'.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *TokenIssue) Synopsis() string {
+	return "issue a token for the chunk server"
+}
+
+// Usage returns a usage description
+func (cmd *TokenIssue) Usage() string {
+	return "git bits token issue [options] <name>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *TokenIssue) Run(args []string) int {
+	args, err := flags.ParseArgs(&TokenIssueOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected the name of the token, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	scope, err := bits.ParseTokenScope(TokenIssueOpts.Scope)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	token, err := repo.IssueToken(args[0], scope)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to issue token: %v", err))
+		return exitCode(err)
+	}
+
+	cmd.ui.Output(token)
+	return 0
+}
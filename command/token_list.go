@@ -0,0 +1,76 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type TokenList struct {
+	ui cli.Ui
+}
+
+func NewTokenList() (cmd cli.Command, err error) {
+	return &TokenList{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stdout,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *TokenList) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Lists the name and scope of each token that the chunk server accepts.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *TokenList) Synopsis() string {
+	return "list the tokens of the chunk server"
+}
+
+// Usage returns a usage description
+func (cmd *TokenList) Usage() string {
+	return "git bits token list"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *TokenList) Run(args []string) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	tokens, err := repo.Tokens()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to list tokens: %v", err))
+		return exitCode(err)
+	}
+
+	for _, t := range tokens {
+		cmd.ui.Output(fmt.Sprintf("%s\t%s", t.Name, t.Scope))
+	}
+
+	return 0
+}
@@ -0,0 +1,79 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type TokenRevoke struct {
+	ui cli.Ui
+}
+
+func NewTokenRevoke() (cmd cli.Command, err error) {
+	return &TokenRevoke{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *TokenRevoke) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Removes the token with the given name, the chunk server stops accepting
+  it right away. Once the last token is revoked chunks can be fetched
+  without one again.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *TokenRevoke) Synopsis() string {
+	return "revoke a token of the chunk server"
+}
+
+// Usage returns a usage description
+func (cmd *TokenRevoke) Usage() string {
+	return "git bits token revoke <name>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *TokenRevoke) Run(args []string) int {
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected the name of the token, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	err = repo.RevokeToken(args[0])
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to revoke token: %v", err))
+		return exitCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,80 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type TokenRotate struct {
+	ui cli.Ui
+}
+
+func NewTokenRotate() (cmd cli.Command, err error) {
+	return &TokenRotate{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stdout,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *TokenRotate) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Replaces the token with the given name by a new one of the same scope and
+  writes it to STDOUT. The chunk server stops accepting the old token right
+  away.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *TokenRotate) Synopsis() string {
+	return "replace a token of the chunk server"
+}
+
+// Usage returns a usage description
+func (cmd *TokenRotate) Usage() string {
+	return "git bits token rotate <name>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *TokenRotate) Run(args []string) int {
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected the name of the token, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	token, err := repo.RotateToken(args[0])
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to rotate token: %v", err))
+		return exitCode(err)
+	}
+
+	cmd.ui.Output(token)
+	return 0
+}
@@ -0,0 +1,136 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var TopOpts struct {
+	// Time between refreshes
+	Interval time.Duration `short:"i" long:"interval" default:"1s" description:"time between refreshes (default=1s)"`
+
+	// Show the transfers once
+	Once bool `long:"once" description:"show the transfers once instead of refreshing until they end"`
+}
+
+type Top struct {
+	ui cli.Ui
+}
+
+func NewTop() (cmd cli.Command, err error) {
+	return &Top{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Top) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &TopOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Attaches to the push, fetch, pull or daemon that runs in the repository
+  and shows its chunk transfers until it ends: the chunk each worker moves
+  and at what rate, how many chunks are queued for a worker, how many were
+  retried (e.g. resumed downloads) and the transfers that completed last.
+  Only one process serves its transfers at a time, the one that started
+  first.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Top) Synopsis() string {
+	return "show the chunk transfers of a running command"
+}
+
+// Usage returns a usage description
+func (cmd *Top) Usage() string {
+	return "git bits top [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Top) Run(args []string) int {
+	_, err := flags.ParseArgs(&TopOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	snap, err := repo.AttachMonitor()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to attach: %v", err))
+		return ExitFailure
+	}
+
+	for {
+		buf := bytes.NewBuffer(nil)
+		if !TopOpts.Once {
+			buf.WriteString("\x1b[H\x1b[2J") //redraw from the top of the screen
+		}
+
+		err = bits.WriteMonitor(buf, snap)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to show transfers: %v", err))
+			return ExitFailure
+		}
+
+		os.Stdout.Write(buf.Bytes())
+		if TopOpts.Once {
+			return 0
+		}
+
+		time.Sleep(TopOpts.Interval)
+		snap, err = repo.AttachMonitor()
+		if err != nil {
+			cmd.ui.Info("transfers ended")
+			return 0
+		}
+	}
+}
+
+//serveMonitor serves the transfers of the repository for 'git bits top'
+//while the command runs, unless another process serves its transfers
+func serveMonitor(repo *bits.Repository) (stop func()) {
+	stop, err := repo.ServeMonitor()
+	if err != nil {
+		return func() {}
+	}
+
+	return stop
+}
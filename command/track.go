@@ -0,0 +1,124 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var TrackOpts struct {
+	// Check the staged files instead of adding patterns
+	Auto bool `long:"auto" description:"check for staged files larger than 'bits.auto-track-size' that are not split"`
+
+	// Add patterns for the files that are found
+	Add bool `long:"add" description:"with --auto, add patterns for the files that are found instead of warning about them"`
+}
+
+type Track struct {
+	ui cli.Ui
+}
+
+func NewTrack() (cmd cli.Command, err error) {
+	return &Track{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Track) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &TrackOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Adds each pattern to .gitattributes such that matching files are split
+  by git-bits, e.g. 'git bits track "*.iso"'.
+
+  With --auto it checks the staged files instead: files larger than
+  'bits.auto-track-size' (e.g. 100MB) that no pattern splits are reported,
+  such that they are not accidentally committed to git as a whole. When
+  'bits.auto-track' is set to 'add' or with --add a pattern for their
+  extension (or path) is added instead and they are staged again. The
+  pre-commit hook that 'git bits install' writes runs this before each
+  commit, it does nothing if no size is configured.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Track) Synopsis() string {
+	return "split files that match patterns or are large"
+}
+
+// Usage returns a usage description
+func (cmd *Track) Usage() string {
+	return "git bits track [options] [<pattern>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Track) Run(args []string) int {
+	args, err := flags.ParseArgs(&TrackOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if !TrackOpts.Auto && len(args) == 0 {
+		cmd.ui.Error(fmt.Sprintf("expected one or more patterns or --auto, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	if TrackOpts.Auto {
+		_, err = repo.AutoTrack(os.Stderr, TrackOpts.Add)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to check staged files: %v", err))
+			return exitCode(err)
+		}
+
+		return 0
+	}
+
+	added, err := repo.Track(args...)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to track patterns: %v", err))
+		return exitCode(err)
+	}
+
+	for _, pattern := range added {
+		cmd.ui.Info(fmt.Sprintf("tracking '%s' with git-bits", pattern))
+	}
+
+	return 0
+}
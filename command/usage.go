@@ -0,0 +1,144 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var UsageOpts struct {
+	// Format the usage is written in
+	Format string `short:"f" long:"format" default:"text" choice:"text" choice:"json" description:"format the usage is written to stdout in"`
+}
+
+type Usage struct {
+	ui cli.Ui
+}
+
+func NewUsage() (cmd cli.Command, err error) {
+	return &Usage{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Usage) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &UsageOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Writes to stdout how many bytes and chunks this clone uploaded to and
+  downloaded from each remote since it started counting, e.g. to attribute
+  the egress costs of a bucket to repositories or to decide where a caching
+  proxy pays off. Remotes are named by what they point to (e.g. the bucket)
+  rather than by the git remote, chunks that were fetched from peers on the
+  local network are counted as "%s". The totals are kept in the local
+  store of the clone and are only counted for transfers that completed.
+
+%s`, cmd.Synopsis(), bits.PeerUsageName, buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Usage) Synopsis() string {
+	return "show the bytes transferred per remote"
+}
+
+// Usage returns a usage description
+func (cmd *Usage) Usage() string {
+	return "git bits usage [options]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Usage) Run(args []string) int {
+	args, err := flags.ParseArgs(&UsageOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) > 0 {
+		cmd.ui.Error(fmt.Sprintf("unexpected arguments, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	usage, err := repo.Usage()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to read usage: %v", err))
+		return exitCode(err)
+	}
+
+	if UsageOpts.Format == "json" {
+		if usage == nil {
+			usage = []bits.RemoteUsage{}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(usage)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to write usage: %v", err))
+			return ExitFailure
+		}
+
+		return 0
+	}
+
+	if len(usage) == 0 {
+		cmd.ui.Info("no chunks were transferred yet")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REMOTE\tUPLOADED\tDOWNLOADED\tSINCE\tLAST")
+	for _, u := range usage {
+		fmt.Fprintf(tw, "%s\t%s (%d chunks)\t%s (%d chunks)\t%s\t%s\n",
+			u.Remote,
+			humanize.Bytes(uint64(u.UploadedBytes)), u.UploadedChunks,
+			humanize.Bytes(uint64(u.DownloadedBytes)), u.DownloadedChunks,
+			u.Since.Local().Format("2006-01-02"), humanize.Time(u.Last))
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to write usage: %v", err))
+		return ExitFailure
+	}
+
+	return 0
+}
@@ -0,0 +1,153 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var VerifyManifestOpts struct {
+	// File with the keys that may sign manifests
+	AllowedSigners string `long:"allowed-signers" description:"ssh allowed signers file (default=git config gpg.ssh.allowedSignersFile)"`
+
+	// Who signed the manifest
+	Identity string `short:"i" long:"identity" description:"principal in the allowed signers file that must have signed the manifest" required:"true"`
+
+	// File with the signature
+	Signature string `short:"s" long:"signature" description:"file with the signature of the manifest (default=<manifest>.sig)"`
+}
+
+type VerifyManifest struct {
+	ui cli.Ui
+}
+
+func NewVerifyManifest() (cmd cli.Command, err error) {
+	return &VerifyManifest{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *VerifyManifest) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &VerifyManifestOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Proves the dataset in this clone matches a release manifest that was
+  written with 'git bits manifest'. The signature must be made by the
+  given identity according to the ssh allowed signers file, the tag of the
+  manifest must point to the listed commit and its split files must consist
+  of exactly the listed chunks. Each chunk must be stored locally with the
+  listed size and content that hashes to its key, pull the tag first.
+
+  Mismatches are written to stdout and exit with the verification exit code
+  (5), chunks that are only missing exit with the missing chunk code (4).
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *VerifyManifest) Synopsis() string {
+	return "prove the local dataset matches a manifest"
+}
+
+// Usage returns a usage description
+func (cmd *VerifyManifest) Usage() string {
+	return "git bits verify-manifest [options] <manifest>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *VerifyManifest) Run(args []string) int {
+	args, err := flags.ParseArgs(&VerifyManifestOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a single manifest, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	signers := VerifyManifestOpts.AllowedSigners
+	if signers == "" {
+		signers = gitConfig(repo, "gpg.ssh.allowedSignersFile")
+	}
+
+	if signers == "" {
+		cmd.ui.Error("no allowed signers to verify the manifest with, provide them with --allowed-signers or configure git's gpg.ssh.allowedSignersFile")
+		return ExitConfig
+	}
+
+	sigp := VerifyManifestOpts.Signature
+	if sigp == "" {
+		sigp = args[0] + bits.ManifestSignatureSuffix
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to read manifest: %v", err))
+		return ExitFailure
+	}
+
+	sig, err := ioutil.ReadFile(sigp)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to read signature: %v", err))
+		return ExitFailure
+	}
+
+	err = bits.VerifyManifestSignature(data, sig, signers, VerifyManifestOpts.Identity)
+	if err != nil {
+		cmd.ui.Error(err.Error())
+		return exitCode(err)
+	}
+
+	m, err := bits.ReadManifest(bytes.NewReader(data))
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("invalid manifest: %v", err))
+		return ExitVerification
+	}
+
+	err = repo.VerifyManifest(m, os.Stdout)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("dataset doesn't match the manifest: %v", err))
+		return exitCode(err)
+	}
+
+	cmd.ui.Info(fmt.Sprintf("dataset matches the manifest of '%s' signed by '%s': %d chunks", m.Tag, VerifyManifestOpts.Identity, len(m.Chunks)))
+	return 0
+}
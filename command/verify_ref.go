@@ -0,0 +1,115 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var VerifyRefOpts struct {
+	// List the missing chunks
+	Keys bool `long:"keys" description:"also write the keys of the missing chunks to stdout"`
+}
+
+type VerifyRef struct {
+	ui cli.Ui
+}
+
+func NewVerifyRef() (cmd cli.Command, err error) {
+	return &VerifyRef{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *VerifyRef) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &VerifyRefOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Checks that every split file in the tree of <ref> (HEAD by default) can
+  be reconstructed: that each of its chunks is stored locally or remotely.
+  Only the existence of chunks is checked, nothing is downloaded, such that
+  it is fast enough to run in CI on every merge. Files of which chunks are
+  missing are written to stdout and the command exits with the missing
+  chunk exit code (4).
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *VerifyRef) Synopsis() string {
+	return "check that the split files of a ref are complete"
+}
+
+// Usage returns a usage description
+func (cmd *VerifyRef) Usage() string {
+	return "git bits verify-ref [options] [<ref>]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *VerifyRef) Run(args []string) int {
+	args, err := flags.ParseArgs(&VerifyRefOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return ExitUsage
+	}
+
+	if len(args) > 1 {
+		cmd.ui.Error(fmt.Sprintf("expected at most one ref, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	ref := "HEAD"
+	if len(args) == 1 {
+		ref = args[0]
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return ExitFailure
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return exitCode(err)
+	}
+
+	report, err := repo.VerifyRef(ref, os.Stdout)
+	if VerifyRefOpts.Keys {
+		for _, k := range report.Missing {
+			fmt.Fprintf(os.Stdout, "%x\n", k)
+		}
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to verify '%s': %v", ref, err))
+		return exitCode(err)
+	}
+
+	cmd.ui.Info(fmt.Sprintf("all %d files in '%s' can be reconstructed: %d chunks, %d local, %d remote", report.Files, ref, report.Chunks, report.Local, report.Remote))
+	return 0
+}
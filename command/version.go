@@ -0,0 +1,97 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+//BuildInfo describes the build of git-bits, release builds set it through
+//ldflags (see make.sh)
+type BuildInfo struct {
+	Version string
+	Commit  string
+	Date    string
+}
+
+//Build is the build of the running binary, it is set by main
+var Build = BuildInfo{Version: "dev", Commit: "unknown", Date: "unknown"}
+
+//String describes the build and what it supports such that it can be
+//included in support tickets as is
+func (b BuildInfo) String() string {
+	hashes := []string{}
+	for _, h := range bits.KeyHashes() {
+		hashes = append(hashes, h.String())
+	}
+
+	lines := []string{
+		fmt.Sprintf("git-bits %s", b.Version),
+		fmt.Sprintf("commit:     %s", b.Commit),
+		fmt.Sprintf("built:      %s", b.Date),
+		fmt.Sprintf("go:         %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH),
+		fmt.Sprintf("pointers:   versions 0-%d", bits.PointerVersionKeyHash),
+		fmt.Sprintf("key hashes: %s", strings.Join(hashes, ", ")),
+		fmt.Sprintf("backends:   %s", strings.Join(bits.RemoteBackends, ", ")),
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+type Version struct {
+	ui cli.Ui
+}
+
+func NewVersion() (cmd cli.Command, err error) {
+	return &Version{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Version) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Writes the version, the commit and date it was built from, the pointer
+  format versions it reads and the remote backends it supports to stdout.
+  'git bits --version' writes the same. Please include it when reporting
+  an issue.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Version) Synopsis() string {
+	return "show the version and build information"
+}
+
+// Usage returns a usage description
+func (cmd *Version) Usage() string {
+	return "git bits version"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Version) Run(args []string) int {
+	if len(args) > 0 {
+		cmd.ui.Error(fmt.Sprintf("expected no arguments, usage: %s", cmd.Usage()))
+		return ExitUsage
+	}
+
+	fmt.Fprintln(os.Stdout, Build)
+	return 0
+}
@@ -9,25 +9,97 @@ import (
 	"github.com/nerdalize/git-bits/command"
 )
 
+//version, commit and date are set through ldflags by make.sh
 var (
 	name    = "git-bits"
-	version = "0.0.0"
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
 )
 
 func main() {
-	c := cli.NewCLI(name, version)
-	c.Args = os.Args[1:]
+	command.Build = command.BuildInfo{Version: version, Commit: commit, Date: date}
+	c := cli.NewCLI(name, command.Build.String())
+	args, stopProfiling, err := command.StartProfiling(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(command.ExitUsage)
+	}
+
+	c.Args = args
 	c.Commands = map[string]cli.CommandFactory{
-		"scan":    command.NewScan,
-		"split":   command.NewSplit,
-		"install": command.NewInstall,
-		"fetch":   command.NewFetch,
-		"pull":    command.NewPull,
-		"push":    command.NewPush,
-		"combine": command.NewCombine,
+		"scan":            command.NewScan,
+		"split":           command.NewSplit,
+		"install":         command.NewInstall,
+		"init":            command.NewInit,
+		"fetch":           command.NewFetch,
+		"pull":            command.NewPull,
+		"publish":         command.NewPublish,
+		"push":            command.NewPush,
+		"combine":         command.NewCombine,
+		"filter-process":  command.NewFilterProcess,
+		"cat":             command.NewCat,
+		"merge-driver":    command.NewMergeDriver,
+		"diff-driver":     command.NewDiffDriver,
+		"archive":         command.NewArchive,
+		"prefetch":        command.NewPrefetch,
+		"daemon":          command.NewDaemon,
+		"serve":           command.NewServe,
+		"serve-grpc":      command.NewServeGRPC,
+		"token issue":     command.NewTokenIssue,
+		"token rotate":    command.NewTokenRotate,
+		"token revoke":    command.NewTokenRevoke,
+		"token list":      command.NewTokenList,
+		"mount":           command.NewMount,
+		"check-remote":    command.NewCheckRemote,
+		"copy":            command.NewCopy,
+		"reshard":         command.NewReshard,
+		"gc":              command.NewGC,
+		"fsck":            command.NewFsck,
+		"index export":    command.NewIndexExport,
+		"env":             command.NewEnv,
+		"track":           command.NewTrack,
+		"evict":           command.NewEvict,
+		"status":          command.NewStatus,
+		"version":         command.NewVersion,
+		"bench":           command.NewBench,
+		"bench-clone":     command.NewBenchClone,
+		"dedup-report":    command.NewDedupReport,
+		"get":             command.NewGet,
+		"gateway":         command.NewGateway,
+		"verify-ref":      command.NewVerifyRef,
+		"ci-check":        command.NewCICheck,
+		"manifest":        command.NewManifest,
+		"verify-manifest": command.NewVerifyManifest,
+		"usage":           command.NewUsage,
+		"prune-local":     command.NewPruneLocal,
+		"ingest":          command.NewIngest,
+		"prune-remote":    command.NewPruneRemote,
+		"tier":            command.NewTier,
+		"top":             command.NewTop,
+		"doctor":          command.NewDoctor,
+		"check-staged":    command.NewCheckStaged,
+	}
+
+	//the cli writes the version to stderr and exits with 1
+	if c.IsVersion() {
+		fmt.Fprintln(os.Stdout, command.Build)
+		stopProfiling()
+		os.Exit(command.ExitOK)
+	}
+
+	//hidden commands are meant for developers, they are left out of the help
+	hidden := map[string]bool{"bench": true, "bench-clone": true}
+	visible := []string{}
+	for cmd := range c.Commands {
+		if !hidden[cmd] {
+			visible = append(visible, cmd)
+		}
 	}
 
+	c.HelpFunc = cli.FilteredHelpFunc(visible, cli.BasicHelpFunc(name))
 	status, err := c.Run()
+	stopProfiling()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s: %s", name, err)
 	}
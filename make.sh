@@ -32,12 +32,17 @@ function run_test { #run test suite of itself and its dependencies
 		-var aws_secret_key="${AWS_SECRET_ACCESS_KEY}"
 }
 
+#ldflags records the version, commit and date of a build
+function ldflags {
+	echo "-X main.version=`cat VERSION` -X main.commit=`git rev-parse --short HEAD` -X main.date=`date -u +%Y-%m-%dT%H:%M:%SZ`"
+}
+
 function run_build { #build a development version
-	go build -o $GOPATH/bin/git-bits -ldflags "-X main.version=`cat VERSION`"
+	go build -o $GOPATH/bin/git-bits -ldflags "`ldflags`"
 }
 
 function run_release { #cross compile new release builds
-	gox -ldflags "-X main.version=`cat VERSION`" -osarch="linux/amd64 windows/amd64 darwin/amd64" -output=./bin/{{.OS}}_{{.Arch}}/git-bits
+	gox -ldflags "`ldflags`" -osarch="linux/amd64 windows/amd64 darwin/amd64" -output=./bin/{{.OS}}_{{.Arch}}/git-bits
 }
 
 case $1 in